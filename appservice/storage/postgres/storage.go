@@ -40,6 +40,9 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties) (*Data
 	if result.db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(result.db, "appservice", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	if err = result.prepare(); err != nil {
 		return nil, err
 	}
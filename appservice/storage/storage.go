@@ -19,12 +19,13 @@ package storage
 import (
 	"net/url"
 
+	"github.com/matrix-org/dendrite/appservice/storage/mysql"
 	"github.com/matrix-org/dendrite/appservice/storage/postgres"
 	"github.com/matrix-org/dendrite/appservice/storage/sqlite3"
 	"github.com/matrix-org/dendrite/common"
 )
 
-// NewDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
+// NewDatabase opens a new Postgres, MySQL or Sqlite database (based on dataSourceName scheme)
 // and sets DB connection parameters
 func NewDatabase(dataSourceName string, dbProperties common.DbProperties) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
@@ -32,8 +33,10 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties) (Datab
 		return postgres.NewDatabase(dataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
-	case "postgres":
+	case "postgres", "cockroachdb":
 		return postgres.NewDatabase(dataSourceName, dbProperties)
+	case "mysql":
+		return mysql.NewDatabase(dataSourceName, dbProperties)
 	case "file":
 		return sqlite3.NewDatabase(dataSourceName)
 	default:
@@ -0,0 +1,34 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package authtypes
+
+// EventReport is a user's report of an event to the server admins, e.g.
+// because it is abusive.
+type EventReport struct {
+	ID      int64  `json:"id"`
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+	// The user who reported the event
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	// How offensive the user found the event, from -100 (most offensive) to
+	// 0, or nil if they didn't say
+	Score *int `json:"score,omitempty"`
+	// When the event was reported, as a unix timestamp (ms resolution)
+	ReceivedTS int64 `json:"received_ts"`
+	// The admin who resolved the report and when, as a unix timestamp (ms
+	// resolution), if it has been resolved
+	ResolvedBy string `json:"resolved_by,omitempty"`
+	ResolvedTS int64  `json:"resolved_ts,omitempty"`
+}
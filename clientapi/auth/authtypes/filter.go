@@ -0,0 +1,26 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// LegacyFilter is a filter which was stored in the accounts database before
+// filters were moved to the sync API database.
+type LegacyFilter struct {
+	// The ID that the filter was given when it was uploaded.
+	ID int64
+	// The localpart of the user who uploaded the filter.
+	Localpart string
+	// The filter as canonical JSON.
+	Filter []byte
+}
@@ -6,7 +6,16 @@ type LoginType string
 // The relevant login types implemented in Dendrite
 const (
 	LoginTypeDummy              = "m.login.dummy"
+	LoginTypePassword           = "m.login.password"
+	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeMSISDN             = "m.login.msisdn"
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeSSO                = "m.login.sso"
+	LoginTypeCAS                = "m.login.cas"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeJWT                = "org.matrix.login.jwt"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
+	LoginTypeTerms              = "m.login.terms"
 )
@@ -0,0 +1,52 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// Pusher represents a push gateway that notifications for a user's events
+// are sent to, as configured by one of their clients.
+type Pusher struct {
+	PushKey           string                 `json:"pushkey"`
+	Kind              string                 `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag,omitempty"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+	// When the push key was last set, as a unix timestamp (ms resolution).
+	PushKeyTS int64 `json:"-"`
+}
+
+// NotificationCounts are how many events in a room a user has been notified
+// about since they last read it, and how many of those were highlighted.
+type NotificationCounts struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
+// EmailNotification is a notification about an event which is waiting to be
+// emailed to a user who has an email pusher, if they don't read it first.
+type EmailNotification struct {
+	RoomID            string
+	EventID           string
+	Sender            string
+	SenderDisplayName string
+	RoomName          string
+	// What the event says, e.g. the body of a message
+	Body string
+	// When the user was notified about the event, as a unix timestamp (ms
+	// resolution)
+	NotifiedTS int64
+}
@@ -0,0 +1,38 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// RegistrationToken is a token which allows users to register when the server
+// requires the m.login.registration_token auth stage.
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// How many times the token may be used, or nil if it may be used any
+	// number of times
+	UsesAllowed *int `json:"uses_allowed"`
+	// How many registrations the token has been used for
+	Completed int `json:"completed"`
+	// When the token expires, as a unix timestamp (ms resolution), or nil if
+	// it never does
+	ExpiryTime *int64 `json:"expiry_time"`
+}
+
+// IsValid returns whether the token can still be used to register at the
+// given time, as a unix timestamp (ms resolution).
+func (t *RegistrationToken) IsValid(nowTS int64) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || *t.ExpiryTime > nowTS
+}
@@ -19,3 +19,22 @@ type ThreePID struct {
 	Address string `json:"address"`
 	Medium  string `json:"medium"`
 }
+
+// ThreePIDSession is a session for validating that a user owns a third-party
+// identifier, by sending a token to it which the user then submits back.
+type ThreePIDSession struct {
+	SessionID    string
+	ClientSecret string
+	Medium       string
+	Address      string
+	Token        string
+	SendAttempt  int
+	// The URL which the user is redirected to after validating, if any
+	NextLink string
+	// When the session was created, as a unix timestamp (ms resolution)
+	CreatedTS int64
+	// When the token was submitted, or 0 if it hasn't been yet
+	ValidatedTS int64
+	// How many times a token was submitted before the session was validated
+	SubmitAttempts int
+}
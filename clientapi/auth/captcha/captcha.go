@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package captcha implements verifying the captchas which users solve when
+// registering, using the provider chosen in the config.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// Verifier verifies users' responses to captchas.
+type Verifier interface {
+	// Verify returns whether the response is a valid solution to a captcha.
+	// Returns an error if the provider couldn't be asked.
+	Verify(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+// NewVerifier returns the Verifier for the configured captcha provider.
+func NewVerifier(cfg *config.Dendrite, client *http.Client) Verifier {
+	// reCAPTCHA, hCaptcha and most self-hosted providers implement the same
+	// siteverify API, so only the URL and keys differ between them.
+	return &siteVerifier{
+		url:     cfg.Matrix.RecaptchaSiteVerifyAPI,
+		secret:  cfg.Matrix.RecaptchaPrivateKey,
+		siteKey: cfg.Matrix.RecaptchaPublicKey,
+		client:  client,
+	}
+}
+
+// siteVerifier verifies responses with a siteverify API, which takes the
+// response as a form and returns whether it was successful as JSON. See
+// https://developers.google.com/recaptcha/docs/verify and
+// https://docs.hcaptcha.com/#verify-the-user-response-server-side
+type siteVerifier struct {
+	url     string
+	secret  string
+	siteKey string
+	client  *http.Client
+}
+
+func (v *siteVerifier) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	form := url.Values{
+		"secret":   {v.secret},
+		"response": {response},
+		"remoteip": {remoteIP},
+		"sitekey":  {v.siteKey},
+	}
+	req, err := http.NewRequest(http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha server responded with HTTP %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid response from captcha server: %w", err)
+	}
+	return result.Success, nil
+}
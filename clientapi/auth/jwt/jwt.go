@@ -0,0 +1,192 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwt implements verifying the JSON Web Tokens which users log in with
+// when using the org.matrix.login.jwt login type. Only JWS compact
+// serialisation with the HMAC, RSA PKCS #1 v1.5 and ECDSA algorithms is
+// supported. See https://tools.ietf.org/html/rfc7519
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// Register the hash functions which the algorithms use.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// Claims are the claims in a token's payload.
+type Claims map[string]interface{}
+
+// String returns the value of a string claim, or an empty string if the claim
+// is missing or isn't a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Verifier verifies tokens using the configured algorithm and key.
+type Verifier struct {
+	cfg *config.JWT
+}
+
+// NewVerifier creates a new Verifier.
+func NewVerifier(cfg *config.JWT) *Verifier {
+	return &Verifier{cfg: cfg}
+}
+
+// Verify checks the token's signature, that it is currently valid, and that
+// it was issued by the configured issuer for one of the configured audiences.
+// Returns the token's claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	return v.verify(token, time.Now())
+}
+
+func (v *Verifier) verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// The algorithm must be the configured one, or else a token could be
+	// signed with an HMAC keyed with the public key.
+	if header.Algorithm != v.cfg.Algorithm {
+		return nil, fmt.Errorf("jwt: unexpected algorithm %q", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: malformed signature: %w", err)
+	}
+	if err = v.verifySignature(parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("jwt: token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt: token isn't valid yet")
+	}
+	if v.cfg.Issuer != "" && claims.String("iss") != v.cfg.Issuer {
+		return nil, fmt.Errorf("jwt: unexpected issuer %q", claims.String("iss"))
+	}
+	if !v.validAudience(claims["aud"]) {
+		return nil, errors.New("jwt: unexpected audience")
+	}
+	return claims, nil
+}
+
+// validAudience returns whether the aud claim, which is either a string or an
+// array of strings, includes one of the configured audiences. Tokens which
+// are for specific audiences are rejected if no audiences are configured.
+func (v *Verifier) validAudience(aud interface{}) bool {
+	var audiences []interface{}
+	switch aud := aud.(type) {
+	case nil:
+		return len(v.cfg.Audiences) == 0
+	case string:
+		audiences = []interface{}{aud}
+	case []interface{}:
+		audiences = aud
+	default:
+		return false
+	}
+	for _, a := range audiences {
+		for _, want := range v.cfg.Audiences {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *Verifier) verifySignature(signed string, signature []byte) error {
+	if len(v.cfg.Algorithm) != 5 {
+		return fmt.Errorf("jwt: unsupported algorithm %q", v.cfg.Algorithm)
+	}
+	var hash crypto.Hash
+	switch v.cfg.Algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("jwt: unsupported algorithm %q", v.cfg.Algorithm)
+	}
+	h := hash.New()
+	h.Write([]byte(signed)) // nolint: errcheck
+	digest := h.Sum(nil)
+
+	valid := false
+	switch v.cfg.Algorithm[:2] {
+	case "HS":
+		mac := hmac.New(hash.New, []byte(v.cfg.Secret))
+		mac.Write([]byte(signed)) // nolint: errcheck
+		valid = hmac.Equal(signature, mac.Sum(nil))
+	case "RS":
+		if key, ok := v.cfg.PublicKey.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		}
+	case "ES":
+		// The signature is the concatenation of R and S, each padded to the
+		// size of the curve.
+		if key, ok := v.cfg.PublicKey.(*ecdsa.PublicKey); ok {
+			size := (key.Params().BitSize + 7) / 8
+			if len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				valid = ecdsa.Verify(key, digest, r, s)
+			}
+		}
+	}
+	if !valid {
+		return errors.New("jwt: invalid signature")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("jwt: malformed token: %w", err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("jwt: malformed token: %w", err)
+	}
+	return nil
+}
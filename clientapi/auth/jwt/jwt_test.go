@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, secret string, alg string, claims Claims) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed)) // nolint: errcheck
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHS256(t *testing.T) {
+	v := NewVerifier(&config.JWT{
+		Algorithm: "HS256",
+		Secret:    "secret",
+		Issuer:    "https://idp.example.com",
+		Audiences: []string{"dendrite"},
+	})
+	now := time.Unix(1500000000, 0)
+	valid := Claims{
+		"sub": "alice",
+		"iss": "https://idp.example.com",
+		"aud": []string{"other", "dendrite"},
+		"exp": 1500000060,
+		"nbf": 1499999940,
+	}
+	claims, err := v.verify(signHS256(t, "secret", "HS256", valid), now)
+	if err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if claims.String("sub") != "alice" {
+		t.Errorf("verify: got sub %q, want alice", claims.String("sub"))
+	}
+
+	with := func(name string, value interface{}) Claims {
+		c := Claims{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		c[name] = value
+		return c
+	}
+	for name, token := range map[string]string{
+		"wrong secret":    signHS256(t, "wrong", "HS256", valid),
+		"wrong algorithm": signHS256(t, "secret", "none", valid),
+		"expired":         signHS256(t, "secret", "HS256", with("exp", 1500000000)),
+		"not yet valid":   signHS256(t, "secret", "HS256", with("nbf", 1500000060)),
+		"wrong issuer":    signHS256(t, "secret", "HS256", with("iss", "https://evil.example.com")),
+		"wrong audience":  signHS256(t, "secret", "HS256", with("aud", "other")),
+		"no audience":     signHS256(t, "secret", "HS256", with("aud", nil)),
+		"malformed":       "not.a.token",
+	} {
+		if _, err := v.verify(token, now); err == nil {
+			t.Errorf("verify: expected an error for a token with %s", name)
+		}
+	}
+}
+
+func TestVerifyES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVerifier(&config.JWT{Algorithm: "ES256", PublicKey: key.Public()})
+
+	signed := encodeSegment(t, map[string]string{"alg": "ES256"}) + "." + encodeSegment(t, Claims{"sub": "bob"})
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	if _, err = v.Verify(token); err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	signature[0] ^= 1
+	if _, err = v.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(signature)); err == nil {
+		t.Error("Verify: expected an error for a bad signature")
+	}
+}
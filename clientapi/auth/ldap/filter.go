@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// The context-specific tags of the kinds of search filter.
+// See https://tools.ietf.org/html/rfc4511#section-4.5.1
+const (
+	filterAnd            byte = 0
+	filterOr             byte = 1
+	filterNot            byte = 2
+	filterEqualityMatch  byte = 3
+	filterSubstrings     byte = 4
+	filterGreaterOrEqual byte = 5
+	filterLessOrEqual    byte = 6
+	filterPresent        byte = 7
+	filterApproxMatch    byte = 8
+
+	substringInitial byte = 0
+	substringAny     byte = 1
+	substringFinal   byte = 2
+)
+
+// EscapeFilter escapes the characters which have a special meaning in the
+// values of search filters.
+// See https://tools.ietf.org/html/rfc4515#section-3
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter converts the string representation of a search filter into
+// its BER encoding.
+func compileFilter(filter string) (*packet, error) {
+	p, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", filter, rest)
+	}
+	return p, nil
+}
+
+// parseFilter parses a parenthesised filter from the start of s, returning the
+// rest of s after it.
+func parseFilter(s string) (*packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected '(' at %q", s)
+	}
+	s = s[1:]
+	var p *packet
+	var err error
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := filterAnd
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		p = newConstructed(classContext | tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			var child *packet
+			if child, s, err = parseFilter(s); err != nil {
+				return nil, "", err
+			}
+			p.children = append(p.children, child)
+		}
+	case strings.HasPrefix(s, "!"):
+		var child *packet
+		if child, s, err = parseFilter(s[1:]); err != nil {
+			return nil, "", err
+		}
+		p = newConstructed(classContext|filterNot, child)
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("missing ')'")
+		}
+		if p, err = parseItem(s[:end]); err != nil {
+			return nil, "", err
+		}
+		s = s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("expected ')' at %q", s)
+	}
+	return p, s[1:], nil
+}
+
+// parseItem parses a simple filter, like "uid=alice", without its parentheses.
+func parseItem(item string) (*packet, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("expected an attribute and value in %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := filterEqualityMatch
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApproxMatch, attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("expected an attribute in %q", item)
+	}
+
+	if tag == filterEqualityMatch && value == "*" {
+		return newString(classContext|filterPresent, attr), nil
+	}
+	if tag == filterEqualityMatch && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		substrings := newConstructed(tagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeFilterValue(part)
+			if err != nil {
+				return nil, err
+			}
+			kind := substringAny
+			if i == 0 {
+				kind = substringInitial
+			} else if i == len(parts)-1 {
+				kind = substringFinal
+			}
+			substrings.children = append(substrings.children, newString(classContext|kind, unescaped))
+		}
+		return newConstructed(classContext|filterSubstrings, newString(tagOctetString, attr), substrings), nil
+	}
+	unescaped, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return newConstructed(classContext|tag, newString(tagOctetString, attr), newString(tagOctetString, unescaped)), nil
+}
+
+// unescapeFilterValue replaces the "\xx" escapes in a filter value with the
+// bytes which they represent.
+func unescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("incomplete escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,344 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ldap implements checking users' passwords with an LDAP server, such
+// as OpenLDAP or Active Directory. Only the parts of LDAPv3 which are needed
+// for this are implemented: simple binds, searches and StartTLS.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+var (
+	// ErrUserNotFound is returned when the LDAP server has no user with the
+	// given username.
+	ErrUserNotFound = errors.New("ldap: user not found")
+	// ErrInvalidCredentials is returned when the user's password is wrong.
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+)
+
+// The LDAP operations which are used, which are all application tags.
+// See https://tools.ietf.org/html/rfc4511#section-4.2
+const (
+	opBindRequest       byte = 0
+	opBindResponse      byte = 1
+	opUnbindRequest     byte = 2
+	opSearchRequest     byte = 3
+	opSearchResultEntry byte = 4
+	opSearchResultDone  byte = 5
+	opExtendedRequest   byte = 23
+	opExtendedResponse  byte = 24
+)
+
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+
+	scopeWholeSubtree = 2
+	derefNever        = 0
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	// How long to wait for the LDAP server if the context has no deadline.
+	defaultTimeout = 30 * time.Second
+)
+
+// User is a user whose password has been checked by the LDAP server.
+type User struct {
+	// The distinguished name of the user's entry.
+	DN string
+	// The attributes of the user's entry which were asked for.
+	Attributes map[string][]string
+}
+
+// Attribute returns the first value of the attribute with the given name, or
+// an empty string if the user doesn't have it. Attribute names are not case
+// sensitive.
+func (u *User) Attribute(name string) string {
+	for attr, values := range u.Attributes {
+		if strings.EqualFold(attr, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Authenticator checks users' passwords with an LDAP server.
+type Authenticator struct {
+	cfg *config.LDAP
+}
+
+// NewAuthenticator creates a new Authenticator.
+func NewAuthenticator(cfg *config.LDAP) *Authenticator {
+	return &Authenticator{cfg: cfg}
+}
+
+// Authenticate checks the user's password. The user's entry is looked up by
+// its username attribute, and then the password is checked by binding as it.
+// Returns ErrUserNotFound if there is no such user, ErrInvalidCredentials if
+// the password is wrong, or another error if the server couldn't be used.
+func (a *Authenticator) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	if password == "" {
+		// A simple bind with an empty password is an unauthenticated bind,
+		// which succeeds without checking anything.
+		return nil, ErrInvalidCredentials
+	}
+	c, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if a.cfg.BindDN != "" {
+		if err = c.bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: bind as %q failed: %w", a.cfg.BindDN, err)
+		}
+	}
+	filter := "(" + a.cfg.UsernameAttribute + "=" + EscapeFilter(username) + ")"
+	if a.cfg.Filter != "" {
+		filter = "(&" + filter + a.cfg.Filter + ")"
+	}
+	var attributes []string
+	if a.cfg.DisplayNameAttribute != "" {
+		attributes = append(attributes, a.cfg.DisplayNameAttribute)
+	}
+	users, err := c.search(a.cfg.BaseDN, filter, attributes)
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+	default:
+		return nil, fmt.Errorf("ldap: %d users match %q", len(users), filter)
+	}
+
+	if err = c.bind(users[0].DN, password); err != nil {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+// conn is a connection to an LDAP server.
+type conn struct {
+	net.Conn
+	r         *bufio.Reader
+	messageID int64
+}
+
+// dial connects to the LDAP server, using TLS for ldaps:// URIs or if
+// StartTLS is configured.
+func (a *Authenticator) dial(ctx context.Context) (*conn, error) {
+	u, err := url.Parse(a.cfg.URI)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid URI: %w", err)
+	}
+	host := u.Hostname()
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URI scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	if err = netConn.SetDeadline(deadline); err != nil {
+		netConn.Close() // nolint: errcheck
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if u.Scheme == "ldaps" {
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+	c := &conn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if u.Scheme == "ldap" && a.cfg.StartTLS {
+		if err = c.startTLS(tlsConfig); err != nil {
+			c.Close() // nolint: errcheck
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// send sends a request to the server and returns its message ID.
+func (c *conn) send(op *packet) (int64, error) {
+	c.messageID++
+	msg := newConstructed(tagSequence, newInteger(tagInteger, c.messageID), op)
+	_, err := c.Write(msg.bytes())
+	return c.messageID, err
+}
+
+// receive returns the operation of the next response to the request with the
+// given message ID.
+func (c *conn) receive(messageID int64) (*packet, error) {
+	for {
+		msg, err := readPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence|constructed || len(msg.children) < 2 {
+			return nil, errors.New("ldap: malformed response")
+		}
+		if msg.child(0).int() == messageID {
+			return msg.child(1), nil
+		}
+	}
+}
+
+// roundTrip sends a request and returns the operation of its response, which
+// must be of the given type.
+func (c *conn) roundTrip(op *packet, responseOp byte) (*packet, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if res.tag != classApplication|constructed|responseOp {
+		return nil, fmt.Errorf("ldap: unexpected response type %#x", res.tag)
+	}
+	return res, nil
+}
+
+// result returns an error if the LDAPResult isn't successful.
+func result(res *packet) error {
+	switch code := res.child(0).int(); code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	default:
+		return fmt.Errorf("ldap: result code %d: %s", code, res.child(2).value)
+	}
+}
+
+func (c *conn) startTLS(tlsConfig *tls.Config) error {
+	res, err := c.roundTrip(newConstructed(
+		classApplication|opExtendedRequest,
+		newString(classContext|0, startTLSOID),
+	), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err = result(res); err != nil {
+		return fmt.Errorf("ldap: StartTLS failed: %w", err)
+	}
+	tlsConn := tls.Client(c.Conn, tlsConfig)
+	c.Conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (c *conn) bind(dn, password string) error {
+	res, err := c.roundTrip(newConstructed(
+		classApplication|opBindRequest,
+		newInteger(tagInteger, 3),
+		newString(tagOctetString, dn),
+		newString(classContext|0, password),
+	), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return result(res)
+}
+
+func (c *conn) search(baseDN, filter string, attributes []string) ([]*User, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := newConstructed(tagSequence)
+	for _, attr := range attributes {
+		attrs.children = append(attrs.children, newString(tagOctetString, attr))
+	}
+	id, err := c.send(newConstructed(
+		classApplication|opSearchRequest,
+		newString(tagOctetString, baseDN),
+		newInteger(tagEnumerated, scopeWholeSubtree),
+		newInteger(tagEnumerated, derefNever),
+		// Only two entries are needed to tell that a username is ambiguous.
+		newInteger(tagInteger, 2),
+		newInteger(tagInteger, 0),
+		newBoolean(false),
+		compiled,
+		attrs,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	for {
+		res, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch res.tag {
+		case classApplication | constructed | opSearchResultEntry:
+			user := &User{
+				DN:         string(res.child(0).value),
+				Attributes: make(map[string][]string),
+			}
+			for _, attr := range res.child(1).children {
+				name := string(attr.child(0).value)
+				for _, value := range attr.child(1).children {
+					user.Attributes[name] = append(user.Attributes[name], string(value.value))
+				}
+			}
+			users = append(users, user)
+		case classApplication | constructed | opSearchResultDone:
+			if err = result(res); err != nil {
+				return nil, err
+			}
+			return users, nil
+		default:
+			// Ignore search result references, since referrals aren't followed.
+		}
+	}
+}
+
+// close unbinds and closes the connection.
+func (c *conn) close() {
+	_, _ = c.send(newPrimitive(classApplication|opUnbindRequest, nil))
+	c.Close() // nolint: errcheck
+}
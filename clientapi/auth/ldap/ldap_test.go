@@ -0,0 +1,164 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestCompileFilter(t *testing.T) {
+	got, err := compileFilter("(&(uid=alice\\2a)(objectClass=*))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newConstructed(classContext|filterAnd,
+		newConstructed(classContext|filterEqualityMatch,
+			newString(tagOctetString, "uid"),
+			newString(tagOctetString, "alice*"),
+		),
+		newString(classContext|filterPresent, "objectClass"),
+	)
+	if !bytes.Equal(got.bytes(), want.bytes()) {
+		t.Errorf("compileFilter: got %x, want %x", got.bytes(), want.bytes())
+	}
+
+	for _, filter := range []string{"", "uid=alice", "(uid=alice", "(&(uid=alice)", "(uid=\\zz)"} {
+		if _, err := compileFilter(filter); err == nil {
+			t.Errorf("compileFilter(%q): expected an error", filter)
+		}
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	if got, want := EscapeFilter("a*(b)\\"), "a\\2a\\28b\\29\\5c"; got != want {
+		t.Errorf("EscapeFilter: got %q, want %q", got, want)
+	}
+}
+
+// serveLDAP runs a fake LDAP server which knows a single user, alice, whose
+// password is "secret".
+func serveLDAP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close() // nolint: errcheck
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAPConn(c)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func serveLDAPConn(c net.Conn) {
+	defer c.Close() // nolint: errcheck
+	r := bufio.NewReader(c)
+	reply := func(id *packet, op *packet) {
+		_, _ = c.Write(newConstructed(tagSequence, id, op).bytes())
+	}
+	ldapResult := func(op byte, code int64) *packet {
+		return newConstructed(classApplication|op,
+			newInteger(tagEnumerated, code),
+			newString(tagOctetString, ""),
+			newString(tagOctetString, ""),
+		)
+	}
+	for {
+		msg, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		id, op := msg.child(0), msg.child(1)
+		switch op.tag &^ (classApplication | constructed) {
+		case opBindRequest:
+			dn, password := string(op.child(1).value), string(op.child(2).value)
+			code := int64(resultInvalidCredentials)
+			if (dn == "cn=admin,dc=example,dc=com" && password == "admin") ||
+				(dn == "uid=alice,dc=example,dc=com" && password == "secret") {
+				code = resultSuccess
+			}
+			reply(id, ldapResult(opBindResponse, code))
+		case opSearchRequest:
+			// The filter is (uid=...), optionally and-ed with another.
+			filter := op.child(6)
+			if filter.tag == classContext|constructed|filterAnd {
+				filter = filter.child(0)
+			}
+			if string(filter.child(1).value) == "alice" {
+				reply(id, newConstructed(classApplication|opSearchResultEntry,
+					newString(tagOctetString, "uid=alice,dc=example,dc=com"),
+					newConstructed(tagSequence,
+						newConstructed(tagSequence,
+							newString(tagOctetString, "cn"),
+							newConstructed(tagSet, newString(tagOctetString, "Alice")),
+						),
+					),
+				))
+			}
+			reply(id, ldapResult(opSearchResultDone, resultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := NewAuthenticator(&config.LDAP{
+		Enabled:              true,
+		URI:                  serveLDAP(t),
+		BindDN:               "cn=admin,dc=example,dc=com",
+		BindPassword:         "admin",
+		BaseDN:               "dc=example,dc=com",
+		UsernameAttribute:    "uid",
+		Filter:               "(objectClass=person)",
+		DisplayNameAttribute: "cn",
+	})
+	ctx := context.Background()
+
+	user, err := a.Authenticate(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if user.DN != "uid=alice,dc=example,dc=com" {
+		t.Errorf("Authenticate: got DN %q", user.DN)
+	}
+	if got := user.Attribute("CN"); got != "Alice" {
+		t.Errorf("Authenticate: got display name %q, want Alice", got)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		want               error
+	}{
+		{"alice", "wrong", ErrInvalidCredentials},
+		{"alice", "", ErrInvalidCredentials},
+		{"bob", "secret", ErrUserNotFound},
+	} {
+		if _, err := a.Authenticate(ctx, tc.username, tc.password); err != tc.want {
+			t.Errorf("Authenticate(%q, %q): got %v, want %v", tc.username, tc.password, err, tc.want)
+		}
+	}
+}
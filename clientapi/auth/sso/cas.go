@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// CASTicketPath is the path of the endpoint which the CAS server redirects
+// users back to, with a ticket, after they have signed on.
+const CASTicketPath = "/_matrix/client/r0/login/cas/ticket"
+
+// CASProvider is a Central Authentication Service server.
+// See https://apereo.github.io/cas/6.1.x/protocol/CAS-Protocol-Specification.html
+type CASProvider struct {
+	cfg    *config.CAS
+	client *http.Client
+}
+
+// casServiceResponse is the response to a request to validate a ticket.
+type casServiceResponse struct {
+	Success *struct {
+		User       string `xml:"user"`
+		Attributes struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
+// NewCASProvider creates a new CASProvider.
+func NewCASProvider(cfg *config.CAS, client *http.Client) *CASProvider {
+	return &CASProvider{cfg: cfg, client: client}
+}
+
+// ServiceURL returns the URL which the CAS server redirects users back to
+// after they have signed on, which sends them on to the client's redirect URL.
+func (p *CASProvider) ServiceURL(redirectURL string) string {
+	return strings.TrimSuffix(p.cfg.PublicBaseURL, "/") + CASTicketPath +
+		"?redirectUrl=" + url.QueryEscape(redirectURL)
+}
+
+// LoginURL returns the URL at the CAS server which users are sent to in order
+// to sign on.
+func (p *CASProvider) LoginURL(redirectURL string) string {
+	return strings.TrimSuffix(p.cfg.ServerURL, "/") + "/login?service=" +
+		url.QueryEscape(p.ServiceURL(redirectURL))
+}
+
+// ValidateTicket checks the ticket which the CAS server passed back with the
+// CAS server, and returns the identity of the user who it was issued to.
+// Their attributes, if the server releases any, are returned as claims.
+func (p *CASProvider) ValidateTicket(
+	ctx context.Context, ticket, redirectURL string,
+) (*Identity, error) {
+	validateURL := strings.TrimSuffix(p.cfg.ServerURL, "/") + "/p3/serviceValidate?" + url.Values{
+		"ticket":  {ticket},
+		"service": {p.ServiceURL(redirectURL)},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodGet, validateURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ticket validation request failed: HTTP %d", res.StatusCode)
+	}
+	var response casServiceResponse
+	if err = xml.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid ticket validation response: %w", err)
+	}
+	if response.Failure != nil {
+		return nil, fmt.Errorf(
+			"ticket validation failed: %s: %s", response.Failure.Code, strings.TrimSpace(response.Failure.Message),
+		)
+	}
+	if response.Success == nil || strings.TrimSpace(response.Success.User) == "" {
+		return nil, fmt.Errorf("ticket validation response has no user")
+	}
+
+	identity := &Identity{
+		Issuer:  p.cfg.ServerURL,
+		Subject: strings.TrimSpace(response.Success.User),
+		Claims:  make(map[string]interface{}),
+	}
+	for _, attr := range response.Success.Attributes.Values {
+		// Only the first value of attributes with several values is kept.
+		if _, ok := identity.Claims[attr.XMLName.Local]; !ok {
+			identity.Claims[attr.XMLName.Local] = strings.TrimSpace(attr.Value)
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+const casSuccessResponse = `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationSuccess>
+		<cas:user>alice</cas:user>
+		<cas:attributes>
+			<cas:displayName>Alice Liddell</cas:displayName>
+			<cas:memberOf>staff</cas:memberOf>
+			<cas:memberOf>wonderland</cas:memberOf>
+		</cas:attributes>
+	</cas:authenticationSuccess>
+</cas:serviceResponse>`
+
+const casFailureResponse = `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+	<cas:authenticationFailure code="INVALID_TICKET">Ticket ST-2 not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`
+
+func TestCASProvider(t *testing.T) {
+	var provider *CASProvider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/cas/p3/serviceValidate" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.URL.Query().Get("service") != provider.ServiceURL("https://app.example.com/") {
+			t.Errorf("got service %q", req.URL.Query().Get("service"))
+		}
+		response := casFailureResponse
+		if req.URL.Query().Get("ticket") == "ST-1" {
+			response = casSuccessResponse
+		}
+		if _, err := w.Write([]byte(response)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer srv.Close()
+	provider = NewCASProvider(&config.CAS{
+		ServerURL:     srv.URL + "/cas",
+		PublicBaseURL: "https://matrix.example.com",
+	}, srv.Client())
+
+	wantLoginURL := srv.URL + "/cas/login?service=https%3A%2F%2Fmatrix.example.com%2F_matrix%2Fclient%2Fr0%2Flogin%2Fcas%2Fticket%3FredirectUrl%3Dhttps%253A%252F%252Fapp.example.com%252F"
+	if got := provider.LoginURL("https://app.example.com/"); got != wantLoginURL {
+		t.Errorf("got login URL %q, want %q", got, wantLoginURL)
+	}
+
+	identity, err := provider.ValidateTicket(context.Background(), "ST-1", "https://app.example.com/")
+	if err != nil {
+		t.Fatalf("ValidateTicket failed: %s", err)
+	}
+	if identity.Subject != "alice" {
+		t.Errorf("got subject %q, want alice", identity.Subject)
+	}
+	if got := identity.Claim("displayName"); got != "Alice Liddell" {
+		t.Errorf("got displayName %q, want Alice Liddell", got)
+	}
+	if got := identity.Claim("memberOf"); got != "staff" {
+		t.Errorf("got memberOf %q, want staff", got)
+	}
+
+	if _, err = provider.ValidateTicket(context.Background(), "ST-2", "https://app.example.com/"); err == nil {
+		t.Errorf("ValidateTicket succeeded with an invalid ticket")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements single sign-on with an OpenID Connect identity
+// provider, using the authorization code flow.
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// CallbackPath is the path of the endpoint which the identity provider
+// redirects users back to after they have signed on.
+const CallbackPath = "/_matrix/client/r0/login/sso/callback"
+
+// Provider is an OpenID Connect identity provider.
+type Provider struct {
+	cfg    *config.OpenIDConnect
+	client *http.Client
+
+	// The provider's configuration, which is discovered when it is first needed.
+	discoveryMu sync.Mutex
+	discovery   *discoveryDocument
+}
+
+// discoveryDocument is the part of the provider's configuration which is used
+// by the authorization code flow.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// Identity is a user's identity at the identity provider.
+type Identity struct {
+	// The issuer and the subject together identify the user.
+	Issuer  string
+	Subject string
+	// The claims about the user from the userinfo endpoint.
+	Claims map[string]interface{}
+}
+
+// Claim returns the value of a claim about the user if it is a string, or an
+// empty string otherwise.
+func (i *Identity) Claim(name string) string {
+	value, _ := i.Claims[name].(string)
+	return value
+}
+
+// NewProvider creates a new Provider. The configuration of the identity
+// provider is fetched when it is first needed.
+func NewProvider(cfg *config.OpenIDConnect, client *http.Client) *Provider {
+	return &Provider{cfg: cfg, client: client}
+}
+
+// CallbackURL returns the URL which the identity provider redirects users
+// back to after they have signed on.
+func (p *Provider) CallbackURL() string {
+	return strings.TrimSuffix(p.cfg.PublicBaseURL, "/") + CallbackPath
+}
+
+// AuthorizationURL returns the URL at the identity provider which users are
+// sent to in order to sign on. The state is passed back to the callback.
+func (p *Provider) AuthorizationURL(ctx context.Context, state string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", p.CallbackURL())
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// Exchange exchanges the authorization code which was passed to the callback
+// for an access token, and uses it to look up the user's identity.
+//
+// The user's identity is taken from the userinfo endpoint rather than from the
+// ID token. Both the token and userinfo endpoints are requested directly from
+// the identity provider, so the ID token's signature doesn't need to be checked.
+func (p *Provider) Exchange(ctx context.Context, code string) (*Identity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.CallbackURL())
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// https://tools.ietf.org/html/rfc6749#section-2.3.1 requires the client ID
+	// and secret to be form-encoded before they are used for basic auth.
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err = p.doJSON(ctx, req, &token); err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "bearer") {
+		return nil, fmt.Errorf("token response has no bearer token")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var claims map[string]interface{}
+	if err = p.doJSON(ctx, req, &claims); err != nil {
+		return nil, fmt.Errorf("userinfo request failed: %w", err)
+	}
+	identity := &Identity{
+		Issuer: discovery.Issuer,
+		Claims: claims,
+	}
+	if identity.Subject = identity.Claim("sub"); identity.Subject == "" {
+		return nil, fmt.Errorf("userinfo response has no subject")
+	}
+	return identity, nil
+}
+
+// discover fetches the identity provider's configuration, or returns it if it
+// has already been fetched.
+// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.discoveryMu.Lock()
+	defer p.discoveryMu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	req, err := http.NewRequest(http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery discoveryDocument
+	if err = p.doJSON(ctx, req, &discovery); err != nil {
+		return nil, fmt.Errorf("discovery request failed: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovered issuer %q doesn't match configured issuer %q", discovery.Issuer, p.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("identity provider doesn't support the authorization code flow")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *Provider) doJSON(ctx context.Context, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, body)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// newTestIdentityProvider starts an identity provider which issues the access
+// token "opensesame" for the code "letmein".
+func newTestIdentityProvider(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		clientID, clientSecret, ok := req.BasicAuth()
+		if !ok || clientID != "dendrite" || clientSecret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.PostFormValue("code") != "letmein" || req.PostFormValue("redirect_uri") != "https://matrix.example.com"+CallbackPath {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"access_token": "opensesame", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer opensesame" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]string{"sub": "1234", "preferred_username": "Alice"})
+	})
+	return srv
+}
+
+func TestProvider(t *testing.T) {
+	srv := newTestIdentityProvider(t)
+	defer srv.Close()
+	provider := NewProvider(&config.OpenIDConnect{
+		Issuer:        srv.URL,
+		ClientID:      "dendrite",
+		ClientSecret:  "s3cr3t",
+		PublicBaseURL: "https://matrix.example.com/",
+		Scopes:        []string{"openid", "profile"},
+	}, srv.Client())
+	ctx := context.Background()
+
+	authURL, err := provider.AuthorizationURL(ctx, "xyz")
+	if err != nil {
+		t.Fatalf("AuthorizationURL failed: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("AuthorizationURL returned an invalid URL: %s", err)
+	}
+	if got, want := u.Path, "/authorize"; got != want {
+		t.Errorf("got authorization path %q, want %q", got, want)
+	}
+	for param, want := range map[string]string{
+		"response_type": "code",
+		"client_id":     "dendrite",
+		"scope":         "openid profile",
+		"state":         "xyz",
+		"redirect_uri":  "https://matrix.example.com" + CallbackPath,
+	} {
+		if got := u.Query().Get(param); got != want {
+			t.Errorf("got %s %q, want %q", param, got, want)
+		}
+	}
+
+	identity, err := provider.Exchange(ctx, "letmein")
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err)
+	}
+	if identity.Issuer != srv.URL || identity.Subject != "1234" {
+		t.Errorf("got identity %s %s, want %s 1234", identity.Issuer, identity.Subject, srv.URL)
+	}
+	if got := identity.Claim("preferred_username"); got != "Alice" {
+		t.Errorf("got preferred_username %q, want Alice", got)
+	}
+
+	if _, err = provider.Exchange(ctx, "wrongcode"); err == nil {
+		t.Errorf("Exchange succeeded with the wrong code")
+	}
+}
@@ -26,6 +26,7 @@ import (
 type Database interface {
 	common.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*authtypes.Account, error)
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
@@ -43,10 +44,36 @@ type Database interface {
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
-	GetFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
-	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
+	GetLocalpartForSSOIdentity(ctx context.Context, issuer, subject string) (localpart string, err error)
+	SaveSSOIdentity(ctx context.Context, issuer, subject, localpart string) error
+	CreateThreePIDSession(ctx context.Context, session *authtypes.ThreePIDSession) error
+	GetThreePIDSession(ctx context.Context, sessionID string) (*authtypes.ThreePIDSession, error)
+	GetThreePIDSessionBySecret(ctx context.Context, clientSecret, medium, address string) (*authtypes.ThreePIDSession, error)
+	UpdateThreePIDSessionSendAttempt(ctx context.Context, sessionID string, sendAttempt int) error
+	ValidateThreePIDSession(ctx context.Context, sessionID string, validatedTS int64) error
+	UseThreePIDSessionSubmitAttempt(ctx context.Context, sessionID string, maxAttempts int) (bool, error)
+	RemoveThreePIDSession(ctx context.Context, sessionID string) error
+	RemoveExpiredThreePIDSessions(ctx context.Context, createdBeforeTS int64) error
+	CreateRegistrationToken(ctx context.Context, token *authtypes.RegistrationToken) error
+	GetRegistrationToken(ctx context.Context, token string) (*authtypes.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error)
+	RemoveRegistrationToken(ctx context.Context, token string) error
+	UseRegistrationToken(ctx context.Context, token string, nowTS int64) (bool, error)
+	ReleaseRegistrationToken(ctx context.Context, token string) error
+	GetTermsConsent(ctx context.Context, localpart string) (string, error)
+	SetTermsConsent(ctx context.Context, localpart, version string, consentedTS int64) error
+	GetLoginFailures(ctx context.Context, kind, subject string) (failures int, lastFailureTS int64, err error)
+	RecordLoginFailure(ctx context.Context, kind, subject string, failureTS, resetBeforeTS int64) error
+	ReleaseLoginFailure(ctx context.Context, kind, subject string) error
+	ClearLoginFailures(ctx context.Context, kind, subject string) error
+	CreateEventReport(ctx context.Context, report *authtypes.EventReport) (int64, error)
+	GetEventReport(ctx context.Context, id int64) (*authtypes.EventReport, error)
+	GetEventReports(ctx context.Context, includeResolved bool, beforeID int64, limit int) ([]authtypes.EventReport, error)
+	ResolveEventReport(ctx context.Context, id int64, resolvedBy string, resolvedTS int64) (bool, error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*authtypes.Account, error)
+	GetLegacyFilters(ctx context.Context) ([]authtypes.LegacyFilter, error)
+	RemoveLegacyFilters(ctx context.Context) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+// Filters used to be stored in the account_filter table, before they were
+// moved to the sync API database. The table only exists in databases created
+// before then, so these statements aren't prepared along with the others.
+
+const selectLegacyFilterTableSQL = "" +
+	"SELECT COUNT(*) FROM information_schema.tables" +
+	" WHERE table_schema = DATABASE() AND table_name = 'account_filter'"
+
+const selectLegacyFiltersSQL = "" +
+	"SELECT id, localpart, filter FROM account_filter ORDER BY id ASC"
+
+const dropLegacyFilterTableSQL = "" +
+	"DROP TABLE IF EXISTS account_filter"
+
+// GetLegacyFilters returns the filters which were stored in the accounts
+// database before filters were moved to the sync API database, or none if
+// the database was created after they were moved.
+func (d *Database) GetLegacyFilters(ctx context.Context) ([]authtypes.LegacyFilter, error) {
+	var count int
+	if err := d.db.QueryRowContext(ctx, selectLegacyFilterTableSQL).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	rows, err := d.db.QueryContext(ctx, selectLegacyFiltersSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "GetLegacyFilters: rows.close() failed")
+	var filters []authtypes.LegacyFilter
+	for rows.Next() {
+		var filter authtypes.LegacyFilter
+		if err = rows.Scan(&filter.ID, &filter.Localpart, &filter.Filter); err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, rows.Err()
+}
+
+// RemoveLegacyFilters removes the filters which were stored in the accounts
+// database, once they have been moved to the sync API database.
+func (d *Database) RemoveLegacyFilters(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, dropLegacyFilterTableSQL)
+	return err
+}
@@ -0,0 +1,655 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Database represents an account database
+type Database struct {
+	db *sql.DB
+	common.PartitionOffsetStatements
+	accounts      accountsStatements
+	profiles      profilesStatements
+	memberships   membershipStatements
+	accountDatas  accountDataStatements
+	threepids     threepidStatements
+	ssoIDs        ssoIdentityStatements
+	sessions      threepidSessionStatements
+	regTokens     registrationTokenStatements
+	consents      termsConsentStatements
+	loginFailures loginFailuresStatements
+	eventReports  eventReportStatements
+	serverName    gomatrixserverlib.ServerName
+
+	createGuestAccountMu sync.Mutex
+}
+
+// NewDatabase creates a new accounts and profiles database
+func NewDatabase(dataSourceName string, dbProperties common.DbProperties, serverName gomatrixserverlib.ServerName) (*Database, error) {
+	var db *sql.DB
+	dsn, err := sqlutil.ParseMySQLDataSourceName(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if db, err = sqlutil.Open(sqlutil.MySQLDriverName, dsn, dbProperties); err != nil {
+		return nil, err
+	}
+	if err = sqlutil.NewMigrator(db, "accounts", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
+	partitions := common.PartitionOffsetStatements{}
+	if err = partitions.PrepareMySQL(db, "account"); err != nil {
+		return nil, err
+	}
+	a := accountsStatements{}
+	if err = a.prepare(db, serverName); err != nil {
+		return nil, err
+	}
+	p := profilesStatements{}
+	if err = p.prepare(db); err != nil {
+		return nil, err
+	}
+	m := membershipStatements{}
+	if err = m.prepare(db); err != nil {
+		return nil, err
+	}
+	ac := accountDataStatements{}
+	if err = ac.prepare(db); err != nil {
+		return nil, err
+	}
+	t := threepidStatements{}
+	if err = t.prepare(db); err != nil {
+		return nil, err
+	}
+	s := ssoIdentityStatements{}
+	if err = s.prepare(db); err != nil {
+		return nil, err
+	}
+	ts := threepidSessionStatements{}
+	if err = ts.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := registrationTokenStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	tc := termsConsentStatements{}
+	if err = tc.prepare(db); err != nil {
+		return nil, err
+	}
+	lf := loginFailuresStatements{}
+	if err = lf.prepare(db); err != nil {
+		return nil, err
+	}
+	er := eventReportStatements{}
+	if err = er.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, m, ac, t, s, ts, rt, tc, lf, er, serverName, sync.Mutex{}}, nil
+}
+
+// GetAccountByPassword returns the account associated with the given localpart and password.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) GetAccountByPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) (*authtypes.Account, error) {
+	hash, err := d.accounts.selectPasswordHash(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
+		return nil, err
+	}
+	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+}
+
+// SetPassword replaces the password of the account associated with the given
+// localpart. Returns an error if something went wrong with the SQL query.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePasswordHash(ctx, localpart, hash)
+}
+
+// GetProfileByLocalpart returns the profile associated with the given localpart.
+// Returns sql.ErrNoRows if no profile exists which matches the given localpart.
+func (d *Database) GetProfileByLocalpart(
+	ctx context.Context, localpart string,
+) (*authtypes.Profile, error) {
+	return d.profiles.selectProfileByLocalpart(ctx, localpart)
+}
+
+// SetAvatarURL updates the avatar URL of the profile associated with the given
+// localpart. Returns an error if something went wrong with the SQL query
+func (d *Database) SetAvatarURL(
+	ctx context.Context, localpart string, avatarURL string,
+) error {
+	return d.profiles.setAvatarURL(ctx, localpart, avatarURL)
+}
+
+// SetDisplayName updates the display name of the profile associated with the given
+// localpart. Returns an error if something went wrong with the SQL query
+func (d *Database) SetDisplayName(
+	ctx context.Context, localpart string, displayName string,
+) error {
+	return d.profiles.setDisplayName(ctx, localpart, displayName)
+}
+
+// CreateGuestAccount makes a new guest account and creates an empty profile
+// for this account.
+func (d *Database) CreateGuestAccount(ctx context.Context) (acc *authtypes.Account, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		// We need to lock so we sequentially create numeric localparts. If we don't, two calls to
+		// this function will cause the same number to be selected and one will fail with a duplicate
+		// key error when it inserts the account.
+		d.createGuestAccountMu.Lock()
+		defer d.createGuestAccountMu.Unlock()
+
+		var numLocalpart int64
+		numLocalpart, err = d.accounts.selectNewNumericLocalpart(ctx, txn)
+		if err != nil {
+			return err
+		}
+		localpart := strconv.FormatInt(numLocalpart, 10)
+		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		return err
+	})
+	return acc, err
+}
+
+// CreateAccount makes a new account with the given login name and password, and creates an empty profile
+// for this account. If no password is supplied, the account will be a passwordless account. If the
+// account already exists, it will return nil, nil.
+func (d *Database) CreateAccount(
+	ctx context.Context, localpart, plaintextPassword, appserviceID string,
+) (acc *authtypes.Account, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		return err
+	})
+	return
+}
+
+func (d *Database) createAccount(
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+) (*authtypes.Account, error) {
+	var err error
+	// Generate a password hash if this is not a password-less user
+	hash := ""
+	if plaintextPassword != "" {
+		hash, err = hashPassword(plaintextPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := d.profiles.insertProfile(ctx, txn, localpart); err != nil {
+		if common.IsUniqueConstraintViolationErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", `{
+		"global": {
+			"content": [],
+			"override": [],
+			"room": [],
+			"sender": [],
+			"underride": []
+		}
+	}`); err != nil {
+		return nil, err
+	}
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+}
+
+// SaveMembership saves the user matching a given localpart as a member of a given
+// room. It also stores the ID of the membership event.
+// If a membership already exists between the user and the room, or if the
+// insert fails, returns the SQL error
+func (d *Database) saveMembership(
+	ctx context.Context, txn *sql.Tx, localpart, roomID, eventID string,
+) error {
+	return d.memberships.insertMembership(ctx, txn, localpart, roomID, eventID)
+}
+
+// removeMembershipsByEventIDs removes the memberships corresponding to the
+// `join` membership events IDs in the eventIDs slice.
+// If the removal fails, or if there is no membership to remove, returns an error
+func (d *Database) removeMembershipsByEventIDs(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	return d.memberships.deleteMembershipsByEventIDs(ctx, txn, eventIDs)
+}
+
+// UpdateMemberships adds the "join" membership events included in a given state
+// events array, and removes those which ID is included in a given array of events
+// IDs. All of the process is run in a transaction, which commits only once/if every
+// insertion and deletion has been successfully processed.
+// Returns a SQL error if there was an issue with any part of the process
+func (d *Database) UpdateMemberships(
+	ctx context.Context, eventsToAdd []gomatrixserverlib.Event, idsToRemove []string,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.removeMembershipsByEventIDs(ctx, txn, idsToRemove); err != nil {
+			return err
+		}
+
+		for _, event := range eventsToAdd {
+			if err := d.newMembership(ctx, txn, event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetMembershipInRoomByLocalpart returns the membership for an user
+// matching the given localpart if he is a member of the room matching roomID,
+// if not sql.ErrNoRows is returned.
+// If there was an issue during the retrieval, returns the SQL error
+func (d *Database) GetMembershipInRoomByLocalpart(
+	ctx context.Context, localpart, roomID string,
+) (authtypes.Membership, error) {
+	return d.memberships.selectMembershipInRoomByLocalpart(ctx, localpart, roomID)
+}
+
+// GetMembershipsByLocalpart returns an array containing the memberships for all
+// the rooms a user matching a given localpart is a member of
+// If no membership match the given localpart, returns an empty array
+// If there was an issue during the retrieval, returns the SQL error
+func (d *Database) GetMembershipsByLocalpart(
+	ctx context.Context, localpart string,
+) (memberships []authtypes.Membership, err error) {
+	return d.memberships.selectMembershipsByLocalpart(ctx, localpart)
+}
+
+// GetRoomIDsByLocalPart returns an array containing the room ids of all
+// the rooms a user matching a given localpart is a member of
+// If no membership match the given localpart, returns an empty array
+// If there was an issue during the retrieval, returns the SQL error
+func (d *Database) GetRoomIDsByLocalPart(
+	ctx context.Context, localpart string,
+) ([]string, error) {
+	return d.memberships.selectRoomIDsByLocalPart(ctx, localpart)
+}
+
+// newMembership saves a new membership in the database.
+// If the event isn't a valid m.room.member event with type `join`, does nothing.
+// If an error occurred, returns the SQL error
+func (d *Database) newMembership(
+	ctx context.Context, txn *sql.Tx, ev gomatrixserverlib.Event,
+) error {
+	if ev.Type() == "m.room.member" && ev.StateKey() != nil {
+		localpart, serverName, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err != nil {
+			return err
+		}
+
+		// We only want state events from local users
+		if string(serverName) != string(d.serverName) {
+			return nil
+		}
+
+		eventID := ev.EventID()
+		roomID := ev.RoomID()
+		membership, err := ev.Membership()
+		if err != nil {
+			return err
+		}
+
+		// Only "join" membership events can be considered as new memberships
+		if membership == gomatrixserverlib.Join {
+			if err := d.saveMembership(ctx, txn, localpart, roomID, eventID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SaveAccountData saves new account data for a given user and a given room.
+// If the account data is not specific to a room, the room ID should be an empty string
+// If an account data already exists for a given set (user, room, data type), it will
+// update the corresponding row with the new content
+// Returns a SQL error if there was an issue with the insertion/update
+func (d *Database) SaveAccountData(
+	ctx context.Context, localpart, roomID, dataType, content string,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accountDatas.insertAccountData(ctx, txn, localpart, roomID, dataType, content)
+	})
+}
+
+// GetAccountData returns account data related to a given localpart
+// If no account data could be found, returns an empty arrays
+// Returns an error if there was an issue with the retrieval
+func (d *Database) GetAccountData(ctx context.Context, localpart string) (
+	global []gomatrixserverlib.ClientEvent,
+	rooms map[string][]gomatrixserverlib.ClientEvent,
+	err error,
+) {
+	return d.accountDatas.selectAccountData(ctx, localpart)
+}
+
+// GetAccountDataByType returns account data matching a given
+// localpart, room ID and type.
+// If no account data could be found, returns nil
+// Returns an error if there was an issue with the retrieval
+func (d *Database) GetAccountDataByType(
+	ctx context.Context, localpart, roomID, dataType string,
+) (data *gomatrixserverlib.ClientEvent, err error) {
+	return d.accountDatas.selectAccountDataByType(
+		ctx, localpart, roomID, dataType,
+	)
+}
+
+// GetNewNumericLocalpart generates and returns a new unused numeric localpart
+func (d *Database) GetNewNumericLocalpart(
+	ctx context.Context,
+) (int64, error) {
+	return d.accounts.selectNewNumericLocalpart(ctx, nil)
+}
+
+func hashPassword(plaintext string) (hash string, err error) {
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
+	return string(hashBytes), err
+}
+
+// Err3PIDInUse is the error returned when trying to save an association involving
+// a third-party identifier which is already associated to a local user.
+var Err3PIDInUse = errors.New("This third-party identifier is already in use")
+
+// SaveThreePIDAssociation saves the association between a third party identifier
+// and a local Matrix user (identified by the user's ID's local part).
+// If the third-party identifier is already part of an association, returns Err3PIDInUse.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) SaveThreePIDAssociation(
+	ctx context.Context, threepid, localpart, medium string,
+) (err error) {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		user, err := d.threepids.selectLocalpartForThreePID(
+			ctx, txn, threepid, medium,
+		)
+		if err != nil {
+			return err
+		}
+
+		if len(user) > 0 {
+			return Err3PIDInUse
+		}
+
+		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart)
+	})
+}
+
+// RemoveThreePIDAssociation removes the association involving a given third-party
+// identifier.
+// If no association exists involving this third-party identifier, returns nothing.
+// If there was a problem talking to the database, returns an error.
+func (d *Database) RemoveThreePIDAssociation(
+	ctx context.Context, threepid string, medium string,
+) (err error) {
+	return d.threepids.deleteThreePID(ctx, threepid, medium)
+}
+
+// GetLocalpartForThreePID looks up the localpart associated with a given third-party
+// identifier.
+// If no association involves the given third-party idenfitier, returns an empty
+// string.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) GetLocalpartForThreePID(
+	ctx context.Context, threepid string, medium string,
+) (localpart string, err error) {
+	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
+}
+
+// GetThreePIDsForLocalpart looks up the third-party identifiers associated with
+// a given local user.
+// If no association is known for this user, returns an empty slice.
+// Returns an error if there was an issue talking to the database.
+func (d *Database) GetThreePIDsForLocalpart(
+	ctx context.Context, localpart string,
+) (threepids []authtypes.ThreePID, err error) {
+	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
+}
+
+// GetLocalpartForSSOIdentity looks up the localpart associated with the given
+// identity at a single sign-on provider.
+// If no local user is associated with the identity, returns an empty string.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) GetLocalpartForSSOIdentity(
+	ctx context.Context, issuer, subject string,
+) (localpart string, err error) {
+	return d.ssoIDs.selectLocalpartForSSOIdentity(ctx, nil, issuer, subject)
+}
+
+// SaveSSOIdentity associates the identity at a single sign-on provider with a
+// local user, so that the user is logged in whenever they sign on with it.
+// Returns an error if the identity is already associated with a local user or
+// if there was a problem talking to the database.
+func (d *Database) SaveSSOIdentity(
+	ctx context.Context, issuer, subject, localpart string,
+) error {
+	return d.ssoIDs.insertSSOIdentity(ctx, nil, issuer, subject, localpart)
+}
+
+// CreateThreePIDSession stores a new session for validating a third-party
+// identifier. Returns an error if there is already a session with the same
+// client secret and third-party identifier.
+func (d *Database) CreateThreePIDSession(
+	ctx context.Context, session *authtypes.ThreePIDSession,
+) error {
+	return d.sessions.insertThreePIDSession(ctx, session)
+}
+
+// GetThreePIDSession returns the session for validating a third-party
+// identifier with the given ID, or nil if there is no such session.
+func (d *Database) GetThreePIDSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSession(ctx, sessionID)
+}
+
+// GetThreePIDSessionBySecret returns the session which the client created
+// with the given secret for validating the third-party identifier, or nil if
+// there is no such session.
+func (d *Database) GetThreePIDSessionBySecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSessionBySecret(ctx, clientSecret, medium, address)
+}
+
+// UpdateThreePIDSessionSendAttempt records the latest send attempt from the
+// client for a session.
+func (d *Database) UpdateThreePIDSessionSendAttempt(
+	ctx context.Context, sessionID string, sendAttempt int,
+) error {
+	return d.sessions.updateThreePIDSessionSendAttempt(ctx, sessionID, sendAttempt)
+}
+
+// ValidateThreePIDSession records that the token for a session was submitted
+// at the given time, as a unix timestamp (ms resolution).
+func (d *Database) ValidateThreePIDSession(
+	ctx context.Context, sessionID string, validatedTS int64,
+) error {
+	return d.sessions.updateThreePIDSessionValidated(ctx, sessionID, validatedTS)
+}
+
+// UseThreePIDSessionSubmitAttempt counts an attempt to submit the token for a
+// session, unless the session has already had maxAttempts. Returns whether
+// the attempt was counted, i.e. whether the token may be checked.
+func (d *Database) UseThreePIDSessionSubmitAttempt(
+	ctx context.Context, sessionID string, maxAttempts int,
+) (bool, error) {
+	return d.sessions.updateThreePIDSessionSubmitAttempts(ctx, sessionID, maxAttempts)
+}
+
+// RemoveThreePIDSession deletes a session once it has been used.
+func (d *Database) RemoveThreePIDSession(ctx context.Context, sessionID string) error {
+	return d.sessions.deleteThreePIDSession(ctx, sessionID)
+}
+
+// RemoveExpiredThreePIDSessions deletes the sessions which were created before
+// the given time, as a unix timestamp (ms resolution).
+func (d *Database) RemoveExpiredThreePIDSessions(ctx context.Context, createdBeforeTS int64) error {
+	return d.sessions.deleteExpiredThreePIDSessions(ctx, createdBeforeTS)
+}
+
+// CreateRegistrationToken stores a new registration token. Returns an error
+// if the token already exists.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token *authtypes.RegistrationToken,
+) error {
+	return d.regTokens.insertRegistrationToken(ctx, token)
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationToken(ctx, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationTokens(ctx)
+}
+
+// RemoveRegistrationToken revokes a registration token.
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) error {
+	return d.regTokens.deleteRegistrationToken(ctx, token)
+}
+
+// UseRegistrationToken records that a registration token was used, if it's
+// still valid at the given time, as a unix timestamp (ms resolution).
+// Returns whether the token was valid.
+func (d *Database) UseRegistrationToken(
+	ctx context.Context, token string, nowTS int64,
+) (bool, error) {
+	return d.regTokens.useRegistrationToken(ctx, token, nowTS)
+}
+
+// ReleaseRegistrationToken gives back a use of a registration token, because
+// the registration it was used for couldn't be completed.
+func (d *Database) ReleaseRegistrationToken(ctx context.Context, token string) error {
+	return d.regTokens.releaseRegistrationToken(ctx, token)
+}
+
+// GetTermsConsent returns the version of the terms of service which the user
+// consented to, or "" if they haven't consented to any.
+func (d *Database) GetTermsConsent(ctx context.Context, localpart string) (string, error) {
+	return d.consents.selectTermsConsent(ctx, localpart)
+}
+
+// SetTermsConsent records that the user consented to the given version of the
+// terms of service at the given time, as a unix timestamp (ms resolution).
+func (d *Database) SetTermsConsent(
+	ctx context.Context, localpart, version string, consentedTS int64,
+) error {
+	return d.consents.upsertTermsConsent(ctx, localpart, version, consentedTS)
+}
+
+// GetLoginFailures returns how many login attempts have failed for the kind
+// of subject ("user", "user_ip" or "ip") since the count was last reset, and when the
+// last one failed, as a unix timestamp (ms resolution).
+func (d *Database) GetLoginFailures(
+	ctx context.Context, kind, subject string,
+) (failures int, lastFailureTS int64, err error) {
+	return d.loginFailures.selectLoginFailures(ctx, kind, subject)
+}
+
+// RecordLoginFailure records that a login attempt failed at the given time.
+// The count is reset first if the last failure was before resetBeforeTS.
+func (d *Database) RecordLoginFailure(
+	ctx context.Context, kind, subject string, failureTS, resetBeforeTS int64,
+) error {
+	return d.loginFailures.upsertLoginFailure(ctx, kind, subject, failureTS, resetBeforeTS)
+}
+
+// ReleaseLoginFailure takes back a failed login attempt which was recorded
+// for an attempt that didn't fail after all.
+func (d *Database) ReleaseLoginFailure(ctx context.Context, kind, subject string) error {
+	return d.loginFailures.releaseLoginFailure(ctx, kind, subject)
+}
+
+// ClearLoginFailures resets the count of failed login attempts.
+func (d *Database) ClearLoginFailures(ctx context.Context, kind, subject string) error {
+	return d.loginFailures.deleteLoginFailures(ctx, kind, subject)
+}
+
+// CheckAccountAvailability checks if the username/localpart is already present
+// in the database.
+// If the DB returns sql.ErrNoRows the Localpart isn't taken.
+func (d *Database) CheckAccountAvailability(ctx context.Context, localpart string) (bool, error) {
+	_, err := d.accounts.selectAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+// GetAccountByLocalpart returns the account associated with the given localpart.
+// This function assumes the request is authenticated or the account data is used only internally.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
+) (*authtypes.Account, error) {
+	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+}
+
+// CreateEventReport stores a user's report of an event and returns the ID of
+// the report.
+func (d *Database) CreateEventReport(ctx context.Context, report *authtypes.EventReport) (int64, error) {
+	return d.eventReports.insertEventReport(ctx, report)
+}
+
+// GetEventReport returns the event report, or nil if it doesn't exist.
+func (d *Database) GetEventReport(ctx context.Context, id int64) (*authtypes.EventReport, error) {
+	return d.eventReports.selectEventReport(ctx, id)
+}
+
+// GetEventReports returns up to limit event reports with IDs below beforeID,
+// newest first. Resolved reports are only included if includeResolved is true.
+func (d *Database) GetEventReports(
+	ctx context.Context, includeResolved bool, beforeID int64, limit int,
+) ([]authtypes.EventReport, error) {
+	return d.eventReports.selectEventReports(ctx, includeResolved, beforeID, limit)
+}
+
+// ResolveEventReport marks an event report as resolved by the given admin.
+// Returns false if the report doesn't exist or was already resolved.
+func (d *Database) ResolveEventReport(
+	ctx context.Context, id int64, resolvedBy string, resolvedTS int64,
+) (bool, error) {
+	return d.eventReports.resolveEventReport(ctx, id, resolvedBy, resolvedTS)
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+const threepidSessionSchema = `
+-- Stores the sessions for validating that users own third-party identifiers
+CREATE TABLE IF NOT EXISTS account_threepid_sessions (
+	-- The ID of the session
+	session_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	-- The secret which the client created the session with
+	client_secret VARCHAR(255) NOT NULL,
+	-- The third-party identifier being validated
+	medium VARCHAR(255) NOT NULL,
+	address VARCHAR(255) NOT NULL,
+	-- The token which was sent to the third-party identifier
+	token VARCHAR(255) NOT NULL,
+	-- The latest send attempt from the client, so that retries don't resend
+	send_attempt INTEGER NOT NULL,
+	-- Where to redirect the user after validating, if anywhere
+	next_link TEXT NOT NULL,
+	-- When the session was created, as a unix timestamp (ms resolution)
+	created_ts BIGINT NOT NULL,
+	-- When the token was submitted, or 0 if it hasn't been yet
+	validated_ts BIGINT NOT NULL DEFAULT 0,
+
+	UNIQUE KEY account_threepid_sessions_unique (client_secret, medium, address)
+);
+`
+
+// How many times a token has been submitted for a session which hadn't been
+// validated yet, so that sessions can be invalidated before their tokens can
+// be guessed.
+const threepidSessionSubmitAttemptsSchema = `
+ALTER TABLE account_threepid_sessions ADD COLUMN submit_attempts INTEGER NOT NULL DEFAULT 0
+`
+
+const insertThreePIDSessionSQL = "" +
+	"INSERT INTO account_threepid_sessions" +
+	" (session_id, client_secret, medium, address, token, send_attempt, next_link, created_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const selectThreePIDSessionSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, next_link, created_ts, validated_ts, submit_attempts" +
+	" FROM account_threepid_sessions WHERE session_id = $1"
+
+const selectThreePIDSessionBySecretSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, next_link, created_ts, validated_ts, submit_attempts" +
+	" FROM account_threepid_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3"
+
+const updateThreePIDSessionSendAttemptSQL = "" +
+	"UPDATE account_threepid_sessions SET send_attempt = $1 WHERE session_id = $2"
+
+const updateThreePIDSessionValidatedSQL = "" +
+	"UPDATE account_threepid_sessions SET validated_ts = $1 WHERE session_id = $2"
+
+const updateThreePIDSessionSubmitAttemptsSQL = "" +
+	"UPDATE account_threepid_sessions SET submit_attempts = submit_attempts + 1" +
+	" WHERE session_id = $1 AND submit_attempts < $2"
+
+const deleteThreePIDSessionSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE session_id = $1"
+
+const deleteExpiredThreePIDSessionsSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE created_ts < $1"
+
+type threepidSessionStatements struct {
+	insertThreePIDSessionStmt               *sql.Stmt
+	selectThreePIDSessionStmt               *sql.Stmt
+	selectThreePIDSessionBySecretStmt       *sql.Stmt
+	updateThreePIDSessionSendAttemptStmt    *sql.Stmt
+	updateThreePIDSessionValidatedStmt      *sql.Stmt
+	updateThreePIDSessionSubmitAttemptsStmt *sql.Stmt
+	deleteThreePIDSessionStmt               *sql.Stmt
+	deleteExpiredThreePIDSessionsStmt       *sql.Stmt
+}
+
+func (s *threepidSessionStatements) prepare(db *sql.DB) (err error) {
+	if s.insertThreePIDSessionStmt, err = db.Prepare(insertThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionStmt, err = db.Prepare(selectThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionBySecretStmt, err = db.Prepare(selectThreePIDSessionBySecretSQL); err != nil {
+		return
+	}
+	if s.updateThreePIDSessionSendAttemptStmt, err = db.Prepare(updateThreePIDSessionSendAttemptSQL); err != nil {
+		return
+	}
+	if s.updateThreePIDSessionValidatedStmt, err = db.Prepare(updateThreePIDSessionValidatedSQL); err != nil {
+		return
+	}
+	if s.updateThreePIDSessionSubmitAttemptsStmt, err = db.Prepare(updateThreePIDSessionSubmitAttemptsSQL); err != nil {
+		return
+	}
+	if s.deleteThreePIDSessionStmt, err = db.Prepare(deleteThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredThreePIDSessionsStmt, err = db.Prepare(deleteExpiredThreePIDSessionsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *threepidSessionStatements) insertThreePIDSession(
+	ctx context.Context, session *authtypes.ThreePIDSession,
+) (err error) {
+	_, err = s.insertThreePIDSessionStmt.ExecContext(
+		ctx, session.SessionID, session.ClientSecret, session.Medium, session.Address,
+		session.Token, session.SendAttempt, session.NextLink, session.CreatedTS,
+	)
+	return
+}
+
+func scanThreePIDSession(row *sql.Row) (*authtypes.ThreePIDSession, error) {
+	var session authtypes.ThreePIDSession
+	err := row.Scan(
+		&session.SessionID, &session.ClientSecret, &session.Medium, &session.Address,
+		&session.Token, &session.SendAttempt, &session.NextLink, &session.CreatedTS,
+		&session.ValidatedTS, &session.SubmitAttempts,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *threepidSessionStatements) selectThreePIDSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDSession, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionStmt.QueryRowContext(ctx, sessionID))
+}
+
+func (s *threepidSessionStatements) selectThreePIDSessionBySecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDSession, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionBySecretStmt.QueryRowContext(
+		ctx, clientSecret, medium, address,
+	))
+}
+
+func (s *threepidSessionStatements) updateThreePIDSessionSendAttempt(
+	ctx context.Context, sessionID string, sendAttempt int,
+) (err error) {
+	_, err = s.updateThreePIDSessionSendAttemptStmt.ExecContext(ctx, sendAttempt, sessionID)
+	return
+}
+
+func (s *threepidSessionStatements) updateThreePIDSessionValidated(
+	ctx context.Context, sessionID string, validatedTS int64,
+) (err error) {
+	_, err = s.updateThreePIDSessionValidatedStmt.ExecContext(ctx, validatedTS, sessionID)
+	return
+}
+
+// updateThreePIDSessionSubmitAttempts counts an attempt to submit the token
+// for a session, unless it has already had maxAttempts. Returns whether the
+// attempt was counted.
+func (s *threepidSessionStatements) updateThreePIDSessionSubmitAttempts(
+	ctx context.Context, sessionID string, maxAttempts int,
+) (bool, error) {
+	res, err := s.updateThreePIDSessionSubmitAttemptsStmt.ExecContext(ctx, sessionID, maxAttempts)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *threepidSessionStatements) deleteThreePIDSession(
+	ctx context.Context, sessionID string,
+) (err error) {
+	_, err = s.deleteThreePIDSessionStmt.ExecContext(ctx, sessionID)
+	return
+}
+
+func (s *threepidSessionStatements) deleteExpiredThreePIDSessions(
+	ctx context.Context, createdBeforeTS int64,
+) (err error) {
+	_, err = s.deleteExpiredThreePIDSessionsStmt.ExecContext(ctx, createdBeforeTS)
+	return
+}
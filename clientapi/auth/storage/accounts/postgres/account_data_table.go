@@ -57,10 +57,6 @@ type accountDataStatements struct {
 }
 
 func (s *accountDataStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(accountDataSchema)
-	if err != nil {
-		return
-	}
 	if s.insertAccountDataStmt, err = db.Prepare(insertAccountDataSQL); err != nil {
 		return
 	}
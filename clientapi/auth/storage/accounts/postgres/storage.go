@@ -34,13 +34,18 @@ import (
 type Database struct {
 	db *sql.DB
 	common.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	memberships  membershipStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	filter       filterStatements
-	serverName   gomatrixserverlib.ServerName
+	accounts      accountsStatements
+	profiles      profilesStatements
+	memberships   membershipStatements
+	accountDatas  accountDataStatements
+	threepids     threepidStatements
+	ssoIDs        ssoIdentityStatements
+	sessions      threepidSessionStatements
+	regTokens     registrationTokenStatements
+	consents      termsConsentStatements
+	loginFailures loginFailuresStatements
+	eventReports  eventReportStatements
+	serverName    gomatrixserverlib.ServerName
 }
 
 // NewDatabase creates a new accounts and profiles database
@@ -50,6 +55,9 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties, server
 	if db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(db, "accounts", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	partitions := common.PartitionOffsetStatements{}
 	if err = partitions.Prepare(db, "account"); err != nil {
 		return nil, err
@@ -74,11 +82,31 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties, server
 	if err = t.prepare(db); err != nil {
 		return nil, err
 	}
-	f := filterStatements{}
-	if err = f.prepare(db); err != nil {
+	s := ssoIdentityStatements{}
+	if err = s.prepare(db); err != nil {
+		return nil, err
+	}
+	ts := threepidSessionStatements{}
+	if err = ts.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := registrationTokenStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	tc := termsConsentStatements{}
+	if err = tc.prepare(db); err != nil {
+		return nil, err
+	}
+	lf := loginFailuresStatements{}
+	if err = lf.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, m, ac, t, f, serverName}, nil
+	er := eventReportStatements{}
+	if err = er.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, m, ac, t, s, ts, rt, tc, lf, er, serverName}, nil
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -96,6 +124,18 @@ func (d *Database) GetAccountByPassword(
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
+// SetPassword replaces the password of the account associated with the given
+// localpart. Returns an error if something went wrong with the SQL query.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePasswordHash(ctx, localpart, hash)
+}
+
 // GetProfileByLocalpart returns the profile associated with the given localpart.
 // Returns sql.ErrNoRows if no profile exists which matches the given localpart.
 func (d *Database) GetProfileByLocalpart(
@@ -395,22 +435,169 @@ func (d *Database) GetThreePIDsForLocalpart(
 	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
 }
 
-// GetFilter looks up the filter associated with a given local user and filter ID.
-// Returns a filter structure. Otherwise returns an error if no such filter exists
-// or if there was an error talking to the database.
-func (d *Database) GetFilter(
-	ctx context.Context, localpart string, filterID string,
-) (*gomatrixserverlib.Filter, error) {
-	return d.filter.selectFilter(ctx, localpart, filterID)
+// GetLocalpartForSSOIdentity looks up the localpart associated with the given
+// identity at a single sign-on provider.
+// If no local user is associated with the identity, returns an empty string.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) GetLocalpartForSSOIdentity(
+	ctx context.Context, issuer, subject string,
+) (localpart string, err error) {
+	return d.ssoIDs.selectLocalpartForSSOIdentity(ctx, nil, issuer, subject)
+}
+
+// SaveSSOIdentity associates the identity at a single sign-on provider with a
+// local user, so that the user is logged in whenever they sign on with it.
+// Returns an error if the identity is already associated with a local user or
+// if there was a problem talking to the database.
+func (d *Database) SaveSSOIdentity(
+	ctx context.Context, issuer, subject, localpart string,
+) error {
+	return d.ssoIDs.insertSSOIdentity(ctx, nil, issuer, subject, localpart)
+}
+
+// CreateThreePIDSession stores a new session for validating a third-party
+// identifier. Returns an error if there is already a session with the same
+// client secret and third-party identifier.
+func (d *Database) CreateThreePIDSession(
+	ctx context.Context, session *authtypes.ThreePIDSession,
+) error {
+	return d.sessions.insertThreePIDSession(ctx, session)
+}
+
+// GetThreePIDSession returns the session for validating a third-party
+// identifier with the given ID, or nil if there is no such session.
+func (d *Database) GetThreePIDSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSession(ctx, sessionID)
+}
+
+// GetThreePIDSessionBySecret returns the session which the client created
+// with the given secret for validating the third-party identifier, or nil if
+// there is no such session.
+func (d *Database) GetThreePIDSessionBySecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSessionBySecret(ctx, clientSecret, medium, address)
+}
+
+// UpdateThreePIDSessionSendAttempt records the latest send attempt from the
+// client for a session.
+func (d *Database) UpdateThreePIDSessionSendAttempt(
+	ctx context.Context, sessionID string, sendAttempt int,
+) error {
+	return d.sessions.updateThreePIDSessionSendAttempt(ctx, sessionID, sendAttempt)
+}
+
+// ValidateThreePIDSession records that the token for a session was submitted
+// at the given time, as a unix timestamp (ms resolution).
+func (d *Database) ValidateThreePIDSession(
+	ctx context.Context, sessionID string, validatedTS int64,
+) error {
+	return d.sessions.updateThreePIDSessionValidated(ctx, sessionID, validatedTS)
+}
+
+// UseThreePIDSessionSubmitAttempt counts an attempt to submit the token for a
+// session, unless the session has already had maxAttempts. Returns whether
+// the attempt was counted, i.e. whether the token may be checked.
+func (d *Database) UseThreePIDSessionSubmitAttempt(
+	ctx context.Context, sessionID string, maxAttempts int,
+) (bool, error) {
+	return d.sessions.updateThreePIDSessionSubmitAttempts(ctx, sessionID, maxAttempts)
+}
+
+// RemoveThreePIDSession deletes a session once it has been used.
+func (d *Database) RemoveThreePIDSession(ctx context.Context, sessionID string) error {
+	return d.sessions.deleteThreePIDSession(ctx, sessionID)
+}
+
+// RemoveExpiredThreePIDSessions deletes the sessions which were created before
+// the given time, as a unix timestamp (ms resolution).
+func (d *Database) RemoveExpiredThreePIDSessions(ctx context.Context, createdBeforeTS int64) error {
+	return d.sessions.deleteExpiredThreePIDSessions(ctx, createdBeforeTS)
+}
+
+// CreateRegistrationToken stores a new registration token. Returns an error
+// if the token already exists.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token *authtypes.RegistrationToken,
+) error {
+	return d.regTokens.insertRegistrationToken(ctx, token)
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationToken(ctx, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationTokens(ctx)
+}
+
+// RemoveRegistrationToken revokes a registration token.
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) error {
+	return d.regTokens.deleteRegistrationToken(ctx, token)
+}
+
+// UseRegistrationToken records that a registration token was used, if it's
+// still valid at the given time, as a unix timestamp (ms resolution).
+// Returns whether the token was valid.
+func (d *Database) UseRegistrationToken(
+	ctx context.Context, token string, nowTS int64,
+) (bool, error) {
+	return d.regTokens.useRegistrationToken(ctx, token, nowTS)
+}
+
+// ReleaseRegistrationToken gives back a use of a registration token, because
+// the registration it was used for couldn't be completed.
+func (d *Database) ReleaseRegistrationToken(ctx context.Context, token string) error {
+	return d.regTokens.releaseRegistrationToken(ctx, token)
+}
+
+// GetTermsConsent returns the version of the terms of service which the user
+// consented to, or "" if they haven't consented to any.
+func (d *Database) GetTermsConsent(ctx context.Context, localpart string) (string, error) {
+	return d.consents.selectTermsConsent(ctx, localpart)
+}
+
+// SetTermsConsent records that the user consented to the given version of the
+// terms of service at the given time, as a unix timestamp (ms resolution).
+func (d *Database) SetTermsConsent(
+	ctx context.Context, localpart, version string, consentedTS int64,
+) error {
+	return d.consents.upsertTermsConsent(ctx, localpart, version, consentedTS)
+}
+
+// GetLoginFailures returns how many login attempts have failed for the kind
+// of subject ("user", "user_ip" or "ip") since the count was last reset, and when the
+// last one failed, as a unix timestamp (ms resolution).
+func (d *Database) GetLoginFailures(
+	ctx context.Context, kind, subject string,
+) (failures int, lastFailureTS int64, err error) {
+	return d.loginFailures.selectLoginFailures(ctx, kind, subject)
 }
 
-// PutFilter puts the passed filter into the database.
-// Returns the filterID as a string. Otherwise returns an error if something
-// goes wrong.
-func (d *Database) PutFilter(
-	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
-) (string, error) {
-	return d.filter.insertFilter(ctx, filter, localpart)
+// RecordLoginFailure records that a login attempt failed at the given time.
+// The count is reset first if the last failure was before resetBeforeTS.
+func (d *Database) RecordLoginFailure(
+	ctx context.Context, kind, subject string, failureTS, resetBeforeTS int64,
+) error {
+	return d.loginFailures.upsertLoginFailure(ctx, kind, subject, failureTS, resetBeforeTS)
+}
+
+// ReleaseLoginFailure takes back a failed login attempt which was recorded
+// for an attempt that didn't fail after all.
+func (d *Database) ReleaseLoginFailure(ctx context.Context, kind, subject string) error {
+	return d.loginFailures.releaseLoginFailure(ctx, kind, subject)
+}
+
+// ClearLoginFailures resets the count of failed login attempts.
+func (d *Database) ClearLoginFailures(ctx context.Context, kind, subject string) error {
+	return d.loginFailures.deleteLoginFailures(ctx, kind, subject)
 }
 
 // CheckAccountAvailability checks if the username/localpart is already present
@@ -431,3 +618,30 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*authtypes.Account, error) {
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
+
+// CreateEventReport stores a user's report of an event and returns the ID of
+// the report.
+func (d *Database) CreateEventReport(ctx context.Context, report *authtypes.EventReport) (int64, error) {
+	return d.eventReports.insertEventReport(ctx, report)
+}
+
+// GetEventReport returns the event report, or nil if it doesn't exist.
+func (d *Database) GetEventReport(ctx context.Context, id int64) (*authtypes.EventReport, error) {
+	return d.eventReports.selectEventReport(ctx, id)
+}
+
+// GetEventReports returns up to limit event reports with IDs below beforeID,
+// newest first. Resolved reports are only included if includeResolved is true.
+func (d *Database) GetEventReports(
+	ctx context.Context, includeResolved bool, beforeID int64, limit int,
+) ([]authtypes.EventReport, error) {
+	return d.eventReports.selectEventReports(ctx, includeResolved, beforeID, limit)
+}
+
+// ResolveEventReport marks an event report as resolved by the given admin.
+// Returns false if the report doesn't exist or was already resolved.
+func (d *Database) ResolveEventReport(
+	ctx context.Context, id int64, resolvedBy string, resolvedTS int64,
+) (bool, error) {
+	return d.eventReports.resolveEventReport(ctx, id, resolvedBy, resolvedTS)
+}
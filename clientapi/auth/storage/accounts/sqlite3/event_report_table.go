@@ -0,0 +1,169 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const eventReportSchema = `
+-- Stores the events which users have reported to the server admins
+CREATE TABLE IF NOT EXISTS account_event_reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The room and event which were reported
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- The user who reported the event
+	user_id TEXT NOT NULL,
+	-- Why the user reported the event
+	reason TEXT NOT NULL,
+	-- How offensive the user found the event, from -100 (most offensive) to
+	-- 0, or NULL if they didn't say
+	score INTEGER,
+	-- When the event was reported, as a unix timestamp (ms resolution)
+	received_ts BIGINT NOT NULL,
+	-- The admin who resolved the report and when, as a unix timestamp (ms
+	-- resolution), or NULL if it hasn't been resolved
+	resolved_by TEXT,
+	resolved_ts BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS account_event_reports_unresolved_idx ON account_event_reports(resolved_ts, id);
+`
+
+const insertEventReportSQL = "" +
+	"INSERT INTO account_event_reports (room_id, event_id, user_id, reason, score, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectEventReportSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, received_ts, resolved_by, resolved_ts" +
+	" FROM account_event_reports WHERE id = $1"
+
+// Reports are listed newest first, starting before the given ID.
+const selectEventReportsSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, received_ts, resolved_by, resolved_ts" +
+	" FROM account_event_reports WHERE ($1 OR resolved_ts IS NULL) AND id < $2" +
+	" ORDER BY id DESC LIMIT $3"
+
+const resolveEventReportSQL = "" +
+	"UPDATE account_event_reports SET resolved_by = $1, resolved_ts = $2" +
+	" WHERE id = $3 AND resolved_ts IS NULL"
+
+type eventReportStatements struct {
+	insertEventReportStmt  *sql.Stmt
+	selectEventReportStmt  *sql.Stmt
+	selectEventReportsStmt *sql.Stmt
+	resolveEventReportStmt *sql.Stmt
+}
+
+func (s *eventReportStatements) prepare(db *sql.DB) (err error) {
+	if s.insertEventReportStmt, err = db.Prepare(insertEventReportSQL); err != nil {
+		return
+	}
+	if s.selectEventReportStmt, err = db.Prepare(selectEventReportSQL); err != nil {
+		return
+	}
+	if s.selectEventReportsStmt, err = db.Prepare(selectEventReportsSQL); err != nil {
+		return
+	}
+	if s.resolveEventReportStmt, err = db.Prepare(resolveEventReportSQL); err != nil {
+		return
+	}
+	return
+}
+
+func nullableScore(score *int) sql.NullInt64 {
+	if score == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*score), Valid: true}
+}
+
+func (s *eventReportStatements) insertEventReport(
+	ctx context.Context, report *authtypes.EventReport,
+) (int64, error) {
+	res, err := s.insertEventReportStmt.ExecContext(
+		ctx, report.RoomID, report.EventID, report.UserID, report.Reason,
+		nullableScore(report.Score), report.ReceivedTS,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func scanEventReport(row rowScanner) (*authtypes.EventReport, error) {
+	var report authtypes.EventReport
+	var score, resolvedTS sql.NullInt64
+	var resolvedBy sql.NullString
+	if err := row.Scan(
+		&report.ID, &report.RoomID, &report.EventID, &report.UserID, &report.Reason,
+		&score, &report.ReceivedTS, &resolvedBy, &resolvedTS,
+	); err != nil {
+		return nil, err
+	}
+	if score.Valid {
+		s := int(score.Int64)
+		report.Score = &s
+	}
+	report.ResolvedBy = resolvedBy.String
+	report.ResolvedTS = resolvedTS.Int64
+	return &report, nil
+}
+
+func (s *eventReportStatements) selectEventReport(
+	ctx context.Context, id int64,
+) (*authtypes.EventReport, error) {
+	report, err := scanEventReport(s.selectEventReportStmt.QueryRowContext(ctx, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+func (s *eventReportStatements) selectEventReports(
+	ctx context.Context, includeResolved bool, beforeID int64, limit int,
+) ([]authtypes.EventReport, error) {
+	rows, err := s.selectEventReportsStmt.QueryContext(ctx, includeResolved, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventReports: rows.close() failed")
+
+	reports := []authtypes.EventReport{}
+	for rows.Next() {
+		report, err := scanEventReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *eventReportStatements) resolveEventReport(
+	ctx context.Context, id int64, resolvedBy string, resolvedTS int64,
+) (bool, error) {
+	res, err := s.resolveEventReportStmt.ExecContext(ctx, resolvedBy, resolvedTS, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
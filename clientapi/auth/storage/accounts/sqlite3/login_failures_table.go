@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const loginFailuresSchema = `
+-- Stores how many failed login attempts there have been for each account and
+-- from each IP address
+CREATE TABLE IF NOT EXISTS account_login_failures (
+	-- What the attempts are counted for: "user", "user_ip" or "ip"
+	kind TEXT NOT NULL,
+	-- The localpart, "localpart|IP address" or IP address
+	subject TEXT NOT NULL,
+	-- How many attempts have failed since the count was last reset
+	failures INTEGER NOT NULL,
+	-- When the last attempt failed, as a unix timestamp (ms resolution)
+	last_failure_ts BIGINT NOT NULL,
+
+	PRIMARY KEY (kind, subject)
+);
+`
+
+// The count is reset if the last failure was before the given time.
+const upsertLoginFailureSQL = "" +
+	"INSERT INTO account_login_failures (kind, subject, failures, last_failure_ts) VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT (kind, subject) DO UPDATE SET" +
+	" failures = CASE WHEN account_login_failures.last_failure_ts < $4 THEN 1 ELSE account_login_failures.failures + 1 END," +
+	" last_failure_ts = $3"
+
+const selectLoginFailuresSQL = "" +
+	"SELECT failures, last_failure_ts FROM account_login_failures WHERE kind = $1 AND subject = $2"
+
+const releaseLoginFailureSQL = "" +
+	"UPDATE account_login_failures SET failures = failures - 1 WHERE kind = $1 AND subject = $2 AND failures > 0"
+
+const deleteLoginFailuresSQL = "" +
+	"DELETE FROM account_login_failures WHERE kind = $1 AND subject = $2"
+
+type loginFailuresStatements struct {
+	upsertLoginFailureStmt  *sql.Stmt
+	selectLoginFailuresStmt *sql.Stmt
+	releaseLoginFailureStmt *sql.Stmt
+	deleteLoginFailuresStmt *sql.Stmt
+}
+
+func (s *loginFailuresStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertLoginFailureStmt, err = db.Prepare(upsertLoginFailureSQL); err != nil {
+		return
+	}
+	if s.selectLoginFailuresStmt, err = db.Prepare(selectLoginFailuresSQL); err != nil {
+		return
+	}
+	if s.releaseLoginFailureStmt, err = db.Prepare(releaseLoginFailureSQL); err != nil {
+		return
+	}
+	if s.deleteLoginFailuresStmt, err = db.Prepare(deleteLoginFailuresSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *loginFailuresStatements) upsertLoginFailure(
+	ctx context.Context, kind, subject string, failureTS, resetBeforeTS int64,
+) (err error) {
+	_, err = s.upsertLoginFailureStmt.ExecContext(ctx, kind, subject, failureTS, resetBeforeTS)
+	return
+}
+
+func (s *loginFailuresStatements) selectLoginFailures(
+	ctx context.Context, kind, subject string,
+) (failures int, lastFailureTS int64, err error) {
+	err = s.selectLoginFailuresStmt.QueryRowContext(ctx, kind, subject).Scan(&failures, &lastFailureTS)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return
+}
+
+func (s *loginFailuresStatements) releaseLoginFailure(
+	ctx context.Context, kind, subject string,
+) (err error) {
+	_, err = s.releaseLoginFailureStmt.ExecContext(ctx, kind, subject)
+	return
+}
+
+func (s *loginFailuresStatements) deleteLoginFailures(
+	ctx context.Context, kind, subject string,
+) (err error) {
+	_, err = s.deleteLoginFailuresStmt.ExecContext(ctx, kind, subject)
+	return
+}
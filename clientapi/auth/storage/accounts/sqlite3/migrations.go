@@ -0,0 +1,67 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// migrations are the schema migrations for the accounts database, in order.
+var migrations = []sqlutil.Migration{
+	{
+		Version:     1,
+		Description: "Create the initial schema",
+		Up: sqlutil.Statements(
+			accountsSchema,
+			profilesSchema,
+			membershipSchema,
+			accountDataSchema,
+			threepidSchema,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Store the identities which users log in with by single sign-on",
+		Up:          sqlutil.Statements(ssoIdentitySchema),
+	},
+	{
+		Version:     3,
+		Description: "Store the sessions for validating third-party identifiers",
+		Up:          sqlutil.Statements(threepidSessionSchema),
+	},
+	{
+		Version:     4,
+		Description: "Store the tokens which allow users to register",
+		Up:          sqlutil.Statements(registrationTokenSchema),
+	},
+	{
+		Version:     5,
+		Description: "Store which version of the terms of service users consented to",
+		Up:          sqlutil.Statements(termsConsentSchema),
+	},
+	{
+		Version:     6,
+		Description: "Store how many login attempts have failed",
+		Up:          sqlutil.Statements(loginFailuresSchema),
+	},
+	{
+		Version:     7,
+		Description: "Store the events which users have reported",
+		Up:          sqlutil.Statements(eventReportSchema),
+	},
+	{
+		Version:     8,
+		Description: "Count the attempts to submit third-party identifier validation tokens",
+		Up:          sqlutil.Statements(threepidSessionSubmitAttemptsSchema),
+	},
+}
@@ -53,10 +53,6 @@ type profilesStatements struct {
 }
 
 func (s *profilesStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(profilesSchema)
-	if err != nil {
-		return
-	}
 	if s.insertProfileStmt, err = db.Prepare(insertProfileSQL); err != nil {
 		return
 	}
@@ -0,0 +1,182 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const registrationTokenSchema = `
+-- Stores the tokens which allow users to register
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+	-- The token
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many times the token may be used, or NULL if it's unlimited
+	uses_allowed INTEGER,
+	-- How many registrations the token has been used for
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token expires, as a unix timestamp (ms resolution), or NULL
+	-- if it never does
+	expiry_ts BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, expiry_ts) VALUES ($1, $2, $3)"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_ts FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_ts FROM account_registration_tokens ORDER BY token"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+// The token is only used if it's still valid, so that concurrent
+// registrations can't use it more times than allowed.
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_ts IS NULL OR expiry_ts > $2)"
+
+// A use is given back if the registration it was used for couldn't complete.
+const releaseRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed - 1 WHERE token = $1 AND completed > 0"
+
+type registrationTokenStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+	releaseRegistrationTokenStmt *sql.Stmt
+}
+
+func (s *registrationTokenStatements) prepare(db *sql.DB) (err error) {
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokensStmt, err = db.Prepare(selectRegistrationTokensSQL); err != nil {
+		return
+	}
+	if s.deleteRegistrationTokenStmt, err = db.Prepare(deleteRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.releaseRegistrationTokenStmt, err = db.Prepare(releaseRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *registrationTokenStatements) insertRegistrationToken(
+	ctx context.Context, token *authtypes.RegistrationToken,
+) (err error) {
+	var usesAllowed sql.NullInt64
+	if token.UsesAllowed != nil {
+		usesAllowed = sql.NullInt64{Int64: int64(*token.UsesAllowed), Valid: true}
+	}
+	var expiryTS sql.NullInt64
+	if token.ExpiryTime != nil {
+		expiryTS = sql.NullInt64{Int64: *token.ExpiryTime, Valid: true}
+	}
+	_, err = s.insertRegistrationTokenStmt.ExecContext(ctx, token.Token, usesAllowed, expiryTS)
+	return
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRegistrationToken(row rowScanner) (*authtypes.RegistrationToken, error) {
+	var token authtypes.RegistrationToken
+	var usesAllowed, expiryTS sql.NullInt64
+	if err := row.Scan(&token.Token, &usesAllowed, &token.Completed, &expiryTS); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		uses := int(usesAllowed.Int64)
+		token.UsesAllowed = &uses
+	}
+	if expiryTS.Valid {
+		token.ExpiryTime = &expiryTS.Int64
+	}
+	return &token, nil
+}
+
+func (s *registrationTokenStatements) selectRegistrationToken(
+	ctx context.Context, token string,
+) (*authtypes.RegistrationToken, error) {
+	result, err := scanRegistrationToken(s.selectRegistrationTokenStmt.QueryRowContext(ctx, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return result, err
+}
+
+func (s *registrationTokenStatements) selectRegistrationTokens(
+	ctx context.Context,
+) ([]authtypes.RegistrationToken, error) {
+	rows, err := s.selectRegistrationTokensStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+
+	tokens := []authtypes.RegistrationToken{}
+	for rows.Next() {
+		token, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *registrationTokenStatements) deleteRegistrationToken(
+	ctx context.Context, token string,
+) (err error) {
+	_, err = s.deleteRegistrationTokenStmt.ExecContext(ctx, token)
+	return
+}
+
+func (s *registrationTokenStatements) useRegistrationToken(
+	ctx context.Context, token string, nowTS int64,
+) (bool, error) {
+	res, err := s.useRegistrationTokenStmt.ExecContext(ctx, token, nowTS)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+func (s *registrationTokenStatements) releaseRegistrationToken(
+	ctx context.Context, token string,
+) (err error) {
+	_, err = s.releaseRegistrationTokenStmt.ExecContext(ctx, token)
+	return
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const ssoIdentitySchema = `
+-- Stores the identities at single sign-on providers which local users log in with
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+	-- The issuer of the identity, i.e. the identity provider
+	issuer TEXT NOT NULL,
+	-- The subject of the identity, which is unique to the user at the issuer
+	subject TEXT NOT NULL,
+	-- The localpart of the Matrix user ID associated to this identity
+	localpart TEXT NOT NULL,
+
+	PRIMARY KEY(issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS account_sso_identities_localpart ON account_sso_identities(localpart);
+`
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE issuer = $1 AND subject = $2"
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (issuer, subject, localpart) VALUES ($1, $2, $3)"
+
+type ssoIdentityStatements struct {
+	selectLocalpartForSSOIdentityStmt *sql.Stmt
+	insertSSOIdentityStmt             *sql.Stmt
+}
+
+func (s *ssoIdentityStatements) prepare(db *sql.DB) (err error) {
+	if s.selectLocalpartForSSOIdentityStmt, err = db.Prepare(selectLocalpartForSSOIdentitySQL); err != nil {
+		return
+	}
+	if s.insertSSOIdentityStmt, err = db.Prepare(insertSSOIdentitySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *ssoIdentityStatements) selectLocalpartForSSOIdentity(
+	ctx context.Context, txn *sql.Tx, issuer, subject string,
+) (localpart string, err error) {
+	stmt := common.TxStmt(txn, s.selectLocalpartForSSOIdentityStmt)
+	err = stmt.QueryRowContext(ctx, issuer, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (s *ssoIdentityStatements) insertSSOIdentity(
+	ctx context.Context, txn *sql.Tx, issuer, subject, localpart string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.insertSSOIdentityStmt)
+	_, err = stmt.ExecContext(ctx, issuer, subject, localpart)
+	return
+}
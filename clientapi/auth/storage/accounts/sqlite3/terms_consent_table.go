@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const termsConsentSchema = `
+-- Stores which version of the terms of service each user consented to
+CREATE TABLE IF NOT EXISTS account_terms_consent (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- The version of the terms which the user consented to
+	version TEXT NOT NULL,
+	-- When the user consented, as a unix timestamp (ms resolution)
+	consented_ts BIGINT NOT NULL
+);
+`
+
+const upsertTermsConsentSQL = "" +
+	"INSERT INTO account_terms_consent (localpart, version, consented_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart) DO UPDATE SET version = $2, consented_ts = $3"
+
+const selectTermsConsentSQL = "" +
+	"SELECT version FROM account_terms_consent WHERE localpart = $1"
+
+type termsConsentStatements struct {
+	upsertTermsConsentStmt *sql.Stmt
+	selectTermsConsentStmt *sql.Stmt
+}
+
+func (s *termsConsentStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertTermsConsentStmt, err = db.Prepare(upsertTermsConsentSQL); err != nil {
+		return
+	}
+	if s.selectTermsConsentStmt, err = db.Prepare(selectTermsConsentSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *termsConsentStatements) upsertTermsConsent(
+	ctx context.Context, localpart, version string, consentedTS int64,
+) (err error) {
+	_, err = s.upsertTermsConsentStmt.ExecContext(ctx, localpart, version, consentedTS)
+	return
+}
+
+func (s *termsConsentStatements) selectTermsConsent(
+	ctx context.Context, localpart string,
+) (version string, err error) {
+	err = s.selectTermsConsentStmt.QueryRowContext(ctx, localpart).Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var ctx = context.Background()
+
+// mustCreateDatabase creates an empty database, which is on the server named by
+// DENDRITE_TEST_DATABASE if it is set. The returned function removes it again.
+func mustCreateDatabase(t *testing.T) (accounts.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := accounts.NewDatabase(dataSource, nil, gomatrixserverlib.ServerName("hollow.knight"))
+	if err != nil {
+		closeDB()
+		t.Fatalf("accounts.NewDatabase returned %s", err)
+	}
+	return db, closeDB
+}
+
+func TestAccounts(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	account, err := db.CreateAccount(ctx, "hornet", "gitgud", "")
+	if err != nil {
+		t.Fatalf("CreateAccount returned %s", err)
+	}
+	if account.UserID != "@hornet:hollow.knight" {
+		t.Errorf("CreateAccount: unexpected user ID %s", account.UserID)
+	}
+	if _, err = db.CreateAccount(ctx, "hornet", "gitgud", ""); err == nil {
+		t.Errorf("CreateAccount: expected creating the account twice to fail")
+	}
+	if available, err := db.CheckAccountAvailability(ctx, "hornet"); err != nil || available {
+		t.Errorf("CheckAccountAvailability: expected the localpart to be taken, got %v (%v)", available, err)
+	}
+
+	if _, err = db.GetAccountByPassword(ctx, "hornet", "wrong"); err == nil {
+		t.Errorf("GetAccountByPassword: expected the wrong password to be rejected")
+	}
+	if err = db.SetPassword(ctx, "hornet", "shaw"); err != nil {
+		t.Fatalf("SetPassword returned %s", err)
+	}
+	if account, err = db.GetAccountByPassword(ctx, "hornet", "shaw"); err != nil || account.Localpart != "hornet" {
+		t.Errorf("GetAccountByPassword: expected the new password to be accepted, got %+v (%v)", account, err)
+	}
+
+	if err = db.SetDisplayName(ctx, "hornet", "Hornet"); err != nil {
+		t.Fatalf("SetDisplayName returned %s", err)
+	}
+	if err = db.SetAvatarURL(ctx, "hornet", "mxc://hollow.knight/needle"); err != nil {
+		t.Fatalf("SetAvatarURL returned %s", err)
+	}
+	profile, err := db.GetProfileByLocalpart(ctx, "hornet")
+	if err != nil || profile.DisplayName != "Hornet" || profile.AvatarURL != "mxc://hollow.knight/needle" {
+		t.Errorf("GetProfileByLocalpart: unexpected %+v (%v)", profile, err)
+	}
+
+	guest, err := db.CreateGuestAccount(ctx)
+	if err != nil {
+		t.Fatalf("CreateGuestAccount returned %s", err)
+	}
+	next, err := db.GetNewNumericLocalpart(ctx)
+	if err != nil || next <= 0 {
+		t.Fatalf("GetNewNumericLocalpart: unexpected %d (%v)", next, err)
+	}
+	if guest.Localpart == "" {
+		t.Errorf("CreateGuestAccount: expected a localpart")
+	}
+}
+
+func TestAccountData(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	if err := db.SaveAccountData(ctx, "hornet", "", "m.direct", `{"a":1}`); err != nil {
+		t.Fatalf("SaveAccountData returned %s", err)
+	}
+	// Saving the same type again replaces it.
+	if err := db.SaveAccountData(ctx, "hornet", "", "m.direct", `{"a":2}`); err != nil {
+		t.Fatalf("SaveAccountData returned %s", err)
+	}
+	if err := db.SaveAccountData(ctx, "hornet", "!room:hollow.knight", "m.tag", `{"tags":{}}`); err != nil {
+		t.Fatalf("SaveAccountData returned %s", err)
+	}
+
+	global, rooms, err := db.GetAccountData(ctx, "hornet")
+	if err != nil {
+		t.Fatalf("GetAccountData returned %s", err)
+	}
+	if len(global) != 1 || global[0].Type != "m.direct" || string(global[0].Content) != `{"a":2}` {
+		t.Errorf("GetAccountData: unexpected global account data %+v", global)
+	}
+	if len(rooms["!room:hollow.knight"]) != 1 || rooms["!room:hollow.knight"][0].Type != "m.tag" {
+		t.Errorf("GetAccountData: unexpected room account data %+v", rooms)
+	}
+	data, err := db.GetAccountDataByType(ctx, "hornet", "!room:hollow.knight", "m.tag")
+	if err != nil || data == nil || string(data.Content) != `{"tags":{}}` {
+		t.Errorf("GetAccountDataByType: unexpected %+v (%v)", data, err)
+	}
+}
+
+func TestThreePIDAssociations(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	if err := db.SaveThreePIDAssociation(ctx, "hornet@hollow.knight", "hornet", "email"); err != nil {
+		t.Fatalf("SaveThreePIDAssociation returned %s", err)
+	}
+	// Each backend has its own error value, but they have the same message.
+	if err := db.SaveThreePIDAssociation(ctx, "hornet@hollow.knight", "knight", "email"); err == nil || err.Error() != accounts.Err3PIDInUse.Error() {
+		t.Errorf("SaveThreePIDAssociation: expected Err3PIDInUse, got %v", err)
+	}
+	if localpart, err := db.GetLocalpartForThreePID(ctx, "hornet@hollow.knight", "email"); err != nil || localpart != "hornet" {
+		t.Errorf("GetLocalpartForThreePID: expected hornet, got %s (%v)", localpart, err)
+	}
+	threepids, err := db.GetThreePIDsForLocalpart(ctx, "hornet")
+	if err != nil || len(threepids) != 1 || threepids[0].Address != "hornet@hollow.knight" {
+		t.Errorf("GetThreePIDsForLocalpart: unexpected %+v (%v)", threepids, err)
+	}
+	if err = db.RemoveThreePIDAssociation(ctx, "hornet@hollow.knight", "email"); err != nil {
+		t.Fatalf("RemoveThreePIDAssociation returned %s", err)
+	}
+	if localpart, err := db.GetLocalpartForThreePID(ctx, "hornet@hollow.knight", "email"); err != nil || localpart != "" {
+		t.Errorf("GetLocalpartForThreePID: expected no localpart, got %s (%v)", localpart, err)
+	}
+
+	if err = db.SaveSSOIdentity(ctx, "https://idp.hollow.knight", "subject", "hornet"); err != nil {
+		t.Fatalf("SaveSSOIdentity returned %s", err)
+	}
+	if localpart, err := db.GetLocalpartForSSOIdentity(ctx, "https://idp.hollow.knight", "subject"); err != nil || localpart != "hornet" {
+		t.Errorf("GetLocalpartForSSOIdentity: expected hornet, got %s (%v)", localpart, err)
+	}
+}
+
+func TestRegistrationTokenConcurrentUse(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	usesAllowed := 3
+	if err := db.CreateRegistrationToken(ctx, &authtypes.RegistrationToken{
+		Token: "grub", UsesAllowed: &usesAllowed,
+	}); err != nil {
+		t.Fatalf("CreateRegistrationToken returned %s", err)
+	}
+
+	// Many registrations race to use the token, but only as many as are
+	// allowed succeed.
+	const attempts = 20
+	var wg sync.WaitGroup
+	var used, failed int32
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valid, err := db.UseRegistrationToken(ctx, "grub", time.Now().UnixNano()/int64(time.Millisecond))
+			switch {
+			case err != nil:
+				atomic.AddInt32(&failed, 1)
+			case valid:
+				atomic.AddInt32(&used, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != 0 {
+		t.Errorf("UseRegistrationToken failed %d times", failed)
+	}
+	if used != int32(usesAllowed) {
+		t.Errorf("UseRegistrationToken: expected %d uses, got %d", usesAllowed, used)
+	}
+	token, err := db.GetRegistrationToken(ctx, "grub")
+	if err != nil || token == nil || token.Completed != usesAllowed {
+		t.Errorf("GetRegistrationToken: expected %d completed, got %+v (%v)", usesAllowed, token, err)
+	}
+
+	// A use which is given back can be used again, once.
+	if err = db.ReleaseRegistrationToken(ctx, "grub"); err != nil {
+		t.Fatalf("ReleaseRegistrationToken returned %s", err)
+	}
+	nowTS := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, want := range []bool{true, false} {
+		if valid, err := db.UseRegistrationToken(ctx, "grub", nowTS); err != nil || valid != want {
+			t.Errorf("UseRegistrationToken %d after release: expected %v, got %v (%v)", i, want, valid, err)
+		}
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	for _, ts := range []int64{1000, 2000} {
+		if err := db.RecordLoginFailure(ctx, "user", "hornet", ts, 0); err != nil {
+			t.Fatalf("RecordLoginFailure returned %s", err)
+		}
+	}
+	if failures, lastFailureTS, err := db.GetLoginFailures(ctx, "user", "hornet"); err != nil || failures != 2 || lastFailureTS != 2000 {
+		t.Errorf("GetLoginFailures: expected 2 failures at 2000, got %d at %d (%v)", failures, lastFailureTS, err)
+	}
+	// Other kinds of subject are counted separately.
+	if failures, _, err := db.GetLoginFailures(ctx, "ip", "hornet"); err != nil || failures != 0 {
+		t.Errorf("GetLoginFailures: expected no failures for the IP address, got %d (%v)", failures, err)
+	}
+
+	// A failure which is taken back isn't counted, and there are never fewer
+	// than none.
+	for i := 0; i < 3; i++ {
+		if err := db.ReleaseLoginFailure(ctx, "user", "hornet"); err != nil {
+			t.Fatalf("ReleaseLoginFailure returned %s", err)
+		}
+	}
+	if failures, _, err := db.GetLoginFailures(ctx, "user", "hornet"); err != nil || failures != 0 {
+		t.Errorf("GetLoginFailures: expected no failures after releasing them, got %d (%v)", failures, err)
+	}
+
+	// Failures from before the reset time are forgotten.
+	if err := db.RecordLoginFailure(ctx, "user", "hornet", 3000, 0); err != nil {
+		t.Fatalf("RecordLoginFailure returned %s", err)
+	}
+	if err := db.RecordLoginFailure(ctx, "user", "hornet", 9000, 5000); err != nil {
+		t.Fatalf("RecordLoginFailure returned %s", err)
+	}
+	if failures, _, err := db.GetLoginFailures(ctx, "user", "hornet"); err != nil || failures != 1 {
+		t.Errorf("GetLoginFailures: expected the count to be reset, got %d (%v)", failures, err)
+	}
+
+	if err := db.ClearLoginFailures(ctx, "user", "hornet"); err != nil {
+		t.Fatalf("ClearLoginFailures returned %s", err)
+	}
+	if failures, _, err := db.GetLoginFailures(ctx, "user", "hornet"); err != nil || failures != 0 {
+		t.Errorf("GetLoginFailures: expected no failures after clearing them, got %d (%v)", failures, err)
+	}
+}
@@ -42,6 +42,9 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties, server
 	if db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(db, "devices", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	d := devicesStatements{}
 	if err = d.prepare(db, serverName); err != nil {
 		return nil, err
@@ -19,13 +19,14 @@ package devices
 import (
 	"net/url"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/mysql"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/postgres"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/sqlite3"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
-// NewDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
+// NewDatabase opens a new Postgres, MySQL or Sqlite database (based on dataSourceName scheme)
 // and sets postgres connection parameters
 func NewDatabase(dataSourceName string, dbProperties common.DbProperties, serverName gomatrixserverlib.ServerName) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
@@ -33,8 +34,10 @@ func NewDatabase(dataSourceName string, dbProperties common.DbProperties, server
 		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
 	}
 	switch uri.Scheme {
-	case "postgres":
+	case "postgres", "cockroachdb":
 		return postgres.NewDatabase(dataSourceName, dbProperties, serverName)
+	case "mysql":
+		return mysql.NewDatabase(dataSourceName, dbProperties, serverName)
 	case "file":
 		return sqlite3.NewDatabase(dataSourceName, serverName)
 	default:
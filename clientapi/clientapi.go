@@ -20,6 +20,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/consumers"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/push/emailnotifier"
 	"github.com/matrix-org/dendrite/clientapi/routing"
 	"github.com/matrix-org/dendrite/common/basecomponent"
 	"github.com/matrix-org/dendrite/common/transactions"
@@ -64,9 +65,20 @@ func SetupClientAPIComponent(
 		logrus.WithError(err).Panicf("failed to start room server consumer")
 	}
 
+	pushDB := base.CreatePushDB()
+	pushConsumer := consumers.NewOutputRoomEventPushConsumer(
+		base.Cfg, base.KafkaConsumer, pushDB, accountsDB, rsAPI,
+	)
+	if err := pushConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start room server push consumer")
+	}
+	if base.Cfg.Matrix.Email.Notifications.Enabled {
+		emailnotifier.NewNotifier(base.Cfg, pushDB, accountsDB).Start()
+	}
+
 	routing.Setup(
 		base.APIMux, base.Cfg, roomserverProducer, rsAPI, asAPI,
-		accountsDB, deviceDB, federation, *keyRing, userUpdateProducer,
+		accountsDB, deviceDB, pushDB, federation, *keyRing, userUpdateProducer,
 		syncProducer, eduProducer, transactionsCache, fsAPI,
 	)
 }
@@ -0,0 +1,397 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/push/emailnotifier"
+	"github.com/matrix-org/dendrite/clientapi/push/pushgateway"
+	"github.com/matrix-org/dendrite/clientapi/push/pushrules"
+	"github.com/matrix-org/dendrite/clientapi/push/storage"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait for a push gateway to respond to a notification.
+const pushGatewayTimeout = 30 * time.Second
+
+// OutputRoomEventPushConsumer consumes events that originated in the room
+// server, and counts the notifications they cause and sends them to the
+// pushers of the local users in the room, according to the users' push rules.
+type OutputRoomEventPushConsumer struct {
+	rsAPI      api.RoomserverInternalAPI
+	rsConsumer *common.ContinualConsumer
+	db         storage.Database
+	accountDB  accounts.Database
+	gateway    *pushgateway.Client
+	serverName gomatrixserverlib.ServerName
+	// Whether notifications are stored to be emailed to email pushers
+	emailNotifications bool
+}
+
+// NewOutputRoomEventPushConsumer creates a new OutputRoomEventPushConsumer.
+// Call Start() to begin consuming from room servers.
+func NewOutputRoomEventPushConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+) *OutputRoomEventPushConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputRoomEventPushConsumer{
+		rsConsumer: &consumer,
+		db:         store,
+		accountDB:  accountDB,
+		rsAPI:      rsAPI,
+		gateway:    pushgateway.NewClient(&http.Client{Timeout: pushGatewayTimeout}),
+		serverName: cfg.Matrix.ServerName,
+		emailNotifications: cfg.Matrix.Email.Enabled &&
+			cfg.Matrix.Email.Notifications.Enabled,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventPushConsumer) Start() error {
+	return s.rsConsumer.Start()
+}
+
+// pushRoomState is the state of a room that is needed to work out who to
+// notify about an event in it, and how.
+type pushRoomState struct {
+	// The display names of the joined members, keyed by user ID.
+	members map[string]string
+	// The room's power levels.
+	powerLevels gomatrixserverlib.PowerLevelContent
+	// The power levels needed to trigger each kind of notification.
+	notificationLevels map[string]int64
+	// The name of the room, if it has one.
+	name string
+}
+
+func (s *OutputRoomEventPushConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+
+	ev := output.NewRoomEvent.Event.Event
+
+	// Sending an event in a room counts as reading it.
+	if s.isLocalUser(ev.Sender()) {
+		localpart, _, err := gomatrixserverlib.SplitID('@', ev.Sender())
+		if err == nil {
+			err = s.db.ResetNotificationCounts(context.TODO(), localpart, ev.RoomID())
+		}
+		if err == nil && s.emailNotifications {
+			err = s.db.RemoveEmailNotificationsInRoom(context.TODO(), localpart, ev.RoomID())
+		}
+		if err != nil {
+			log.WithError(err).WithField("user_id", ev.Sender()).Error("push: failed to reset notification counts")
+		}
+	}
+
+	state, err := s.roomState(context.TODO(), ev.RoomID())
+	if err != nil {
+		log.WithError(err).WithField("room_id", ev.RoomID()).Error("push: failed to get room state")
+		return err
+	}
+
+	for _, userID := range s.recipients(&ev, state) {
+		if err = s.notifyUser(context.TODO(), &ev, state, userID); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"event_id": ev.EventID(),
+				"user_id":  userID,
+			}).Error("push: failed to notify user")
+		}
+	}
+	return nil
+}
+
+// roomState fetches the current state of the room from the room server.
+func (s *OutputRoomEventPushConsumer) roomState(
+	ctx context.Context, roomID string,
+) (*pushRoomState, error) {
+	req := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := s.rsAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+
+	state := &pushRoomState{
+		members:            map[string]string{},
+		notificationLevels: map[string]int64{},
+	}
+	state.powerLevels.Defaults()
+	for _, headeredEvent := range res.StateEvents {
+		ev := headeredEvent.Event
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			var content struct {
+				Membership  string `json:"membership"`
+				DisplayName string `json:"displayname"`
+			}
+			if err := json.Unmarshal(ev.Content(), &content); err != nil || ev.StateKey() == nil {
+				continue
+			}
+			if content.Membership == gomatrixserverlib.Join {
+				state.members[*ev.StateKey()] = content.DisplayName
+			}
+		case gomatrixserverlib.MRoomPowerLevels:
+			powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev)
+			if err != nil {
+				continue
+			}
+			state.powerLevels = powerLevels
+			var content struct {
+				Notifications map[string]int64 `json:"notifications"`
+			}
+			if err = json.Unmarshal(ev.Content(), &content); err == nil && content.Notifications != nil {
+				state.notificationLevels = content.Notifications
+			}
+		case "m.room.name":
+			var content struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(ev.Content(), &content); err == nil {
+				state.name = content.Name
+			}
+		}
+	}
+	return state, nil
+}
+
+// recipients returns the local users who might be notified about the event:
+// the joined members of the room other than the sender, and the target of an
+// invite.
+func (s *OutputRoomEventPushConsumer) recipients(
+	ev *gomatrixserverlib.Event, state *pushRoomState,
+) []string {
+	var userIDs []string
+	for userID := range state.members {
+		if userID != ev.Sender() && s.isLocalUser(userID) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+		target := *ev.StateKey()
+		membership, err := ev.Membership()
+		if err == nil && membership == gomatrixserverlib.Invite && s.isLocalUser(target) {
+			if _, joined := state.members[target]; !joined {
+				userIDs = append(userIDs, target)
+			}
+		}
+	}
+	return userIDs
+}
+
+func (s *OutputRoomEventPushConsumer) isLocalUser(userID string) bool {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	return err == nil && domain == s.serverName
+}
+
+// notifyUser evaluates the user's push rules against the event and, if they
+// say to notify the user, counts the notification and sends it to each of the
+// user's pushers. The notifications are sent in the background.
+func (s *OutputRoomEventPushConsumer) notifyUser(
+	ctx context.Context, ev *gomatrixserverlib.Event, state *pushRoomState, userID string,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	data, err := s.accountDB.GetAccountDataByType(ctx, localpart, "", pushrules.AccountDataType)
+	if err != nil {
+		return err
+	}
+	ruleSets, err := pushrules.FromAccountData(data, localpart, userID)
+	if err != nil {
+		return err
+	}
+
+	rule := ruleSets.Global.Match(ev, &pushrules.EvaluationContext{
+		UserID:                  userID,
+		UserDisplayName:         state.members[userID],
+		RoomMemberCount:         len(state.members),
+		SenderPowerLevel:        state.powerLevels.UserLevel(ev.Sender()),
+		NotificationPowerLevels: state.notificationLevels,
+	})
+	if rule == nil || !pushrules.Notify(rule.Actions) {
+		return nil
+	}
+	tweaks := pushrules.Tweaks(rule.Actions)
+	if err = s.db.IncrementNotificationCount(ctx, localpart, ev.RoomID(), tweaks["highlight"] == true); err != nil {
+		return err
+	}
+
+	pushers, err := s.db.GetPushers(ctx, localpart)
+	if err != nil || len(pushers) == 0 {
+		return err
+	}
+	counts, err := s.unreadCounts(ctx, localpart)
+	if err != nil {
+		return err
+	}
+
+	queuedEmail := false
+	for _, pusher := range pushers {
+		switch pusher.Kind {
+		case "http":
+			url, ok := pusher.Data["url"].(string)
+			if !ok {
+				continue
+			}
+			n := pushNotification(ev, state, userID, pusher, tweaks)
+			n.Counts = counts
+			go s.sendNotification(localpart, pusher, url, n)
+		case emailnotifier.PusherKind:
+			// The notification is emailed later if the user hasn't read it
+			// by then, to all of their email pushers at once.
+			if !s.emailNotifications || queuedEmail {
+				continue
+			}
+			if err = s.db.AddEmailNotification(ctx, localpart, emailNotification(ev, state)); err != nil {
+				return err
+			}
+			queuedEmail = true
+		}
+	}
+	return nil
+}
+
+// emailNotification returns the notification about the event to store until
+// it is emailed.
+func emailNotification(ev *gomatrixserverlib.Event, state *pushRoomState) authtypes.EmailNotification {
+	return authtypes.EmailNotification{
+		RoomID:            ev.RoomID(),
+		EventID:           ev.EventID(),
+		Sender:            ev.Sender(),
+		SenderDisplayName: state.members[ev.Sender()],
+		RoomName:          state.name,
+		Body:              emailnotifier.Summary(ev),
+		NotifiedTS:        time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// unreadCounts returns the counts of the user's unread notifications in all
+// of their rooms, for showing on their devices' badges.
+func (s *OutputRoomEventPushConsumer) unreadCounts(
+	ctx context.Context, localpart string,
+) (*pushgateway.Counts, error) {
+	roomCounts, err := s.db.GetNotificationCounts(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	counts := &pushgateway.Counts{}
+	for _, c := range roomCounts {
+		counts.Unread += c.NotificationCount
+	}
+	return counts, nil
+}
+
+// pushNotification builds the notification about the event to send to the
+// given pusher.
+func pushNotification(
+	ev *gomatrixserverlib.Event, state *pushRoomState, userID string,
+	pusher authtypes.Pusher, tweaks map[string]interface{},
+) *pushgateway.Notification {
+	// The pusher's data is passed on to the push gateway, apart from the URL
+	// of the gateway itself.
+	data := map[string]interface{}{}
+	for k, v := range pusher.Data {
+		if k != "url" {
+			data[k] = v
+		}
+	}
+	prio := "low"
+	if tweaks["highlight"] == true || tweaks["sound"] != nil || ev.Type() == "m.room.encrypted" {
+		prio = "high"
+	}
+
+	n := &pushgateway.Notification{
+		EventID: ev.EventID(),
+		RoomID:  ev.RoomID(),
+		Prio:    prio,
+		Devices: []pushgateway.Device{{
+			AppID:     pusher.AppID,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Data:      data,
+			Tweaks:    tweaks,
+		}},
+	}
+	// Pushers can ask for only the event ID, e.g. so that the contents of
+	// the event aren't seen by the push gateway.
+	if pusher.Data["format"] == "event_id_only" {
+		return n
+	}
+	n.Type = ev.Type()
+	n.Sender = ev.Sender()
+	n.SenderDisplayName = state.members[ev.Sender()]
+	n.RoomName = state.name
+	n.Content = ev.Content()
+	n.UserIsTarget = ev.StateKey() != nil && *ev.StateKey() == userID
+	return n
+}
+
+// sendNotification sends the notification to the push gateway at the given
+// URL, retrying if need be, and removes the pusher if the gateway rejects it.
+func (s *OutputRoomEventPushConsumer) sendNotification(
+	localpart string, pusher authtypes.Pusher, url string, n *pushgateway.Notification,
+) {
+	logger := log.WithFields(log.Fields{
+		"event_id": n.EventID,
+		"app_id":   pusher.AppID,
+		"url":      url,
+	})
+	ctx := context.Background()
+	rejected, err := s.gateway.NotifyWithRetry(ctx, url, n)
+	if err != nil {
+		logger.WithError(err).Warn("push: failed to send notification to push gateway")
+		return
+	}
+	for _, pushKey := range rejected {
+		if pushKey != pusher.PushKey {
+			continue
+		}
+		logger.Info("push: push gateway rejected push key, removing pusher")
+		if err = s.db.RemovePusher(ctx, localpart, pusher.AppID, pushKey); err != nil {
+			logger.WithError(err).Error("push: failed to remove rejected pusher")
+		}
+	}
+}
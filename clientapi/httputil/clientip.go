@@ -0,0 +1,61 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client which made the request. If
+// the request came through one of the trusted reverse proxies then the
+// address is taken from the X-Forwarded-For header instead. The header is
+// read from the right, skipping the addresses of trusted proxies, as anything
+// to the left of the address added by the last trusted proxy could have been
+// made up by the client.
+func ClientIP(req *http.Request, trustedProxies []*net.IPNet) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if len(trustedProxies) == 0 || !isTrustedProxy(net.ParseIP(ip), trustedProxies) {
+		return ip
+	}
+	forwardedFor := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwarded := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwarded == nil {
+			break
+		}
+		ip = forwarded.String()
+		if !isTrustedProxy(forwarded, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
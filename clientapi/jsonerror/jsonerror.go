@@ -53,6 +53,12 @@ func Forbidden(msg string) *MatrixError {
 	return &MatrixError{"M_FORBIDDEN", msg}
 }
 
+// ConsentNotGiven is an error when the client tries to access a resource
+// before the user has consented to the server's terms of service.
+func ConsentNotGiven(msg string) *MatrixError {
+	return &MatrixError{"M_CONSENT_NOT_GIVEN", msg}
+}
+
 // BadJSON is an error when the client supplies malformed JSON.
 func BadJSON(msg string) *MatrixError {
 	return &MatrixError{"M_BAD_JSON", msg}
@@ -81,6 +87,18 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when a parameter, such as a field of an event's
+// content, was invalid.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
+// BadAlias is an error when a room alias in an m.room.canonical_alias event
+// doesn't point to the room.
+func BadAlias(msg string) *MatrixError {
+	return &MatrixError{"M_BAD_ALIAS", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -137,6 +155,18 @@ func UnsupportedRoomVersion(msg string) *MatrixError {
 	return &MatrixError{"M_UNSUPPORTED_ROOM_VERSION", msg}
 }
 
+// NotYetUploaded is an error when the client downloads media which has been
+// created with the unstable MSC2246 /create endpoint but not uploaded in time.
+func NotYetUploaded(msg string) *MatrixError {
+	return &MatrixError{"FI.MAU.MSC2246_NOT_YET_UPLOADED", msg}
+}
+
+// CannotOverwriteMedia is an error when the client uploads to a media ID which
+// already has media, as per the unstable MSC2246.
+func CannotOverwriteMedia(msg string) *MatrixError {
+	return &MatrixError{"FI.MAU.MSC2246_CANNOT_OVERWRITE_MEDIA", msg}
+}
+
 // LimitExceededError is a rate-limiting error.
 type LimitExceededError struct {
 	MatrixError
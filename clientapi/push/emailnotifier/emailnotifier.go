@@ -0,0 +1,256 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package emailnotifier emails users digests of the messages that they have
+// been notified about but haven't read, for users who have added an email
+// pusher.
+package emailnotifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/push/storage"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// The kind and app ID of email pushers, whose push keys are email addresses.
+const (
+	PusherKind = "email"
+	AppID      = "m.email"
+)
+
+// PreferencesAccountDataType is the type of the account data that users can
+// set their email notification preferences with.
+const PreferencesAccountDataType = "im.dendrite.email_notifications"
+
+// UnsubscribePath is the path of the client API endpoint that the unsubscribe
+// links in emails point to.
+const UnsubscribePath = "/_matrix/client/unstable/pushers/email/unsubscribe"
+
+// The longest that event bodies can be in emails before being cut short.
+const maxBodyLength = 200
+
+// preferences are a user's email notification preferences.
+type preferences struct {
+	// Whether the user is emailed at all
+	Enabled bool `json:"enabled"`
+	// How long a notification must have been unread for before it is
+	// emailed, in milliseconds
+	DelayMS int64 `json:"delay_ms"`
+}
+
+// A Notifier periodically emails users the notifications that they haven't
+// read.
+type Notifier struct {
+	cfg       *config.Dendrite
+	db        storage.Database
+	accountDB accounts.Database
+	mailer    *threepid.Mailer
+}
+
+// NewNotifier creates a new Notifier. Call Start() to begin sending emails.
+func NewNotifier(cfg *config.Dendrite, db storage.Database, accountDB accounts.Database) *Notifier {
+	return &Notifier{
+		cfg:       cfg,
+		db:        db,
+		accountDB: accountDB,
+		mailer:    threepid.NewMailer(&cfg.Matrix.Email),
+	}
+}
+
+// Start checks for notifications to email in the background, every interval.
+func (n *Notifier) Start() {
+	go func() {
+		ticker := time.NewTicker(n.cfg.Matrix.Email.Notifications.Interval)
+		for range ticker.C {
+			n.sendDigests(context.Background(), time.Now())
+		}
+	}()
+}
+
+// sendDigests sends digests to all of the users whose notifications are due
+// to be emailed.
+func (n *Notifier) sendDigests(ctx context.Context, now time.Time) {
+	localparts, err := n.db.GetEmailNotificationLocalparts(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("email notifications: failed to get users to email")
+		return
+	}
+	for _, localpart := range localparts {
+		if err = n.sendDigest(ctx, localpart, now); err != nil {
+			logrus.WithError(err).WithField("localpart", localpart).Error(
+				"email notifications: failed to send digest",
+			)
+		}
+	}
+}
+
+// sendDigest emails the user all of their unread notifications, once the
+// oldest of them has been unread for the user's delay.
+func (n *Notifier) sendDigest(ctx context.Context, localpart string, now time.Time) error {
+	notifications, err := n.db.GetEmailNotifications(ctx, localpart)
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+	latestTS := notifications[len(notifications)-1].NotifiedTS
+
+	prefs, err := n.preferences(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	if !prefs.Enabled {
+		return n.db.RemoveEmailNotificationsBefore(ctx, localpart, latestTS)
+	}
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	if nowMS-notifications[0].NotifiedTS < prefs.DelayMS {
+		return nil
+	}
+
+	pushers, err := n.db.GetPushers(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	for _, pusher := range pushers {
+		if pusher.Kind != PusherKind {
+			continue
+		}
+		unsubscribeURL := UnsubscribeURL(n.cfg, localpart, pusher.PushKey)
+		subject, body := digest(n.cfg.Matrix.Email.Notifications.AppName, notifications, unsubscribeURL)
+		if err = n.mailer.Send(pusher.PushKey, subject, body); err != nil {
+			return err
+		}
+	}
+	return n.db.RemoveEmailNotificationsBefore(ctx, localpart, latestTS)
+}
+
+// preferences returns the user's email notification preferences, using the
+// configured defaults for anything that they haven't set.
+func (n *Notifier) preferences(ctx context.Context, localpart string) (*preferences, error) {
+	prefs := &preferences{
+		Enabled: true,
+		DelayMS: int64(n.cfg.Matrix.Email.Notifications.Delay / time.Millisecond),
+	}
+	data, err := n.accountDB.GetAccountDataByType(ctx, localpart, "", PreferencesAccountDataType)
+	if err != nil || data == nil {
+		return prefs, err
+	}
+	if err = json.Unmarshal(data.Content, prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// digest returns the subject and body of an email about the notifications,
+// grouped by room in the order of each room's first notification.
+func digest(
+	appName string, notifications []authtypes.EmailNotification, unsubscribeURL string,
+) (subject, body string) {
+	var roomIDs []string
+	byRoom := map[string][]authtypes.EmailNotification{}
+	for _, n := range notifications {
+		if _, ok := byRoom[n.RoomID]; !ok {
+			roomIDs = append(roomIDs, n.RoomID)
+		}
+		byRoom[n.RoomID] = append(byRoom[n.RoomID], n)
+	}
+
+	messages := "messages"
+	if len(notifications) == 1 {
+		messages = "message"
+	}
+	rooms := "rooms"
+	if len(roomIDs) == 1 {
+		rooms = "room"
+	}
+	subject = fmt.Sprintf("[%s] You have %d unread %s", appName, len(notifications), messages)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "You have %d unread %s in %d %s on %s.\n", len(notifications), messages, len(roomIDs), rooms, appName)
+	for _, roomID := range roomIDs {
+		roomNotifications := byRoom[roomID]
+		roomName := roomNotifications[len(roomNotifications)-1].RoomName
+		if roomName == "" {
+			roomName = roomID
+		}
+		fmt.Fprintf(&b, "\n%s:\n", roomName)
+		for _, n := range roomNotifications {
+			sender := n.SenderDisplayName
+			if sender == "" {
+				sender = n.Sender
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", sender, n.Body)
+		}
+	}
+	fmt.Fprintf(&b, "\nOpen your Matrix client to read and reply to them.\n")
+	fmt.Fprintf(&b, "\nTo stop receiving these emails, open this link:\n%s\n", unsubscribeURL)
+	return subject, b.String()
+}
+
+// Summary returns what an event says, for including in an email about it.
+func Summary(ev *gomatrixserverlib.Event) string {
+	switch ev.Type() {
+	case "m.room.message":
+		body := gjson.GetBytes(ev.Content(), "body").String()
+		if len(body) > maxBodyLength {
+			body = strings.ToValidUTF8(body[:maxBodyLength], "") + "..."
+		}
+		return body
+	case "m.room.encrypted":
+		return "sent an encrypted message"
+	case gomatrixserverlib.MRoomMember:
+		return "invited you to the room"
+	case "m.call.invite":
+		return "is calling you"
+	default:
+		return "sent an event"
+	}
+}
+
+// UnsubscribeURL returns the link that removes the user's email pusher for the
+// email address, which is included in every email sent to it.
+func UnsubscribeURL(cfg *config.Dendrite, localpart, email string) string {
+	query := url.Values{}
+	query.Set("localpart", localpart)
+	query.Set("email", email)
+	query.Set("token", unsubscribeToken(cfg, localpart, email))
+	return strings.TrimRight(cfg.Matrix.Email.PublicBaseURL, "/") + UnsubscribePath + "?" + query.Encode()
+}
+
+// ValidUnsubscribeToken returns whether the token in an unsubscribe link is
+// the one for the user and email address, which means that the link was sent
+// in an email to that address.
+func ValidUnsubscribeToken(cfg *config.Dendrite, localpart, email, token string) bool {
+	return hmac.Equal([]byte(token), []byte(unsubscribeToken(cfg, localpart, email)))
+}
+
+// unsubscribeToken signs the user and email address with the server's private
+// key, so that the links in emails don't need an access token.
+func unsubscribeToken(cfg *config.Dendrite, localpart, email string) string {
+	mac := hmac.New(sha256.New, cfg.Matrix.PrivateKey)
+	mac.Write([]byte(localpart + "\x00" + email)) // nolint: errcheck
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package emailnotifier
+
+import (
+	"crypto/ed25519"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestDigest(t *testing.T) {
+	notifications := []authtypes.EmailNotification{
+		{RoomID: "!a:test", Sender: "@alice:test", SenderDisplayName: "Alice", RoomName: "Lunch", Body: "hungry?"},
+		{RoomID: "!b:test", Sender: "@bob:test", Body: "hello"},
+		{RoomID: "!a:test", Sender: "@alice:test", SenderDisplayName: "Alice", RoomName: "Lunch", Body: "pizza"},
+	}
+	subject, body := digest("Matrix", notifications, "https://example.com/unsubscribe")
+	if subject != "[Matrix] You have 3 unread messages" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	want := "You have 3 unread messages in 2 rooms on Matrix.\n" +
+		"\nLunch:\n  Alice: hungry?\n  Alice: pizza\n" +
+		"\n!b:test:\n  @bob:test: hello\n"
+	if !strings.HasPrefix(body, want) {
+		t.Errorf("unexpected body %q", body)
+	}
+	if !strings.Contains(body, "https://example.com/unsubscribe") {
+		t.Errorf("body %q is missing the unsubscribe link", body)
+	}
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	cfg.Matrix.Email.PublicBaseURL = "https://example.com/"
+
+	u, err := url.Parse(UnsubscribeURL(cfg, "alice", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != UnsubscribePath {
+		t.Errorf("unexpected path %q", u.Path)
+	}
+	query := u.Query()
+	if !ValidUnsubscribeToken(cfg, query.Get("localpart"), query.Get("email"), query.Get("token")) {
+		t.Error("token from unsubscribe URL is not valid")
+	}
+	if ValidUnsubscribeToken(cfg, "bob", query.Get("email"), query.Get("token")) {
+		t.Error("token is valid for a different user")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package pushgateway implements a client for the push gateway API, which is
+// used to send notifications to the devices of users that have pushers.
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NotifyPath is the path of the push gateway endpoint that notifications are
+// sent to.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// A Notification is a notification about an event that is sent to a push
+// gateway, for delivery to one or more devices.
+type Notification struct {
+	EventID           string          `json:"event_id,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Prio              string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []Device        `json:"devices"`
+}
+
+// Counts are the counts of unread notifications for the user.
+type Counts struct {
+	Unread      int `json:"unread"`
+	MissedCalls int `json:"missed_calls,omitempty"`
+}
+
+// A Device is a device that a notification should be delivered to, as given
+// by one of the user's pushers.
+type Device struct {
+	AppID     string                 `json:"app_id"`
+	PushKey   string                 `json:"pushkey"`
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+type notifyRequest struct {
+	Notification *Notification `json:"notification"`
+}
+
+type notifyResponse struct {
+	Rejected []string `json:"rejected"`
+}
+
+// A StatusError is returned when a push gateway responds with an error.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("push gateway returned HTTP %d", e.StatusCode)
+}
+
+// A Client sends notifications to push gateways.
+type Client struct {
+	httpClient *http.Client
+	// How long to wait before the first retry. This doubles after every
+	// failed attempt, up to maxBackoff.
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// How many times to try to send a notification before giving up.
+	maxAttempts int
+}
+
+// NewClient creates a new push gateway client using the given HTTP client.
+func NewClient(httpClient *http.Client) *Client {
+	return &Client{
+		httpClient:     httpClient,
+		initialBackoff: time.Second,
+		maxBackoff:     5 * time.Minute,
+		maxAttempts:    10,
+	}
+}
+
+// Notify sends the notification to the push gateway at the given URL once,
+// and returns the push keys that the gateway rejected. The push gateway
+// rejects push keys that are no longer valid, and their pushers should be
+// removed.
+func (c *Client) Notify(ctx context.Context, url string, n *Notification) ([]string, error) {
+	body, err := json.Marshal(notifyRequest{Notification: n})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: res.StatusCode}
+	}
+	var response notifyResponse
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Rejected, nil
+}
+
+// NotifyWithRetry sends the notification to the push gateway at the given URL
+// like Notify, but retries with exponential backoff if the gateway can't be
+// reached or returns a server error. It blocks until the notification has been
+// sent, the gateway has rejected it, or it has been tried too many times.
+func (c *Client) NotifyWithRetry(ctx context.Context, url string, n *Notification) ([]string, error) {
+	backoff := c.initialBackoff
+	for attempt := 1; ; attempt++ {
+		rejected, err := c.Notify(ctx, url, n)
+		if err == nil || !retryable(err) || attempt >= c.maxAttempts {
+			return rejected, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// retryable returns whether sending a notification that failed with the given
+// error should be tried again. Client errors mean that the gateway won't
+// accept the notification however many times it is sent.
+func retryable(err error) bool {
+	if statusErr, ok := err.(*StatusError); ok {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyWithRetry(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var body notifyRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode notification: %s", err)
+		}
+		if body.Notification == nil || body.Notification.EventID != "$event:localhost" {
+			t.Errorf("unexpected notification: %+v", body.Notification)
+		}
+		w.Write([]byte(`{"rejected":["badkey"]}`)) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.Client())
+	c.initialBackoff = time.Millisecond
+	rejected, err := c.NotifyWithRetry(context.Background(), srv.URL+NotifyPath, &Notification{
+		EventID: "$event:localhost",
+		Devices: []Device{{AppID: "app", PushKey: "badkey"}},
+	})
+	if err != nil {
+		t.Fatalf("NotifyWithRetry failed: %s", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+	if len(rejected) != 1 || rejected[0] != "badkey" {
+		t.Errorf("got rejected push keys %v, want [badkey]", rejected)
+	}
+}
+
+func TestNotifyWithRetryClientError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.Client())
+	c.initialBackoff = time.Millisecond
+	_, err := c.NotifyWithRetry(context.Background(), srv.URL+NotifyPath, &Notification{})
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got error %v, want HTTP 400", err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+}
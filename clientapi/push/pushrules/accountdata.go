@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AccountDataType is the type of the account data that users' push rules are
+// stored as, which is also how clients are told that the rules have changed.
+const AccountDataType = "m.push_rules"
+
+// GlobalScope is the only scope of push rules, which applies to all of the
+// user's devices.
+const GlobalScope = "global"
+
+// AccountRuleSets are all of a user's push rules, keyed by scope.
+type AccountRuleSets struct {
+	Global Ruleset `json:"global"`
+}
+
+// DefaultAccountRuleSets returns the push rules of a user who hasn't changed
+// any of them.
+func DefaultAccountRuleSets(localpart, userID string) *AccountRuleSets {
+	return &AccountRuleSets{Global: *DefaultRuleset(localpart, userID)}
+}
+
+// FromAccountData returns the push rules stored in the given account data,
+// or the default push rules if the user has no push rules account data.
+func FromAccountData(data *gomatrixserverlib.ClientEvent, localpart, userID string) (*AccountRuleSets, error) {
+	if data == nil {
+		return DefaultAccountRuleSets(localpart, userID), nil
+	}
+	var ruleSets AccountRuleSets
+	if err := json.Unmarshal(data.Content, &ruleSets); err != nil {
+		return nil, err
+	}
+	return &ruleSets, nil
+}
+
+// Rules returns the rules of the given kind in the ruleset, so that they can
+// be changed, or an error if there is no such kind.
+func (rs *Ruleset) Rules(kind string) (*[]Rule, error) {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override, nil
+	case ContentKind:
+		return &rs.Content, nil
+	case RoomKind:
+		return &rs.Room, nil
+	case SenderKind:
+		return &rs.Sender, nil
+	case UnderrideKind:
+		return &rs.Underride, nil
+	default:
+		return nil, fmt.Errorf("unknown push rule kind %q", kind)
+	}
+}
+
+// FindRule returns the index of the rule with the given ID in the rules, or
+// -1 if there is no such rule.
+func FindRule(rules []Rule, ruleID string) int {
+	for i := range rules {
+		if rules[i].RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsDefaultRuleID returns whether the rule ID is that of one of the default
+// rules defined by the spec, which users can't create or delete.
+func IsDefaultRuleID(ruleID string) bool {
+	return strings.HasPrefix(ruleID, ".")
+}
+
+// ValidateActions returns an error if any of the actions are unknown.
+func ValidateActions(actions []interface{}) error {
+	for _, action := range actions {
+		switch a := action.(type) {
+		case string:
+			if a != NotifyAction && a != DontNotifyAction && a != CoalesceAction {
+				return fmt.Errorf("unknown action %q", a)
+			}
+		case map[string]interface{}:
+			if _, ok := a["set_tweak"].(string); !ok {
+				return fmt.Errorf("tweak actions must have a set_tweak string")
+			}
+		default:
+			return fmt.Errorf("actions must be strings or tweaks")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pushrules
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// The power level needed to trigger a notification if the room's power levels
+// don't say otherwise.
+const defaultNotificationPowerLevel = 50
+
+// An EvaluationContext holds the information about the room and the user being
+// notified that push rule conditions need, besides the event itself.
+type EvaluationContext struct {
+	// The user the rules are being evaluated for.
+	UserID string
+	// The user's display name in the room, if any.
+	UserDisplayName string
+	// How many users are joined to the room.
+	RoomMemberCount int
+	// The power level of the event's sender.
+	SenderPowerLevel int64
+	// The power levels needed to trigger each kind of notification, e.g. "room",
+	// from the "notifications" key of the room's power levels.
+	NotificationPowerLevels map[string]int64
+}
+
+// Match returns the first enabled rule in the ruleset that matches the event,
+// evaluating the rules kind by kind in order of priority, or nil if no rule
+// matches.
+func (rs *Ruleset) Match(event *gomatrixserverlib.Event, ec *EvaluationContext) *Rule {
+	for _, kind := range []struct {
+		name  string
+		rules []Rule
+	}{
+		{OverrideKind, rs.Override},
+		{ContentKind, rs.Content},
+		{RoomKind, rs.Room},
+		{SenderKind, rs.Sender},
+		{UnderrideKind, rs.Underride},
+	} {
+		for i := range kind.rules {
+			rule := &kind.rules[i]
+			if rule.Enabled && rule.matches(kind.name, event, ec) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) matches(kind string, event *gomatrixserverlib.Event, ec *EvaluationContext) bool {
+	switch kind {
+	case ContentKind:
+		return matchGlob(rule.Pattern, gjson.GetBytes(event.Content(), "body").String(), true)
+	case RoomKind:
+		return rule.RuleID == event.RoomID()
+	case SenderKind:
+		return rule.RuleID == event.Sender()
+	}
+	for _, condition := range rule.Conditions {
+		if !condition.matches(event, ec) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Condition) matches(event *gomatrixserverlib.Event, ec *EvaluationContext) bool {
+	switch c.Kind {
+	case EventMatchCondition:
+		value := gjson.GetBytes(event.JSON(), c.Key)
+		if !value.Exists() || value.Type != gjson.String {
+			return false
+		}
+		return matchGlob(c.Pattern, value.String(), c.Key == "content.body")
+	case ContainsDisplayNameCondition:
+		if ec.UserDisplayName == "" {
+			return false
+		}
+		body := gjson.GetBytes(event.Content(), "body").String()
+		return matchRegexp(regexp.QuoteMeta(ec.UserDisplayName), body, true)
+	case RoomMemberCountCondition:
+		return matchMemberCount(c.Is, ec.RoomMemberCount)
+	case SenderNotificationPermissionCondition:
+		level, ok := ec.NotificationPowerLevels[c.Key]
+		if !ok {
+			level = defaultNotificationPowerLevel
+		}
+		return ec.SenderPowerLevel >= level
+	default:
+		// Unknown conditions never match, so that rules with conditions
+		// from newer versions of the spec don't trigger unexpectedly.
+		return false
+	}
+}
+
+// matchGlob returns whether the value matches the glob pattern, ignoring
+// case. If words is true then the pattern only needs to match a sequence of
+// whole words in the value, otherwise it must match the entire value.
+func matchGlob(pattern, value string, words bool) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, "\\*", ".*?", -1)
+	expr = strings.Replace(expr, "\\?", ".", -1)
+	return matchRegexp(expr, value, words)
+}
+
+// matchRegexp returns whether the value matches the regular expression,
+// ignoring case, either as a sequence of whole words or in its entirety.
+func matchRegexp(expr, value string, words bool) bool {
+	if words {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = "^" + expr + "$"
+	}
+	re, err := regexp.Compile("(?is)" + expr)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// matchMemberCount returns whether the member count satisfies the "is" field
+// of a room_member_count condition, e.g. "2", "==2" or ">=10".
+func matchMemberCount(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == n
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	default:
+		return false
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package pushrules implements the push rules that decide which events a user
+// is notified about, and how.
+package pushrules
+
+// The kinds of push rule, in the order in which they are evaluated.
+const (
+	OverrideKind  = "override"
+	ContentKind   = "content"
+	RoomKind      = "room"
+	SenderKind    = "sender"
+	UnderrideKind = "underride"
+)
+
+// The kinds of condition that a push rule can have.
+const (
+	EventMatchCondition                   = "event_match"
+	ContainsDisplayNameCondition          = "contains_display_name"
+	RoomMemberCountCondition              = "room_member_count"
+	SenderNotificationPermissionCondition = "sender_notification_permission"
+)
+
+// The actions that a push rule can have, other than tweaks.
+const (
+	NotifyAction     = "notify"
+	DontNotifyAction = "dont_notify"
+	CoalesceAction   = "coalesce"
+)
+
+// A Ruleset is the set of push rules for a user, grouped by kind.
+type Ruleset struct {
+	Override  []Rule `json:"override"`
+	Content   []Rule `json:"content"`
+	Room      []Rule `json:"room"`
+	Sender    []Rule `json:"sender"`
+	Underride []Rule `json:"underride"`
+}
+
+// A Rule is a single push rule. Content rules have a pattern that is matched
+// against the body of the event, room and sender rules match the room or
+// sender given by the rule ID, and other rules have a list of conditions.
+type Rule struct {
+	RuleID     string        `json:"rule_id"`
+	Default    bool          `json:"default"`
+	Enabled    bool          `json:"enabled"`
+	Actions    []interface{} `json:"actions"`
+	Conditions []Condition   `json:"conditions,omitempty"`
+	Pattern    string        `json:"pattern,omitempty"`
+}
+
+// A Condition is a condition that an event must satisfy for a push rule to
+// match it.
+type Condition struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Is      string `json:"is,omitempty"`
+}
+
+// A Tweak is an action that sets a tweak for the notification, e.g. the sound
+// to play.
+type Tweak struct {
+	SetTweak string      `json:"set_tweak"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// DefaultRuleset returns the push rules that the spec defines for every user,
+// for the user with the given ID and localpart.
+func DefaultRuleset(localpart, userID string) *Ruleset {
+	dontNotify := []interface{}{DontNotifyAction}
+	notify := []interface{}{
+		NotifyAction,
+		Tweak{SetTweak: "highlight", Value: false},
+	}
+	notifyWithSound := []interface{}{
+		NotifyAction,
+		Tweak{SetTweak: "sound", Value: "default"},
+		Tweak{SetTweak: "highlight", Value: false},
+	}
+	highlight := []interface{}{
+		NotifyAction,
+		Tweak{SetTweak: "highlight"},
+	}
+	highlightWithSound := []interface{}{
+		NotifyAction,
+		Tweak{SetTweak: "sound", Value: "default"},
+		Tweak{SetTweak: "highlight"},
+	}
+	return &Ruleset{
+		Override: []Rule{
+			{RuleID: ".m.rule.master", Default: true, Enabled: false, Actions: dontNotify, Conditions: []Condition{}},
+			{RuleID: ".m.rule.suppress_notices", Default: true, Enabled: true, Actions: dontNotify, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "content.msgtype", Pattern: "m.notice"},
+			}},
+			{RuleID: ".m.rule.invite_for_me", Default: true, Enabled: true, Actions: notifyWithSound, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+				{Kind: EventMatchCondition, Key: "content.membership", Pattern: "invite"},
+				{Kind: EventMatchCondition, Key: "state_key", Pattern: userID},
+			}},
+			{RuleID: ".m.rule.member_event", Default: true, Enabled: true, Actions: dontNotify, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.member"},
+			}},
+			{RuleID: ".m.rule.contains_display_name", Default: true, Enabled: true, Actions: highlightWithSound, Conditions: []Condition{
+				{Kind: ContainsDisplayNameCondition},
+			}},
+			{RuleID: ".m.rule.tombstone", Default: true, Enabled: true, Actions: highlight, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.tombstone"},
+				{Kind: EventMatchCondition, Key: "state_key", Pattern: ""},
+			}},
+			{RuleID: ".m.rule.roomnotif", Default: true, Enabled: true, Actions: highlight, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "content.body", Pattern: "@room"},
+				{Kind: SenderNotificationPermissionCondition, Key: "room"},
+			}},
+		},
+		Content: []Rule{
+			{RuleID: ".m.rule.contains_user_name", Default: true, Enabled: true, Actions: highlightWithSound, Pattern: localpart},
+		},
+		Room:   []Rule{},
+		Sender: []Rule{},
+		Underride: []Rule{
+			{RuleID: ".m.rule.call", Default: true, Enabled: true, Actions: []interface{}{
+				NotifyAction,
+				Tweak{SetTweak: "sound", Value: "ring"},
+				Tweak{SetTweak: "highlight", Value: false},
+			}, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.call.invite"},
+			}},
+			{RuleID: ".m.rule.encrypted_room_one_to_one", Default: true, Enabled: true, Actions: notifyWithSound, Conditions: []Condition{
+				{Kind: RoomMemberCountCondition, Is: "2"},
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+			}},
+			{RuleID: ".m.rule.room_one_to_one", Default: true, Enabled: true, Actions: notifyWithSound, Conditions: []Condition{
+				{Kind: RoomMemberCountCondition, Is: "2"},
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+			}},
+			{RuleID: ".m.rule.message", Default: true, Enabled: true, Actions: notify, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.message"},
+			}},
+			{RuleID: ".m.rule.encrypted", Default: true, Enabled: true, Actions: notify, Conditions: []Condition{
+				{Kind: EventMatchCondition, Key: "type", Pattern: "m.room.encrypted"},
+			}},
+		},
+	}
+}
+
+// Notify returns whether the actions of a push rule notify the user.
+func Notify(actions []interface{}) bool {
+	for _, action := range actions {
+		if action == NotifyAction || action == CoalesceAction {
+			return true
+		}
+	}
+	return false
+}
+
+// Tweaks returns the tweaks set by the actions of a push rule, keyed by
+// name. A highlight tweak without a value highlights the notification.
+func Tweaks(actions []interface{}) map[string]interface{} {
+	tweaks := map[string]interface{}{}
+	for _, action := range actions {
+		switch a := action.(type) {
+		case Tweak:
+			tweaks[a.SetTweak] = tweakValue(a.SetTweak, a.Value)
+		case map[string]interface{}:
+			// Rules that have been decoded from JSON have their tweaks as maps.
+			name, ok := a["set_tweak"].(string)
+			if !ok {
+				continue
+			}
+			tweaks[name] = tweakValue(name, a["value"])
+		}
+	}
+	return tweaks
+}
+
+func tweakValue(name string, value interface{}) interface{} {
+	if value == nil && name == "highlight" {
+		return true
+	}
+	return value
+}
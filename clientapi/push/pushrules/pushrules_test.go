@@ -0,0 +1,177 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pushrules
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return &ev
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		words   bool
+		want    bool
+	}{
+		{"m.room.message", "m.room.message", false, true},
+		{"m.room.*", "m.room.message", false, true},
+		{"m.room.?essage", "m.room.message", false, true},
+		{"m.room", "m.room.message", false, false},
+		{"alice", "hello ALICE!", true, true},
+		{"alice", "hello malice", true, false},
+		{"ali*", "where is alison?", true, true},
+		{"@room", "@room wake up", true, true},
+	}
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.value, test.words); got != test.want {
+			t.Errorf("matchGlob(%q, %q, %v) = %v, want %v", test.pattern, test.value, test.words, got, test.want)
+		}
+	}
+}
+
+func TestMatchMemberCount(t *testing.T) {
+	tests := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"==2", 2, true},
+		{"<10", 9, true},
+		{">10", 10, false},
+		{">=10", 10, true},
+		{"<=1", 2, false},
+		{"!2", 2, false},
+	}
+	for _, test := range tests {
+		if got := matchMemberCount(test.is, test.count); got != test.want {
+			t.Errorf("matchMemberCount(%q, %d) = %v, want %v", test.is, test.count, got, test.want)
+		}
+	}
+}
+
+func TestDefaultRuleset(t *testing.T) {
+	rs := DefaultRuleset("alice", "@alice:localhost")
+	ec := &EvaluationContext{
+		UserID:          "@alice:localhost",
+		UserDisplayName: "Alice Liddell",
+		RoomMemberCount: 3,
+	}
+	tests := []struct {
+		name      string
+		eventJSON string
+		ruleID    string
+		notify    bool
+		highlight bool
+	}{
+		{
+			name:      "message",
+			eventJSON: `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			ruleID:    ".m.rule.message",
+			notify:    true,
+		},
+		{
+			name:      "notice",
+			eventJSON: `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$2:localhost","content":{"msgtype":"m.notice","body":"hello alice"}}`,
+			ruleID:    ".m.rule.suppress_notices",
+		},
+		{
+			name:      "display name",
+			eventJSON: `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$3:localhost","content":{"msgtype":"m.text","body":"hi alice liddell"}}`,
+			ruleID:    ".m.rule.contains_display_name",
+			notify:    true,
+			highlight: true,
+		},
+		{
+			name:      "user name",
+			eventJSON: `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$4:localhost","content":{"msgtype":"m.text","body":"hi alice"}}`,
+			ruleID:    ".m.rule.contains_user_name",
+			notify:    true,
+			highlight: true,
+		},
+		{
+			name:      "invite",
+			eventJSON: `{"type":"m.room.member","state_key":"@alice:localhost","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$5:localhost","content":{"membership":"invite"}}`,
+			ruleID:    ".m.rule.invite_for_me",
+			notify:    true,
+		},
+		{
+			name:      "room notification from unprivileged user",
+			eventJSON: `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$6:localhost","content":{"msgtype":"m.text","body":"@room hello"}}`,
+			ruleID:    ".m.rule.message",
+			notify:    true,
+		},
+	}
+	for _, test := range tests {
+		rule := rs.Match(mustEvent(t, test.eventJSON), ec)
+		if rule == nil {
+			t.Errorf("%s: no rule matched", test.name)
+			continue
+		}
+		if rule.RuleID != test.ruleID {
+			t.Errorf("%s: got rule %q, want %q", test.name, rule.RuleID, test.ruleID)
+		}
+		if got := Notify(rule.Actions); got != test.notify {
+			t.Errorf("%s: got notify %v, want %v", test.name, got, test.notify)
+		}
+		if got := Tweaks(rule.Actions)["highlight"] == true; got != test.highlight {
+			t.Errorf("%s: got highlight %v, want %v", test.name, got, test.highlight)
+		}
+	}
+}
+
+func TestFromAccountData(t *testing.T) {
+	ruleSets := DefaultAccountRuleSets("alice", "@alice:localhost")
+	ruleSets.Global.Room = append(ruleSets.Global.Room, Rule{
+		RuleID:  "!room:localhost",
+		Enabled: true,
+		Actions: []interface{}{NotifyAction, Tweak{SetTweak: "highlight"}},
+	})
+	content, err := json.Marshal(ruleSets)
+	if err != nil {
+		t.Fatalf("failed to marshal push rules: %s", err)
+	}
+	loaded, err := FromAccountData(&gomatrixserverlib.ClientEvent{Type: AccountDataType, Content: content}, "alice", "@alice:localhost")
+	if err != nil {
+		t.Fatalf("FromAccountData failed: %s", err)
+	}
+
+	// Room rules take priority over the underride rule for messages.
+	ev := mustEvent(t, `{"type":"m.room.message","room_id":"!room:localhost","sender":"@bob:localhost","event_id":"$1:localhost","content":{"msgtype":"m.text","body":"hello"}}`)
+	rule := loaded.Global.Match(ev, &EvaluationContext{UserID: "@alice:localhost", RoomMemberCount: 3})
+	if rule == nil || rule.RuleID != "!room:localhost" {
+		t.Fatalf("got rule %+v, want the room rule", rule)
+	}
+	if Tweaks(rule.Actions)["highlight"] != true {
+		t.Errorf("decoded highlight tweak was not applied")
+	}
+	if err = ValidateActions(rule.Actions); err != nil {
+		t.Errorf("ValidateActions failed for decoded actions: %s", err)
+	}
+	if err = ValidateActions([]interface{}{"bogus"}); err == nil {
+		t.Errorf("ValidateActions accepted an unknown action")
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+type Database interface {
+	common.PartitionStorer
+	GetPushers(ctx context.Context, localpart string) ([]authtypes.Pusher, error)
+	SetPusher(ctx context.Context, localpart string, pusher authtypes.Pusher) error
+	RemovePusher(ctx context.Context, localpart, appID, pushKey string) error
+	RemovePushersForOtherUsers(ctx context.Context, localpart, appID, pushKey string) error
+	IncrementNotificationCount(ctx context.Context, localpart, roomID string, highlight bool) error
+	GetNotificationCounts(ctx context.Context, localpart string) (map[string]authtypes.NotificationCounts, error)
+	ResetNotificationCounts(ctx context.Context, localpart, roomID string) error
+	AddEmailNotification(ctx context.Context, localpart string, n authtypes.EmailNotification) error
+	GetEmailNotifications(ctx context.Context, localpart string) ([]authtypes.EmailNotification, error)
+	GetEmailNotificationLocalparts(ctx context.Context) ([]string, error)
+	RemoveEmailNotificationsInRoom(ctx context.Context, localpart, roomID string) error
+	RemoveEmailNotificationsBefore(ctx context.Context, localpart string, notifiedBeforeTS int64) error
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const pushersSchema = `
+-- Stores the pushers that local users have configured for receiving push
+-- notifications
+CREATE TABLE IF NOT EXISTS pusher_pushers (
+	-- The localpart of the user the pusher belongs to
+	localpart VARCHAR(255) NOT NULL,
+	-- The ID of the application that the pusher is for
+	app_id VARCHAR(255) NOT NULL,
+	-- The key that identifies the pusher to the push gateway
+	pushkey VARCHAR(255) NOT NULL,
+	-- The kind of pusher, currently always "http"
+	kind TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	lang TEXT NOT NULL,
+	-- The JSON-encoded data for the pusher, including the gateway URL
+	data TEXT NOT NULL,
+	-- When the pusher was last set, as a unix timestamp (ms resolution)
+	pushkey_ts BIGINT NOT NULL,
+
+	PRIMARY KEY (localpart, app_id, pushkey),
+	INDEX pusher_pushers_app_id_pushkey_idx (app_id, pushkey)
+);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO pusher_pushers (localpart, app_id, pushkey, kind, app_display_name, device_display_name," +
+	" profile_tag, lang, data, pushkey_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON DUPLICATE KEY UPDATE kind = $4, app_display_name = $5," +
+	" device_display_name = $6, profile_tag = $7, lang = $8, data = $9, pushkey_ts = $10"
+
+const selectPushersByLocalpartSQL = "" +
+	"SELECT app_id, pushkey, kind, app_display_name, device_display_name, profile_tag, lang, data, pushkey_ts" +
+	" FROM pusher_pushers WHERE localpart = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM pusher_pushers WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePushersForOtherUsersSQL = "" +
+	"DELETE FROM pusher_pushers WHERE localpart != $1 AND app_id = $2 AND pushkey = $3"
+
+type pushersStatements struct {
+	upsertPusherStmt               *sql.Stmt
+	selectPushersByLocalpartStmt   *sql.Stmt
+	deletePusherStmt               *sql.Stmt
+	deletePushersForOtherUsersStmt *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersByLocalpartStmt, err = db.Prepare(selectPushersByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersForOtherUsersStmt, err = db.Prepare(deletePushersForOtherUsersSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, localpart string, pusher authtypes.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = s.upsertPusherStmt.ExecContext(
+		ctx, localpart, pusher.AppID, pusher.PushKey, pusher.Kind, pusher.AppDisplayName,
+		pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data), pusher.PushKeyTS,
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushersByLocalpart(
+	ctx context.Context, localpart string,
+) ([]authtypes.Pusher, error) {
+	rows, err := s.selectPushersByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPushersByLocalpart: rows.close() failed")
+
+	pushers := []authtypes.Pusher{}
+	for rows.Next() {
+		var pusher authtypes.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.AppID, &pusher.PushKey, &pusher.Kind, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data, &pusher.PushKeyTS,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, localpart, appID, pushKey string,
+) (err error) {
+	_, err = s.deletePusherStmt.ExecContext(ctx, localpart, appID, pushKey)
+	return
+}
+
+func (s *pushersStatements) deletePushersForOtherUsers(
+	ctx context.Context, localpart, appID, pushKey string,
+) (err error) {
+	_, err = s.deletePushersForOtherUsersStmt.ExecContext(ctx, localpart, appID, pushKey)
+	return
+}
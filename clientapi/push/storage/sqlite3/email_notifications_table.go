@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const emailNotificationsSchema = `
+-- Stores the notifications which are waiting to be emailed to local users
+-- with email pushers, until they are emailed or the user reads the room
+CREATE TABLE IF NOT EXISTS pusher_email_notifications (
+	localpart TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	sender_display_name TEXT NOT NULL,
+	room_name TEXT NOT NULL,
+	-- What the event says, e.g. the body of a message
+	body TEXT NOT NULL,
+	-- When the user was notified, as a unix timestamp (ms resolution)
+	notified_ts BIGINT NOT NULL,
+
+	PRIMARY KEY (localpart, event_id)
+);
+`
+
+const insertEmailNotificationSQL = "" +
+	"INSERT INTO pusher_email_notifications (localpart, room_id, event_id, sender, sender_display_name," +
+	" room_name, body, notified_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectEmailNotificationsSQL = "" +
+	"SELECT room_id, event_id, sender, sender_display_name, room_name, body, notified_ts" +
+	" FROM pusher_email_notifications WHERE localpart = $1 ORDER BY notified_ts ASC"
+
+const selectEmailNotificationLocalpartsSQL = "" +
+	"SELECT DISTINCT localpart FROM pusher_email_notifications"
+
+const deleteEmailNotificationsInRoomSQL = "" +
+	"DELETE FROM pusher_email_notifications WHERE localpart = $1 AND room_id = $2"
+
+const deleteEmailNotificationsBeforeSQL = "" +
+	"DELETE FROM pusher_email_notifications WHERE localpart = $1 AND notified_ts <= $2"
+
+type emailNotificationsStatements struct {
+	insertEmailNotificationStmt           *sql.Stmt
+	selectEmailNotificationsStmt          *sql.Stmt
+	selectEmailNotificationLocalpartsStmt *sql.Stmt
+	deleteEmailNotificationsInRoomStmt    *sql.Stmt
+	deleteEmailNotificationsBeforeStmt    *sql.Stmt
+}
+
+func (s *emailNotificationsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertEmailNotificationStmt, err = db.Prepare(insertEmailNotificationSQL); err != nil {
+		return
+	}
+	if s.selectEmailNotificationsStmt, err = db.Prepare(selectEmailNotificationsSQL); err != nil {
+		return
+	}
+	if s.selectEmailNotificationLocalpartsStmt, err = db.Prepare(selectEmailNotificationLocalpartsSQL); err != nil {
+		return
+	}
+	if s.deleteEmailNotificationsInRoomStmt, err = db.Prepare(deleteEmailNotificationsInRoomSQL); err != nil {
+		return
+	}
+	if s.deleteEmailNotificationsBeforeStmt, err = db.Prepare(deleteEmailNotificationsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *emailNotificationsStatements) insertEmailNotification(
+	ctx context.Context, localpart string, n authtypes.EmailNotification,
+) (err error) {
+	_, err = s.insertEmailNotificationStmt.ExecContext(
+		ctx, localpart, n.RoomID, n.EventID, n.Sender, n.SenderDisplayName, n.RoomName, n.Body, n.NotifiedTS,
+	)
+	return
+}
+
+func (s *emailNotificationsStatements) selectEmailNotifications(
+	ctx context.Context, localpart string,
+) ([]authtypes.EmailNotification, error) {
+	rows, err := s.selectEmailNotificationsStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEmailNotifications: rows.close() failed")
+
+	var notifications []authtypes.EmailNotification
+	for rows.Next() {
+		var n authtypes.EmailNotification
+		if err = rows.Scan(
+			&n.RoomID, &n.EventID, &n.Sender, &n.SenderDisplayName, &n.RoomName, &n.Body, &n.NotifiedTS,
+		); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *emailNotificationsStatements) selectEmailNotificationLocalparts(
+	ctx context.Context,
+) ([]string, error) {
+	rows, err := s.selectEmailNotificationLocalpartsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEmailNotificationLocalparts: rows.close() failed")
+
+	var localparts []string
+	for rows.Next() {
+		var localpart string
+		if err = rows.Scan(&localpart); err != nil {
+			return nil, err
+		}
+		localparts = append(localparts, localpart)
+	}
+	return localparts, rows.Err()
+}
+
+func (s *emailNotificationsStatements) deleteEmailNotificationsInRoom(
+	ctx context.Context, localpart, roomID string,
+) (err error) {
+	_, err = s.deleteEmailNotificationsInRoomStmt.ExecContext(ctx, localpart, roomID)
+	return
+}
+
+func (s *emailNotificationsStatements) deleteEmailNotificationsBefore(
+	ctx context.Context, localpart string, notifiedBeforeTS int64,
+) (err error) {
+	_, err = s.deleteEmailNotificationsBeforeStmt.ExecContext(ctx, localpart, notifiedBeforeTS)
+	return
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const notificationCountsSchema = `
+-- Stores how many unread notifications local users have in each room
+CREATE TABLE IF NOT EXISTS pusher_notification_counts (
+	localpart TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- How many events the user has been notified about since they last read the room
+	notification_count BIGINT NOT NULL,
+	-- How many of those notifications were highlighted
+	highlight_count BIGINT NOT NULL,
+
+	PRIMARY KEY (localpart, room_id)
+);
+`
+
+const incrementNotificationCountSQL = "" +
+	"INSERT INTO pusher_notification_counts (localpart, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT (localpart, room_id) DO UPDATE SET" +
+	" notification_count = pusher_notification_counts.notification_count + 1," +
+	" highlight_count = pusher_notification_counts.highlight_count + $3"
+
+const selectNotificationCountsSQL = "" +
+	"SELECT room_id, notification_count, highlight_count FROM pusher_notification_counts WHERE localpart = $1"
+
+const deleteNotificationCountsSQL = "" +
+	"DELETE FROM pusher_notification_counts WHERE localpart = $1 AND room_id = $2"
+
+type notificationCountsStatements struct {
+	incrementNotificationCountStmt *sql.Stmt
+	selectNotificationCountsStmt   *sql.Stmt
+	deleteNotificationCountsStmt   *sql.Stmt
+}
+
+func (s *notificationCountsStatements) prepare(db *sql.DB) (err error) {
+	if s.incrementNotificationCountStmt, err = db.Prepare(incrementNotificationCountSQL); err != nil {
+		return
+	}
+	if s.selectNotificationCountsStmt, err = db.Prepare(selectNotificationCountsSQL); err != nil {
+		return
+	}
+	if s.deleteNotificationCountsStmt, err = db.Prepare(deleteNotificationCountsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notificationCountsStatements) incrementNotificationCount(
+	ctx context.Context, localpart, roomID string, highlight bool,
+) (err error) {
+	highlights := 0
+	if highlight {
+		highlights = 1
+	}
+	_, err = s.incrementNotificationCountStmt.ExecContext(ctx, localpart, roomID, highlights)
+	return
+}
+
+func (s *notificationCountsStatements) selectNotificationCounts(
+	ctx context.Context, localpart string,
+) (map[string]authtypes.NotificationCounts, error) {
+	rows, err := s.selectNotificationCountsStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectNotificationCounts: rows.close() failed")
+
+	counts := map[string]authtypes.NotificationCounts{}
+	for rows.Next() {
+		var roomID string
+		var c authtypes.NotificationCounts
+		if err = rows.Scan(&roomID, &c.NotificationCount, &c.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = c
+	}
+	return counts, rows.Err()
+}
+
+func (s *notificationCountsStatements) deleteNotificationCounts(
+	ctx context.Context, localpart, roomID string,
+) (err error) {
+	_, err = s.deleteNotificationCountsStmt.ExecContext(ctx, localpart, roomID)
+	return
+}
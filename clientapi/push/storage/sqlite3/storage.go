@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// Database represents a push database.
+type Database struct {
+	db *sql.DB
+	common.PartitionOffsetStatements
+	pushers            pushersStatements
+	notificationCounts notificationCountsStatements
+	emailNotifications emailNotificationsStatements
+}
+
+// NewDatabase creates a new push database
+func NewDatabase(dataSourceName string) (*Database, error) {
+	var db *sql.DB
+	var err error
+	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, nil); err != nil {
+		return nil, err
+	}
+	if err = sqlutil.NewMigrator(db, "push", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
+	partitions := common.PartitionOffsetStatements{}
+	if err = partitions.Prepare(db, "push"); err != nil {
+		return nil, err
+	}
+	p := pushersStatements{}
+	if err = p.prepare(db); err != nil {
+		return nil, err
+	}
+	nc := notificationCountsStatements{}
+	if err = nc.prepare(db); err != nil {
+		return nil, err
+	}
+	en := emailNotificationsStatements{}
+	if err = en.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, p, nc, en}, nil
+}
+
+// GetPushers returns the pushers for the user with the given localpart.
+func (d *Database) GetPushers(
+	ctx context.Context, localpart string,
+) ([]authtypes.Pusher, error) {
+	return d.pushers.selectPushersByLocalpart(ctx, localpart)
+}
+
+// SetPusher creates the given pusher for the user with the given localpart,
+// or updates it if the user already has a pusher with the same app ID and
+// push key.
+func (d *Database) SetPusher(
+	ctx context.Context, localpart string, pusher authtypes.Pusher,
+) error {
+	return d.pushers.upsertPusher(ctx, localpart, pusher)
+}
+
+// RemovePusher removes the pusher with the given app ID and push key for the
+// user with the given localpart, if there is one.
+func (d *Database) RemovePusher(
+	ctx context.Context, localpart, appID, pushKey string,
+) error {
+	return d.pushers.deletePusher(ctx, localpart, appID, pushKey)
+}
+
+// RemovePushersForOtherUsers removes the pushers with the given app ID and
+// push key for every user other than the one with the given localpart.
+func (d *Database) RemovePushersForOtherUsers(
+	ctx context.Context, localpart, appID, pushKey string,
+) error {
+	return d.pushers.deletePushersForOtherUsers(ctx, localpart, appID, pushKey)
+}
+
+// IncrementNotificationCount records that the user with the given localpart
+// has been notified about another event in the room.
+func (d *Database) IncrementNotificationCount(
+	ctx context.Context, localpart, roomID string, highlight bool,
+) error {
+	return d.notificationCounts.incrementNotificationCount(ctx, localpart, roomID, highlight)
+}
+
+// GetNotificationCounts returns the unread notification counts of the user
+// with the given localpart, keyed by room ID. Rooms without any unread
+// notifications are left out.
+func (d *Database) GetNotificationCounts(
+	ctx context.Context, localpart string,
+) (map[string]authtypes.NotificationCounts, error) {
+	return d.notificationCounts.selectNotificationCounts(ctx, localpart)
+}
+
+// ResetNotificationCounts records that the user with the given localpart has
+// read all of the events in the room.
+func (d *Database) ResetNotificationCounts(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.notificationCounts.deleteNotificationCounts(ctx, localpart, roomID)
+}
+
+// AddEmailNotification records a notification which is waiting to be emailed
+// to the user with the given localpart.
+func (d *Database) AddEmailNotification(
+	ctx context.Context, localpart string, n authtypes.EmailNotification,
+) error {
+	return d.emailNotifications.insertEmailNotification(ctx, localpart, n)
+}
+
+// GetEmailNotifications returns the notifications which are waiting to be
+// emailed to the user with the given localpart, oldest first.
+func (d *Database) GetEmailNotifications(
+	ctx context.Context, localpart string,
+) ([]authtypes.EmailNotification, error) {
+	return d.emailNotifications.selectEmailNotifications(ctx, localpart)
+}
+
+// GetEmailNotificationLocalparts returns the localparts of the users who have
+// notifications waiting to be emailed to them.
+func (d *Database) GetEmailNotificationLocalparts(ctx context.Context) ([]string, error) {
+	return d.emailNotifications.selectEmailNotificationLocalparts(ctx)
+}
+
+// RemoveEmailNotificationsInRoom removes the notifications about events in
+// the room which are waiting to be emailed to the user with the given
+// localpart, e.g. because they have read the room.
+func (d *Database) RemoveEmailNotificationsInRoom(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.emailNotifications.deleteEmailNotificationsInRoom(ctx, localpart, roomID)
+}
+
+// RemoveEmailNotificationsBefore removes the notifications for the user with
+// the given localpart from the given time or before, once they have been
+// emailed.
+func (d *Database) RemoveEmailNotificationsBefore(
+	ctx context.Context, localpart string, notifiedBeforeTS int64,
+) error {
+	return d.emailNotifications.deleteEmailNotificationsBefore(ctx, localpart, notifiedBeforeTS)
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit limits how often users and IP addresses may make requests
+// to each class of client API endpoints.
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// sweepInterval is how often buckets which have refilled are forgotten, so
+// that the limiters don't grow forever.
+const sweepInterval = time.Minute
+
+// Limiter limits requests with a token bucket for each user or IP address.
+// Each request takes a token, and the buckets are refilled at a constant rate
+// up to the burst size.
+type Limiter struct {
+	perSecond float64
+	burst     float64
+	now       func() time.Time
+
+	sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewLimiter returns a limiter with the given limits.
+func NewLimiter(limit config.RateLimit) *Limiter {
+	return &Limiter{
+		perSecond: limit.PerSecond,
+		burst:     float64(limit.Burst),
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key's bucket. Returns whether there was one,
+// and if not, how long it will be until there is.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.perSecond <= 0 {
+		return false, sweepInterval
+	}
+	wait := time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+	return false, wait
+}
+
+// refill returns how many tokens the bucket has at the given time.
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*l.perSecond
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// sweep forgets the buckets which are full, as they're the same as new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Class is a class of client API endpoints which share a limit.
+type Class int
+
+// The classes of client API endpoints.
+const (
+	Login Class = iota
+	Registration
+	Messaging
+	Joins
+	ThreePIDValidation
+)
+
+// RateLimits are the limiters for each class of client API endpoints.
+type RateLimits struct {
+	limiters map[Class]*Limiter
+	// The access tokens of the application services whose users aren't
+	// rate limited
+	exemptASTokens map[string]bool
+	// The reverse proxies trusted to give the address of the client
+	trustedProxies []*net.IPNet
+}
+
+// NewRateLimits returns the configured rate limits, or nil if rate limiting is
+// disabled. Methods on a nil *RateLimits never limit requests.
+func NewRateLimits(cfg *config.Dendrite) *RateLimits {
+	if !cfg.Matrix.RateLimiting.Enabled {
+		return nil
+	}
+	r := &RateLimits{
+		limiters: map[Class]*Limiter{
+			Login:              NewLimiter(cfg.Matrix.RateLimiting.Login),
+			Registration:       NewLimiter(cfg.Matrix.RateLimiting.Registration),
+			Messaging:          NewLimiter(cfg.Matrix.RateLimiting.Messaging),
+			Joins:              NewLimiter(cfg.Matrix.RateLimiting.Joins),
+			ThreePIDValidation: NewLimiter(cfg.Matrix.RateLimiting.ThreePIDValidation),
+		},
+		exemptASTokens: make(map[string]bool),
+		trustedProxies: cfg.Derived.TrustedProxies,
+	}
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		if !appservice.RateLimited {
+			r.exemptASTokens[appservice.ASToken] = true
+		}
+	}
+	return r
+}
+
+// LimitDevice returns an error response if the device's user has exceeded
+// the limits of the class. Users of application services which aren't rate
+// limited are exempt.
+func (r *RateLimits) LimitDevice(class Class, device *authtypes.Device) *util.JSONResponse {
+	if r == nil {
+		return nil
+	}
+	if device.ID == types.AppServiceDeviceID && r.exemptASTokens[device.AccessToken] {
+		return nil
+	}
+	return limit(r.limiters[class], device.UserID)
+}
+
+// LimitIP returns an error response if the IP address which the request came
+// from has exceeded the limits of the class. Requests through trusted reverse
+// proxies are limited by the address of the client the proxy gives.
+func (r *RateLimits) LimitIP(class Class, req *http.Request) *util.JSONResponse {
+	if r == nil {
+		return nil
+	}
+	return limit(r.limiters[class], httputil.ClientIP(req, r.trustedProxies))
+}
+
+func limit(l *Limiter, key string) *util.JSONResponse {
+	if ok, wait := l.Allow(key); !ok {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many requests", int64(wait/time.Millisecond)),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(config.RateLimit{PerSecond: 0.5, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("@alice:localhost"); !ok {
+			t.Fatalf("request %d in the burst was limited", i)
+		}
+	}
+	ok, wait := l.Allow("@alice:localhost")
+	if ok || wait != 2*time.Second {
+		t.Errorf("expected to wait 2s after the burst, got %v, %s", ok, wait)
+	}
+	if ok, _ = l.Allow("@bob:localhost"); !ok {
+		t.Error("another user was limited")
+	}
+
+	now = now.Add(2 * time.Second)
+	if ok, _ = l.Allow("@alice:localhost"); !ok {
+		t.Error("request after waiting was limited")
+	}
+
+	now = now.Add(2 * sweepInterval)
+	l.Allow("@carol:localhost")
+	if _, ok := l.buckets["@alice:localhost"]; ok {
+		t.Error("full bucket wasn't swept")
+	}
+}
+
+func TestRateLimitsExemptAppServices(t *testing.T) {
+	var cfg config.Dendrite
+	cfg.Matrix.RateLimiting.Enabled = true
+	cfg.Matrix.RateLimiting.Messaging = config.RateLimit{PerSecond: 0, Burst: 1}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ASToken: "exempt", RateLimited: false},
+		{ASToken: "limited", RateLimited: true},
+	}
+	r := NewRateLimits(&cfg)
+
+	exempt := &authtypes.Device{ID: types.AppServiceDeviceID, UserID: "@bridge:localhost", AccessToken: "exempt"}
+	limited := &authtypes.Device{ID: types.AppServiceDeviceID, UserID: "@irc:localhost", AccessToken: "limited"}
+	for i := 0; i < 2; i++ {
+		if resErr := r.LimitDevice(Messaging, exempt); resErr != nil {
+			t.Errorf("exempt application service user was limited: %v", resErr.JSON)
+		}
+	}
+	r.LimitDevice(Messaging, limited)
+	if resErr := r.LimitDevice(Messaging, limited); resErr == nil || resErr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected application service user to be limited, got %v", resErr)
+	}
+
+	var disabled *RateLimits
+	if resErr := disabled.LimitDevice(Messaging, limited); resErr != nil {
+		t.Error("disabled rate limits limited a request")
+	}
+}
+
+func TestRateLimitsTrustedProxies(t *testing.T) {
+	var cfg config.Dendrite
+	cfg.Matrix.RateLimiting.Enabled = true
+	cfg.Matrix.RateLimiting.Login = config.RateLimit{PerSecond: 0, Burst: 1}
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg.Derived.TrustedProxies = []*net.IPNet{proxies}
+	r := NewRateLimits(&cfg)
+
+	request := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for _, header := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		return req
+	}
+
+	// Clients behind the proxy are limited separately.
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		if resErr := r.LimitIP(Login, request("10.0.0.1:1234", client)); resErr != nil {
+			t.Errorf("first request from %s was limited", client)
+		}
+	}
+	// The client can't get around the limit by making up addresses, as only
+	// the address added by the trusted proxies is used, even if it was added
+	// by a chain of them.
+	if resErr := r.LimitIP(Login, request("10.0.0.1:1234", "198.51.100.1, 192.0.2.1", "10.0.0.2")); resErr == nil {
+		t.Error("client was able to choose its address")
+	}
+	// Untrusted servers can't give the address of the client.
+	if resErr := r.LimitIP(Login, request("203.0.113.1:1234", "192.0.2.3")); resErr != nil {
+		t.Error("first request from an untrusted server was limited")
+	}
+	if resErr := r.LimitIP(Login, request("203.0.113.1:1234", "192.0.2.4")); resErr == nil {
+		t.Error("untrusted server was able to choose the client's address")
+	}
+}
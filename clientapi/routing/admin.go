@@ -0,0 +1,240 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+// validRegistrationTokenRegex matches the characters which registration tokens
+// may contain.
+var validRegistrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+type createRegistrationTokenRequest struct {
+	// The token to create. A random token of the given length is generated if
+	// it isn't set.
+	Token       string `json:"token"`
+	Length      int    `json:"length"`
+	UsesAllowed *int   `json:"uses_allowed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+type registrationTokensResponse struct {
+	RegistrationTokens []authtypes.RegistrationToken `json:"registration_tokens"`
+}
+
+// checkAdmin returns an error response unless the device belongs to one of
+// the server's administrators.
+func checkAdmin(device *authtypes.Device, cfg *config.Dendrite) *util.JSONResponse {
+	if !cfg.IsAdmin(device.UserID) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	}
+	return nil
+}
+
+// GetRegistrationTokens implements GET /_dendrite/admin/v1/registrationTokens
+func GetRegistrationTokens(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: registrationTokensResponse{tokens},
+	}
+}
+
+// CreateRegistrationToken implements POST /_dendrite/admin/v1/registrationTokens/new
+func CreateRegistrationToken(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r createRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if r.Token == "" {
+		if r.Length == 0 {
+			r.Length = defaultRegistrationTokenLength
+		}
+		if r.Length < 0 || r.Length > maxRegistrationTokenLength {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("'length' must be between 1 and 64"),
+			}
+		}
+		var err error
+		if r.Token, err = generateRegistrationToken(r.Length); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("generateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+	} else if len(r.Token) > maxRegistrationTokenLength || !validRegistrationTokenRegex.MatchString(r.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'token' must be at most 64 characters from [A-Za-z0-9._~-]"),
+		}
+	}
+	if r.UsesAllowed != nil && *r.UsesAllowed < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'uses_allowed' must not be negative"),
+		}
+	}
+	if r.ExpiryTime != nil && *r.ExpiryTime < time.Now().UnixNano()/int64(time.Millisecond) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'expiry_time' must not be in the past"),
+		}
+	}
+
+	existing, err := accountDB.GetRegistrationToken(req.Context(), r.Token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if existing != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Registration token already exists"),
+		}
+	}
+
+	token := authtypes.RegistrationToken{
+		Token:       r.Token,
+		UsesAllowed: r.UsesAllowed,
+		ExpiryTime:  r.ExpiryTime,
+	}
+	if err = accountDB.CreateRegistrationToken(req.Context(), &token); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: token,
+	}
+}
+
+// GetRegistrationToken implements GET /_dendrite/admin/v1/registrationTokens/{token}
+func GetRegistrationToken(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+	token string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if regToken == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: regToken,
+	}
+}
+
+// DeleteRegistrationToken implements DELETE /_dendrite/admin/v1/registrationTokens/{token}
+func DeleteRegistrationToken(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+	token string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if regToken == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	if err = accountDB.RemoveRegistrationToken(req.Context(), token); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// RegistrationTokenValidity implements GET /register/m.login.registration_token/validity
+func RegistrationTokenValidity(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'token' must be supplied."),
+		}
+	}
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Valid bool `json:"valid"`
+		}{regToken != nil && regToken.IsValid(time.Now().UnixNano()/int64(time.Millisecond))},
+	}
+}
+
+// generateRegistrationToken returns a random token of the given length.
+func generateRegistrationToken(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:length], nil
+}
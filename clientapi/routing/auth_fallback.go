@@ -19,6 +19,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/util"
@@ -31,7 +32,7 @@ const recaptchaTemplate = `
 <title>Authentication</title>
 <meta name='viewport' content='width=device-width, initial-scale=1,
     user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
-<script src="https://www.google.com/recaptcha/api.js"
+<script src="{{.scriptURL}}"
     async defer></script>
 <script src="//code.jquery.com/jquery-1.11.2.min.js"></script>
 <script>
@@ -51,7 +52,7 @@ function captchaDone() {
         Please verify that you're not a robot.
         </p>
 		<input type="hidden" name="session" value="{{.session}}" />
-        <div class="g-recaptcha"
+        <div class="{{.captchaClass}}"
             data-sitekey="{{.siteKey}}"
             data-callback="captchaDone">
         </div>
@@ -101,7 +102,7 @@ func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]s
 // AuthFallback implements GET and POST /auth/{authType}/fallback/web?session={sessionID}
 func AuthFallback(
 	w http.ResponseWriter, req *http.Request, authType string,
-	cfg *config.Dendrite,
+	ssoProvider *sso.Provider, cfg *config.Dendrite,
 ) *util.JSONResponse {
 	sessionID := req.URL.Query().Get("session")
 
@@ -114,9 +115,11 @@ func AuthFallback(
 
 	serveRecaptcha := func() {
 		data := map[string]string{
-			"myUrl":   req.URL.String(),
-			"session": sessionID,
-			"siteKey": cfg.Matrix.RecaptchaPublicKey,
+			"myUrl":        req.URL.String(),
+			"session":      sessionID,
+			"siteKey":      cfg.Matrix.RecaptchaPublicKey,
+			"scriptURL":    cfg.Matrix.CaptchaScriptURL,
+			"captchaClass": cfg.Matrix.CaptchaClass,
 		}
 		serveTemplate(w, recaptchaTemplate, data)
 	}
@@ -136,6 +139,17 @@ func AuthFallback(
 			serveRecaptcha()
 			return nil
 		}
+		// Handle single sign-on, which is completed by the callback once the
+		// user has signed on at the identity provider.
+		if authType == authtypes.LoginTypeSSO {
+			if ssoProvider == nil {
+				return writeHTTPMessage(w, req,
+					"Single sign-on is disabled on this Homeserver",
+					http.StatusBadRequest,
+				)
+			}
+			return redirectToProvider(w, req, ssoProvider, "", sessionID)
+		}
 		return &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Unknown auth stage type"),
@@ -155,8 +169,8 @@ func AuthFallback(
 				return &res
 			}
 
-			response := req.Form.Get("g-recaptcha-response")
-			if err := validateRecaptcha(cfg, response, clientIP); err != nil {
+			response := req.Form.Get(cfg.Matrix.CaptchaResponseField)
+			if err := validateRecaptcha(req.Context(), cfg, response, clientIP); err != nil {
 				util.GetLogger(req.Context()).Error(err)
 				return err
 			}
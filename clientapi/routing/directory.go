@@ -15,12 +15,14 @@
 package routing
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -232,3 +234,66 @@ func RemoveLocalAlias(
 		JSON: struct{}{},
 	}
 }
+
+// GetAliases implements GET /rooms/{roomID}/aliases, which returns all of the
+// local aliases of the room. Only members of the room can see them, unless
+// the room's history is world-readable.
+func GetAliases(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	membershipReq := roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if !membershipRes.IsInRoom {
+		stateReq := roomserverAPI.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+			},
+		}
+		var stateRes roomserverAPI.QueryLatestEventsAndStateResponse
+		if err := rsAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+			return jsonerror.InternalServerError()
+		}
+		var content common.HistoryVisibilityContent
+		if len(stateRes.StateEvents) > 0 {
+			if err := json.Unmarshal(stateRes.StateEvents[0].Content(), &content); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		if content.HistoryVisibility != "world_readable" {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room and its history isn't world-readable"),
+			}
+		}
+	}
+
+	aliasesReq := roomserverAPI.GetAliasesForRoomIDRequest{RoomID: roomID}
+	var aliasesRes roomserverAPI.GetAliasesForRoomIDResponse
+	if err := rsAPI.GetAliasesForRoomID(req.Context(), &aliasesReq, &aliasesRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+	if aliasesRes.Aliases == nil {
+		aliasesRes.Aliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Aliases []string `json:"aliases"`
+		}{aliasesRes.Aliases},
+	}
+}
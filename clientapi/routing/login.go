@@ -15,12 +15,16 @@
 package routing
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 
 	"context"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/jwt"
+	"github.com/matrix-org/dendrite/clientapi/auth/ldap"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -46,8 +50,11 @@ type loginIdentifier struct {
 }
 
 type passwordRequest struct {
+	Type       string          `json:"type"`
 	Identifier loginIdentifier `json:"identifier"`
 	Password   string          `json:"password"`
+	// The login token from single sign-on, if Type is m.login.token
+	Token string `json:"token"`
 	// Both DeviceID and InitialDisplayName can be omitted, or empty strings ("")
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
@@ -68,15 +75,41 @@ func passwordLogin() loginFlows {
 	return f
 }
 
+// ssoLogin adds the flows for logging in by single sign-on, where the client
+// sends the user to /login/sso/redirect, or /login/cas/redirect for CAS, and
+// then logs in with the login token which it is given back.
+func ssoLogin(f loginFlows, cfg *config.Dendrite) loginFlows {
+	if cfg.Matrix.CAS.Enabled {
+		f.Flows = append(f.Flows, flow{authtypes.LoginTypeCAS, []string{authtypes.LoginTypeCAS}})
+	}
+	f.Flows = append(f.Flows,
+		flow{authtypes.LoginTypeSSO, []string{authtypes.LoginTypeSSO}},
+		flow{authtypes.LoginTypeToken, []string{authtypes.LoginTypeToken}},
+	)
+	return f
+}
+
+// ssoEnabled returns whether users can log in by single sign-on.
+func ssoEnabled(cfg *config.Dendrite) bool {
+	return cfg.Matrix.OpenIDConnect.Enabled || cfg.Matrix.CAS.Enabled
+}
+
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
-	cfg *config.Dendrite,
+	ldapAuth *ldap.Authenticator, jwtVerifier *jwt.Verifier, cfg *config.Dendrite,
 ) util.JSONResponse {
-	if req.Method == http.MethodGet { // TODO: support other forms of login other than password, depending on config options
+	if req.Method == http.MethodGet {
+		flows := passwordLogin()
+		if ssoEnabled(cfg) {
+			flows = ssoLogin(flows, cfg)
+		}
+		if jwtVerifier != nil {
+			flows.Flows = append(flows.Flows, flow{authtypes.LoginTypeJWT, []string{authtypes.LoginTypeJWT}})
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: flows,
 		}
 	} else if req.Method == http.MethodPost {
 		var r passwordRequest
@@ -85,8 +118,32 @@ func Login(
 		if resErr != nil {
 			return *resErr
 		}
-		switch r.Identifier.Type {
-		case "m.id.user":
+		switch {
+		case r.Type == authtypes.LoginTypeToken:
+			localpart, ok := ssoSessions.takeLoginToken(r.Token)
+			if !ok || !ssoEnabled(cfg) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("login token is invalid or has expired"),
+				}
+			}
+			var err error
+			acc, err = accountDB.GetAccountByLocalpart(req.Context(), localpart)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+				return jsonerror.InternalServerError()
+			}
+		case r.Type == authtypes.LoginTypeJWT && jwtVerifier != nil:
+			var err error
+			acc, err = authenticateJWT(req.Context(), accountDB, jwtVerifier, r.Token, cfg)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Info("JWT login failed")
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("token is invalid, or the account does not exist"),
+				}
+			}
+		case r.Identifier.Type == "m.id.user":
 			if r.Identifier.User == "" {
 				return util.JSONResponse{
 					Code: http.StatusBadRequest,
@@ -104,8 +161,12 @@ func Login(
 				}
 			}
 
-			acc, err = accountDB.GetAccountByPassword(req.Context(), localpart, r.Password)
+			if resErr := reserveLoginAttempt(req, accountDB, localpart, cfg); resErr != nil {
+				return *resErr
+			}
+			acc, err = authenticatePassword(req.Context(), accountDB, ldapAuth, localpart, r.Password, cfg)
 			if err != nil {
+				logLoginFailure(req, accountDB, localpart, cfg)
 				// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
 				// but that would leak the existence of the user.
 				return util.JSONResponse{
@@ -113,12 +174,14 @@ func Login(
 					JSON: jsonerror.Forbidden("username or password was incorrect, or the account does not exist"),
 				}
 			}
+			releaseLoginAttempt(req, accountDB, localpart, cfg)
 		default:
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
 				JSON: jsonerror.BadJSON("login identifier '" + r.Identifier.Type + "' not supported"),
 			}
 		}
+		clearLoginFailures(req, accountDB, acc.Localpart, cfg)
 
 		token, err := auth.GenerateAccessToken()
 		if err != nil {
@@ -150,6 +213,88 @@ func Login(
 	}
 }
 
+// authenticatePassword returns the account with the given localpart if the
+// password is right. If LDAP is enabled then the password is checked with the
+// LDAP server first, falling back to the local password if the LDAP server
+// doesn't know the user or can't be reached.
+func authenticatePassword(
+	ctx context.Context, accountDB accounts.Database, ldapAuth *ldap.Authenticator,
+	localpart, password string, cfg *config.Dendrite,
+) (*authtypes.Account, error) {
+	if ldapAuth == nil {
+		return accountDB.GetAccountByPassword(ctx, localpart, password)
+	}
+	user, err := ldapAuth.Authenticate(ctx, localpart, password)
+	switch err {
+	case nil:
+	case ldap.ErrInvalidCredentials:
+		return nil, err
+	case ldap.ErrUserNotFound:
+		return accountDB.GetAccountByPassword(ctx, localpart, password)
+	default:
+		util.GetLogger(ctx).WithError(err).Error("ldapAuth.Authenticate failed")
+		return accountDB.GetAccountByPassword(ctx, localpart, password)
+	}
+
+	return getOrCreateAccount(
+		ctx, accountDB, localpart, user.Attribute(cfg.Matrix.LDAP.DisplayNameAttribute),
+		cfg.Matrix.LDAP.CreateAccounts, cfg,
+	)
+}
+
+// authenticateJWT returns the account of the user who the JSON Web Token was
+// issued to, creating it if it doesn't exist and that is configured.
+func authenticateJWT(
+	ctx context.Context, accountDB accounts.Database, jwtVerifier *jwt.Verifier,
+	token string, cfg *config.Dendrite,
+) (*authtypes.Account, error) {
+	claims, err := jwtVerifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	localpart, err := userutil.ParseUsernameParam(claims.String(cfg.Matrix.JWT.SubjectClaim), &cfg.Matrix.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if validateUsername(localpart) != nil {
+		return nil, fmt.Errorf("invalid localpart %q", localpart)
+	}
+	return getOrCreateAccount(
+		ctx, accountDB, localpart, claims.String(cfg.Matrix.JWT.DisplayNameClaim),
+		cfg.Matrix.JWT.CreateAccounts, cfg,
+	)
+}
+
+// getOrCreateAccount returns the account with the given localpart. If it
+// doesn't exist and create is true then it is created, without a password
+// since the user is authenticated by something else.
+func getOrCreateAccount(
+	ctx context.Context, accountDB accounts.Database, localpart, displayName string,
+	create bool, cfg *config.Dendrite,
+) (*authtypes.Account, error) {
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err != sql.ErrNoRows || !create {
+		return acc, err
+	}
+	if UsernameMatchesExclusiveNamespaces(cfg, localpart) {
+		return nil, err
+	}
+	// CreateAccount returns a nil account if another login created it first.
+	if acc, err = accountDB.CreateAccount(ctx, localpart, "", ""); err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		return accountDB.GetAccountByLocalpart(ctx, localpart)
+	}
+	if displayName != "" {
+		if err = accountDB.SetDisplayName(ctx, localpart, displayName); err != nil {
+			return nil, err
+		}
+	}
+	amtRegUsers.Inc()
+	return acc, nil
+}
+
 // getDevice returns a new or existing device
 func getDevice(
 	ctx context.Context,
@@ -0,0 +1,213 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The kinds of subject which failed login attempts are counted for. Failures
+// for an account only ever delay further attempts, so that someone guessing
+// its password can't lock its owner out, whereas accounts are locked out for
+// an IP address, and IP addresses are locked out, after too many failures.
+const (
+	loginFailureUser   = "user"
+	loginFailureUserIP = "user_ip"
+	loginFailureIP     = "ip"
+)
+
+// loginAttemptsMutex makes checking whether a login attempt may be made and
+// reserving it one step, so that concurrent attempts can't all get past the
+// check before any of them has been counted.
+var loginAttemptsMutex sync.Mutex
+
+// A loginSubject is something which failed login attempts are counted for.
+// It is never locked out if maxFailures is 0.
+type loginSubject struct {
+	kind, subject string
+	maxFailures   int
+}
+
+// loginSubjects returns the subjects which login attempts for the account
+// from the IP address are counted for. Only the IP address is counted if the
+// localpart isn't known.
+func loginSubjects(lockout *config.LoginLockout, localpart, ip string) []loginSubject {
+	subjects := []loginSubject{{loginFailureIP, ip, lockout.MaxFailuresPerIP}}
+	if localpart != "" {
+		subjects = append(subjects,
+			loginSubject{loginFailureUser, localpart, 0},
+			loginSubject{loginFailureUserIP, localpart + "|" + ip, lockout.MaxFailures},
+		)
+	}
+	return subjects
+}
+
+// loginRetryAfter returns how long it is until another login attempt may be
+// made, given how many have failed and when the last one did. Each failure
+// doubles the delay, up to max_delay for subjects which are never locked out,
+// or until there are too many and the subject is locked out.
+func loginRetryAfter(
+	lockout *config.LoginLockout, failures, maxFailures int, lastFailureTS int64, now time.Time,
+) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	lastFailure := time.Unix(0, lastFailureTS*int64(time.Millisecond))
+	wait := lockout.LockoutDuration
+	if maxFailures == 0 || failures < maxFailures {
+		longest := lockout.LockoutDuration
+		if maxFailures == 0 {
+			longest = lockout.MaxDelay
+		}
+		wait = lockout.InitialDelay << uint(failures-1)
+		if wait <= 0 || wait > longest {
+			wait = longest
+		}
+	}
+	return lastFailure.Add(wait).Sub(now)
+}
+
+// reserveLoginAttempt returns an error response if login attempts for the
+// account, or from the IP address the request came from, must wait. Otherwise
+// the attempt is counted as failed until it is given back with
+// releaseLoginAttempt once it has succeeded.
+func reserveLoginAttempt(
+	req *http.Request, accountDB accounts.Database, localpart string, cfg *config.Dendrite,
+) *util.JSONResponse {
+	lockout := &cfg.Matrix.LoginLockout
+	if !lockout.Enabled {
+		return nil
+	}
+	now := time.Now()
+	subjects := loginSubjects(lockout, localpart, loginIP(req, cfg))
+
+	loginAttemptsMutex.Lock()
+	defer loginAttemptsMutex.Unlock()
+	for _, s := range subjects {
+		failures, lastFailureTS, err := accountDB.GetLoginFailures(req.Context(), s.kind, s.subject)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLoginFailures failed")
+			res := jsonerror.InternalServerError()
+			return &res
+		}
+		// IP addresses aren't delayed, as one may be shared by many users who
+		// each make the odd mistake.
+		if s.kind == loginFailureIP && failures < s.maxFailures {
+			continue
+		}
+		if wait := loginRetryAfter(lockout, failures, s.maxFailures, lastFailureTS, now); wait > 0 {
+			return &util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(
+					"Too many failed login attempts, try again later", int64(wait/time.Millisecond),
+				),
+			}
+		}
+	}
+	nowTS := now.UnixNano() / int64(time.Millisecond)
+	resetBeforeTS := now.Add(-lockout.LockoutDuration).UnixNano() / int64(time.Millisecond)
+	for _, s := range subjects {
+		if err := accountDB.RecordLoginFailure(req.Context(), s.kind, s.subject, nowTS, resetBeforeTS); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RecordLoginFailure failed")
+			res := jsonerror.InternalServerError()
+			return &res
+		}
+	}
+	return nil
+}
+
+// releaseLoginAttempt gives back a login attempt reserved by
+// reserveLoginAttempt which didn't fail.
+func releaseLoginAttempt(
+	req *http.Request, accountDB accounts.Database, localpart string, cfg *config.Dendrite,
+) {
+	lockout := &cfg.Matrix.LoginLockout
+	if !lockout.Enabled {
+		return
+	}
+	for _, s := range loginSubjects(lockout, localpart, loginIP(req, cfg)) {
+		if err := accountDB.ReleaseLoginFailure(req.Context(), s.kind, s.subject); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.ReleaseLoginFailure failed")
+		}
+	}
+}
+
+// logLoginFailure writes an audit log entry for a failed login attempt, which
+// was already counted when it was reserved. Only the IP address is logged if
+// the localpart isn't known.
+func logLoginFailure(
+	req *http.Request, accountDB accounts.Database, localpart string, cfg *config.Dendrite,
+) {
+	ip := loginIP(req, cfg)
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"localpart": localpart,
+		"ip":        ip,
+	})
+	lockout := &cfg.Matrix.LoginLockout
+	if lockout.Enabled {
+		for _, s := range loginSubjects(lockout, localpart, ip) {
+			failures, _, err := accountDB.GetLoginFailures(req.Context(), s.kind, s.subject)
+			if err != nil {
+				logger.WithError(err).Error("accountDB.GetLoginFailures failed")
+				continue
+			}
+			logger = logger.WithField(s.kind+"_failures", failures)
+			if s.maxFailures > 0 && failures == s.maxFailures {
+				logger.WithField("kind", s.kind).Warn("Locked out after too many failed login attempts")
+			}
+		}
+	}
+	logger.Warn("Failed login attempt")
+}
+
+// clearLoginFailures forgets the failed login attempts for the account, and
+// for the account from the IP address the request came from, once the user
+// has logged in, and writes an audit log entry.
+func clearLoginFailures(
+	req *http.Request, accountDB accounts.Database, localpart string, cfg *config.Dendrite,
+) {
+	ip := loginIP(req, cfg)
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"localpart": localpart,
+		"ip":        ip,
+	})
+	logger.Info("Successful login")
+	if !cfg.Matrix.LoginLockout.Enabled {
+		return
+	}
+	for _, s := range loginSubjects(&cfg.Matrix.LoginLockout, localpart, ip) {
+		if s.kind == loginFailureIP {
+			continue
+		}
+		if err := accountDB.ClearLoginFailures(req.Context(), s.kind, s.subject); err != nil {
+			logger.WithError(err).Error("accountDB.ClearLoginFailures failed")
+		}
+	}
+}
+
+// loginIP returns the IP address which the request came from, which for
+// requests through a trusted reverse proxy is the address the proxy gives.
+func loginIP(req *http.Request, cfg *config.Dendrite) string {
+	return httputil.ClientIP(req, cfg.Derived.TrustedProxies)
+}
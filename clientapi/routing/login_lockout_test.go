@@ -0,0 +1,198 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestLoginRetryAfter(t *testing.T) {
+	lockout := &config.LoginLockout{
+		InitialDelay:    time.Second,
+		MaxDelay:        time.Minute,
+		MaxFailures:     5,
+		LockoutDuration: 15 * time.Minute,
+	}
+	lastFailure := time.Unix(1000, 0)
+	lastFailureTS := lastFailure.UnixNano() / int64(time.Millisecond)
+
+	for _, tc := range []struct {
+		failures, maxFailures int
+		want                  time.Duration
+	}{
+		{0, 5, 0},
+		{1, 5, time.Second},
+		{2, 5, 2 * time.Second},
+		{4, 5, 8 * time.Second},
+		{5, 5, 15 * time.Minute},
+		// Subjects which are never locked out are only delayed.
+		{4, 0, 8 * time.Second},
+		{7, 0, time.Minute},
+		{100, 0, time.Minute},
+	} {
+		got := loginRetryAfter(lockout, tc.failures, tc.maxFailures, lastFailureTS, lastFailure)
+		if got != tc.want {
+			t.Errorf("%d of %d failures: wanted to wait %s, got %s", tc.failures, tc.maxFailures, tc.want, got)
+		}
+	}
+
+	if got := loginRetryAfter(lockout, 5, lockout.MaxFailures, lastFailureTS, lastFailure.Add(time.Hour)); got > 0 {
+		t.Errorf("wanted the lockout to have ended, got %s to wait", got)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+
+	cfg := &config.Dendrite{}
+	cfg.Matrix.LoginLockout = config.LoginLockout{
+		Enabled:          true,
+		InitialDelay:     time.Minute,
+		MaxDelay:         2 * time.Minute,
+		MaxFailures:      3,
+		MaxFailuresPerIP: 3,
+		LockoutDuration:  15 * time.Minute,
+	}
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+	// attempt makes a login attempt, which fails unless succeed is set, and
+	// returns whether it was allowed.
+	attempt := func(remoteAddr, localpart string, succeed bool) bool {
+		req := request(remoteAddr)
+		if reserveLoginAttempt(req, db, localpart, cfg) != nil {
+			return false
+		}
+		if succeed {
+			releaseLoginAttempt(req, db, localpart, cfg)
+			clearLoginFailures(req, db, localpart, cfg)
+		} else {
+			logLoginFailure(req, db, localpart, cfg)
+		}
+		return true
+	}
+	const attacker, owner = "192.0.2.1:1234", "198.51.100.1:1234"
+
+	if !attempt(attacker, "alice", false) {
+		t.Fatalf("wanted login to be allowed before any failures")
+	}
+	// Failures delay attempts for the account from anywhere, so that
+	// changing IP address doesn't get around the delay.
+	if attempt(owner, "alice", true) {
+		t.Errorf("wanted login for alice from the owner to wait after a failure")
+	}
+	if !attempt(attacker, "bob", true) {
+		t.Errorf("wanted login for bob from the attacker to be allowed")
+	}
+
+	// However many failures there are for an account it is never locked out,
+	// only delayed, whereas it is locked out for an IP address with too many.
+	failedTS := time.Now().Add(-cfg.Matrix.LoginLockout.MaxDelay).UnixNano() / int64(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		for _, subject := range []struct{ kind, subject string }{
+			{loginFailureUser, "carol"},
+			{loginFailureUserIP, "carol|192.0.2.1"},
+		} {
+			if err := db.RecordLoginFailure(ctx, subject.kind, subject.subject, failedTS, 0); err != nil {
+				t.Fatalf("RecordLoginFailure returned %s", err)
+			}
+		}
+	}
+	if attempt(attacker, "carol", true) {
+		t.Errorf("wanted login for carol from the attacker to be locked out")
+	}
+	if !attempt(owner, "carol", true) {
+		t.Errorf("wanted login for carol from the owner to be allowed after the delay")
+	}
+	// Logging in clears the failures for the account, but not for the account
+	// from other IP addresses.
+	if failures, _, _ := db.GetLoginFailures(ctx, loginFailureUser, "carol"); failures != 0 {
+		t.Errorf("wanted the failures for carol to be cleared, got %d", failures)
+	}
+	if attempt(attacker, "carol", true) {
+		t.Errorf("wanted login for carol from the attacker to still be locked out")
+	}
+
+	// Too many failures from an IP address lock it out for every account.
+	attempt(attacker, "dave", false)
+	attempt(attacker, "", false)
+	for _, localpart := range []string{"erin", ""} {
+		if attempt(attacker, localpart, true) {
+			t.Errorf("wanted login for %q from the attacker to be locked out", localpart)
+		}
+	}
+	if !attempt(owner, "erin", true) {
+		t.Errorf("wanted login for erin from the owner to be allowed")
+	}
+	// Successful logins don't count towards the lockout of an IP address.
+	for i := 0; i < cfg.Matrix.LoginLockout.MaxFailuresPerIP; i++ {
+		if !attempt(owner, "erin", true) {
+			t.Fatalf("wanted login for erin from the owner to be allowed")
+		}
+	}
+}
+
+func TestLoginAttemptsReserved(t *testing.T) {
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+
+	cfg := &config.Dendrite{}
+	cfg.Matrix.LoginLockout = config.LoginLockout{
+		Enabled:          true,
+		InitialDelay:     time.Minute,
+		MaxDelay:         time.Minute,
+		MaxFailures:      3,
+		MaxFailuresPerIP: 3,
+		LockoutDuration:  15 * time.Minute,
+	}
+
+	// Only one of many concurrent attempts for an account is allowed, as the
+	// others must wait in case it fails.
+	const attempts = 10
+	var wg sync.WaitGroup
+	allowed := make(chan bool, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+			allowed <- reserveLoginAttempt(req, db, "alice", cfg) == nil
+		}(i)
+	}
+	wg.Wait()
+	close(allowed)
+	count := 0
+	for ok := range allowed {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("wanted 1 concurrent attempt to be allowed, got %d", count)
+	}
+}
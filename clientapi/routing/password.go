@@ -0,0 +1,336 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-account-password
+type changePasswordRequest struct {
+	NewPassword   string   `json:"new_password"`
+	LogoutDevices *bool    `json:"logout_devices"`
+	Auth          authDict `json:"auth"`
+}
+
+// RequestPasswordResetEmailToken implements POST /account/password/email/requestToken
+func RequestPasswordResetEmailToken(
+	req *http.Request, accountDB accounts.Database, mailer *threepid.Mailer,
+	cfg *config.Dendrite,
+) util.JSONResponse {
+	if mailer == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Password resets by email are disabled on this server"),
+		}
+	}
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if resErr := validateEmailAssociationRequest(&body); resErr != nil {
+		return *resErr
+	}
+
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Email, "email")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "Email address not found",
+			},
+		}
+	}
+
+	sid, err := sendValidationEmail(req.Context(), accountDB, mailer, body, "reset your password", cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sendValidationEmail failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{SID: sid},
+	}
+}
+
+// Password implements POST /account/password. Users who are logged in must
+// authenticate with their current password, and users who aren't can instead
+// validate an email address which is associated with their account. The
+// device is nil if the request has no access token.
+func Password(
+	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
+	device *authtypes.Device, mailer *threepid.Mailer, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r changePasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	var flows []authtypes.Flow
+	var userID string
+	if device != nil {
+		flows = append(flows, loggedInUserFlows(cfg)...)
+		userID = device.UserID
+	}
+	if mailer != nil {
+		flows = append(flows, authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}})
+	}
+	if len(flows) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken("Missing access token"),
+		}
+	}
+	uiaRequired := userInteractiveAuthRequired(r.Auth.Session, userID, flows)
+
+	var localpart string
+	// The validated email session, if the email address was used to
+	// authenticate, which is used up once the password has been changed.
+	var session *authtypes.ThreePIDSession
+	switch {
+	case r.Auth.Type == authtypes.LoginTypePassword && device != nil:
+		if resErr := checkPasswordStage(req, accountDB, device, r.Auth, cfg); resErr != nil {
+			return *resErr
+		}
+		var err error
+		if localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+	case r.Auth.Type == authtypes.LoginTypeSSO && device != nil && cfg.Matrix.OpenIDConnect.Enabled:
+		if !checkSSOStage(device, r.Auth.Session) {
+			return uiaRequired
+		}
+		var err error
+		if localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+	case r.Auth.Type == authtypes.LoginTypeEmail && mailer != nil:
+		creds := r.Auth.ThreePIDCreds
+		if creds == nil {
+			creds = r.Auth.LegacyThreePIDCreds
+		}
+		if creds == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("'threepid_creds' must be supplied."),
+			}
+		}
+		// Guessing the credentials of validated sessions counts towards the
+		// lockout of the IP address like guessing passwords does.
+		if resErr := reserveLoginAttempt(req, accountDB, "", cfg); resErr != nil {
+			return *resErr
+		}
+		var err error
+		session, err = checkThreePIDValidated(req.Context(), accountDB, *creds)
+		if err == errThreePIDNotValidated {
+			logLoginFailure(req, accountDB, "", cfg)
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_UNAUTHORIZED",
+					Err:     "Email address has not been validated. Follow the link in the email which was sent to it.",
+				},
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("checkThreePIDValidated failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart, err = accountDB.GetLocalpartForThreePID(req.Context(), session.Address, session.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart == "" || (device != nil && device.UserID != userutil.MakeUserID(localpart, cfg.Matrix.ServerName)) {
+			logLoginFailure(req, accountDB, "", cfg)
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Email address is not associated with this account"),
+			}
+		}
+		// The credentials were right, so whatever happens from here on the
+		// attempt didn't fail, but the account may still have to wait.
+		releaseLoginAttempt(req, accountDB, "", cfg)
+		if resErr := reserveLoginAttempt(req, accountDB, localpart, cfg); resErr != nil {
+			return *resErr
+		}
+		defer releaseLoginAttempt(req, accountDB, localpart, cfg)
+	default:
+		return uiaRequired
+	}
+
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'new_password' must be supplied."),
+		}
+	}
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+	if err := accountDB.SetPassword(req.Context(), localpart, r.NewPassword); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPassword failed")
+		return jsonerror.InternalServerError()
+	}
+	// The session can only be used once, but it isn't used up until the
+	// password has been changed so that it can be retried if that fails.
+	if session != nil {
+		if err := accountDB.RemoveThreePIDSession(req.Context(), session.SessionID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDSession failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		if err := logoutOtherDevices(req, deviceDB, localpart, device); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("logoutOtherDevices failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// loggedInUserFlows returns the flows of user-interactive auth which users
+// who are logged in can complete to confirm who they are: entering their
+// password, or signing on with the identity provider if there is one.
+func loggedInUserFlows(cfg *config.Dendrite) []authtypes.Flow {
+	flows := []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}}}
+	if cfg.Matrix.OpenIDConnect.Enabled {
+		flows = append(flows, authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeSSO}})
+	}
+	return flows
+}
+
+// userInteractiveAuthRequired returns the response which asks the client to
+// complete one of the flows of user-interactive auth. If the user is logged in
+// then the session is tied to them, and a new session is started if the one
+// given already authenticates another user.
+func userInteractiveAuthRequired(sessionID, userID string, flows []authtypes.Flow) util.JSONResponse {
+	if sessionID == "" || (userID != "" && !SetSessionUser(sessionID, userID)) {
+		sessionID = util.RandomString(sessionIDLength)
+		if userID != "" {
+			SetSessionUser(sessionID, userID)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusUnauthorized,
+		JSON: newUserInteractiveResponse(sessionID, flows, map[string]interface{}{}),
+	}
+}
+
+// checkLoggedInUserAuth returns nil if the request has completed one of the
+// flows of user-interactive auth in loggedInUserFlows as the device's user.
+// Otherwise it returns the response to send to the client.
+func checkLoggedInUserAuth(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, r authDict,
+	cfg *config.Dendrite,
+) *util.JSONResponse {
+	switch {
+	case r.Type == authtypes.LoginTypePassword:
+		return checkPasswordStage(req, accountDB, device, r, cfg)
+	case r.Type == authtypes.LoginTypeSSO && cfg.Matrix.OpenIDConnect.Enabled:
+		if checkSSOStage(device, r.Session) {
+			return nil
+		}
+	}
+	res := userInteractiveAuthRequired(r.Session, device.UserID, loggedInUserFlows(cfg))
+	return &res
+}
+
+// checkSSOStage returns whether the session has completed the m.login.sso
+// stage of user-interactive auth, and authenticates the device's user.
+func checkSSOStage(device *authtypes.Device, sessionID string) bool {
+	if sessionID == "" || sessions.GetSessionUser(sessionID) != device.UserID {
+		return false
+	}
+	for _, stage := range sessions.GetCompletedStages(sessionID) {
+		if stage == authtypes.LoginTypeSSO {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPasswordStage returns nil if the request has completed the
+// m.login.password stage of user-interactive auth with the password of the
+// device's user. Otherwise it returns the response to send to the client.
+// Wrong passwords count towards the login lockout.
+func checkPasswordStage(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, r authDict,
+	cfg *config.Dendrite,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if resErr := reserveLoginAttempt(req, accountDB, localpart, cfg); resErr != nil {
+		return resErr
+	}
+	if _, err = accountDB.GetAccountByPassword(req.Context(), localpart, r.Password); err != nil {
+		logLoginFailure(req, accountDB, localpart, cfg)
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("password is incorrect"),
+		}
+	}
+	releaseLoginAttempt(req, accountDB, localpart, cfg)
+	return nil
+}
+
+// logoutOtherDevices removes all of the user's devices except for the one
+// which made the request, if any.
+func logoutOtherDevices(
+	req *http.Request, deviceDB devices.Database, localpart string, device *authtypes.Device,
+) error {
+	if device == nil {
+		return deviceDB.RemoveAllDevices(req.Context(), localpart)
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(req.Context(), localpart)
+	if err != nil {
+		return err
+	}
+	var deviceIDs []string
+	for _, dev := range devs {
+		if dev.ID != device.ID {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	return deviceDB.RemoveDevices(req.Context(), localpart, deviceIDs)
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestPasswordResetByEmail(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "hollow.knight"
+	cfg.Matrix.LoginLockout = config.LoginLockout{
+		Enabled:          true,
+		InitialDelay:     time.Second,
+		MaxFailures:      5,
+		MaxFailuresPerIP: 3,
+		LockoutDuration:  time.Minute,
+	}
+	mailer := &threepid.Mailer{}
+
+	if _, err := db.CreateAccount(ctx, "hornet", "oldpassword", ""); err != nil {
+		t.Fatalf("CreateAccount returned %s", err)
+	}
+	session := mustCreateThreePIDSession(t, db, "1")
+	if err := db.SaveThreePIDAssociation(ctx, session.Address, "hornet", "msisdn"); err != nil {
+		t.Fatalf("SaveThreePIDAssociation returned %s", err)
+	}
+	if err := db.ValidateThreePIDSession(ctx, session.SessionID, time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+		t.Fatalf("ValidateThreePIDSession returned %s", err)
+	}
+
+	reset := func(remoteAddr, secret, newPassword string) int {
+		body := fmt.Sprintf(`{
+			"new_password": %q,
+			"logout_devices": false,
+			"auth": {"type": "m.login.email.identity", "threepid_creds": {"sid": %q, "client_secret": %q}}
+		}`, newPassword, session.SessionID, secret)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		return Password(req, db, nil, nil, mailer, cfg).Code
+	}
+
+	// A password which is rejected doesn't use up the session.
+	if code := reset("192.0.2.1:1234", session.ClientSecret, "short"); code != http.StatusBadRequest {
+		t.Fatalf("expected a weak password to be rejected, got %d", code)
+	}
+	if got, err := db.GetThreePIDSession(ctx, session.SessionID); err != nil || got == nil {
+		t.Fatalf("expected the session to be kept after a rejected password, got %v (err %v)", got, err)
+	}
+
+	// Guessing the credentials of the session locks out the IP address.
+	for i := 0; i < cfg.Matrix.LoginLockout.MaxFailuresPerIP; i++ {
+		if code := reset("192.0.2.2:1234", "wrong", "newpassword"); code != http.StatusUnauthorized {
+			t.Fatalf("expected wrong credentials to be rejected, got %d", code)
+		}
+	}
+	if code := reset("192.0.2.2:1234", session.ClientSecret, "newpassword"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP address to be locked out, got %d", code)
+	}
+
+	if code := reset("192.0.2.1:1234", session.ClientSecret, "newpassword"); code != http.StatusOK {
+		t.Fatalf("expected the password to be reset, got %d", code)
+	}
+	if _, err := db.GetAccountByPassword(ctx, "hornet", "newpassword"); err != nil {
+		t.Errorf("expected the new password to be set, got %s", err)
+	}
+	if got, err := db.GetThreePIDSession(ctx, session.SessionID); err != nil || got != nil {
+		t.Errorf("expected the session to be used up, got %v (err %v)", got, err)
+	}
+}
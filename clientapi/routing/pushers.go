@@ -0,0 +1,225 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/push/emailnotifier"
+	"github.com/matrix-org/dendrite/clientapi/push/storage"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum lengths of a pusher's app ID and push key, as given by the spec.
+const (
+	maxPusherAppIDLength   = 64
+	maxPusherPushKeyLength = 512
+)
+
+type setPusherRequest struct {
+	PushKey string `json:"pushkey"`
+	// The kind of pusher, or null to remove the pusher.
+	Kind              *string                `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+	// If false, other users' pushers with the same app ID and push key are
+	// removed.
+	Append bool `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, pushDB storage.Database, device *authtypes.Device,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	pushers, err := pushDB.GetPushers(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushDB.GetPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Pushers []authtypes.Pusher `json:"pushers"`
+		}{pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set
+func SetPusher(
+	req *http.Request, pushDB storage.Database, accountDB accounts.Database,
+	device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	emailEnabled := cfg.Matrix.Email.Enabled && cfg.Matrix.Email.Notifications.Enabled
+	if err := validateSetPusherRequest(&r, emailEnabled); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: err,
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.Kind == nil {
+		if err = pushDB.RemovePusher(req.Context(), localpart, r.AppID, r.PushKey); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("pushDB.RemovePusher failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	// Users can only have emails sent to addresses that they have proven
+	// that they own.
+	if *r.Kind == emailnotifier.PusherKind {
+		owner, err := accountDB.GetLocalpartForThreePID(req.Context(), r.PushKey, "email")
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if owner != localpart {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("pushkey must be an email address on your account"),
+			}
+		}
+	}
+
+	if !r.Append {
+		if err = pushDB.RemovePushersForOtherUsers(req.Context(), localpart, r.AppID, r.PushKey); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("pushDB.RemovePushersForOtherUsers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	pusher := authtypes.Pusher{
+		PushKey:           r.PushKey,
+		Kind:              *r.Kind,
+		AppID:             r.AppID,
+		AppDisplayName:    r.AppDisplayName,
+		DeviceDisplayName: r.DeviceDisplayName,
+		ProfileTag:        r.ProfileTag,
+		Language:          r.Language,
+		Data:              r.Data,
+		PushKeyTS:         time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err = pushDB.SetPusher(req.Context(), localpart, pusher); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushDB.SetPusher failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// validateSetPusherRequest returns an error if the request is missing a
+// required field, or asks for a kind of pusher that isn't supported. Email
+// pushers are only supported if email notifications are enabled.
+func validateSetPusherRequest(r *setPusherRequest, emailEnabled bool) *jsonerror.MatrixError {
+	switch {
+	case r.PushKey == "":
+		return jsonerror.MissingArgument("Missing pushkey")
+	case r.AppID == "":
+		return jsonerror.MissingArgument("Missing app_id")
+	case len(r.PushKey) > maxPusherPushKeyLength:
+		return jsonerror.InvalidArgumentValue("pushkey is too long")
+	case len(r.AppID) > maxPusherAppIDLength:
+		return jsonerror.InvalidArgumentValue("app_id is too long")
+	}
+	// Only the push key and app ID are needed to remove a pusher.
+	if r.Kind == nil {
+		return nil
+	}
+
+	switch {
+	case r.AppDisplayName == "":
+		return jsonerror.MissingArgument("Missing app_display_name")
+	case r.DeviceDisplayName == "":
+		return jsonerror.MissingArgument("Missing device_display_name")
+	case r.Language == "":
+		return jsonerror.MissingArgument("Missing lang")
+	case r.Data == nil:
+		return jsonerror.MissingArgument("Missing data")
+	}
+
+	switch *r.Kind {
+	case "http":
+		gatewayURL, ok := r.Data["url"].(string)
+		if !ok {
+			return jsonerror.MissingArgument("Missing data.url for http pusher")
+		}
+		u, err := url.Parse(gatewayURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return jsonerror.InvalidArgumentValue("data.url must be an absolute http or https URL")
+		}
+	case emailnotifier.PusherKind:
+		if !emailEnabled {
+			return jsonerror.InvalidArgumentValue("Unsupported pusher kind " + *r.Kind)
+		}
+		if r.AppID != emailnotifier.AppID {
+			return jsonerror.InvalidArgumentValue("app_id must be " + emailnotifier.AppID + " for email pushers")
+		}
+	default:
+		return jsonerror.InvalidArgumentValue("Unsupported pusher kind " + *r.Kind)
+	}
+	return nil
+}
+
+// UnsubscribeEmailPusher implements GET /unstable/pushers/email/unsubscribe,
+// which is linked to from every notification email and removes the user's
+// email pusher for that address.
+func UnsubscribeEmailPusher(
+	w http.ResponseWriter, req *http.Request, pushDB storage.Database, cfg *config.Dendrite,
+) *util.JSONResponse {
+	query := req.URL.Query()
+	localpart, email := query.Get("localpart"), query.Get("email")
+	if !emailnotifier.ValidUnsubscribeToken(cfg, localpart, email, query.Get("token")) {
+		return writeHTTPMessage(w, req, "This link is invalid.", http.StatusBadRequest)
+	}
+	if err := pushDB.RemovePusher(req.Context(), localpart, emailnotifier.AppID, email); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushDB.RemovePusher failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	return writeHTTPMessage(w, req,
+		"You have been unsubscribed and will no longer receive notification emails at "+email+".",
+		http.StatusOK,
+	)
+}
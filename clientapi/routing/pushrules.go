@@ -0,0 +1,402 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/push/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type putPushRuleRequest struct {
+	Actions    []interface{}         `json:"actions"`
+	Conditions []pushrules.Condition `json:"conditions"`
+	Pattern    string                `json:"pattern"`
+}
+
+type pushRuleEnabled struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type pushRuleActions struct {
+	Actions []interface{} `json:"actions"`
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+) util.JSONResponse {
+	ruleSets, err := loadPushRules(req.Context(), accountDB, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("loadPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, scope string,
+) util.JSONResponse {
+	if scope != pushrules.GlobalScope {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope " + scope),
+		}
+	}
+	ruleSets, err := loadPushRules(req.Context(), accountDB, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("loadPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets.Global,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, scope, kind string,
+) util.JSONResponse {
+	_, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rules,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}
+func GetPushRuleByRuleID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	scope, kind, ruleID string,
+) util.JSONResponse {
+	_, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushrules.FindRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}, which
+// creates or replaces one of the user's own push rules.
+func PutPushRuleByRuleID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	var r putPushRuleRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if pushrules.IsDefaultRuleID(ruleID) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Push rule IDs starting with '.' are reserved for default rules"),
+		}
+	}
+	if r.Actions == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing actions"),
+		}
+	}
+	if err := pushrules.ValidateActions(r.Actions); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	ruleSets, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch kind {
+	case pushrules.ContentKind:
+		if r.Pattern == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing pattern"),
+			}
+		}
+		rule.Pattern = r.Pattern
+	case pushrules.RoomKind, pushrules.SenderKind:
+		// The rule ID is the room or user that the rule matches.
+	default:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []pushrules.Condition{}
+		}
+	}
+
+	// A rule that is being replaced keeps its position unless it is moved.
+	pos := pushrules.FindRule(*rules, ruleID)
+	if pos >= 0 {
+		*rules = append((*rules)[:pos], (*rules)[pos+1:]...)
+	} else {
+		// New rules take priority over the other rules of the same kind,
+		// apart from the master rule, which turns off all notifications.
+		pos = 0
+		if len(*rules) > 0 && (*rules)[0].RuleID == ".m.rule.master" {
+			pos = 1
+		}
+	}
+	before, after := req.URL.Query().Get("before"), req.URL.Query().Get("after")
+	if before != "" || after != "" {
+		relativeTo := before
+		if relativeTo == "" {
+			relativeTo = after
+		}
+		pos = pushrules.FindRule(*rules, relativeTo)
+		if pos < 0 || pushrules.IsDefaultRuleID(relativeTo) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("before and after must be the IDs of user-defined push rules"),
+			}
+		}
+		if before == "" {
+			pos++
+		}
+	}
+	*rules = append((*rules)[:pos], append([]pushrules.Rule{rule}, (*rules)[pos:]...)...)
+
+	return savePushRulesResponse(req, accountDB, syncProducer, device, ruleSets)
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleId}
+func DeletePushRuleByRuleID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	if pushrules.IsDefaultRuleID(ruleID) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Default push rules can't be deleted"),
+		}
+	}
+	ruleSets, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushrules.FindRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+
+	return savePushRulesResponse(req, accountDB, syncProducer, device, ruleSets)
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}/{attr}
+// for the "enabled" and "actions" attributes.
+func GetPushRuleAttrByRuleID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	_, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushrules.FindRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	rule := (*rules)[i]
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleEnabled{Enabled: &rule.Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleActions{Actions: rule.Actions},
+		}
+	default:
+		return unknownPushRuleAttr(attr)
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}/{attr}
+// for the "enabled" and "actions" attributes. Unlike the rest of a rule, these
+// can be changed for the default rules too.
+func PutPushRuleAttrByRuleID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	if attr != "enabled" && attr != "actions" {
+		return unknownPushRuleAttr(attr)
+	}
+	ruleSets, rules, resErr := pushRulesOfKind(req, accountDB, device, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushrules.FindRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+
+	switch attr {
+	case "enabled":
+		var r pushRuleEnabled
+		if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if r.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing enabled"),
+			}
+		}
+		(*rules)[i].Enabled = *r.Enabled
+	case "actions":
+		var r pushRuleActions
+		if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		if r.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing actions"),
+			}
+		}
+		if err := pushrules.ValidateActions(r.Actions); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(err.Error()),
+			}
+		}
+		(*rules)[i].Actions = r.Actions
+	}
+
+	return savePushRulesResponse(req, accountDB, syncProducer, device, ruleSets)
+}
+
+// pushRulesOfKind loads the user's push rules, and returns them along with the
+// rules of the given scope and kind, or an error response if there is no such
+// scope or kind.
+func pushRulesOfKind(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, scope, kind string,
+) (*pushrules.AccountRuleSets, *[]pushrules.Rule, *util.JSONResponse) {
+	if scope != pushrules.GlobalScope {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope " + scope),
+		}
+	}
+	ruleSets, err := loadPushRules(req.Context(), accountDB, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("loadPushRules failed")
+		res := jsonerror.InternalServerError()
+		return nil, nil, &res
+	}
+	rules, err := ruleSets.Global.Rules(kind)
+	if err != nil {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	return ruleSets, rules, nil
+}
+
+// loadPushRules returns the user's push rules, which are the default rules
+// until the user changes any of them.
+func loadPushRules(
+	ctx context.Context, accountDB accounts.Database, userID string,
+) (*pushrules.AccountRuleSets, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := accountDB.GetAccountDataByType(ctx, localpart, "", pushrules.AccountDataType)
+	if err != nil {
+		return nil, err
+	}
+	return pushrules.FromAccountData(data, localpart, userID)
+}
+
+// savePushRulesResponse stores the user's push rules and tells the sync API
+// that they have changed, so that the user's clients find out about it.
+func savePushRulesResponse(
+	req *http.Request, accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	device *authtypes.Device, ruleSets *pushrules.AccountRuleSets,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	content, err := json.Marshal(ruleSets)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SaveAccountData(
+		req.Context(), localpart, "", pushrules.AccountDataType, string(content),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(device.UserID, "", pushrules.AccountDataType); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func pushRuleNotFound() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Push rule not found"),
+	}
+}
+
+func unknownPushRuleAttr(attr string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidArgumentValue("Unknown push rule attribute " + attr),
+	}
+}
@@ -19,12 +19,10 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
@@ -36,10 +34,12 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/captcha"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -76,6 +76,16 @@ func init() {
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	// The third-party identifiers validated during each session, which are
+	// associated with the account once it is registered.
+	threePIDs map[string][]authtypes.ThreePID
+	// The registration token supplied during each session, which is used
+	// up once the account is registered.
+	registrationTokens map[string]string
+	// The user ID of the user who each session authenticates, for sessions
+	// started by users who are logged in, so that stages which are completed
+	// outside of the session's requests can be checked against it.
+	users map[string]string
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -92,10 +102,75 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
+		sessions:           make(map[string][]authtypes.LoginType),
+		threePIDs:          make(map[string][]authtypes.ThreePID),
+		registrationTokens: make(map[string]string),
+		users:              make(map[string]string),
 	}
 }
 
+// GetThreePIDs returns the third-party identifiers validated during a session.
+func (d *sessionsDict) GetThreePIDs(sessionID string) []authtypes.ThreePID {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.threePIDs[sessionID]
+}
+
+// AddSessionThreePID records that a session has validated a third-party
+// identifier.
+func AddSessionThreePID(sessionID string, threePID authtypes.ThreePID) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	for _, existing := range sessions.threePIDs[sessionID] {
+		if existing == threePID {
+			return
+		}
+	}
+	sessions.threePIDs[sessionID] = append(sessions.threePIDs[sessionID], threePID)
+}
+
+// GetRegistrationToken returns the registration token supplied during a
+// session, or "" if there wasn't one.
+func (d *sessionsDict) GetRegistrationToken(sessionID string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.registrationTokens[sessionID]
+}
+
+// SetSessionRegistrationToken records the registration token supplied during
+// a session.
+func SetSessionRegistrationToken(sessionID, token string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sessions.registrationTokens[sessionID] = token
+}
+
+// GetSessionUser returns the user ID of the user who a session authenticates,
+// or "" if the session wasn't started by a user who is logged in.
+func (d *sessionsDict) GetSessionUser(sessionID string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.users[sessionID]
+}
+
+// SetSessionUser records the user ID of the user who a session authenticates.
+// Returns false if the session already authenticates another user.
+func SetSessionUser(sessionID, userID string) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if existing, ok := sessions.users[sessionID]; ok && existing != userID {
+		return false
+	}
+	sessions.users[sessionID] = userID
+	return true
+}
+
 // AddCompletedSessionStage records that a session has completed an auth stage.
 func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
 	sessions.Lock()
@@ -114,6 +189,9 @@ var (
 	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
 	sessions           = newSessionsDict()
 	validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-./]+$`)
+	// recaptchaClient is used to verify captcha responses, so that a slow
+	// captcha server can't hold up registrations forever.
+	recaptchaClient = &http.Client{Timeout: 30 * time.Second}
 )
 
 // registerRequest represents the submitted registration request.
@@ -150,6 +228,13 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Password
+	Password string `json:"password"`
+	// Email identity, which older clients send as threepidCreds
+	ThreePIDCreds       *threepid.Credentials `json:"threepid_creds"`
+	LegacyThreePIDCreds *threepid.Credentials `json:"threepidCreds"`
+	// Registration token
+	Token string `json:"token"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -190,14 +275,6 @@ type registerResponse struct {
 	DeviceID    string                       `json:"device_id,omitempty"`
 }
 
-// recaptchaResponse represents the HTTP response from a Google Recaptcha server
-type recaptchaResponse struct {
-	Success     bool      `json:"success"`
-	ChallengeTS time.Time `json:"challenge_ts"`
-	Hostname    string    `json:"hostname"`
-	ErrorCodes  []int     `json:"error-codes"`
-}
-
 // validateUsername returns an error response if the username is invalid
 func validateUsername(username string) *util.JSONResponse {
 	// https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/rest/client/v2_alpha/register.py#L161
@@ -255,6 +332,7 @@ func validatePassword(password string) *util.JSONResponse {
 
 // validateRecaptcha returns an error response if the captcha response is invalid
 func validateRecaptcha(
+	ctx context.Context,
 	cfg *config.Dendrite,
 	response string,
 	clientip string,
@@ -273,44 +351,21 @@ func validateRecaptcha(
 		}
 	}
 
-	// Make a POST request to Google's API to check the captcha response
-	resp, err := http.PostForm(cfg.Matrix.RecaptchaSiteVerifyAPI,
-		url.Values{
-			"secret":   {cfg.Matrix.RecaptchaPrivateKey},
-			"response": {response},
-			"remoteip": {clientip},
-		},
-	)
-
-	if err != nil {
-		return &util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: jsonerror.BadJSON("Error in requesting validation of captcha response"),
-		}
+	// The client's IP address is given without the port
+	if host, _, err := net.SplitHostPort(clientip); err == nil {
+		clientip = host
 	}
 
-	// Close the request once we're finishing reading from it
-	defer resp.Body.Close() // nolint: errcheck
-
-	// Grab the body of the response from the captcha server
-	var r recaptchaResponse
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return &util.JSONResponse{
-			Code: http.StatusGatewayTimeout,
-			JSON: jsonerror.Unknown("Error in contacting captcha server" + err.Error()),
-		}
-	}
-	err = json.Unmarshal(body, &r)
+	ok, err := captcha.NewVerifier(cfg, recaptchaClient).Verify(ctx, response, clientip)
 	if err != nil {
+		log.WithError(err).Error("Failed to verify captcha response")
 		return &util.JSONResponse{
 			Code: http.StatusInternalServerError,
-			JSON: jsonerror.BadJSON("Error in unmarshaling captcha server's response: " + err.Error()),
+			JSON: jsonerror.Unknown("Error in requesting validation of captcha response"),
 		}
 	}
 
-	// Check that we received a "success"
-	if !r.Success {
+	if !ok {
 		return &util.JSONResponse{
 			Code: http.StatusUnauthorized,
 			JSON: jsonerror.BadJSON("Invalid captcha response. Please try again."),
@@ -581,7 +636,7 @@ func handleRegistrationFlow(
 	switch r.Auth.Type {
 	case authtypes.LoginTypeRecaptcha:
 		// Check given captcha response
-		resErr := validateRecaptcha(cfg, r.Auth.Response, req.RemoteAddr)
+		resErr := validateRecaptcha(req.Context(), cfg, r.Auth.Response, req.RemoteAddr)
 		if resErr != nil {
 			return *resErr
 		}
@@ -633,6 +688,31 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeMSISDN:
+		// Check that the phone number was validated and isn't already in use
+		if resErr := checkRegistrationThreePID(req, accountDB, r.Auth, "msisdn", sessionID); resErr != nil {
+			return *resErr
+		}
+
+		// Add MSISDN to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeMSISDN)
+
+	case authtypes.LoginTypeRegistrationToken:
+		// Check that the token is valid. It's only used up once the account
+		// is registered, in case registration fails at a later stage.
+		if resErr := checkRegistrationToken(req, accountDB, r.Auth.Token); resErr != nil {
+			return *resErr
+		}
+		SetSessionRegistrationToken(sessionID, r.Auth.Token)
+
+		// Add RegistrationToken to the list of completed registration stages
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
+	case authtypes.LoginTypeTerms:
+		// Completing the stage is how the user consents to the terms, which
+		// is recorded once the account is registered.
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeTerms)
+
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -704,11 +784,51 @@ func checkAndCompleteFlow(
 	deviceDB devices.Database,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
-		// This flow was completed, registration can continue
-		return completeRegistration(
+		// This flow was completed, registration can continue. Use up the
+		// registration token first, as it may have become invalid since it
+		// was checked. This is a single conditional update, so concurrent
+		// registrations can't use it more times than allowed.
+		token := sessions.GetRegistrationToken(sessionID)
+		if token != "" {
+			valid, err := accountDB.UseRegistrationToken(req.Context(), token, time.Now().UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+				return jsonerror.InternalServerError()
+			}
+			if !valid {
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.Forbidden("Registration token is no longer valid"),
+				}
+			}
+		}
+		res := completeRegistration(
 			req.Context(), accountDB, deviceDB, r.Username, r.Password, "",
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 		)
+		if res.Code != http.StatusOK {
+			// Give the use of the token back, so that it isn't used up by a
+			// registration which failed, e.g. because the username is taken.
+			if token != "" {
+				if err := accountDB.ReleaseRegistrationToken(req.Context(), token); err != nil {
+					util.GetLogger(req.Context()).WithError(err).Error("accountDB.ReleaseRegistrationToken failed")
+				}
+			}
+			return res
+		}
+		if err := recordTermsConsent(req.Context(), accountDB, r.Username, cfg); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("recordTermsConsent failed")
+		}
+		// Associate the third-party identifiers which were validated with
+		// the new account.
+		for _, threePID := range sessions.GetThreePIDs(sessionID) {
+			if err := accountDB.SaveThreePIDAssociation(
+				req.Context(), threePID.Address, r.Username, threePID.Medium,
+			); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+			}
+		}
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -720,6 +840,83 @@ func checkAndCompleteFlow(
 	}
 }
 
+// checkRegistrationToken returns an error response unless the registration
+// token exists and can still be used.
+func checkRegistrationToken(
+	req *http.Request, accountDB accounts.Database, token string,
+) *util.JSONResponse {
+	if token == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'token' must be supplied."),
+		}
+	}
+	regToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if regToken == nil || !regToken.IsValid(time.Now().UnixNano()/int64(time.Millisecond)) {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("Invalid registration token"),
+		}
+	}
+	return nil
+}
+
+// checkRegistrationThreePID returns an error response unless the auth dict's
+// credentials are for a session which validated a third-party identifier of
+// the given medium that isn't in use yet. The identifier is remembered for
+// the registration session.
+func checkRegistrationThreePID(
+	req *http.Request, accountDB accounts.Database, r authDict,
+	medium, sessionID string,
+) *util.JSONResponse {
+	creds := r.ThreePIDCreds
+	if creds == nil {
+		creds = r.LegacyThreePIDCreds
+	}
+	if creds == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'threepid_creds' must be supplied."),
+		}
+	}
+	session, err := checkThreePIDValidated(req.Context(), accountDB, *creds)
+	if err == errThreePIDNotValidated || (err == nil && session.Medium != medium) {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("checkThreePIDValidated failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), session.Address, session.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if localpart != "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+	AddSessionThreePID(sessionID, authtypes.ThreePID{Address: session.Address, Medium: session.Medium})
+	return nil
+}
+
 // LegacyRegister process register requests from the legacy v1 API
 func LegacyRegister(
 	req *http.Request,
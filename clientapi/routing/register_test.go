@@ -15,7 +15,12 @@
 package routing
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"sync"
 	"testing"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -207,3 +212,108 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+func TestMapLocalpart(t *testing.T) {
+	tests := map[string]string{
+		"alice":             "alice",
+		"Alice.Smith":       "alice.smith",
+		"alice@example.com": "alice",
+		"Jean-Luc Picard":   "jean-luc_picard",
+		"_hidden":           "hidden",
+		"":                  "",
+	}
+	for claim, want := range tests {
+		if got := mapLocalpart(claim); got != want {
+			t.Errorf("mapLocalpart(%q) = %q, want %q", claim, got, want)
+		}
+	}
+}
+
+func TestValidateRecaptcha(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.PostFormValue("secret") != "private" || req.PostFormValue("remoteip") != "192.0.2.1" {
+			t.Errorf("unexpected siteverify request: %v", req.PostForm)
+		}
+		success := req.PostFormValue("response") == "valid"
+		fmt.Fprintf(w, `{"success": %t}`, success)
+	}))
+	defer srv.Close()
+
+	cfg := config.Dendrite{}
+	cfg.Matrix.RecaptchaEnabled = true
+	cfg.Matrix.RecaptchaPrivateKey = "private"
+	cfg.Matrix.RecaptchaSiteVerifyAPI = srv.URL
+
+	if resErr := validateRecaptcha(context.Background(), &cfg, "valid", "192.0.2.1:12345"); resErr != nil {
+		t.Errorf("validateRecaptcha: expected a valid response, got %v", resErr.JSON)
+	}
+	if resErr := validateRecaptcha(context.Background(), &cfg, "invalid", "192.0.2.1:12345"); resErr == nil || resErr.Code != http.StatusUnauthorized {
+		t.Errorf("validateRecaptcha: expected an invalid response, got %v", resErr)
+	}
+	if resErr := validateRecaptcha(context.Background(), &cfg, "", "192.0.2.1:12345"); resErr == nil {
+		t.Error("validateRecaptcha: expected an error for an empty response")
+	}
+}
+
+func TestRegistrationTokenConcurrentRegistrations(t *testing.T) {
+	accountDB, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+	ctx := context.Background()
+	usesAllowed := 2
+	if err := accountDB.CreateRegistrationToken(ctx, &authtypes.RegistrationToken{
+		Token: "grub", UsesAllowed: &usesAllowed,
+	}); err != nil {
+		t.Fatalf("CreateRegistrationToken returned %s", err)
+	}
+	cfg := &config.Dendrite{}
+	flow := []authtypes.LoginType{authtypes.LoginTypeRegistrationToken}
+	cfg.Derived.Registration.Flows = []authtypes.Flow{{Stages: flow}}
+
+	register := func(sessionID, username string) int {
+		SetSessionRegistrationToken(sessionID, "grub")
+		r := registerRequest{Username: username, Password: "gitgud", InhibitLogin: true}
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		return checkAndCompleteFlow(flow, req, r, sessionID, cfg, accountDB, nil).Code
+	}
+
+	// A registration which fails doesn't use up the token.
+	if code := register("token-taken-1", "grimm"); code != http.StatusOK {
+		t.Fatalf("expected the first registration to succeed, got %d", code)
+	}
+	if code := register("token-taken-2", "grimm"); code == http.StatusOK {
+		t.Fatalf("expected registering a taken username to fail")
+	}
+	token, err := accountDB.GetRegistrationToken(ctx, "grub")
+	if err != nil || token == nil || token.Completed != 1 {
+		t.Fatalf("expected the token to have been used once, got %+v (%v)", token, err)
+	}
+
+	// Of many registrations racing to use the token, only as many as it has
+	// uses left succeed.
+	const attempts = 10
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- register(fmt.Sprintf("token-race-%d", i), fmt.Sprintf("hornet%d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	var succeeded int
+	for code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		} else if code != http.StatusUnauthorized {
+			t.Errorf("expected registrations to succeed or be refused, got %d", code)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected 1 registration to succeed, got %d", succeeded)
+	}
+	if token, err = accountDB.GetRegistrationToken(ctx, "grub"); err != nil || token.Completed != usesAllowed {
+		t.Errorf("expected the token to have been used %d times, got %+v (%v)", usesAllowed, token, err)
+	}
+}
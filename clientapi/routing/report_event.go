@@ -0,0 +1,228 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultEventReportsLimit = 100
+	maxEventReportsLimit     = 1000
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int   `json:"score"`
+}
+
+type eventReportsResponse struct {
+	EventReports []authtypes.EventReport `json:"event_reports"`
+	// The token to pass as "from" to get the next page, if there might be one
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}
+func ReportEvent(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID, eventID string,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'score' must be between -100 and 0"),
+		}
+	}
+
+	// Users can only report events in rooms that they are in, and the event
+	// must actually be in the room.
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Event not found"),
+	}
+	membershipReq := roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		return notFound
+	}
+	eventsReq := roomserverAPI.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return notFound
+	}
+
+	report := authtypes.EventReport{
+		RoomID:     roomID,
+		EventID:    eventID,
+		UserID:     device.UserID,
+		Reason:     r.Reason,
+		Score:      r.Score,
+		ReceivedTS: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if _, err := accountDB.CreateEventReport(req.Context(), &report); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetEventReports implements GET /_dendrite/admin/v1/eventReports
+func GetEventReports(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	query := req.URL.Query()
+	beforeID := int64(math.MaxInt64)
+	if from := query.Get("from"); from != "" {
+		var err error
+		if beforeID, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("'from' is invalid"),
+			}
+		}
+	}
+	limit := defaultEventReportsLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxEventReportsLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("'limit' must be between 1 and 1000"),
+			}
+		}
+	}
+	includeResolved := query.Get("include_resolved") == "true"
+
+	reports, err := accountDB.GetEventReports(req.Context(), includeResolved, beforeID, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetEventReports failed")
+		return jsonerror.InternalServerError()
+	}
+	res := eventReportsResponse{EventReports: reports}
+	if len(reports) == limit {
+		res.NextToken = strconv.FormatInt(reports[len(reports)-1].ID, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetEventReport implements GET /_dendrite/admin/v1/eventReports/{reportID}
+func GetEventReport(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+	reportID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	report, resErr := loadEventReport(req, accountDB, reportID)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
+
+// ResolveEventReport implements POST /_dendrite/admin/v1/eventReports/{reportID}/resolve
+func ResolveEventReport(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+	reportID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	report, resErr := loadEventReport(req, accountDB, reportID)
+	if resErr != nil {
+		return *resErr
+	}
+	resolvedTS := time.Now().UnixNano() / int64(time.Millisecond)
+	resolved, err := accountDB.ResolveEventReport(req.Context(), report.ID, device.UserID, resolvedTS)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.ResolveEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+	if !resolved {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Event report has already been resolved"),
+		}
+	}
+	report.ResolvedBy = device.UserID
+	report.ResolvedTS = resolvedTS
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
+
+// loadEventReport returns the event report with the ID from the URL, or an
+// error response if there isn't one.
+func loadEventReport(
+	req *http.Request, accountDB accounts.Database, reportID string,
+) (*authtypes.EventReport, *util.JSONResponse) {
+	notFound := &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Event report not found"),
+	}
+	id, err := strconv.ParseInt(reportID, 10, 64)
+	if err != nil {
+		return nil, notFound
+	}
+	report, err := accountDB.GetEventReport(req.Context(), id)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetEventReport failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if report == nil {
+		return nil, notFound
+	}
+	return report, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+type roomAnnounceOnlyRequest struct {
+	AnnounceOnly *bool `json:"announce_only"`
+}
+
+type roomAnnounceOnlyResponse struct {
+	AnnounceOnly bool `json:"announce_only"`
+}
+
+// GetRoomAnnounceOnly implements GET /_dendrite/admin/v1/rooms/{roomID}/announceOnly
+func GetRoomAnnounceOnly(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var res roomserverAPI.QueryRoomAnnounceOnlyResponse
+	if err := rsAPI.QueryRoomAnnounceOnly(req.Context(), &roomserverAPI.QueryRoomAnnounceOnlyRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomAnnounceOnly failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomAnnounceOnlyResponse{res.AnnounceOnly},
+	}
+}
+
+// SetRoomAnnounceOnly implements PUT /_dendrite/admin/v1/rooms/{roomID}/announceOnly
+func SetRoomAnnounceOnly(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r roomAnnounceOnlyRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.AnnounceOnly == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'announce_only' must be supplied"),
+		}
+	}
+
+	// The roomserver reports an unknown room as an error, so check that the
+	// room exists first to be able to tell it apart from other failures.
+	var queryRes roomserverAPI.QueryRoomAnnounceOnlyResponse
+	if err := rsAPI.QueryRoomAnnounceOnly(req.Context(), &roomserverAPI.QueryRoomAnnounceOnlyRequest{
+		RoomID: roomID,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomAnnounceOnly failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+	if err := rsAPI.PerformSetRoomAnnounceOnly(req.Context(), &roomserverAPI.PerformSetRoomAnnounceOnlyRequest{
+		RoomID:       roomID,
+		AnnounceOnly: *r.AnnounceOnly,
+	}, &roomserverAPI.PerformSetRoomAnnounceOnlyResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformSetRoomAnnounceOnly failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomAnnounceOnlyResponse{*r.AnnounceOnly},
+	}
+}
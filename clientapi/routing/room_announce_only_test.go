@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// fakeAnnounceOnlyAPI implements the parts of the roomserver API which are
+// used to change whether rooms are announce-only.
+type fakeAnnounceOnlyAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	rooms map[string]bool
+}
+
+func (a *fakeAnnounceOnlyAPI) QueryRoomAnnounceOnly(
+	ctx context.Context,
+	req *roomserverAPI.QueryRoomAnnounceOnlyRequest,
+	res *roomserverAPI.QueryRoomAnnounceOnlyResponse,
+) error {
+	res.AnnounceOnly, res.RoomExists = a.rooms[req.RoomID]
+	return nil
+}
+
+func (a *fakeAnnounceOnlyAPI) PerformSetRoomAnnounceOnly(
+	ctx context.Context,
+	req *roomserverAPI.PerformSetRoomAnnounceOnlyRequest,
+	res *roomserverAPI.PerformSetRoomAnnounceOnlyResponse,
+) error {
+	if _, ok := a.rooms[req.RoomID]; !ok {
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+	a.rooms[req.RoomID] = req.AnnounceOnly
+	return nil
+}
+
+func TestRoomAnnounceOnly(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.Admins = []string{"@admin:hollow.knight"}
+	admin := &authtypes.Device{UserID: "@admin:hollow.knight"}
+	user := &authtypes.Device{UserID: "@user:hollow.knight"}
+	rsAPI := &fakeAnnounceOnlyAPI{rooms: map[string]bool{"!room:hollow.knight": false}}
+
+	set := func(device *authtypes.Device, roomID, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		return SetRoomAnnounceOnly(req, device, cfg, rsAPI, roomID).Code
+	}
+	get := func(device *authtypes.Device, roomID string) (int, bool) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		res := GetRoomAnnounceOnly(req, device, cfg, rsAPI, roomID)
+		if body, ok := res.JSON.(roomAnnounceOnlyResponse); ok {
+			return res.Code, body.AnnounceOnly
+		}
+		return res.Code, false
+	}
+
+	if code := set(user, "!room:hollow.knight", `{"announce_only": true}`); code != http.StatusForbidden {
+		t.Errorf("non-admin set: want %d, got %d", http.StatusForbidden, code)
+	}
+	if code, _ := get(user, "!room:hollow.knight"); code != http.StatusForbidden {
+		t.Errorf("non-admin get: want %d, got %d", http.StatusForbidden, code)
+	}
+	if code := set(admin, "!room:hollow.knight", `{}`); code != http.StatusBadRequest {
+		t.Errorf("set without announce_only: want %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := set(admin, "!unknown:hollow.knight", `{"announce_only": true}`); code != http.StatusNotFound {
+		t.Errorf("set unknown room: want %d, got %d", http.StatusNotFound, code)
+	}
+	if code, _ := get(admin, "!unknown:hollow.knight"); code != http.StatusNotFound {
+		t.Errorf("get unknown room: want %d, got %d", http.StatusNotFound, code)
+	}
+	for _, announceOnly := range []bool{true, false} {
+		if code := set(admin, "!room:hollow.knight", fmt.Sprintf(`{"announce_only": %v}`, announceOnly)); code != http.StatusOK {
+			t.Fatalf("set: want %d, got %d", http.StatusOK, code)
+		}
+		if code, got := get(admin, "!room:hollow.knight"); code != http.StatusOK || got != announceOnly {
+			t.Errorf("get: want %d %v, got %d %v", http.StatusOK, announceOnly, code, got)
+		}
+	}
+}
@@ -15,18 +15,24 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/jwt"
+	"github.com/matrix-org/dendrite/clientapi/auth/ldap"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/push/storage"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/common/transactions"
@@ -39,6 +45,7 @@ import (
 const pathPrefixV1 = "/_matrix/client/api/v1"
 const pathPrefixR0 = "/_matrix/client/r0"
 const pathPrefixUnstable = "/_matrix/client/unstable"
+const pathPrefixAdmin = "/_dendrite/admin/v1"
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
 // to clients which need to make outbound HTTP requests.
@@ -53,6 +60,7 @@ func Setup(
 	asAPI appserviceAPI.AppServiceQueryAPI,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
+	pushDB storage.Database,
 	federation *gomatrixserverlib.FederationClient,
 	keyRing gomatrixserverlib.KeyRing,
 	userUpdateProducer *producers.UserUpdateProducer,
@@ -81,6 +89,7 @@ func Setup(
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 	v1mux := apiMux.PathPrefix(pathPrefixV1).Subrouter()
 	unstableMux := apiMux.PathPrefix(pathPrefixUnstable).Subrouter()
+	adminMux := apiMux.PathPrefix(pathPrefixAdmin).Subrouter()
 
 	authData := auth.Data{
 		AccountDB:   accountDB,
@@ -88,6 +97,36 @@ func Setup(
 		AppServices: cfg.Derived.ApplicationServices,
 	}
 
+	var ssoProvider *sso.Provider
+	if cfg.Matrix.OpenIDConnect.Enabled {
+		ssoProvider = sso.NewProvider(
+			&cfg.Matrix.OpenIDConnect, &http.Client{Timeout: 30 * time.Second},
+		)
+	}
+	var casProvider *sso.CASProvider
+	if cfg.Matrix.CAS.Enabled {
+		casProvider = sso.NewCASProvider(
+			&cfg.Matrix.CAS, &http.Client{Timeout: 30 * time.Second},
+		)
+	}
+	var ldapAuth *ldap.Authenticator
+	if cfg.Matrix.LDAP.Enabled {
+		ldapAuth = ldap.NewAuthenticator(&cfg.Matrix.LDAP)
+	}
+	var mailer *threepid.Mailer
+	if cfg.Matrix.Email.Enabled {
+		mailer = threepid.NewMailer(&cfg.Matrix.Email)
+	}
+	var smsSender *threepid.SMSSender
+	if cfg.Matrix.SMS.Enabled {
+		smsSender = threepid.NewSMSSender(&cfg.Matrix.SMS, &http.Client{Timeout: 30 * time.Second})
+	}
+	rateLimits := ratelimit.NewRateLimits(cfg)
+	var jwtVerifier *jwt.Verifier
+	if cfg.Matrix.JWT.Enabled {
+		jwtVerifier = jwt.NewVerifier(&cfg.Matrix.JWT)
+	}
+
 	r0mux.Handle("/createRoom",
 		common.MakeAuthAPI("createRoom", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return CreateRoom(req, device, cfg, producer, accountDB, rsAPI, asAPI)
@@ -95,6 +134,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
 		common.MakeAuthAPI(gomatrixserverlib.Join, authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if resErr := rateLimits.LimitDevice(ratelimit.Joins, device); resErr != nil {
+				return *resErr
+			}
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -104,11 +146,43 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	// TODO: Add /knock/{roomIDOrAlias} once a supported room version allows
+	// knocking. The roomserver already tracks knock memberships.
 	r0mux.Handle("/joined_rooms",
 		common.MakeAuthAPI("joined_rooms", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, accountDB)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/aliases",
+		common.MakeAuthAPI("rooms_aliases", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetAliases(req, device, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		common.MakeAuthAPI("rooms_report", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, accountDB, device, rsAPI, vars["roomID"], vars["eventID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		common.MakeAuthAPI("rooms_upgrade", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UpgradeRoom(req, device, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/leave",
 		common.MakeAuthAPI("membership", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
@@ -126,27 +200,38 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if vars["membership"] == gomatrixserverlib.Join {
+				if resErr := rateLimits.LimitDevice(ratelimit.Joins, device); resErr != nil {
+					return *resErr
+				}
+			}
 			return SendMembership(req, accountDB, device, vars["roomID"], vars["membership"], cfg, rsAPI, asAPI, producer)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
 		common.MakeAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if resErr := rateLimits.LimitDevice(ratelimit.Messaging, device); resErr != nil {
+				return *resErr
+			}
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, producer, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, accountDB, rsAPI, producer, nil, federation)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		common.MakeAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			if resErr := rateLimits.LimitDevice(ratelimit.Messaging, device); resErr != nil {
+				return *resErr
+			}
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, producer, transactionsCache)
+				nil, cfg, accountDB, rsAPI, producer, transactionsCache, federation)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
@@ -195,7 +280,7 @@ func Setup(
 			if strings.HasSuffix(eventType, "/") {
 				eventType = eventType[:len(eventType)-1]
 			}
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, producer, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, accountDB, rsAPI, producer, nil, federation)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -206,15 +291,21 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, producer, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, accountDB, rsAPI, producer, nil, federation)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", common.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
+		if resErr := rateLimits.LimitIP(ratelimit.Registration, req); resErr != nil {
+			return *resErr
+		}
 		return Register(req, accountDB, deviceDB, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v1mux.Handle("/register", common.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
+		if resErr := rateLimits.LimitIP(ratelimit.Registration, req); resErr != nil {
+			return *resErr
+		}
 		return LegacyRegister(req, accountDB, deviceDB, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
@@ -284,56 +375,134 @@ func Setup(
 
 	r0mux.Handle("/login",
 		common.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return Login(req, accountDB, deviceDB, cfg)
+			if req.Method == http.MethodPost {
+				if resErr := rateLimits.LimitIP(ratelimit.Login, req); resErr != nil {
+					return *resErr
+				}
+			}
+			return Login(req, accountDB, deviceDB, ldapAuth, jwtVerifier, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		common.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
-			return AuthFallback(w, req, vars["authType"], cfg)
+			return AuthFallback(w, req, vars["authType"], ssoProvider, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/login/sso/redirect",
+		common.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return SSORedirect(w, req, ssoProvider, casProvider, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/login/sso/callback",
+		common.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return SSOCallback(w, req, ssoProvider, accountDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/login/cas/redirect",
+		common.MakeHTMLAPI("login_cas_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return CASRedirect(w, req, casProvider, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/login/cas/ticket",
+		common.MakeHTMLAPI("login_cas_ticket", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return CASTicket(w, req, casProvider, accountDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/pushrules/",
-		common.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		common.MakeAuthAPI("push_rules", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetAllPushRules(req, accountDB, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		common.MakeAuthAPI("push_rules_by_scope", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRulesByScope(req, accountDB, device, vars["scope"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/user/{userId}/filter",
-		common.MakeAuthAPI("put_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		common.MakeAuthAPI("push_rules_by_kind", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return PutFilter(req, device, accountDB, vars["userId"])
+			return GetPushRulesByKind(req, accountDB, device, vars["scope"], vars["kind"])
 		}),
-	).Methods(http.MethodPost, http.MethodOptions)
+	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/user/{userId}/filter/{filterId}",
-		common.MakeAuthAPI("get_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("push_rule_by_rule_id", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetFilter(req, device, accountDB, vars["userId"], vars["filterId"])
+			return GetPushRuleByRuleID(req, accountDB, device, vars["scope"], vars["kind"], vars["ruleID"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("put_push_rule_by_rule_id", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleByRuleID(req, accountDB, device, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("delete_push_rule_by_rule_id", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req, accountDB, device, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodDelete)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		common.MakeAuthAPI("push_rule_attr_by_rule_id", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleAttrByRuleID(req, accountDB, device, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		common.MakeAuthAPI("put_push_rule_attr_by_rule_id", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req, accountDB, device, syncProducer, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushers",
+		common.MakeAuthAPI("get_pushers", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetPushers(req, pushDB, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		common.MakeAuthAPI("set_pusher", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return SetPusher(req, pushDB, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// Riot user settings
 
 	r0mux.Handle("/profile/{userID}",
@@ -398,19 +567,190 @@ func Setup(
 
 	r0mux.Handle("/account/3pid",
 		common.MakeAuthAPI("account_3pid", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return CheckAndSave3PIDAssociation(req, accountDB, device, cfg)
+			return CheckAndSave3PIDAssociation(req, accountDB, device, mailer, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	unstableMux.Handle("/account/3pid/delete",
-		common.MakeAuthAPI("account_3pid", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return Forget3PID(req, accountDB)
+	unstableMux.Handle("/terms",
+		common.MakeExternalAPI("terms", func(req *http.Request) util.JSONResponse {
+			return GetTerms(cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/terms",
+		common.MakeAuthAPI("accept_terms", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return AcceptTerms(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost)
+
+	r0mux.Handle("/register/m.login.registration_token/validity",
+		common.MakeExternalAPI("registration_token_validity", func(req *http.Request) util.JSONResponse {
+			return RegistrationTokenValidity(req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens",
+		common.MakeAuthAPI("admin_registration_tokens", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetRegistrationTokens(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens/new",
+		common.MakeAuthAPI("admin_create_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return CreateRegistrationToken(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens/{token}",
+		common.MakeAuthAPI("admin_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRegistrationToken(req, accountDB, device, cfg, vars["token"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/registrationTokens/{token}",
+		common.MakeAuthAPI("admin_delete_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteRegistrationToken(req, accountDB, device, cfg, vars["token"])
+		}),
+	).Methods(http.MethodDelete)
+
+	adminMux.Handle("/eventReports",
+		common.MakeAuthAPI("admin_event_reports", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetEventReports(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/eventReports/{reportID}",
+		common.MakeAuthAPI("admin_event_report", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetEventReport(req, accountDB, device, cfg, vars["reportID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/eventReports/{reportID}/resolve",
+		common.MakeAuthAPI("admin_resolve_event_report", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ResolveEventReport(req, accountDB, device, cfg, vars["reportID"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	adminMux.Handle("/rooms/{roomID}/announceOnly",
+		common.MakeAuthAPI("admin_room_announce_only", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRoomAnnounceOnly(req, device, cfg, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	adminMux.Handle("/rooms/{roomID}/announceOnly",
+		common.MakeAuthAPI("admin_set_room_announce_only", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetRoomAnnounceOnly(req, device, cfg, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/account/3pid/add",
+		common.MakeAuthAPI("account_3pid_add", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return Add3PID(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	forget3PIDHandler := common.MakeAuthAPI("account_3pid_delete", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return Forget3PID(req, accountDB, device)
+	})
+	r0mux.Handle("/account/3pid/delete", forget3PIDHandler).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/account/3pid/delete", forget3PIDHandler).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/email/requestToken",
 		common.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, accountDB, cfg)
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return *resErr
+			}
+			return RequestEmailToken(req, accountDB, mailer, "add it to your account", cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/register/email/requestToken",
+		common.MakeExternalAPI("register_request_token", func(req *http.Request) util.JSONResponse {
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return *resErr
+			}
+			return RequestEmailToken(req, accountDB, mailer, "register an account", cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/{path:(?:account/3pid|register)}/msisdn/requestToken",
+		common.MakeExternalAPI("msisdn_request_token", func(req *http.Request) util.JSONResponse {
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return *resErr
+			}
+			return RequestMSISDNToken(req, accountDB, smsSender, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/threepid/msisdn/submitToken",
+		common.MakeExternalAPI("threepid_msisdn_submit_token", func(req *http.Request) util.JSONResponse {
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return *resErr
+			}
+			return SubmitMSISDNToken(req, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/pushers/email/unsubscribe",
+		common.MakeHTMLAPI("pushers_email_unsubscribe", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			return UnsubscribeEmailPusher(w, req, pushDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/threepid/email/submitToken",
+		common.MakeHTMLAPI("threepid_email_submit_token", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return resErr
+			}
+			return SubmitEmailToken(w, req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/account/password/email/requestToken",
+		common.MakeExternalAPI("account_password_request_token", func(req *http.Request) util.JSONResponse {
+			if resErr := rateLimits.LimitIP(ratelimit.ThreePIDValidation, req); resErr != nil {
+				return *resErr
+			}
+			return RequestPasswordResetEmailToken(req, accountDB, mailer, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/password",
+		common.MakeExternalAPI("account_password", func(req *http.Request) util.JSONResponse {
+			// The access token is optional, since users who have forgotten
+			// their password can reset it by validating their email address.
+			var device *authtypes.Device
+			if _, err := auth.ExtractAccessToken(req); err == nil {
+				var resErr *util.JSONResponse
+				if device, resErr = auth.VerifyUserFromRequest(req, authData); resErr != nil {
+					return *resErr
+				}
+			}
+			return Password(req, accountDB, deviceDB, device, mailer, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
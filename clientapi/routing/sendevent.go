@@ -15,9 +15,12 @@
 package routing
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
@@ -45,10 +48,19 @@ func SendEvent(
 	device *authtypes.Device,
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.Dendrite,
+	accountDB accounts.Database,
 	rsAPI api.RoomserverInternalAPI,
 	producer *producers.RoomserverProducer,
 	txnCache *transactions.Cache,
+	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
+	// Users can't send messages until they've consented to the terms
+	if stateKey == nil {
+		if resErr := checkTermsConsent(req, accountDB, device, cfg); resErr != nil {
+			return *resErr
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -65,7 +77,7 @@ func SendEvent(
 		}
 	}
 
-	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
+	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI, federation)
 	if resErr != nil {
 		return *resErr
 	}
@@ -116,6 +128,7 @@ func generateSendEvent(
 	roomID, eventType string, stateKey *string,
 	cfg *config.Dendrite,
 	rsAPI api.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
 ) (*gomatrixserverlib.Event, *util.JSONResponse) {
 	// parse the incoming http request
 	userID := device.UserID
@@ -133,6 +146,12 @@ func generateSendEvent(
 		}
 	}
 
+	if eventType == "m.room.canonical_alias" && stateKey != nil && *stateKey == "" {
+		if resErr = validateCanonicalAlias(req, r, roomID, cfg, rsAPI, federation); resErr != nil {
+			return nil, resErr
+		}
+	}
+
 	// create the new event and set all the fields we can
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -174,3 +193,67 @@ func generateSendEvent(
 	}
 	return e, nil
 }
+
+// validateCanonicalAlias returns an error response if the content of an
+// m.room.canonical_alias event is invalid, which it is if any of its aliases
+// are malformed or don't point to the room.
+func validateCanonicalAlias(
+	req *http.Request,
+	content map[string]interface{},
+	roomID string,
+	cfg *config.Dendrite,
+	rsAPI api.RoomserverInternalAPI,
+	federation *gomatrixserverlib.FederationClient,
+) *util.JSONResponse {
+	var aliasContent common.CanonicalAliasContent
+	raw, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(raw, &aliasContent)
+	}
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("'alias' must be a string and 'alt_aliases' a list of strings"),
+		}
+	}
+
+	aliases := aliasContent.AltAliases
+	if aliasContent.Alias != "" {
+		aliases = append([]string{aliasContent.Alias}, aliases...)
+	}
+	for _, alias := range aliases {
+		var domain gomatrixserverlib.ServerName
+		if _, domain, err = gomatrixserverlib.SplitID('#', alias); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("%q is not a valid room alias", alias)),
+			}
+		}
+
+		var aliasRoomID string
+		if domain == cfg.Matrix.ServerName {
+			queryReq := api.GetRoomIDForAliasRequest{Alias: alias}
+			var queryRes api.GetRoomIDForAliasResponse
+			if err = rsAPI.GetRoomIDForAlias(req.Context(), &queryReq, &queryRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
+			aliasRoomID = queryRes.RoomID
+		} else {
+			// If the remote server can't be reached then the alias can't be
+			// shown to point to the room, so it is rejected.
+			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), domain, alias)
+			if fedErr == nil {
+				aliasRoomID = fedRes.RoomID
+			}
+		}
+		if aliasRoomID != roomID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadAlias(fmt.Sprintf("Room alias %s does not point to the room", alias)),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long users have to sign on at the identity provider.
+	ssoStateLifetime = 10 * time.Minute
+	// How long clients have to exchange a login token for an access token.
+	loginTokenLifetime = 2 * time.Minute
+	// How many numbered localparts to try when the localpart which a user's
+	// claims map to is taken.
+	maxLocalpartAttempts = 100
+	// The cookie which binds a sign-on in progress to the browser which
+	// started it.
+	ssoStateCookie = "dendrite_sso_state"
+	// The path of the cookie, which covers the endpoints that the identity
+	// provider and the CAS server redirect users back to.
+	ssoStateCookiePath = "/_matrix/client/r0/login/"
+)
+
+// ssoConfirmTemplate is an HTML template presented to the user after signing
+// on, before they are sent back to a client which isn't on the whitelist, as
+// the client is given access to their account.
+const ssoConfirmTemplate = `
+<html>
+<head>
+<title>Continue to your client</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>You are about to give {{.clientURL}} access to your account {{.userID}}.</p>
+        <p>If you didn't start logging in to this application, close this window.</p>
+        <p><a href="{{.redirectURL}}">Continue</a></p>
+    </div>
+</body>
+</html>
+`
+
+// ssoState is a sign-on in progress at the identity provider. Either the
+// client is logging in, and is sent back to the redirect URL with a login
+// token, or it is completing a stage of user-interactive authentication.
+type ssoState struct {
+	redirectURL string
+	sessionID   string
+	expires     time.Time
+}
+
+type loginToken struct {
+	localpart string
+	expires   time.Time
+}
+
+// ssoStore keeps track of the sign-ons in progress and the login tokens which
+// haven't been used yet. Like the user-interactive authentication sessions
+// they are only kept in memory.
+type ssoStore struct {
+	sync.Mutex
+	states      map[string]ssoState
+	loginTokens map[string]loginToken
+}
+
+var ssoSessions = &ssoStore{
+	states:      make(map[string]ssoState),
+	loginTokens: make(map[string]loginToken),
+}
+
+// addState stores a sign-on in progress and returns the state which
+// identifies it to the callback.
+func (s *ssoStore) addState(redirectURL, sessionID string) (string, error) {
+	state, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	s.states[state] = ssoState{redirectURL, sessionID, time.Now().Add(ssoStateLifetime)}
+	return state, nil
+}
+
+// takeState returns and removes the sign-on identified by the state.
+func (s *ssoStore) takeState(state string) (ssoState, bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	st, ok := s.states[state]
+	delete(s.states, state)
+	return st, ok
+}
+
+// addLoginToken returns a new login token for the user.
+func (s *ssoStore) addLoginToken(localpart string) (string, error) {
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	s.loginTokens[token] = loginToken{localpart, time.Now().Add(loginTokenLifetime)}
+	return token, nil
+}
+
+// takeLoginToken returns the localpart of the user who the login token is
+// for, and removes it so that it can only be used once.
+func (s *ssoStore) takeLoginToken(token string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	lt, ok := s.loginTokens[token]
+	delete(s.loginTokens, token)
+	return lt.localpart, ok
+}
+
+func (s *ssoStore) removeExpired() {
+	now := time.Now()
+	for state, st := range s.states {
+		if now.After(st.expires) {
+			delete(s.states, state)
+		}
+	}
+	for token, lt := range s.loginTokens {
+		if now.After(lt.expires) {
+			delete(s.loginTokens, token)
+		}
+	}
+}
+
+// SSORedirect implements GET /login/sso/redirect?redirectUrl={redirectURL}.
+// Users sign on with the OpenID Connect provider if there is one, or else with
+// the CAS server.
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, provider *sso.Provider,
+	casProvider *sso.CASProvider, cfg *config.Dendrite,
+) *util.JSONResponse {
+	if provider == nil {
+		return CASRedirect(w, req, casProvider, cfg)
+	}
+	redirectURL, errRes := clientRedirectURL(req, cfg.Matrix.OpenIDConnect.ClientRedirectWhitelist)
+	if errRes != nil {
+		return errRes
+	}
+	return redirectToProvider(w, req, provider, redirectURL, "")
+}
+
+// setStateCookie binds the sign-on identified by the state to the browser,
+// so that it can only be completed by the browser which started it. This
+// stops an attacker from logging a victim in to the attacker's account. The
+// cookie is only marked secure if users are sent back over HTTPS.
+func setStateCookie(w http.ResponseWriter, state, callbackURL string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     ssoStateCookiePath,
+		MaxAge:   int(ssoStateLifetime / time.Second),
+		Secure:   strings.HasPrefix(callbackURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeBoundState returns and removes the sign-on identified by the state, as
+// long as it was started by the browser which made the request. The cookie
+// is removed either way.
+func takeBoundState(w http.ResponseWriter, req *http.Request, state string) (ssoState, bool) {
+	cookie, err := req.Cookie(ssoStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return ssoState{}, false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoStateCookie,
+		Path:   ssoStateCookiePath,
+		MaxAge: -1,
+	})
+	return ssoSessions.takeState(state)
+}
+
+// CASRedirect implements GET /login/cas/redirect?redirectUrl={redirectURL}
+func CASRedirect(
+	w http.ResponseWriter, req *http.Request, casProvider *sso.CASProvider,
+	cfg *config.Dendrite,
+) *util.JSONResponse {
+	if casProvider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is disabled on this homeserver"),
+		}
+	}
+	redirectURL, errRes := clientRedirectURL(req, cfg.Matrix.CAS.ClientRedirectWhitelist)
+	if errRes != nil {
+		return errRes
+	}
+	// The CAS protocol has no state parameter, so the state is only kept in
+	// the cookie, and the redirect URL is checked against it on the way back.
+	state, err := ssoSessions.addState(redirectURL, "")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoSessions.addState failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	setStateCookie(w, state, casProvider.ServiceURL(redirectURL))
+	http.Redirect(w, req, casProvider.LoginURL(redirectURL), http.StatusFound)
+	return nil
+}
+
+// CASTicket implements GET /login/cas/ticket?redirectUrl={redirectURL}&ticket={ticket},
+// which the CAS server redirects users back to after they have signed on.
+func CASTicket(
+	w http.ResponseWriter, req *http.Request, casProvider *sso.CASProvider,
+	accountDB accounts.Database, cfg *config.Dendrite,
+) *util.JSONResponse {
+	if casProvider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is disabled on this homeserver"),
+		}
+	}
+	redirectURL, errRes := clientRedirectURL(req, cfg.Matrix.CAS.ClientRedirectWhitelist)
+	if errRes != nil {
+		return errRes
+	}
+	var state string
+	if cookie, err := req.Cookie(ssoStateCookie); err == nil {
+		state = cookie.Value
+	}
+	if st, ok := takeBoundState(w, req, state); !ok || st.redirectURL != redirectURL {
+		return writeHTTPMessage(w, req,
+			"Unknown or expired single sign-on session, please try again",
+			http.StatusBadRequest,
+		)
+	}
+	ticket := req.URL.Query().Get("ticket")
+	if ticket == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("ticket parameter missing"),
+		}
+	}
+
+	identity, err := casProvider.ValidateTicket(req.Context(), ticket, redirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("casProvider.ValidateTicket failed")
+		return writeHTTPMessage(w, req, "Single sign-on failed", http.StatusUnauthorized)
+	}
+	localpart, err := localpartForSSOIdentity(
+		req.Context(), accountDB, identity,
+		cfg.Matrix.CAS.LocalpartAttribute, cfg.Matrix.CAS.DisplayNameAttribute, cfg,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("localpartForSSOIdentity failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	return redirectWithLoginToken(w, req, redirectURL, localpart, cfg.Matrix.CAS.ClientRedirectWhitelist, cfg)
+}
+
+// clientRedirectURL returns the URL which the client asked to be sent back to
+// after the user has signed on, or an error response if it isn't allowed. If
+// there is a whitelist then the URL must be on it.
+func clientRedirectURL(req *http.Request, whitelist []string) (string, *util.JSONResponse) {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("redirectUrl parameter missing"),
+		}
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil || !redirectURLAllowed(u) || (len(whitelist) > 0 && !redirectURLWhitelisted(u, whitelist)) {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl is not allowed"),
+		}
+	}
+	return redirectURL, nil
+}
+
+// SSOCallback implements GET /login/sso/callback, which the identity provider
+// redirects users back to after they have signed on.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, provider *sso.Provider,
+	accountDB accounts.Database, cfg *config.Dendrite,
+) *util.JSONResponse {
+	if provider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is disabled on this homeserver"),
+		}
+	}
+	query := req.URL.Query()
+	st, ok := takeBoundState(w, req, query.Get("state"))
+	if !ok {
+		return writeHTTPMessage(w, req,
+			"Unknown or expired single sign-on session, please try again",
+			http.StatusBadRequest,
+		)
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		util.GetLogger(req.Context()).WithField("error", errCode).Warn("Identity provider returned an error")
+		return writeHTTPMessage(w, req,
+			"Single sign-on failed: "+errCode+" "+query.Get("error_description"),
+			http.StatusUnauthorized,
+		)
+	}
+
+	identity, err := provider.Exchange(req.Context(), query.Get("code"))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.Exchange failed")
+		return writeHTTPMessage(w, req, "Single sign-on failed", http.StatusUnauthorized)
+	}
+	if st.sessionID != "" {
+		return completeSSOStage(w, req, accountDB, identity, st.sessionID, cfg)
+	}
+	localpart, err := localpartForSSOIdentity(
+		req.Context(), accountDB, identity,
+		cfg.Matrix.OpenIDConnect.LocalpartClaim, cfg.Matrix.OpenIDConnect.DisplayNameClaim, cfg,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("localpartForSSOIdentity failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	return redirectWithLoginToken(
+		w, req, st.redirectURL, localpart, cfg.Matrix.OpenIDConnect.ClientRedirectWhitelist, cfg,
+	)
+}
+
+// completeSSOStage adds single sign-on as a completed stage of the
+// user-interactive auth session, as long as the user who signed on is the
+// user who the session authenticates. Unlike logging in, signing on with an
+// identity which hasn't been used before doesn't create an account.
+func completeSSOStage(
+	w http.ResponseWriter, req *http.Request, accountDB accounts.Database,
+	identity *sso.Identity, sessionID string, cfg *config.Dendrite,
+) *util.JSONResponse {
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(req.Context(), identity.Issuer, identity.Subject)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForSSOIdentity failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	userID := sessions.GetSessionUser(sessionID)
+	if localpart == "" || userID == "" || userutil.MakeUserID(localpart, cfg.Matrix.ServerName) != userID {
+		util.GetLogger(req.Context()).WithFields(log.Fields{
+			"localpart": localpart,
+			"user_id":   userID,
+		}).Warn("Single sign-on for user-interactive auth as a different user")
+		return writeHTTPMessage(w, req,
+			"You signed on as a different user to the one who is logged in",
+			http.StatusForbidden,
+		)
+	}
+	AddCompletedSessionStage(sessionID, authtypes.LoginTypeSSO)
+	serveTemplate(w, successTemplate, map[string]string{})
+	return nil
+}
+
+// redirectWithLoginToken sends the client back to its redirect URL with a
+// login token for the user who signed on. Unless the redirect URL is on the
+// whitelist the user is asked to confirm first, as whoever the URL belongs to
+// can log in as them with the token.
+func redirectWithLoginToken(
+	w http.ResponseWriter, req *http.Request, clientRedirectURL, localpart string,
+	whitelist []string, cfg *config.Dendrite,
+) *util.JSONResponse {
+	token, err := ssoSessions.addLoginToken(localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoSessions.addLoginToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	redirectURL, err := url.Parse(clientRedirectURL)
+	if err != nil {
+		// This was checked when the sign-on was started.
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	whitelisted := redirectURLWhitelisted(redirectURL, whitelist)
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("loginToken", token)
+	redirectURL.RawQuery = redirectQuery.Encode()
+	if !whitelisted {
+		serveTemplate(w, ssoConfirmTemplate, map[string]string{
+			"clientURL":   clientRedirectURL,
+			"userID":      userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+			"redirectURL": redirectURL.String(),
+		})
+		return nil
+	}
+	http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+	return nil
+}
+
+// redirectToProvider sends the user to sign on at the identity provider.
+func redirectToProvider(
+	w http.ResponseWriter, req *http.Request, provider *sso.Provider,
+	redirectURL, sessionID string,
+) *util.JSONResponse {
+	state, err := ssoSessions.addState(redirectURL, sessionID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoSessions.addState failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), state)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.AuthorizationURL failed")
+		return writeHTTPMessage(w, req,
+			"The single sign-on provider is unavailable",
+			http.StatusBadGateway,
+		)
+	}
+	setStateCookie(w, state, provider.CallbackURL())
+	http.Redirect(w, req, authURL, http.StatusFound)
+	return nil
+}
+
+// redirectURLAllowed returns whether the URL could be a client to send users
+// back to after signing on. It must be absolute, and not a URL which runs
+// script if the user follows it.
+func redirectURLAllowed(u *url.URL) bool {
+	if !u.IsAbs() {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "javascript", "data", "vbscript", "file":
+		return false
+	}
+	return true
+}
+
+// redirectURLWhitelisted returns whether clients can be sent straight back to
+// the URL with a login token. The URL must have the same scheme and host as a
+// URL on the whitelist, and be at or below its path. An empty whitelist has
+// nothing on it, so users are always asked to confirm.
+func redirectURLWhitelisted(u *url.URL, whitelist []string) bool {
+	for _, entry := range whitelist {
+		allowed, err := url.Parse(entry)
+		if err != nil || !allowed.IsAbs() {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, allowed.Scheme) || !strings.EqualFold(u.Host, allowed.Host) {
+			continue
+		}
+		prefix := allowed.Path
+		if prefix == "" || u.Path == prefix {
+			return true
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if strings.HasPrefix(u.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// localpartForSSOIdentity returns the localpart of the user who signs on with
+// the identity. If this is the first time that the identity has been used, a
+// new account is created for it, named after the localpart claim or else after
+// the subject, and with its display name set from the display name claim.
+func localpartForSSOIdentity(
+	ctx context.Context, accountDB accounts.Database, identity *sso.Identity,
+	localpartClaim, displayNameClaim string, cfg *config.Dendrite,
+) (string, error) {
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != nil || localpart != "" {
+		return localpart, err
+	}
+
+	base := mapLocalpart(identity.Subject)
+	if localpartClaim != "" {
+		base = mapLocalpart(identity.Claim(localpartClaim))
+	}
+	var acc *authtypes.Account
+	for attempt := 0; acc == nil; attempt++ {
+		if attempt >= maxLocalpartAttempts {
+			return "", fmt.Errorf("no free localpart for %q", base)
+		}
+		localpart = base
+		if base == "" {
+			var id int64
+			if id, err = accountDB.GetNewNumericLocalpart(ctx); err != nil {
+				return "", err
+			}
+			localpart = strconv.FormatInt(id, 10)
+		} else if attempt > 0 {
+			localpart = base + strconv.Itoa(attempt)
+		}
+		if UsernameMatchesExclusiveNamespaces(cfg, localpart) {
+			continue
+		}
+		// The account is passwordless, so the user can only log in by signing
+		// on. CreateAccount returns a nil account if the localpart is taken.
+		if acc, err = accountDB.CreateAccount(ctx, localpart, "", ""); err != nil {
+			return "", err
+		}
+	}
+	if err = accountDB.SaveSSOIdentity(ctx, identity.Issuer, identity.Subject, localpart); err != nil {
+		return "", err
+	}
+	if displayName := identity.Claim(displayNameClaim); displayName != "" {
+		if err = accountDB.SetDisplayName(ctx, localpart, displayName); err != nil {
+			return "", err
+		}
+	}
+	amtRegUsers.Inc()
+	return localpart, nil
+}
+
+// mapLocalpart makes a valid localpart from a claim about the user, by
+// lowercasing it and replacing the characters which aren't allowed.
+func mapLocalpart(claim string) string {
+	// Use the part before the domain of claims which are email addresses.
+	if i := strings.Index(claim, "@"); i >= 0 {
+		claim = claim[:i]
+	}
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.', r == '/':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, claim)
+	// Leave room for the numbers which are added if the localpart is taken.
+	if len(mapped) > maxUsernameLength-2 {
+		mapped = mapped[:maxUsernameLength-2]
+	}
+	return strings.TrimLeft(mapped, "_")
+}
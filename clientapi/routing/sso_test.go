@@ -0,0 +1,283 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestSSOUserInteractiveAuth(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "hollow.knight"
+	cfg.Matrix.OpenIDConnect.Enabled = true
+
+	for _, localpart := range []string{"hornet", "zote"} {
+		if _, err := db.CreateAccount(ctx, localpart, "", ""); err != nil {
+			t.Fatalf("CreateAccount returned %s", err)
+		}
+		if err := db.SaveSSOIdentity(ctx, "https://idp.example", localpart+"-subject", localpart); err != nil {
+			t.Fatalf("SaveSSOIdentity returned %s", err)
+		}
+	}
+	hornet := &authtypes.Device{UserID: "@hornet:hollow.knight"}
+	zote := &authtypes.Device{UserID: "@zote:hollow.knight"}
+
+	// Starting user-interactive auth ties the session to the user, and
+	// offers signing on as well as the password.
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	res := checkLoggedInUserAuth(req, db, hornet, authDict{}, cfg)
+	if res == nil || res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected user-interactive auth to be required, got %v", res)
+	}
+	uia := res.JSON.(userInteractiveResponse)
+	if len(uia.Flows) != 2 || uia.Flows[1].Stages[0] != authtypes.LoginTypeSSO {
+		t.Fatalf("expected the single sign-on flow to be offered, got %v", uia.Flows)
+	}
+	sessionID := uia.Session
+	auth := authDict{Type: authtypes.LoginTypeSSO, Session: sessionID}
+
+	// Signing on as another user, or with an identity which isn't
+	// associated with an account, doesn't complete the stage.
+	for _, subject := range []string{"zote-subject", "unknown-subject"} {
+		w := httptest.NewRecorder()
+		identity := &sso.Identity{Issuer: "https://idp.example", Subject: subject}
+		if res = completeSSOStage(w, req, db, identity, sessionID, cfg); res != nil || w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected signing on to be forbidden, got %v %d", subject, res, w.Code)
+		}
+		if res = checkLoggedInUserAuth(req, db, hornet, auth, cfg); res == nil {
+			t.Fatalf("%s: expected the stage not to be completed", subject)
+		}
+	}
+	if localpart, err := db.GetLocalpartForSSOIdentity(ctx, "https://idp.example", "unknown-subject"); err != nil || localpart != "" {
+		t.Errorf("expected no account to be created for the unknown identity, got %q (err %v)", localpart, err)
+	}
+
+	w := httptest.NewRecorder()
+	identity := &sso.Identity{Issuer: "https://idp.example", Subject: "hornet-subject"}
+	if res = completeSSOStage(w, req, db, identity, sessionID, cfg); res != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected signing on to complete the stage, got %v %d", res, w.Code)
+	}
+	if res = checkLoggedInUserAuth(req, db, hornet, auth, cfg); res != nil {
+		t.Errorf("expected user-interactive auth to be completed, got %v", res)
+	}
+	// The session can't be used by another user, who is given a new one.
+	res = checkLoggedInUserAuth(req, db, zote, auth, cfg)
+	if res == nil || res.JSON.(userInteractiveResponse).Session == sessionID {
+		t.Errorf("expected another user to be given a new session, got %v", res)
+	}
+}
+
+func TestRedirectURLWhitelisted(t *testing.T) {
+	whitelist := []string{"https://good.example", "https://app.example/client/", "element://"}
+	for _, tc := range []struct {
+		redirectURL string
+		want        bool
+	}{
+		{"https://good.example", true},
+		{"https://good.example/anything?x=1", true},
+		{"HTTPS://GOOD.EXAMPLE/", true},
+		{"https://good.example.evil.com/", false},
+		{"https://good.example@evil.com/", false},
+		{"http://good.example/", false},
+		{"https://good.example:8443/", false},
+		{"https://app.example/client/", true},
+		{"https://app.example/client/page", true},
+		{"https://app.example/client", false},
+		{"https://app.example/clientevil", false},
+		{"https://app.example/", false},
+		{"element://", true},
+	} {
+		u, err := url.Parse(tc.redirectURL)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) returned %s", tc.redirectURL, err)
+		}
+		if got := redirectURLWhitelisted(u, whitelist); got != tc.want {
+			t.Errorf("%s: want whitelisted %v, got %v", tc.redirectURL, tc.want, got)
+		}
+		if redirectURLWhitelisted(u, nil) {
+			t.Errorf("%s: want nothing whitelisted by an empty whitelist", tc.redirectURL)
+		}
+	}
+
+	for _, redirectURL := range []string{"/relative", "javascript:alert(1)", "data:text/html,hi"} {
+		u, err := url.Parse(redirectURL)
+		if err == nil && redirectURLAllowed(u) {
+			t.Errorf("%s: want the redirect URL not to be allowed", redirectURL)
+		}
+	}
+}
+
+func TestRedirectWithLoginToken(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "hollow.knight"
+	whitelist := []string{"https://good.example/"}
+
+	// Whitelisted clients are sent straight back with a login token.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if res := redirectWithLoginToken(w, req, "https://good.example/app", "hornet", whitelist, cfg); res != nil {
+		t.Fatalf("redirectWithLoginToken returned %v", res)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || location.Host != "good.example" {
+		t.Fatalf("expected a redirect to the client, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if localpart, ok := ssoSessions.takeLoginToken(location.Query().Get("loginToken")); !ok || localpart != "hornet" {
+		t.Errorf("expected a login token for hornet, got %q %v", localpart, ok)
+	}
+
+	// Other clients, and every client when the whitelist is empty, are only
+	// given the login token once the user confirms.
+	for _, wl := range [][]string{whitelist, nil} {
+		w = httptest.NewRecorder()
+		if res := redirectWithLoginToken(w, req, "https://evil.example/", "hornet", wl, cfg); res != nil {
+			t.Fatalf("redirectWithLoginToken returned %v", res)
+		}
+		if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+			t.Errorf("whitelist %v: expected a confirmation page, got %d %q", wl, w.Code, w.Header().Get("Location"))
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "@hornet:hollow.knight") || !strings.Contains(body, `href="https://evil.example/?loginToken=`) {
+			t.Errorf("whitelist %v: expected the confirmation page to link to the client, got %s", wl, body)
+		}
+	}
+}
+
+func TestSSOStateBoundToBrowser(t *testing.T) {
+	state, err := ssoSessions.addState("https://good.example/", "")
+	if err != nil {
+		t.Fatalf("addState returned %s", err)
+	}
+	w := httptest.NewRecorder()
+	setStateCookie(w, state, "https://matrix.example"+sso.CallbackPath)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("expected a secure HTTP-only state cookie, got %v", cookies)
+	}
+
+	// A callback from another browser, e.g. because an attacker sent the
+	// victim their own callback URL, is refused and doesn't use up the state.
+	req := httptest.NewRequest(http.MethodGet, "/?state="+state, nil)
+	if _, ok := takeBoundState(httptest.NewRecorder(), req, state); ok {
+		t.Errorf("expected the state to be refused without the cookie")
+	}
+	req.AddCookie(&http.Cookie{Name: ssoStateCookie, Value: "other"})
+	if _, ok := takeBoundState(httptest.NewRecorder(), req, state); ok {
+		t.Errorf("expected the state to be refused with another browser's cookie")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/?state="+state, nil)
+	req.AddCookie(cookies[0])
+	st, ok := takeBoundState(httptest.NewRecorder(), req, state)
+	if !ok || st.redirectURL != "https://good.example/" {
+		t.Errorf("expected the state to be accepted from the browser which started it, got %+v %v", st, ok)
+	}
+	if _, ok = takeBoundState(httptest.NewRecorder(), req, state); ok {
+		t.Errorf("expected the state to only be used once")
+	}
+}
+
+func TestCASLogin(t *testing.T) {
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+			<cas:authenticationSuccess><cas:user>hornet</cas:user></cas:authenticationSuccess>
+		</cas:serviceResponse>`))
+		if err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer srv.Close()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "hollow.knight"
+	cfg.Matrix.CAS = config.CAS{
+		Enabled:                 true,
+		ServerURL:               srv.URL + "/cas",
+		PublicBaseURL:           "https://matrix.example",
+		ClientRedirectWhitelist: []string{"https://good.example/"},
+	}
+	cfg.Derived.ExclusiveApplicationServicesUsernameRegexp = regexp.MustCompile("^$")
+	provider := sso.NewCASProvider(&cfg.Matrix.CAS, srv.Client())
+
+	// Clients which aren't whitelisted can't start signing on.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?redirectUrl="+url.QueryEscape("https://good.example.evil.com/"), nil)
+	if res := CASRedirect(w, req, provider, cfg); res == nil || res.Code != http.StatusBadRequest {
+		t.Errorf("expected the redirect URL to be rejected, got %v", res)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected no state cookie for a rejected redirect URL")
+	}
+
+	redirectURL := "https://good.example/app"
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?redirectUrl="+url.QueryEscape(redirectURL), nil)
+	if res := CASRedirect(w, req, provider, cfg); res != nil || w.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the CAS server, got %v %d", res, w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ssoStateCookie {
+		t.Fatalf("expected a state cookie, got %v", cookies)
+	}
+
+	ticket := func(redirectURL string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?ticket=ST-1&redirectUrl="+url.QueryEscape(redirectURL), nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if res := CASTicket(w, req, provider, db, cfg); res != nil {
+			w.Code = res.Code
+		}
+		return w
+	}
+	// The ticket is refused from another browser, for a redirect URL which
+	// isn't whitelisted, or for a different redirect URL to the one which
+	// signing on was started for.
+	if w = ticket(redirectURL); w.Code != http.StatusBadRequest {
+		t.Errorf("expected the ticket to be refused without the cookie, got %d", w.Code)
+	}
+	if w = ticket("https://evil.example/", cookies...); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a redirect URL which isn't whitelisted to be rejected, got %d", w.Code)
+	}
+	if w = ticket("https://good.example/other", cookies...); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a different redirect URL to be refused, got %d", w.Code)
+	}
+
+	// The state was used up by the refused ticket, so start again.
+	w = httptest.NewRecorder()
+	if res := CASRedirect(w, req, provider, cfg); res != nil {
+		t.Fatalf("CASRedirect returned %v", res)
+	}
+	w = ticket(redirectURL, w.Result().Cookies()...)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || location.Host != "good.example" || location.Query().Get("loginToken") == "" {
+		t.Errorf("expected a redirect to the client with a login token, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type acceptTermsRequest struct {
+	// The URLs of the policies which the user accepts
+	UserAccepts []string `json:"user_accepts"`
+}
+
+// GetTerms implements GET /unstable/terms, returning the policies which users
+// must consent to in the same form as the m.login.terms auth stage's params.
+func GetTerms(cfg *config.Dendrite) util.JSONResponse {
+	params, ok := cfg.Derived.Registration.Params[authtypes.LoginTypeTerms]
+	if !ok {
+		params = map[string]interface{}{"policies": struct{}{}}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: params,
+	}
+}
+
+// AcceptTerms implements POST /unstable/terms, which existing users consent
+// to the current version of the policies with.
+func AcceptTerms(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r acceptTermsRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	accepted := make(map[string]bool, len(r.UserAccepts))
+	for _, url := range r.UserAccepts {
+		accepted[url] = true
+	}
+	for _, policy := range cfg.Matrix.Terms.Policies {
+		if !accepted[policy.URL] {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The policy " + policy.URL + " must be accepted"),
+			}
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = recordTermsConsent(req.Context(), accountDB, localpart, cfg); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("recordTermsConsent failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// recordTermsConsent records that the user consented to the current version
+// of the policies.
+func recordTermsConsent(
+	ctx context.Context, accountDB accounts.Database, localpart string, cfg *config.Dendrite,
+) error {
+	if !cfg.Matrix.Terms.Enabled {
+		return nil
+	}
+	return accountDB.SetTermsConsent(
+		ctx, localpart, cfg.Matrix.Terms.Version, time.Now().UnixNano()/int64(time.Millisecond),
+	)
+}
+
+// checkTermsConsent returns an error response if the user hasn't consented to
+// the current version of the policies. Application services don't need to.
+func checkTermsConsent(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) *util.JSONResponse {
+	if !cfg.Matrix.Terms.Enabled || device.ID == types.AppServiceDeviceID {
+		return nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	version, err := accountDB.GetTermsConsent(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetTermsConsent failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if version != cfg.Matrix.Terms.Version {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.ConsentNotGiven(
+				"You must accept the current terms of service before sending messages. " +
+					"They can be fetched from and accepted at " + pathPrefixUnstable + "/terms",
+			),
+		}
+	}
+	return nil
+}
@@ -15,8 +15,18 @@
 package routing
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
 	"net/http"
+	"net/url"
+	"regexp"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -28,6 +38,16 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// How long the tokens sent to validate third-party identifiers are valid for.
+const threepidSessionLifetime = time.Hour
+
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-register-email-requesttoken
+var validClientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_-]{1,255}$`)
+
+// errThreePIDNotValidated is returned when a third-party identifier hasn't
+// been validated by the session's token being submitted.
+var errThreePIDNotValidated = errors.New("third-party identifier has not been validated")
+
 type reqTokenResponse struct {
 	SID string `json:"sid"`
 }
@@ -36,14 +56,43 @@ type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
 
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-account-3pid-add
+type add3PIDRequest struct {
+	SID    string   `json:"sid"`
+	Secret string   `json:"client_secret"`
+	Auth   authDict `json:"auth"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-register-msisdn-requesttoken
+type msisdnTokenResponse struct {
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url"`
+	MSISDN    string `json:"msisdn"`
+	IntlFmt   string `json:"intl_fmt"`
+}
+
+type forget3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.Dendrite) util.JSONResponse {
+// If emails are enabled then the validation email is sent by this server,
+// otherwise by the identity server in the request.
+func RequestEmailToken(
+	req *http.Request, accountDB accounts.Database, mailer *threepid.Mailer,
+	purpose string, cfg *config.Dendrite,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	if mailer != nil {
+		if resErr := validateEmailAssociationRequest(&body); resErr != nil {
+			return *resErr
+		}
+	}
 
 	var resp reqTokenResponse
 	var err error
@@ -65,6 +114,18 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		}
 	}
 
+	if mailer != nil {
+		resp.SID, err = sendValidationEmail(req.Context(), accountDB, mailer, body, purpose, cfg)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("sendValidationEmail failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		}
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
@@ -82,16 +143,86 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 	}
 }
 
+// RequestMSISDNToken implements:
+//     POST /account/3pid/msisdn/requestToken
+//     POST /register/msisdn/requestToken
+// The code is texted to the user, who gives it to the client to submit.
+func RequestMSISDNToken(
+	req *http.Request, accountDB accounts.Database, smsSender *threepid.SMSSender,
+	cfg *config.Dendrite,
+) util.JSONResponse {
+	if smsSender == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Phone number validation is disabled on this server"),
+		}
+	}
+	var body threepid.MSISDNAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'client_secret' is invalid."),
+		}
+	}
+	msisdn, err := threepid.NormaliseMSISDN(body.Country, body.PhoneNumber)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'phone_number' is invalid."),
+		}
+	}
+
+	// Check if the 3PID is already in use locally
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), msisdn, "msisdn")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(localpart) > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+
+	sid, err := sendValidationSMS(req.Context(), accountDB, smsSender, body, msisdn, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sendValidationSMS failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: msisdnTokenResponse{
+			SID:       sid,
+			SubmitURL: cfg.Matrix.SMS.PublicBaseURL + "/_matrix/client/unstable/threepid/msisdn/submitToken",
+			MSISDN:    msisdn,
+			IntlFmt:   "+" + msisdn,
+		},
+	}
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
 	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
-	cfg *config.Dendrite,
+	mailer *threepid.Mailer, cfg *config.Dendrite,
 ) util.JSONResponse {
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
+	// The session was created by this server if emails are enabled, and
+	// can't be published on an identity server.
+	if mailer != nil {
+		return save3PIDFromSession(req, accountDB, device, body.Creds)
+	}
+
 	// Check if the association has been validated
 	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
 	if err == threepid.ErrNotTrusted {
@@ -168,20 +299,374 @@ func GetAssociated3PIDs(
 	}
 }
 
+// Add3PID implements POST /account/3pid/add
+func Add3PID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, cfg *config.Dendrite,
+) util.JSONResponse {
+	var body add3PIDRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if resErr := checkLoggedInUserAuth(req, accountDB, device, body.Auth, cfg); resErr != nil {
+		return *resErr
+	}
+	return save3PIDFromSession(req, accountDB, device, threepid.Credentials{
+		SID:    body.SID,
+		Secret: body.Secret,
+	})
+}
+
+// save3PIDFromSession associates the third-party identifier which was
+// validated by a session on this server with the device's user.
+func save3PIDFromSession(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	creds threepid.Credentials,
+) util.JSONResponse {
+	session, err := checkThreePIDValidated(req.Context(), accountDB, creds)
+	if err == errThreePIDNotValidated {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("checkThreePIDValidated failed")
+		return jsonerror.InternalServerError()
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	existing, err := accountDB.GetLocalpartForThreePID(req.Context(), session.Address, session.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	switch existing {
+	case "":
+		if err = accountDB.SaveThreePIDAssociation(req.Context(), session.Address, localpart, session.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+			return jsonerror.InternalServerError()
+		}
+	case localpart:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     accounts.Err3PIDInUse.Error(),
+			},
+		}
+	}
+
+	// The session can only be used once.
+	if err = accountDB.RemoveThreePIDSession(req.Context(), session.SessionID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDSession failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 // Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+func Forget3PID(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+) util.JSONResponse {
 	var body authtypes.ThreePID
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	if err := accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	// Users can only remove their own third-party identifiers.
+	existing, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Address, body.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if existing != localpart {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Third-party identifier is not associated with this account"),
+		}
+	}
+
+	if err = accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// Associations aren't published on identity servers, so there is nothing
+	// to unbind there.
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: forget3PIDResponse{IDServerUnbindResult: "no-support"},
+	}
+}
+
+// validateEmailAssociationRequest returns an error response if the request to
+// validate an email address is missing its address or has an invalid secret.
+func validateEmailAssociationRequest(body *threepid.EmailAssociationRequest) *util.JSONResponse {
+	if body.Email == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'email' must be supplied."),
+		}
+	}
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'client_secret' is invalid."),
+		}
+	}
+	return nil
+}
+
+// startThreePIDSession returns the session for validating the third-party
+// identifier which the client created with the given secret, or creates one.
+// Also returns whether the session's token should be sent, which it
+// shouldn't be if the client is retrying a send attempt which was already
+// made.
+func startThreePIDSession(
+	ctx context.Context, accountDB accounts.Database,
+	clientSecret, medium, address string, sendAttempt int, nextLink string,
+	generateToken func() (string, error),
+) (*authtypes.ThreePIDSession, bool, error) {
+	now := time.Now()
+	if err := accountDB.RemoveExpiredThreePIDSessions(
+		ctx, now.Add(-threepidSessionLifetime).UnixNano()/int64(time.Millisecond),
+	); err != nil {
+		return nil, false, err
+	}
+
+	session, err := accountDB.GetThreePIDSessionBySecret(ctx, clientSecret, medium, address)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case session == nil:
+		session = &authtypes.ThreePIDSession{
+			ClientSecret: clientSecret,
+			Medium:       medium,
+			Address:      address,
+			SendAttempt:  sendAttempt,
+			NextLink:     nextLink,
+			CreatedTS:    now.UnixNano() / int64(time.Millisecond),
+		}
+		if session.SessionID, err = auth.GenerateAccessToken(); err != nil {
+			return nil, false, err
+		}
+		if session.Token, err = generateToken(); err != nil {
+			return nil, false, err
+		}
+		if err = accountDB.CreateThreePIDSession(ctx, session); err != nil {
+			return nil, false, err
+		}
+	case sendAttempt <= session.SendAttempt:
+		return session, false, nil
+	default:
+		if err = accountDB.UpdateThreePIDSessionSendAttempt(ctx, session.SessionID, sendAttempt); err != nil {
+			return nil, false, err
+		}
+	}
+	return session, true, nil
+}
+
+// sendValidationEmail starts a session for validating the email address and
+// emails the user a link to submit the session's token. Returns the session's
+// ID.
+func sendValidationEmail(
+	ctx context.Context, accountDB accounts.Database, mailer *threepid.Mailer,
+	body threepid.EmailAssociationRequest, purpose string, cfg *config.Dendrite,
+) (string, error) {
+	session, send, err := startThreePIDSession(
+		ctx, accountDB, body.Secret, "email", body.Email, body.SendAttempt, body.NextLink,
+		auth.GenerateAccessToken,
+	)
+	if err != nil || !send {
+		return sessionID(session), err
 	}
+
+	link := cfg.Matrix.Email.PublicBaseURL + "/_matrix/client/unstable/threepid/email/submitToken?" + url.Values{
+		"sid":           {session.SessionID},
+		"client_secret": {session.ClientSecret},
+		"token":         {session.Token},
+	}.Encode()
+	text := fmt.Sprintf(
+		"A request was made to %s using this email address on %s.\r\n\r\n"+
+			"To confirm that this was you, follow this link:\r\n\r\n%s\r\n\r\n"+
+			"If you didn't make this request, you can ignore this email.\r\n",
+		purpose, cfg.Matrix.ServerName, link,
+	)
+	if err = mailer.Send(body.Email, "Validate your email address", text); err != nil {
+		return "", err
+	}
+	return session.SessionID, nil
+}
+
+// sendValidationSMS starts a session for validating the phone number and
+// texts the user a code to submit. Returns the session's ID.
+func sendValidationSMS(
+	ctx context.Context, accountDB accounts.Database, smsSender *threepid.SMSSender,
+	body threepid.MSISDNAssociationRequest, msisdn string, cfg *config.Dendrite,
+) (string, error) {
+	session, send, err := startThreePIDSession(
+		ctx, accountDB, body.Secret, "msisdn", msisdn, body.SendAttempt, body.NextLink,
+		generateSMSCode,
+	)
+	if err != nil || !send {
+		return sessionID(session), err
+	}
+
+	text := fmt.Sprintf("Your %s validation code is %s", cfg.Matrix.ServerName, session.Token)
+	if err = smsSender.Send(ctx, msisdn, text); err != nil {
+		return "", err
+	}
+	return session.SessionID, nil
+}
+
+// generateSMSCode generates a random six digit code, which is short enough
+// for users to type in.
+func generateSMSCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n), nil
+}
+
+func sessionID(session *authtypes.ThreePIDSession) string {
+	if session == nil {
+		return ""
+	}
+	return session.SessionID
+}
+
+// maxThreePIDSubmitAttempts is how many times a token may be submitted for a
+// session before it is invalidated, as the codes sent by SMS are short enough
+// to be guessed otherwise. The client has to request a new token after that.
+const maxThreePIDSubmitAttempts = 5
+
+// submitThreePIDToken records that the session's token was submitted, which
+// validates the third-party identifier. Returns nil if the session doesn't
+// exist, the secret or token are wrong, or the session has expired. Sessions
+// are removed once too many tokens have been submitted without validating
+// them.
+func submitThreePIDToken(
+	ctx context.Context, accountDB accounts.Database, sid, clientSecret, token string,
+) (*authtypes.ThreePIDSession, error) {
+	session, err := accountDB.GetThreePIDSession(ctx, sid)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	if clientSecret != session.ClientSecret || threepidSessionExpired(session) {
+		return nil, nil
+	}
+	if session.ValidatedTS == 0 {
+		// The attempt is counted before the token is checked, so that
+		// concurrent guesses can't get past the limit.
+		allowed, err := accountDB.UseThreePIDSessionSubmitAttempt(ctx, session.SessionID, maxThreePIDSubmitAttempts)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, accountDB.RemoveThreePIDSession(ctx, session.SessionID)
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.Token)) != 1 {
+		return nil, nil
+	}
+	if session.ValidatedTS == 0 {
+		session.ValidatedTS = time.Now().UnixNano() / int64(time.Millisecond)
+		if err = accountDB.ValidateThreePIDSession(ctx, session.SessionID, session.ValidatedTS); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// SubmitEmailToken implements GET /unstable/threepid/email/submitToken, which
+// is linked to from the emails sent to validate email addresses.
+func SubmitEmailToken(
+	w http.ResponseWriter, req *http.Request, accountDB accounts.Database,
+) *util.JSONResponse {
+	query := req.URL.Query()
+	session, err := submitThreePIDToken(
+		req.Context(), accountDB, query.Get("sid"), query.Get("client_secret"), query.Get("token"),
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("submitThreePIDToken failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if session == nil {
+		return writeHTTPMessage(w, req,
+			"This link is invalid or has expired. Please try again.",
+			http.StatusBadRequest,
+		)
+	}
+	if session.NextLink != "" {
+		http.Redirect(w, req, session.NextLink, http.StatusFound)
+		return nil
+	}
+	return writeHTTPMessage(w, req,
+		"Your email address has been validated. You can now return to your client.",
+		http.StatusOK,
+	)
+}
+
+// SubmitMSISDNToken implements POST /unstable/threepid/msisdn/submitToken,
+// which is the submit_url which clients send the codes texted to users to.
+func SubmitMSISDNToken(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	var body struct {
+		SID    string `json:"sid"`
+		Secret string `json:"client_secret"`
+		Token  string `json:"token"`
+	}
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	session, err := submitThreePIDToken(req.Context(), accountDB, body.SID, body.Secret, body.Token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("submitThreePIDToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Success bool `json:"success"`
+		}{session != nil},
+	}
+}
+
+// checkThreePIDValidated returns the session with the given credentials if
+// its token has been submitted, or errThreePIDNotValidated if not.
+func checkThreePIDValidated(
+	ctx context.Context, accountDB accounts.Database, creds threepid.Credentials,
+) (*authtypes.ThreePIDSession, error) {
+	session, err := accountDB.GetThreePIDSession(ctx, creds.SID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.ClientSecret != creds.Secret ||
+		session.ValidatedTS == 0 || threepidSessionExpired(session) {
+		return nil, errThreePIDNotValidated
+	}
+	return session, nil
+}
+
+func threepidSessionExpired(session *authtypes.ThreePIDSession) bool {
+	created := time.Unix(0, session.CreatedTS*int64(time.Millisecond))
+	return time.Since(created) > threepidSessionLifetime
 }
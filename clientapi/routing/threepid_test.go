@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common/test"
+)
+
+// mustCreateAccountDB creates an empty accounts database, which is on the
+// server named by DENDRITE_TEST_DATABASE if it is set, and returns it along
+// with a function which removes it.
+func mustCreateAccountDB(t *testing.T) (accounts.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := accounts.NewDatabase(dataSource, nil, "hollow.knight")
+	if err != nil {
+		closeDB()
+		t.Fatalf("accounts.NewDatabase returned %s", err)
+	}
+	return db, closeDB
+}
+
+func mustCreateThreePIDSession(t *testing.T, db accounts.Database, sessionID string) *authtypes.ThreePIDSession {
+	session := &authtypes.ThreePIDSession{
+		SessionID:    sessionID,
+		ClientSecret: "secret-" + sessionID,
+		Medium:       "msisdn",
+		Address:      "4477700900" + sessionID,
+		Token:        "123456",
+		CreatedTS:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err := db.CreateThreePIDSession(context.Background(), session); err != nil {
+		t.Fatalf("CreateThreePIDSession returned %s", err)
+	}
+	return session
+}
+
+func TestSubmitThreePIDTokenAttempts(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateAccountDB(t)
+	defer closeDB()
+
+	// Wrong secrets don't count towards the limit, as they can't be used to
+	// guess the token.
+	session := mustCreateThreePIDSession(t, db, "1")
+	for i := 0; i < maxThreePIDSubmitAttempts; i++ {
+		if got, err := submitThreePIDToken(ctx, db, session.SessionID, "wrong", session.Token); err != nil || got != nil {
+			t.Fatalf("expected a wrong secret to be rejected, got %v (err %v)", got, err)
+		}
+	}
+	for i := 1; i < maxThreePIDSubmitAttempts; i++ {
+		if got, err := submitThreePIDToken(ctx, db, session.SessionID, session.ClientSecret, "000000"); err != nil || got != nil {
+			t.Fatalf("expected a wrong token to be rejected, got %v (err %v)", got, err)
+		}
+	}
+	got, err := submitThreePIDToken(ctx, db, session.SessionID, session.ClientSecret, session.Token)
+	if err != nil || got == nil || got.ValidatedTS == 0 {
+		t.Fatalf("expected the right token to validate the session on the last attempt, got %v (err %v)", got, err)
+	}
+	// The link in a validation email may be followed more than once.
+	for i := 0; i < maxThreePIDSubmitAttempts+1; i++ {
+		if got, err = submitThreePIDToken(ctx, db, session.SessionID, session.ClientSecret, session.Token); err != nil || got == nil {
+			t.Fatalf("expected the validated session to be returned again, got %v (err %v)", got, err)
+		}
+	}
+
+	// Once too many tokens have been submitted, the session is removed and
+	// even the right token is rejected.
+	session = mustCreateThreePIDSession(t, db, "2")
+	for i := 0; i < maxThreePIDSubmitAttempts; i++ {
+		if got, err = submitThreePIDToken(ctx, db, session.SessionID, session.ClientSecret, "000000"); err != nil || got != nil {
+			t.Fatalf("expected a wrong token to be rejected, got %v (err %v)", got, err)
+		}
+	}
+	if got, err = submitThreePIDToken(ctx, db, session.SessionID, session.ClientSecret, session.Token); err != nil || got != nil {
+		t.Fatalf("expected the right token to be rejected after too many attempts, got %v (err %v)", got, err)
+	}
+	if got, err = db.GetThreePIDSession(ctx, session.SessionID); err != nil || got != nil {
+		t.Errorf("expected the session to be removed, got %v (err %v)", got, err)
+	}
+}
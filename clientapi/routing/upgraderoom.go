@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type upgradeRoomRequest struct {
+	NewVersion gomatrixserverlib.RoomVersion `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+func UpgradeRoom(
+	req *http.Request, device *authtypes.Device,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.NewVersion == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing new_version"),
+		}
+	}
+	if _, err := roomserverVersion.SupportedRoomVersion(r.NewVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+
+	upgradeReq := roomserverAPI.PerformUpgradeRoomRequest{
+		RoomID:      roomID,
+		UserID:      device.UserID,
+		RoomVersion: r.NewVersion,
+	}
+	upgradeRes := roomserverAPI.PerformUpgradeRoomResponse{}
+	if err := rsAPI.PerformUpgradeRoom(req.Context(), &upgradeReq, &upgradeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformUpgradeRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if upgradeRes.NotAllowed {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to upgrade this room"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{ReplacementRoom: upgradeRes.NewRoomID},
+	}
+}
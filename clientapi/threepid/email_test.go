@@ -0,0 +1,67 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"net/smtp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestMailerSend(t *testing.T) {
+	m := NewMailer(&config.Email{
+		SMTPAddress:  "smtp.example.com:587",
+		SMTPUsername: "dendrite",
+		SMTPPassword: "secret",
+		From:         "Matrix <noreply@example.com>",
+	})
+	var sent []byte
+	m.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "smtp.example.com:587" || a == nil {
+			t.Errorf("sendMail: got address %q and auth %v", addr, a)
+		}
+		if from != "noreply@example.com" || len(to) != 1 || to[0] != "alice@example.com" {
+			t.Errorf("sendMail: got from %q and to %v", from, to)
+		}
+		sent = msg
+		return nil
+	}
+	if err := m.Send("alice@example.com", "Validate your email address", "Follow this link: https://example.com/?a=b"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Validate your email address" {
+		t.Errorf("Subject: got %q", got)
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Follow this link: https://example.com/?a=3Db"; string(body) != want {
+		t.Errorf("body: got %q, want %q", body, want)
+	}
+
+	if err = m.Send("not an address", "", ""); err == nil {
+		t.Error("Send: expected an error for an invalid address")
+	}
+}
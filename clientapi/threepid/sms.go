@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// MSISDNAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-register-msisdn-requesttoken
+type MSISDNAssociationRequest struct {
+	IDServer    string `json:"id_server"`
+	Secret      string `json:"client_secret"`
+	Country     string `json:"country"`
+	PhoneNumber string `json:"phone_number"`
+	SendAttempt int    `json:"send_attempt"`
+	NextLink    string `json:"next_link"`
+}
+
+// ErrInvalidPhoneNumber is returned when a phone number can't be converted
+// to an MSISDN.
+var ErrInvalidPhoneNumber = errors.New("invalid phone number")
+
+// NormaliseMSISDN converts a phone number to an MSISDN, i.e. the digits of
+// the number in international format without a leading "+". Numbers which
+// aren't in international format, i.e. starting with "+" or "00", are taken
+// to be in the given ISO 3166-1 alpha-2 country.
+func NormaliseMSISDN(country, phoneNumber string) (string, error) {
+	international := strings.HasPrefix(strings.TrimSpace(phoneNumber), "+")
+	var digits strings.Builder
+	for _, c := range phoneNumber {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case strings.ContainsRune("+ -.()", c):
+		default:
+			return "", ErrInvalidPhoneNumber
+		}
+	}
+	msisdn := digits.String()
+	if !international && strings.HasPrefix(msisdn, "00") {
+		msisdn = msisdn[2:]
+		international = true
+	}
+	if !international {
+		code, ok := callingCodes[strings.ToUpper(country)]
+		if !ok {
+			return "", ErrInvalidPhoneNumber
+		}
+		// Drop the trunk prefix which is dialled for national calls.
+		msisdn = code + strings.TrimPrefix(msisdn, "0")
+	}
+	// E.164 numbers are at most 15 digits long.
+	if len(msisdn) < 7 || len(msisdn) > 15 || msisdn[0] == '0' {
+		return "", ErrInvalidPhoneNumber
+	}
+	return msisdn, nil
+}
+
+// SMSSender sends text messages with the configured SMS gateway.
+type SMSSender struct {
+	cfg    *config.SMS
+	client *http.Client
+}
+
+// NewSMSSender creates a new SMSSender.
+func NewSMSSender(cfg *config.SMS, client *http.Client) *SMSSender {
+	return &SMSSender{cfg: cfg, client: client}
+}
+
+// Send sends a text message to the MSISDN.
+func (s *SMSSender) Send(ctx context.Context, msisdn, text string) error {
+	body, err := json.Marshal(struct {
+		To   string `json:"to"`
+		Text string `json:"text"`
+	}{"+" + msisdn, text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.GatewayURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.GatewayToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.GatewayToken)
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway responded with HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
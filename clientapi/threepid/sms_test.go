@@ -0,0 +1,40 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import "testing"
+
+func TestNormaliseMSISDN(t *testing.T) {
+	for _, tc := range []struct {
+		country, phoneNumber, want string
+	}{
+		{"GB", "07700 900123", "447700900123"},
+		{"gb", "+44 7700 900123", "447700900123"},
+		{"", "+1 (202) 555-0123", "12025550123"},
+		{"FR", "0033 6 12 34 56 78", "33612345678"},
+		{"US", "202-555-0123", "12025550123"},
+	} {
+		got, err := NormaliseMSISDN(tc.country, tc.phoneNumber)
+		if err != nil || got != tc.want {
+			t.Errorf("NormaliseMSISDN(%q, %q): got %q, %v, want %q", tc.country, tc.phoneNumber, got, err, tc.want)
+		}
+	}
+
+	for _, phoneNumber := range []string{"07700 900123", "+44 7700 abc", "+1234", "+1234567890123456"} {
+		if _, err := NormaliseMSISDN("", phoneNumber); err == nil {
+			t.Errorf("NormaliseMSISDN(%q): expected an error", phoneNumber)
+		}
+	}
+}
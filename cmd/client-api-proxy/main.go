@@ -21,6 +21,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -57,6 +58,10 @@ var (
 	keyFile           = flag.String("tls-key", "", "The PEM private key to use for TLS")
 )
 
+// filterPathRegexp matches the paths of the filter endpoints, which are served
+// by the sync API server.
+var filterPathRegexp = regexp.MustCompile(`^/_matrix/client/r0/user/[^/]+/filter(/[^/]+)?$`)
+
 func makeProxy(targetURL string) (*httputil.ReverseProxy, error) {
 	if !strings.HasSuffix(targetURL, "/") {
 		targetURL += "/"
@@ -148,10 +153,17 @@ func main() {
 	}
 
 	http.Handle("/_matrix/client/r0/sync", syncProxy)
+	http.Handle("/_matrix/client/r0/search", syncProxy)
 	http.Handle("/_matrix/client/r0/directory/list/", publicRoomsProxy)
 	http.Handle("/_matrix/client/r0/publicRooms", publicRoomsProxy)
 	http.Handle("/_matrix/media/v1/", mediaProxy)
-	http.Handle("/", clientProxy)
+	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if filterPathRegexp.MatchString(req.URL.Path) {
+			syncProxy.ServeHTTP(w, req)
+			return
+		}
+		clientProxy.ServeHTTP(w, req)
+	}))
 
 	srv := &http.Server{
 		Addr:         *bindAddress,
@@ -161,6 +173,7 @@ func main() {
 
 	fmt.Println("Proxying requests to:")
 	fmt.Println("  /_matrix/client/r0/sync            => ", *syncServerURL+"/api/_matrix/client/r0/sync")
+	fmt.Println("  /_matrix/client/r0/user/*/filter   => ", *syncServerURL+"/api/_matrix/client/r0/user/*/filter")
 	fmt.Println("  /_matrix/client/r0/directory/list  => ", *publicRoomsAPIURL+"/_matrix/client/r0/directory/list")
 	fmt.Println("  /_matrix/client/r0/publicRooms     => ", *publicRoomsAPIURL+"/_matrix/media/client/r0/publicRooms")
 	fmt.Println("  /_matrix/media/v1                  => ", *mediaAPIURL+"/api/_matrix/media/v1")
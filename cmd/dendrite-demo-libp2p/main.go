@@ -56,7 +56,7 @@ func createKeyDB(
 ) keydb.Database {
 	db, err := keydb.NewDatabase(
 		string(base.Base.Cfg.Database.ServerKey),
-		base.Base.Cfg.DbProperties(),
+		base.Base.Cfg.DbPropertiesFor("server_key"),
 		base.Base.Cfg.Matrix.ServerName,
 		base.Base.Cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
 		base.Base.Cfg.Matrix.KeyID,
@@ -135,6 +135,7 @@ func main() {
 	cfg.Database.FederationSender = config.DataSource(fmt.Sprintf("file:%s-federationsender.db", *instanceName))
 	cfg.Database.AppService = config.DataSource(fmt.Sprintf("file:%s-appservice.db", *instanceName))
 	cfg.Database.PublicRoomsAPI = config.DataSource(fmt.Sprintf("file:%s-publicroomsa.db", *instanceName))
+	cfg.Database.Push = config.DataSource(fmt.Sprintf("file:%s-push.db", *instanceName))
 	cfg.Database.Naffka = config.DataSource(fmt.Sprintf("file:%s-naffka.db", *instanceName))
 	if err = cfg.Derive(); err != nil {
 		panic(err)
@@ -170,7 +171,7 @@ func main() {
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
 	federationapi.SetupFederationAPIComponent(&base.Base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(&base.Base, deviceDB)
+	mediaapi.SetupMediaAPIComponent(&base.Base, deviceDB, rsAPI)
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabaseWithPubSub(string(base.Base.Cfg.Database.PublicRoomsAPI), base.LibP2PPubsub)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
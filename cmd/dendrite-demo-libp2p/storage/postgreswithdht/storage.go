@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -78,16 +79,18 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 	return count + int64(len(d.foundRooms)), nil
 }
 
-func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, filter string, since *types.PublicRoomsPosition, backwards bool, limit int) ([]gomatrixserverlib.PublicRoom, error) {
 	realfilter := filter
 	if realfilter == "__local__" {
 		realfilter = ""
 	}
-	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, realfilter)
+	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, realfilter, since, backwards, limit)
 	if err != nil {
 		return []gomatrixserverlib.PublicRoom{}, err
 	}
-	if filter != "__local__" {
+	// Rooms found in the DHT have no position in the directory, so they are
+	// only added to the first page.
+	if filter != "__local__" && since == nil {
 		d.foundRoomsMutex.RLock()
 		defer d.foundRoomsMutex.RUnlock()
 		for _, room := range d.foundRooms {
@@ -126,7 +129,7 @@ func (d *PublicRoomsServerDatabase) Interval() {
 func (d *PublicRoomsServerDatabase) AdvertiseRoomsIntoDHT() error {
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), 3*time.Second)
 	_ = dbCancel
-	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__")
+	ourRooms, err := d.GetPublicRooms(dbCtx, "__local__", nil, false, 1024)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,212 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/naffka"
+	"golang.org/x/crypto/ed25519"
+
+	appservice "github.com/matrix-org/dendrite/appservice/storage"
+	push "github.com/matrix-org/dendrite/clientapi/push/storage"
+	federationsender "github.com/matrix-org/dendrite/federationsender/storage"
+	mediaapi "github.com/matrix-org/dendrite/mediaapi/storage"
+	publicroomsapi "github.com/matrix-org/dendrite/publicroomsapi/storage"
+	roomserver "github.com/matrix-org/dendrite/roomserver/storage"
+	syncapi "github.com/matrix-org/dendrite/syncapi/storage"
+)
+
+// A database is one of the databases in the config file.
+type database struct {
+	// The name of the database in the config file.
+	name string
+	// dataSource returns the database's data source from the config.
+	dataSource func(cfg *config.Dendrite) config.DataSource
+	// createSchema creates the schema of the database at the data source, by
+	// opening it the same way that Dendrite does.
+	createSchema func(cfg *config.Dendrite, dataSource string) error
+}
+
+var databases = []database{
+	{
+		name:       "account",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.Account },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := accounts.NewDatabase(dataSource, cfg.DbPropertiesFor("account"), cfg.Matrix.ServerName)
+			return err
+		},
+	},
+	{
+		name:       "device",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.Device },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := devices.NewDatabase(dataSource, cfg.DbPropertiesFor("device"), cfg.Matrix.ServerName)
+			return err
+		},
+	},
+	{
+		name:       "media_api",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.MediaAPI },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := mediaapi.Open(dataSource, cfg.DbPropertiesFor("media_api"))
+			return err
+		},
+	},
+	{
+		name:       "server_key",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.ServerKey },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := keydb.NewDatabase(
+				dataSource, cfg.DbPropertiesFor("server_key"), cfg.Matrix.ServerName,
+				cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey), cfg.Matrix.KeyID,
+			)
+			return err
+		},
+	},
+	{
+		name:       "sync_api",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.SyncAPI },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := syncapi.NewSyncServerDatasource(dataSource, cfg.DbPropertiesFor("sync_api"))
+			return err
+		},
+	},
+	{
+		name:       "room_server",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.RoomServer },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := roomserver.Open(dataSource, cfg.DbPropertiesFor("room_server"))
+			return err
+		},
+	},
+	{
+		name:       "federation_sender",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.FederationSender },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			// The queued content is copied as it is, along with the version
+			// of the key it was encrypted with, so no key is needed.
+			_, err := federationsender.NewDatabase(dataSource, cfg.DbPropertiesFor("federation_sender"), nil)
+			return err
+		},
+	},
+	{
+		name:       "appservice",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.AppService },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := appservice.NewDatabase(dataSource, cfg.DbPropertiesFor("appservice"))
+			return err
+		},
+	},
+	{
+		name:       "public_rooms_api",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.PublicRoomsAPI },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := publicroomsapi.NewPublicRoomsServerDatabase(dataSource, cfg.DbPropertiesFor("public_rooms_api"))
+			return err
+		},
+	},
+	{
+		name:       "push",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.Push },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			_, err := push.NewDatabase(dataSource, cfg.DbPropertiesFor("push"))
+			return err
+		},
+	},
+	{
+		name:       "naffka",
+		dataSource: func(cfg *config.Dendrite) config.DataSource { return cfg.Database.Naffka },
+		createSchema: func(cfg *config.Dendrite, dataSource string) error {
+			kind, err := databaseKindOf(dataSource)
+			if err != nil {
+				return err
+			}
+			if kind == sqliteDatabase {
+				db, err := sqlutil.Open(common.SQLiteDriverName(), dataSource, nil)
+				if err != nil {
+					return err
+				}
+				_, err = naffka.NewSqliteDatabase(db)
+				return err
+			}
+			db, err := sqlutil.Open("postgres", dataSource, cfg.DbPropertiesFor("naffka"))
+			if err != nil {
+				return err
+			}
+			_, err = naffka.NewPostgresqlDatabase(db)
+			return err
+		},
+	},
+}
+
+// A migration copies the contents of a database to another. Several of the
+// databases in the config file may be stored in the same database, in which
+// case they are copied together.
+type migration struct {
+	from, to  string
+	databases []database
+	toCfg     *config.Dendrite
+}
+
+func (m *migration) name() string {
+	names := make([]string, len(m.databases))
+	for i, db := range m.databases {
+		names[i] = db.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// planMigrations works out which databases need to be copied to which.
+func planMigrations(fromCfg, toCfg *config.Dendrite) ([]*migration, error) {
+	var migrations []*migration
+	byFrom := map[string]*migration{}
+	byTo := map[string]*migration{}
+	for _, db := range databases {
+		from, to := string(db.dataSource(fromCfg)), string(db.dataSource(toCfg))
+		if from == "" && to == "" {
+			continue
+		}
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("the %s database must be configured in both config files", db.name)
+		}
+		if from == to {
+			return nil, fmt.Errorf("both config files use the same %s database", db.name)
+		}
+		m := byFrom[from]
+		if m == nil {
+			m = byTo[to]
+		}
+		if m == nil {
+			m = &migration{from: from, to: to, toCfg: toCfg}
+			byFrom[from], byTo[to] = m, m
+			migrations = append(migrations, m)
+		} else if m.from != from || m.to != to {
+			return nil, fmt.Errorf(
+				"the %s database is shared with the %s database in one config file but not in the other",
+				db.name, m.databases[0].name,
+			)
+		}
+		m.databases = append(m.databases, db)
+	}
+	return migrations, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: %s -from <config> -to <config>
+
+Copy the contents of Dendrite's databases from one set of databases to another,
+e.g. from SQLite to Postgres or from Postgres to SQLite. The databases to copy
+from are taken from the first config file, and the databases to copy to from
+the second, which is otherwise the same. Numeric IDs and stream positions are
+preserved, so clients and remote servers won't notice the move.
+
+Dendrite must not be running while the databases are copied, and the databases
+being copied to must not contain any data yet.
+
+Arguments:
+
+`
+
+var (
+	fromConfigPath = flag.String("from", "", "The path to the config file listing the databases to copy from.")
+	toConfigPath   = flag.String("to", "", "The path to the config file listing the databases to copy to.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *fromConfigPath == "" || *toConfigPath == "" {
+		flag.Usage()
+		fmt.Println("Missing --from or --to")
+		os.Exit(1)
+	}
+
+	fromCfg, err := config.LoadMonolithic(*fromConfigPath)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to load %s", *fromConfigPath)
+	}
+	toCfg, err := config.LoadMonolithic(*toConfigPath)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to load %s", *toConfigPath)
+	}
+
+	migrations, err := planMigrations(fromCfg, toCfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("Can't copy the databases")
+	}
+
+	for _, m := range migrations {
+		if err = m.run(context.Background()); err != nil {
+			logrus.WithError(err).Fatalf("Failed to copy the %s database", m.name())
+		}
+	}
+	logrus.Info("Finished copying the databases")
+}
@@ -0,0 +1,512 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/sirupsen/logrus"
+)
+
+type databaseKind int
+
+const (
+	sqliteDatabase databaseKind = iota
+	postgresDatabase
+)
+
+// databaseKindOf works out which kind of database a data source refers to, in
+// the same way as the storage packages do.
+func databaseKindOf(dataSource string) (databaseKind, error) {
+	uri, err := url.Parse(dataSource)
+	if err != nil {
+		return postgresDatabase, nil
+	}
+	switch uri.Scheme {
+	case "file":
+		return sqliteDatabase, nil
+	case "mysql":
+		return 0, fmt.Errorf("copying MySQL databases isn't supported")
+	default:
+		return postgresDatabase, nil
+	}
+}
+
+// The schema migrations are recorded by each component when its schema is
+// created in the destination, so aren't copied.
+const schemaMigrationsTable = "dendrite_schema_migrations"
+
+// A counter hands out IDs which aren't otherwise stored in a table, such as
+// stream positions. Postgres uses a sequence for each counter, which SQLite
+// doesn't have, so it uses a table row instead.
+type counter struct {
+	// The name of the sequence used by Postgres.
+	sequence string
+	// The name of the table used by SQLite.
+	table string
+	// Selects the last ID handed out from the SQLite table.
+	selectSQL string
+	// Updates the SQLite table so that the next ID handed out follows the
+	// given one.
+	updateSQL string
+}
+
+var counters = []counter{
+	{
+		sequence:  "syncapi_stream_id",
+		table:     "syncapi_stream_id",
+		selectSQL: "SELECT stream_id FROM syncapi_stream_id WHERE stream_name = 'global'",
+		updateSQL: "UPDATE syncapi_stream_id SET stream_id = $1 WHERE stream_name = 'global'",
+	},
+	{
+		sequence:  "txn_id_counter",
+		table:     "appservice_counters",
+		selectSQL: "SELECT last_id - 1 FROM appservice_counters WHERE name = 'txn_id'",
+		updateSQL: "UPDATE appservice_counters SET last_id = $1 + 1 WHERE name = 'txn_id'",
+	},
+}
+
+func isCounterTable(table string) bool {
+	for _, c := range counters {
+		if c.table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// A column of a table. Postgres stores lists in array columns, which SQLite
+// stores as JSON text instead.
+type column struct {
+	name string
+	// The Postgres type of the column, e.g. "int8" or "_text" for an array.
+	pgType string
+}
+
+func (c column) isArray() bool {
+	return strings.HasPrefix(c.pgType, "_")
+}
+
+// A sqlDatabase is a source or destination of a migration.
+type sqlDatabase struct {
+	*sql.DB
+	kind databaseKind
+}
+
+func openDatabase(dataSource string) (*sqlDatabase, error) {
+	kind, err := databaseKindOf(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	driverName := "postgres"
+	if kind == sqliteDatabase {
+		driverName = common.SQLiteDriverName()
+	}
+	db, err := sqlutil.Open(driverName, dataSource, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlDatabase{db, kind}, nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// tables returns the names of the tables in the database.
+func (d *sqlDatabase) tables(ctx context.Context) (map[string]bool, error) {
+	query := "SELECT table_name FROM information_schema.tables" +
+		" WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'"
+	if d.kind == sqliteDatabase {
+		query = "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite%'"
+	}
+	rows, err := d.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "tables: rows.close() failed")
+	tables := map[string]bool{}
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables[table] = true
+	}
+	return tables, rows.Err()
+}
+
+// columns returns the columns of the table, in order.
+func (d *sqlDatabase) columns(ctx context.Context, table string) ([]column, error) {
+	query := "SELECT column_name, udt_name FROM information_schema.columns" +
+		" WHERE table_schema = current_schema() AND table_name = $1" +
+		" ORDER BY ordinal_position"
+	if d.kind == sqliteDatabase {
+		query = "SELECT name, '' FROM pragma_table_info($1) ORDER BY cid"
+	}
+	rows, err := d.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "columns: rows.close() failed")
+	var columns []column
+	for rows.Next() {
+		var c column
+		if err = rows.Scan(&c.name, &c.pgType); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+func (d *sqlDatabase) countRows(ctx context.Context, table string) (count int64, err error) {
+	err = d.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdentifier(table)).Scan(&count)
+	return
+}
+
+// lastCounterID returns the last ID handed out by the counter, and whether the
+// database has the counter at all.
+func (d *sqlDatabase) lastCounterID(ctx context.Context, c counter, tables map[string]bool) (int64, bool, error) {
+	var id int64
+	if d.kind == sqliteDatabase {
+		if !tables[c.table] {
+			return 0, false, nil
+		}
+		err := d.QueryRowContext(ctx, c.selectSQL).Scan(&id)
+		return id, err == nil, err
+	}
+	var exists bool
+	err := d.QueryRowContext(
+		ctx,
+		"SELECT EXISTS(SELECT 1 FROM information_schema.sequences"+
+			" WHERE sequence_schema = current_schema() AND sequence_name = $1)",
+		c.sequence,
+	).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	var isCalled bool
+	err = d.QueryRowContext(
+		ctx, "SELECT last_value, is_called FROM "+quoteIdentifier(c.sequence),
+	).Scan(&id, &isCalled)
+	if err != nil {
+		return 0, false, err
+	}
+	if !isCalled {
+		id--
+	}
+	return id, true, nil
+}
+
+func (m *migration) run(ctx context.Context) error {
+	logger := logrus.WithField("databases", m.name())
+	from, err := openDatabase(m.from)
+	if err != nil {
+		return err
+	}
+	defer from.Close() // nolint: errcheck
+	to, err := openDatabase(m.to)
+	if err != nil {
+		return err
+	}
+	defer to.Close() // nolint: errcheck
+
+	fromTables, err := from.tables(ctx)
+	if err != nil {
+		return err
+	}
+	toTables, err := to.tables(ctx)
+	if err != nil {
+		return err
+	}
+	// Refuse to overwrite anything which is already in the destination.
+	for table := range fromTables {
+		if !toTables[table] || table == schemaMigrationsTable || isCounterTable(table) {
+			continue
+		}
+		var count int64
+		if count, err = to.countRows(ctx, table); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("the destination database already contains data in %s", table)
+		}
+	}
+
+	logger.Info("Creating the schema in the destination database")
+	for _, db := range m.databases {
+		if err = db.createSchema(m.toCfg, m.to); err != nil {
+			return fmt.Errorf("creating the %s schema: %w", db.name, err)
+		}
+	}
+	if toTables, err = to.tables(ctx); err != nil {
+		return err
+	}
+
+	for table := range fromTables {
+		if table == schemaMigrationsTable {
+			continue
+		}
+		if !toTables[table] {
+			if !isCounterTable(table) {
+				logger.Warnf("Not copying %s, which doesn't exist in the destination database", table)
+			}
+			continue
+		}
+		var count int64
+		if count, err = copyTable(ctx, from, to, table); err != nil {
+			return fmt.Errorf("copying %s: %w", table, err)
+		}
+		logger.Infof("Copied %d rows of %s", count, table)
+	}
+
+	return copyCounters(ctx, from, to, fromTables, toTables)
+}
+
+// copyTable replaces the contents of the table in the destination with the
+// contents of the table in the source. Only the columns which are in both are
+// copied, so that the destination's defaults are used for any columns which
+// the source is too old to have.
+func copyTable(ctx context.Context, from, to *sqlDatabase, table string) (int64, error) {
+	fromColumns, err := from.columns(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	toColumns, err := to.columns(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	byName := map[string]column{}
+	for _, c := range fromColumns {
+		byName[c.name] = c
+	}
+	var names, placeholders []string
+	var pairs [][2]column
+	for _, c := range toColumns {
+		fromColumn, ok := byName[c.name]
+		if !ok {
+			continue
+		}
+		names = append(names, quoteIdentifier(c.name))
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(names)))
+		pairs = append(pairs, [2]column{fromColumn, c})
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+
+	var count int64
+	err = common.WithTransaction(to.DB, func(txn *sql.Tx) error {
+		count = 0
+		rows, err := from.QueryContext(ctx, "SELECT "+strings.Join(names, ", ")+" FROM "+quoteIdentifier(table))
+		if err != nil {
+			return err
+		}
+		defer common.CloseAndLogIfError(ctx, rows, "copyTable: rows.close() failed")
+		// Remove anything added to the table while creating the schema, such
+		// as our own server keys, which will be copied from the source.
+		if _, err = txn.ExecContext(ctx, "DELETE FROM "+quoteIdentifier(table)); err != nil {
+			return err
+		}
+		stmt, err := txn.PrepareContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES (%s)",
+			quoteIdentifier(table), strings.Join(names, ", "), strings.Join(placeholders, ", "),
+		))
+		if err != nil {
+			return err
+		}
+		defer common.CloseAndLogIfError(ctx, stmt, "copyTable: stmt.close() failed")
+		values := make([]interface{}, len(pairs))
+		pointers := make([]interface{}, len(pairs))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for rows.Next() {
+			if err = rows.Scan(pointers...); err != nil {
+				return err
+			}
+			args := make([]interface{}, len(pairs))
+			for i, pair := range pairs {
+				if args[i], err = convertValue(values[i], pair[0], pair[1]); err != nil {
+					return fmt.Errorf("column %s: %w", pair[1].name, err)
+				}
+			}
+			if _, err = stmt.ExecContext(ctx, args...); err != nil {
+				return err
+			}
+			count++
+		}
+		return rows.Err()
+	})
+	return count, err
+}
+
+// convertValue converts a value read from a column of the source into a value
+// which can be written to the same column of the destination.
+func convertValue(value interface{}, from, to column) (interface{}, error) {
+	switch {
+	case to.isArray() && !from.isArray():
+		// SQLite's JSON lists become Postgres arrays.
+		var list []byte
+		switch v := value.(type) {
+		case string:
+			list = []byte(v)
+		case []byte:
+			list = v
+		case nil:
+		default:
+			return nil, fmt.Errorf("can't convert %T to an array", value)
+		}
+		if len(list) == 0 {
+			list = []byte("[]")
+		}
+		if to.pgType == "_text" || to.pgType == "_varchar" {
+			var array pq.StringArray
+			if err := json.Unmarshal(list, &array); err != nil {
+				return nil, err
+			}
+			if array == nil {
+				array = pq.StringArray{}
+			}
+			return array, nil
+		}
+		var array pq.Int64Array
+		if err := json.Unmarshal(list, &array); err != nil {
+			return nil, err
+		}
+		if array == nil {
+			array = pq.Int64Array{}
+		}
+		return array, nil
+	case from.isArray() && !to.isArray():
+		// Postgres arrays become JSON lists for SQLite.
+		var list interface{}
+		if from.pgType == "_text" || from.pgType == "_varchar" {
+			var array pq.StringArray
+			if err := array.Scan(value); err != nil {
+				return nil, err
+			}
+			list = []string(array)
+		} else {
+			var array pq.Int64Array
+			if err := array.Scan(value); err != nil {
+				return nil, err
+			}
+			list = []int64(array)
+		}
+		listJSON, err := json.Marshal(list)
+		return string(listJSON), err
+	case to.pgType == "bytea":
+		if v, ok := value.(string); ok {
+			return []byte(v), nil
+		}
+	case to.pgType != "":
+		// SQLite returns text stored as a blob as []byte, which the Postgres
+		// driver would otherwise write as a bytea.
+		if v, ok := value.([]byte); ok {
+			return string(v), nil
+		}
+	}
+	return value, nil
+}
+
+// sequenceDefaultRegexp matches the default of a column which is set from a
+// sequence, capturing the name of the sequence.
+var sequenceDefaultRegexp = regexp.MustCompile(`^nextval\('([^']+)'`)
+
+// copyCounters makes sure that the destination won't hand out any IDs which
+// have already been used by the source.
+func copyCounters(ctx context.Context, from, to *sqlDatabase, fromTables, toTables map[string]bool) error {
+	lastIDs := map[string]int64{}
+	for _, c := range counters {
+		id, ok, err := from.lastCounterID(ctx, c, fromTables)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if to.kind == sqliteDatabase {
+			if toTables[c.table] {
+				if _, err = to.ExecContext(ctx, c.updateSQL, id); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		lastIDs[c.sequence] = id
+	}
+	if to.kind == sqliteDatabase {
+		// SQLite keeps its AUTOINCREMENT counters up to date itself.
+		return nil
+	}
+
+	// The IDs copied into columns which are set from a sequence by default
+	// have been used as well.
+	rows, err := to.QueryContext(
+		ctx,
+		"SELECT table_name, column_name, column_default FROM information_schema.columns"+
+			" WHERE table_schema = current_schema() AND column_default LIKE 'nextval(%'",
+	)
+	if err != nil {
+		return err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "copyCounters: rows.close() failed")
+	type sequenceColumn struct{ sequence, table, column string }
+	var columns []sequenceColumn
+	for rows.Next() {
+		var table, column, columnDefault string
+		if err = rows.Scan(&table, &column, &columnDefault); err != nil {
+			return err
+		}
+		if match := sequenceDefaultRegexp.FindStringSubmatch(columnDefault); match != nil {
+			columns = append(columns, sequenceColumn{match[1], table, column})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		var id int64
+		err = to.QueryRowContext(
+			ctx, fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s", quoteIdentifier(c.column), quoteIdentifier(c.table)),
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+		if id > lastIDs[c.sequence] {
+			lastIDs[c.sequence] = id
+		}
+	}
+	for sequence, id := range lastIDs {
+		if id <= 0 {
+			continue
+		}
+		if _, err = to.ExecContext(ctx, "SELECT setval($1, $2)", sequence, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+
+	mediaapi "github.com/matrix-org/dendrite/mediaapi/storage"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	fromCfg, toCfg := &config.Dendrite{}, &config.Dendrite{}
+	fromCfg.Database.Account = "file:shared.db"
+	fromCfg.Database.Device = "file:shared.db"
+	fromCfg.Database.MediaAPI = "file:media.db"
+	toCfg.Database.Account = "postgres://localhost/shared"
+	toCfg.Database.Device = "postgres://localhost/shared"
+	toCfg.Database.MediaAPI = "postgres://localhost/media"
+
+	migrations, err := planMigrations(fromCfg, toCfg)
+	if err != nil {
+		t.Fatalf("planMigrations returned %s", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].name() != "account, device" || migrations[0].to != "postgres://localhost/shared" {
+		t.Errorf("expected the shared databases to be copied together, got %s to %s", migrations[0].name(), migrations[0].to)
+	}
+	if migrations[1].name() != "media_api" || migrations[1].from != "file:media.db" {
+		t.Errorf("unexpected migration of %s from %s", migrations[1].name(), migrations[1].from)
+	}
+
+	// Databases which are shared in only one of the config files can't be copied
+	toCfg.Database.Device = "postgres://localhost/device"
+	if _, err = planMigrations(fromCfg, toCfg); err == nil {
+		t.Errorf("expected databases shared in only one config file to be rejected")
+	}
+	toCfg.Database.Device = ""
+	if _, err = planMigrations(fromCfg, toCfg); err == nil {
+		t.Errorf("expected a database configured in only one config file to be rejected")
+	}
+	toCfg.Database.Device = "file:shared.db"
+	toCfg.Database.Account = "file:shared.db"
+	if _, err = planMigrations(fromCfg, toCfg); err == nil {
+		t.Errorf("expected copying a database onto itself to be rejected")
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	text := column{name: "c"}
+	for _, tc := range []struct {
+		value    interface{}
+		from, to column
+		want     interface{}
+	}{
+		{`["a","b"]`, text, column{"c", "_text"}, pq.StringArray{"a", "b"}},
+		{nil, text, column{"c", "_text"}, pq.StringArray{}},
+		{[]byte(`[1,2]`), text, column{"c", "_int8"}, pq.Int64Array{1, 2}},
+		{[]byte(`{"a","b"}`), column{"c", "_text"}, text, `["a","b"]`},
+		{[]byte(`{1,2}`), column{"c", "_int8"}, text, `[1,2]`},
+		{"bytes", text, column{"c", "bytea"}, []byte("bytes")},
+		{[]byte("text"), text, column{"c", "text"}, "text"},
+		{int64(1), text, text, int64(1)},
+	} {
+		got, err := convertValue(tc.value, tc.from, tc.to)
+		if err != nil {
+			t.Errorf("convertValue(%v) returned %s", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("convertValue(%v): expected %#v, got %#v", tc.value, tc.want, got)
+		}
+	}
+}
+
+func TestMigrationRun(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dendrite-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	fromCfg, toCfg := &config.Dendrite{}, &config.Dendrite{}
+	fromCfg.Database.MediaAPI = config.DataSource("file:" + filepath.Join(dir, "from.db"))
+	toCfg.Database.MediaAPI = config.DataSource("file:" + filepath.Join(dir, "to.db"))
+
+	from, err := mediaapi.Open(string(fromCfg.Database.MediaAPI), fromCfg.DbPropertiesFor("media_api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       "grub",
+		Origin:        "hollow.knight",
+		ContentType:   "image/png",
+		FileSizeBytes: 10,
+		UploadName:    "grub.png",
+		Base64Hash:    "hash",
+		UserID:        "@knight:hollow.knight",
+	}
+	if err = from.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := planMigrations(fromCfg, toCfg)
+	if err != nil || len(migrations) != 1 {
+		t.Fatalf("planMigrations returned %v, %s", migrations, err)
+	}
+	if err = migrations[0].run(ctx); err != nil {
+		t.Fatalf("run returned %s", err)
+	}
+
+	to, err := mediaapi.Open(string(toCfg.Database.MediaAPI), toCfg.DbPropertiesFor("media_api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := to.GetMediaMetadata(ctx, "grub", "hollow.knight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied == nil || copied.UserID != mediaMetadata.UserID || copied.Base64Hash != mediaMetadata.Base64Hash {
+		t.Fatalf("expected the media to be copied, got %+v", copied)
+	}
+
+	// The destination now contains data, so it mustn't be overwritten
+	if err = migrations[0].run(ctx); err == nil {
+		t.Fatalf("expected copying to a destination containing data to fail")
+	}
+}
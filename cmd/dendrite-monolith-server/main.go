@@ -82,8 +82,8 @@ func main() {
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
 	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(base, deviceDB)
-	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI), base.Cfg.DbProperties())
+	mediaapi.SetupMediaAPIComponent(base, deviceDB, rsAPI)
+	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI), base.Cfg.DbPropertiesFor("public_rooms_api"))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
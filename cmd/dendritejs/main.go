@@ -89,6 +89,7 @@ func main() {
 	cfg.Database.MediaAPI = "file:dendritejs_mediaapi.db"
 	cfg.Database.Naffka = "file:dendritejs_naffka.db"
 	cfg.Database.PublicRoomsAPI = "file:dendritejs_publicrooms.db"
+	cfg.Database.Push = "file:dendritejs_push.db"
 	cfg.Database.RoomServer = "file:dendritejs_roomserver.db"
 	cfg.Database.ServerKey = "file:dendritejs_serverkey.db"
 	cfg.Database.SyncAPI = "file:dendritejs_syncapi.db"
@@ -138,7 +139,7 @@ func main() {
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
 	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asQuery, fedSenderAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(base, deviceDB)
+	mediaapi.SetupMediaAPIComponent(base, deviceDB, rsAPI)
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
@@ -32,6 +32,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	push "github.com/matrix-org/dendrite/clientapi/push/storage"
 	"github.com/matrix-org/dendrite/common"
 
 	"github.com/Shopify/sarama"
@@ -154,7 +155,7 @@ func (b *BaseDendrite) CreateHTTPFederationSenderAPIs() federationSenderAPI.Fede
 // CreateDeviceDB creates a new instance of the device database. Should only be
 // called once per component.
 func (b *BaseDendrite) CreateDeviceDB() devices.Database {
-	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.DbProperties(), b.Cfg.Matrix.ServerName)
+	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.DbPropertiesFor("device"), b.Cfg.Matrix.ServerName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to devices db")
 	}
@@ -165,7 +166,7 @@ func (b *BaseDendrite) CreateDeviceDB() devices.Database {
 // CreateAccountsDB creates a new instance of the accounts database. Should only
 // be called once per component.
 func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
-	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.DbProperties(), b.Cfg.Matrix.ServerName)
+	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.DbPropertiesFor("account"), b.Cfg.Matrix.ServerName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
@@ -173,12 +174,23 @@ func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
 	return db
 }
 
+// CreatePushDB creates a new instance of the push database. Should only be
+// called once per component.
+func (b *BaseDendrite) CreatePushDB() push.Database {
+	db, err := push.NewDatabase(string(b.Cfg.Database.Push), b.Cfg.DbPropertiesFor("push"))
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to connect to push db")
+	}
+
+	return db
+}
+
 // CreateKeyDB creates a new instance of the key database. Should only be called
 // once per component.
 func (b *BaseDendrite) CreateKeyDB() keydb.Database {
 	db, err := keydb.NewDatabase(
 		string(b.Cfg.Database.ServerKey),
-		b.Cfg.DbProperties(),
+		b.Cfg.DbPropertiesFor("server_key"),
 		b.Cfg.Matrix.ServerName,
 		b.Cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
 		b.Cfg.Matrix.KeyID,
@@ -263,7 +275,7 @@ func setupNaffka(cfg *config.Dendrite) (sarama.Consumer, sarama.SyncProducer) {
 			logrus.WithError(err).Panic("Failed to setup naffka database")
 		}
 	} else {
-		db, err = sqlutil.Open("postgres", string(cfg.Database.Naffka), nil)
+		db, err = sqlutil.Open("postgres", string(cfg.Database.Naffka), cfg.DbPropertiesFor("naffka"))
 		if err != nil {
 			logrus.WithError(err).Panic("Failed to open naffka database")
 		}
@@ -274,10 +274,6 @@ func checkErrors(config *Dendrite) (err error) {
 		idMap[appservice.ID] = true
 		tokenMap[appservice.ASToken] = true
 
-		// TODO: Remove once rate_limited is implemented
-		if appservice.RateLimited {
-			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
-		}
 		// TODO: Remove once protocols is implemented
 		if len(appservice.Protocols) > 0 {
 			log.Warn("WARNING: Application service option protocols is currently unimplemented")
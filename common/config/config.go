@@ -16,11 +16,15 @@ package config
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -96,12 +100,50 @@ type Dendrite struct {
 		// HTTP API endpoint used to verify whether the captcha response
 		// was successful
 		RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
+		// The captcha provider: "recaptcha", "hcaptcha" or "custom". The
+		// captcha_* options below default according to the provider.
+		CaptchaProvider string `yaml:"captcha_provider"`
+		// The name of the form field which the captcha widget puts its
+		// response in
+		CaptchaResponseField string `yaml:"captcha_response_field"`
+		// The URL of the script which renders the captcha widget
+		CaptchaScriptURL string `yaml:"captcha_script_url"`
+		// The class of the element which the captcha widget is rendered in
+		CaptchaClass string `yaml:"captcha_class"`
 		// If set disables new users from registering (except via shared
 		// secrets)
 		RegistrationDisabled bool `yaml:"registration_disabled"`
+		// If set, new users must supply a registration token created with
+		// the admin API when registering
+		RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+		// The Matrix user IDs of the server's administrators, who may use
+		// the admin API
+		Admins []string `yaml:"admins"`
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
+		// Single sign-on with an OpenID Connect identity provider
+		OpenIDConnect OpenIDConnect `yaml:"oidc"`
+		// Single sign-on with a CAS server
+		CAS CAS `yaml:"cas"`
+		// Checking passwords with an LDAP server
+		LDAP LDAP `yaml:"ldap"`
+		// Logging in with JSON Web Tokens from an external identity provider
+		JWT JWT `yaml:"jwt"`
+		// Sending emails to validate users' email addresses
+		Email Email `yaml:"email"`
+		// Sending text messages to validate users' phone numbers
+		SMS SMS `yaml:"sms"`
+		// Terms of service which users must consent to
+		Terms Terms `yaml:"terms"`
+		// Limiting how often clients may make requests to the client API
+		RateLimiting RateLimiting `yaml:"rate_limiting"`
+		// The IP ranges of the reverse proxies in front of the client API,
+		// which are trusted to give the address of the client in the
+		// X-Forwarded-For header when rate limiting and locking out logins
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// Protecting accounts from password guessing
+		LoginLockout LoginLockout `yaml:"login_lockout"`
 	} `yaml:"matrix"`
 
 	// The configuration specific to the media repostitory.
@@ -120,6 +162,18 @@ type Dendrite struct {
 		MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
 		// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+		// Whether to remove EXIF and similar metadata, such as the location a
+		// photo was taken at, from JPEG and PNG images when they are uploaded
+		StripImageMetadata bool `yaml:"strip_image_metadata"`
+		// If set, media files are stored in an S3-compatible object store rather
+		// than in base_path, which is then only used for temporary files.
+		S3 MediaS3 `yaml:"s3"`
+		// Configuration for generating previews of URLs with /preview_url
+		URLPreview MediaURLPreview `yaml:"url_preview"`
+		// Configuration for deleting old media
+		Retention MediaRetention `yaml:"retention"`
+		// Configuration for creating media IDs to upload to later
+		AsyncUploads MediaAsyncUploads `yaml:"async_uploads"`
 	} `yaml:"media"`
 
 	// The configuration to use for Prometheus metrics
@@ -186,6 +240,11 @@ type Dendrite struct {
 		// The PublicRoomsAPI database stores information used to compute the public
 		// room directory. It is only accessed by the PublicRoomsAPI server.
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
+		// The Push database stores the pushers that users have configured for
+		// receiving push notifications, and their unread notification counts.
+		// It is accessed by the ClientAPI and the SyncAPI. Defaults to the
+		// Account database if not set.
+		Push DataSource `yaml:"push"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
 		// Maximum open connections to the DB (0 = use default, negative means unlimited)
@@ -194,6 +253,18 @@ type Dendrite struct {
 		MaxIdleConns int `yaml:"max_idle_conns"`
 		// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 		ConnMaxLifetimeSec int `yaml:"conn_max_lifetime"`
+		// Connection pool settings for individual databases, keyed by the name
+		// of the database above (e.g. "room_server"). These override the settings
+		// for all databases above.
+		ConnectionPools map[string]DatabaseConnectionPool `yaml:"connection_pools"`
+		// Read-only Postgres replicas of the databases above. If set, read-heavy
+		// queries are sent to the replica and everything else to the primary.
+		ReadReplicas struct {
+			// A replica of the RoomServer database, used for event and state lookups.
+			RoomServer DataSource `yaml:"room_server"`
+			// A replica of the SyncAPI database, used for /sync requests.
+			SyncAPI DataSource `yaml:"sync_api"`
+		} `yaml:"read_replicas"`
 	} `yaml:"database"`
 
 	// TURN Server Config
@@ -216,6 +287,85 @@ type Dendrite struct {
 		Password string `yaml:"turn_password"`
 	} `yaml:"turn"`
 
+	// The config for the room server.
+	RoomServer struct {
+		// The number of leave transitions in a single state update at or above
+		// which the resulting retired invites are sent to consumers as a single
+		// batched output event rather than one event each. This smooths the load
+		// on consumers when a large room is shut down. 0 disables batching.
+		MassLeaveRetireThreshold int `yaml:"mass_leave_retire_threshold"`
+		// Whether to write an OutputStateDelta event for each change in the
+		// current state of a room, bundling the membership and non-membership
+		// state changes together so that consumers can apply them atomically.
+		EmitStateDeltas bool `yaml:"emit_state_deltas"`
+		// Whether to include the content of the previous membership event for
+		// the user in the membership output events written for membership
+		// changes.
+		MembershipPrevContent bool `yaml:"membership_prev_content"`
+		// Whether to include the version of the current state of the room in
+		// the output events written for membership changes, so that consumers
+		// which cache the room state can tell when their copy is stale.
+		MembershipStateVersion bool `yaml:"membership_state_version"`
+		// How strictly to validate the content of membership events when
+		// updating the membership of a user. Either "lenient" or "strict".
+		MembershipValidation MembershipValidation `yaml:"membership_validation"`
+		// Whether to write an OutputMembershipDailySummary event for each room
+		// in which memberships changed, shortly after midnight UTC each day.
+		MembershipDailySummary bool `yaml:"membership_daily_summary"`
+		// Optionally write each membership transition to a table in a separate
+		// SQL database for analytics. This is done in the background, and
+		// transitions are dropped rather than holding up the roomserver if the
+		// database can't keep up.
+		MembershipAnalytics struct {
+			// The database to write to. Leave empty to disable the sink.
+			Database DataSource `yaml:"database"`
+			// The name of the table to write to. It is created if needed.
+			Table string `yaml:"table"`
+			// The number of transitions to queue for writing before dropping.
+			QueueSize int `yaml:"queue_size"`
+		} `yaml:"membership_analytics"`
+	} `yaml:"room_server"`
+
+	// The config for the federation sender.
+	FederationSender struct {
+		// The maximum number of events per second to send to any single
+		// destination, unless overridden for the destination in the database.
+		// 0 means no limit.
+		DestinationRateLimit float64 `yaml:"destination_rate_limit"`
+		// The limits on the size of the transactions sent to each destination,
+		// unless overridden for the destination in the database. 0 means no
+		// limit.
+		TransactionLimits struct {
+			// The maximum number of PDUs in a transaction.
+			MaxPDUs int `yaml:"max_pdus"`
+			// The maximum number of EDUs in a transaction.
+			MaxEDUs int `yaml:"max_edus"`
+			// The maximum size in bytes of the PDUs and EDUs in a transaction.
+			MaxBytes int `yaml:"max_bytes"`
+		} `yaml:"transaction_limits"`
+		// The maximum number of destinations which may be sent to at once.
+		// Each destination has its own worker, so a slow destination only
+		// holds up the events for itself. 0 means no limit.
+		MaxConcurrentDestinations int `yaml:"max_concurrent_destinations"`
+		// The maximum number of requests which may be in flight to a single
+		// destination at once. Transactions are always sent one at a time so
+		// that events arrive in order, so this only applies to invites.
+		MaxInFlightPerDestination int `yaml:"max_in_flight_per_destination"`
+		// Encrypts the events and EDUs queued in the database, for deployments
+		// which require data to be encrypted at rest. Off by default.
+		QueueEncryption struct {
+			// The version of the key which newly queued content is encrypted
+			// with. 0 means that it isn't encrypted.
+			KeyVersion int `yaml:"key_version"`
+			// The paths to the files holding each version of the key, as 32
+			// bytes encoded as base64. Old versions are needed until the
+			// content queued with them has been sent.
+			KeyPaths map[int]Path `yaml:"key_paths"`
+			// The keys read from KeyPaths.
+			Keys map[int][]byte `yaml:"-"`
+		} `yaml:"queue_encryption"`
+	} `yaml:"federation_sender"`
+
 	// The internal addresses the components will listen on.
 	// These should not be exposed externally as they expose metrics and debugging APIs.
 	// Falls back to addresses listed in Listen if not specified
@@ -293,6 +443,9 @@ type Dendrite struct {
 		ExclusiveApplicationServicesAliasRegexp *regexp.Regexp
 		// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 		// servers from creating RoomIDs in exclusive application service namespaces
+
+		// The parsed IP ranges of the trusted reverse proxies
+		TrustedProxies []*net.IPNet
 	} `yaml:"-"`
 }
 
@@ -311,12 +464,344 @@ type KeyPerspectives []struct {
 	} `yaml:"keys"`
 }
 
+// OpenIDConnect configures logging in by single sign-on with an OpenID Connect
+// identity provider. Users who sign on for the first time are given a new
+// account, named after one of the claims about them from the provider.
+type OpenIDConnect struct {
+	// Whether users can log in with the identity provider
+	Enabled bool `yaml:"enabled"`
+	// The issuer URL of the identity provider, which its configuration is
+	// discovered from, e.g. https://accounts.example.com
+	Issuer string `yaml:"issuer"`
+	// The client ID and secret which this server was registered with at the
+	// identity provider
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The URL which clients use to reach the client API, e.g.
+	// https://matrix.example.com, which the identity provider redirects back
+	// to. It must be registered with the identity provider.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// The scopes to request. Defaults to openid and profile.
+	Scopes []string `yaml:"scopes"`
+	// The claim which the localparts of new accounts are made from.
+	// Defaults to preferred_username.
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The claim which the display names of new accounts are set from.
+	// Defaults to name.
+	DisplayNameClaim string `yaml:"display_name_claim"`
+	// The URLs which clients may be redirected back to after signing on.
+	// A redirect URL must have the same scheme and host as one of them, and
+	// be at or below its path, so https://app.example.com/ allows any page on
+	// app.example.com. If empty then users can be sent back to any client,
+	// but are asked to confirm first as the client can log in as them.
+	ClientRedirectWhitelist []string `yaml:"client_redirect_whitelist"`
+}
+
+// CAS configures logging in by single sign-on with a Central Authentication
+// Service server. Users who sign on for the first time are given a new
+// account, named after their CAS username or one of their attributes.
+type CAS struct {
+	// Whether users can log in with the CAS server
+	Enabled bool `yaml:"enabled"`
+	// The URL of the CAS server, e.g. https://cas.example.com/cas
+	ServerURL string `yaml:"server_url"`
+	// The URL which clients use to reach the client API, e.g.
+	// https://matrix.example.com, which the CAS server redirects back to.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// The attribute which the localparts of new accounts are made from.
+	// Defaults to the CAS username.
+	LocalpartAttribute string `yaml:"localpart_attribute"`
+	// The attribute which the display names of new accounts are set from.
+	// Defaults to displayName.
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+	// The URLs which clients may be redirected back to after signing on. See
+	// OpenIDConnect.ClientRedirectWhitelist.
+	ClientRedirectWhitelist []string `yaml:"client_redirect_whitelist"`
+}
+
+// LDAP configures checking users' passwords with an LDAP server. Users who
+// aren't known to the LDAP server can still log in with a local password.
+type LDAP struct {
+	// Whether passwords are checked with the LDAP server
+	Enabled bool `yaml:"enabled"`
+	// The URI of the LDAP server, e.g. ldaps://ldap.example.com
+	URI string `yaml:"uri"`
+	// Whether to use StartTLS with ldap:// URIs
+	StartTLS bool `yaml:"start_tls"`
+	// The DN and password to bind as when searching for users. If empty
+	// then searches are made anonymously.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	// The DN under which users are searched for, e.g.
+	// ou=users,dc=example,dc=com
+	BaseDN string `yaml:"base_dn"`
+	// The attribute which holds users' usernames. Defaults to uid.
+	UsernameAttribute string `yaml:"username_attribute"`
+	// An optional filter which users must also match, e.g.
+	// (memberOf=cn=matrix,ou=groups,dc=example,dc=com)
+	Filter string `yaml:"filter"`
+	// The attribute which the display names of new accounts are set from.
+	// Defaults to cn.
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+	// Whether to create accounts for LDAP users logging in for the first time
+	CreateAccounts bool `yaml:"create_accounts"`
+}
+
+// JWT configures logging in with JSON Web Tokens, using the
+// org.matrix.login.jwt login type. The tokens are minted by an external
+// identity provider and signed with either a shared secret or the provider's
+// private key.
+type JWT struct {
+	// Whether users can log in with JSON Web Tokens
+	Enabled bool `yaml:"enabled"`
+	// The algorithm which tokens are signed with, one of HS256, HS384, HS512,
+	// RS256, RS384, RS512, ES256, ES384 or ES512.
+	Algorithm string `yaml:"algorithm"`
+	// The shared secret which HS* tokens are signed with
+	Secret string `yaml:"secret"`
+	// The path to the PEM public key which RS* and ES* tokens are verified with
+	PublicKeyPath Path `yaml:"public_key_path"`
+	// The public key loaded from PublicKeyPath
+	PublicKey crypto.PublicKey `yaml:"-"`
+	// If set, tokens must have been issued by this issuer
+	Issuer string `yaml:"issuer"`
+	// If set, tokens must have been issued for one of these audiences
+	Audiences []string `yaml:"audiences"`
+	// The claim which holds the user's localpart or user ID. Defaults to sub.
+	SubjectClaim string `yaml:"subject_claim"`
+	// The claim which the display names of new accounts are set from
+	DisplayNameClaim string `yaml:"display_name_claim"`
+	// Whether to create accounts for users logging in for the first time
+	CreateAccounts bool `yaml:"create_accounts"`
+}
+
+// Email configures sending emails with an SMTP server, which are used to
+// validate users' email addresses, e.g. when they reset their password.
+type Email struct {
+	// Whether emails are sent
+	Enabled bool `yaml:"enabled"`
+	// The host and port of the SMTP server, e.g. smtp.example.com:587.
+	// STARTTLS is used if the server supports it.
+	SMTPAddress string `yaml:"smtp_address"`
+	// The username and password to authenticate to the SMTP server with,
+	// if it requires authentication
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address which emails are sent from, e.g.
+	// "Matrix <noreply@example.com>"
+	From string `yaml:"from"`
+	// The URL which clients use to reach the client API, e.g.
+	// https://matrix.example.com, which links in emails point to.
+	PublicBaseURL string `yaml:"public_base_url"`
+	// Emails to users about messages they have missed
+	Notifications EmailNotifications `yaml:"notifications"`
+}
+
+// MediaS3 configures storing media files in an S3-compatible object store.
+type MediaS3 struct {
+	// The URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com. Buckets
+	// are always addressed with path-style URLs.
+	Endpoint string `yaml:"endpoint"`
+	// The region the bucket is in, which requests are signed for
+	Region string `yaml:"region"`
+	// The bucket to store the files in
+	Bucket string `yaml:"bucket"`
+	// An optional prefix for the keys of the stored files, e.g. "media/"
+	Prefix string `yaml:"prefix"`
+	// The credentials to sign requests with
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// If set, clients downloading media are redirected to a signed URL for the
+	// file which is valid for this long, rather than the file being streamed
+	// through the media API.
+	SignedURLExpiry time.Duration `yaml:"signed_url_expiry"`
+}
+
+// MediaURLPreview configures the /preview_url endpoint of the media API.
+type MediaURLPreview struct {
+	// Whether URL previews are enabled
+	Enabled bool `yaml:"enabled"`
+	// A list of IP ranges in CIDR notation which the media API must not
+	// connect to when fetching a URL to preview. Defaults to the loopback,
+	// private, link-local and other reserved ranges.
+	BlockedIPRanges []string `yaml:"blocked_ip_ranges"`
+	// The maximum size of a page to download for a preview. Defaults to 10MB.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// How long a generated preview is cached for. Defaults to one hour.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// MediaRetention configures deleting old media files and their metadata.
+type MediaRetention struct {
+	// Media from other servers which hasn't been downloaded from this server
+	// for this long is deleted. It is fetched again if it is requested later.
+	// Remote media is kept forever if this is not set.
+	RemoteMediaLifetime time.Duration `yaml:"remote_media_lifetime"`
+	// Media uploaded to this server is deleted this long after it was
+	// uploaded. Local media is kept forever if this is not set.
+	LocalMediaLifetime time.Duration `yaml:"local_media_lifetime"`
+	// How often to check for media to delete. Defaults to one hour.
+	Interval time.Duration `yaml:"interval"`
+	// If true, the media which would be deleted is only logged.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// MediaAsyncUploads configures asynchronous uploads as per MSC2246, where a
+// client creates a media ID and uploads the media to it later.
+type MediaAsyncUploads struct {
+	// How long a created media ID can be uploaded to. Defaults to 24 hours.
+	UnusedExpiry time.Duration `yaml:"unused_expiry"`
+	// The maximum number of media IDs a user can have created without
+	// uploading to them yet. Defaults to 10.
+	MaxPendingUploads int `yaml:"max_pending_uploads"`
+	// The longest a download waits for media which hasn't been uploaded yet.
+	// Defaults to 20 seconds.
+	MaxDownloadWait time.Duration `yaml:"max_download_wait"`
+}
+
+// DefaultBlockedIPRanges are the IP ranges which URL previews are not fetched
+// from if none are configured.
+var DefaultBlockedIPRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// EmailNotifications configures emailing users digests of the messages which
+// they have been notified about but haven't read, for users who have added an
+// email pusher. Users can choose a different delay, or turn the emails off,
+// with their "im.dendrite.email_notifications" account data.
+type EmailNotifications struct {
+	// Whether users can add email pushers
+	Enabled bool `yaml:"enabled"`
+	// How long a notification must have been unread for before it is emailed
+	Delay time.Duration `yaml:"delay"`
+	// How often to check for notifications to email
+	Interval time.Duration `yaml:"interval"`
+	// The name used for the server in the emails, e.g. "Example Chat"
+	AppName string `yaml:"app_name"`
+}
+
+// SMS configures sending text messages with an SMS gateway, which are used to
+// validate users' phone numbers. Each message is sent by POSTing a JSON object
+// with "to" and "text" keys to the gateway URL, e.g. a small service in front
+// of the operator's SMS provider.
+type SMS struct {
+	// Whether text messages are sent
+	Enabled bool `yaml:"enabled"`
+	// The URL which messages are POSTed to
+	GatewayURL string `yaml:"gateway_url"`
+	// If set, sent to the gateway as a bearer token
+	GatewayToken string `yaml:"gateway_token"`
+	// The URL which clients use to reach the client API, e.g.
+	// https://matrix.example.com, which clients submit codes to.
+	PublicBaseURL string `yaml:"public_base_url"`
+}
+
+// Terms are the policy documents, such as terms of service and privacy
+// policies, which users must consent to when registering and before sending
+// messages.
+type Terms struct {
+	// Whether users must consent to the policies
+	Enabled bool `yaml:"enabled"`
+	// The version of the policies. Users must consent again whenever it
+	// changes.
+	Version string `yaml:"version"`
+	// The policy documents
+	Policies []TermsPolicy `yaml:"policies"`
+}
+
+// TermsPolicy is a policy document which users must consent to.
+type TermsPolicy struct {
+	// An ID for the policy, e.g. "privacy_policy"
+	ID string `yaml:"id"`
+	// The name of the policy, which clients show to users
+	Name string `yaml:"name"`
+	// The URL of the policy document
+	URL string `yaml:"url"`
+	// The language of the policy document. Defaults to "en".
+	Language string `yaml:"language"`
+}
+
+// RateLimiting limits how often each user, or for unauthenticated endpoints
+// each IP address, may make requests to each class of client API endpoints.
+type RateLimiting struct {
+	// Whether requests are rate limited
+	Enabled bool `yaml:"enabled"`
+	// Logging in
+	Login RateLimit `yaml:"login"`
+	// Registering
+	Registration RateLimit `yaml:"registration"`
+	// Sending messages
+	Messaging RateLimit `yaml:"messaging"`
+	// Joining rooms
+	Joins RateLimit `yaml:"joins"`
+	// Validating third-party identifiers
+	ThreePIDValidation RateLimit `yaml:"threepid_validation"`
+}
+
+// RateLimit is the limit on a class of endpoints. Clients may make a burst of
+// requests, after which they're limited to a constant rate.
+type RateLimit struct {
+	// How many requests per second may be made after a burst
+	PerSecond float64 `yaml:"per_second"`
+	// How many requests may be made in a burst
+	Burst int `yaml:"burst"`
+}
+
+// LoginLockout slows down and then refuses password login attempts for
+// accounts from each IP address, and from IP addresses, which have had too
+// many failed attempts.
+type LoginLockout struct {
+	// Whether failed login attempts are tracked
+	Enabled bool `yaml:"enabled"`
+	// How long login attempts for an account must wait after a failed one.
+	// This doubles with each further failure.
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	// The longest that login attempts for an account must wait. Accounts are
+	// only ever delayed, rather than locked out, so that someone guessing
+	// the password of an account can't lock its owner out.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// How many failed attempts for an account from an IP address lock the
+	// account out for that IP address
+	MaxFailures int `yaml:"max_failures"`
+	// How many failed attempts from an IP address lock it out
+	MaxFailuresPerIP int `yaml:"max_failures_per_ip"`
+	// How long accounts and IP addresses are locked out for. Failed attempts
+	// older than this are forgotten.
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
 // A Path on the filesystem.
 type Path string
 
 // A DataSource for opening a postgresql database using lib/pq.
 type DataSource string
 
+// DatabaseConnectionPool holds the connection pool settings for a single
+// database. Zero values leave the setting for all databases in place.
+type DatabaseConnectionPool struct {
+	// Maximum open connections to the DB (negative means unlimited)
+	MaxOpenConns int `yaml:"max_open_conns"`
+	// Maximum idle connections to the DB (negative means unlimited)
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// maximum amount of time (in seconds) a connection may be reused (negative means unlimited)
+	ConnMaxLifetimeSec int `yaml:"conn_max_lifetime"`
+}
+
 // A Topic in kafka.
 type Topic string
 
@@ -352,6 +837,19 @@ type LogrusHook struct {
 	Params map[string]interface{} `yaml:"params"`
 }
 
+// MembershipValidation is how strictly the roomserver validates the content
+// of membership events.
+type MembershipValidation string
+
+const (
+	// MembershipValidationLenient ignores unknown keys in the content of
+	// membership events.
+	MembershipValidationLenient MembershipValidation = "lenient"
+	// MembershipValidationStrict rejects membership events with unknown
+	// top-level keys in their content.
+	MembershipValidationStrict MembershipValidation = "strict"
+)
+
 // configErrors stores problems encountered when parsing a config file.
 // It implements the error interface.
 type configErrors []string
@@ -436,6 +934,31 @@ func loadConfig(
 		config.Matrix.TLSFingerPrints = append(config.Matrix.TLSFingerPrints, *fingerprint)
 	}
 
+	if config.Matrix.JWT.Enabled && config.Matrix.JWT.PublicKeyPath != "" {
+		publicKeyPath := absPath(basePath, config.Matrix.JWT.PublicKeyPath)
+		var publicKeyData []byte
+		if publicKeyData, err = readFile(publicKeyPath); err != nil {
+			return nil, err
+		}
+		if config.Matrix.JWT.PublicKey, err = readPublicKeyPEM(publicKeyPath, publicKeyData); err != nil {
+			return nil, err
+		}
+	}
+
+	queueEncryption := &config.FederationSender.QueueEncryption
+	for version, keyPath := range queueEncryption.KeyPaths {
+		var keyData []byte
+		if keyData, err = readFile(absPath(basePath, keyPath)); err != nil {
+			return nil, err
+		}
+		if queueEncryption.Keys == nil {
+			queueEncryption.Keys = map[int][]byte{}
+		}
+		if queueEncryption.Keys[version], err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyData))); err != nil {
+			return nil, fmt.Errorf("invalid queue encryption key in %q: %w", keyPath, err)
+		}
+	}
+
 	config.Media.AbsBasePath = Path(absPath(basePath, config.Media.BasePath))
 
 	// Generate data from config options
@@ -455,7 +978,6 @@ func (config *Dendrite) Derive() error {
 	config.Derived.Registration.Params = make(map[string]interface{})
 
 	// TODO: Add email auth type
-	// TODO: Add MSISDN auth type
 
 	if config.Matrix.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.Matrix.RecaptchaPublicKey}
@@ -466,6 +988,55 @@ func (config *Dendrite) Derive() error {
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	// Users can also register by validating their phone number, which is
+	// then associated with their account.
+	if config.Matrix.SMS.Enabled {
+		stages := []authtypes.LoginType{authtypes.LoginTypeMSISDN}
+		if config.Matrix.RecaptchaEnabled {
+			stages = []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeMSISDN}
+		}
+		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+			authtypes.Flow{Stages: stages})
+	}
+
+	// Every flow starts by checking the registration token, if one is required
+	if config.Matrix.RegistrationRequiresToken {
+		for i, flow := range config.Derived.Registration.Flows {
+			config.Derived.Registration.Flows[i].Stages = append(
+				[]authtypes.LoginType{authtypes.LoginTypeRegistrationToken}, flow.Stages...,
+			)
+		}
+	}
+
+	// Every flow ends with consenting to the terms, if there are any
+	if config.Matrix.Terms.Enabled {
+		policies := make(map[string]interface{})
+		for _, policy := range config.Matrix.Terms.Policies {
+			policies[policy.ID] = map[string]interface{}{
+				"version": config.Matrix.Terms.Version,
+				policy.Language: map[string]string{
+					"name": policy.Name,
+					"url":  policy.URL,
+				},
+			}
+		}
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = map[string]interface{}{"policies": policies}
+		for i := range config.Derived.Registration.Flows {
+			config.Derived.Registration.Flows[i].Stages = append(
+				config.Derived.Registration.Flows[i].Stages, authtypes.LoginTypeTerms,
+			)
+		}
+	}
+
+	config.Derived.TrustedProxies = nil
+	for _, ipRange := range config.Matrix.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy IP range %q: %w", ipRange, err)
+		}
+		config.Derived.TrustedProxies = append(config.Derived.TrustedProxies, ipNet)
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(config); err != nil {
 		return err
@@ -484,6 +1055,84 @@ func (config *Dendrite) SetDefaults() {
 		config.Matrix.TrustedIDServers = []string{}
 	}
 
+	if config.Matrix.CaptchaProvider == "" {
+		config.Matrix.CaptchaProvider = "recaptcha"
+	}
+	switch config.Matrix.CaptchaProvider {
+	case "recaptcha":
+		setDefaultString(&config.Matrix.RecaptchaSiteVerifyAPI, "https://www.google.com/recaptcha/api/siteverify")
+		setDefaultString(&config.Matrix.CaptchaResponseField, "g-recaptcha-response")
+		setDefaultString(&config.Matrix.CaptchaScriptURL, "https://www.google.com/recaptcha/api.js")
+		setDefaultString(&config.Matrix.CaptchaClass, "g-recaptcha")
+	case "hcaptcha":
+		setDefaultString(&config.Matrix.RecaptchaSiteVerifyAPI, "https://hcaptcha.com/siteverify")
+		setDefaultString(&config.Matrix.CaptchaResponseField, "h-captcha-response")
+		setDefaultString(&config.Matrix.CaptchaScriptURL, "https://js.hcaptcha.com/1/api.js")
+		setDefaultString(&config.Matrix.CaptchaClass, "h-captcha")
+	}
+
+	if config.Matrix.Email.Notifications.Delay == 0 {
+		config.Matrix.Email.Notifications.Delay = 10 * time.Minute
+	}
+	if config.Matrix.Email.Notifications.Interval == 0 {
+		config.Matrix.Email.Notifications.Interval = time.Minute
+	}
+	setDefaultString(&config.Matrix.Email.Notifications.AppName, "Matrix")
+
+	if config.Matrix.LoginLockout.InitialDelay == 0 {
+		config.Matrix.LoginLockout.InitialDelay = time.Second
+	}
+	if config.Matrix.LoginLockout.MaxDelay == 0 {
+		config.Matrix.LoginLockout.MaxDelay = time.Minute
+	}
+	if config.Matrix.LoginLockout.MaxFailures == 0 {
+		config.Matrix.LoginLockout.MaxFailures = 5
+	}
+	if config.Matrix.LoginLockout.MaxFailuresPerIP == 0 {
+		config.Matrix.LoginLockout.MaxFailuresPerIP = 20
+	}
+	if config.Matrix.LoginLockout.LockoutDuration == 0 {
+		config.Matrix.LoginLockout.LockoutDuration = 15 * time.Minute
+	}
+
+	defaultRateLimit(&config.Matrix.RateLimiting.Login, 0.17, 3)
+	defaultRateLimit(&config.Matrix.RateLimiting.Registration, 0.17, 3)
+	defaultRateLimit(&config.Matrix.RateLimiting.Messaging, 0.2, 10)
+	defaultRateLimit(&config.Matrix.RateLimiting.Joins, 0.1, 10)
+	defaultRateLimit(&config.Matrix.RateLimiting.ThreePIDValidation, 0.1, 5)
+
+	for i := range config.Matrix.Terms.Policies {
+		setDefaultString(&config.Matrix.Terms.Policies[i].Language, "en")
+	}
+
+	if config.Matrix.OpenIDConnect.Scopes == nil {
+		config.Matrix.OpenIDConnect.Scopes = []string{"openid", "profile"}
+	}
+
+	if config.Matrix.OpenIDConnect.LocalpartClaim == "" {
+		config.Matrix.OpenIDConnect.LocalpartClaim = "preferred_username"
+	}
+
+	if config.Matrix.OpenIDConnect.DisplayNameClaim == "" {
+		config.Matrix.OpenIDConnect.DisplayNameClaim = "name"
+	}
+
+	if config.Matrix.CAS.DisplayNameAttribute == "" {
+		config.Matrix.CAS.DisplayNameAttribute = "displayName"
+	}
+
+	if config.Matrix.LDAP.UsernameAttribute == "" {
+		config.Matrix.LDAP.UsernameAttribute = "uid"
+	}
+
+	if config.Matrix.LDAP.DisplayNameAttribute == "" {
+		config.Matrix.LDAP.DisplayNameAttribute = "cn"
+	}
+
+	if config.Matrix.JWT.SubjectClaim == "" {
+		config.Matrix.JWT.SubjectClaim = "sub"
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
@@ -493,6 +1142,38 @@ func (config *Dendrite) SetDefaults() {
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
 
+	if config.Media.URLPreview.BlockedIPRanges == nil {
+		config.Media.URLPreview.BlockedIPRanges = DefaultBlockedIPRanges
+	}
+
+	if config.Media.URLPreview.MaxPageSizeBytes == 0 {
+		config.Media.URLPreview.MaxPageSizeBytes = 10485760
+	}
+
+	if config.Media.URLPreview.CacheTTL == 0 {
+		config.Media.URLPreview.CacheTTL = time.Hour
+	}
+
+	if config.Media.Retention.Interval == 0 {
+		config.Media.Retention.Interval = time.Hour
+	}
+
+	if config.Media.AsyncUploads.UnusedExpiry == 0 {
+		config.Media.AsyncUploads.UnusedExpiry = 24 * time.Hour
+	}
+
+	if config.Media.AsyncUploads.MaxPendingUploads == 0 {
+		config.Media.AsyncUploads.MaxPendingUploads = 10
+	}
+
+	if config.Media.AsyncUploads.MaxDownloadWait == 0 {
+		config.Media.AsyncUploads.MaxDownloadWait = 20 * time.Second
+	}
+
+	if config.Database.Push == "" {
+		config.Database.Push = config.Database.Account
+	}
+
 	if config.Database.MaxIdleConns == 0 {
 		config.Database.MaxIdleConns = 2
 	}
@@ -501,6 +1182,31 @@ func (config *Dendrite) SetDefaults() {
 		config.Database.MaxOpenConns = 100
 	}
 
+	if config.RoomServer.MembershipValidation == "" {
+		config.RoomServer.MembershipValidation = MembershipValidationLenient
+	}
+
+	if config.RoomServer.MembershipAnalytics.Table == "" {
+		config.RoomServer.MembershipAnalytics.Table = "membership_transitions"
+	}
+
+	if config.RoomServer.MembershipAnalytics.QueueSize == 0 {
+		config.RoomServer.MembershipAnalytics.QueueSize = 1000
+	}
+
+	// These are the limits from the server-server API specification.
+	if config.FederationSender.TransactionLimits.MaxPDUs == 0 {
+		config.FederationSender.TransactionLimits.MaxPDUs = 50
+	}
+
+	if config.FederationSender.TransactionLimits.MaxEDUs == 0 {
+		config.FederationSender.TransactionLimits.MaxEDUs = 100
+	}
+
+	if config.FederationSender.MaxInFlightPerDestination == 0 {
+		config.FederationSender.MaxInFlightPerDestination = 1
+	}
+
 }
 
 // Error returns a string detailing how many errors were contained within a
@@ -557,6 +1263,21 @@ func (config *Dendrite) checkTurn(configErrs *configErrors) {
 	}
 }
 
+// setDefaultString sets the option to the default value if it isn't set.
+func setDefaultString(option *string, value string) {
+	if *option == "" {
+		*option = value
+	}
+}
+
+// defaultRateLimit sets the limit to the default values if it isn't set.
+func defaultRateLimit(limit *RateLimit, perSecond float64, burst int) {
+	if limit.PerSecond == 0 && limit.Burst == 0 {
+		limit.PerSecond = perSecond
+		limit.Burst = burst
+	}
+}
+
 // checkMatrix verifies the parameters matrix.* are valid.
 func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "matrix.server_name", string(config.Matrix.ServerName))
@@ -566,6 +1287,89 @@ func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 		checkNotEmpty(configErrs, "matrix.recaptcha_public_key", string(config.Matrix.RecaptchaPublicKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
+		checkNotEmpty(configErrs, "matrix.captcha_response_field", config.Matrix.CaptchaResponseField)
+		checkNotEmpty(configErrs, "matrix.captcha_script_url", config.Matrix.CaptchaScriptURL)
+		checkNotEmpty(configErrs, "matrix.captcha_class", config.Matrix.CaptchaClass)
+		switch config.Matrix.CaptchaProvider {
+		case "recaptcha", "hcaptcha", "custom":
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "matrix.captcha_provider", config.Matrix.CaptchaProvider))
+		}
+	}
+	if config.Matrix.OpenIDConnect.Enabled {
+		checkNotEmpty(configErrs, "matrix.oidc.issuer", config.Matrix.OpenIDConnect.Issuer)
+		checkNotEmpty(configErrs, "matrix.oidc.client_id", config.Matrix.OpenIDConnect.ClientID)
+		checkNotEmpty(configErrs, "matrix.oidc.client_secret", config.Matrix.OpenIDConnect.ClientSecret)
+		checkNotEmpty(configErrs, "matrix.oidc.public_base_url", config.Matrix.OpenIDConnect.PublicBaseURL)
+	}
+	if config.Matrix.CAS.Enabled {
+		checkNotEmpty(configErrs, "matrix.cas.server_url", config.Matrix.CAS.ServerURL)
+		checkNotEmpty(configErrs, "matrix.cas.public_base_url", config.Matrix.CAS.PublicBaseURL)
+	}
+	if config.Matrix.LDAP.Enabled {
+		checkNotEmpty(configErrs, "matrix.ldap.uri", config.Matrix.LDAP.URI)
+		checkNotEmpty(configErrs, "matrix.ldap.base_dn", config.Matrix.LDAP.BaseDN)
+	}
+	if config.Matrix.Email.Enabled {
+		checkNotEmpty(configErrs, "matrix.email.smtp_address", config.Matrix.Email.SMTPAddress)
+		checkNotEmpty(configErrs, "matrix.email.from", config.Matrix.Email.From)
+		checkNotEmpty(configErrs, "matrix.email.public_base_url", config.Matrix.Email.PublicBaseURL)
+	}
+	if config.Matrix.Email.Notifications.Enabled {
+		if !config.Matrix.Email.Enabled {
+			configErrs.Add("matrix.email.notifications requires matrix.email to be enabled")
+		}
+		checkPositive(configErrs, "matrix.email.notifications.delay", int64(config.Matrix.Email.Notifications.Delay))
+		checkPositive(configErrs, "matrix.email.notifications.interval", int64(config.Matrix.Email.Notifications.Interval))
+	}
+	if config.Matrix.SMS.Enabled {
+		checkNotEmpty(configErrs, "matrix.sms.gateway_url", config.Matrix.SMS.GatewayURL)
+		checkNotEmpty(configErrs, "matrix.sms.public_base_url", config.Matrix.SMS.PublicBaseURL)
+	}
+	if config.Matrix.RateLimiting.Enabled {
+		for key, limit := range map[string]RateLimit{
+			"matrix.rate_limiting.login":               config.Matrix.RateLimiting.Login,
+			"matrix.rate_limiting.registration":        config.Matrix.RateLimiting.Registration,
+			"matrix.rate_limiting.messaging":           config.Matrix.RateLimiting.Messaging,
+			"matrix.rate_limiting.joins":               config.Matrix.RateLimiting.Joins,
+			"matrix.rate_limiting.threepid_validation": config.Matrix.RateLimiting.ThreePIDValidation,
+		} {
+			checkPositive(configErrs, key+".burst", int64(limit.Burst))
+			if limit.PerSecond < 0 {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", key+".per_second", limit.PerSecond))
+			}
+		}
+	}
+	for i, ipRange := range config.Matrix.TrustedProxies {
+		if _, _, err := net.ParseCIDR(ipRange); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("matrix.trusted_proxies[%d]", i), ipRange))
+		}
+	}
+	if config.Matrix.LoginLockout.Enabled {
+		checkPositive(configErrs, "matrix.login_lockout.initial_delay", int64(config.Matrix.LoginLockout.InitialDelay))
+		checkPositive(configErrs, "matrix.login_lockout.max_delay", int64(config.Matrix.LoginLockout.MaxDelay))
+		checkPositive(configErrs, "matrix.login_lockout.max_failures", int64(config.Matrix.LoginLockout.MaxFailures))
+		checkPositive(configErrs, "matrix.login_lockout.max_failures_per_ip", int64(config.Matrix.LoginLockout.MaxFailuresPerIP))
+		checkPositive(configErrs, "matrix.login_lockout.lockout_duration", int64(config.Matrix.LoginLockout.LockoutDuration))
+	}
+	if config.Matrix.Terms.Enabled {
+		checkNotEmpty(configErrs, "matrix.terms.version", config.Matrix.Terms.Version)
+		checkNotZero(configErrs, "matrix.terms.policies", int64(len(config.Matrix.Terms.Policies)))
+		for _, policy := range config.Matrix.Terms.Policies {
+			checkNotEmpty(configErrs, "matrix.terms.policies.id", policy.ID)
+			checkNotEmpty(configErrs, "matrix.terms.policies.name", policy.Name)
+			checkNotEmpty(configErrs, "matrix.terms.policies.url", policy.URL)
+		}
+	}
+	if config.Matrix.JWT.Enabled {
+		switch config.Matrix.JWT.Algorithm {
+		case "HS256", "HS384", "HS512":
+			checkNotEmpty(configErrs, "matrix.jwt.secret", config.Matrix.JWT.Secret)
+		case "RS256", "RS384", "RS512", "ES256", "ES384", "ES512":
+			checkNotEmpty(configErrs, "matrix.jwt.public_key_path", string(config.Matrix.JWT.PublicKeyPath))
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "matrix.jwt.algorithm", config.Matrix.JWT.Algorithm))
+		}
 	}
 }
 
@@ -579,6 +1383,42 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 		checkPositive(configErrs, fmt.Sprintf("media.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+
+	if config.Media.S3.Bucket != "" {
+		checkNotEmpty(configErrs, "media.s3.endpoint", config.Media.S3.Endpoint)
+		checkNotEmpty(configErrs, "media.s3.region", config.Media.S3.Region)
+		checkNotEmpty(configErrs, "media.s3.access_key_id", config.Media.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media.s3.secret_access_key", config.Media.S3.SecretAccessKey)
+		checkPositive(configErrs, "media.s3.signed_url_expiry", int64(config.Media.S3.SignedURLExpiry))
+		// S3 doesn't accept signed URLs which are valid for more than a week.
+		if config.Media.S3.SignedURLExpiry > 7*24*time.Hour {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media.s3.signed_url_expiry", config.Media.S3.SignedURLExpiry))
+		}
+	}
+
+	if config.Media.Retention.RemoteMediaLifetime != 0 || config.Media.Retention.LocalMediaLifetime != 0 {
+		checkPositive(configErrs, "media.retention.interval", int64(config.Media.Retention.Interval))
+	}
+	if config.Media.Retention.RemoteMediaLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media.retention.remote_media_lifetime", config.Media.Retention.RemoteMediaLifetime))
+	}
+	if config.Media.Retention.LocalMediaLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media.retention.local_media_lifetime", config.Media.Retention.LocalMediaLifetime))
+	}
+
+	checkPositive(configErrs, "media.async_uploads.unused_expiry", int64(config.Media.AsyncUploads.UnusedExpiry))
+	checkPositive(configErrs, "media.async_uploads.max_pending_uploads", int64(config.Media.AsyncUploads.MaxPendingUploads))
+	checkPositive(configErrs, "media.async_uploads.max_download_wait", int64(config.Media.AsyncUploads.MaxDownloadWait))
+
+	if config.Media.URLPreview.Enabled {
+		checkPositive(configErrs, "media.url_preview.max_page_size_bytes", int64(config.Media.URLPreview.MaxPageSizeBytes))
+		checkPositive(configErrs, "media.url_preview.cache_ttl", int64(config.Media.URLPreview.CacheTTL))
+		for i, ipRange := range config.Media.URLPreview.BlockedIPRanges {
+			if _, _, err := net.ParseCIDR(ipRange); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media.url_preview.blocked_ip_ranges[%d]", i), ipRange))
+			}
+		}
+	}
 }
 
 // checkKafka verifies the parameters kafka.* and the related
@@ -610,6 +1450,25 @@ func (config *Dendrite) checkDatabase(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "database.media_api", string(config.Database.MediaAPI))
 	checkNotEmpty(configErrs, "database.sync_api", string(config.Database.SyncAPI))
 	checkNotEmpty(configErrs, "database.room_server", string(config.Database.RoomServer))
+	for database := range config.Database.ConnectionPools {
+		if !isDatabaseName(database) {
+			configErrs.Add(fmt.Sprintf(
+				"invalid key in config key %q: %q is not a database",
+				"database.connection_pools", database,
+			))
+		}
+	}
+}
+
+// isDatabaseName returns true if the name is that of one of the databases in
+// the database section of the config.
+func isDatabaseName(name string) bool {
+	switch name {
+	case "account", "device", "media_api", "server_key", "sync_api", "room_server",
+		"federation_sender", "appservice", "public_rooms_api", "push", "naffka":
+		return true
+	}
+	return false
 }
 
 // checkListen verifies the parameters listen.* are valid.
@@ -622,6 +1481,65 @@ func (config *Dendrite) checkListen(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "listen.edu_server", string(config.Listen.EDUServer))
 }
 
+// checkRoomServer verifies the parameters room_server.* are valid.
+func (config *Dendrite) checkRoomServer(configErrs *configErrors) {
+	switch config.RoomServer.MembershipValidation {
+	case MembershipValidationLenient, MembershipValidationStrict:
+	default:
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %q, expected %q or %q",
+			"room_server.membership_validation", config.RoomServer.MembershipValidation,
+			MembershipValidationLenient, MembershipValidationStrict,
+		))
+	}
+}
+
+// checkFederationSender verifies the parameters federation_sender.* are valid.
+func (config *Dendrite) checkFederationSender(configErrs *configErrors) {
+	if config.FederationSender.DestinationRateLimit < 0 {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %v, expected 0 or more",
+			"federation_sender.destination_rate_limit", config.FederationSender.DestinationRateLimit,
+		))
+	}
+	limits := config.FederationSender.TransactionLimits
+	for _, limit := range []struct {
+		key   string
+		value int
+	}{
+		{"federation_sender.transaction_limits.max_pdus", limits.MaxPDUs},
+		{"federation_sender.transaction_limits.max_edus", limits.MaxEDUs},
+		{"federation_sender.transaction_limits.max_bytes", limits.MaxBytes},
+		{"federation_sender.max_concurrent_destinations", config.FederationSender.MaxConcurrentDestinations},
+		{"federation_sender.max_in_flight_per_destination", config.FederationSender.MaxInFlightPerDestination},
+	} {
+		if limit.value < 0 {
+			configErrs.Add(fmt.Sprintf(
+				"invalid value for config key %q: %d, expected 0 or more", limit.key, limit.value,
+			))
+		}
+	}
+	queueEncryption := config.FederationSender.QueueEncryption
+	if queueEncryption.KeyVersion < 0 {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %d, expected 0 or more",
+			"federation_sender.queue_encryption.key_version", queueEncryption.KeyVersion,
+		))
+	} else if queueEncryption.KeyVersion > 0 {
+		checkNotEmpty(configErrs, fmt.Sprintf(
+			"federation_sender.queue_encryption.key_paths.%d", queueEncryption.KeyVersion,
+		), string(queueEncryption.KeyPaths[queueEncryption.KeyVersion]))
+	}
+	for version := range queueEncryption.KeyPaths {
+		if version <= 0 {
+			configErrs.Add(fmt.Sprintf(
+				"invalid key version in config key %q: %d, expected 1 or more",
+				"federation_sender.queue_encryption.key_paths", version,
+			))
+		}
+	}
+}
+
 // checkLogging verifies the parameters logging.* are valid.
 func (config *Dendrite) checkLogging(configErrs *configErrors) {
 	for _, logrusHook := range config.Logging {
@@ -647,6 +1565,8 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkTurn(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
+	config.checkRoomServer(&configErrs)
+	config.checkFederationSender(&configErrs)
 	config.checkLogging(&configErrs)
 
 	if !monolithic {
@@ -701,6 +1621,24 @@ func readKeyPEM(path string, data []byte) (gomatrixserverlib.KeyID, ed25519.Priv
 	}
 }
 
+// readPublicKeyPEM reads the first PKIX public key from PEM data.
+func readPublicKeyPEM(path string, data []byte) (crypto.PublicKey, error) {
+	for {
+		var keyBlock *pem.Block
+		keyBlock, data = pem.Decode(data)
+		if keyBlock == nil {
+			return nil, fmt.Errorf("no public key PEM data in %q", path)
+		}
+		if keyBlock.Type == "PUBLIC KEY" {
+			publicKey, err := x509.ParsePKIXPublicKey(keyBlock.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key in %q: %s", path, err)
+			}
+			return publicKey, nil
+		}
+	}
+}
+
 func fingerprintPEM(data []byte) *gomatrixserverlib.TLSFingerprint {
 	for {
 		var certDERBlock *pem.Block
@@ -715,6 +1653,16 @@ func fingerprintPEM(data []byte) *gomatrixserverlib.TLSFingerprint {
 	}
 }
 
+// IsAdmin returns whether the user is one of the server's administrators.
+func (config *Dendrite) IsAdmin(userID string) bool {
+	for _, admin := range config.Matrix.Admins {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
 // AppServiceURL returns a HTTP URL for where the appservice component is listening.
 func (config *Dendrite) AppServiceURL() string {
 	// Hard code the appservice server to talk HTTP for now.
@@ -790,6 +1738,39 @@ func (config Dendrite) DbProperties() DbProperties {
 	return config
 }
 
+// DbPropertiesFor returns the connection pool settings for the named database,
+// e.g. "room_server", which are the settings for all databases with any that
+// are set in database.connection_pools for that database overriding them.
+func (config Dendrite) DbPropertiesFor(database string) DbProperties {
+	props := dbProperties{
+		maxIdleConns:    config.MaxIdleConns(),
+		maxOpenConns:    config.MaxOpenConns(),
+		connMaxLifetime: config.ConnMaxLifetime(),
+	}
+	pool := config.Database.ConnectionPools[database]
+	if pool.MaxIdleConns != 0 {
+		props.maxIdleConns = pool.MaxIdleConns
+	}
+	if pool.MaxOpenConns != 0 {
+		props.maxOpenConns = pool.MaxOpenConns
+	}
+	if pool.ConnMaxLifetimeSec != 0 {
+		props.connMaxLifetime = time.Duration(pool.ConnMaxLifetimeSec) * time.Second
+	}
+	return props
+}
+
+// dbProperties is the DbProperties of a single database.
+type dbProperties struct {
+	maxIdleConns    int
+	maxOpenConns    int
+	connMaxLifetime time.Duration
+}
+
+func (p dbProperties) MaxIdleConns() int              { return p.maxIdleConns }
+func (p dbProperties) MaxOpenConns() int              { return p.maxOpenConns }
+func (p dbProperties) ConnMaxLifetime() time.Duration { return p.connMaxLifetime }
+
 // logrusLogger is a small wrapper that implements jaeger.Logger using logrus.
 type logrusLogger struct {
 	l *logrus.Logger
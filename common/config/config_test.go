@@ -15,8 +15,14 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -32,6 +38,72 @@ func TestLoadConfigRelative(t *testing.T) {
 	}
 }
 
+func TestLoadQueueEncryptionKeys(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	configData := testConfig + `
+federation_sender:
+  queue_encryption:
+    key_version: 2
+    key_paths:
+      1: old_key.txt
+      2: /keys/new_key.txt
+`
+	cfg, err := loadConfig("/my/config/dir", []byte(configData),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":   testCert,
+			"/my/config/dir/old_key.txt":    base64.StdEncoding.EncodeToString([]byte(key)) + "\n",
+			"/keys/new_key.txt":             base64.StdEncoding.EncodeToString([]byte(key)),
+		}.readFile,
+		false,
+	)
+	if err != nil {
+		t.Fatal("failed to load config:", err)
+	}
+	keys := cfg.FederationSender.QueueEncryption.Keys
+	if len(keys) != 2 || string(keys[1]) != key || string(keys[2]) != key {
+		t.Errorf("expected both keys to be loaded, got %v", keys)
+	}
+
+	// The key which content is encrypted with must be configured.
+	_, err = loadConfig("/my/config/dir", []byte(strings.Replace(configData, "key_version: 2", "key_version: 3", 1)),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":   testCert,
+		}.readFile,
+		false,
+	)
+	if err == nil {
+		t.Error("expected a missing key to be rejected")
+	}
+}
+
+func TestDbPropertiesFor(t *testing.T) {
+	var cfg Dendrite
+	cfg.Database.MaxOpenConns = 100
+	cfg.Database.MaxIdleConns = 2
+	cfg.Database.ConnMaxLifetimeSec = 60
+	cfg.Database.ConnectionPools = map[string]DatabaseConnectionPool{
+		"room_server": {MaxOpenConns: 20, ConnMaxLifetimeSec: -1},
+	}
+
+	props := cfg.DbPropertiesFor("room_server")
+	if props.MaxOpenConns() != 20 || props.MaxIdleConns() != 2 || props.ConnMaxLifetime() != -time.Second {
+		t.Errorf("room_server: got %d open, %d idle, %s lifetime", props.MaxOpenConns(), props.MaxIdleConns(), props.ConnMaxLifetime())
+	}
+	props = cfg.DbPropertiesFor("sync_api")
+	if props.MaxOpenConns() != 100 || props.MaxIdleConns() != 2 || props.ConnMaxLifetime() != time.Minute {
+		t.Errorf("sync_api: got %d open, %d idle, %s lifetime", props.MaxOpenConns(), props.MaxIdleConns(), props.ConnMaxLifetime())
+	}
+
+	var errs configErrors
+	cfg.Database.ConnectionPools["roomserver"] = DatabaseConnectionPool{MaxOpenConns: 1}
+	cfg.checkDatabase(&errs)
+	if !strings.Contains(strings.Join(errs, "\n"), `"roomserver" is not a database`) {
+		t.Errorf("expected an error for an unknown database in connection_pools, got %q", errs)
+	}
+}
+
 const testConfig = `
 version: 0
 matrix:
@@ -80,6 +152,30 @@ func (m mockReadFile) readFile(path string) ([]byte, error) {
 	return []byte(data), nil
 }
 
+func TestDeriveRegistrationFlows(t *testing.T) {
+	var cfg Dendrite
+	cfg.Matrix.RegistrationRequiresToken = true
+	cfg.Matrix.Terms.Enabled = true
+	cfg.Matrix.Terms.Version = "1.0"
+	cfg.Matrix.Terms.Policies = []TermsPolicy{{ID: "privacy_policy", Name: "Privacy Policy", URL: "https://example.com/privacy"}}
+	cfg.SetDefaults()
+	if err := cfg.Derive(); err != nil {
+		t.Fatal("failed to derive config:", err)
+	}
+
+	want := []authtypes.LoginType{
+		authtypes.LoginTypeRegistrationToken, authtypes.LoginTypeDummy, authtypes.LoginTypeTerms,
+	}
+	if got := cfg.Derived.Registration.Flows[0].Stages; !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted stages %v, got %v", want, got)
+	}
+	params := cfg.Derived.Registration.Params[authtypes.LoginTypeTerms].(map[string]interface{})
+	policy := params["policies"].(map[string]interface{})["privacy_policy"].(map[string]interface{})
+	if policy["version"] != "1.0" || policy["en"].(map[string]string)["url"] != "https://example.com/privacy" {
+		t.Errorf("unexpected terms params %v", params)
+	}
+}
+
 func TestReadKey(t *testing.T) {
 	keyID, _, err := readKeyPEM("path/to/key", []byte(testKey))
 	if err != nil {
@@ -22,6 +22,7 @@ import (
 	"golang.org/x/crypto/ed25519"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/keydb/mysql"
 	"github.com/matrix-org/dendrite/common/keydb/postgres"
 	"github.com/matrix-org/dendrite/common/keydb/sqlite3"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -40,8 +41,10 @@ func NewDatabase(
 		return postgres.NewDatabase(dataSourceName, dbProperties, serverName, serverKey, serverKeyID)
 	}
 	switch uri.Scheme {
-	case "postgres":
+	case "postgres", "cockroachdb":
 		return postgres.NewDatabase(dataSourceName, dbProperties, serverName, serverKey, serverKeyID)
+	case "mysql":
+		return mysql.NewDatabase(dataSourceName, dbProperties, serverName, serverKey, serverKeyID)
 	case "file":
 		return sqlite3.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
 	default:
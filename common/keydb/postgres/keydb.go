@@ -47,6 +47,9 @@ func NewDatabase(
 	if err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(db, "keydb", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	d := &Database{}
 	err = d.statements.prepare(db)
 	if err != nil {
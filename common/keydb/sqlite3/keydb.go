@@ -24,8 +24,6 @@ import (
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // A Database implements gomatrixserverlib.KeyDatabase and is used to store
@@ -48,6 +46,9 @@ func NewDatabase(
 	if err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(db, "keydb", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	d := &Database{}
 	err = d.statements.prepare(db)
 	if err != nil {
@@ -68,10 +68,6 @@ type serverKeyStatements struct {
 
 func (s *serverKeyStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(serverKeysSchema)
-	if err != nil {
-		return
-	}
 	if s.bulkSelectServerKeysStmt, err = db.Prepare(bulkSelectServerKeysSQL); err != nil {
 		return
 	}
@@ -41,6 +41,23 @@ const upsertPartitionOffsetsSQL = "" +
 	" ON CONFLICT (topic, partition)" +
 	" DO UPDATE SET partition_offset = $3"
 
+// MySQL doesn't allow TEXT columns in unique keys and reserves the word
+// "partition", so it needs its own schema and statements.
+const mysqlPartitionOffsetsSchema = "" +
+	"CREATE TABLE IF NOT EXISTS ${prefix}_partition_offsets (" +
+	" topic VARCHAR(255) NOT NULL," +
+	" `partition` INTEGER NOT NULL," +
+	" partition_offset BIGINT NOT NULL," +
+	" UNIQUE (topic, `partition`)" +
+	")"
+
+const mysqlSelectPartitionOffsetsSQL = "" +
+	"SELECT `partition`, partition_offset FROM ${prefix}_partition_offsets WHERE topic = $1"
+
+const mysqlUpsertPartitionOffsetsSQL = "" +
+	"INSERT INTO ${prefix}_partition_offsets (topic, `partition`, partition_offset) VALUES ($1, $2, $3)" +
+	" ON DUPLICATE KEY UPDATE partition_offset = $3"
+
 // PartitionOffsetStatements represents a set of statements that can be run on a partition_offsets table.
 type PartitionOffsetStatements struct {
 	selectPartitionOffsetsStmt *sql.Stmt
@@ -51,17 +68,28 @@ type PartitionOffsetStatements struct {
 // Takes a prefix to prepend to the table name used to store the partition offsets.
 // This allows multiple components to share the same database schema.
 func (s *PartitionOffsetStatements) Prepare(db *sql.DB, prefix string) (err error) {
-	_, err = db.Exec(strings.Replace(partitionOffsetsSchema, "${prefix}", prefix, -1))
+	return s.prepare(db, prefix, partitionOffsetsSchema, selectPartitionOffsetsSQL, upsertPartitionOffsetsSQL)
+}
+
+// PrepareMySQL is like Prepare, but for MySQL databases.
+func (s *PartitionOffsetStatements) PrepareMySQL(db *sql.DB, prefix string) (err error) {
+	return s.prepare(db, prefix, mysqlPartitionOffsetsSchema, mysqlSelectPartitionOffsetsSQL, mysqlUpsertPartitionOffsetsSQL)
+}
+
+func (s *PartitionOffsetStatements) prepare(
+	db *sql.DB, prefix, schema, selectSQL, upsertSQL string,
+) (err error) {
+	_, err = db.Exec(strings.Replace(schema, "${prefix}", prefix, -1))
 	if err != nil {
 		return
 	}
 	if s.selectPartitionOffsetsStmt, err = db.Prepare(
-		strings.Replace(selectPartitionOffsetsSQL, "${prefix}", prefix, -1),
+		strings.Replace(selectSQL, "${prefix}", prefix, -1),
 	); err != nil {
 		return
 	}
 	if s.upsertPartitionOffsetStmt, err = db.Prepare(
-		strings.Replace(upsertPartitionOffsetsSQL, "${prefix}", prefix, -1),
+		strings.Replace(upsertSQL, "${prefix}", prefix, -1),
 	); err != nil {
 		return
 	}
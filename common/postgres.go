@@ -23,3 +23,12 @@ func IsUniqueConstraintViolationErr(err error) bool {
 	pqErr, ok := err.(*pq.Error)
 	return ok && pqErr.Code == "23505"
 }
+
+// IsSerialisationFailureErr returns true if the error is a postgresql serialization_failure
+// error, meaning that the transaction conflicted with a concurrent one and can be retried.
+// Postgres only returns these for serializable transactions, but CockroachDB runs every
+// transaction that way.
+func IsSerialisationFailureErr(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
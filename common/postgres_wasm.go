@@ -20,3 +20,8 @@ package common
 func IsUniqueConstraintViolationErr(err error) bool {
 	return false
 }
+
+// IsSerialisationFailureErr no-ops for this architecture
+func IsSerialisationFailureErr(err error) bool {
+	return false
+}
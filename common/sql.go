@@ -41,10 +41,28 @@ func EndTransaction(txn Transaction, succeeded *bool) error {
 	}
 }
 
+// maxTransactionAttempts is the number of times WithTransaction will run a
+// transaction which keeps failing because it conflicts with concurrent ones.
+const maxTransactionAttempts = 5
+
 // WithTransaction runs a block of code passing in an SQL transaction
 // If the code returns an error or panics then the transactions is rolledback
 // Otherwise the transaction is committed.
+// If the transaction fails with a serialisation failure, which CockroachDB
+// returns when transactions conflict, then it is retried from the start, so the
+// block of code must not have side effects outside of the transaction other
+// than setting its results.
 func WithTransaction(db *sql.DB, fn func(txn *sql.Tx) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = withTransaction(db, fn)
+		if err == nil || attempt == maxTransactionAttempts || !IsSerialisationFailureErr(err) {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+}
+
+func withTransaction(db *sql.DB, fn func(txn *sql.Tx) error) (err error) {
 	txn, err := db.Begin()
 	if err != nil {
 		return
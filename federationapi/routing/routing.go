@@ -79,7 +79,7 @@ func Setup(
 			}
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, producer, eduProducer, keys, federation,
+				cfg, rsAPI, producer, eduProducer, keys, federation, federationSenderAPI,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -263,6 +263,9 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
+	// TODO: Add /make_knock and /send_knock once a supported room version
+	// allows knocking. The roomserver already tracks knock memberships.
+
 	v1fedmux.Handle("/make_leave/{roomID}/{eventID}", common.MakeFedAPI(
 		"federation_make_leave", cfg.Matrix.ServerName, keys,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common/config"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -40,6 +41,7 @@ func Send(
 	eduProducer *producers.EDUServerProducer,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
 ) util.JSONResponse {
 	t := txnReq{
 		context:     httpReq.Context(),
@@ -73,6 +75,16 @@ func Send(
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
 
+	// The origin has evidently come back if it is sending us transactions, so
+	// stop backing off from it.
+	aliveReq := federationSenderAPI.PerformServersAliveRequest{
+		Servers: []gomatrixserverlib.ServerName{t.Origin},
+	}
+	aliveRes := federationSenderAPI.PerformServersAliveResponse{}
+	if err := fsAPI.PerformServersAlive(httpReq.Context(), &aliveReq, &aliveRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("fsAPI.PerformServersAlive failed")
+	}
+
 	resp, err := t.processTransaction()
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("t.processTransaction failed")
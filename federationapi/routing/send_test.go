@@ -86,6 +86,8 @@ type testRoomserverAPI struct {
 
 func (t *testRoomserverAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI) {}
 
+func (t *testRoomserverAPI) SetJoinedHostsChangedHook(hook api.JoinedHostsChangedFunc) {}
+
 func (t *testRoomserverAPI) InputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
@@ -165,6 +167,78 @@ func (t *testRoomserverAPI) QueryMembershipForUser(
 	return fmt.Errorf("not implemented")
 }
 
+// Make a local user leave all of their rooms.
+func (t *testRoomserverAPI) PerformLeaveAllRooms(
+	ctx context.Context,
+	req *api.PerformLeaveAllRoomsRequest,
+	res *api.PerformLeaveAllRoomsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Set whether a room is in announce-only mode.
+func (t *testRoomserverAPI) PerformSetRoomAnnounceOnly(
+	ctx context.Context,
+	req *api.PerformSetRoomAnnounceOnlyRequest,
+	res *api.PerformSetRoomAnnounceOnlyResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Shut down a room.
+func (t *testRoomserverAPI) PerformShutdownRoom(
+	ctx context.Context,
+	req *api.PerformShutdownRoomRequest,
+	res *api.PerformShutdownRoomResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Purge a room from the roomserver.
+func (t *testRoomserverAPI) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Upgrade a room to a new room version.
+func (t *testRoomserverAPI) PerformUpgradeRoom(
+	ctx context.Context,
+	req *api.PerformUpgradeRoomRequest,
+	res *api.PerformUpgradeRoomResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Query whether a room is in announce-only mode.
+func (t *testRoomserverAPI) QueryRoomAnnounceOnly(
+	ctx context.Context,
+	request *api.QueryRoomAnnounceOnlyRequest,
+	response *api.QueryRoomAnnounceOnlyResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Query the mxc:// URIs of the media referenced by the events in a room.
+func (t *testRoomserverAPI) QueryRoomMediaURIs(
+	ctx context.Context,
+	request *api.QueryRoomMediaURIsRequest,
+	response *api.QueryRoomMediaURIsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Query the output events that would be emitted by a membership change.
+func (t *testRoomserverAPI) QueryMembershipChangePreview(
+	ctx context.Context,
+	request *api.QueryMembershipChangePreviewRequest,
+	response *api.QueryMembershipChangePreviewResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query a list of membership events for a room
 func (t *testRoomserverAPI) QueryMembershipsForRoom(
 	ctx context.Context,
@@ -30,6 +30,20 @@ type FederationSenderInternalAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query whether sending events to all destinations over federation is
+	// paused, e.g. during maintenance.
+	QueryGlobalSendPaused(
+		ctx context.Context,
+		request *QueryGlobalSendPausedRequest,
+		response *QueryGlobalSendPausedResponse,
+	) error
+	// Query the health of the queues of events for each destination, e.g.
+	// how many events are pending and whether we are backing off from it.
+	QueryDestinationQueues(
+		ctx context.Context,
+		request *QueryDestinationQueuesRequest,
+		response *QueryDestinationQueuesResponse,
+	) error
 	// Handle an instruction to make_join & send_join with a remote server.
 	PerformJoin(
 		ctx context.Context,
@@ -42,6 +56,20 @@ type FederationSenderInternalAPI interface {
 		request *PerformLeaveRequest,
 		response *PerformLeaveResponse,
 	) error
+	// Bring the joined hosts for a room back in line with the membership of
+	// the room in the roomserver, e.g. after they have drifted due to a crash.
+	PerformReconcileJoinedHosts(
+		ctx context.Context,
+		request *PerformReconcileJoinedHostsRequest,
+		response *PerformReconcileJoinedHostsResponse,
+	) error
+	// Notify the federation sender that servers are reachable, e.g. because
+	// they have sent us a transaction, so that it stops backing off from them.
+	PerformServersAlive(
+		ctx context.Context,
+		request *PerformServersAliveRequest,
+		response *PerformServersAliveResponse,
+	) error
 }
 
 // NewFederationSenderInternalAPIHTTP creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
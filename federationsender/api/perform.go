@@ -18,6 +18,12 @@ const (
 
 	// FederationSenderPerformLeaveRequestPath is the HTTP path for the PerformLeaveRequest API.
 	FederationSenderPerformLeaveRequestPath = "/api/federationsender/performLeaveRequest"
+
+	// FederationSenderPerformReconcileJoinedHostsPath is the HTTP path for the PerformReconcileJoinedHosts API.
+	FederationSenderPerformReconcileJoinedHostsPath = "/api/federationsender/performReconcileJoinedHosts"
+
+	// FederationSenderPerformServersAlivePath is the HTTP path for the PerformServersAlive API.
+	FederationSenderPerformServersAlivePath = "/api/federationsender/performServersAlive"
 )
 
 type PerformDirectoryLookupRequest struct {
@@ -87,3 +93,49 @@ func (h *httpFederationSenderInternalAPI) PerformLeave(
 	apiURL := h.federationSenderURL + FederationSenderPerformLeaveRequestPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+type PerformReconcileJoinedHostsRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformReconcileJoinedHostsResponse struct {
+	// The joined hosts that were missing and have been added.
+	Added []types.JoinedHost `json:"added"`
+	// The joined hosts that were no longer joined and have been removed.
+	Removed []types.JoinedHost `json:"removed"`
+}
+
+// Handle an instruction to bring the joined hosts for a room back in line
+// with the membership of the room in the roomserver.
+func (h *httpFederationSenderInternalAPI) PerformReconcileJoinedHosts(
+	ctx context.Context,
+	request *PerformReconcileJoinedHostsRequest,
+	response *PerformReconcileJoinedHostsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReconcileJoinedHosts")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformReconcileJoinedHostsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+type PerformServersAliveRequest struct {
+	Servers []gomatrixserverlib.ServerName `json:"servers"`
+}
+
+type PerformServersAliveResponse struct {
+}
+
+// Handle an instruction to clear the backoff for servers which are known to
+// be reachable, catching them up if they were blacklisted.
+func (h *httpFederationSenderInternalAPI) PerformServersAlive(
+	ctx context.Context,
+	request *PerformServersAliveRequest,
+	response *PerformServersAliveResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformServersAlive")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformServersAlivePath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
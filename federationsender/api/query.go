@@ -16,6 +16,12 @@ const FederationSenderQueryJoinedHostsInRoomPath = "/api/federationsender/queryJ
 // FederationSenderQueryJoinedHostServerNamesInRoomPath is the HTTP path for the QueryJoinedHostServerNamesInRoom API.
 const FederationSenderQueryJoinedHostServerNamesInRoomPath = "/api/federationsender/queryJoinedHostServerNamesInRoom"
 
+// FederationSenderQueryGlobalSendPausedPath is the HTTP path for the QueryGlobalSendPaused API.
+const FederationSenderQueryGlobalSendPausedPath = "/api/federationsender/queryGlobalSendPaused"
+
+// FederationSenderQueryDestinationQueuesPath is the HTTP path for the QueryDestinationQueues API.
+const FederationSenderQueryDestinationQueuesPath = "/api/federationsender/queryDestinationQueues"
+
 // QueryJoinedHostsInRoomRequest is a request to QueryJoinedHostsInRoom
 type QueryJoinedHostsInRoomRequest struct {
 	RoomID string `json:"room_id"`
@@ -61,3 +67,53 @@ func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	apiURL := h.federationSenderURL + FederationSenderQueryJoinedHostServerNamesInRoomPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryGlobalSendPausedRequest is a request to QueryGlobalSendPaused
+type QueryGlobalSendPausedRequest struct{}
+
+// QueryGlobalSendPausedResponse is a response to QueryGlobalSendPaused
+type QueryGlobalSendPausedResponse struct {
+	// Whether sending to all destinations is paused. Events are still queued
+	// while sending is paused, and are sent once it is resumed.
+	Paused bool `json:"paused"`
+}
+
+// QueryGlobalSendPaused implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryGlobalSendPaused(
+	ctx context.Context,
+	request *QueryGlobalSendPausedRequest,
+	response *QueryGlobalSendPausedResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryGlobalSendPaused")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryGlobalSendPausedPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryDestinationQueuesRequest is a request to QueryDestinationQueues
+type QueryDestinationQueuesRequest struct {
+	// The maximum number of destinations with pending events to return,
+	// most backed up first. Defaults to 100 if not positive.
+	Limit int `json:"limit"`
+}
+
+// QueryDestinationQueuesResponse is a response to QueryDestinationQueues
+type QueryDestinationQueuesResponse struct {
+	// The status of the queue for each destination which has pending events,
+	// followed by any others which are being backed off from or blacklisted.
+	Destinations []types.DestinationQueueStatus `json:"destinations"`
+}
+
+// QueryDestinationQueues implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryDestinationQueues(
+	ctx context.Context,
+	request *QueryDestinationQueuesRequest,
+	response *QueryDestinationQueuesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDestinationQueues")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryDestinationQueuesPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -93,6 +93,9 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	for i := range joined {
 		names[i] = joined[i].ServerName
 	}
+	// The joined hosts in the database are updated from the roomserver output
+	// log, so they can be behind the changes the roomserver told us about.
+	names = t.queues.JoinedHosts(ote.Event.RoomID, names)
 
 	edu := &gomatrixserverlib.EDU{Type: ote.Event.Type}
 	if edu.Content, err = json.Marshal(map[string]interface{}{
@@ -31,6 +31,10 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+// mRoomTombstone is the event type of the state event which marks a room as
+// having been replaced by another room.
+const mRoomTombstone = "m.room.tombstone"
+
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
 	cfg        *config.Dendrite
@@ -118,6 +122,17 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 			}).Panicf("roomserver output log: write invite event failure")
 			return nil
 		}
+	case api.OutputTypePurgeRoom:
+		log.WithField("room_id", output.PurgeRoom.RoomID).Info("received purge room from roomserver")
+
+		if err := s.db.PurgeRoom(context.TODO(), output.PurgeRoom.RoomID); err != nil {
+			// panic rather than continue with an inconsistent database
+			log.WithFields(log.Fields{
+				"room_id":    output.PurgeRoom.RoomID,
+				log.ErrorKey: err,
+			}).Panicf("roomserver output log: purge room failure")
+			return nil
+		}
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -169,6 +184,28 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 		return nil
 	}
 
+	// Once a room has been replaced by another room there is no point in
+	// fanning out the messages in it any more. State events, including the
+	// tombstone event itself, are still sent so that the other servers have
+	// an accurate view of the state of the room.
+	if ore.Event.Type() == mRoomTombstone && ore.Event.StateKeyEquals("") {
+		if err = s.db.SetRoomTombstoned(context.TODO(), ore.Event.RoomID()); err != nil {
+			return err
+		}
+	} else if ore.Event.StateKey() == nil {
+		tombstoned, terr := s.db.IsRoomTombstoned(context.TODO(), ore.Event.RoomID())
+		if terr != nil {
+			return terr
+		}
+		if tombstoned {
+			log.WithFields(log.Fields{
+				"event_id": ore.Event.EventID(),
+				"room_id":  ore.Event.RoomID(),
+			}).Debug("Not sending event in tombstoned room")
+			return nil
+		}
+	}
+
 	// Work out which hosts were joined at the event itself.
 	joinedHostsAtEvent, err := s.joinedHostsAtEvent(ore, oldJoinedHosts)
 	if err != nil {
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/producers"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -38,7 +39,14 @@ func SetupFederationSenderComponent(
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	keyRing *gomatrixserverlib.KeyRing,
 ) api.FederationSenderInternalAPI {
-	federationSenderDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationSender), base.Cfg.DbProperties())
+	queueEncryption := base.Cfg.FederationSender.QueueEncryption
+	queueCipher, err := encryption.NewCipher(queueEncryption.KeyVersion, queueEncryption.Keys)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to set up the federation sender queue encryption")
+	}
+	federationSenderDB, err := storage.NewDatabase(
+		string(base.Cfg.Database.FederationSender), base.Cfg.DbPropertiesFor("federation_sender"), queueCipher,
+	)
 	if err != nil {
 		logrus.WithError(err).Panic("failed to connect to federation sender db")
 	}
@@ -49,8 +57,13 @@ func SetupFederationSenderComponent(
 
 	statistics := &types.Statistics{}
 	queues := queue.NewOutgoingQueues(
-		base.Cfg.Matrix.ServerName, federation, roomserverProducer, statistics,
+		federationSenderDB, base.Cfg.Matrix.ServerName, federation, roomserverProducer, statistics,
+		base.Cfg.FederationSender.DestinationRateLimit,
+		types.TransactionLimits(base.Cfg.FederationSender.TransactionLimits),
+		base.Cfg.FederationSender.MaxConcurrentDestinations,
+		base.Cfg.FederationSender.MaxInFlightPerDestination,
 	)
+	rsAPI.SetJoinedHostsChangedHook(queues.JoinedHostsChanged)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, queues,
@@ -69,7 +82,7 @@ func SetupFederationSenderComponent(
 
 	queryAPI := internal.NewFederationSenderInternalAPI(
 		federationSenderDB, base.Cfg, roomserverProducer, federation, keyRing,
-		statistics,
+		statistics, queues,
 	)
 	queryAPI.SetupHTTP(http.DefaultServeMux)
 
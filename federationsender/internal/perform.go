@@ -7,6 +7,8 @@ import (
 
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/internal/perform"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -264,3 +266,78 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		request.RoomID, len(request.ServerNames),
 	)
 }
+
+// PerformReconcileJoinedHosts implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformReconcileJoinedHosts(
+	ctx context.Context,
+	request *api.PerformReconcileJoinedHostsRequest,
+	response *api.PerformReconcileJoinedHostsResponse,
+) error {
+	// The current state of the room in the roomserver is authoritative, so
+	// work out the joined hosts from the join events in it.
+	stateReq := roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: request.RoomID,
+	}
+	stateRes := roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err := r.producer.InputAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return err
+	}
+	if !stateRes.RoomExists {
+		return fmt.Errorf("room %q does not exist", request.RoomID)
+	}
+	wanted := map[string]types.JoinedHost{}
+	for _, ev := range stateRes.StateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if membership, err := ev.Membership(); err != nil || membership != gomatrixserverlib.Join {
+			continue
+		}
+		_, serverName, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err != nil {
+			continue
+		}
+		wanted[ev.EventID()] = types.JoinedHost{
+			MemberEventID: ev.EventID(), ServerName: serverName,
+		}
+	}
+
+	joinedHosts, err := r.db.GetJoinedHosts(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	var removeEventIDs []string
+	for _, joinedHost := range joinedHosts {
+		if _, ok := wanted[joinedHost.MemberEventID]; ok {
+			delete(wanted, joinedHost.MemberEventID)
+			continue
+		}
+		response.Removed = append(response.Removed, joinedHost)
+		removeEventIDs = append(removeEventIDs, joinedHost.MemberEventID)
+	}
+	for _, joinedHost := range wanted {
+		response.Added = append(response.Added, joinedHost)
+	}
+	if len(response.Added) == 0 && len(response.Removed) == 0 {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id": request.RoomID,
+		"added":   len(response.Added),
+		"removed": len(response.Removed),
+	}).Info("Reconciling joined hosts with roomserver")
+	return r.db.ReconcileJoinedHosts(ctx, request.RoomID, response.Added, removeEventIDs)
+}
+
+// PerformServersAlive implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformServersAlive(
+	ctx context.Context,
+	request *api.PerformServersAliveRequest,
+	response *api.PerformServersAliveResponse,
+) error {
+	for _, serverName := range request.Servers {
+		r.queues.ServerAlive(serverName)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testRoomID      = fmt.Sprintf("!hallownest:%s", testOrigin)
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+// fakeRoomserverAPI returns the given state events as the current state of
+// testRoomID, and says that any other room doesn't exist.
+type fakeRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	state []gomatrixserverlib.HeaderedEvent
+}
+
+func (r *fakeRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *roomserverAPI.QueryLatestEventsAndStateRequest,
+	response *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	if request.RoomID != testRoomID {
+		return nil
+	}
+	response.RoomExists = true
+	response.RoomVersion = testRoomVersion
+	response.StateEvents = r.state
+	return nil
+}
+
+func mustCreateMemberEvent(t *testing.T, userID, membership string) gomatrixserverlib.HeaderedEvent {
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:   testRoomID,
+		Sender:   userID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+		Content:  []byte(fmt.Sprintf(`{"membership":%q}`, membership)),
+		Depth:    1,
+	}
+	e, err := b.Build(time.Now(), testOrigin, "ed25519:perform_test", testPrivateKey, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return e.Headered(testRoomVersion)
+}
+
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.NewDatabase(dataSource, nil, nil)
+	if err != nil {
+		closeDB()
+		t.Fatalf("storage.NewDatabase returned %s", err)
+	}
+	return db, closeDB
+}
+
+func joinedHostEventIDs(hosts []types.JoinedHost) []string {
+	eventIDs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		eventIDs = append(eventIDs, host.MemberEventID)
+	}
+	sort.Strings(eventIDs)
+	return eventIDs
+}
+
+func TestPerformReconcileJoinedHosts(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	hornetJoin := mustCreateMemberEvent(t, "@hornet:hollow.knight", "join")
+	quirrelJoin := mustCreateMemberEvent(t, "@quirrel:pale.court", "join")
+	zoteLeave := mustCreateMemberEvent(t, "@zote:greenpath", "leave")
+	rsAPI := &fakeRoomserverAPI{
+		state: []gomatrixserverlib.HeaderedEvent{hornetJoin, quirrelJoin, zoteLeave},
+	}
+	fsAPI := NewFederationSenderInternalAPI(
+		db, nil, producers.NewRoomserverProducer(rsAPI, testOrigin, "ed25519:perform_test", testPrivateKey),
+		nil, nil, &types.Statistics{}, nil,
+	)
+
+	// The federation sender missed Quirrel's join and Zote's leave, so it
+	// still thinks that greenpath is in the room and pale.court isn't.
+	zoteJoinEventID := "$zote_join:greenpath"
+	if err := db.ReconcileJoinedHosts(ctx, testRoomID, []types.JoinedHost{
+		{MemberEventID: hornetJoin.EventID(), ServerName: "hollow.knight"},
+		{MemberEventID: zoteJoinEventID, ServerName: "greenpath"},
+	}, nil); err != nil {
+		t.Fatalf("ReconcileJoinedHosts returned %s", err)
+	}
+
+	var res api.PerformReconcileJoinedHostsResponse
+	if err := fsAPI.PerformReconcileJoinedHosts(ctx, &api.PerformReconcileJoinedHostsRequest{RoomID: testRoomID}, &res); err != nil {
+		t.Fatalf("PerformReconcileJoinedHosts returned %s", err)
+	}
+	if len(res.Added) != 1 || res.Added[0].MemberEventID != quirrelJoin.EventID() || res.Added[0].ServerName != "pale.court" {
+		t.Errorf("want Quirrel's join to be added, got %+v", res.Added)
+	}
+	if len(res.Removed) != 1 || res.Removed[0].MemberEventID != zoteJoinEventID {
+		t.Errorf("want Zote's join to be removed, got %+v", res.Removed)
+	}
+
+	joinedHosts, err := db.GetJoinedHosts(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("GetJoinedHosts returned %s", err)
+	}
+	want := []string{hornetJoin.EventID(), quirrelJoin.EventID()}
+	sort.Strings(want)
+	if got := joinedHostEventIDs(joinedHosts); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want joined hosts %v, got %v", want, got)
+	}
+
+	// Once the joined hosts match there is nothing left to do.
+	res = api.PerformReconcileJoinedHostsResponse{}
+	if err = fsAPI.PerformReconcileJoinedHosts(ctx, &api.PerformReconcileJoinedHostsRequest{RoomID: testRoomID}, &res); err != nil {
+		t.Fatalf("PerformReconcileJoinedHosts returned %s", err)
+	}
+	if len(res.Added) != 0 || len(res.Removed) != 0 {
+		t.Errorf("want no changes, got %+v", res)
+	}
+
+	// Rooms that the roomserver doesn't know about can't be reconciled.
+	res = api.PerformReconcileJoinedHostsResponse{}
+	if err = fsAPI.PerformReconcileJoinedHosts(ctx, &api.PerformReconcileJoinedHostsRequest{RoomID: "!abyss:hollow.knight"}, &res); err == nil {
+		t.Errorf("want an error for an unknown room")
+	}
+}
+
+func TestQueryGlobalSendPaused(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	fsAPI := NewFederationSenderInternalAPI(db, nil, nil, nil, nil, &types.Statistics{}, nil)
+
+	for _, paused := range []bool{true, false} {
+		if err := db.SetGlobalSendPaused(ctx, paused); err != nil {
+			t.Fatalf("SetGlobalSendPaused returned %s", err)
+		}
+		var res api.QueryGlobalSendPausedResponse
+		if err := fsAPI.QueryGlobalSendPaused(ctx, &api.QueryGlobalSendPausedRequest{}, &res); err != nil {
+			t.Fatalf("QueryGlobalSendPaused returned %s", err)
+		}
+		if res.Paused != paused {
+			t.Errorf("expected paused to be %v, got %v", paused, res.Paused)
+		}
+	}
+}
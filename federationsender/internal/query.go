@@ -32,8 +32,33 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	for _, host := range joinedHosts {
 		response.ServerNames = append(response.ServerNames, host.ServerName)
 	}
+	response.ServerNames = f.queues.JoinedHosts(request.RoomID, response.ServerNames)
 
 	// TODO: remove duplicates?
 
 	return
 }
+
+// QueryGlobalSendPaused implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryGlobalSendPaused(
+	ctx context.Context,
+	request *api.QueryGlobalSendPausedRequest,
+	response *api.QueryGlobalSendPausedResponse,
+) (err error) {
+	response.Paused, err = f.db.IsGlobalSendPaused(ctx)
+	return
+}
+
+// QueryDestinationQueues implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryDestinationQueues(
+	ctx context.Context,
+	request *api.QueryDestinationQueuesRequest,
+	response *api.QueryDestinationQueuesResponse,
+) (err error) {
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	response.Destinations, err = f.queues.DestinationStatuses(ctx, limit)
+	return
+}
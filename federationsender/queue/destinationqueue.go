@@ -18,9 +18,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -34,19 +36,27 @@ import (
 // ensures that only one request is in flight to a given destination
 // at a time.
 type destinationQueue struct {
+	db                 storage.Database                        // database, may be nil
 	rsProducer         *producers.RoomserverProducer           // roomserver producer
 	client             *gomatrixserverlib.FederationClient     // federation client
 	origin             gomatrixserverlib.ServerName            // origin of requests
 	destination        gomatrixserverlib.ServerName            // destination of requests
 	running            atomic.Bool                             // is the queue worker running?
 	statistics         *types.ServerStatistics                 // statistics about this remote server
+	allPaused          *atomic.Bool                            // is sending paused for all destinations?
+	rateLimit          float64                                 // default events per second, 0 for no limit
+	txnLimits          types.TransactionLimits                 // default limits on each transaction
+	slots              chan struct{}                           // shared by all destinations, nil for no limit
+	maxInFlight        int                                     // most requests to send at once
 	incomingPDUs       chan *gomatrixserverlib.HeaderedEvent   // PDUs to send
-	incomingEDUs       chan *gomatrixserverlib.EDU             // EDUs to send
+	incomingEDUs       chan *types.QueuedEDU                   // EDUs to send
 	incomingInvites    chan *gomatrixserverlib.InviteV2Request // invites to send
 	lastTransactionIDs []gomatrixserverlib.TransactionID       // last transaction ID
 	pendingPDUs        []*gomatrixserverlib.HeaderedEvent      // owned by backgroundSend
-	pendingEDUs        []*gomatrixserverlib.EDU                // owned by backgroundSend
+	pendingEDUs        []*types.QueuedEDU                      // owned by backgroundSend
 	pendingInvites     []*gomatrixserverlib.InviteV2Request    // owned by backgroundSend
+	enqueued           atomic.Int64                            // events queued since last recorded
+	dequeued           atomic.Int64                            // events sent since last recorded
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -60,13 +70,14 @@ func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.HeaderedEvent) {
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
+	oq.enqueued.Inc()
 	oq.incomingPDUs <- ev
 }
 
 // sendEDU adds the EDU event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending events to that destination.
-func (oq *destinationQueue) sendEDU(ev *gomatrixserverlib.EDU) {
+func (oq *destinationQueue) sendEDU(ev *types.QueuedEDU) {
 	if oq.statistics.Blacklisted() {
 		// If the destination is blacklisted then drop the event.
 		return
@@ -74,6 +85,7 @@ func (oq *destinationQueue) sendEDU(ev *gomatrixserverlib.EDU) {
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
+	oq.enqueued.Inc()
 	oq.incomingEDUs <- ev
 }
 
@@ -88,6 +100,7 @@ func (oq *destinationQueue) sendInvite(ev *gomatrixserverlib.InviteV2Request) {
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
+	oq.enqueued.Inc()
 	oq.incomingInvites <- ev
 }
 
@@ -101,64 +114,99 @@ func (oq *destinationQueue) backgroundSend() {
 	}
 	defer oq.running.Store(false)
 
+	// If the queue was restored with events still pending from before a
+	// restart then start sending them straight away.
+	morePending := len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0
 	for {
 		// Wait either for incoming events, or until we hit an
-		// idle timeout.
-		select {
-		case pdu := <-oq.incomingPDUs:
-			// Ordering of PDUs is important so we add them to the end
-			// of the queue and they will all be added to transactions
-			// in order.
-			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
-		case edu := <-oq.incomingEDUs:
-			// Likewise for EDUs, although we should probably not try
-			// too hard with some EDUs (like typing notifications) after
-			// a certain amount of time has passed.
-			// TODO: think about EDU expiry some more
-			oq.pendingEDUs = append(oq.pendingEDUs, edu)
-		case invite := <-oq.incomingInvites:
-			// There's no strict ordering requirement for invites like
-			// there is for transactions, so we put the invite onto the
-			// front of the queue. This means that if an invite that is
-			// stuck failing already, that it won't block our new invite
-			// from being sent.
-			oq.pendingInvites = append(
-				[]*gomatrixserverlib.InviteV2Request{invite},
-				oq.pendingInvites...,
-			)
-		case <-time.After(time.Second * 30):
-			// The worker is idle so stop the goroutine. It'll
-			// get restarted automatically the next time we
-			// get an event.
-			return
+		// idle timeout. If the last transaction couldn't fit all of the
+		// pending events then send the next one straight away instead.
+		if !morePending {
+			select {
+			case pdu := <-oq.incomingPDUs:
+				// Ordering of PDUs is important so we add them to the end
+				// of the queue and they will all be added to transactions
+				// in order.
+				oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+			case edu := <-oq.incomingEDUs:
+				// Likewise for EDUs, although some EDUs (like typing
+				// notifications) are dropped if they expire before they
+				// can be sent.
+				oq.pendingEDUs = append(oq.pendingEDUs, edu)
+			case invite := <-oq.incomingInvites:
+				// There's no strict ordering requirement for invites like
+				// there is for transactions, so we put the invite onto the
+				// front of the queue. This means that if an invite that is
+				// stuck failing already, that it won't block our new invite
+				// from being sent.
+				oq.pendingInvites = append(
+					[]*gomatrixserverlib.InviteV2Request{invite},
+					oq.pendingInvites...,
+				)
+			case <-time.After(time.Second * 30):
+				// The worker is idle so stop the goroutine. It'll
+				// get restarted automatically the next time we
+				// get an event.
+				return
+			}
 		}
+		morePending = false
+
+		// If sending is paused for all destinations then keep queuing
+		// events until it is resumed, before applying any backoff.
+		oq.waitWhileAllPaused()
 
 		// If we are backing off this server then wait for the
 		// backoff duration to complete first.
 		if backoff, duration := oq.statistics.BackoffDuration(); backoff {
-			<-time.After(duration)
+			oq.queueIncomingUntil(time.After(duration))
 		}
 
-		// How many things do we have waiting?
-		numPDUs := len(oq.pendingPDUs)
-		numEDUs := len(oq.pendingEDUs)
+		// Wait for one of the slots shared with the other destinations,
+		// if they are limited, before sending anything.
+		oq.acquireSlot()
+
+		// Pick up everything else that has arrived in the meantime, so
+		// that it is batched into the same transaction rather than being
+		// sent one event at a time.
+		oq.drainIncoming()
+
+		// Drop any EDUs which are no longer worth sending, which may be
+		// the case if we have been backing off for a while.
+		oq.dropExpiredEDUs()
+
+		// How many things do we have waiting, and how many of them fit
+		// into the next transaction?
+		sentEvents := 0
+		numPDUs, numEDUs := oq.transactionSize()
 		numInvites := len(oq.pendingInvites)
 
 		// If we have pending PDUs or EDUs then construct a transaction.
 		if numPDUs > 0 || numEDUs > 0 {
 			// Try sending the next transaction and see what happens.
-			transaction, terr := oq.nextTransaction(oq.pendingPDUs, oq.pendingEDUs, oq.statistics.SuccessCount())
+			transaction, terr := oq.nextTransaction(
+				oq.pendingPDUs[:numPDUs], oq.pendingEDUs[:numEDUs], oq.statistics.SuccessCount(),
+			)
 			if terr != nil {
 				// We failed to send the transaction.
+				oq.recordSendAttempt(false, nil, nil)
 				if giveUp := oq.statistics.Failure(); giveUp {
 					// It's been suggested that we should give up because
 					// the backoff has exceeded a maximum allowable value.
+					oq.releaseSlot()
+					oq.dropPending()
 					return
 				}
+				// Otherwise retry the transaction once the backoff has
+				// passed, rather than waiting for something new to send.
+				morePending = true
 			} else if transaction {
 				// If we successfully sent the transaction then clear out
 				// the pending events and EDUs.
 				oq.statistics.Success()
+				oq.dequeued.Add(int64(numPDUs + numEDUs))
+				oq.recordSendAttempt(true, oq.pendingPDUs[:numPDUs], oq.pendingEDUs[:numEDUs])
+				sentEvents += numPDUs + numEDUs
 				// Reallocate so that the underlying arrays can be GC'd, as
 				// opposed to growing forever.
 				for i := 0; i < numPDUs; i++ {
@@ -172,9 +220,10 @@ func (oq *destinationQueue) backgroundSend() {
 					oq.pendingPDUs[numPDUs:]...,
 				)
 				oq.pendingEDUs = append(
-					[]*gomatrixserverlib.EDU{},
+					[]*types.QueuedEDU{},
 					oq.pendingEDUs[numEDUs:]...,
 				)
+				morePending = len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0
 			}
 		}
 
@@ -184,15 +233,22 @@ func (oq *destinationQueue) backgroundSend() {
 			if ierr != nil {
 				// We failed to send the transaction so increase the
 				// backoff and give it another go shortly.
+				oq.recordSendAttempt(false, nil, nil)
 				if giveUp := oq.statistics.Failure(); giveUp {
 					// It's been suggested that we should give up because
 					// the backoff has exceeded a maximum allowable value.
+					oq.releaseSlot()
+					oq.dropPending()
 					return
 				}
+				morePending = true
 			} else if sent > 0 {
 				// If we successfully sent the invites then clear out
 				// the pending invites.
 				oq.statistics.Success()
+				oq.dequeued.Add(int64(sent))
+				oq.recordSendAttempt(true, nil, nil)
+				sentEvents += sent
 				// Reallocate so that the underlying array can be GC'd, as
 				// opposed to growing forever.
 				oq.pendingInvites = append(
@@ -201,6 +257,263 @@ func (oq *destinationQueue) backgroundSend() {
 				)
 			}
 		}
+
+		// Give up the slot so that other destinations can use it while
+		// this one is waiting to send again.
+		oq.releaseSlot()
+
+		// Wait long enough that we don't exceed the rate limit for the
+		// destination before sending anything else.
+		oq.throttle(sentEvents)
+	}
+}
+
+// dropPending drops everything pending for the destination once it has been
+// blacklisted, so that the queue doesn't grow without bound while it is down.
+// It is caught up with the latest event in each room instead once it is known
+// to be reachable again.
+func (oq *destinationQueue) dropPending() {
+	log.WithFields(log.Fields{
+		"destination": oq.destination,
+		"pdus":        len(oq.pendingPDUs),
+		"edus":        len(oq.pendingEDUs),
+		"invites":     len(oq.pendingInvites),
+	}).Warn("Destination is blacklisted, dropping pending events")
+	oq.pendingPDUs = nil
+	oq.pendingEDUs = nil
+	oq.pendingInvites = nil
+	if oq.db == nil {
+		return
+	}
+	if err := oq.db.DeletePendingForDestination(context.TODO(), oq.destination); err != nil {
+		log.WithError(err).WithField("destination", oq.destination).Error("failed to delete pending events")
+	}
+}
+
+// dropExpiredEDUs removes the pending EDUs which have expired from the queue,
+// e.g. typing notifications which are long out of date.
+func (oq *destinationQueue) dropExpiredEDUs() {
+	now := time.Now()
+	var expiredNIDs []int64
+	pending := oq.pendingEDUs[:0]
+	for _, edu := range oq.pendingEDUs {
+		if !edu.Expired(now) {
+			pending = append(pending, edu)
+			continue
+		}
+		if edu.NID != 0 {
+			expiredNIDs = append(expiredNIDs, edu.NID)
+		}
+	}
+	for i := len(pending); i < len(oq.pendingEDUs); i++ {
+		oq.pendingEDUs[i] = nil
+	}
+	oq.pendingEDUs = pending
+	if oq.db == nil || len(expiredNIDs) == 0 {
+		return
+	}
+	if err := oq.db.DeleteQueuedEDUs(context.TODO(), expiredNIDs); err != nil {
+		log.WithError(err).WithField("destination", oq.destination).Error("failed to delete expired EDUs")
+	}
+}
+
+// transactionSize returns how many of the pending PDUs and EDUs fit into the
+// next transaction. The limits set for the destination in the database take
+// precedence over the defaults.
+func (oq *destinationQueue) transactionSize() (numPDUs, numEDUs int) {
+	limits := oq.txnLimits
+	if oq.db != nil {
+		dbLimits, ok, err := oq.db.DestinationTransactionLimits(context.TODO(), oq.destination)
+		if err != nil {
+			log.WithError(err).WithField("destination", oq.destination).Error("failed to get transaction limits")
+		} else if ok {
+			limits = dbLimits
+		}
+	}
+	return packTransaction(oq.pendingPDUs, oq.pendingEDUs, limits)
+}
+
+// packTransaction returns how many of the PDUs and EDUs, taken in order, fit
+// into a transaction within the limits. The PDUs are packed before the EDUs.
+// At least one PDU or EDU is always included, even if it is larger than the
+// byte limit on its own, so that it doesn't block the queue.
+func packTransaction(
+	pdus []*gomatrixserverlib.HeaderedEvent, edus []*types.QueuedEDU,
+	limits types.TransactionLimits,
+) (numPDUs, numEDUs int) {
+	size := 0
+	fits := func(n int) bool {
+		return limits.MaxBytes <= 0 || numPDUs+numEDUs == 0 || size+n <= limits.MaxBytes
+	}
+	for _, pdu := range pdus {
+		if limits.MaxPDUs > 0 && numPDUs >= limits.MaxPDUs {
+			break
+		}
+		n := len(pdu.JSON())
+		if !fits(n) {
+			// Stop here rather than skipping the PDU, as PDUs must be sent
+			// in order.
+			break
+		}
+		size += n
+		numPDUs++
+	}
+	for _, edu := range edus {
+		if limits.MaxEDUs > 0 && numEDUs >= limits.MaxEDUs {
+			break
+		}
+		n := len(edu.EDU.Type) + len(edu.EDU.Content)
+		if !fits(n) {
+			break
+		}
+		size += n
+		numEDUs++
+	}
+	return
+}
+
+// drainIncoming moves everything waiting on the incoming channels onto the
+// pending queues without blocking.
+func (oq *destinationQueue) drainIncoming() {
+	for {
+		select {
+		case pdu := <-oq.incomingPDUs:
+			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+		case edu := <-oq.incomingEDUs:
+			oq.pendingEDUs = append(oq.pendingEDUs, edu)
+		case invite := <-oq.incomingInvites:
+			// Invites go onto the front of the queue as in backgroundSend.
+			oq.pendingInvites = append(
+				[]*gomatrixserverlib.InviteV2Request{invite},
+				oq.pendingInvites...,
+			)
+		default:
+			return
+		}
+	}
+}
+
+// queueIncomingUntil adds incoming events to the pending queues until the
+// timer fires, so that whoever is queuing events for the destination isn't
+// blocked while it is being backed off from, which would in turn hold up the
+// events for other destinations.
+func (oq *destinationQueue) queueIncomingUntil(timer <-chan time.Time) {
+	for {
+		select {
+		case <-timer:
+			return
+		case pdu := <-oq.incomingPDUs:
+			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+		case edu := <-oq.incomingEDUs:
+			oq.pendingEDUs = append(oq.pendingEDUs, edu)
+		case invite := <-oq.incomingInvites:
+			// Invites go onto the front of the queue as in backgroundSend.
+			oq.pendingInvites = append(
+				[]*gomatrixserverlib.InviteV2Request{invite},
+				oq.pendingInvites...,
+			)
+		}
+	}
+}
+
+// acquireSlot waits for one of the slots for sending to destinations to be
+// free, if they are limited, adding incoming events to the pending queues in
+// the meantime as in queueIncomingUntil.
+func (oq *destinationQueue) acquireSlot() {
+	if oq.slots == nil {
+		return
+	}
+	for {
+		select {
+		case oq.slots <- struct{}{}:
+			return
+		case pdu := <-oq.incomingPDUs:
+			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+		case edu := <-oq.incomingEDUs:
+			oq.pendingEDUs = append(oq.pendingEDUs, edu)
+		case invite := <-oq.incomingInvites:
+			oq.pendingInvites = append(
+				[]*gomatrixserverlib.InviteV2Request{invite},
+				oq.pendingInvites...,
+			)
+		}
+	}
+}
+
+// releaseSlot frees the slot taken by acquireSlot.
+func (oq *destinationQueue) releaseSlot() {
+	if oq.slots != nil {
+		<-oq.slots
+	}
+}
+
+// waitWhileAllPaused blocks while sending is paused for all destinations.
+// Incoming events are still added to the pending queues in the meantime, so
+// that they are sent once sending is resumed rather than blocking the callers.
+func (oq *destinationQueue) waitWhileAllPaused() {
+	for oq.allPaused != nil && oq.allPaused.Load() {
+		select {
+		case pdu := <-oq.incomingPDUs:
+			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+		case edu := <-oq.incomingEDUs:
+			oq.pendingEDUs = append(oq.pendingEDUs, edu)
+		case invite := <-oq.incomingInvites:
+			// Invites go onto the front of the queue as in backgroundSend.
+			oq.pendingInvites = append(
+				[]*gomatrixserverlib.InviteV2Request{invite},
+				oq.pendingInvites...,
+			)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// throttle waits for as long as it should take to send the given number of
+// events to the destination at its rate limit, if it has one. The limit set
+// for the destination in the database takes precedence over the default.
+// Incoming events are added to the pending queues in the meantime, as when
+// backing off, so that a slow destination doesn't block whoever is queuing.
+func (oq *destinationQueue) throttle(sentEvents int) {
+	if sentEvents == 0 {
+		return
+	}
+	eventsPerSec := oq.rateLimit
+	if oq.db != nil {
+		limit, ok, err := oq.db.DestinationRateLimit(context.TODO(), oq.destination)
+		if err != nil {
+			log.WithError(err).WithField("destination", oq.destination).Error("failed to get rate limit")
+		} else if ok {
+			eventsPerSec = limit
+		}
+	}
+	if eventsPerSec <= 0 {
+		return
+	}
+	oq.queueIncomingUntil(time.After(time.Duration(float64(sentEvents) / eventsPerSec * float64(time.Second))))
+}
+
+// recordSendAttempt records the outcome of an attempt to send to the
+// destination in the database, along with the events and EDUs that were
+// acknowledged by the destination if it succeeded. Failing to record them
+// isn't fatal, as they have been sent regardless.
+func (oq *destinationQueue) recordSendAttempt(
+	success bool, pdus []*gomatrixserverlib.HeaderedEvent, edus []*types.QueuedEDU,
+) {
+	if oq.db == nil {
+		return
+	}
+	eventIDs := make([]string, len(pdus))
+	for i, pdu := range pdus {
+		eventIDs[i] = pdu.EventID()
+	}
+	var eduNIDs []int64
+	for _, edu := range edus {
+		if edu.NID != 0 {
+			eduNIDs = append(eduNIDs, edu.NID)
+		}
+	}
+	if err := oq.db.RecordSendAttempt(context.TODO(), oq.destination, success, eventIDs, eduNIDs); err != nil {
+		log.WithError(err).WithField("destination", oq.destination).Error("failed to record send attempt")
 	}
 }
 
@@ -209,7 +522,7 @@ func (oq *destinationQueue) backgroundSend() {
 // false otherwise.
 func (oq *destinationQueue) nextTransaction(
 	pendingPDUs []*gomatrixserverlib.HeaderedEvent,
-	pendingEDUs []*gomatrixserverlib.EDU,
+	pendingEDUs []*types.QueuedEDU,
 	sentCounter uint32,
 ) (bool, error) {
 	t := gomatrixserverlib.Transaction{
@@ -235,7 +548,7 @@ func (oq *destinationQueue) nextTransaction(
 	}
 
 	for _, edu := range pendingEDUs {
-		t.EDUs = append(t.EDUs, *edu)
+		t.EDUs = append(t.EDUs, *edu.EDU)
 	}
 
 	logrus.WithField("server_name", oq.destination).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
@@ -275,61 +588,100 @@ func (oq *destinationQueue) nextInvites(
 	pendingInvites []*gomatrixserverlib.InviteV2Request,
 ) (int, error) {
 	done := 0
-	for _, inviteReq := range pendingInvites {
-		ev, roomVersion := inviteReq.Event(), inviteReq.RoomVersion()
+	for len(pendingInvites) > 0 {
+		// Send up to the in-flight limit for the destination at once.
+		batch := pendingInvites
+		if oq.maxInFlight > 0 && len(batch) > oq.maxInFlight {
+			batch = batch[:oq.maxInFlight]
+		}
+		pendingInvites = pendingInvites[len(batch):]
 
-		log.WithFields(log.Fields{
-			"event_id":     ev.EventID(),
-			"room_version": roomVersion,
-			"destination":  oq.destination,
-		}).Info("sending invite")
-
-		inviteRes, err := oq.client.SendInviteV2(
-			context.TODO(),
-			oq.destination,
-			*inviteReq,
-		)
-		switch e := err.(type) {
-		case nil:
-			done++
-		case gomatrix.HTTPError:
-			log.WithFields(log.Fields{
-				"event_id":    ev.EventID(),
-				"state_key":   ev.StateKey(),
-				"destination": oq.destination,
-				"status_code": e.Code,
-			}).WithError(err).Error("failed to send invite due to HTTP error")
-			// Check whether we should do something about the error or
-			// just accept it as unavoidable.
-			if e.Code >= 400 && e.Code <= 499 {
-				// We tried but the remote side has sent back a client error.
-				// It's no use retrying because it will happen again.
+		results := make([]struct {
+			done bool
+			err  error
+		}, len(batch))
+		var wg sync.WaitGroup
+		for i, inviteReq := range batch {
+			wg.Add(1)
+			go func(i int, inviteReq *gomatrixserverlib.InviteV2Request) {
+				defer wg.Done()
+				results[i].done, results[i].err = oq.sendInviteRequest(inviteReq)
+			}(i, inviteReq)
+		}
+		wg.Wait()
+
+		// Only count the invites up to the first failure as done, as the
+		// caller removes that many from the front of the queue. Any after
+		// it which did get sent will be sent again, which is harmless.
+		for _, result := range results {
+			if result.done {
 				done++
-				continue
 			}
-			return done, err
-		default:
-			log.WithFields(log.Fields{
-				"event_id":    ev.EventID(),
-				"state_key":   ev.StateKey(),
-				"destination": oq.destination,
-			}).WithError(err).Error("failed to send invite")
-			return done, err
+			if result.err != nil {
+				return done, result.err
+			}
 		}
+	}
 
-		if _, err = oq.rsProducer.SendInviteResponse(
-			context.TODO(),
-			inviteRes,
-			roomVersion,
-		); err != nil {
-			log.WithFields(log.Fields{
-				"event_id":    ev.EventID(),
-				"state_key":   ev.StateKey(),
-				"destination": oq.destination,
-			}).WithError(err).Error("failed to return signed invite to roomserver")
-			return done, err
+	return done, nil
+}
+
+// sendInviteRequest sends an invite to the destination and passes the signed
+// invite back to the roomserver. Returns true if the invite doesn't need to be
+// sent again, even if an error is also returned.
+func (oq *destinationQueue) sendInviteRequest(
+	inviteReq *gomatrixserverlib.InviteV2Request,
+) (bool, error) {
+	ev, roomVersion := inviteReq.Event(), inviteReq.RoomVersion()
+
+	log.WithFields(log.Fields{
+		"event_id":     ev.EventID(),
+		"room_version": roomVersion,
+		"destination":  oq.destination,
+	}).Info("sending invite")
+
+	inviteRes, err := oq.client.SendInviteV2(
+		context.TODO(),
+		oq.destination,
+		*inviteReq,
+	)
+	switch e := err.(type) {
+	case nil:
+	case gomatrix.HTTPError:
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"state_key":   ev.StateKey(),
+			"destination": oq.destination,
+			"status_code": e.Code,
+		}).WithError(err).Error("failed to send invite due to HTTP error")
+		// Check whether we should do something about the error or
+		// just accept it as unavoidable.
+		if e.Code >= 400 && e.Code <= 499 {
+			// We tried but the remote side has sent back a client error.
+			// It's no use retrying because it will happen again.
+			return true, nil
 		}
+		return false, err
+	default:
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"state_key":   ev.StateKey(),
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to send invite")
+		return false, err
 	}
 
-	return done, nil
+	if _, err = oq.rsProducer.SendInviteResponse(
+		context.TODO(),
+		inviteRes,
+		roomVersion,
+	); err != nil {
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"state_key":   ev.StateKey(),
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to return signed invite to roomserver")
+		return true, err
+	}
+	return true, nil
 }
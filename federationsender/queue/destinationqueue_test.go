@@ -0,0 +1,105 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPackTransactionLimits(t *testing.T) {
+	edus := []*types.QueuedEDU{
+		{EDU: &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"a":1}`)}},
+		{EDU: &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"b":2}`)}},
+		{EDU: &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"c":3}`)}},
+	}
+	size := len(edus[0].EDU.Type) + len(edus[0].EDU.Content)
+
+	tests := []struct {
+		limits types.TransactionLimits
+		want   int
+	}{
+		{types.TransactionLimits{}, 3},
+		{types.TransactionLimits{MaxEDUs: 2}, 2},
+		{types.TransactionLimits{MaxBytes: size*2 + 1}, 2},
+		{types.TransactionLimits{MaxBytes: 1}, 1},
+	}
+	for _, test := range tests {
+		numPDUs, numEDUs := packTransaction(nil, edus, test.limits)
+		if numPDUs != 0 || numEDUs != test.want {
+			t.Errorf("limits %+v: wanted 0 PDUs and %d EDUs, got %d and %d", test.limits, test.want, numPDUs, numEDUs)
+		}
+	}
+}
+
+func TestDropExpiredEDUs(t *testing.T) {
+	old := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+	oq := &destinationQueue{
+		pendingEDUs: []*types.QueuedEDU{
+			{QueuedTS: old, EDU: &gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping}},
+			{QueuedTS: old, EDU: &gomatrixserverlib.EDU{Type: "m.receipt"}},
+			{QueuedTS: gomatrixserverlib.AsTimestamp(time.Now()), EDU: &gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping}},
+		},
+	}
+	oq.dropExpiredEDUs()
+	if len(oq.pendingEDUs) != 2 {
+		t.Fatalf("wanted 2 EDUs left, got %d", len(oq.pendingEDUs))
+	}
+	if oq.pendingEDUs[0].EDU.Type != "m.receipt" || oq.pendingEDUs[1].EDU.Type != gomatrixserverlib.MTyping {
+		t.Errorf("wrong EDUs left: %q and %q", oq.pendingEDUs[0].EDU.Type, oq.pendingEDUs[1].EDU.Type)
+	}
+}
+
+func TestDrainIncoming(t *testing.T) {
+	oq := &destinationQueue{
+		incomingPDUs:    make(chan *gomatrixserverlib.HeaderedEvent, 4),
+		incomingEDUs:    make(chan *types.QueuedEDU, 4),
+		incomingInvites: make(chan *gomatrixserverlib.InviteV2Request, 4),
+	}
+	for i := 0; i < 3; i++ {
+		oq.incomingEDUs <- &types.QueuedEDU{EDU: &gomatrixserverlib.EDU{Type: "m.receipt"}}
+	}
+	oq.drainIncoming()
+	if len(oq.pendingEDUs) != 3 {
+		t.Errorf("wanted 3 pending EDUs, got %d", len(oq.pendingEDUs))
+	}
+}
+
+func TestAcquireSlotQueuesIncoming(t *testing.T) {
+	oq := &destinationQueue{
+		slots:           make(chan struct{}, 1),
+		incomingPDUs:    make(chan *gomatrixserverlib.HeaderedEvent),
+		incomingEDUs:    make(chan *types.QueuedEDU),
+		incomingInvites: make(chan *gomatrixserverlib.InviteV2Request),
+	}
+	// Another destination holds the only slot until it has seen an EDU
+	// queued for this destination, which mustn't block.
+	oq.slots <- struct{}{}
+	go func() {
+		oq.incomingEDUs <- &types.QueuedEDU{EDU: &gomatrixserverlib.EDU{Type: "m.receipt"}}
+		<-oq.slots
+	}()
+	oq.acquireSlot()
+	if len(oq.pendingEDUs) != 1 {
+		t.Errorf("wanted 1 pending EDU, got %d", len(oq.pendingEDUs))
+	}
+	oq.releaseSlot()
+	if len(oq.slots) != 0 {
+		t.Errorf("wanted the slot to be released")
+	}
+}
@@ -15,40 +15,176 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
+	db          storage.Database
 	rsProducer  *producers.RoomserverProducer
 	origin      gomatrixserverlib.ServerName
 	client      *gomatrixserverlib.FederationClient
 	statistics  *types.Statistics
-	queuesMutex sync.Mutex // protects the below
+	rateLimit   float64                 // default events per second to each destination
+	txnLimits   types.TransactionLimits // default limits on each transaction
+	slots       chan struct{}           // limits the destinations sent to at once, nil for no limit
+	maxInFlight int                     // most requests to send to each destination at once
+	allPaused   atomic.Bool             // is sending paused for all destinations?
+	queuesMutex sync.Mutex              // protects the below
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
+	pausedMutex sync.Mutex      // protects the below
+	pausedRooms map[string]bool // rooms for which sending is paused
+	heldRooms   map[string]bool // rooms which have events being held back
+	joinedMutex sync.Mutex      // protects the below
+	// joins (true) and leaves (false) of servers reported through
+	// JoinedHostsChanged which the database may not have caught up with yet
+	joinedHosts map[string]map[gomatrixserverlib.ServerName]bool
 }
 
-// NewOutgoingQueues makes a new OutgoingQueues
+// pausedRoomsPollInterval is how often the rooms for which sending is paused
+// are refreshed from the database, and the rooms which have events being held
+// back are checked to see if sending has been resumed.
+const pausedRoomsPollInterval = time.Second * 10
+
+// globalSendPausedPollInterval is how often the database is checked to see
+// whether sending has been paused or resumed for all destinations.
+const globalSendPausedPollInterval = time.Second * 10
+
+// NewOutgoingQueues makes a new OutgoingQueues. If a database is given then
+// the throughput of each queue is recorded to it once a minute. The rate limit
+// is the default maximum number of events per second to send to each
+// destination, or 0 for no limit, and the transaction limits are the default
+// limits on the size of each transaction sent to a destination. At most
+// maxConcurrentDestinations destinations are sent to at once, or any number
+// if 0, and at most maxInFlight requests are sent to each at once.
 func NewOutgoingQueues(
+	db storage.Database,
 	origin gomatrixserverlib.ServerName,
 	client *gomatrixserverlib.FederationClient,
 	rsProducer *producers.RoomserverProducer,
 	statistics *types.Statistics,
+	rateLimit float64,
+	txnLimits types.TransactionLimits,
+	maxConcurrentDestinations, maxInFlight int,
 ) *OutgoingQueues {
-	return &OutgoingQueues{
-		rsProducer: rsProducer,
-		origin:     origin,
-		client:     client,
-		statistics: statistics,
-		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
+	oqs := &OutgoingQueues{
+		db:          db,
+		rsProducer:  rsProducer,
+		origin:      origin,
+		client:      client,
+		statistics:  statistics,
+		rateLimit:   rateLimit,
+		txnLimits:   txnLimits,
+		maxInFlight: maxInFlight,
+		queues:      map[gomatrixserverlib.ServerName]*destinationQueue{},
+		pausedRooms: map[string]bool{},
+		heldRooms:   map[string]bool{},
+		joinedHosts: map[string]map[gomatrixserverlib.ServerName]bool{},
+	}
+	if maxConcurrentDestinations > 0 {
+		oqs.slots = make(chan struct{}, maxConcurrentDestinations)
+	}
+	if db != nil {
+		oqs.restorePending()
+		oqs.restoreHeld()
+		go oqs.recordThroughput()
+		go oqs.updateMetrics()
+		go oqs.resumePausedRooms()
+		go oqs.pollGlobalSendPaused()
+	}
+	return oqs
+}
+
+// restorePending loads the events and EDUs which were still pending for each
+// destination when the server last stopped, and starts sending them. This has
+// to happen before anything new is queued so that they are sent in order.
+func (oqs *OutgoingQueues) restorePending() {
+	ctx := context.Background()
+	destinations, err := oqs.db.PendingDestinations(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to get destinations with pending events")
+		return
+	}
+	for _, destination := range destinations {
+		pdus, err := oqs.db.PendingPDUs(ctx, destination)
+		if err != nil {
+			log.WithError(err).WithField("server_name", destination).Error("Failed to get pending events")
+			continue
+		}
+		edus, err := oqs.db.PendingEDUs(ctx, destination)
+		if err != nil {
+			log.WithError(err).WithField("server_name", destination).Error("Failed to get pending EDUs")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"server_name": destination, "pdus": len(pdus), "edus": len(edus),
+		}).Info("Restoring pending events for destination")
+		oq := oqs.getQueue(destination)
+		oq.pendingPDUs = pdus
+		oq.pendingEDUs = edus
+		go oq.backgroundSend()
+	}
+}
+
+// recordThroughput periodically writes the number of events queued for and
+// sent to each destination since the last run to the database, so that the
+// growth rate of each queue can be queried with QueueThroughput.
+func (oqs *OutgoingQueues) recordThroughput() {
+	for range time.Tick(time.Minute) {
+		oqs.queuesMutex.Lock()
+		queues := make([]*destinationQueue, 0, len(oqs.queues))
+		for _, oq := range oqs.queues {
+			queues = append(queues, oq)
+		}
+		oqs.queuesMutex.Unlock()
+
+		for _, oq := range queues {
+			enqueued, dequeued := oq.enqueued.Swap(0), oq.dequeued.Swap(0)
+			if enqueued == 0 && dequeued == 0 {
+				continue
+			}
+			err := oqs.db.RecordQueueThroughput(context.Background(), oq.destination, enqueued, dequeued)
+			if err != nil {
+				log.WithError(err).WithField("server_name", oq.destination).Error("Failed to record queue throughput")
+				// Put the counts back so that they are retried next time.
+				oq.enqueued.Add(enqueued)
+				oq.dequeued.Add(dequeued)
+			}
+		}
+	}
+}
+
+// pollGlobalSendPaused periodically checks whether sending has been paused or
+// resumed for all destinations, so that the destination queues don't have to
+// check the database before every transaction.
+func (oqs *OutgoingQueues) pollGlobalSendPaused() {
+	for {
+		oqs.refreshGlobalSendPaused()
+		time.Sleep(globalSendPausedPollInterval)
+	}
+}
+
+// refreshGlobalSendPaused updates whether sending is paused for all
+// destinations from the database.
+func (oqs *OutgoingQueues) refreshGlobalSendPaused() {
+	paused, err := oqs.db.IsGlobalSendPaused(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to check if sending is paused for all destinations")
+	} else if oqs.allPaused.Swap(paused) != paused {
+		log.WithField("paused", paused).Info("Sending to all destinations has been paused or resumed")
 	}
 }
 
@@ -58,13 +194,19 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 	oq := oqs.queues[destination]
 	if oq == nil {
 		oq = &destinationQueue{
+			db:              oqs.db,
 			rsProducer:      oqs.rsProducer,
 			origin:          oqs.origin,
 			destination:     destination,
 			client:          oqs.client,
 			statistics:      oqs.statistics.ForServer(destination),
+			allPaused:       &oqs.allPaused,
+			rateLimit:       oqs.rateLimit,
+			txnLimits:       oqs.txnLimits,
+			slots:           oqs.slots,
+			maxInFlight:     oqs.maxInFlight,
 			incomingPDUs:    make(chan *gomatrixserverlib.HeaderedEvent, 128),
-			incomingEDUs:    make(chan *gomatrixserverlib.EDU, 128),
+			incomingEDUs:    make(chan *types.QueuedEDU, 128),
 			incomingInvites: make(chan *gomatrixserverlib.InviteV2Request, 128),
 		}
 		oqs.queues[destination] = oq
@@ -88,15 +230,163 @@ func (oqs *OutgoingQueues) SendEvent(
 	// Remove our own server from the list of destinations.
 	destinations = filterAndDedupeDests(oqs.origin, destinations)
 
+	// If sending is paused for the room then hold on to the event until it
+	// is resumed.
+	if oqs.holdIfPaused(ev, destinations) {
+		log.WithFields(log.Fields{
+			"destinations": destinations, "event": ev.EventID(),
+		}).Info("Holding event as sending is paused for room")
+		return nil
+	}
+
 	log.WithFields(log.Fields{
 		"destinations": destinations, "event": ev.EventID(),
 	}).Info("Sending event")
 
+	oqs.sendEventToDestinations(ev, destinations)
+	return nil
+}
+
+func (oqs *OutgoingQueues) sendEventToDestinations(
+	ev *gomatrixserverlib.HeaderedEvent, destinations []gomatrixserverlib.ServerName,
+) {
+	var queues []*destinationQueue
+	var pending []gomatrixserverlib.ServerName
 	for _, destination := range destinations {
-		oqs.getQueue(destination).sendEvent(ev)
+		oq := oqs.getQueue(destination)
+		queues = append(queues, oq)
+		if !oq.statistics.Blacklisted() {
+			pending = append(pending, destination)
+		}
+	}
+	if oqs.db != nil && len(pending) > 0 {
+		// Record which destinations the event is pending for, so that it is
+		// still sent if we restart. Failing to do so isn't fatal, as the
+		// queues themselves are held in memory.
+		if err := oqs.db.AssociatePDUWithDestinations(context.TODO(), ev, pending); err != nil {
+			log.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to record pending destinations for event")
+		}
 	}
+	for _, oq := range queues {
+		oq.sendEvent(ev)
+	}
+}
 
-	return nil
+// holdIfPaused holds on to the event and returns true if sending is paused for
+// its room, or if earlier events in the room are still being held, so that
+// the events are sent in order once sending is resumed. Held events are
+// stored in the database so that they aren't lost if the server restarts.
+func (oqs *OutgoingQueues) holdIfPaused(
+	ev *gomatrixserverlib.HeaderedEvent, destinations []gomatrixserverlib.ServerName,
+) bool {
+	if oqs.db == nil {
+		return false
+	}
+	roomID := ev.RoomID()
+	// The event is stored while the lock is held so that releaseHeld can't
+	// miss it. This only happens for rooms which are paused.
+	oqs.pausedMutex.Lock()
+	defer oqs.pausedMutex.Unlock()
+	if !oqs.pausedRooms[roomID] && !oqs.heldRooms[roomID] {
+		return false
+	}
+	if err := oqs.db.HoldPDUWithDestinations(context.TODO(), ev, destinations); err != nil {
+		// Rather send the event than lose it.
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to hold event for paused room")
+		return false
+	}
+	oqs.heldRooms[roomID] = true
+	return true
+}
+
+// restoreHeld loads the rooms for which sending is paused, and the rooms which
+// still had events being held back when the server last stopped, so that new
+// events in those rooms are held behind them.
+func (oqs *OutgoingQueues) restoreHeld() {
+	roomIDs, err := oqs.db.HeldRooms(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to get rooms with held events")
+	}
+	oqs.pausedMutex.Lock()
+	for _, roomID := range roomIDs {
+		oqs.heldRooms[roomID] = true
+	}
+	oqs.pausedMutex.Unlock()
+	oqs.refreshPausedRooms()
+}
+
+// refreshPausedRooms updates the cached set of rooms for which sending is
+// paused from the database, so that it doesn't have to be checked for every
+// event. It returns the rooms which have events being held back but are no
+// longer paused.
+func (oqs *OutgoingQueues) refreshPausedRooms() (resumed []string) {
+	roomIDs, err := oqs.db.PausedRooms(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to get rooms for which sending is paused")
+		return nil
+	}
+	paused := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		paused[roomID] = true
+	}
+	oqs.pausedMutex.Lock()
+	defer oqs.pausedMutex.Unlock()
+	oqs.pausedRooms = paused
+	for roomID := range oqs.heldRooms {
+		if !paused[roomID] {
+			resumed = append(resumed, roomID)
+		}
+	}
+	return resumed
+}
+
+// resumePausedRooms periodically refreshes the rooms for which sending is
+// paused, and sends the events held back for the rooms which have been
+// resumed.
+func (oqs *OutgoingQueues) resumePausedRooms() {
+	for range time.Tick(pausedRoomsPollInterval) {
+		for _, roomID := range oqs.refreshPausedRooms() {
+			oqs.releaseHeld(roomID)
+		}
+	}
+}
+
+// releaseHeld sends the events held back for a room in the order they were
+// held. Until there are none left, new events in the room are held behind
+// them. The lock is only held while reading the held events from the
+// database, and not while sending them.
+func (oqs *OutgoingQueues) releaseHeld(roomID string) {
+	for {
+		oqs.pausedMutex.Lock()
+		if oqs.pausedRooms[roomID] {
+			// Sending has been paused again.
+			oqs.pausedMutex.Unlock()
+			return
+		}
+		held, err := oqs.db.ReleaseHeldPDUs(context.Background(), roomID)
+		if err == nil && len(held) == 0 {
+			delete(oqs.heldRooms, roomID)
+		}
+		oqs.pausedMutex.Unlock()
+		if err != nil {
+			// The events are still held, so this is tried again next time.
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to release held events for room")
+			return
+		}
+		if len(held) == 0 {
+			return
+		}
+		log.WithFields(log.Fields{
+			"room_id": roomID, "events": len(held),
+		}).Info("Sending is resumed for room, sending held events")
+		// The events are already pending for their destinations in the
+		// database, so they only need adding to the queues.
+		for _, h := range held {
+			for _, destination := range h.Destinations {
+				oqs.getQueue(destination).sendEvent(h.Event)
+			}
+		}
+	}
 }
 
 // SendEvent sends an event to the destinations
@@ -153,13 +443,158 @@ func (oqs *OutgoingQueues) SendEDU(
 		}).Info("Sending EDU event")
 	}
 
+	var queues []*destinationQueue
+	var pending []gomatrixserverlib.ServerName
 	for _, destination := range destinations {
-		oqs.getQueue(destination).sendEDU(e)
+		oq := oqs.getQueue(destination)
+		queues = append(queues, oq)
+		if !oq.statistics.Blacklisted() {
+			pending = append(pending, destination)
+		}
+	}
+	var queued map[gomatrixserverlib.ServerName]*types.QueuedEDU
+	if oqs.db != nil && len(pending) > 0 {
+		// As with events, record which destinations the EDU is pending for
+		// so that it is still sent if we restart.
+		var err error
+		if queued, err = oqs.db.AssociateEDUWithDestinations(context.TODO(), e, pending); err != nil {
+			log.WithError(err).WithField("edu_type", e.Type).Error("Failed to record pending destinations for EDU")
+		}
+	}
+	queuedTS := gomatrixserverlib.AsTimestamp(time.Now())
+	for _, oq := range queues {
+		q, ok := queued[oq.destination]
+		if !ok {
+			q = &types.QueuedEDU{QueuedTS: queuedTS, EDU: e}
+		}
+		oq.sendEDU(q)
 	}
 
 	return nil
 }
 
+// JoinedHostsChanged is called by the roomserver when running in the same
+// process whenever servers join or leave a room. The changes are remembered
+// so that JoinedHosts can apply them before the database catches up. A server
+// that has just joined a room is evidently alive, so any backoff or
+// blacklisting for it is cleared to avoid holding up the events that are
+// about to be sent to it.
+func (oqs *OutgoingQueues) JoinedHostsChanged(
+	roomID string, joined, left []gomatrixserverlib.ServerName,
+) {
+	oqs.joinedMutex.Lock()
+	changes := oqs.joinedHosts[roomID]
+	if changes == nil {
+		changes = map[gomatrixserverlib.ServerName]bool{}
+		oqs.joinedHosts[roomID] = changes
+	}
+	for _, destination := range joined {
+		changes[destination] = true
+	}
+	for _, destination := range left {
+		changes[destination] = false
+	}
+	oqs.joinedMutex.Unlock()
+
+	for _, destination := range joined {
+		if destination == oqs.origin {
+			continue
+		}
+		stats := oqs.statistics.ForServer(destination)
+		if backoff, _ := stats.BackoffDuration(); backoff || stats.Blacklisted() {
+			log.WithFields(log.Fields{
+				"room_id":     roomID,
+				"server_name": destination,
+			}).Info("Clearing backoff for server which joined room")
+			stats.ClearBackoff()
+		}
+	}
+}
+
+// JoinedHosts returns the servers joined to the room, given the joined hosts
+// from the database, with the joins and leaves reported by JoinedHostsChanged
+// which the database hasn't caught up with yet applied to them. The changes
+// which the database has caught up with are forgotten.
+func (oqs *OutgoingQueues) JoinedHosts(
+	roomID string, hosts []gomatrixserverlib.ServerName,
+) []gomatrixserverlib.ServerName {
+	oqs.joinedMutex.Lock()
+	defer oqs.joinedMutex.Unlock()
+	changes := oqs.joinedHosts[roomID]
+	if len(changes) == 0 {
+		return hosts
+	}
+	inDatabase := make(map[gomatrixserverlib.ServerName]bool, len(hosts))
+	var result []gomatrixserverlib.ServerName
+	for _, host := range hosts {
+		inDatabase[host] = true
+		if joined, ok := changes[host]; !ok || joined {
+			result = append(result, host)
+		}
+	}
+	for host, joined := range changes {
+		if joined == inDatabase[host] {
+			delete(changes, host)
+		} else if joined {
+			result = append(result, host)
+		}
+	}
+	if len(changes) == 0 {
+		delete(oqs.joinedHosts, roomID)
+	}
+	return result
+}
+
+// ServerAlive is called when a destination is known to be reachable, e.g.
+// because it has sent us a transaction. Any backoff for it is cleared, and if
+// it was blacklisted then it is caught up with the latest event in each room
+// it is joined to, rather than the events that were dropped while it was down.
+// The remote server can then fetch whatever it is missing itself.
+func (oqs *OutgoingQueues) ServerAlive(destination gomatrixserverlib.ServerName) {
+	if destination == oqs.origin {
+		return
+	}
+	stats := oqs.statistics.ForServer(destination)
+	blacklisted := stats.Blacklisted()
+	if backoff, _ := stats.BackoffDuration(); !backoff && !blacklisted {
+		return
+	}
+	log.WithField("server_name", destination).Info("Clearing backoff for server which is reachable")
+	stats.ClearBackoff()
+	if blacklisted && oqs.db != nil {
+		go oqs.catchUp(destination)
+	}
+}
+
+// catchUp sends the latest event in each room that the destination is joined
+// to, so that it can find out about everything it missed while it was down.
+func (oqs *OutgoingQueues) catchUp(destination gomatrixserverlib.ServerName) {
+	ctx := context.Background()
+	logger := log.WithField("server_name", destination)
+	eventIDs, err := oqs.db.LatestEventIDsForDestination(ctx, destination)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get latest events to catch up destination")
+		return
+	}
+	if len(eventIDs) == 0 {
+		return
+	}
+	req := api.QueryEventsByIDRequest{EventIDs: eventIDs}
+	res := api.QueryEventsByIDResponse{}
+	if err = oqs.rsProducer.InputAPI.QueryEventsByID(ctx, &req, &res); err != nil {
+		logger.WithError(err).Error("Failed to query latest events to catch up destination")
+		return
+	}
+	logger.WithField("events", len(res.Events)).Info("Catching up destination with latest events")
+	destinations := []gomatrixserverlib.ServerName{destination}
+	for i := range res.Events {
+		ev := &res.Events[i]
+		if !oqs.holdIfPaused(ev, destinations) {
+			oqs.sendEventToDestinations(ev, destinations)
+		}
+	}
+}
+
 // filterAndDedupeDests removes our own server from the list of destinations
 // and deduplicates any servers in the list that may appear more than once.
 func filterAndDedupeDests(origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName) (
@@ -0,0 +1,450 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testDestination = gomatrixserverlib.ServerName("pale.court")
+	testRoomID      = fmt.Sprintf("!hallownest:%s", testOrigin)
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+func mustCreateEvent(t *testing.T, body string) *gomatrixserverlib.HeaderedEvent {
+	return mustCreateRoomEvent(t, testRoomID, body)
+}
+
+func mustCreateRoomEvent(t *testing.T, roomID, body string) *gomatrixserverlib.HeaderedEvent {
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:  roomID,
+		Sender:  fmt.Sprintf("@hornet:%s", testOrigin),
+		Type:    "m.room.message",
+		Content: []byte(fmt.Sprintf(`{"body":%q,"msgtype":"m.text"}`, body)),
+		Depth:   1,
+	}
+	e, err := b.Build(time.Now(), testOrigin, "ed25519:queue_test", testPrivateKey, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	h := e.Headered(testRoomVersion)
+	return &h
+}
+
+// newTestQueues makes queues which record the events sent to the destination
+// rather than sending them, without starting any background goroutines.
+func newTestQueues(db storage.Database) *OutgoingQueues {
+	oqs := &OutgoingQueues{
+		db:          db,
+		origin:      testOrigin,
+		statistics:  &types.Statistics{},
+		queues:      map[gomatrixserverlib.ServerName]*destinationQueue{},
+		pausedRooms: map[string]bool{},
+		heldRooms:   map[string]bool{},
+		joinedHosts: map[string]map[gomatrixserverlib.ServerName]bool{},
+	}
+	oq := oqs.getQueue(testDestination)
+	oq.running.Store(true)
+	return oqs
+}
+
+// sentEvents returns the IDs of the events added to the queue for the
+// destination since it was last called.
+func sentEvents(oqs *OutgoingQueues) (eventIDs []string) {
+	oq := oqs.getQueue(testDestination)
+	for {
+		select {
+		case ev := <-oq.incomingPDUs:
+			eventIDs = append(eventIDs, ev.EventID())
+		default:
+			return
+		}
+	}
+}
+
+func TestHoldEventsForPausedRoom(t *testing.T) {
+	ctx := context.Background()
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	defer closeDB()
+	db, err := storage.NewDatabase(dataSource, nil, nil)
+	if err != nil {
+		t.Fatalf("storage.NewDatabase returned %s", err)
+	}
+	if err = db.SetRoomSendPaused(ctx, testRoomID, true); err != nil {
+		t.Fatalf("SetRoomSendPaused returned %s", err)
+	}
+	destinations := []gomatrixserverlib.ServerName{testDestination}
+
+	oqs := newTestQueues(db)
+	oqs.restoreHeld()
+	first := mustCreateEvent(t, "first")
+	if err = oqs.SendEvent(first, testOrigin, destinations); err != nil {
+		t.Fatalf("SendEvent returned %s", err)
+	}
+	if sent := sentEvents(oqs); len(sent) != 0 {
+		t.Fatalf("expected the event to be held, but %v were sent", sent)
+	}
+
+	// After a restart the held event is still held, and sending is resumed
+	// while there are still events held for the room.
+	oqs = newTestQueues(db)
+	oqs.restoreHeld()
+	if err = db.SetRoomSendPaused(ctx, testRoomID, false); err != nil {
+		t.Fatalf("SetRoomSendPaused returned %s", err)
+	}
+	resumed := oqs.refreshPausedRooms()
+	if len(resumed) != 1 || resumed[0] != testRoomID {
+		t.Fatalf("expected %s to be resumed, got %v", testRoomID, resumed)
+	}
+
+	// A new event is held behind the earlier one until it has been sent.
+	second := mustCreateEvent(t, "second")
+	if err = oqs.SendEvent(second, testOrigin, destinations); err != nil {
+		t.Fatalf("SendEvent returned %s", err)
+	}
+	if sent := sentEvents(oqs); len(sent) != 0 {
+		t.Fatalf("expected the event to be held behind the earlier one, but %v were sent", sent)
+	}
+	oqs.releaseHeld(testRoomID)
+	sent := sentEvents(oqs)
+	if len(sent) != 2 || sent[0] != first.EventID() || sent[1] != second.EventID() {
+		t.Fatalf("expected the held events to be sent in order, got %v", sent)
+	}
+	pending, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(pending) != 2 {
+		t.Errorf("expected the released events to be pending, got %d", len(pending))
+	}
+
+	// Once everything held has been sent, new events are sent straight away.
+	third := mustCreateEvent(t, "third")
+	if err = oqs.SendEvent(third, testOrigin, destinations); err != nil {
+		t.Fatalf("SendEvent returned %s", err)
+	}
+	if sent = sentEvents(oqs); len(sent) != 1 || sent[0] != third.EventID() {
+		t.Errorf("expected the new event to be sent, got %v", sent)
+	}
+}
+
+func TestJoinedHostsChanged(t *testing.T) {
+	oqs := newTestQueues(nil)
+	const roomID = "!room:localhost"
+	stats := oqs.statistics.ForServer("joined.example")
+	stats.Failure()
+
+	oqs.JoinedHostsChanged(roomID, []gomatrixserverlib.ServerName{"joined.example"}, nil)
+	if backoff, _ := stats.BackoffDuration(); backoff {
+		t.Errorf("expected the backoff to be cleared for the server which joined")
+	}
+	oqs.JoinedHostsChanged(roomID, nil, []gomatrixserverlib.ServerName{"left.example"})
+
+	// The database hasn't caught up with either change yet.
+	got := oqs.JoinedHosts(roomID, []gomatrixserverlib.ServerName{"left.example", "other.example"})
+	if want := "[other.example joined.example]"; fmt.Sprint(got) != want {
+		t.Errorf("expected joined hosts %s, got %v", want, got)
+	}
+	// Other rooms aren't affected.
+	got = oqs.JoinedHosts("!other:localhost", []gomatrixserverlib.ServerName{"left.example"})
+	if want := "[left.example]"; fmt.Sprint(got) != want {
+		t.Errorf("expected joined hosts %s, got %v", want, got)
+	}
+
+	// Once the database has caught up the changes are forgotten.
+	got = oqs.JoinedHosts(roomID, []gomatrixserverlib.ServerName{"joined.example", "other.example"})
+	if want := "[joined.example other.example]"; fmt.Sprint(got) != want {
+		t.Errorf("expected joined hosts %s, got %v", want, got)
+	}
+	if len(oqs.joinedHosts) != 0 {
+		t.Errorf("expected the changes to be forgotten, got %v", oqs.joinedHosts)
+	}
+
+	// A server which rejoins after leaving is joined again.
+	oqs.JoinedHostsChanged(roomID, nil, []gomatrixserverlib.ServerName{"other.example"})
+	oqs.JoinedHostsChanged(roomID, []gomatrixserverlib.ServerName{"other.example"}, nil)
+	got = oqs.JoinedHosts(roomID, nil)
+	if want := "[other.example]"; fmt.Sprint(got) != want {
+		t.Errorf("expected joined hosts %s, got %v", want, got)
+	}
+}
+
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.NewDatabase(dataSource, nil, nil)
+	if err != nil {
+		closeDB()
+		t.Fatalf("storage.NewDatabase returned %s", err)
+	}
+	return db, closeDB
+}
+
+func TestRestorePending(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	destinations := []gomatrixserverlib.ServerName{testDestination}
+
+	// Queue some events and an EDU before a restart.
+	first, second := mustCreateEvent(t, "first"), mustCreateEvent(t, "second")
+	oqs := newTestQueues(db)
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{first, second} {
+		if err := oqs.SendEvent(ev, testOrigin, destinations); err != nil {
+			t.Fatalf("SendEvent returned %s", err)
+		}
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"user_id":"@hornet:hollow.knight"}`)}
+	if _, err := db.AssociateEDUWithDestinations(ctx, edu, destinations); err != nil {
+		t.Fatalf("AssociateEDUWithDestinations returned %s", err)
+	}
+
+	// After the restart they are pending again, in order, ahead of anything
+	// new that is queued.
+	oqs = newTestQueues(db)
+	oqs.restorePending()
+	third := mustCreateEvent(t, "third")
+	if err := oqs.SendEvent(third, testOrigin, destinations); err != nil {
+		t.Fatalf("SendEvent returned %s", err)
+	}
+	oq := oqs.getQueue(testDestination)
+	if len(oq.pendingPDUs) != 2 || oq.pendingPDUs[0].EventID() != first.EventID() || oq.pendingPDUs[1].EventID() != second.EventID() {
+		t.Errorf("expected the queued events to be restored in order, got %d events", len(oq.pendingPDUs))
+	}
+	if len(oq.pendingEDUs) != 1 || oq.pendingEDUs[0].EDU.Type != edu.Type {
+		t.Errorf("expected the queued EDU to be restored, got %+v", oq.pendingEDUs)
+	}
+	if sent := sentEvents(oqs); len(sent) != 1 || sent[0] != third.EventID() {
+		t.Errorf("expected the new event to be queued behind the restored ones, got %v", sent)
+	}
+}
+
+// fakeEventsAPI returns the events it holds from QueryEventsByID, in the
+// order it holds them.
+type fakeEventsAPI struct {
+	api.RoomserverInternalAPI
+	events []gomatrixserverlib.HeaderedEvent
+}
+
+func (a *fakeEventsAPI) QueryEventsByID(
+	ctx context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse,
+) error {
+	for _, ev := range a.events {
+		for _, eventID := range req.EventIDs {
+			if ev.EventID() == eventID {
+				res.Events = append(res.Events, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func TestCatchUp(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	pausedRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+
+	// The destination is joined to three rooms, and sending is paused for
+	// one of them.
+	latest := mustCreateEvent(t, "latest")
+	other := mustCreateRoomEvent(t, fmt.Sprintf("!greenpath:%s", testOrigin), "other")
+	paused := mustCreateRoomEvent(t, pausedRoomID, "paused")
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{latest, other, paused} {
+		host := types.JoinedHost{MemberEventID: ev.EventID() + "_member", ServerName: testDestination}
+		if _, err := db.UpdateRoom(ctx, ev.RoomID(), "", ev.EventID(), []types.JoinedHost{host}, nil); err != nil {
+			t.Fatalf("UpdateRoom returned %s", err)
+		}
+	}
+	if err := db.SetRoomSendPaused(ctx, pausedRoomID, true); err != nil {
+		t.Fatalf("SetRoomSendPaused returned %s", err)
+	}
+
+	oqs := newTestQueues(db)
+	oqs.restoreHeld()
+	oqs.rsProducer = &producers.RoomserverProducer{
+		InputAPI: &fakeEventsAPI{events: []gomatrixserverlib.HeaderedEvent{*other, *paused, *latest}},
+	}
+	oqs.catchUp(testDestination)
+
+	// The latest events in the rooms which aren't paused are sent in the order
+	// the roomserver returned them, and are recorded as pending in case of a
+	// restart.
+	sent := sentEvents(oqs)
+	if len(sent) != 2 || sent[0] != other.EventID() || sent[1] != latest.EventID() {
+		t.Errorf("expected the latest events to be sent in order, got %v", sent)
+	}
+	pending, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(pending) != 2 || pending[0].EventID() != other.EventID() || pending[1].EventID() != latest.EventID() {
+		t.Errorf("expected the latest events to be pending in order, got %d events", len(pending))
+	}
+	held, err := db.HeldRooms(ctx)
+	if err != nil {
+		t.Fatalf("HeldRooms returned %s", err)
+	}
+	if len(held) != 1 || held[0] != pausedRoomID {
+		t.Errorf("expected the event in the paused room to be held, got %v", held)
+	}
+
+	// Once sending is resumed the held event follows.
+	if err = db.SetRoomSendPaused(ctx, pausedRoomID, false); err != nil {
+		t.Fatalf("SetRoomSendPaused returned %s", err)
+	}
+	oqs.refreshPausedRooms()
+	oqs.releaseHeld(pausedRoomID)
+	if sent = sentEvents(oqs); len(sent) != 1 || sent[0] != paused.EventID() {
+		t.Errorf("expected the held event to be sent, got %v", sent)
+	}
+}
+
+func TestThrottleDoesNotBlockQueuing(t *testing.T) {
+	oqs := newTestQueues(nil)
+	oq := oqs.getQueue(testDestination)
+	oq.rateLimit = 2
+
+	// Queue more events than fit in the incoming channel while the
+	// destination is being throttled.
+	const count = 200
+	events := make([]*gomatrixserverlib.HeaderedEvent, count)
+	for i := range events {
+		events[i] = mustCreateEvent(t, fmt.Sprintf("event %d", i))
+	}
+	throttled := make(chan struct{})
+	go func() {
+		oq.throttle(1)
+		close(throttled)
+	}()
+	queued := make(chan struct{})
+	go func() {
+		for _, ev := range events {
+			oq.sendEvent(ev)
+		}
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+	case <-throttled:
+		t.Fatalf("queuing events blocked while the destination was throttled")
+	}
+	<-throttled
+	if got := len(oq.pendingPDUs) + len(oq.incomingPDUs); got != count {
+		t.Errorf("expected %d events to be pending, got %d", count, got)
+	}
+}
+
+func TestRecordSendAttempt(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	destinations := []gomatrixserverlib.ServerName{testDestination}
+
+	oqs := newTestQueues(db)
+	first, second := mustCreateEvent(t, "first"), mustCreateEvent(t, "second")
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{first, second} {
+		if err := oqs.SendEvent(ev, testOrigin, destinations); err != nil {
+			t.Fatalf("SendEvent returned %s", err)
+		}
+	}
+	if rate, err := db.DestinationSuccessRate(ctx, testDestination); err != nil || rate != 1 {
+		t.Errorf("expected a success rate of 1 before any attempts, got %v (err %v)", rate, err)
+	}
+
+	// One attempt failed and one succeeded in sending the first event.
+	oq := oqs.getQueue(testDestination)
+	oq.recordSendAttempt(false, nil, nil)
+	oq.recordSendAttempt(true, []*gomatrixserverlib.HeaderedEvent{first}, nil)
+	if rate, err := db.DestinationSuccessRate(ctx, testDestination); err != nil || rate != 0.5 {
+		t.Errorf("expected a success rate of 0.5, got %v (err %v)", rate, err)
+	}
+	pending, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(pending) != 1 || pending[0].EventID() != second.EventID() {
+		t.Errorf("expected only the second event to be pending, got %d events", len(pending))
+	}
+	if rate, err := db.DestinationSuccessRate(ctx, "white.palace"); err != nil || rate != 1 {
+		t.Errorf("expected other destinations to be unaffected, got %v (err %v)", rate, err)
+	}
+}
+
+func TestGlobalSendPause(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	if err := db.SetGlobalSendPaused(ctx, true); err != nil {
+		t.Fatalf("SetGlobalSendPaused returned %s", err)
+	}
+	oqs := newTestQueues(db)
+	oqs.refreshGlobalSendPaused()
+	oq := oqs.getQueue(testDestination)
+
+	// While sending is paused the queue waits, but events are still queued
+	// rather than blocking whoever is sending them.
+	done := make(chan struct{})
+	go func() {
+		oq.waitWhileAllPaused()
+		close(done)
+	}()
+	event := mustCreateEvent(t, "paused")
+	if err := oqs.SendEvent(event, testOrigin, []gomatrixserverlib.ServerName{testDestination}); err != nil {
+		t.Fatalf("SendEvent returned %s", err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("expected the queue to wait while sending is paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once sending is resumed the queue carries on with the queued event.
+	if err := db.SetGlobalSendPaused(ctx, false); err != nil {
+		t.Fatalf("SetGlobalSendPaused returned %s", err)
+	}
+	oqs.refreshGlobalSendPaused()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the queue to stop waiting once sending is resumed")
+	}
+	if len(oq.pendingPDUs) != 1 || oq.pendingPDUs[0].EventID() != event.EventID() {
+		t.Errorf("expected the event to be pending, got %d events", len(oq.pendingPDUs))
+	}
+}
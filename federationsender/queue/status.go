@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsDestinationsLimit is the maximum number of destinations with pending
+// events that metrics are exported for, so that the number of label values
+// stays bounded.
+const metricsDestinationsLimit = 100
+
+// metricsUpdateInterval is how often the metrics are updated.
+const metricsUpdateInterval = time.Minute
+
+// DestinationStatuses returns the status of the queues for up to limit of the
+// destinations with the most pending events, followed by any others which we
+// are backing off from or have blacklisted.
+func (oqs *OutgoingQueues) DestinationStatuses(
+	ctx context.Context, limit int,
+) ([]types.DestinationQueueStatus, error) {
+	var backlogs []types.DestinationBacklog
+	if oqs.db != nil {
+		var err error
+		if backlogs, err = oqs.db.DestinationsByBacklog(ctx, limit); err != nil {
+			return nil, err
+		}
+	}
+	servers := oqs.statistics.Servers()
+
+	statuses := make([]types.DestinationQueueStatus, 0, len(backlogs))
+	seen := make(map[gomatrixserverlib.ServerName]bool, len(backlogs))
+	for _, backlog := range backlogs {
+		status := types.DestinationQueueStatus{
+			ServerName:      backlog.ServerName,
+			PendingEvents:   backlog.PendingEvents,
+			OldestPendingTS: backlog.OldestQueuedTS,
+		}
+		if stats, ok := servers[backlog.ServerName]; ok {
+			addServerStatistics(&status, stats)
+		}
+		statuses = append(statuses, status)
+		seen[backlog.ServerName] = true
+	}
+
+	var unhealthy []types.DestinationQueueStatus
+	for serverName, stats := range servers {
+		if seen[serverName] {
+			continue
+		}
+		if _, backoff := stats.BackoffUntil(); !backoff && !stats.Blacklisted() {
+			continue
+		}
+		status := types.DestinationQueueStatus{ServerName: serverName}
+		addServerStatistics(&status, stats)
+		unhealthy = append(unhealthy, status)
+	}
+	sort.Slice(unhealthy, func(i, j int) bool {
+		return unhealthy[i].ServerName < unhealthy[j].ServerName
+	})
+	return append(statuses, unhealthy...), nil
+}
+
+// addServerStatistics fills in the parts of the status which come from the
+// in-memory statistics for the destination.
+func addServerStatistics(status *types.DestinationQueueStatus, stats *types.ServerStatistics) {
+	status.Blacklisted = stats.Blacklisted()
+	status.FailureCount = stats.FailureCount()
+	if until, ok := stats.BackoffUntil(); ok {
+		status.BackoffUntilTS = gomatrixserverlib.AsTimestamp(until)
+	}
+	if lastSuccess, ok := stats.LastSuccess(); ok {
+		status.LastSuccessTS = gomatrixserverlib.AsTimestamp(lastSuccess)
+	}
+}
+
+// updateMetrics periodically exports the status of the queues for the most
+// backed up destinations as Prometheus metrics.
+func (oqs *OutgoingQueues) updateMetrics() {
+	for range time.Tick(metricsUpdateInterval) {
+		statuses, err := oqs.DestinationStatuses(context.Background(), metricsDestinationsLimit)
+		if err != nil {
+			log.WithError(err).Error("Failed to get destination queue statuses for metrics")
+			continue
+		}
+		now := time.Now()
+		destinationPendingEvents.Reset()
+		destinationOldestPendingAge.Reset()
+		destinationBlacklisted.Reset()
+		destinationLastSuccess.Reset()
+		for _, status := range statuses {
+			destination := string(status.ServerName)
+			destinationPendingEvents.WithLabelValues(destination).Set(float64(status.PendingEvents))
+			if status.OldestPendingTS != 0 {
+				age := now.Sub(status.OldestPendingTS.Time()).Seconds()
+				destinationOldestPendingAge.WithLabelValues(destination).Set(age)
+			}
+			blacklisted := 0.0
+			if status.Blacklisted {
+				blacklisted = 1
+			}
+			destinationBlacklisted.WithLabelValues(destination).Set(blacklisted)
+			if status.LastSuccessTS != 0 {
+				lastSuccess := float64(status.LastSuccessTS.Time().Unix())
+				destinationLastSuccess.WithLabelValues(destination).Set(lastSuccess)
+			}
+		}
+	}
+}
+
+var destinationPendingEvents = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_pending_events",
+		Help:      "The number of events pending for each of the most backed up destinations",
+	},
+	[]string{"destination"},
+)
+
+var destinationOldestPendingAge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_oldest_pending_age_seconds",
+		Help:      "How long the oldest event pending for each destination has been queued",
+	},
+	[]string{"destination"},
+)
+
+var destinationBlacklisted = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_blacklisted",
+		Help:      "Whether sending to each destination has been given up on until it is reachable again",
+	},
+	[]string{"destination"},
+)
+
+var destinationLastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "destination_last_success_timestamp_seconds",
+		Help:      "When each destination was last sent to successfully",
+	},
+	[]string{"destination"},
+)
+
+func init() {
+	prometheus.MustRegister(
+		destinationPendingEvents, destinationOldestPendingAge,
+		destinationBlacklisted, destinationLastSuccess,
+	)
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption encrypts the content of the events and EDUs queued in the
+// federation sender database, for deployments which require data to be
+// encrypted at rest.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// KeySize is the size of each key in bytes, for AES-256.
+const KeySize = 32
+
+// A Cipher encrypts queued content with the current version of the key, and
+// decrypts it with whichever version of the key it was encrypted with. The
+// version is stored alongside the content, so that the key can be rotated
+// while content encrypted with older versions is still queued. Version 0
+// means that the content isn't encrypted.
+//
+// A nil *Cipher stores content without encrypting it, but can't read content
+// which was encrypted.
+type Cipher struct {
+	version int
+	aeads   map[int]cipher.AEAD
+}
+
+// NewCipher returns a Cipher which encrypts with the key of the given version
+// and can decrypt with any of the keys. Returns nil if the version is 0, in
+// which case content isn't encrypted.
+func NewCipher(version int, keys map[int][]byte) (*Cipher, error) {
+	if version == 0 {
+		if len(keys) == 0 {
+			return nil, nil
+		}
+	} else if _, ok := keys[version]; !ok {
+		return nil, fmt.Errorf("encryption: no key for version %d", version)
+	}
+	c := &Cipher{version: version, aeads: map[int]cipher.AEAD{}}
+	for v, key := range keys {
+		if v <= 0 {
+			return nil, fmt.Errorf("encryption: invalid key version %d, expected 1 or more", v)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("encryption: key version %d is %d bytes, expected %d", v, len(key), KeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if c.aeads[v], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Encrypt returns the content to store for the plaintext, along with the
+// version of the key it was encrypted with. Encrypted content is stored as
+// base64, so that it fits in the same text columns as unencrypted JSON.
+func (c *Cipher) Encrypt(plaintext []byte) (string, int, error) {
+	if c == nil || c.version == 0 {
+		return string(plaintext), 0, nil
+	}
+	aead := c.aeads[c.version]
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return "", 0, err
+	}
+	sealed = aead.Seal(sealed, sealed, plaintext, nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), c.version, nil
+}
+
+// Decrypt returns the plaintext of content which was stored with the given
+// version of the key.
+func (c *Cipher) Decrypt(content []byte, version int) ([]byte, error) {
+	if version == 0 {
+		return content, nil
+	}
+	var aead cipher.AEAD
+	if c != nil {
+		aead = c.aeads[version]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("encryption: no key for version %d", version)
+	}
+	sealed := make([]byte, base64.RawStdEncoding.DecodedLen(len(content)))
+	n, err := base64.RawStdEncoding.Decode(sealed, content)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[:n]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encryption: content is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	plaintext := []byte(`{"type":"m.room.message","content":{"body":"secret"}}`)
+
+	old, err := NewCipher(1, map[int][]byte{1: testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, version, err := old.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || strings.Contains(content, "secret") {
+		t.Fatalf("expected the content to be encrypted with version 1, got version %d: %s", version, content)
+	}
+
+	// After rotating the key, content encrypted with the old key can still be
+	// read, and new content is encrypted with the new key.
+	rotated, err := NewCipher(2, map[int][]byte{1: testKey(1), 2: testKey(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := rotated.Decrypt([]byte(content), version)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("expected to decrypt with the old key, got %q (%v)", decrypted, err)
+	}
+	if _, version, _ = rotated.Encrypt(plaintext); version != 2 {
+		t.Errorf("expected new content to be encrypted with version 2, got %d", version)
+	}
+
+	// Without the key, or with content which was tampered with, it can't be read.
+	if _, err = (*Cipher)(nil).Decrypt([]byte(content), version); err == nil {
+		t.Errorf("expected decrypting without a key to fail")
+	}
+	tampered := []byte(content)
+	tampered[len(tampered)-2] ^= 1
+	if _, err = rotated.Decrypt(tampered, version); err == nil {
+		t.Errorf("expected decrypting tampered content to fail")
+	}
+}
+
+func TestCipherPlaintext(t *testing.T) {
+	plaintext := []byte(`{"a":1}`)
+	for _, c := range []*Cipher{nil, mustNewCipher(t, 0, map[int][]byte{1: testKey(1)})} {
+		content, version, err := c.Encrypt(plaintext)
+		if err != nil || version != 0 || content != string(plaintext) {
+			t.Errorf("expected the content to be stored unencrypted, got %q, %d (%v)", content, version, err)
+		}
+		if decrypted, err := c.Decrypt([]byte(content), 0); err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("expected to read unencrypted content, got %q (%v)", decrypted, err)
+		}
+	}
+}
+
+func TestNewCipherErrors(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		keys    map[int][]byte
+	}{
+		{1, nil},
+		{1, map[int][]byte{2: testKey(2)}},
+		{1, map[int][]byte{1: testKey(1)[:16]}},
+		{1, map[int][]byte{1: testKey(1), 0: testKey(0)}},
+	} {
+		if _, err := NewCipher(tc.version, tc.keys); err == nil {
+			t.Errorf("NewCipher(%d, %v): expected an error", tc.version, tc.keys)
+		}
+	}
+}
+
+func mustNewCipher(t *testing.T, version int, keys map[int][]byte) *Cipher {
+	c, err := NewCipher(version, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -16,13 +16,91 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	common.PartitionStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	// DestinationsForRoom returns the distinct servers with users joined to a room.
+	DestinationsForRoom(ctx context.Context, roomID string) ([]gomatrixserverlib.ServerName, error)
+	// ReconcileJoinedHosts adds and removes joined hosts for a room without checking the last sent event.
+	ReconcileJoinedHosts(ctx context.Context, roomID string, addHosts []types.JoinedHost, removeHosts []string) error
+	// SetRoomTombstoned records that a room has been replaced by another room.
+	SetRoomTombstoned(ctx context.Context, roomID string) error
+	// IsRoomTombstoned returns whether a room has been replaced by another room.
+	IsRoomTombstoned(ctx context.Context, roomID string) (bool, error)
+	// SetRoomSendPaused pauses or resumes sending the events in a room over federation.
+	SetRoomSendPaused(ctx context.Context, roomID string, paused bool) error
+	// IsRoomSendPaused returns whether sending the events in a room over federation is paused.
+	IsRoomSendPaused(ctx context.Context, roomID string) (bool, error)
+	// PausedRooms returns the IDs of the rooms for which sending events over federation is paused.
+	PausedRooms(ctx context.Context) ([]string, error)
+	// PurgeRoom removes the joined hosts and all other state for a room.
+	PurgeRoom(ctx context.Context, roomID string) error
+	// SetGlobalSendPaused pauses or resumes sending events to all destinations over federation.
+	SetGlobalSendPaused(ctx context.Context, paused bool) error
+	// IsGlobalSendPaused returns whether sending events to all destinations over federation is paused.
+	IsGlobalSendPaused(ctx context.Context) (bool, error)
+	// SetDestinationRateLimit sets the maximum events per second to send to a destination, or
+	// removes the override if negative.
+	SetDestinationRateLimit(ctx context.Context, serverName gomatrixserverlib.ServerName, eventsPerSec float64) error
+	// DestinationRateLimit returns the maximum events per second to send to a destination, if set.
+	DestinationRateLimit(ctx context.Context, serverName gomatrixserverlib.ServerName) (eventsPerSec float64, ok bool, err error)
+	// SetDestinationTransactionLimits sets the limits on the size of the transactions sent
+	// to a destination, or removes the override if nil.
+	SetDestinationTransactionLimits(ctx context.Context, serverName gomatrixserverlib.ServerName, limits *types.TransactionLimits) error
+	// DestinationTransactionLimits returns the limits on the size of the transactions sent
+	// to a destination, if set.
+	DestinationTransactionLimits(ctx context.Context, serverName gomatrixserverlib.ServerName) (limits types.TransactionLimits, ok bool, err error)
+	// RecordQueueThroughput adds to the number of events queued for and sent to a destination.
+	RecordQueueThroughput(ctx context.Context, serverName gomatrixserverlib.ServerName, enqueued, dequeued int64) error
+	// QueueThroughput returns the average number of events queued for and sent to a
+	// destination per minute, so that a queue which is temporarily backed up but
+	// draining can be told apart from one which is falling behind.
+	QueueThroughput(ctx context.Context, serverName gomatrixserverlib.ServerName) (enqueuedPerMin, dequeuedPerMin float64, err error)
+	// RecordSentEvents records that events were sent to, and acknowledged by, a destination.
+	RecordSentEvents(ctx context.Context, serverName gomatrixserverlib.ServerName, eventIDs []string) error
+	// PruneSentEvents deletes up to maxRows records of sent events older than the
+	// cutoff, returning how many were deleted and whether there are none left.
+	PruneSentEvents(ctx context.Context, olderThan time.Time, maxRows int) (deleted int, done bool, err error)
+	// RecordSendAttempt counts a send attempt towards the success rate of a
+	// destination, recording the sent events if it succeeded. The sent events and EDUs
+	// are no longer pending for the destination.
+	RecordSendAttempt(ctx context.Context, serverName gomatrixserverlib.ServerName, success bool, sentEventIDs []string, sentEDUNIDs []int64) error
+	// DestinationSuccessRate returns the rolling success rate of send attempts to a destination.
+	DestinationSuccessRate(ctx context.Context, serverName gomatrixserverlib.ServerName) (float64, error)
+	// AssociatePDUWithDestinations records that an event has been queued for each of the destinations.
+	AssociatePDUWithDestinations(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, serverNames []gomatrixserverlib.ServerName) error
+	// HoldPDUWithDestinations records that an event is being held back for each of the
+	// destinations until sending is resumed for its room.
+	HoldPDUWithDestinations(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, serverNames []gomatrixserverlib.ServerName) error
+	// HeldRooms returns the IDs of the rooms which have events being held back.
+	HeldRooms(ctx context.Context) ([]string, error)
+	// ReleaseHeldPDUs returns the events being held back for a room, oldest first, and
+	// makes them pending for their destinations.
+	ReleaseHeldPDUs(ctx context.Context, roomID string) ([]types.HeldPDU, error)
+	// AssociateEDUWithDestinations records that an EDU has been queued for each of the destinations.
+	AssociateEDUWithDestinations(ctx context.Context, edu *gomatrixserverlib.EDU, serverNames []gomatrixserverlib.ServerName) (map[gomatrixserverlib.ServerName]*types.QueuedEDU, error)
+	// DeleteQueuedEDUs removes queued EDUs by their numeric IDs, e.g. because they have expired.
+	DeleteQueuedEDUs(ctx context.Context, eduNIDs []int64) error
+	// PendingDestinations returns the destinations with pending events or EDUs.
+	PendingDestinations(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	// PendingPDUs returns the events still pending for a destination, oldest first.
+	PendingPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]*gomatrixserverlib.HeaderedEvent, error)
+	// PendingEDUs returns the EDUs still pending for a destination, oldest first.
+	PendingEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]*types.QueuedEDU, error)
+	// DeletePendingForDestination removes all of the events and EDUs pending for a destination.
+	DeletePendingForDestination(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+	// LatestEventIDsForDestination returns the latest event ID in each room a destination is joined to.
+	LatestEventIDsForDestination(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error)
+	// DistinctPendingEvents returns the distinct IDs of events still pending for any destination, oldest first.
+	DistinctPendingEvents(ctx context.Context, limit int) ([]string, error)
+	// DestinationsByBacklog returns the destinations with pending events, most pending first.
+	DestinationsByBacklog(ctx context.Context, limit int) ([]types.DestinationBacklog, error)
 }
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const destinationAttemptsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_destination_attempts (
+    server_name VARCHAR(255) NOT NULL,
+    bucket_ts BIGINT NOT NULL,
+    attempts BIGINT NOT NULL DEFAULT 0,
+    successes BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (server_name, bucket_ts)
+);
+`
+
+const upsertDestinationAttemptSQL = "" +
+	"INSERT INTO federationsender_destination_attempts (server_name, bucket_ts, attempts, successes)" +
+	" VALUES ($1, $2, 1, $3)" +
+	" ON DUPLICATE KEY UPDATE" +
+	" attempts = federationsender_destination_attempts.attempts + 1," +
+	" successes = federationsender_destination_attempts.successes + VALUES(successes)"
+
+const selectDestinationAttemptsSQL = "" +
+	"SELECT COALESCE(SUM(attempts), 0), COALESCE(SUM(successes), 0)" +
+	" FROM federationsender_destination_attempts" +
+	" WHERE server_name = $1 AND bucket_ts >= $2"
+
+const deleteDestinationAttemptsBeforeSQL = "" +
+	"DELETE FROM federationsender_destination_attempts WHERE bucket_ts < $1"
+
+type destinationAttemptsStatements struct {
+	upsertDestinationAttemptStmt        *sql.Stmt
+	selectDestinationAttemptsStmt       *sql.Stmt
+	deleteDestinationAttemptsBeforeStmt *sql.Stmt
+}
+
+func (s *destinationAttemptsStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertDestinationAttemptStmt, err = db.Prepare(upsertDestinationAttemptSQL); err != nil {
+		return
+	}
+	if s.selectDestinationAttemptsStmt, err = db.Prepare(selectDestinationAttemptsSQL); err != nil {
+		return
+	}
+	if s.deleteDestinationAttemptsBeforeStmt, err = db.Prepare(deleteDestinationAttemptsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertDestinationAttempt counts a send attempt to the destination in the
+// bucket, creating the bucket if it doesn't exist.
+func (s *destinationAttemptsStatements) upsertDestinationAttempt(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	bucketTS gomatrixserverlib.Timestamp, success bool,
+) error {
+	successes := 0
+	if success {
+		successes = 1
+	}
+	stmt := common.TxStmt(txn, s.upsertDestinationAttemptStmt)
+	_, err := stmt.ExecContext(ctx, serverName, bucketTS, successes)
+	return err
+}
+
+// selectDestinationAttempts returns the total number of attempts and successes
+// for the destination in all buckets starting at or after the given timestamp.
+func (s *destinationAttemptsStatements) selectDestinationAttempts(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	sinceTS gomatrixserverlib.Timestamp,
+) (attempts, successes int64, err error) {
+	err = s.selectDestinationAttemptsStmt.QueryRowContext(
+		ctx, serverName, sinceTS,
+	).Scan(&attempts, &successes)
+	return
+}
+
+// deleteDestinationAttemptsBefore removes all buckets starting before the
+// given timestamp, for all destinations.
+func (s *destinationAttemptsStatements) deleteDestinationAttemptsBefore(
+	ctx context.Context, txn *sql.Tx, beforeTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := common.TxStmt(txn, s.deleteDestinationAttemptsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, beforeTS)
+	return err
+}
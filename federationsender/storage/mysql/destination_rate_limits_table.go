@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const destinationRateLimitsSchema = `
+-- The destination_rate_limits table stores the maximum rate at which events
+-- are sent to a destination, where an operator has overridden the default.
+CREATE TABLE IF NOT EXISTS federationsender_destination_rate_limits (
+    -- The destination server name
+    server_name VARCHAR(255) PRIMARY KEY,
+    -- The maximum number of events per second to send, or 0 for no limit
+    events_per_sec REAL NOT NULL
+);`
+
+const upsertDestinationRateLimitSQL = "" +
+	"INSERT INTO federationsender_destination_rate_limits (server_name, events_per_sec)" +
+	" VALUES ($1, $2)" +
+	" ON DUPLICATE KEY UPDATE events_per_sec = $2"
+
+const deleteDestinationRateLimitSQL = "" +
+	"DELETE FROM federationsender_destination_rate_limits WHERE server_name = $1"
+
+const selectDestinationRateLimitSQL = "" +
+	"SELECT events_per_sec FROM federationsender_destination_rate_limits WHERE server_name = $1"
+
+type destinationRateLimitsStatements struct {
+	upsertDestinationRateLimitStmt *sql.Stmt
+	deleteDestinationRateLimitStmt *sql.Stmt
+	selectDestinationRateLimitStmt *sql.Stmt
+}
+
+func (s *destinationRateLimitsStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertDestinationRateLimitStmt, err = db.Prepare(upsertDestinationRateLimitSQL); err != nil {
+		return
+	}
+	if s.deleteDestinationRateLimitStmt, err = db.Prepare(deleteDestinationRateLimitSQL); err != nil {
+		return
+	}
+	if s.selectDestinationRateLimitStmt, err = db.Prepare(selectDestinationRateLimitSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertDestinationRateLimit sets the rate limit for the destination.
+func (s *destinationRateLimitsStatements) upsertDestinationRateLimit(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	eventsPerSec float64,
+) error {
+	stmt := common.TxStmt(txn, s.upsertDestinationRateLimitStmt)
+	_, err := stmt.ExecContext(ctx, serverName, eventsPerSec)
+	return err
+}
+
+// deleteDestinationRateLimit removes the rate limit for the destination, so
+// that the default is used instead.
+func (s *destinationRateLimitsStatements) deleteDestinationRateLimit(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := common.TxStmt(txn, s.deleteDestinationRateLimitStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+// selectDestinationRateLimit returns the rate limit for the destination, and
+// whether one has been set.
+func (s *destinationRateLimitsStatements) selectDestinationRateLimit(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (eventsPerSec float64, ok bool, err error) {
+	stmt := common.TxStmt(txn, s.selectDestinationRateLimitStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&eventsPerSec)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return eventsPerSec, err == nil, err
+}
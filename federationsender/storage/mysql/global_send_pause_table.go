@@ -0,0 +1,92 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const globalSendPauseSchema = `
+-- The global_send_pause table has a single row if sending to all destinations
+-- over federation has been paused by an operator, e.g. during maintenance.
+CREATE TABLE IF NOT EXISTS federationsender_global_send_pause (
+    -- Always true, so that the table can have at most one row.
+    single_row BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (single_row),
+    -- When sending was paused, in milliseconds since the epoch.
+    paused_ts BIGINT NOT NULL
+);`
+
+const insertGlobalSendPauseSQL = "" +
+	"INSERT IGNORE INTO federationsender_global_send_pause (paused_ts) VALUES ($1)"
+
+const deleteGlobalSendPauseSQL = "" +
+	"DELETE FROM federationsender_global_send_pause"
+
+const selectGlobalSendPauseSQL = "" +
+	"SELECT paused_ts FROM federationsender_global_send_pause"
+
+type globalSendPauseStatements struct {
+	insertGlobalSendPauseStmt *sql.Stmt
+	deleteGlobalSendPauseStmt *sql.Stmt
+	selectGlobalSendPauseStmt *sql.Stmt
+}
+
+func (s *globalSendPauseStatements) prepare(db *sql.DB) (err error) {
+	if s.insertGlobalSendPauseStmt, err = db.Prepare(insertGlobalSendPauseSQL); err != nil {
+		return
+	}
+	if s.deleteGlobalSendPauseStmt, err = db.Prepare(deleteGlobalSendPauseSQL); err != nil {
+		return
+	}
+	if s.selectGlobalSendPauseStmt, err = db.Prepare(selectGlobalSendPauseSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertGlobalSendPause marks sending as paused for all destinations, if it
+// wasn't already.
+func (s *globalSendPauseStatements) insertGlobalSendPause(
+	ctx context.Context, txn *sql.Tx, pausedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := common.TxStmt(txn, s.insertGlobalSendPauseStmt).ExecContext(ctx, pausedTS)
+	return err
+}
+
+// deleteGlobalSendPause marks sending as no longer paused for all destinations.
+func (s *globalSendPauseStatements) deleteGlobalSendPause(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	_, err := common.TxStmt(txn, s.deleteGlobalSendPauseStmt).ExecContext(ctx)
+	return err
+}
+
+// selectGlobalSendPause returns whether sending is paused for all
+// destinations.
+func (s *globalSendPauseStatements) selectGlobalSendPause(
+	ctx context.Context, txn *sql.Tx,
+) (bool, error) {
+	var pausedTS gomatrixserverlib.Timestamp
+	stmt := common.TxStmt(txn, s.selectGlobalSendPauseStmt)
+	err := stmt.QueryRowContext(ctx).Scan(&pausedTS)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const sentEventsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_sent_events (
+    event_id VARCHAR(255) NOT NULL,
+    server_name VARCHAR(255) NOT NULL,
+    sent_ts BIGINT NOT NULL,
+    PRIMARY KEY (event_id, server_name),
+    INDEX federationsender_sent_events_sent_ts_idx (sent_ts)
+);
+`
+
+const insertSentEventSQL = "" +
+	"INSERT IGNORE INTO federationsender_sent_events (event_id, server_name, sent_ts)" +
+	" VALUES ($1, $2, $3)"
+
+const deleteSentEventsBeforeSQL = "" +
+	"DELETE FROM federationsender_sent_events WHERE sent_ts < $1 LIMIT $2"
+
+const selectSentEventBeforeSQL = "" +
+	"SELECT 1 FROM federationsender_sent_events WHERE sent_ts < $1 LIMIT 1"
+
+type sentEventsStatements struct {
+	insertSentEventStmt        *sql.Stmt
+	deleteSentEventsBeforeStmt *sql.Stmt
+	selectSentEventBeforeStmt  *sql.Stmt
+}
+
+func (s *sentEventsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertSentEventStmt, err = db.Prepare(insertSentEventSQL); err != nil {
+		return
+	}
+	if s.deleteSentEventsBeforeStmt, err = db.Prepare(deleteSentEventsBeforeSQL); err != nil {
+		return
+	}
+	if s.selectSentEventBeforeStmt, err = db.Prepare(selectSentEventBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertSentEvent records that the event was acknowledged by the destination.
+func (s *sentEventsStatements) insertSentEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+	serverName gomatrixserverlib.ServerName, sentTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := common.TxStmt(txn, s.insertSentEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID, serverName, sentTS)
+	return err
+}
+
+// deleteSentEventsBefore deletes up to limit records of events which were sent
+// before the timestamp, and returns how many were deleted.
+func (s *sentEventsStatements) deleteSentEventsBefore(
+	ctx context.Context, txn *sql.Tx, beforeTS gomatrixserverlib.Timestamp, limit int,
+) (int, error) {
+	stmt := common.TxStmt(txn, s.deleteSentEventsBeforeStmt)
+	res, err := stmt.ExecContext(ctx, beforeTS, limit)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
+
+// selectSentEventBefore returns whether there are any records of events which
+// were sent before the timestamp.
+func (s *sentEventsStatements) selectSentEventBefore(
+	ctx context.Context, txn *sql.Tx, beforeTS gomatrixserverlib.Timestamp,
+) (bool, error) {
+	var exists int
+	stmt := common.TxStmt(txn, s.selectSentEventBeforeStmt)
+	err := stmt.QueryRowContext(ctx, beforeTS).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
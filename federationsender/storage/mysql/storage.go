@@ -0,0 +1,622 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database stores information needed by the federation sender
+type Database struct {
+	joinedHostsStatements
+	roomStatements
+	queueThroughputStatements
+	tombstonedRoomsStatements
+	pausedRoomsStatements
+	globalSendPauseStatements
+	destinationRateLimitsStatements
+	destinationTransactionLimitsStatements
+	sentEventsStatements
+	destinationAttemptsStatements
+	queuePDUsStatements
+	queuePDUJSONStatements
+	queueEDUsStatements
+	common.PartitionOffsetStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database. The queued events and EDUs are encrypted
+// with queueCipher, or stored unencrypted if it is nil.
+func NewDatabase(dataSourceName string, dbProperties common.DbProperties, queueCipher *encryption.Cipher) (*Database, error) {
+	var result Database
+	result.queuePDUJSONStatements.cipher = queueCipher
+	result.queueEDUsStatements.cipher = queueCipher
+	dsn, err := sqlutil.ParseMySQLDataSourceName(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if result.db, err = sqlutil.Open(sqlutil.MySQLDriverName, dsn, dbProperties); err != nil {
+		return nil, err
+	}
+	if err = sqlutil.NewMigrator(result.db, "federationsender", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = result.prepare(); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (d *Database) prepare() error {
+	var err error
+
+	if err = d.joinedHostsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.roomStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueThroughputStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.tombstonedRoomsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.pausedRoomsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.globalSendPauseStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.destinationRateLimitsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.destinationTransactionLimitsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.sentEventsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.destinationAttemptsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queuePDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queuePDUJSONStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.queueEDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	return d.PartitionOffsetStatements.PrepareMySQL(d.db, "federationsender")
+}
+
+// UpdateRoom updates the joined hosts for a room and returns what the joined
+// hosts were before the update, or nil if this was a duplicate message.
+// This is called when we receive a message from kafka, so we pass in
+// oldEventID and newEventID to check that we haven't missed any messages or
+// this isn't a duplicate message.
+func (d *Database) UpdateRoom(
+	ctx context.Context,
+	roomID, oldEventID, newEventID string,
+	addHosts []types.JoinedHost,
+	removeHosts []string,
+) (joinedHosts []types.JoinedHost, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		err = d.insertRoom(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+
+		lastSentEventID, err := d.selectRoomForUpdate(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+
+		if lastSentEventID == newEventID {
+			// We've handled this message before, so let's just ignore it.
+			// We can only get a duplicate for the last message we processed,
+			// so its enough just to compare the newEventID with lastSentEventID
+			return nil
+		}
+
+		if lastSentEventID != "" && lastSentEventID != oldEventID {
+			return types.EventIDMismatchError{
+				DatabaseID: lastSentEventID, RoomServerID: oldEventID,
+			}
+		}
+
+		joinedHosts, err = d.selectJoinedHostsWithTx(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+
+		for _, add := range addHosts {
+			err = d.insertJoinedHosts(ctx, txn, roomID, add.MemberEventID, add.ServerName)
+			if err != nil {
+				return err
+			}
+		}
+		if err = d.deleteJoinedHosts(ctx, txn, removeHosts); err != nil {
+			return err
+		}
+		return d.updateRoom(ctx, txn, roomID, newEventID)
+	})
+	return
+}
+
+// ReconcileJoinedHosts adds and removes joined hosts for the room to bring
+// them back in line with the roomserver. Unlike UpdateRoom it doesn't check or
+// update the last sent event ID for the room, as the changes don't correspond
+// to a message from the roomserver.
+func (d *Database) ReconcileJoinedHosts(
+	ctx context.Context, roomID string,
+	addHosts []types.JoinedHost, removeHosts []string,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, add := range addHosts {
+			if err := d.insertJoinedHosts(ctx, txn, roomID, add.MemberEventID, add.ServerName); err != nil {
+				return err
+			}
+		}
+		return d.deleteJoinedHosts(ctx, txn, removeHosts)
+	})
+}
+
+// GetJoinedHosts returns the currently joined hosts for room,
+// as known to federationserver.
+// Returns an error if something goes wrong.
+func (d *Database) GetJoinedHosts(
+	ctx context.Context, roomID string,
+) ([]types.JoinedHost, error) {
+	return d.selectJoinedHosts(ctx, roomID)
+}
+
+// DestinationsForRoom returns the distinct servers with users joined to the
+// room, i.e. the servers that its events are fanned out to. This includes our
+// own server if any local users are joined.
+func (d *Database) DestinationsForRoom(
+	ctx context.Context, roomID string,
+) ([]gomatrixserverlib.ServerName, error) {
+	return d.selectJoinedHostServerNames(ctx, roomID)
+}
+
+// SetRoomTombstoned records that the room has been replaced by another room,
+// so that its events no longer need to be fanned out to the servers in it.
+func (d *Database) SetRoomTombstoned(ctx context.Context, roomID string) error {
+	return d.insertTombstonedRoom(ctx, nil, roomID)
+}
+
+// IsRoomTombstoned returns whether SetRoomTombstoned has been called for the
+// room.
+func (d *Database) IsRoomTombstoned(ctx context.Context, roomID string) (bool, error) {
+	return d.selectTombstonedRoom(ctx, nil, roomID)
+}
+
+// SetRoomSendPaused pauses or resumes sending the events in the room to other
+// servers over federation.
+func (d *Database) SetRoomSendPaused(ctx context.Context, roomID string, paused bool) error {
+	if paused {
+		return d.insertPausedRoom(ctx, nil, roomID)
+	}
+	return d.deletePausedRoom(ctx, nil, roomID)
+}
+
+// IsRoomSendPaused returns whether sending the events in the room to other
+// servers over federation is paused.
+func (d *Database) IsRoomSendPaused(ctx context.Context, roomID string) (bool, error) {
+	return d.selectPausedRoom(ctx, nil, roomID)
+}
+
+// PausedRooms returns the IDs of all of the rooms for which sending events to
+// other servers over federation is paused.
+func (d *Database) PausedRooms(ctx context.Context) ([]string, error) {
+	return d.selectAllPausedRooms(ctx)
+}
+
+// PurgeRoom removes the joined hosts for the room, along with whether it is
+// paused or tombstoned. Events that are already queued for destinations are
+// still sent.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteJoinedHostsForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.deletePausedRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.deleteTombstonedRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.deleteRoom(ctx, txn, roomID)
+	})
+}
+
+// SetGlobalSendPaused pauses or resumes sending events to all destinations
+// over federation. Events are still queued while sending is paused.
+func (d *Database) SetGlobalSendPaused(ctx context.Context, paused bool) error {
+	if paused {
+		return d.insertGlobalSendPause(ctx, nil, gomatrixserverlib.AsTimestamp(time.Now()))
+	}
+	return d.deleteGlobalSendPause(ctx, nil)
+}
+
+// IsGlobalSendPaused returns whether sending events to all destinations over
+// federation is paused.
+func (d *Database) IsGlobalSendPaused(ctx context.Context) (bool, error) {
+	return d.selectGlobalSendPause(ctx, nil)
+}
+
+// SetDestinationRateLimit sets the maximum number of events per second to send
+// to the destination, overriding the default. 0 means no limit, and a negative
+// rate removes the override so that the default is used again.
+func (d *Database) SetDestinationRateLimit(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, eventsPerSec float64,
+) error {
+	if eventsPerSec < 0 {
+		return d.deleteDestinationRateLimit(ctx, nil, serverName)
+	}
+	return d.upsertDestinationRateLimit(ctx, nil, serverName, eventsPerSec)
+}
+
+// DestinationRateLimit returns the maximum number of events per second to send
+// to the destination, and whether it has been set by SetDestinationRateLimit.
+func (d *Database) DestinationRateLimit(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (eventsPerSec float64, ok bool, err error) {
+	return d.selectDestinationRateLimit(ctx, nil, serverName)
+}
+
+// SetDestinationTransactionLimits sets the limits on the size of the
+// transactions sent to the destination, overriding the defaults. nil removes
+// the override so that the defaults are used again.
+func (d *Database) SetDestinationTransactionLimits(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, limits *types.TransactionLimits,
+) error {
+	if limits == nil {
+		return d.deleteDestinationTransactionLimits(ctx, nil, serverName)
+	}
+	return d.upsertDestinationTransactionLimits(ctx, nil, serverName, *limits)
+}
+
+// DestinationTransactionLimits returns the limits on the size of the
+// transactions sent to the destination, and whether they have been set by
+// SetDestinationTransactionLimits.
+func (d *Database) DestinationTransactionLimits(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (limits types.TransactionLimits, ok bool, err error) {
+	return d.selectDestinationTransactionLimits(ctx, nil, serverName)
+}
+
+// RecordQueueThroughput adds to the number of events queued for and sent to
+// the destination in the current one-minute bucket. Buckets which have fallen
+// out of the window used by QueueThroughput are removed at the same time.
+func (d *Database) RecordQueueThroughput(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	enqueued, dequeued int64,
+) error {
+	now := time.Now()
+	bucket := gomatrixserverlib.AsTimestamp(now.Truncate(time.Minute))
+	expired := gomatrixserverlib.AsTimestamp(now.Add(-types.QueueThroughputWindow))
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.upsertQueueThroughput(ctx, txn, serverName, bucket, enqueued, dequeued); err != nil {
+			return err
+		}
+		return d.deleteQueueThroughputBefore(ctx, txn, expired)
+	})
+}
+
+// QueueThroughput returns the average number of events queued for and sent to
+// the destination per minute, over the last types.QueueThroughputWindow.
+func (d *Database) QueueThroughput(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (enqueuedPerMin, dequeuedPerMin float64, err error) {
+	since := gomatrixserverlib.AsTimestamp(time.Now().Add(-types.QueueThroughputWindow).Truncate(time.Minute))
+	enqueued, dequeued, err := d.selectQueueThroughput(ctx, serverName, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	minutes := types.QueueThroughputWindow.Minutes()
+	return float64(enqueued) / minutes, float64(dequeued) / minutes, nil
+}
+
+// RecordSentEvents records that the events were sent to, and acknowledged by,
+// the destination.
+func (d *Database) RecordSentEvents(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, eventIDs []string,
+) error {
+	sentTS := gomatrixserverlib.AsTimestamp(time.Now())
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, eventID := range eventIDs {
+			if err := d.insertSentEvent(ctx, txn, eventID, serverName, sentTS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PruneSentEvents deletes up to maxRows records of sent events which are older
+// than the cutoff. It returns the number of records deleted, and whether there
+// are no more records older than the cutoff left to delete, so that it can be
+// called repeatedly in small batches until it is done.
+func (d *Database) PruneSentEvents(
+	ctx context.Context, olderThan time.Time, maxRows int,
+) (deleted int, done bool, err error) {
+	beforeTS := gomatrixserverlib.AsTimestamp(olderThan)
+	deleted, err = d.deleteSentEventsBefore(ctx, nil, beforeTS, maxRows)
+	if err != nil {
+		return 0, false, err
+	}
+	if deleted < maxRows {
+		return deleted, true, nil
+	}
+	more, err := d.selectSentEventBefore(ctx, nil, beforeTS)
+	if err != nil {
+		return deleted, false, err
+	}
+	return deleted, !more, nil
+}
+
+// RecordSendAttempt counts an attempt to send a transaction to the destination
+// towards its success rate. If the attempt succeeded then the events that were
+// sent in the transaction are recorded as sent, and are no longer pending for
+// the destination, in the same database transaction, so that the counters
+// always agree with the sent events. The sent EDUs, given by their numeric
+// IDs in the queue, are also no longer pending.
+func (d *Database) RecordSendAttempt(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	success bool, sentEventIDs []string, sentEDUNIDs []int64,
+) error {
+	now := time.Now()
+	bucket := gomatrixserverlib.AsTimestamp(now.Truncate(time.Minute))
+	expired := gomatrixserverlib.AsTimestamp(now.Add(-types.DestinationSuccessRateWindow))
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.upsertDestinationAttempt(ctx, txn, serverName, bucket, success); err != nil {
+			return err
+		}
+		if success {
+			sentTS := gomatrixserverlib.AsTimestamp(now)
+			for _, eventID := range sentEventIDs {
+				if err := d.insertSentEvent(ctx, txn, eventID, serverName, sentTS); err != nil {
+					return err
+				}
+				if err := d.deleteQueuePDU(ctx, txn, eventID, serverName); err != nil {
+					return err
+				}
+				if err := d.deleteUnqueuedPDUJSON(ctx, txn, eventID); err != nil {
+					return err
+				}
+			}
+			for _, eduNID := range sentEDUNIDs {
+				if err := d.deleteQueueEDU(ctx, txn, eduNID); err != nil {
+					return err
+				}
+			}
+		}
+		return d.deleteDestinationAttemptsBefore(ctx, txn, expired)
+	})
+}
+
+// DestinationSuccessRate returns the fraction of attempts to send to the
+// destination that succeeded over the last types.DestinationSuccessRateWindow,
+// between 0 and 1. If there were no attempts in the window then it returns 1.
+func (d *Database) DestinationSuccessRate(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (float64, error) {
+	since := gomatrixserverlib.AsTimestamp(time.Now().Add(-types.DestinationSuccessRateWindow).Truncate(time.Minute))
+	attempts, successes, err := d.selectDestinationAttempts(ctx, serverName, since)
+	if err != nil {
+		return 0, err
+	}
+	if attempts == 0 {
+		return 1, nil
+	}
+	return float64(successes) / float64(attempts), nil
+}
+
+// AssociatePDUWithDestinations records that the event has been queued to be
+// sent to each of the destinations, storing the event so that it can still be
+// sent if the server restarts.
+func (d *Database) AssociatePDUWithDestinations(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, serverNames []gomatrixserverlib.ServerName,
+) error {
+	return d.queuePDU(ctx, event, serverNames, "")
+}
+
+// HoldPDUWithDestinations records that the event is being held back from each
+// of the destinations because sending is paused for its room. It isn't
+// pending for the destinations until ReleaseHeldPDUs is called for the room,
+// but is stored so that it isn't lost if the server restarts in the meantime.
+func (d *Database) HoldPDUWithDestinations(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent, serverNames []gomatrixserverlib.ServerName,
+) error {
+	return d.queuePDU(ctx, event, serverNames, event.RoomID())
+}
+
+func (d *Database) queuePDU(
+	ctx context.Context, event *gomatrixserverlib.HeaderedEvent,
+	serverNames []gomatrixserverlib.ServerName, heldRoomID string,
+) error {
+	queuedTS := gomatrixserverlib.AsTimestamp(time.Now())
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.insertQueuePDUJSON(ctx, txn, event); err != nil {
+			return err
+		}
+		for _, serverName := range serverNames {
+			if err := d.insertQueuePDU(ctx, txn, event.EventID(), serverName, queuedTS, heldRoomID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// HeldRooms returns the IDs of the rooms which have events being held back
+// by HoldPDUWithDestinations.
+func (d *Database) HeldRooms(ctx context.Context) ([]string, error) {
+	return d.selectHeldRooms(ctx)
+}
+
+// ReleaseHeldPDUs returns the events being held back for the room, in the
+// order they were held, along with the destinations they were held for. In
+// the same transaction they become pending for those destinations, so that
+// they are restored with the rest of the queue if the server restarts before
+// they are sent.
+func (d *Database) ReleaseHeldPDUs(ctx context.Context, roomID string) (held []types.HeldPDU, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if held, err = d.selectHeldPDUJSON(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.releaseHeldQueuePDUs(ctx, txn, roomID)
+	})
+	return
+}
+
+// DistinctPendingEvents returns up to limit distinct event IDs which are still
+// pending for at least one destination, oldest first. An event queued for many
+// destinations is only returned once.
+func (d *Database) DistinctPendingEvents(ctx context.Context, limit int) ([]string, error) {
+	return d.selectDistinctQueuePDUs(ctx, limit)
+}
+
+// DestinationsByBacklog returns up to limit destinations which have events
+// pending for them, ordered by the number of pending events, largest first,
+// so that the most backed up destinations can be drained first.
+func (d *Database) DestinationsByBacklog(ctx context.Context, limit int) ([]types.DestinationBacklog, error) {
+	return d.selectQueuePDUBacklogs(ctx, limit)
+}
+
+// AssociateEDUWithDestinations records that the EDU has been queued to be sent
+// to each of the destinations, so that it can still be sent if the server
+// restarts. Returns the queued EDU for each destination.
+func (d *Database) AssociateEDUWithDestinations(
+	ctx context.Context, edu *gomatrixserverlib.EDU, serverNames []gomatrixserverlib.ServerName,
+) (map[gomatrixserverlib.ServerName]*types.QueuedEDU, error) {
+	queuedTS := gomatrixserverlib.AsTimestamp(time.Now())
+	queued := make(map[gomatrixserverlib.ServerName]*types.QueuedEDU, len(serverNames))
+	err := common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, serverName := range serverNames {
+			eduNID, err := d.insertQueueEDU(ctx, txn, edu, serverName, queuedTS)
+			if err != nil {
+				return err
+			}
+			queued[serverName] = &types.QueuedEDU{NID: eduNID, QueuedTS: queuedTS, EDU: edu}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queued, nil
+}
+
+// DeleteQueuedEDUs removes the EDUs with the given numeric IDs from the queue,
+// e.g. because they have expired.
+func (d *Database) DeleteQueuedEDUs(ctx context.Context, eduNIDs []int64) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, eduNID := range eduNIDs {
+			if err := d.deleteQueueEDU(ctx, txn, eduNID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PendingDestinations returns the destinations which have events or EDUs
+// pending for them.
+func (d *Database) PendingDestinations(ctx context.Context) ([]gomatrixserverlib.ServerName, error) {
+	pduServerNames, err := d.selectQueuePDUDestinations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	eduServerNames, err := d.selectQueueEDUDestinations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[gomatrixserverlib.ServerName]bool, len(pduServerNames))
+	var serverNames []gomatrixserverlib.ServerName
+	for _, serverName := range append(pduServerNames, eduServerNames...) {
+		if !seen[serverName] {
+			seen[serverName] = true
+			serverNames = append(serverNames, serverName)
+		}
+	}
+	return serverNames, nil
+}
+
+// PendingPDUs returns the events pending for the destination, in the order
+// they were queued.
+func (d *Database) PendingPDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	return d.selectQueuedPDUJSON(ctx, serverName)
+}
+
+// PendingEDUs returns the EDUs pending for the destination, in the order
+// they were queued.
+func (d *Database) PendingEDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]*types.QueuedEDU, error) {
+	return d.selectQueueEDUs(ctx, serverName)
+}
+
+// LatestEventIDsForDestination returns the ID of the latest event in each room
+// that the destination has users joined to.
+func (d *Database) LatestEventIDsForDestination(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]string, error) {
+	return d.selectLastEventIDsForServer(ctx, serverName)
+}
+
+// DeletePendingForDestination removes all of the events and EDUs pending for
+// the destination.
+func (d *Database) DeletePendingForDestination(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueuePDUsForServer(ctx, txn, serverName); err != nil {
+			return err
+		}
+		if err := d.deleteAllUnqueuedPDUJSON(ctx, txn); err != nil {
+			return err
+		}
+		return d.deleteQueueEDUsForServer(ctx, txn, serverName)
+	})
+}
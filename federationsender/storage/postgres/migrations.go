@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// migrations are the schema migrations for the federation sender database, in order.
+var migrations = []sqlutil.Migration{
+	{
+		Version:     1,
+		Description: "Create the initial schema",
+		Up: sqlutil.Statements(
+			joinedHostsSchema,
+			roomSchema,
+			queueThroughputSchema,
+			tombstonedRoomsSchema,
+			pausedRoomsSchema,
+			globalSendPauseSchema,
+			destinationRateLimitsSchema,
+			destinationTransactionLimitsSchema,
+			sentEventsSchema,
+			destinationAttemptsSchema,
+			queuePDUsSchema,
+			queuePDUJSONSchema,
+			queueEDUsSchema,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Encrypt queued events and EDUs",
+		Up:          sqlutil.Statements(queuePDUJSONKeyVersionSchema, queueEDUsKeyVersionSchema),
+	},
+	{
+		Version:     3,
+		Description: "Hold queued events for paused rooms",
+		Up:          sqlutil.Statements(queuePDUsHeldRoomSchema, queuePDUsHeldRoomIndexSchema),
+	},
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const pausedRoomsSchema = `
+-- The paused_rooms table stores the IDs of rooms for which sending events over
+-- federation has been paused by an operator, e.g. during a spam incident.
+CREATE TABLE IF NOT EXISTS federationsender_paused_rooms (
+    -- The string ID of the room
+    room_id TEXT PRIMARY KEY
+);`
+
+const insertPausedRoomSQL = "" +
+	"INSERT INTO federationsender_paused_rooms (room_id) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const deletePausedRoomSQL = "" +
+	"DELETE FROM federationsender_paused_rooms WHERE room_id = $1"
+
+const selectPausedRoomSQL = "" +
+	"SELECT room_id FROM federationsender_paused_rooms WHERE room_id = $1"
+
+const selectAllPausedRoomsSQL = "" +
+	"SELECT room_id FROM federationsender_paused_rooms"
+
+type pausedRoomsStatements struct {
+	insertPausedRoomStmt     *sql.Stmt
+	deletePausedRoomStmt     *sql.Stmt
+	selectPausedRoomStmt     *sql.Stmt
+	selectAllPausedRoomsStmt *sql.Stmt
+}
+
+func (s *pausedRoomsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertPausedRoomStmt, err = db.Prepare(insertPausedRoomSQL); err != nil {
+		return
+	}
+	if s.deletePausedRoomStmt, err = db.Prepare(deletePausedRoomSQL); err != nil {
+		return
+	}
+	if s.selectPausedRoomStmt, err = db.Prepare(selectPausedRoomSQL); err != nil {
+		return
+	}
+	if s.selectAllPausedRoomsStmt, err = db.Prepare(selectAllPausedRoomsSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertPausedRoom marks sending as paused for the room, if it wasn't already.
+func (s *pausedRoomsStatements) insertPausedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.insertPausedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// deletePausedRoom marks sending as no longer paused for the room.
+func (s *pausedRoomsStatements) deletePausedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.deletePausedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// selectPausedRoom returns whether sending is paused for the room.
+func (s *pausedRoomsStatements) selectPausedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (bool, error) {
+	var id string
+	stmt := common.TxStmt(txn, s.selectPausedRoomStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// selectAllPausedRooms returns the IDs of all of the rooms for which sending
+// is paused.
+func (s *pausedRoomsStatements) selectAllPausedRooms(
+	ctx context.Context,
+) ([]string, error) {
+	rows, err := s.selectAllPausedRoomsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectAllPausedRooms: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
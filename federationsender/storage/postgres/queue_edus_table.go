@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueEDUsSchema = `
+-- The queue_edus table stores the EDUs queued to be sent to each destination,
+-- so that the queues can be restored if the server restarts. Rows are removed
+-- once the destination has acknowledged the EDU, or once the EDU has expired.
+CREATE TABLE IF NOT EXISTS federationsender_queue_edus (
+    -- Orders the EDUs in the order they were queued.
+    edu_nid BIGSERIAL PRIMARY KEY,
+    -- The destination server name.
+    server_name TEXT NOT NULL,
+    -- The JSON of the EDU.
+    edu_json TEXT NOT NULL,
+    -- When the EDU was queued, in milliseconds since the epoch.
+    queued_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_edus_server_name_idx
+    ON federationsender_queue_edus (server_name, edu_nid);
+`
+
+// The JSON of an EDU may be encrypted, in which case key_version is the
+// version of the key it was encrypted with.
+const queueEDUsKeyVersionSchema = `
+ALTER TABLE federationsender_queue_edus ADD COLUMN key_version BIGINT NOT NULL DEFAULT 0
+`
+
+const insertQueueEDUSQL = "" +
+	"INSERT INTO federationsender_queue_edus (server_name, edu_json, queued_ts, key_version)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" RETURNING edu_nid"
+
+const deleteQueueEDUSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE edu_nid = $1"
+
+const deleteQueueEDUsForServerSQL = "" +
+	"DELETE FROM federationsender_queue_edus WHERE server_name = $1"
+
+const selectQueueEDUsSQL = "" +
+	"SELECT edu_nid, edu_json, queued_ts, key_version FROM federationsender_queue_edus" +
+	" WHERE server_name = $1" +
+	" ORDER BY edu_nid ASC"
+
+const selectQueueEDUDestinationsSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue_edus"
+
+type queueEDUsStatements struct {
+	insertQueueEDUStmt             *sql.Stmt
+	deleteQueueEDUStmt             *sql.Stmt
+	selectQueueEDUsStmt            *sql.Stmt
+	selectQueueEDUDestinationsStmt *sql.Stmt
+	deleteQueueEDUsForServerStmt   *sql.Stmt
+	cipher                         *encryption.Cipher
+}
+
+func (s *queueEDUsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertQueueEDUStmt, err = db.Prepare(insertQueueEDUSQL); err != nil {
+		return
+	}
+	if s.deleteQueueEDUStmt, err = db.Prepare(deleteQueueEDUSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUsStmt, err = db.Prepare(selectQueueEDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueueEDUDestinationsStmt, err = db.Prepare(selectQueueEDUDestinationsSQL); err != nil {
+		return
+	}
+	if s.deleteQueueEDUsForServerStmt, err = db.Prepare(deleteQueueEDUsForServerSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertQueueEDU records that the EDU is queued for the destination and
+// returns its numeric ID in the queue.
+func (s *queueEDUsStatements) insertQueueEDU(
+	ctx context.Context, txn *sql.Tx, edu *gomatrixserverlib.EDU,
+	serverName gomatrixserverlib.ServerName, queuedTS gomatrixserverlib.Timestamp,
+) (int64, error) {
+	eduJSON, err := json.Marshal(edu)
+	if err != nil {
+		return 0, err
+	}
+	var eduNID int64
+	content, keyVersion, err := s.cipher.Encrypt(eduJSON)
+	if err != nil {
+		return 0, err
+	}
+	stmt := common.TxStmt(txn, s.insertQueueEDUStmt)
+	err = stmt.QueryRowContext(ctx, serverName, content, queuedTS, keyVersion).Scan(&eduNID)
+	return eduNID, err
+}
+
+// deleteQueueEDU removes the EDU with the given numeric ID from the queue.
+func (s *queueEDUsStatements) deleteQueueEDU(
+	ctx context.Context, txn *sql.Tx, eduNID int64,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueueEDUStmt)
+	_, err := stmt.ExecContext(ctx, eduNID)
+	return err
+}
+
+// deleteQueueEDUsForServer removes all of the EDUs queued for the destination.
+func (s *queueEDUsStatements) deleteQueueEDUsForServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueueEDUsForServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+// selectQueueEDUs returns the EDUs queued for the destination, in the order
+// they were queued.
+func (s *queueEDUsStatements) selectQueueEDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]*types.QueuedEDU, error) {
+	rows, err := s.selectQueueEDUsStmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueueEDUs: rows.close() failed")
+	var edus []*types.QueuedEDU
+	for rows.Next() {
+		var content []byte
+		var keyVersion int
+		queued := types.QueuedEDU{EDU: &gomatrixserverlib.EDU{}}
+		if err = rows.Scan(&queued.NID, &content, &queued.QueuedTS, &keyVersion); err != nil {
+			return nil, err
+		}
+		var eduJSON []byte
+		if eduJSON, err = s.cipher.Decrypt(content, keyVersion); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(eduJSON, queued.EDU); err != nil {
+			return nil, err
+		}
+		edus = append(edus, &queued)
+	}
+	return edus, rows.Err()
+}
+
+// selectQueueEDUDestinations returns the destinations which have EDUs queued
+// for them.
+func (s *queueEDUsStatements) selectQueueEDUDestinations(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	rows, err := s.selectQueueEDUDestinationsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueueEDUDestinations: rows.close() failed")
+	var serverNames []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		serverNames = append(serverNames, serverName)
+	}
+	return serverNames, rows.Err()
+}
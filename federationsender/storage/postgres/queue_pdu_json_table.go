@@ -0,0 +1,217 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queuePDUJSONSchema = `
+-- The queue_pdu_json table stores the JSON of the events in the queue_pdus
+-- table, so that the queues can be restored if the server restarts. It is
+-- stored once however many destinations the event is queued for, and is
+-- removed once the event is no longer queued for any destination.
+CREATE TABLE IF NOT EXISTS federationsender_queue_pdu_json (
+    -- Orders the events in the order they were queued.
+    json_nid BIGSERIAL PRIMARY KEY,
+    -- The event ID of the queued event.
+    event_id TEXT NOT NULL UNIQUE,
+    -- The JSON of the event, including the room version header.
+    headered_event_json TEXT NOT NULL
+);
+`
+
+// The JSON of an event may be encrypted, in which case key_version is the
+// version of the key it was encrypted with.
+const queuePDUJSONKeyVersionSchema = `
+ALTER TABLE federationsender_queue_pdu_json ADD COLUMN key_version BIGINT NOT NULL DEFAULT 0
+`
+
+const insertQueuePDUJSONSQL = "" +
+	"INSERT INTO federationsender_queue_pdu_json (event_id, headered_event_json, key_version)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteUnqueuedPDUJSONSQL = "" +
+	"DELETE FROM federationsender_queue_pdu_json WHERE event_id = $1" +
+	" AND NOT EXISTS (SELECT 1 FROM federationsender_queue_pdus WHERE event_id = $1)"
+
+const deleteAllUnqueuedPDUJSONSQL = "" +
+	"DELETE FROM federationsender_queue_pdu_json WHERE NOT EXISTS (" +
+	"SELECT 1 FROM federationsender_queue_pdus" +
+	" WHERE federationsender_queue_pdus.event_id = federationsender_queue_pdu_json.event_id)"
+
+const selectQueuedPDUJSONSQL = "" +
+	"SELECT j.headered_event_json, j.key_version FROM federationsender_queue_pdu_json j" +
+	" INNER JOIN federationsender_queue_pdus q ON q.event_id = j.event_id" +
+	" WHERE q.server_name = $1 AND q.held_room_id = ''" +
+	" ORDER BY j.json_nid ASC"
+
+const selectHeldPDUJSONSQL = "" +
+	"SELECT j.event_id, j.headered_event_json, j.key_version, q.server_name FROM federationsender_queue_pdu_json j" +
+	" INNER JOIN federationsender_queue_pdus q ON q.event_id = j.event_id" +
+	" WHERE q.held_room_id = $1" +
+	" ORDER BY j.json_nid ASC, q.server_name ASC"
+
+type queuePDUJSONStatements struct {
+	insertQueuePDUJSONStmt       *sql.Stmt
+	deleteUnqueuedPDUJSONStmt    *sql.Stmt
+	deleteAllUnqueuedPDUJSONStmt *sql.Stmt
+	selectQueuedPDUJSONStmt      *sql.Stmt
+	selectHeldPDUJSONStmt        *sql.Stmt
+	cipher                       *encryption.Cipher
+}
+
+func (s *queuePDUJSONStatements) prepare(db *sql.DB) (err error) {
+	if s.insertQueuePDUJSONStmt, err = db.Prepare(insertQueuePDUJSONSQL); err != nil {
+		return
+	}
+	if s.deleteUnqueuedPDUJSONStmt, err = db.Prepare(deleteUnqueuedPDUJSONSQL); err != nil {
+		return
+	}
+	if s.deleteAllUnqueuedPDUJSONStmt, err = db.Prepare(deleteAllUnqueuedPDUJSONSQL); err != nil {
+		return
+	}
+	if s.selectQueuedPDUJSONStmt, err = db.Prepare(selectQueuedPDUJSONSQL); err != nil {
+		return
+	}
+	if s.selectHeldPDUJSONStmt, err = db.Prepare(selectHeldPDUJSONSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertQueuePDUJSON stores the JSON of a queued event, if it isn't stored
+// already.
+func (s *queuePDUJSONStatements) insertQueuePDUJSON(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	content, keyVersion, err := s.cipher.Encrypt(eventJSON)
+	if err != nil {
+		return err
+	}
+	stmt := common.TxStmt(txn, s.insertQueuePDUJSONStmt)
+	_, err = stmt.ExecContext(ctx, event.EventID(), content, keyVersion)
+	return err
+}
+
+// deleteUnqueuedPDUJSON removes the JSON of the event if it is no longer
+// queued for any destination.
+func (s *queuePDUJSONStatements) deleteUnqueuedPDUJSON(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteUnqueuedPDUJSONStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+// deleteAllUnqueuedPDUJSON removes the JSON of all events which are no longer
+// queued for any destination.
+func (s *queuePDUJSONStatements) deleteAllUnqueuedPDUJSON(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := common.TxStmt(txn, s.deleteAllUnqueuedPDUJSONStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
+
+// selectQueuedPDUJSON returns the events queued for the destination, in the
+// order they were queued.
+func (s *queuePDUJSONStatements) selectQueuedPDUJSON(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	rows, err := s.selectQueuedPDUJSONStmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueuedPDUJSON: rows.close() failed")
+	var events []*gomatrixserverlib.HeaderedEvent
+	for rows.Next() {
+		var content []byte
+		var keyVersion int
+		if err = rows.Scan(&content, &keyVersion); err != nil {
+			return nil, err
+		}
+		event, err := s.decryptPDUJSON(content, keyVersion)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// selectHeldPDUJSON returns the events held back for the room, in the order
+// they were queued, along with the destinations they are held for.
+func (s *queuePDUJSONStatements) selectHeldPDUJSON(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]types.HeldPDU, error) {
+	rows, err := common.TxStmt(txn, s.selectHeldPDUJSONStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectHeldPDUJSON: rows.close() failed")
+	var held []types.HeldPDU
+	var lastEventID string
+	for rows.Next() {
+		var eventID string
+		var content []byte
+		var keyVersion int
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&eventID, &content, &keyVersion, &serverName); err != nil {
+			return nil, err
+		}
+		// The rows for each event are adjacent, so each event only needs
+		// decrypting once.
+		if eventID == lastEventID {
+			last := &held[len(held)-1]
+			last.Destinations = append(last.Destinations, serverName)
+			continue
+		}
+		event, err := s.decryptPDUJSON(content, keyVersion)
+		if err != nil {
+			return nil, err
+		}
+		held = append(held, types.HeldPDU{Event: event, Destinations: []gomatrixserverlib.ServerName{serverName}})
+		lastEventID = eventID
+	}
+	return held, rows.Err()
+}
+
+// decryptPDUJSON decrypts and parses the stored JSON of an event.
+func (s *queuePDUJSONStatements) decryptPDUJSON(
+	content []byte, keyVersion int,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	eventJSON, err := s.cipher.Decrypt(content, keyVersion)
+	if err != nil {
+		return nil, err
+	}
+	var event gomatrixserverlib.HeaderedEvent
+	if err = json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const tombstonedRoomsSchema = `
+-- The tombstoned_rooms table stores the IDs of rooms which have been replaced
+-- by another room. Events in these rooms are no longer fanned out to the
+-- servers in the room, other than the state events.
+CREATE TABLE IF NOT EXISTS federationsender_tombstoned_rooms (
+    -- The string ID of the room
+    room_id TEXT PRIMARY KEY
+);`
+
+const insertTombstonedRoomSQL = "" +
+	"INSERT INTO federationsender_tombstoned_rooms (room_id) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectTombstonedRoomSQL = "" +
+	"SELECT room_id FROM federationsender_tombstoned_rooms WHERE room_id = $1"
+
+const deleteTombstonedRoomSQL = "" +
+	"DELETE FROM federationsender_tombstoned_rooms WHERE room_id = $1"
+
+type tombstonedRoomsStatements struct {
+	insertTombstonedRoomStmt *sql.Stmt
+	selectTombstonedRoomStmt *sql.Stmt
+	deleteTombstonedRoomStmt *sql.Stmt
+}
+
+func (s *tombstonedRoomsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertTombstonedRoomStmt, err = db.Prepare(insertTombstonedRoomSQL); err != nil {
+		return
+	}
+	if s.selectTombstonedRoomStmt, err = db.Prepare(selectTombstonedRoomSQL); err != nil {
+		return
+	}
+	if s.deleteTombstonedRoomStmt, err = db.Prepare(deleteTombstonedRoomSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertTombstonedRoom marks the room as tombstoned, if it wasn't already.
+func (s *tombstonedRoomsStatements) insertTombstonedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.insertTombstonedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// selectTombstonedRoom returns whether the room has been tombstoned.
+func (s *tombstonedRoomsStatements) selectTombstonedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (bool, error) {
+	var id string
+	stmt := common.TxStmt(txn, s.selectTombstonedRoomStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteTombstonedRoom marks the room as no longer tombstoned.
+func (s *tombstonedRoomsStatements) deleteTombstonedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.deleteTombstonedRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const destinationTransactionLimitsSchema = `
+-- The destination_transaction_limits table stores the limits on the size of
+-- the transactions sent to a destination, where an operator has overridden the
+-- defaults.
+CREATE TABLE IF NOT EXISTS federationsender_destination_transaction_limits (
+    -- The destination server name
+    server_name TEXT PRIMARY KEY,
+    -- The maximum number of PDUs in a transaction, or 0 for no limit
+    max_pdus INTEGER NOT NULL,
+    -- The maximum number of EDUs in a transaction, or 0 for no limit
+    max_edus INTEGER NOT NULL,
+    -- The maximum size of the PDUs and EDUs in a transaction in bytes, or 0
+    -- for no limit
+    max_bytes INTEGER NOT NULL
+);`
+
+const upsertDestinationTransactionLimitsSQL = "" +
+	"INSERT INTO federationsender_destination_transaction_limits (server_name, max_pdus, max_edus, max_bytes)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name) DO UPDATE SET max_pdus = $2, max_edus = $3, max_bytes = $4"
+
+const deleteDestinationTransactionLimitsSQL = "" +
+	"DELETE FROM federationsender_destination_transaction_limits WHERE server_name = $1"
+
+const selectDestinationTransactionLimitsSQL = "" +
+	"SELECT max_pdus, max_edus, max_bytes FROM federationsender_destination_transaction_limits" +
+	" WHERE server_name = $1"
+
+type destinationTransactionLimitsStatements struct {
+	upsertDestinationTransactionLimitsStmt *sql.Stmt
+	deleteDestinationTransactionLimitsStmt *sql.Stmt
+	selectDestinationTransactionLimitsStmt *sql.Stmt
+}
+
+func (s *destinationTransactionLimitsStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertDestinationTransactionLimitsStmt, err = db.Prepare(upsertDestinationTransactionLimitsSQL); err != nil {
+		return
+	}
+	if s.deleteDestinationTransactionLimitsStmt, err = db.Prepare(deleteDestinationTransactionLimitsSQL); err != nil {
+		return
+	}
+	if s.selectDestinationTransactionLimitsStmt, err = db.Prepare(selectDestinationTransactionLimitsSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertDestinationTransactionLimits sets the transaction limits for the
+// destination.
+func (s *destinationTransactionLimitsStatements) upsertDestinationTransactionLimits(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	limits types.TransactionLimits,
+) error {
+	stmt := common.TxStmt(txn, s.upsertDestinationTransactionLimitsStmt)
+	_, err := stmt.ExecContext(ctx, serverName, limits.MaxPDUs, limits.MaxEDUs, limits.MaxBytes)
+	return err
+}
+
+// deleteDestinationTransactionLimits removes the transaction limits for the
+// destination, so that the defaults are used instead.
+func (s *destinationTransactionLimitsStatements) deleteDestinationTransactionLimits(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := common.TxStmt(txn, s.deleteDestinationTransactionLimitsStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+// selectDestinationTransactionLimits returns the transaction limits for the
+// destination, and whether they have been set.
+func (s *destinationTransactionLimitsStatements) selectDestinationTransactionLimits(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (limits types.TransactionLimits, ok bool, err error) {
+	stmt := common.TxStmt(txn, s.selectDestinationTransactionLimitsStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&limits.MaxPDUs, &limits.MaxEDUs, &limits.MaxBytes)
+	if err == sql.ErrNoRows {
+		return types.TransactionLimits{}, false, nil
+	}
+	return limits, err == nil, err
+}
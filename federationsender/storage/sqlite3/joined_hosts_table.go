@@ -55,17 +55,22 @@ const selectJoinedHostsSQL = "" +
 	"SELECT event_id, server_name FROM federationsender_joined_hosts" +
 	" WHERE room_id = $1"
 
+const selectJoinedHostServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_joined_hosts" +
+	" WHERE room_id = $1 ORDER BY server_name ASC"
+
+const deleteJoinedHostsForRoomSQL = "" +
+	"DELETE FROM federationsender_joined_hosts WHERE room_id = $1"
+
 type joinedHostsStatements struct {
-	insertJoinedHostsStmt *sql.Stmt
-	deleteJoinedHostsStmt *sql.Stmt
-	selectJoinedHostsStmt *sql.Stmt
+	insertJoinedHostsStmt           *sql.Stmt
+	deleteJoinedHostsStmt           *sql.Stmt
+	selectJoinedHostsStmt           *sql.Stmt
+	selectJoinedHostServerNamesStmt *sql.Stmt
+	deleteJoinedHostsForRoomStmt    *sql.Stmt
 }
 
 func (s *joinedHostsStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(joinedHostsSchema)
-	if err != nil {
-		return
-	}
 	if s.insertJoinedHostsStmt, err = db.Prepare(insertJoinedHostsSQL); err != nil {
 		return
 	}
@@ -75,6 +80,12 @@ func (s *joinedHostsStatements) prepare(db *sql.DB) (err error) {
 	if s.selectJoinedHostsStmt, err = db.Prepare(selectJoinedHostsSQL); err != nil {
 		return
 	}
+	if s.selectJoinedHostServerNamesStmt, err = db.Prepare(selectJoinedHostServerNamesSQL); err != nil {
+		return
+	}
+	if s.deleteJoinedHostsForRoomStmt, err = db.Prepare(deleteJoinedHostsForRoomSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -114,6 +125,26 @@ func (s *joinedHostsStatements) selectJoinedHosts(
 	return joinedHostsFromStmt(ctx, s.selectJoinedHostsStmt, roomID)
 }
 
+func (s *joinedHostsStatements) selectJoinedHostServerNames(
+	ctx context.Context, roomID string,
+) ([]gomatrixserverlib.ServerName, error) {
+	rows, err := s.selectJoinedHostServerNamesStmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectJoinedHostServerNames: rows.close() failed")
+
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName string
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, gomatrixserverlib.ServerName(serverName))
+	}
+	return result, rows.Err()
+}
+
 func joinedHostsFromStmt(
 	ctx context.Context, stmt *sql.Stmt, roomID string,
 ) ([]types.JoinedHost, error) {
@@ -137,3 +168,11 @@ func joinedHostsFromStmt(
 
 	return result, nil
 }
+
+// deleteJoinedHostsForRoom removes all joined hosts for the room.
+func (s *joinedHostsStatements) deleteJoinedHostsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.deleteJoinedHostsForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queuePDUsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_queue_pdus (
+    event_id TEXT NOT NULL,
+    server_name TEXT NOT NULL,
+    queued_ts INTEGER NOT NULL,
+    PRIMARY KEY (event_id, server_name)
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_pdus_queued_ts_idx
+    ON federationsender_queue_pdus (queued_ts);
+`
+
+// Events which are being held back because sending is paused for their room
+// have the ID of the room in held_room_id, and aren't pending until sending
+// is resumed.
+const queuePDUsHeldRoomSchema = `
+ALTER TABLE federationsender_queue_pdus ADD COLUMN held_room_id TEXT NOT NULL DEFAULT ''
+`
+
+const queuePDUsHeldRoomIndexSchema = `
+CREATE INDEX IF NOT EXISTS federationsender_queue_pdus_held_room_id_idx
+    ON federationsender_queue_pdus (held_room_id)
+`
+
+const insertQueuePDUSQL = "" +
+	"INSERT INTO federationsender_queue_pdus (event_id, server_name, queued_ts, held_room_id)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteQueuePDUSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE event_id = $1 AND server_name = $2"
+
+const selectDistinctQueuePDUsSQL = "" +
+	"SELECT event_id FROM federationsender_queue_pdus WHERE held_room_id = ''" +
+	" GROUP BY event_id ORDER BY MIN(queued_ts) ASC, event_id ASC LIMIT $1"
+
+const selectQueuePDUBacklogsSQL = "" +
+	"SELECT server_name, COUNT(*), MIN(queued_ts) FROM federationsender_queue_pdus" +
+	" WHERE held_room_id = ''" +
+	" GROUP BY server_name ORDER BY COUNT(*) DESC, server_name ASC LIMIT $1"
+
+const selectQueuePDUDestinationsSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue_pdus WHERE held_room_id = ''"
+
+const deleteQueuePDUsForServerSQL = "" +
+	"DELETE FROM federationsender_queue_pdus WHERE server_name = $1 AND held_room_id = ''"
+
+const selectHeldRoomsSQL = "" +
+	"SELECT DISTINCT held_room_id FROM federationsender_queue_pdus WHERE held_room_id <> ''"
+
+const releaseHeldQueuePDUsSQL = "" +
+	"UPDATE federationsender_queue_pdus SET held_room_id = '' WHERE held_room_id = $1"
+
+type queuePDUsStatements struct {
+	insertQueuePDUStmt             *sql.Stmt
+	deleteQueuePDUStmt             *sql.Stmt
+	selectDistinctQueuePDUsStmt    *sql.Stmt
+	selectQueuePDUBacklogsStmt     *sql.Stmt
+	selectQueuePDUDestinationsStmt *sql.Stmt
+	deleteQueuePDUsForServerStmt   *sql.Stmt
+	selectHeldRoomsStmt            *sql.Stmt
+	releaseHeldQueuePDUsStmt       *sql.Stmt
+}
+
+func (s *queuePDUsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertQueuePDUStmt, err = db.Prepare(insertQueuePDUSQL); err != nil {
+		return
+	}
+	if s.deleteQueuePDUStmt, err = db.Prepare(deleteQueuePDUSQL); err != nil {
+		return
+	}
+	if s.selectDistinctQueuePDUsStmt, err = db.Prepare(selectDistinctQueuePDUsSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUBacklogsStmt, err = db.Prepare(selectQueuePDUBacklogsSQL); err != nil {
+		return
+	}
+	if s.selectQueuePDUDestinationsStmt, err = db.Prepare(selectQueuePDUDestinationsSQL); err != nil {
+		return
+	}
+	if s.deleteQueuePDUsForServerStmt, err = db.Prepare(deleteQueuePDUsForServerSQL); err != nil {
+		return
+	}
+	if s.selectHeldRoomsStmt, err = db.Prepare(selectHeldRoomsSQL); err != nil {
+		return
+	}
+	if s.releaseHeldQueuePDUsStmt, err = db.Prepare(releaseHeldQueuePDUsSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertQueuePDU records that the event is queued for the destination. If
+// heldRoomID isn't empty then the event is held back until sending is resumed
+// for that room.
+func (s *queuePDUsStatements) insertQueuePDU(
+	ctx context.Context, txn *sql.Tx, eventID string,
+	serverName gomatrixserverlib.ServerName, queuedTS gomatrixserverlib.Timestamp,
+	heldRoomID string,
+) error {
+	stmt := common.TxStmt(txn, s.insertQueuePDUStmt)
+	_, err := stmt.ExecContext(ctx, eventID, serverName, queuedTS, heldRoomID)
+	return err
+}
+
+// releaseHeldQueuePDUs makes the events held back for the room pending for
+// their destinations.
+func (s *queuePDUsStatements) releaseHeldQueuePDUs(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := common.TxStmt(txn, s.releaseHeldQueuePDUsStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+// selectHeldRooms returns the IDs of the rooms which have events held back.
+func (s *queuePDUsStatements) selectHeldRooms(
+	ctx context.Context,
+) ([]string, error) {
+	rows, err := s.selectHeldRoomsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectHeldRooms: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+// deleteQueuePDU records that the event is no longer queued for the
+// destination.
+func (s *queuePDUsStatements) deleteQueuePDU(
+	ctx context.Context, txn *sql.Tx, eventID string,
+	serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueuePDUStmt)
+	_, err := stmt.ExecContext(ctx, eventID, serverName)
+	return err
+}
+
+// deleteQueuePDUsForServer records that no events are queued for the
+// destination any more. Events held back for paused rooms are kept.
+func (s *queuePDUsStatements) deleteQueuePDUsForServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueuePDUsForServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+// selectDistinctQueuePDUs returns up to limit distinct event IDs which are
+// queued for at least one destination, oldest first.
+func (s *queuePDUsStatements) selectDistinctQueuePDUs(
+	ctx context.Context, limit int,
+) ([]string, error) {
+	rows, err := s.selectDistinctQueuePDUsStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectDistinctQueuePDUs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectQueuePDUBacklogs returns up to limit destinations which have events
+// queued for them, ordered by the number of events queued, largest first.
+func (s *queuePDUsStatements) selectQueuePDUBacklogs(
+	ctx context.Context, limit int,
+) ([]types.DestinationBacklog, error) {
+	rows, err := s.selectQueuePDUBacklogsStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueuePDUBacklogs: rows.close() failed")
+	var backlogs []types.DestinationBacklog
+	for rows.Next() {
+		var backlog types.DestinationBacklog
+		if err = rows.Scan(&backlog.ServerName, &backlog.PendingEvents, &backlog.OldestQueuedTS); err != nil {
+			return nil, err
+		}
+		backlogs = append(backlogs, backlog)
+	}
+	return backlogs, rows.Err()
+}
+
+// selectQueuePDUDestinations returns the destinations which have events
+// queued for them.
+func (s *queuePDUsStatements) selectQueuePDUDestinations(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	rows, err := s.selectQueuePDUDestinationsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQueuePDUDestinations: rows.close() failed")
+	var serverNames []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		serverNames = append(serverNames, serverName)
+	}
+	return serverNames, rows.Err()
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueThroughputSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_queue_throughput (
+    server_name TEXT NOT NULL,
+    bucket_ts INTEGER NOT NULL,
+    enqueued INTEGER NOT NULL DEFAULT 0,
+    dequeued INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (server_name, bucket_ts)
+);
+`
+
+const upsertQueueThroughputSQL = "" +
+	"INSERT INTO federationsender_queue_throughput (server_name, bucket_ts, enqueued, dequeued)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name, bucket_ts) DO UPDATE SET" +
+	" enqueued = federationsender_queue_throughput.enqueued + excluded.enqueued," +
+	" dequeued = federationsender_queue_throughput.dequeued + excluded.dequeued"
+
+const selectQueueThroughputSQL = "" +
+	"SELECT COALESCE(SUM(enqueued), 0), COALESCE(SUM(dequeued), 0)" +
+	" FROM federationsender_queue_throughput" +
+	" WHERE server_name = $1 AND bucket_ts >= $2"
+
+const deleteQueueThroughputBeforeSQL = "" +
+	"DELETE FROM federationsender_queue_throughput WHERE bucket_ts < $1"
+
+type queueThroughputStatements struct {
+	upsertQueueThroughputStmt       *sql.Stmt
+	selectQueueThroughputStmt       *sql.Stmt
+	deleteQueueThroughputBeforeStmt *sql.Stmt
+}
+
+func (s *queueThroughputStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertQueueThroughputStmt, err = db.Prepare(upsertQueueThroughputSQL); err != nil {
+		return
+	}
+	if s.selectQueueThroughputStmt, err = db.Prepare(selectQueueThroughputSQL); err != nil {
+		return
+	}
+	if s.deleteQueueThroughputBeforeStmt, err = db.Prepare(deleteQueueThroughputBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertQueueThroughput adds to the enqueued and dequeued counts for the
+// destination in the bucket, creating the bucket if it doesn't exist.
+func (s *queueThroughputStatements) upsertQueueThroughput(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	bucketTS gomatrixserverlib.Timestamp, enqueued, dequeued int64,
+) error {
+	stmt := common.TxStmt(txn, s.upsertQueueThroughputStmt)
+	_, err := stmt.ExecContext(ctx, serverName, bucketTS, enqueued, dequeued)
+	return err
+}
+
+// selectQueueThroughput returns the total enqueued and dequeued counts for the
+// destination in all buckets starting at or after the given timestamp.
+func (s *queueThroughputStatements) selectQueueThroughput(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	sinceTS gomatrixserverlib.Timestamp,
+) (enqueued, dequeued int64, err error) {
+	err = s.selectQueueThroughputStmt.QueryRowContext(
+		ctx, serverName, sinceTS,
+	).Scan(&enqueued, &dequeued)
+	return
+}
+
+// deleteQueueThroughputBefore removes all buckets starting before the given
+// timestamp, for all destinations.
+func (s *queueThroughputStatements) deleteQueueThroughputBefore(
+	ctx context.Context, txn *sql.Tx, beforeTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := common.TxStmt(txn, s.deleteQueueThroughputBeforeStmt)
+	_, err := stmt.ExecContext(ctx, beforeTS)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const roomSchema = `
@@ -40,20 +41,26 @@ const selectRoomForUpdateSQL = "" +
 	"SELECT last_event_id FROM federationsender_rooms WHERE room_id = $1"
 
 const updateRoomSQL = "" +
-	"UPDATE federationsender_rooms SET last_event_id = $2 WHERE room_id = $1"
+	"UPDATE federationsender_rooms SET last_event_id = $1 WHERE room_id = $2"
+
+const deleteRoomSQL = "" +
+	"DELETE FROM federationsender_rooms WHERE room_id = $1"
+
+const selectLastEventIDsForServerSQL = "" +
+	"SELECT last_event_id FROM federationsender_rooms" +
+	" WHERE last_event_id != '' AND room_id IN (" +
+	"SELECT room_id FROM federationsender_joined_hosts WHERE server_name = $1)"
 
 type roomStatements struct {
 	insertRoomStmt          *sql.Stmt
 	selectRoomForUpdateStmt *sql.Stmt
 	updateRoomStmt          *sql.Stmt
+	deleteRoomStmt          *sql.Stmt
+
+	selectLastEventIDsForServerStmt *sql.Stmt
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(roomSchema)
-	if err != nil {
-		return
-	}
-
 	if s.insertRoomStmt, err = db.Prepare(insertRoomSQL); err != nil {
 		return
 	}
@@ -63,6 +70,12 @@ func (s *roomStatements) prepare(db *sql.DB) (err error) {
 	if s.updateRoomStmt, err = db.Prepare(updateRoomSQL); err != nil {
 		return
 	}
+	if s.deleteRoomStmt, err = db.Prepare(deleteRoomSQL); err != nil {
+		return
+	}
+	if s.selectLastEventIDsForServerStmt, err = db.Prepare(selectLastEventIDsForServerSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -96,6 +109,35 @@ func (s *roomStatements) updateRoom(
 	ctx context.Context, txn *sql.Tx, roomID, lastEventID string,
 ) error {
 	stmt := common.TxStmt(txn, s.updateRoomStmt)
-	_, err := stmt.ExecContext(ctx, roomID, lastEventID)
+	_, err := stmt.ExecContext(ctx, lastEventID, roomID)
 	return err
 }
+
+// deleteRoom removes the room.
+func (s *roomStatements) deleteRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.deleteRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// selectLastEventIDsForServer returns the last_event_id of each room that the
+// server has users joined to.
+func (s *roomStatements) selectLastEventIDsForServer(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]string, error) {
+	rows, err := s.selectLastEventIDsForServerStmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectLastEventIDsForServer: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
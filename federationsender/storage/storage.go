@@ -20,22 +20,27 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
+	"github.com/matrix-org/dendrite/federationsender/storage/mysql"
 	"github.com/matrix-org/dendrite/federationsender/storage/postgres"
 	"github.com/matrix-org/dendrite/federationsender/storage/sqlite3"
 )
 
-// NewDatabase opens a new database
-func NewDatabase(dataSourceName string, dbProperties common.DbProperties) (Database, error) {
+// NewDatabase opens a new database. The queued events and EDUs are encrypted
+// with queueCipher, or stored unencrypted if it is nil.
+func NewDatabase(dataSourceName string, dbProperties common.DbProperties, queueCipher *encryption.Cipher) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, dbProperties, queueCipher)
 	}
 	switch uri.Scheme {
+	case "mysql":
+		return mysql.NewDatabase(dataSourceName, dbProperties, queueCipher)
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName)
-	case "postgres":
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return sqlite3.NewDatabase(dataSourceName, queueCipher)
+	case "postgres", "cockroachdb":
+		return postgres.NewDatabase(dataSourceName, dbProperties, queueCipher)
 	default:
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, dbProperties, queueCipher)
 	}
 }
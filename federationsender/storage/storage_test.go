@@ -0,0 +1,595 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	ctx             = context.Background()
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testDestination = gomatrixserverlib.ServerName("pale.court")
+	testRoomID      = fmt.Sprintf("!hallownest:%s", testOrigin)
+	testUserID      = fmt.Sprintf("@hornet:%s", testOrigin)
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testKeyID       = gomatrixserverlib.KeyID("ed25519:storage_test")
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+// mustCreateDatabase creates an empty database, which is on the server named by
+// DENDRITE_TEST_DATABASE if it is set. It returns the data source so that the
+// database can be opened again, and a function which removes it.
+func mustCreateDatabase(t *testing.T) (string, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	return dataSource, closeDB
+}
+
+func mustOpenDatabase(t *testing.T, dataSource string, queueCipher *encryption.Cipher) storage.Database {
+	db, err := storage.NewDatabase(dataSource, nil, queueCipher)
+	if err != nil {
+		t.Fatalf("storage.NewDatabase returned %s", err)
+	}
+	return db
+}
+
+func mustCreateEvent(t *testing.T, body string) *gomatrixserverlib.HeaderedEvent {
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:  testRoomID,
+		Sender:  testUserID,
+		Type:    "m.room.message",
+		Content: []byte(fmt.Sprintf(`{"body":%q,"msgtype":"m.text"}`, body)),
+		Depth:   1,
+	}
+	e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	h := e.Headered(testRoomVersion)
+	return &h
+}
+
+func mustNewCipher(t *testing.T, version int, keys map[int][]byte) *encryption.Cipher {
+	c, err := encryption.NewCipher(version, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestQueueEncryption(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	key1 := bytes.Repeat([]byte{1}, encryption.KeySize)
+	key2 := bytes.Repeat([]byte{2}, encryption.KeySize)
+	destinations := []gomatrixserverlib.ServerName{testDestination}
+
+	// Content queued before encryption was turned on stays readable.
+	db := mustOpenDatabase(t, dataSource, nil)
+	plain := mustCreateEvent(t, "plain")
+	if err := db.AssociatePDUWithDestinations(ctx, plain, destinations); err != nil {
+		t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+	}
+
+	db = mustOpenDatabase(t, dataSource, mustNewCipher(t, 1, map[int][]byte{1: key1}))
+	secret := mustCreateEvent(t, "secret")
+	if err := db.AssociatePDUWithDestinations(ctx, secret, destinations); err != nil {
+		t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"user_id":"@hornet:hollow.knight"}`)}
+	if _, err := db.AssociateEDUWithDestinations(ctx, edu, destinations); err != nil {
+		t.Fatalf("AssociateEDUWithDestinations returned %s", err)
+	}
+
+	// Without the key the encrypted content can't be read.
+	unkeyed := mustOpenDatabase(t, dataSource, nil)
+	if _, err := unkeyed.PendingPDUs(ctx, testDestination); err == nil {
+		t.Errorf("expected reading encrypted events without the key to fail")
+	}
+	if _, err := unkeyed.PendingEDUs(ctx, testDestination); err == nil {
+		t.Errorf("expected reading encrypted EDUs without the key to fail")
+	}
+
+	// After rotating the key, content encrypted with either key can be read.
+	db = mustOpenDatabase(t, dataSource, mustNewCipher(t, 2, map[int][]byte{1: key1, 2: key2}))
+	rotated := mustCreateEvent(t, "rotated")
+	if err := db.AssociatePDUWithDestinations(ctx, rotated, destinations); err != nil {
+		t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+	}
+	events, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 pending events, got %d", len(events))
+	}
+	for i, want := range []*gomatrixserverlib.HeaderedEvent{plain, secret, rotated} {
+		if events[i].EventID() != want.EventID() || !bytes.Equal(events[i].Content(), want.Content()) {
+			t.Errorf("pending event %d: expected %s, got %s", i, want.EventID(), events[i].EventID())
+		}
+	}
+	edus, err := db.PendingEDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingEDUs returned %s", err)
+	}
+	if len(edus) != 1 || edus[0].EDU.Type != edu.Type || !bytes.Equal(edus[0].EDU.Content, edu.Content) {
+		t.Errorf("expected the EDU to be decrypted, got %+v", edus)
+	}
+
+	// The old key is needed until everything queued with it has been sent.
+	newOnly := mustOpenDatabase(t, dataSource, mustNewCipher(t, 2, map[int][]byte{2: key2}))
+	if _, err = newOnly.PendingPDUs(ctx, testDestination); err == nil {
+		t.Errorf("expected reading events encrypted with a removed key to fail")
+	}
+}
+
+func TestHoldPDUs(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherDestination := gomatrixserverlib.ServerName("white.palace")
+	destinations := []gomatrixserverlib.ServerName{testDestination, otherDestination}
+
+	if err := db.SetRoomSendPaused(ctx, testRoomID, true); err != nil {
+		t.Fatalf("SetRoomSendPaused returned %s", err)
+	}
+	paused, err := db.PausedRooms(ctx)
+	if err != nil {
+		t.Fatalf("PausedRooms returned %s", err)
+	}
+	if len(paused) != 1 || paused[0] != testRoomID {
+		t.Errorf("expected %s to be paused, got %v", testRoomID, paused)
+	}
+
+	first, second := mustCreateEvent(t, "first"), mustCreateEvent(t, "second")
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{first, second} {
+		if err = db.HoldPDUWithDestinations(ctx, ev, destinations); err != nil {
+			t.Fatalf("HoldPDUWithDestinations returned %s", err)
+		}
+	}
+
+	// Held events aren't pending, but survive a restart.
+	db = mustOpenDatabase(t, dataSource, nil)
+	pending, err := db.PendingDestinations(ctx)
+	if err != nil {
+		t.Fatalf("PendingDestinations returned %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending destinations while events are held, got %v", pending)
+	}
+	held, err := db.HeldRooms(ctx)
+	if err != nil {
+		t.Fatalf("HeldRooms returned %s", err)
+	}
+	if len(held) != 1 || held[0] != testRoomID {
+		t.Errorf("expected %s to have held events, got %v", testRoomID, held)
+	}
+
+	released, err := db.ReleaseHeldPDUs(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("ReleaseHeldPDUs returned %s", err)
+	}
+	if len(released) != 2 {
+		t.Fatalf("expected 2 released events, got %d", len(released))
+	}
+	for i, want := range []*gomatrixserverlib.HeaderedEvent{first, second} {
+		if released[i].Event.EventID() != want.EventID() {
+			t.Errorf("released event %d: expected %s, got %s", i, want.EventID(), released[i].Event.EventID())
+		}
+		if len(released[i].Destinations) != 2 || released[i].Destinations[0] != testDestination || released[i].Destinations[1] != otherDestination {
+			t.Errorf("released event %d: expected destinations %v, got %v", i, destinations, released[i].Destinations)
+		}
+	}
+
+	// Released events are pending for their destinations, and are only
+	// released once.
+	events, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(events) != 2 || events[0].EventID() != first.EventID() || events[1].EventID() != second.EventID() {
+		t.Errorf("expected the released events to be pending in order, got %d events", len(events))
+	}
+	if held, err = db.HeldRooms(ctx); err != nil || len(held) != 0 {
+		t.Errorf("expected no rooms with held events, got %v (err %v)", held, err)
+	}
+	if released, err = db.ReleaseHeldPDUs(ctx, testRoomID); err != nil || len(released) != 0 {
+		t.Errorf("expected nothing more to release, got %d events (err %v)", len(released), err)
+	}
+}
+
+func TestPendingQueue(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherDestination := gomatrixserverlib.ServerName("white.palace")
+	destinations := []gomatrixserverlib.ServerName{testDestination, otherDestination}
+
+	first, second := mustCreateEvent(t, "first"), mustCreateEvent(t, "second")
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{first, second} {
+		if err := db.AssociatePDUWithDestinations(ctx, ev, destinations); err != nil {
+			t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+		}
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{"user_id":"@hornet:hollow.knight"}`)}
+	queued, err := db.AssociateEDUWithDestinations(ctx, edu, []gomatrixserverlib.ServerName{testDestination})
+	if err != nil {
+		t.Fatalf("AssociateEDUWithDestinations returned %s", err)
+	}
+	if queued[testDestination] == nil || queued[testDestination].NID == 0 {
+		t.Fatalf("expected the EDU to be queued with a NID, got %+v", queued)
+	}
+
+	// The queue survives a restart, in order.
+	db = mustOpenDatabase(t, dataSource, nil)
+	pending, err := db.PendingDestinations(ctx)
+	if err != nil {
+		t.Fatalf("PendingDestinations returned %s", err)
+	}
+	if len(pending) != 2 {
+		t.Errorf("expected 2 pending destinations, got %v", pending)
+	}
+	for _, destination := range destinations {
+		events, perr := db.PendingPDUs(ctx, destination)
+		if perr != nil {
+			t.Fatalf("PendingPDUs returned %s", perr)
+		}
+		if len(events) != 2 || events[0].EventID() != first.EventID() || events[1].EventID() != second.EventID() {
+			t.Errorf("%s: expected the events to be pending in order, got %d events", destination, len(events))
+		}
+	}
+	edus, err := db.PendingEDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingEDUs returned %s", err)
+	}
+	if len(edus) != 1 || edus[0].NID != queued[testDestination].NID || edus[0].EDU.Type != edu.Type {
+		t.Errorf("expected the EDU to be pending, got %+v", edus)
+	}
+
+	// A failed attempt leaves everything pending.
+	if err = db.RecordSendAttempt(ctx, testDestination, false, []string{first.EventID()}, []int64{edus[0].NID}); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	events, err := db.PendingPDUs(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("expected 2 pending events after a failed attempt, got %d", len(events))
+	}
+
+	// A successful attempt removes what was sent to that destination only.
+	if err = db.RecordSendAttempt(ctx, testDestination, true, []string{first.EventID()}, []int64{edus[0].NID}); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	if events, err = db.PendingPDUs(ctx, testDestination); err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(events) != 1 || events[0].EventID() != second.EventID() {
+		t.Errorf("expected only the second event to be pending, got %d events", len(events))
+	}
+	if edus, err = db.PendingEDUs(ctx, testDestination); err != nil || len(edus) != 0 {
+		t.Errorf("expected no pending EDUs, got %d (err %v)", len(edus), err)
+	}
+	// The other destination still needs the JSON of the sent event.
+	if events, err = db.PendingPDUs(ctx, otherDestination); err != nil {
+		t.Fatalf("PendingPDUs returned %s", err)
+	}
+	if len(events) != 2 || events[0].EventID() != first.EventID() {
+		t.Errorf("expected both events to still be pending for %s, got %d events", otherDestination, len(events))
+	}
+
+	// Dropping the queue for one destination leaves the others alone.
+	if err = db.DeletePendingForDestination(ctx, otherDestination); err != nil {
+		t.Fatalf("DeletePendingForDestination returned %s", err)
+	}
+	if events, err = db.PendingPDUs(ctx, otherDestination); err != nil || len(events) != 0 {
+		t.Errorf("expected no pending events for %s, got %d (err %v)", otherDestination, len(events), err)
+	}
+	if events, err = db.PendingPDUs(ctx, testDestination); err != nil || len(events) != 1 {
+		t.Errorf("expected 1 pending event for %s, got %d (err %v)", testDestination, len(events), err)
+	}
+	if err = db.RecordSendAttempt(ctx, testDestination, true, []string{second.EventID()}, nil); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	if pending, err = db.PendingDestinations(ctx); err != nil || len(pending) != 0 {
+		t.Errorf("expected no pending destinations, got %v (err %v)", pending, err)
+	}
+}
+
+func TestLatestEventIDsForDestination(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+
+	for _, room := range []struct{ roomID, eventID string }{
+		{testRoomID, "$first"}, {otherRoomID, "$other"},
+	} {
+		host := types.JoinedHost{MemberEventID: room.eventID + "_member", ServerName: testDestination}
+		if _, err := db.UpdateRoom(ctx, room.roomID, "", room.eventID, []types.JoinedHost{host}, nil); err != nil {
+			t.Fatalf("UpdateRoom returned %s", err)
+		}
+	}
+	if _, err := db.UpdateRoom(ctx, testRoomID, "$first", "$second", nil, nil); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+
+	eventIDs, err := db.LatestEventIDsForDestination(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("LatestEventIDsForDestination returned %s", err)
+	}
+	sort.Strings(eventIDs)
+	if want := "[$other $second]"; fmt.Sprint(eventIDs) != want {
+		t.Errorf("expected latest events %s, got %v", want, eventIDs)
+	}
+	if eventIDs, err = db.LatestEventIDsForDestination(ctx, "white.palace"); err != nil || len(eventIDs) != 0 {
+		t.Errorf("expected no latest events for a server which isn't joined, got %v (err %v)", eventIDs, err)
+	}
+}
+
+func TestQueueThroughput(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherDestination := gomatrixserverlib.ServerName("white.palace")
+
+	// The counts add up within the window, and are kept per destination.
+	for _, counts := range [][2]int64{{6, 2}, {4, 1}} {
+		if err := db.RecordQueueThroughput(ctx, testDestination, counts[0], counts[1]); err != nil {
+			t.Fatalf("RecordQueueThroughput returned %s", err)
+		}
+	}
+	if err := db.RecordQueueThroughput(ctx, otherDestination, 100, 100); err != nil {
+		t.Fatalf("RecordQueueThroughput returned %s", err)
+	}
+	enqueued, dequeued, err := db.QueueThroughput(ctx, testDestination)
+	if err != nil {
+		t.Fatalf("QueueThroughput returned %s", err)
+	}
+	minutes := types.QueueThroughputWindow.Minutes()
+	if enqueued != 10/minutes || dequeued != 3/minutes {
+		t.Errorf("expected %v enqueued and %v dequeued per minute, got %v and %v", 10/minutes, 3/minutes, enqueued, dequeued)
+	}
+
+	// A destination with nothing recorded has no throughput.
+	if enqueued, dequeued, err = db.QueueThroughput(ctx, "pale.court.invalid"); err != nil || enqueued != 0 || dequeued != 0 {
+		t.Errorf("expected no throughput, got %v and %v (err %v)", enqueued, dequeued, err)
+	}
+}
+
+func TestPruneSentEvents(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	eventIDs := []string{"$1", "$2", "$3", "$4"}
+	if err := db.RecordSentEvents(ctx, testDestination, eventIDs); err != nil {
+		t.Fatalf("RecordSentEvents returned %s", err)
+	}
+	if err := db.RecordSentEvents(ctx, "white.palace", eventIDs[:2]); err != nil {
+		t.Fatalf("RecordSentEvents returned %s", err)
+	}
+
+	// Nothing was sent before an hour ago.
+	deleted, done, err := db.PruneSentEvents(ctx, time.Now().Add(-time.Hour), 2)
+	if err != nil || deleted != 0 || !done {
+		t.Errorf("expected nothing to prune, got %d deleted, done %v (err %v)", deleted, done, err)
+	}
+
+	// Everything is pruned two at a time, and it's done as soon as the last
+	// batch is deleted even though the batch was full.
+	cutoff := time.Now().Add(time.Minute)
+	for i, want := range []struct {
+		deleted int
+		done    bool
+	}{{2, false}, {2, false}, {2, true}, {0, true}} {
+		deleted, done, err = db.PruneSentEvents(ctx, cutoff, 2)
+		if err != nil {
+			t.Fatalf("PruneSentEvents returned %s", err)
+		}
+		if deleted != want.deleted || done != want.done {
+			t.Errorf("batch %d: expected %d deleted, done %v, got %d, %v", i, want.deleted, want.done, deleted, done)
+		}
+	}
+}
+
+func TestDistinctPendingEvents(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherDestination := gomatrixserverlib.ServerName("white.palace")
+
+	first, second, third := mustCreateEvent(t, "first"), mustCreateEvent(t, "second"), mustCreateEvent(t, "third")
+	for _, queued := range []struct {
+		event        *gomatrixserverlib.HeaderedEvent
+		destinations []gomatrixserverlib.ServerName
+	}{
+		{first, []gomatrixserverlib.ServerName{testDestination, otherDestination}},
+		{second, []gomatrixserverlib.ServerName{testDestination}},
+		{third, []gomatrixserverlib.ServerName{otherDestination}},
+	} {
+		if err := db.AssociatePDUWithDestinations(ctx, queued.event, queued.destinations); err != nil {
+			t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+		}
+	}
+
+	// The first event is only returned once although it is pending for both
+	// destinations.
+	for _, test := range []struct {
+		limit int
+		want  []string
+	}{
+		{10, []string{first.EventID(), second.EventID(), third.EventID()}},
+		{2, []string{first.EventID(), second.EventID()}},
+	} {
+		eventIDs, err := db.DistinctPendingEvents(ctx, test.limit)
+		if err != nil {
+			t.Fatalf("DistinctPendingEvents returned %s", err)
+		}
+		if fmt.Sprint(eventIDs) != fmt.Sprint(test.want) {
+			t.Errorf("limit %d: expected %v, got %v", test.limit, test.want, eventIDs)
+		}
+	}
+
+	// The first event is still pending until it is sent to both destinations.
+	if err := db.RecordSendAttempt(ctx, testDestination, true, []string{first.EventID()}, nil); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	eventIDs, err := db.DistinctPendingEvents(ctx, 10)
+	if err != nil || len(eventIDs) != 3 || eventIDs[0] != first.EventID() {
+		t.Errorf("expected the first event to still be pending, got %v (err %v)", eventIDs, err)
+	}
+	if err = db.RecordSendAttempt(ctx, otherDestination, true, []string{first.EventID()}, nil); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	want := []string{second.EventID(), third.EventID()}
+	if eventIDs, err = db.DistinctPendingEvents(ctx, 10); err != nil || fmt.Sprint(eventIDs) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v (err %v)", want, eventIDs, err)
+	}
+}
+
+func TestDestinationsByBacklog(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherDestination := gomatrixserverlib.ServerName("white.palace")
+
+	first, second, third := mustCreateEvent(t, "first"), mustCreateEvent(t, "second"), mustCreateEvent(t, "third")
+	if err := db.AssociatePDUWithDestinations(ctx, first, []gomatrixserverlib.ServerName{otherDestination}); err != nil {
+		t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+	}
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{second, third} {
+		if err := db.AssociatePDUWithDestinations(ctx, ev, []gomatrixserverlib.ServerName{testDestination}); err != nil {
+			t.Fatalf("AssociatePDUWithDestinations returned %s", err)
+		}
+	}
+
+	// The destination with the most pending events comes first, although
+	// the other destination has been waiting longer.
+	backlogs, err := db.DestinationsByBacklog(ctx, 10)
+	if err != nil {
+		t.Fatalf("DestinationsByBacklog returned %s", err)
+	}
+	if len(backlogs) != 2 {
+		t.Fatalf("expected 2 destinations, got %+v", backlogs)
+	}
+	if backlogs[0].ServerName != testDestination || backlogs[0].PendingEvents != 2 {
+		t.Errorf("expected 2 events pending for %s first, got %+v", testDestination, backlogs[0])
+	}
+	if backlogs[1].ServerName != otherDestination || backlogs[1].PendingEvents != 1 {
+		t.Errorf("expected 1 event pending for %s second, got %+v", otherDestination, backlogs[1])
+	}
+	if backlogs[0].OldestQueuedTS == 0 || backlogs[1].OldestQueuedTS > backlogs[0].OldestQueuedTS {
+		t.Errorf("expected the oldest queued times to be set in order, got %+v", backlogs)
+	}
+	if backlogs, err = db.DestinationsByBacklog(ctx, 1); err != nil || len(backlogs) != 1 || backlogs[0].ServerName != testDestination {
+		t.Errorf("expected only %s with a limit of 1, got %+v (err %v)", testDestination, backlogs, err)
+	}
+
+	// Destinations drop out once nothing is pending for them.
+	if err = db.RecordSendAttempt(ctx, otherDestination, true, []string{first.EventID()}, nil); err != nil {
+		t.Fatalf("RecordSendAttempt returned %s", err)
+	}
+	if backlogs, err = db.DestinationsByBacklog(ctx, 10); err != nil || len(backlogs) != 1 || backlogs[0].ServerName != testDestination {
+		t.Errorf("expected only %s to have a backlog, got %+v (err %v)", testDestination, backlogs, err)
+	}
+}
+
+func TestDestinationsForRoom(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+	otherRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+
+	// Two users on the test destination are joined, but it is only listed
+	// once.
+	hosts := []types.JoinedHost{
+		{MemberEventID: "$zote", ServerName: testDestination},
+		{MemberEventID: "$myla", ServerName: testDestination},
+		{MemberEventID: "$hornet", ServerName: testOrigin},
+	}
+	if _, err := db.UpdateRoom(ctx, testRoomID, "", "$first", hosts, nil); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+	otherHosts := []types.JoinedHost{{MemberEventID: "$sly", ServerName: "white.palace"}}
+	if _, err := db.UpdateRoom(ctx, otherRoomID, "", "$other", otherHosts, nil); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+	destinations, err := db.DestinationsForRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("DestinationsForRoom returned %s", err)
+	}
+	sort.Slice(destinations, func(i, j int) bool { return destinations[i] < destinations[j] })
+	if want := fmt.Sprint([]gomatrixserverlib.ServerName{testOrigin, testDestination}); fmt.Sprint(destinations) != want {
+		t.Errorf("expected destinations %s, got %v", want, destinations)
+	}
+
+	// The destination stays until both of its users have left.
+	if _, err = db.UpdateRoom(ctx, testRoomID, "$first", "$second", nil, []string{"$zote"}); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+	if destinations, err = db.DestinationsForRoom(ctx, testRoomID); err != nil || len(destinations) != 2 {
+		t.Errorf("expected 2 destinations, got %v (err %v)", destinations, err)
+	}
+	if _, err = db.UpdateRoom(ctx, testRoomID, "$second", "$third", nil, []string{"$myla", "$hornet"}); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+	if destinations, err = db.DestinationsForRoom(ctx, testRoomID); err != nil || len(destinations) != 0 {
+		t.Errorf("expected no destinations, got %v (err %v)", destinations, err)
+	}
+}
+
+func TestGlobalSendPaused(t *testing.T) {
+	dataSource, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	db := mustOpenDatabase(t, dataSource, nil)
+
+	if paused, err := db.IsGlobalSendPaused(ctx); err != nil || paused {
+		t.Fatalf("expected sending not to be paused, got %v (err %v)", paused, err)
+	}
+	// Pausing twice is the same as pausing once.
+	for i := 0; i < 2; i++ {
+		if err := db.SetGlobalSendPaused(ctx, true); err != nil {
+			t.Fatalf("SetGlobalSendPaused returned %s", err)
+		}
+	}
+	if paused, err := db.IsGlobalSendPaused(ctx); err != nil || !paused {
+		t.Fatalf("expected sending to be paused, got %v (err %v)", paused, err)
+	}
+	if err := db.SetGlobalSendPaused(ctx, false); err != nil {
+		t.Fatalf("SetGlobalSendPaused returned %s", err)
+	}
+	if paused, err := db.IsGlobalSendPaused(ctx); err != nil || paused {
+		t.Errorf("expected sending to be resumed, got %v (err %v)", paused, err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/storage/encryption"
 	"github.com/matrix-org/dendrite/federationsender/storage/sqlite3"
 )
 
@@ -26,6 +27,7 @@ import (
 func NewDatabase(
 	dataSourceName string,
 	dbProperties common.DbProperties, // nolint:unparam
+	queueCipher *encryption.Cipher,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
@@ -33,7 +35,7 @@ func NewDatabase(
 	}
 	switch uri.Scheme {
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName)
+		return sqlite3.NewDatabase(dataSourceName, queueCipher)
 	case "postgres":
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	default:
@@ -2,6 +2,7 @@ package types
 
 import (
 	"math"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -47,6 +48,18 @@ func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerS
 	return server
 }
 
+// Servers returns the statistics for every server that we have
+// interacted with.
+func (s *Statistics) Servers() map[gomatrixserverlib.ServerName]*ServerStatistics {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	servers := make(map[gomatrixserverlib.ServerName]*ServerStatistics, len(s.servers))
+	for serverName, server := range s.servers {
+		servers[serverName] = server
+	}
+	return servers
+}
+
 // ServerStatistics contains information about our interactions with a
 // remote federated host, e.g. how many times we were successful, how
 // many times we failed etc. It also manages the backoff time and black-
@@ -56,6 +69,7 @@ type ServerStatistics struct {
 	backoffUntil   atomic.Value  // time.Time to wait until before sending requests
 	failCounter    atomic.Uint32 // how many times have we failed?
 	successCounter atomic.Uint32 // how many times have we succeeded?
+	lastSuccess    atomic.Value  // time.Time of the last successful request
 }
 
 // Success updates the server statistics with a new successful
@@ -64,7 +78,18 @@ type ServerStatistics struct {
 // we will unblacklist it.
 func (s *ServerStatistics) Success() {
 	s.successCounter.Add(1)
+	s.lastSuccess.Store(time.Now())
+	s.failCounter.Store(0)
+	s.blacklisted.Store(false)
+}
+
+// ClearBackoff resets the failure counter, cancels any backoff
+// that is in progress and unblacklists the host, without counting
+// it as a successful request. This is useful when we find out by
+// some other means that the host is alive again.
+func (s *ServerStatistics) ClearBackoff() {
 	s.failCounter.Store(0)
+	s.backoffUntil.Store(time.Time{})
 	s.blacklisted.Store(false)
 }
 
@@ -89,8 +114,11 @@ func (s *ServerStatistics) Failure() bool {
 	// We're still under the threshold so work out the exponential
 	// backoff based on how many times we have failed already. The
 	// worker goroutine will wait until this time before processing
-	// anything from the queue.
+	// anything from the queue. Up to half as much again is added at
+	// random so that retries to servers which went down at the same
+	// time don't all happen at once.
 	backoffSeconds := time.Second * time.Duration(math.Exp2(float64(failCounter)))
+	backoffSeconds += time.Duration(rand.Int63n(int64(backoffSeconds / 2)))
 	s.backoffUntil.Store(
 		time.Now().Add(backoffSeconds),
 	)
@@ -120,3 +148,25 @@ func (s *ServerStatistics) Blacklisted() bool {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// FailureCount returns the number of consecutive failed requests.
+func (s *ServerStatistics) FailureCount() uint32 {
+	return s.failCounter.Load()
+}
+
+// LastSuccess returns when the last successful request was made, or
+// false if there hasn't been one since we started.
+func (s *ServerStatistics) LastSuccess() (time.Time, bool) {
+	t, ok := s.lastSuccess.Load().(time.Time)
+	return t, ok
+}
+
+// BackoffUntil returns when the backoff for the server ends, or false
+// if we aren't backing off from it.
+func (s *ServerStatistics) BackoffUntil() (time.Time, bool) {
+	t, ok := s.backoffUntil.Load().(time.Time)
+	if !ok || !t.After(time.Now()) {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -16,10 +16,19 @@ package types
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// QueueThroughputWindow is the rolling window over which the throughput of
+// the queue for each destination is averaged.
+const QueueThroughputWindow = 5 * time.Minute
+
+// DestinationSuccessRateWindow is the rolling window over which the success
+// rate of sending to each destination is calculated.
+const DestinationSuccessRateWindow = time.Hour
+
 // A JoinedHost is a server that is joined to a matrix room.
 type JoinedHost struct {
 	// The MemberEventID of a m.room.member join event.
@@ -28,6 +37,88 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// A DestinationBacklog is the number of events still pending for a
+// destination.
+type DestinationBacklog struct {
+	// The destination the events are pending for.
+	ServerName gomatrixserverlib.ServerName
+	// The number of events pending for the destination.
+	PendingEvents int64
+	// When the oldest event pending for the destination was queued.
+	OldestQueuedTS gomatrixserverlib.Timestamp
+}
+
+// A HeldPDU is an event which is being held back because sending is paused
+// for its room, along with the destinations it is to be sent to.
+type HeldPDU struct {
+	// The held event.
+	Event *gomatrixserverlib.HeaderedEvent
+	// The destinations to send the event to once sending is resumed.
+	Destinations []gomatrixserverlib.ServerName
+}
+
+// A DestinationQueueStatus describes the health of the queue of events for a
+// destination.
+type DestinationQueueStatus struct {
+	// The destination the queue is for.
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// The number of events pending for the destination.
+	PendingEvents int64 `json:"pending_events"`
+	// When the oldest event pending for the destination was queued, or 0 if
+	// there are none.
+	OldestPendingTS gomatrixserverlib.Timestamp `json:"oldest_pending_ts,omitempty"`
+	// Whether we have given up sending to the destination until it is known
+	// to be reachable again.
+	Blacklisted bool `json:"blacklisted"`
+	// The number of consecutive failed requests to the destination.
+	FailureCount uint32 `json:"failure_count"`
+	// When the current backoff for the destination ends, or 0 if we aren't
+	// backing off from it.
+	BackoffUntilTS gomatrixserverlib.Timestamp `json:"backoff_until_ts,omitempty"`
+	// When we last sent to the destination successfully, or 0 if we haven't
+	// since we started.
+	LastSuccessTS gomatrixserverlib.Timestamp `json:"last_success_ts,omitempty"`
+}
+
+// TransactionLimits are the limits on the size of the transactions sent to a
+// destination. Pending events are packed into each transaction in order until
+// the next one would exceed a limit. A limit of 0 means no limit.
+type TransactionLimits struct {
+	// The maximum number of PDUs in a transaction.
+	MaxPDUs int
+	// The maximum number of EDUs in a transaction.
+	MaxEDUs int
+	// The maximum size in bytes of the PDUs and EDUs in a transaction. The
+	// first event is always sent even if it is larger than this on its own.
+	MaxBytes int
+}
+
+// eduExpiries is how long after being queued EDUs of each type are still worth
+// sending. EDUs of other types, e.g. receipts and device list updates, never
+// expire, as the remote server would otherwise miss them altogether.
+var eduExpiries = map[string]time.Duration{
+	gomatrixserverlib.MTyping: time.Minute,
+	"m.presence":              5 * time.Minute,
+}
+
+// A QueuedEDU is an EDU which is queued to be sent to a destination.
+type QueuedEDU struct {
+	// The numeric ID of the EDU in the queue for the destination, or 0 if
+	// the queue isn't stored in a database.
+	NID int64
+	// When the EDU was queued.
+	QueuedTS gomatrixserverlib.Timestamp
+	// The EDU itself.
+	EDU *gomatrixserverlib.EDU
+}
+
+// Expired returns whether the EDU has been queued for so long that it is no
+// longer worth sending, e.g. a typing notification.
+func (e *QueuedEDU) Expired(now time.Time) bool {
+	expiry, ok := eduExpiries[e.EDU.Type]
+	return ok && now.Sub(e.QueuedTS.Time()) > expiry
+}
+
 type ServerNames []gomatrixserverlib.ServerName
 
 func (s ServerNames) Len() int           { return len(s) }
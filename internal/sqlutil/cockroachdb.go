@@ -0,0 +1,39 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import "strings"
+
+// CockroachDBScheme is the URL scheme of data source names that refer to
+// CockroachDB databases. These are opened with the Postgres storage
+// implementations, which only use features that CockroachDB supports, and
+// with the Postgres driver, since CockroachDB speaks the Postgres protocol.
+const CockroachDBScheme = "cockroachdb"
+
+// IsCockroachDB returns true if the data source name refers to a CockroachDB
+// database.
+func IsCockroachDB(dataSourceName string) bool {
+	return strings.HasPrefix(dataSourceName, CockroachDBScheme+"://")
+}
+
+// postgresDataSourceName converts a "cockroachdb://" URL into a "postgres://"
+// one that the Postgres driver accepts. Other data source names are returned
+// unchanged.
+func postgresDataSourceName(dataSourceName string) string {
+	if !IsCockroachDB(dataSourceName) {
+		return dataSourceName
+	}
+	return "postgres" + strings.TrimPrefix(dataSourceName, CockroachDBScheme)
+}
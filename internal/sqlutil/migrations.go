@@ -0,0 +1,198 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/sirupsen/logrus"
+)
+
+const migrationsSchema = `
+-- Records the schema migrations which have been applied to the database by
+-- each component. The same database may be shared by several components.
+CREATE TABLE IF NOT EXISTS dendrite_schema_migrations (
+    -- The component which the migration belongs to, e.g. "roomserver".
+    component VARCHAR(255) NOT NULL,
+    -- The version that the migration brought the component's schema to.
+    version BIGINT NOT NULL,
+    -- A description of the migration.
+    description TEXT NOT NULL,
+    -- When the migration was applied, in milliseconds since the epoch.
+    applied_ts BIGINT NOT NULL,
+    PRIMARY KEY (component, version)
+);
+`
+
+const selectMigrationVersionSQL = "" +
+	"SELECT COALESCE(MAX(version), 0) FROM dendrite_schema_migrations WHERE component = $1"
+
+const insertMigrationSQL = "" +
+	"INSERT INTO dendrite_schema_migrations (component, version, description, applied_ts)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const deleteMigrationSQL = "" +
+	"DELETE FROM dendrite_schema_migrations WHERE component = $1 AND version = $2"
+
+// A MigrationFunc applies or reverts a migration using the given transaction.
+type MigrationFunc func(ctx context.Context, txn *sql.Tx) error
+
+// A Migration is a versioned change to the schema of a component's database.
+type Migration struct {
+	// The version of the schema once the migration has been applied. The first
+	// migration of a component has version 1, and each one after that has the
+	// next version.
+	Version int
+	// A short description of the change, which is recorded in the database.
+	Description string
+	// Up applies the change.
+	Up MigrationFunc
+	// Down reverts the change, or is nil if the change can't be reverted.
+	Down MigrationFunc
+}
+
+// Statements returns a MigrationFunc which executes each of the SQL statements
+// in turn.
+func Statements(statements ...string) MigrationFunc {
+	return func(ctx context.Context, txn *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := txn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// A Migrator applies and reverts the migrations of a component's database,
+// recording which have been applied in the database itself.
+type Migrator struct {
+	db         *sql.DB
+	component  string
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the given component's migrations, which
+// must be in version order.
+func NewMigrator(db *sql.DB, component string, migrations []Migration) *Migrator {
+	return &Migrator{db: db, component: component, migrations: migrations}
+}
+
+// Version returns the version of the component's schema, which is the version
+// of the last migration applied, or 0 if none have been.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if _, err := m.db.ExecContext(ctx, migrationsSchema); err != nil {
+		return 0, err
+	}
+	var version int
+	err := m.db.QueryRowContext(ctx, selectMigrationVersionSQL, m.component).Scan(&version)
+	return version, err
+}
+
+// Up applies each migration which hasn't been applied yet, in order. Each one
+// is applied in its own transaction along with the record of it, so that a
+// failed migration leaves the schema at the previous version.
+func (m *Migrator) Up(ctx context.Context) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version > len(m.migrations) {
+		return fmt.Errorf("sqlutil: %s schema is at version %d, which is newer than the latest known version %d", m.component, version, len(m.migrations))
+	}
+	for _, migration := range m.migrations[version:] {
+		migration := migration
+		logrus.WithFields(logrus.Fields{
+			"component":   m.component,
+			"version":     migration.Version,
+			"description": migration.Description,
+		}).Info("Applying database migration")
+		err = common.WithTransaction(m.db, func(txn *sql.Tx) error {
+			if err = migration.Up(ctx, txn); err != nil {
+				return err
+			}
+			_, err = txn.ExecContext(
+				ctx, insertMigrationSQL, m.component, migration.Version,
+				migration.Description, time.Now().UnixNano()/int64(time.Millisecond),
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sqlutil: applying %s migration %d failed: %w", m.component, migration.Version, err)
+		}
+	}
+	return nil
+}
+
+// DownTo reverts each applied migration with a version higher than the given
+// one, newest first, leaving the schema at that version. It fails without
+// reverting anything if any of those migrations can't be reverted.
+func (m *Migrator) DownTo(ctx context.Context, version int) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < 0 || version > current || current > len(m.migrations) {
+		return fmt.Errorf("sqlutil: can't revert %s from version %d to version %d", m.component, current, version)
+	}
+	for _, migration := range m.migrations[version:current] {
+		if migration.Down == nil {
+			return fmt.Errorf("sqlutil: %s migration %d can't be reverted", m.component, migration.Version)
+		}
+	}
+	for i := current - 1; i >= version; i-- {
+		migration := m.migrations[i]
+		logrus.WithFields(logrus.Fields{
+			"component":   m.component,
+			"version":     migration.Version,
+			"description": migration.Description,
+		}).Info("Reverting database migration")
+		err = common.WithTransaction(m.db, func(txn *sql.Tx) error {
+			if err = migration.Down(ctx, txn); err != nil {
+				return err
+			}
+			_, err = txn.ExecContext(ctx, deleteMigrationSQL, m.component, migration.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sqlutil: reverting %s migration %d failed: %w", m.component, migration.Version, err)
+		}
+	}
+	return nil
+}
+
+// check makes sure that the migrations are numbered from 1 without gaps, so
+// that a migration's version is also its position in the list.
+func (m *Migrator) check() error {
+	for i, migration := range m.migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("sqlutil: %s migration %d has version %d", m.component, i+1, migration.Version)
+		}
+		if migration.Up == nil {
+			return fmt.Errorf("sqlutil: %s migration %d has nothing to apply", m.component, migration.Version)
+		}
+	}
+	return nil
+}
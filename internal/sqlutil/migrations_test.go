@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+var testMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create the foo table",
+		Up:          Statements("CREATE TABLE IF NOT EXISTS foo (id BIGINT NOT NULL)"),
+	},
+	{
+		Version:     2,
+		Description: "Create the bar table",
+		Up:          Statements("CREATE TABLE bar (id BIGINT NOT NULL)"),
+		Down:        Statements("DROP TABLE bar"),
+	},
+}
+
+func openMigrationsTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open(common.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	// Each connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func checkVersion(t *testing.T, m *Migrator, want int) {
+	t.Helper()
+	got, err := m.Version(context.Background())
+	if err != nil {
+		t.Fatalf("Version failed: %s", err)
+	}
+	if got != want {
+		t.Fatalf("got version %d, want %d", got, want)
+	}
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	db := openMigrationsTestDB(t)
+	defer db.Close() // nolint: errcheck
+
+	m := NewMigrator(db, "test", testMigrations[:1])
+	checkVersion(t, m, 0)
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %s", err)
+	}
+	checkVersion(t, m, 1)
+
+	// A newer release adds a migration, which is the only one applied.
+	m = NewMigrator(db, "test", testMigrations)
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %s", err)
+	}
+	checkVersion(t, m, 2)
+	if _, err := db.Exec("INSERT INTO bar (id) VALUES (1)"); err != nil {
+		t.Fatalf("bar wasn't created: %s", err)
+	}
+	// Other components sharing the database are tracked separately.
+	checkVersion(t, NewMigrator(db, "other", testMigrations), 0)
+
+	if err := m.DownTo(ctx, 1); err != nil {
+		t.Fatalf("DownTo failed: %s", err)
+	}
+	checkVersion(t, m, 1)
+	if _, err := db.Exec("INSERT INTO bar (id) VALUES (1)"); err == nil {
+		t.Fatal("bar wasn't dropped")
+	}
+	if err := m.DownTo(ctx, 0); err == nil {
+		t.Fatal("expected an error reverting a migration without Down")
+	}
+	checkVersion(t, m, 1)
+}
+
+func TestMigratorFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	db := openMigrationsTestDB(t)
+	defer db.Close() // nolint: errcheck
+
+	failed := errors.New("failed")
+	m := NewMigrator(db, "test", []Migration{testMigrations[0], {
+		Version:     2,
+		Description: "Fail after creating the bar table",
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			if err := Statements("CREATE TABLE bar (id BIGINT NOT NULL)")(ctx, txn); err != nil {
+				return err
+			}
+			return failed
+		},
+	}})
+	if err := m.Up(ctx); !errors.Is(err, failed) {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+	// The first migration is kept, but the failed one is rolled back.
+	checkVersion(t, m, 1)
+	if _, err := db.Exec("INSERT INTO bar (id) VALUES (1)"); err == nil {
+		t.Fatal("bar wasn't rolled back")
+	}
+}
+
+func TestMigratorChecksVersions(t *testing.T) {
+	db := openMigrationsTestDB(t)
+	defer db.Close() // nolint: errcheck
+
+	m := NewMigrator(db, "test", testMigrations[1:])
+	if err := m.Up(context.Background()); err == nil {
+		t.Fatal("expected an error for migrations not starting at version 1")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+
+	"github.com/ngrok/sqlmw"
+)
+
+// ReadReplicaDriverName is the name of the driver used for read-only replicas
+// of Postgres databases. The storage implementations create their schemas
+// when they are opened, which a replica would reject, so the driver skips any
+// statement that creates or alters the schema. The schema is created through
+// the primary database instead and replicated from there.
+const ReadReplicaDriverName = "postgres-replica"
+
+// schemaStatementRegexp matches statements that start, after any comments,
+// by creating or altering the schema.
+var schemaStatementRegexp = regexp.MustCompile(`^(\s*--[^\n]*\n)*\s*(?i:CREATE|ALTER)\s`)
+
+type readReplicaInterceptor struct {
+	sqlmw.Interceptor
+}
+
+func (in *readReplicaInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	if schemaStatementRegexp.MatchString(query) {
+		return driver.ResultNoRows, nil
+	}
+	return in.Interceptor.ConnExecContext(ctx, conn, query, args)
+}
@@ -0,0 +1,33 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import "testing"
+
+func TestSchemaStatementRegexp(t *testing.T) {
+	tests := map[string]bool{
+		"CREATE TABLE IF NOT EXISTS foo (id BIGINT);":                          true,
+		"\n-- Stores foos.\n-- Really.\ncreate sequence IF NOT EXISTS foo_seq": true,
+		"ALTER TABLE foo ADD COLUMN IF NOT EXISTS bar TEXT":                    true,
+		"SELECT id FROM foo WHERE created = $1":                                false,
+		"INSERT INTO foo (id) VALUES ($1)":                                     false,
+		"-- CREATE TABLE foo\nDELETE FROM foo":                                 false,
+	}
+	for query, want := range tests {
+		if got := schemaStatementRegexp.MatchString(query); got != want {
+			t.Errorf("schemaStatementRegexp.MatchString(%q): got %v, want %v", query, got, want)
+		}
+	}
+}
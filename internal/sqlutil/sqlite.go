@@ -0,0 +1,55 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SQLiteKeyParameter is the query parameter of a "file:" data source name
+// which holds the passphrase used to encrypt the SQLite database, e.g.
+// "file:dendrite.db?key=secret". It is only supported if Dendrite is built
+// with the "sqlcipher" build tag, which uses SQLCipher in place of SQLite.
+const SQLiteKeyParameter = "key"
+
+// sqliteDataSourceName converts the key parameter of a "file:" data source name
+// into the parameter that the SQLCipher driver expects. Data source names
+// without a key are returned unchanged.
+func sqliteDataSourceName(dataSourceName string) (string, error) {
+	i := strings.IndexByte(dataSourceName, '?')
+	if i < 0 {
+		return dataSourceName, nil
+	}
+	params, err := url.ParseQuery(dataSourceName[i+1:])
+	if err != nil {
+		return "", err
+	}
+	if _, ok := params[SQLiteKeyParameter]; !ok {
+		return dataSourceName, nil
+	}
+	key := params.Get(SQLiteKeyParameter)
+	if !SQLCipherEnabled {
+		return "", fmt.Errorf("sqlutil: encrypted SQLite databases require Dendrite to be built with the sqlcipher tag")
+	}
+	if key == "" {
+		return "", fmt.Errorf("sqlutil: the SQLite database key must not be empty")
+	}
+	params.Del(SQLiteKeyParameter)
+	// The driver quotes the key with double quotes.
+	params.Set("_pragma_key", strings.Replace(key, `"`, `""`, -1))
+	return dataSourceName[:i+1] + params.Encode(), nil
+}
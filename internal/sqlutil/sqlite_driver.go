@@ -0,0 +1,31 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm,!sqlcipher
+
+package sqlutil
+
+import (
+	"database/sql/driver"
+
+	sqlite "github.com/mattn/go-sqlite3"
+)
+
+// SQLCipherEnabled is true if Dendrite was built to use SQLCipher, so that
+// SQLite databases can be encrypted.
+const SQLCipherEnabled = false
+
+func newSQLiteDriver() driver.Driver {
+	return &sqlite.SQLiteDriver{}
+}
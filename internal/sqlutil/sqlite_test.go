@@ -0,0 +1,40 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import "testing"
+
+func TestSQLiteDataSourceName(t *testing.T) {
+	for _, dsn := range []string{"file:dendrite.db", "file:dendrite.db?_busy_timeout=5000"} {
+		if got, err := sqliteDataSourceName(dsn); err != nil || got != dsn {
+			t.Errorf("sqliteDataSourceName(%q): got %q, %v, want it unchanged", dsn, got, err)
+		}
+	}
+
+	got, err := sqliteDataSourceName(`file:dendrite.db?key=it's+a+"secret"`)
+	if !SQLCipherEnabled {
+		if err == nil {
+			t.Errorf("sqliteDataSourceName: expected an error for a key without SQLCipher, got %q", got)
+		}
+		return
+	}
+	want := "file:dendrite.db?_pragma_key=it%27s+a+%22%22secret%22%22"
+	if err != nil || got != want {
+		t.Errorf("sqliteDataSourceName: got %q, %v, want %q", got, err, want)
+	}
+	if _, err = sqliteDataSourceName("file:dendrite.db?key="); err == nil {
+		t.Errorf("sqliteDataSourceName: expected an error for an empty key")
+	}
+}
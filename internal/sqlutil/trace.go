@@ -79,6 +79,15 @@ func (in *traceInterceptor) RowsNext(c context.Context, rows driver.Rows, dest [
 // usually consisting of at least a database name and connection information. Includes tracing driver
 // if DENDRITE_TRACE_SQL=1
 func Open(driverName, dsn string, dbProperties common.DbProperties) (*sql.DB, error) {
+	if driverName == "postgres" || driverName == ReadReplicaDriverName {
+		dsn = postgresDataSourceName(dsn)
+	}
+	if driverName == common.SQLiteDriverName() {
+		var err error
+		if dsn, err = sqliteDataSourceName(dsn); err != nil {
+			return nil, err
+		}
+	}
 	if tracingEnabled {
 		// install the wrapped driver
 		driverName += "-trace"
@@ -20,16 +20,18 @@ import (
 	"database/sql"
 
 	"github.com/lib/pq"
-	sqlite "github.com/mattn/go-sqlite3"
 	"github.com/ngrok/sqlmw"
 )
 
 func registerDrivers() {
+	sql.Register(ReadReplicaDriverName, sqlmw.Driver(&pq.Driver{}, &readReplicaInterceptor{sqlmw.NullInterceptor{}}))
 	if !tracingEnabled {
 		return
 	}
 	// install the wrapped drivers
 	sql.Register("postgres-trace", sqlmw.Driver(&pq.Driver{}, new(traceInterceptor)))
-	sql.Register("sqlite3-trace", sqlmw.Driver(&sqlite.SQLiteDriver{}, new(traceInterceptor)))
+	sql.Register("sqlite3-trace", sqlmw.Driver(newSQLiteDriver(), new(traceInterceptor)))
+	sql.Register(MySQLDriverName+"-trace", sqlmw.Driver(&mysqlDriver{}, new(traceInterceptor)))
+	sql.Register(ReadReplicaDriverName+"-trace", sqlmw.Driver(&pq.Driver{}, &readReplicaInterceptor{new(traceInterceptor)}))
 
 }
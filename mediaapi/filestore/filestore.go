@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package filestore stores the contents of the files in the media repository,
+// either on local disk or in an S3-compatible object store.
+package filestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// ErrNotFound is returned when there is no file stored under a key.
+var ErrNotFound = errors.New("filestore: file not found")
+
+// ErrSignedURLsNotSupported is returned by file stores which can't give out
+// URLs for their files.
+var ErrSignedURLsNotSupported = errors.New("filestore: signed URLs are not supported")
+
+// FileStore stores the contents of media files and their thumbnails. Files are
+// identified by a key, which is a slash-separated relative path such as
+// "q/w/erty/file".
+type FileStore interface {
+	// Put moves the local file at src into the store under the given key,
+	// replacing any file already stored under it.
+	Put(ctx context.Context, key string, src types.Path) error
+	// Open returns a reader for the file stored under the key and its size
+	// in bytes. The caller must close the reader.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Stat returns the size in bytes of the file stored under the key.
+	Stat(ctx context.Context, key string) (int64, error)
+	// Delete removes the file stored under the key. Deleting a file which
+	// doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL which anyone can download the file stored under
+	// the key from until it expires. The content type and disposition are
+	// returned in the response headers when the URL is used.
+	SignedURL(key string, expiry time.Duration, contentType, contentDisposition string) (string, error)
+}
+
+// NewFileStore returns the file store configured for the media API: an S3
+// bucket if one is configured and the media base path otherwise.
+func NewFileStore(cfg *config.Dendrite) (FileStore, error) {
+	if cfg.Media.S3.Bucket != "" {
+		return NewS3FileStore(cfg.Media.S3)
+	}
+	return NewLocalFileStore(cfg.Media.AbsBasePath), nil
+}
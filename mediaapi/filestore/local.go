@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// LocalFileStore stores files in a directory on local disk.
+type LocalFileStore struct {
+	absBasePath config.Path
+}
+
+// NewLocalFileStore returns a file store which keeps files under the given
+// absolute path.
+func NewLocalFileStore(absBasePath config.Path) *LocalFileStore {
+	return &LocalFileStore{absBasePath}
+}
+
+// filePath returns the path on disk of the file stored under the key, checking
+// that it doesn't escape the base path.
+func (s *LocalFileStore) filePath(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || strings.HasPrefix(key, "../") {
+		return "", fmt.Errorf("filestore: invalid key %q", key)
+	}
+	return filepath.Join(string(s.absBasePath), filepath.FromSlash(key)), nil
+}
+
+// Put implements FileStore
+func (s *LocalFileStore) Put(ctx context.Context, key string, src types.Path) error {
+	dst, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+		return fmt.Errorf("Failed to make directory: %w", err)
+	}
+	if err = os.Rename(string(src), dst); err == nil {
+		return nil
+	}
+	// The source may be on a different filesystem, e.g. if it is in the system's
+	// temporary directory, in which case it has to be copied instead.
+	if err = copyFile(string(src), dst); err != nil {
+		return fmt.Errorf("Failed to move file: %w", err)
+	}
+	return os.Remove(string(src))
+}
+
+// Open implements FileStore
+func (s *LocalFileStore) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+// Stat implements FileStore
+func (s *LocalFileStore) Stat(ctx context.Context, key string) (int64, error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Delete implements FileStore. Directories left empty by removing the file are
+// removed too.
+func (s *LocalFileStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	base := filepath.Clean(string(s.absBasePath)) + string(filepath.Separator)
+	for dir := filepath.Dir(filePath); strings.HasPrefix(dir, base); dir = filepath.Dir(dir) {
+		// Remove fails on directories which aren't empty, which is when to stop.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// SignedURL implements FileStore. Files on local disk can only be downloaded
+// through the media API.
+func (s *LocalFileStore) SignedURL(key string, expiry time.Duration, contentType, contentDisposition string) (string, error) {
+	return "", ErrSignedURLsNotSupported
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer (func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	})()
+	_, err = io.Copy(out, in)
+	return err
+}
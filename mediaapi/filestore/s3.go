@@ -0,0 +1,291 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filestore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const (
+	// amzDateFormat is the format of the timestamps used to sign requests
+	amzDateFormat = "20060102T150405Z"
+	// unsignedPayload is used in place of the hash of request bodies, so that
+	// files can be streamed to the object store without reading them twice.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3FileStore stores files in a bucket of an S3-compatible object store. All
+// requests are signed with AWS Signature Version 4.
+type S3FileStore struct {
+	cfg      config.MediaS3
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3FileStore returns a file store which keeps files in the configured bucket.
+func NewS3FileStore(cfg config.MediaS3) (*S3FileStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("filestore: invalid S3 endpoint: %w", err)
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("filestore: invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	return &S3FileStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+// Put implements FileStore. The file is streamed to the object store and then
+// removed from local disk.
+func (s *S3FileStore) Put(ctx context.Context, key string, src types.Path) error {
+	file, err := os.Open(string(src))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, http.MethodPut, key, file, stat.Size())
+	if err != nil {
+		return err
+	}
+	res.Body.Close() // nolint: errcheck
+	return os.Remove(string(src))
+}
+
+// Open implements FileStore. The file is streamed from the object store as it
+// is read.
+func (s *S3FileStore) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// Stat implements FileStore
+func (s *S3FileStore) Stat(ctx context.Context, key string) (int64, error) {
+	res, err := s.do(ctx, http.MethodHead, key, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close() // nolint: errcheck
+	return res.ContentLength, nil
+}
+
+// Delete implements FileStore
+func (s *S3FileStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, 0)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Body.Close() // nolint: errcheck
+	return nil
+}
+
+// SignedURL implements FileStore with a presigned GET request for the file.
+func (s *S3FileStore) SignedURL(key string, expiry time.Duration, contentType, contentDisposition string) (string, error) {
+	query := url.Values{}
+	if contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+	if contentDisposition != "" {
+		query.Set("response-content-disposition", contentDisposition)
+	}
+	return s.presign(s.objectURL(key), expiry, query, time.Now()), nil
+}
+
+// objectURL returns the path-style URL of the object stored under the key.
+func (s *S3FileStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = ""
+	return &u
+}
+
+// do sends a signed request for the object stored under the key. Responses
+// other than a 2xx are turned into errors, with a 404 being ErrNotFound. The
+// caller must close the body of the returned response.
+func (s *S3FileStore) do(ctx context.Context, method, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		// Files aren't sent chunked, since S3 requires the length to be known.
+		req.ContentLength = size
+	}
+	s.sign(req, unsignedPayload, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("filestore: S3 %s %q failed with status %d: %s", method, key, res.StatusCode, msg)
+}
+
+// sign adds an Authorization header to the request, signing every header which
+// is already set on it.
+func (s *S3FileStore) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.cfg.AccessKeyID, s.scope(amzDate), signedHeaders, s.signature(amzDate, canonicalRequest),
+	))
+}
+
+// presign returns the URL with the query parameters which authorise a GET
+// request for it until it expires.
+func (s *S3FileStore) presign(u *url.URL, expiry time.Duration, query url.Values, t time.Time) string {
+	amzDate := t.UTC().Format(amzDateFormat)
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.cfg.AccessKeyID+"/"+s.scope(amzDate))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expiry/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signed := *u
+	signed.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + s.signature(amzDate, canonicalRequest)
+	return signed.String()
+}
+
+// scope returns the credential scope which requests made at the time are
+// signed for.
+func (s *S3FileStore) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs the canonical form of a request with a key derived from the
+// secret access key.
+func (s *S3FileStore) signature(amzDate, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + s.scope(amzDate) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query parameters sorted and encoded as they are
+// when signing.
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte of the string other than the unreserved
+// characters, and slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
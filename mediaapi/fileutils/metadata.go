@@ -0,0 +1,211 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// The PNG chunks which hold EXIF data or free text, such as the author or location
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// StripMetadata returns a reader of the data from r with EXIF and similar
+// metadata removed, if it is a JPEG or PNG image. Other data is passed through
+// unchanged. The data is processed as it is read, so it is never held in memory
+// in full. The returned reader must be closed once it is no longer needed.
+func StripMetadata(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(stripMetadata(bufio.NewReader(r), pw))
+	}()
+	return pr
+}
+
+func stripMetadata(r *bufio.Reader, w io.Writer) error {
+	magic, _ := r.Peek(len(pngSignature))
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8}):
+		return stripJPEGMetadata(r, w)
+	case bytes.Equal(magic, pngSignature):
+		return stripPNGMetadata(r, w)
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// stripJPEGMetadata removes the APP1 segments, which hold EXIF and XMP data,
+// and the APP13 segments, which hold IPTC data, that come before the image
+// data. As viewers rotate images based on it, the EXIF orientation is kept.
+func stripJPEGMetadata(r *bufio.Reader, w io.Writer) error {
+	// Start of image
+	if _, err := io.CopyN(w, r, 2); err != nil {
+		return err
+	}
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return err
+		}
+		// Markers may be padded with any number of 0xff bytes
+		for marker[0] == 0xff && marker[1] == 0xff {
+			b, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			marker[1] = b
+		}
+		if marker[0] != 0xff || marker[1] == 0xda || marker[1] == 0xd9 {
+			// The start of the image data, the end of the image or data which
+			// isn't understood, from where everything is copied as it is.
+			if _, err := w.Write(marker[:]); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			// Markers without a segment
+			if _, err := w.Write(marker[:]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+		segmentLength := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if segmentLength < 0 {
+			return io.ErrUnexpectedEOF
+		}
+		switch marker[1] {
+		case 0xe1:
+			segment := make([]byte, segmentLength)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return err
+			}
+			if orientation := exifOrientation(segment); orientation > 1 {
+				if _, err := w.Write(orientationSegment(orientation)); err != nil {
+					return err
+				}
+			}
+		case 0xed:
+			if _, err := io.CopyN(ioutil.Discard, r, segmentLength); err != nil {
+				return err
+			}
+		default:
+			if _, err := w.Write(append(marker[:], length[:]...)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, segmentLength); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exifOrientation returns the orientation from the first image directory of
+// an APP1 segment, or 0 if the segment has none.
+func exifOrientation(segment []byte) uint16 {
+	const exifHeaderSize = 6
+	if len(segment) < exifHeaderSize+8 || string(segment[:exifHeaderSize]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[exifHeaderSize:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// The orientation is a single SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
+
+// orientationSegment returns an APP1 segment with EXIF data which only holds the orientation
+func orientationSegment(orientation uint16) []byte {
+	segment := []byte{
+		0xff, 0xe1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0x00, 0x00,
+		// Big endian TIFF header with the first image directory right after it
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+		// One entry: orientation, SHORT, count 1
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		// No more image directories
+		0x00, 0x00, 0x00, 0x00,
+	}
+	binary.BigEndian.PutUint16(segment[28:], orientation)
+	return segment
+}
+
+// stripPNGMetadata removes the chunks which hold EXIF data or text.
+func stripPNGMetadata(r *bufio.Reader, w io.Writer) error {
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// The chunk data is followed by a CRC
+		chunkLength := int64(binary.BigEndian.Uint32(header[:4])) + 4
+		if pngMetadataChunks[string(header[4:])] {
+			if _, err := io.CopyN(ioutil.Discard, r, chunkLength); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, chunkLength); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func stripAll(t *testing.T, data []byte) []byte {
+	r := StripMetadata(bytes.NewReader(data))
+	defer r.Close() // nolint: errcheck
+	stripped, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stripped
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// EXIF with the orientation and a GPS directory pointer
+	exif := []byte{
+		'E', 'x', 'i', 'f', 0, 0,
+		'I', 'I', 0x2a, 0, 8, 0, 0, 0,
+		2, 0,
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0,
+		0x25, 0x88, 4, 0, 1, 0, 0, 0, 0x26, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(exif) + 2)}, exif...)
+	comment := []byte{0xff, 0xfe, 0, 4, 'h', 'i'}
+	withEXIF := append(append(append([]byte{}, encoded[:2]...), app1...), comment...)
+	withEXIF = append(withEXIF, encoded[2:]...)
+
+	stripped := stripAll(t, withEXIF)
+	expected := append(append(append([]byte{}, encoded[:2]...), orientationSegment(6)...), comment...)
+	expected = append(expected, encoded[2:]...)
+	if !bytes.Equal(stripped, expected) {
+		t.Fatalf("expected only the orientation to be kept from the EXIF data")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("failed to decode the stripped JPEG: %s", err)
+	}
+	if exifOrientation(orientationSegment(6)[4:]) != 6 {
+		t.Errorf("expected the orientation segment to have orientation 6")
+	}
+
+	// Images with the default orientation lose the EXIF data altogether
+	// The orientation value follows the start of image, the APP1 marker and length and 24 bytes of EXIF
+	withEXIF[2+4+24] = 1
+	if stripped = stripAll(t, withEXIF); bytes.Contains(stripped, []byte("Exif")) {
+		t.Errorf("expected the EXIF data to be removed")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	text := []byte("tEXtAuthor\x00Someone")
+	chunk := make([]byte, 4, len(text)+8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(text))
+
+	// After the signature and the IHDR chunk
+	const ihdrEnd = 8 + 25
+	withText := append(append(append([]byte{}, encoded[:ihdrEnd]...), chunk...), encoded[ihdrEnd:]...)
+	if stripped := stripAll(t, withText); !bytes.Equal(stripped, encoded) {
+		t.Errorf("expected the tEXt chunk to be removed")
+	}
+}
+
+func TestStripMetadataPassesThroughOtherData(t *testing.T) {
+	data := []byte("GIF89a not really")
+	if stripped := stripAll(t, data); !bytes.Equal(stripped, data) {
+		t.Errorf("expected %q, got %q", data, stripped)
+	}
+}
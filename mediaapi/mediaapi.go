@@ -17,8 +17,11 @@ package mediaapi
 import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/retention"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 )
@@ -28,13 +31,21 @@ import (
 func SetupMediaAPIComponent(
 	base *basecomponent.BaseDendrite,
 	deviceDB devices.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) {
-	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI), base.Cfg.DbProperties())
+	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI), base.Cfg.DbPropertiesFor("media_api"))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	fileStore, err := filestore.NewFileStore(base.Cfg)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media file store")
+	}
+
 	routing.Setup(
-		base.APIMux, base.Cfg, mediaDB, deviceDB, gomatrixserverlib.NewClient(),
+		base.APIMux, base.Cfg, mediaDB, fileStore, deviceDB, gomatrixserverlib.NewClient(), rsAPI,
 	)
+
+	retention.NewPurger(base.Cfg, mediaDB, fileStore).Start()
 }
@@ -0,0 +1,156 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retention deletes media which is older than the configured lifetimes.
+package retention
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+)
+
+// A Purger periodically deletes remote media which hasn't been accessed for
+// the remote media lifetime, and local media older than the local media
+// lifetime, along with their thumbnails.
+type Purger struct {
+	cfg   *config.Dendrite
+	db    storage.Database
+	store filestore.FileStore
+}
+
+// NewPurger creates a new Purger. Call Start() to begin deleting media.
+func NewPurger(cfg *config.Dendrite, db storage.Database, store filestore.FileStore) *Purger {
+	return &Purger{
+		cfg:   cfg,
+		db:    db,
+		store: store,
+	}
+}
+
+// Start checks for media to delete in the background, every interval. Does
+// nothing if neither lifetime is configured.
+func (p *Purger) Start() {
+	retention := p.cfg.Media.Retention
+	if retention.RemoteMediaLifetime == 0 && retention.LocalMediaLifetime == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(retention.Interval)
+		for range ticker.C {
+			p.purge(context.Background(), time.Now())
+		}
+	}()
+}
+
+// purge deletes all of the media which has expired at now, or only logs it
+// in dry-run mode.
+func (p *Purger) purge(ctx context.Context, now time.Time) {
+	retention := p.cfg.Media.Retention
+	// A timestamp of 0 matches no media, keeping it forever.
+	var remoteBeforeTS, localBeforeTS types.UnixMs
+	if retention.RemoteMediaLifetime > 0 {
+		remoteBeforeTS = unixMs(now.Add(-retention.RemoteMediaLifetime))
+	}
+	if retention.LocalMediaLifetime > 0 {
+		localBeforeTS = unixMs(now.Add(-retention.LocalMediaLifetime))
+	}
+
+	media, err := p.db.GetExpiredMedia(ctx, p.cfg.Matrix.ServerName, remoteBeforeTS, localBeforeTS)
+	if err != nil {
+		logrus.WithError(err).Error("media retention: failed to get expired media")
+		return
+	}
+
+	var count int
+	var size types.FileSizeBytes
+	for _, mediaMetadata := range media {
+		logger := logrus.WithFields(logrus.Fields{
+			"media_id":        mediaMetadata.MediaID,
+			"media_origin":    mediaMetadata.Origin,
+			"file_size_bytes": mediaMetadata.FileSizeBytes,
+		})
+		if retention.DryRun {
+			logger.Info("media retention: would delete media")
+		} else if err = p.deleteMedia(ctx, mediaMetadata); err != nil {
+			logger.WithError(err).Error("media retention: failed to delete media")
+			continue
+		}
+		count++
+		size += mediaMetadata.FileSizeBytes
+	}
+
+	if retention.DryRun {
+		logrus.WithFields(logrus.Fields{
+			"count":           count,
+			"file_size_bytes": size,
+		}).Info("media retention: dry run finished, no media was deleted")
+	} else if count > 0 {
+		logrus.WithFields(logrus.Fields{
+			"count":           count,
+			"file_size_bytes": size,
+		}).Info("media retention: deleted expired media")
+	}
+}
+
+// deleteMedia removes the metadata about the media and its thumbnails from the
+// database, then their files unless other media has the same hash and so is
+// stored in the same file.
+func (p *Purger) deleteMedia(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
+	thumbnails, err := p.db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return err
+	}
+	if err = p.db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+		return err
+	}
+
+	count, err := p.db.GetMediaCountWithHash(ctx, mediaMetadata.Base64Hash)
+	if err != nil || count > 0 {
+		return err
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash)
+	if err != nil {
+		return err
+	}
+	for _, thumbnail := range thumbnails {
+		thumbnailPath := thumbnailer.GetThumbnailPath(
+			types.Path(filePath), thumbnail.ThumbnailSize, thumbnail.MediaMetadata.ContentType,
+		)
+		if err = p.deleteFile(ctx, string(thumbnailPath)); err != nil {
+			return err
+		}
+	}
+	return p.deleteFile(ctx, filePath)
+}
+
+// deleteFile deletes a file from the file store, ignoring files which are
+// already gone.
+func (p *Purger) deleteFile(ctx context.Context, key string) error {
+	if err := p.store.Delete(ctx, key); err != nil && err != filestore.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func unixMs(t time.Time) types.UnixMs {
+	return types.UnixMs(t.UnixNano() / int64(time.Millisecond))
+}
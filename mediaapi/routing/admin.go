@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type quarantineResponse struct {
+	// How many media were quarantined, not counting media which already was.
+	NumQuarantined int64 `json:"num_quarantined"`
+}
+
+// checkAdmin returns an error response unless the device belongs to one of
+// the server's administrators.
+func checkAdmin(device *authtypes.Device, cfg *config.Dendrite) *util.JSONResponse {
+	if !cfg.IsAdmin(device.UserID) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	}
+	return nil
+}
+
+// QuarantineMedia implements POST /_dendrite/admin/v1/media/{serverName}/{mediaId}/quarantine
+// The media doesn't need to have been fetched from a remote server yet.
+func QuarantineMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	count, err := db.QuarantineMedia(req.Context(), mediaID, origin, device.UserID, nowMs())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.QuarantineMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{count},
+	}
+}
+
+// UnquarantineMedia implements DELETE /_dendrite/admin/v1/media/{serverName}/{mediaId}/quarantine
+func UnquarantineMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	released, err := db.UnquarantineMedia(req.Context(), mediaID, origin)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.UnquarantineMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	if !released {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The media is not quarantined"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// QuarantineUserMedia implements POST /_dendrite/admin/v1/users/{userID}/media/quarantine
+// Quarantines all of the media which the local user has uploaded.
+func QuarantineUserMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	userID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Only media uploaded by local users can be quarantined by user"),
+		}
+	}
+	count, err := db.QuarantineMediaByUser(
+		req.Context(), types.MatrixUserID(userID), cfg.Matrix.ServerName, device.UserID, nowMs(),
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.QuarantineMediaByUser failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{count},
+	}
+}
+
+// QuarantineRoomMedia implements POST /_dendrite/admin/v1/rooms/{roomID}/media/quarantine
+// Quarantines all of the media, local or remote, referenced by the events in the room.
+func QuarantineRoomMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var res roomserverAPI.QueryRoomMediaURIsResponse
+	if err := rsAPI.QueryRoomMediaURIs(req.Context(), &roomserverAPI.QueryRoomMediaURIsRequest{
+		RoomID: roomID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomMediaURIs failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
+	var total int64
+	ts := nowMs()
+	for _, uri := range res.MediaURIs {
+		parts := strings.SplitN(strings.TrimPrefix(uri, "mxc://"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		count, err := db.QuarantineMedia(
+			req.Context(), types.MediaID(parts[1]), gomatrixserverlib.ServerName(parts[0]), device.UserID, ts,
+		)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("db.QuarantineMedia failed")
+			return jsonerror.InternalServerError()
+		}
+		total += count
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{total},
+	}
+}
+
+func nowMs() types.UnixMs {
+	return types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	mediaURIs map[string][]string
+}
+
+func (r *testRoomserverAPI) QueryRoomMediaURIs(
+	ctx context.Context,
+	request *roomserverAPI.QueryRoomMediaURIsRequest,
+	response *roomserverAPI.QueryRoomMediaURIsResponse,
+) error {
+	response.MediaURIs, response.RoomExists = r.mediaURIs[request.RoomID]
+	return nil
+}
+
+func TestQuarantineMediaAdmin(t *testing.T) {
+	cfg, db, _, cleanup := mustCreateTestMediaAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+	admin := &authtypes.Device{UserID: "@admin:hollow.knight"}
+	req := httptest.NewRequest("POST", "/quarantine", nil)
+
+	for _, mediaMetadata := range []*types.MediaMetadata{
+		{MediaID: "grub", Origin: "hollow.knight", UserID: "@knight:hollow.knight"},
+		{MediaID: "geo", Origin: "hollow.knight", UserID: "@knight:hollow.knight"},
+		{MediaID: "charm", Origin: "hollow.knight", UserID: "@hornet:hollow.knight"},
+		{MediaID: "dream", Origin: "pale.court", UserID: "@knight:hollow.knight"},
+	} {
+		mediaMetadata.ContentType = "text/plain"
+		mediaMetadata.Base64Hash = types.Base64Hash(mediaMetadata.MediaID)
+		if err := db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isQuarantined := func(origin gomatrixserverlib.ServerName, mediaID types.MediaID) bool {
+		quarantined, err := db.IsMediaQuarantined(ctx, mediaID, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return quarantined
+	}
+
+	// Only admins can quarantine media
+	res := QuarantineMedia(req, &authtypes.Device{UserID: "@knight:hollow.knight"}, cfg, db, "hollow.knight", "charm")
+	if res.Code != http.StatusForbidden || isQuarantined("hollow.knight", "charm") {
+		t.Fatalf("expected a non-admin to be forbidden, got %d", res.Code)
+	}
+
+	// By ID, including media which hasn't been fetched
+	res = QuarantineMedia(req, admin, cfg, db, "pale.court", "unfetched")
+	if res.Code != http.StatusOK || res.JSON.(quarantineResponse).NumQuarantined != 1 {
+		t.Fatalf("expected the media to be quarantined, got %d: %+v", res.Code, res.JSON)
+	}
+	if !isQuarantined("pale.court", "unfetched") {
+		t.Errorf("expected unfetched media to be quarantined")
+	}
+
+	// By user, which only applies to local users
+	if res = QuarantineUserMedia(req, admin, cfg, db, "@knight:pale.court"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected quarantining a remote user's media to fail, got %d", res.Code)
+	}
+	res = QuarantineUserMedia(req, admin, cfg, db, "@knight:hollow.knight")
+	if res.Code != http.StatusOK || res.JSON.(quarantineResponse).NumQuarantined != 2 {
+		t.Fatalf("expected the user's media to be quarantined, got %d: %+v", res.Code, res.JSON)
+	}
+	if !isQuarantined("hollow.knight", "grub") || !isQuarantined("hollow.knight", "geo") {
+		t.Errorf("expected the user's local media to be quarantined")
+	}
+	if isQuarantined("hollow.knight", "charm") || isQuarantined("pale.court", "dream") {
+		t.Errorf("expected only the user's local media to be quarantined")
+	}
+
+	// By room, which includes remote media and media which is already quarantined
+	rsAPI := &testRoomserverAPI{mediaURIs: map[string][]string{
+		"!room:hollow.knight": {"mxc://hollow.knight/grub", "mxc://pale.court/dream", "mxc://invalid"},
+	}}
+	if res = QuarantineRoomMedia(req, admin, cfg, db, rsAPI, "!unknown:hollow.knight"); res.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown room to be not found, got %d", res.Code)
+	}
+	res = QuarantineRoomMedia(req, admin, cfg, db, rsAPI, "!room:hollow.knight")
+	if res.Code != http.StatusOK || res.JSON.(quarantineResponse).NumQuarantined != 1 {
+		t.Fatalf("expected the room's media to be quarantined, got %d: %+v", res.Code, res.JSON)
+	}
+	if !isQuarantined("pale.court", "dream") {
+		t.Errorf("expected the room's remote media to be quarantined")
+	}
+
+	// Releasing media from quarantine
+	if res = UnquarantineMedia(req, admin, cfg, db, "hollow.knight", "grub"); res.Code != http.StatusOK {
+		t.Fatalf("expected the media to be released, got %d", res.Code)
+	}
+	if isQuarantined("hollow.knight", "grub") {
+		t.Errorf("expected the media to be released")
+	}
+	if res = UnquarantineMedia(req, admin, cfg, db, "hollow.knight", "grub"); res.Code != http.StatusNotFound {
+		t.Errorf("expected releasing unquarantined media to be not found, got %d", res.Code)
+	}
+}
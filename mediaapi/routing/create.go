@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// createResponse defines the format of the JSON response to /create
+// https://github.com/matrix-org/matrix-doc/pull/2246
+type createResponse struct {
+	ContentURI      string       `json:"content_uri"`
+	UnusedExpiresAt types.UnixMs `json:"unused_expires_at"`
+}
+
+// CreateMedia implements POST /_matrix/media/unstable/fi.mau.msc2246/create
+// It creates a media ID which the user can upload media to later, until it expires.
+func CreateMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+) util.JSONResponse {
+	ts := nowMs()
+	count, err := db.GetPendingUploadCount(req.Context(), types.MatrixUserID(device.UserID), ts)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetPendingUploadCount failed")
+		return jsonerror.InternalServerError()
+	}
+	if count >= cfg.Media.AsyncUploads.MaxPendingUploads {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many media IDs have been created without being uploaded to", 0),
+		}
+	}
+
+	mediaID, err := newMediaID()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("newMediaID failed")
+		return jsonerror.InternalServerError()
+	}
+	pendingUpload := &types.PendingUpload{
+		MediaID:           mediaID,
+		Origin:            cfg.Matrix.ServerName,
+		UserID:            types.MatrixUserID(device.UserID),
+		CreationTimestamp: ts,
+		ExpiresTimestamp:  ts + types.UnixMs(cfg.Media.AsyncUploads.UnusedExpiry/time.Millisecond),
+	}
+	if err = db.StorePendingUpload(req.Context(), pendingUpload); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.StorePendingUpload failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID),
+			UnusedExpiresAt: pendingUpload.ExpiresTimestamp,
+		},
+	}
+}
+
+// UploadCreatedMedia implements PUT /_matrix/media/unstable/fi.mau.msc2246/upload/{serverName}/{mediaId}
+// Only the user who created the media ID can upload to it, and only once.
+func UploadCreatedMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	store filestore.FileStore, activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	r, resErr := parseAndValidateRequest(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.MediaMetadata.UserID = types.MatrixUserID(device.UserID)
+	r.Logger = r.Logger.WithField("MediaID", mediaID)
+
+	var pendingUpload *types.PendingUpload
+	if origin == cfg.Matrix.ServerName {
+		var err error
+		pendingUpload, err = db.GetPendingUpload(req.Context(), mediaID, origin, nowMs())
+		if err != nil {
+			r.Logger.WithError(err).Error("db.GetPendingUpload failed")
+			return jsonerror.InternalServerError()
+		}
+		if pendingUpload == nil {
+			mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+			if err != nil {
+				r.Logger.WithError(err).Error("db.GetMediaMetadata failed")
+				return jsonerror.InternalServerError()
+			}
+			if mediaMetadata != nil {
+				return util.JSONResponse{
+					Code: http.StatusConflict,
+					JSON: jsonerror.CannotOverwriteMedia("Media has already been uploaded to this media ID"),
+				}
+			}
+		}
+	}
+	if pendingUpload == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media ID not found or expired"),
+		}
+	}
+	if pendingUpload.UserID != r.MediaMetadata.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The media ID was created by another user"),
+		}
+	}
+
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
+		return *resErr
+	}
+	if err := db.DeletePendingUpload(req.Context(), mediaID, origin); err != nil {
+		// The media ID expires on its own, and downloads don't wait for media which has been uploaded
+		r.Logger.WithError(err).Warn("Failed to delete the pending upload")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// newMediaID returns a random media ID for media which hasn't been uploaded
+// yet, so it can't be derived from the hash of the file like other media IDs.
+func newMediaID() (types.MediaID, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return types.MediaID(base64.RawURLEncoding.EncodeToString(b)), nil
+}
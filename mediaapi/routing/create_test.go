@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestCreateThenUploadMedia(t *testing.T) {
+	cfg, db, store, cleanup := mustCreateTestMediaAPI(t)
+	defer cleanup()
+	knight := &authtypes.Device{UserID: "@knight:hollow.knight"}
+	hornet := &authtypes.Device{UserID: "@hornet:hollow.knight"}
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+
+	create := func(device *authtypes.Device) (int, types.MediaID) {
+		res := CreateMedia(httptest.NewRequest("POST", "/create", nil), device, cfg, db)
+		if res.Code != http.StatusOK {
+			return res.Code, ""
+		}
+		created := res.JSON.(createResponse)
+		if created.UnusedExpiresAt <= nowMs() {
+			t.Errorf("expected the media ID to expire in the future, got %d", created.UnusedExpiresAt)
+		}
+		if !strings.HasPrefix(created.ContentURI, "mxc://hollow.knight/") {
+			t.Fatalf("unexpected content URI %s", created.ContentURI)
+		}
+		return res.Code, types.MediaID(strings.TrimPrefix(created.ContentURI, "mxc://hollow.knight/"))
+	}
+	upload := func(device *authtypes.Device, origin gomatrixserverlib.ServerName, mediaID types.MediaID) int {
+		req := httptest.NewRequest("PUT", "/upload", bytes.NewReader([]byte("grub")))
+		req.Header.Set("Content-Type", "text/plain")
+		return UploadCreatedMedia(req, device, cfg, db, store, activeThumbnailGeneration, origin, mediaID).Code
+	}
+
+	code, mediaID := create(knight)
+	if code != http.StatusOK {
+		t.Fatalf("expected /create to succeed, got %d", code)
+	}
+	if code = upload(hornet, "hollow.knight", mediaID); code != http.StatusForbidden {
+		t.Errorf("expected another user's upload to be forbidden, got %d", code)
+	}
+	if code = upload(knight, "pale.court", mediaID); code != http.StatusNotFound {
+		t.Errorf("expected an upload to another server's media ID to be not found, got %d", code)
+	}
+	if code = upload(knight, "hollow.knight", mediaID); code != http.StatusOK {
+		t.Fatalf("expected the upload to succeed, got %d", code)
+	}
+	if data := mustReadMedia(t, db, store, mediaID); string(data) != "grub" {
+		t.Errorf("expected the uploaded file to be stored under the created media ID, got %q", data)
+	}
+	if code = upload(knight, "hollow.knight", mediaID); code != http.StatusConflict {
+		t.Errorf("expected a second upload to conflict, got %d", code)
+	}
+
+	// Each user can only have so many media IDs which haven't been uploaded to
+	for i := 0; i < cfg.Media.AsyncUploads.MaxPendingUploads; i++ {
+		if code, _ = create(knight); code != http.StatusOK {
+			t.Fatalf("expected /create to succeed, got %d", code)
+		}
+	}
+	if code, _ = create(knight); code != http.StatusTooManyRequests {
+		t.Errorf("expected /create to be limited, got %d", code)
+	}
+	if code, _ = create(hornet); code != http.StatusOK {
+		t.Errorf("expected /create to succeed for another user, got %d", code)
+	}
+}
+
+func TestUploadExpiredMedia(t *testing.T) {
+	cfg, db, store, cleanup := mustCreateTestMediaAPI(t)
+	defer cleanup()
+
+	ts := nowMs()
+	if err := db.StorePendingUpload(context.Background(), &types.PendingUpload{
+		MediaID:           "expired",
+		Origin:            "hollow.knight",
+		UserID:            "@knight:hollow.knight",
+		CreationTimestamp: ts - 2000,
+		ExpiresTimestamp:  ts - 1000,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("PUT", "/upload", bytes.NewReader([]byte("grub")))
+	req.Header.Set("Content-Type", "text/plain")
+	res := UploadCreatedMedia(
+		req, &authtypes.Device{UserID: "@knight:hollow.knight"}, cfg, db, store,
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		"hollow.knight", "expired",
+	)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected an upload to an expired media ID to be not found, got %d", res.Code)
+	}
+	if mediaMetadata, err := db.GetMediaMetadata(context.Background(), "expired", "hollow.knight"); err != nil || mediaMetadata != nil {
+		t.Fatalf("expected nothing to be stored, got %+v (%v)", mediaMetadata, err)
+	}
+}
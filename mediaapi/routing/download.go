@@ -21,15 +21,15 @@ import (
 	"io"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
@@ -45,6 +45,12 @@ const mediaIDCharacters = "A-Za-z0-9_=-"
 // Note: unfortunately regex.MustCompile() cannot be assigned to a const
 var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 
+// pendingUploadPollInterval is how often a download checks whether media which is still being uploaded has arrived
+const pendingUploadPollInterval = 500 * time.Millisecond
+
+// errNotYetUploaded is returned when a download times out waiting for media to be uploaded to a created media ID
+var errNotYetUploaded = errors.New("media has not been uploaded yet")
+
 // downloadRequest metadata included in or derivable from a download or thumbnail request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-download-servername-mediaid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-thumbnail-servername-mediaid
@@ -52,7 +58,10 @@ type downloadRequest struct {
 	MediaMetadata      *types.MediaMetadata
 	IsThumbnailRequest bool
 	ThumbnailSize      types.ThumbnailSize
-	Logger             *log.Entry
+	ThumbnailType      types.ContentType
+	// How long to wait for media which has been created with /create but not uploaded yet
+	MaxStall time.Duration
+	Logger   *log.Entry
 }
 
 // Download implements GET /download and GET /thumbnail
@@ -68,6 +77,7 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -79,12 +89,23 @@ func Download(
 			Origin:  origin,
 		},
 		IsThumbnailRequest: isThumbnailRequest,
+		MaxStall:           cfg.Media.AsyncUploads.MaxDownloadWait,
 		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
 			"Origin":  origin,
 			"MediaID": mediaID,
 		}),
 	}
 
+	if maxStall := req.FormValue("fi.mau.msc2246.max_stall_ms"); maxStall != "" {
+		ms, err := strconv.ParseInt(maxStall, 10, 64)
+		if err != nil {
+			ms = -1
+		}
+		if ms < int64(dReq.MaxStall/time.Millisecond) {
+			dReq.MaxStall = time.Duration(ms) * time.Millisecond
+		}
+	}
+
 	if dReq.IsThumbnailRequest {
 		width, err := strconv.Atoi(req.FormValue("width"))
 		if err != nil {
@@ -99,10 +120,17 @@ func Download(
 			Height:       height,
 			ResizeMethod: strings.ToLower(req.FormValue("method")),
 		}
+		dReq.ThumbnailType = types.ThumbnailJPEG
+		if acceptsWebP(req.Header.Get("Accept")) {
+			dReq.ThumbnailType = types.ThumbnailWebP
+		}
+		// The thumbnail format depends on the Accept header, so caches must take it into account
+		w.Header().Set("Vary", "Accept")
 		dReq.Logger.WithFields(log.Fields{
 			"RequestedWidth":        dReq.ThumbnailSize.Width,
 			"RequestedHeight":       dReq.ThumbnailSize.Height,
 			"RequestedResizeMethod": dReq.ThumbnailSize.ResizeMethod,
+			"RequestedContentType":  dReq.ThumbnailType,
 		})
 	}
 
@@ -113,9 +141,16 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, cfg, db, store, client,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
+	if err == errNotYetUploaded {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.NotYetUploaded("Media has not been uploaded yet"),
+		})
+		return
+	}
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
 		dReq.jsonErrorResponse(w, util.JSONResponse{
@@ -153,6 +188,26 @@ func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSON
 	w.Write(resBytes) // nolint: errcheck
 }
 
+// acceptsWebP checks whether an Accept header explicitly lists image/webp with a non-zero quality.
+// Wildcards are not enough, as many clients send */* without being able to display WebP.
+func acceptsWebP(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), string(types.ThumbnailWebP)) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(strings.ToLower(param), "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // Validate validates the downloadRequest fields
 func (r *downloadRequest) Validate() *util.JSONResponse {
 	if !mediaIDRegex.MatchString(string(r.MediaMetadata.MediaID)) {
@@ -169,6 +224,12 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 			JSON: jsonerror.NotFound("serverName must be a non-empty string"),
 		}
 	}
+	if r.MaxStall < 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("fi.mau.msc2246.max_stall_ms must be a non-negative integer"),
+		}
+	}
 
 	if r.IsThumbnailRequest {
 		if r.ThumbnailSize.Width <= 0 || r.ThumbnailSize.Height <= 0 {
@@ -196,10 +257,20 @@ func (r *downloadRequest) doDownload(
 	w http.ResponseWriter,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (*types.MediaMetadata, error) {
+	// quarantined media is kept for review by admins, but responds as if it didn't exist
+	quarantined, err := db.IsMediaQuarantined(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying the database")
+	}
+	if quarantined {
+		r.Logger.Info("Media is quarantined")
+		return nil, nil
+	}
 	// check if we have a record of the media in our database
 	mediaMetadata, err := db.GetMediaMetadata(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
@@ -207,88 +278,121 @@ func (r *downloadRequest) doDownload(
 	if err != nil {
 		return nil, errors.Wrap(err, "error querying the database")
 	}
-	if mediaMetadata == nil {
-		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
+	if mediaMetadata == nil && r.MediaMetadata.Origin == cfg.Matrix.ServerName {
+		// The media ID may have been created with /create for media which is still being uploaded
+		mediaMetadata, err = r.waitForUpload(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		if mediaMetadata == nil {
 			// If we do not have a record and the origin is local, the file is not found
 			return nil, nil
 		}
+	}
+	if mediaMetadata == nil {
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, store, activeRemoteRequests, activeThumbnailGeneration,
 		)
 		if resErr != nil {
 			return nil, resErr
 		}
 	} else {
-		// If we have a record, we can respond from the local file
+		// If we have a record, we can respond from the file store
 		r.MediaMetadata = mediaMetadata
+		// The last access time is used to decide when remote media can be deleted
+		if err = db.UpdateMediaLastAccess(
+			ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin, types.UnixMs(time.Now().UnixNano()/1000000),
+		); err != nil {
+			r.Logger.WithError(err).Warn("Failed to update the last access time of the media")
+		}
 	}
-	return r.respondFromLocalFile(
-		ctx, w, cfg.Media.AbsBasePath, activeThumbnailGeneration,
+	return r.respondFromFileStore(
+		ctx, w, store, cfg.Media.S3.SignedURLExpiry, activeThumbnailGeneration,
 		cfg.Media.MaxThumbnailGenerators, db,
 		cfg.Media.DynamicThumbnails, cfg.Media.ThumbnailSizes,
 	)
 }
 
-// respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
+// waitForUpload waits up to MaxStall for media to be uploaded to a media ID created with /create.
+// The database is polled, as the upload may be handled by another instance of the media API.
+// Returns nil, nil if there is no such media ID or it has expired, and errNotYetUploaded if the
+// media wasn't uploaded in time.
+func (r *downloadRequest) waitForUpload(
+	ctx context.Context, db storage.Database,
+) (*types.MediaMetadata, error) {
+	deadline := time.Now().Add(r.MaxStall)
+	for {
+		pendingUpload, err := db.GetPendingUpload(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin, nowMs())
+		if err != nil {
+			return nil, errors.Wrap(err, "error querying the database")
+		}
+		if pendingUpload == nil {
+			return nil, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errNotYetUploaded
+		}
+		r.Logger.Debug("Waiting for media to be uploaded")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pendingUploadPollInterval):
+		}
+
+		mediaMetadata, err := db.GetMediaMetadata(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return nil, errors.Wrap(err, "error querying the database")
+		}
+		if mediaMetadata != nil {
+			return mediaMetadata, nil
+		}
+	}
+}
+
+// respondFromFileStore reads a file from the file store and writes it to the http.ResponseWriter,
+// or redirects the client to a signed URL for the file if signedURLExpiry is set and the file store supports it.
 // If no file was found then returns nil, nil
-func (r *downloadRequest) respondFromLocalFile(
+func (r *downloadRequest) respondFromFileStore(
 	ctx context.Context,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	store filestore.FileStore,
+	signedURLExpiry time.Duration,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
+	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get file path from metadata")
 	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to open file")
-	}
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to stat file")
-	}
-
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
-		r.Logger.WithFields(log.Fields{
-			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
-		}).Warn("File size in database and on-disk differ.")
-		return nil, errors.New("file size in database and on-disk differ")
-	}
 
-	var responseFile *os.File
-	var responseMetadata *types.MediaMetadata
+	responsePath := filePath
+	responseMetadata := r.MediaMetadata
+	contentDisposition := ""
 	if r.IsThumbnailRequest {
-		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+		thumbMetadata, resErr := r.getThumbnail(
+			ctx, store, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
 			db, dynamicThumbnails, thumbnailSizes,
 		)
-		if thumbFile != nil {
-			defer thumbFile.Close() // nolint: errcheck
-		}
 		if resErr != nil {
 			return nil, resErr
 		}
-		if thumbFile == nil {
+		if thumbMetadata == nil {
 			r.Logger.WithFields(log.Fields{
 				"UploadName":    r.MediaMetadata.UploadName,
 				"Base64Hash":    r.MediaMetadata.Base64Hash,
 				"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
 				"ContentType":   r.MediaMetadata.ContentType,
 			}).Info("No good thumbnail found. Responding with original file.")
-			responseFile = file
-			responseMetadata = r.MediaMetadata
 		} else {
 			r.Logger.Info("Responding with thumbnail")
-			responseFile = thumbFile
+			responsePath = string(thumbnailer.GetThumbnailPath(
+				types.Path(filePath), thumbMetadata.ThumbnailSize, thumbMetadata.MediaMetadata.ContentType,
+			))
 			responseMetadata = thumbMetadata.MediaMetadata
 		}
 	} else {
@@ -298,14 +402,43 @@ func (r *downloadRequest) respondFromLocalFile(
 			"FileSizeBytes": r.MediaMetadata.FileSizeBytes,
 			"ContentType":   r.MediaMetadata.ContentType,
 		}).Info("Responding with file")
-		responseFile = file
-		responseMetadata = r.MediaMetadata
 
 		if len(responseMetadata.UploadName) > 0 {
-			w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename*=utf-8"%s"`, responseMetadata.UploadName))
+			contentDisposition = fmt.Sprintf(`inline; filename*=utf-8"%s"`, responseMetadata.UploadName)
 		}
 	}
 
+	if signedURLExpiry > 0 {
+		signedURL, signErr := store.SignedURL(
+			responsePath, signedURLExpiry, string(responseMetadata.ContentType), contentDisposition,
+		)
+		if signErr == nil {
+			w.Header().Set("Location", signedURL)
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return responseMetadata, nil
+		}
+		if signErr != filestore.ErrSignedURLsNotSupported {
+			return nil, errors.Wrap(signErr, "failed to sign URL for file")
+		}
+	}
+
+	file, size, err := store.Open(ctx, responsePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close() // nolint: errcheck
+
+	if responseMetadata.FileSizeBytes > 0 && int64(responseMetadata.FileSizeBytes) != size {
+		r.Logger.WithFields(log.Fields{
+			"fileSizeDatabase":  responseMetadata.FileSizeBytes,
+			"fileSizeFileStore": size,
+		}).Warn("File size in database and in the file store differ.")
+		return nil, errors.New("file size in database and in the file store differ")
+	}
+
+	if contentDisposition != "" {
+		w.Header().Set("Content-Disposition", contentDisposition)
+	}
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
@@ -315,33 +448,35 @@ func (r *downloadRequest) respondFromLocalFile(
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
 
-	if _, err := io.Copy(w, responseFile); err != nil {
+	if _, err := io.Copy(w, file); err != nil {
 		return nil, errors.Wrap(err, "failed to copy from cache")
 	}
 	return responseMetadata, nil
 }
 
+// getThumbnail finds the thumbnail which best matches the request, generating it if needed.
 // Note: Thumbnail generation may be ongoing asynchronously.
-// If no thumbnail was found then returns nil, nil, nil
-func (r *downloadRequest) getThumbnailFile(
+// If no thumbnail was found then returns nil, nil
+func (r *downloadRequest) getThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	filePath types.Path,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+) (*types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, store, filePath, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 	// If dynamicThumbnails is true but there are too many thumbnails being actively generated, we can fall back
@@ -352,8 +487,9 @@ func (r *downloadRequest) getThumbnailFile(
 			ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
 		)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "error looking up thumbnails")
+			return nil, errors.Wrap(err, "error looking up thumbnails")
 		}
+		thumbnails = r.acceptableThumbnails(thumbnails)
 
 		// If we get a thumbnailSize, a pre-generated thumbnail would be best but it is not yet generated.
 		// If we get a thumbnail, we're done.
@@ -368,16 +504,16 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Info("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, store, filePath, *thumbnailSize, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
 		}
 	}
 	if thumbnail == nil {
-		return nil, nil, nil
+		return nil, nil
 	}
 	r.Logger = r.Logger.WithFields(log.Fields{
 		"Width":         thumbnail.ThumbnailSize.Width,
@@ -386,26 +522,25 @@ func (r *downloadRequest) getThumbnailFile(
 		"FileSizeBytes": thumbnail.MediaMetadata.FileSizeBytes,
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
-	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.Wrap(err, "failed to open file")
-	}
-	thumbStat, err := thumbFile.Stat()
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.Wrap(err, "failed to stat file")
-	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
+	return thumbnail, nil
+}
+
+// acceptableThumbnails filters out thumbnails in formats the client did not ask for.
+// JPEG thumbnails, which pre-generated thumbnails always are, are acceptable to every client.
+func (r *downloadRequest) acceptableThumbnails(thumbnails []*types.ThumbnailMetadata) []*types.ThumbnailMetadata {
+	var acceptable []*types.ThumbnailMetadata
+	for _, thumbnail := range thumbnails {
+		contentType := thumbnail.MediaMetadata.ContentType
+		if contentType == types.ThumbnailJPEG || contentType == r.ThumbnailType {
+			acceptable = append(acceptable, thumbnail)
+		}
 	}
-	return thumbFile, thumbnail, nil
+	return acceptable
 }
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	filePath types.Path,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -418,7 +553,7 @@ func (r *downloadRequest) generateThumbnail(
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
+		ctx, store, filePath, thumbnailSize, r.ThumbnailType, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
 	if err != nil {
@@ -430,7 +565,7 @@ func (r *downloadRequest) generateThumbnail(
 	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
-		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
+		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod, r.ThumbnailType,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "error looking up thumbnail")
@@ -447,6 +582,7 @@ func (r *downloadRequest) getRemoteFile(
 	client *gomatrixserverlib.Client,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -481,7 +617,7 @@ func (r *downloadRequest) getRemoteFile(
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
-				cfg.Media.AbsBasePath, *cfg.Media.MaxFileSizeBytes, db,
+				cfg.Media.AbsBasePath, *cfg.Media.MaxFileSizeBytes, db, store,
 				cfg.Media.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.Media.MaxThumbnailGenerators,
 			)
@@ -549,12 +685,13 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
+	store filestore.FileStore,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
 	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+		ctx, client, absBasePath, maxFileSizeBytes, store,
 	)
 	if err != nil {
 		return err
@@ -573,8 +710,9 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			finalDir := filepath.Dir(string(finalPath))
-			fileutils.RemoveDir(types.Path(finalDir), r.Logger)
+			if err = store.Delete(ctx, string(finalPath)); err != nil {
+				r.Logger.WithError(err).Warn("Failed to remove file")
+			}
 		}
 		// NOTE: It should really not be possible to fail the uniqueness test here so
 		// there is no need to handle that separately
@@ -583,7 +721,7 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, finalPath, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -609,6 +747,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
+	store filestore.FileStore,
 ) (types.Path, bool, error) {
 	r.Logger.Info("Fetching remote file")
 
@@ -664,7 +803,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.Base64Hash = hash
 
 	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, store, r.Logger)
 	if err != nil {
 		return "", false, errors.Wrap(err, "failed to move file")
 	}
@@ -0,0 +1,399 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	// Imported for the image codecs used to find the size of preview images
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// urlPreviewTimeout is how long fetching a page or an image for a preview may take.
+const urlPreviewTimeout = 20 * time.Second
+
+// errBlockedIP is returned when a URL to preview resolves to a blocked IP address.
+var errBlockedIP = errors.New("IP address is blocked")
+
+var (
+	metaTagRegex   = regexp.MustCompile(`(?is)<meta\s([^>]*)>`)
+	attributeRegex = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>/]+))`)
+	titleTagRegex  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// newURLPreviewClient returns an HTTP client for fetching URLs to preview which
+// refuses to connect to any address in the blocked IP ranges. The addresses are
+// checked after name resolution, including when following redirects.
+func newURLPreviewClient(cfg config.MediaURLPreview) (*http.Client, error) {
+	blocked := make([]*net.IPNet, 0, len(cfg.BlockedIPRanges))
+	for _, ipRange := range cfg.BlockedIPRanges {
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, ipNet)
+	}
+	dialer := &net.Dialer{
+		Timeout: urlPreviewTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return errors.Wrap(errBlockedIP, host)
+			}
+			for _, ipNet := range blocked {
+				if ipNet.Contains(ip) {
+					return errors.Wrap(errBlockedIP, ip.String())
+				}
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: urlPreviewTimeout,
+		// No proxy is used, as the proxy would connect to the blocked addresses for us.
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: urlPreviewTimeout,
+		},
+	}, nil
+}
+
+// PreviewURL implements GET /preview_url
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-media-r0-preview-url
+// Previews are cached in the database for the configured TTL. The optional ts
+// parameter is ignored and the most recent preview is always returned.
+func PreviewURL(
+	req *http.Request,
+	device *authtypes.Device,
+	cfg *config.Dendrite,
+	db storage.Database,
+	store filestore.FileStore,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) util.JSONResponse {
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("The url parameter is required"),
+		}
+	}
+	pageURL, err := url.Parse(rawURL)
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The url parameter must be an absolute http or https URL"),
+		}
+	}
+	pageURL.Fragment = ""
+
+	logger := util.GetLogger(req.Context()).WithField("url", pageURL.String())
+	now := types.UnixMs(time.Now().UnixNano() / 1000000)
+
+	cached, err := db.GetURLPreview(req.Context(), pageURL.String(), now)
+	if err != nil {
+		logger.WithError(err).Error("Failed to look up cached URL preview")
+		return jsonerror.InternalServerError()
+	}
+	if cached != nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: json.RawMessage(cached),
+		}
+	}
+
+	preview, err := generateURLPreview(
+		req.Context(), pageURL, device, cfg, db, store, client, activeThumbnailGeneration, logger,
+	)
+	if errors.Is(err, errBlockedIP) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The URL is not allowed to be previewed"),
+		}
+	} else if err != nil {
+		logger.WithError(err).Warn("Failed to preview URL")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch the URL"),
+		}
+	}
+
+	previewJSON, err := json.Marshal(preview)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal URL preview")
+		return jsonerror.InternalServerError()
+	}
+	expiresTS := now + types.UnixMs(cfg.Media.URLPreview.CacheTTL/time.Millisecond)
+	if err = db.StoreURLPreview(req.Context(), pageURL.String(), previewJSON, now, expiresTS); err != nil {
+		logger.WithError(err).Warn("Failed to cache URL preview")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: json.RawMessage(previewJSON),
+	}
+}
+
+// generateURLPreview fetches the URL and builds its preview. For HTML pages
+// this is the OpenGraph metadata of the page; for images, and for the image of
+// an HTML page, the image is stored in the media repository and its mxc:// URI
+// is returned. Other types of content get an empty preview.
+func generateURLPreview(
+	ctx context.Context,
+	pageURL *url.URL,
+	device *authtypes.Device,
+	cfg *config.Dendrite,
+	db storage.Database,
+	store filestore.FileStore,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	logger *log.Entry,
+) (map[string]interface{}, error) {
+	maxBytes := int64(cfg.Media.URLPreview.MaxPageSizeBytes)
+	body, contentType, err := fetchForPreview(ctx, client, pageURL.String(), maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := map[string]interface{}{}
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		if err = storePreviewImage(
+			ctx, preview, body, contentType, device, cfg, db, store, activeThumbnailGeneration, logger,
+		); err != nil {
+			return nil, err
+		}
+	case contentType == "text/html" || contentType == "application/xhtml+xml":
+		properties := parseOpenGraph(body)
+		for property, content := range properties {
+			// The image properties describe the page's copy of the image, which
+			// are replaced with the details of our copy below.
+			if !strings.HasPrefix(property, "og:image") {
+				preview[property] = content
+			}
+		}
+		imageURL, ok := properties["og:image"]
+		if !ok {
+			break
+		}
+		if err = previewPageImage(
+			ctx, preview, pageURL, imageURL, device, cfg, db, store, client, activeThumbnailGeneration, logger,
+		); err != nil {
+			// The preview is still useful without the image.
+			logger.WithError(err).WithField("image_url", imageURL).Warn("Failed to fetch the image of the page")
+		}
+	}
+	return preview, nil
+}
+
+// previewPageImage fetches the image of an HTML page, relative to the page URL,
+// and adds it to the preview.
+func previewPageImage(
+	ctx context.Context,
+	preview map[string]interface{},
+	pageURL *url.URL,
+	rawImageURL string,
+	device *authtypes.Device,
+	cfg *config.Dendrite,
+	db storage.Database,
+	store filestore.FileStore,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	logger *log.Entry,
+) error {
+	imageURL, err := pageURL.Parse(rawImageURL)
+	if err != nil {
+		return err
+	}
+	if imageURL.Scheme != "http" && imageURL.Scheme != "https" {
+		return fmt.Errorf("unsupported image URL scheme %q", imageURL.Scheme)
+	}
+	body, contentType, err := fetchForPreview(
+		ctx, client, imageURL.String(), int64(cfg.Media.URLPreview.MaxPageSizeBytes),
+	)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("unexpected content type %q for image", contentType)
+	}
+	return storePreviewImage(
+		ctx, preview, body, contentType, device, cfg, db, store, activeThumbnailGeneration, logger,
+	)
+}
+
+// storePreviewImage stores an image in the media repository as if the user had
+// uploaded it, which also generates its thumbnails, and adds it to the preview.
+func storePreviewImage(
+	ctx context.Context,
+	preview map[string]interface{},
+	data []byte,
+	contentType string,
+	device *authtypes.Device,
+	cfg *config.Dendrite,
+	db storage.Database,
+	store filestore.FileStore,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	logger *log.Entry,
+) error {
+	maxFileSizeBytes := *cfg.Media.MaxFileSizeBytes
+	if maxFileSizeBytes > 0 && int64(len(data)) > int64(maxFileSizeBytes) {
+		return fmt.Errorf("image is larger than the maximum file size (%d)", maxFileSizeBytes)
+	}
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to decode image")
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(len(data)),
+			ContentType:   types.ContentType(contentType),
+			UserID:        types.MatrixUserID(device.UserID),
+		},
+		Logger: logger.WithField("Origin", cfg.Matrix.ServerName),
+	}
+	// doUpload responds with 200 OK if the image was already stored.
+	resErr := r.doUpload(ctx, bytes.NewReader(data), cfg, db, store, activeThumbnailGeneration)
+	if resErr != nil && resErr.Code != http.StatusOK {
+		return fmt.Errorf("failed to store image: %v", resErr.JSON)
+	}
+
+	preview["og:image"] = fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	preview["og:image:type"] = contentType
+	preview["og:image:width"] = imageConfig.Width
+	preview["og:image:height"] = imageConfig.Height
+	preview["matrix:image:size"] = r.MediaMetadata.FileSizeBytes
+	return nil
+}
+
+// fetchForPreview fetches a URL, returning its body and media type. Fails if
+// the body is larger than maxBytes.
+func fetchForPreview(
+	ctx context.Context, client *http.Client, rawURL string, maxBytes int64,
+) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "Dendrite")
+	req.Header.Set("Accept", "text/html, application/xhtml+xml, image/*;q=0.9, */*;q=0.8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", fmt.Errorf("response is larger than %d bytes", maxBytes)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, "", fmt.Errorf("response is larger than %d bytes", maxBytes)
+	}
+	// The media type is left empty if the Content-Type is missing or invalid,
+	// which gives an empty preview.
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return body, mediaType, nil
+}
+
+// parseOpenGraph extracts the OpenGraph properties from an HTML page. The page
+// title and description are used if the page has no og:title or og:description.
+// If a property appears more than once, the first value is used.
+func parseOpenGraph(page []byte) map[string]string {
+	properties := map[string]string{}
+	var description string
+	for _, metaTag := range metaTagRegex.FindAllSubmatch(page, -1) {
+		attributes := map[string]string{}
+		for _, attribute := range attributeRegex.FindAllSubmatch(metaTag[1], -1) {
+			value := attribute[2]
+			if len(attribute[3]) > 0 {
+				value = attribute[3]
+			} else if len(attribute[4]) > 0 {
+				value = attribute[4]
+			}
+			attributes[strings.ToLower(string(attribute[1]))] = html.UnescapeString(string(value))
+		}
+		content, ok := attributes["content"]
+		if !ok {
+			continue
+		}
+		property := attributes["property"]
+		if property == "" {
+			property = attributes["name"]
+		}
+		property = strings.ToLower(property)
+		switch {
+		case strings.HasPrefix(property, "og:"):
+			if _, ok = properties[property]; !ok {
+				properties[property] = strings.TrimSpace(content)
+			}
+		case property == "description" && description == "":
+			description = strings.TrimSpace(content)
+		}
+	}
+
+	if _, ok := properties["og:title"]; !ok {
+		if title := titleTagRegex.FindSubmatch(page); title != nil {
+			if text := strings.TrimSpace(html.UnescapeString(string(title[1]))); text != "" {
+				properties["og:title"] = text
+			}
+		}
+	}
+	if _, ok := properties["og:description"]; !ok && description != "" {
+		properties["og:description"] = description
+	}
+	return properties
+}
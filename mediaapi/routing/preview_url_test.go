@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/pkg/errors"
+)
+
+func TestParseOpenGraph(t *testing.T) {
+	page := []byte(`<html><head>
+<title>Page &amp; title</title>
+<meta name="description" content="A description">
+<meta property="og:title" content="OpenGraph title" />
+<meta property='og:image' content='/image.png'>
+<meta property="og:title" content="Second title">
+</head><body></body></html>`)
+	properties := parseOpenGraph(page)
+	want := map[string]string{
+		"og:title":       "OpenGraph title",
+		"og:image":       "/image.png",
+		"og:description": "A description",
+	}
+	if len(properties) != len(want) {
+		t.Fatalf("got %v, want %v", properties, want)
+	}
+	for property, content := range want {
+		if properties[property] != content {
+			t.Errorf("%s: got %q, want %q", property, properties[property], content)
+		}
+	}
+
+	properties = parseOpenGraph([]byte("<title>Page &amp; title</title>"))
+	if properties["og:title"] != "Page & title" {
+		t.Errorf("og:title: got %q, want %q", properties["og:title"], "Page & title")
+	}
+}
+
+func TestURLPreviewClientBlocksIPs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer server.Close()
+
+	client, err := newURLPreviewClient(config.MediaURLPreview{
+		BlockedIPRanges: config.DefaultBlockedIPRanges,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(server.URL); !errors.Is(err, errBlockedIP) {
+		t.Fatalf("expected the request to be blocked, got %v", err)
+	}
+
+	client, err = newURLPreviewClient(config.MediaURLPreview{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+}
@@ -24,16 +24,21 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
 const pathPrefixR0 = "/_matrix/media/r0"
+const pathPrefixMSC2246 = "/_matrix/media/unstable/fi.mau.msc2246"
+const pathPrefixAdmin = "/_dendrite/admin/v1"
 
 // Setup registers the media API HTTP handlers
 //
@@ -44,10 +49,14 @@ func Setup(
 	apiMux *mux.Router,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	deviceDB devices.Database,
 	client *gomatrixserverlib.Client,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+	msc2246mux := apiMux.PathPrefix(pathPrefixMSC2246).Subrouter()
+	adminMux := apiMux.PathPrefix(pathPrefixAdmin).Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -62,25 +71,100 @@ func Setup(
 	r0mux.Handle("/upload", common.MakeAuthAPI(
 		"upload", authData,
 		func(req *http.Request, _ *authtypes.Device) util.JSONResponse {
-			return Upload(req, cfg, db, activeThumbnailGeneration)
+			return Upload(req, cfg, db, store, activeThumbnailGeneration)
 		},
 	)).Methods(http.MethodPost, http.MethodOptions)
 
+	msc2246mux.Handle("/create", common.MakeAuthAPI(
+		"create", authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return CreateMedia(req, device, cfg, db)
+		},
+	)).Methods(http.MethodPost, http.MethodOptions)
+	msc2246mux.Handle("/upload/{serverName}/{mediaId}", common.MakeAuthAPI(
+		"upload_created", authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UploadCreatedMedia(
+				req, device, cfg, db, store, activeThumbnailGeneration,
+				gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		},
+	)).Methods(http.MethodPut, http.MethodOptions)
+
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 	r0mux.Handle("/download/{serverName}/{mediaId}",
-		makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("download", cfg, db, store, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, db, store, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.Media.URLPreview.Enabled {
+		previewClient, err := newURLPreviewClient(cfg.Media.URLPreview)
+		if err != nil {
+			log.WithError(err).Panic("failed to create the URL preview client")
+		}
+		r0mux.Handle("/preview_url", common.MakeAuthAPI(
+			"preview_url", authData,
+			func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+				return PreviewURL(req, device, cfg, db, store, previewClient, activeThumbnailGeneration)
+			},
+		)).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	adminMux.Handle("/media/{serverName}/{mediaId}/quarantine",
+		common.MakeAuthAPI("admin_quarantine_media", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return QuarantineMedia(
+				req, device, cfg, db, gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/media/{serverName}/{mediaId}/quarantine",
+		common.MakeAuthAPI("admin_unquarantine_media", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UnquarantineMedia(
+				req, device, cfg, db, gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+	adminMux.Handle("/users/{userID}/media/quarantine",
+		common.MakeAuthAPI("admin_quarantine_user_media", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return QuarantineUserMedia(req, device, cfg, db, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/rooms/{roomID}/media/quarantine",
+		common.MakeAuthAPI("admin_quarantine_room_media", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return QuarantineRoomMedia(req, device, cfg, db, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 }
 
 func makeDownloadAPI(
 	name string,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -107,6 +191,7 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
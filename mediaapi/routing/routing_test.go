@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// mustCreateTestMediaAPI returns a configuration, database and file store in a
+// temporary directory, along with a function to remove it again.
+func mustCreateTestMediaAPI(t *testing.T) (*config.Dendrite, storage.Database, filestore.FileStore, func()) {
+	dir, err := ioutil.TempDir("", "mediaapi-routing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite3.Open("file:" + filepath.Join(dir, "mediaapi.db"))
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatalf("sqlite3.Open returned %s", err)
+	}
+
+	maxFileSizeBytes := config.FileSizeBytes(1024 * 1024)
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "hollow.knight"
+	cfg.Matrix.Admins = []string{"@admin:hollow.knight"}
+	cfg.Media.AbsBasePath = config.Path(dir)
+	cfg.Media.MaxFileSizeBytes = &maxFileSizeBytes
+	cfg.Media.AsyncUploads.UnusedExpiry = time.Hour
+	cfg.Media.AsyncUploads.MaxPendingUploads = 2
+
+	return cfg, db, filestore.NewLocalFileStore(cfg.Media.AbsBasePath), func() {
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+// mustReadMedia returns the contents of the stored file for the media.
+func mustReadMedia(t *testing.T, db storage.Database, store filestore.FileStore, mediaID types.MediaID) []byte {
+	mediaMetadata, err := db.GetMediaMetadata(context.Background(), mediaID, "hollow.knight")
+	if err != nil || mediaMetadata == nil {
+		t.Fatalf("failed to get the media metadata for %s: %v", mediaID, err)
+	}
+	path, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, _, err := store.Open(context.Background(), path)
+	if err != nil {
+		t.Fatalf("failed to open the stored file for %s: %s", mediaID, err)
+	}
+	defer file.Close() // nolint: errcheck
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
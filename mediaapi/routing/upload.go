@@ -20,11 +20,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"path"
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
@@ -53,13 +53,13 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.Dendrite, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.Dendrite, db storage.Database, store filestore.FileStore, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -97,6 +97,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store filestore.FileStore,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -105,6 +106,13 @@ func (r *uploadRequest) doUpload(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("Uploading file")
 
+	// Image metadata is stripped before the file data is hashed, so that the hash matches the stored file.
+	if cfg.Media.StripImageMetadata {
+		stripped := fileutils.StripMetadata(reqReader)
+		defer stripped.Close() // nolint: errcheck
+		reqReader = stripped
+	}
+
 	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
@@ -123,7 +131,10 @@ func (r *uploadRequest) doUpload(
 
 	r.MediaMetadata.FileSizeBytes = bytesWritten
 	r.MediaMetadata.Base64Hash = hash
-	r.MediaMetadata.MediaID = types.MediaID(hash)
+	// Media uploaded to a media ID created with /create keeps that ID
+	if r.MediaMetadata.MediaID == "" {
+		r.MediaMetadata.MediaID = types.MediaID(hash)
+	}
 
 	r.Logger = r.Logger.WithField("MediaID", r.MediaMetadata.MediaID)
 
@@ -156,7 +167,7 @@ func (r *uploadRequest) doUpload(
 	}
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.Media.AbsBasePath, db, cfg.Media.ThumbnailSizes,
+		ctx, tmpDir, store, db, cfg.Media.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.Media.MaxThumbnailGenerators,
 	)
 }
@@ -213,13 +224,13 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
+	store filestore.FileStore,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, store, r.Logger)
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
@@ -237,7 +248,9 @@ func (r *uploadRequest) storeFileAndMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			if err = store.Delete(ctx, string(finalPath)); err != nil {
+				r.Logger.WithError(err).Warn("Failed to remove file")
+			}
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -247,7 +260,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, finalPath, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
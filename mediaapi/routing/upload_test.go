@@ -0,0 +1,62 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func TestUploadStripsImageMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	// EXIF without any entries, following the start of image
+	exif := []byte{'E', 'x', 'i', 'f', 0, 0, 'I', 'I', 0x2a, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	withEXIF := append(append([]byte{}, encoded[:2]...), 0xff, 0xe1, 0, byte(len(exif)+2))
+	withEXIF = append(append(withEXIF, exif...), encoded[2:]...)
+
+	for _, strip := range []bool{false, true} {
+		cfg, db, store, cleanup := mustCreateTestMediaAPI(t)
+		cfg.Media.StripImageMetadata = strip
+
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(withEXIF))
+		req.Header.Set("Content-Type", "image/jpeg")
+		res := Upload(req, cfg, db, store, &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		})
+		if res.Code != 200 {
+			cleanup()
+			t.Fatalf("strip=%v: expected the upload to succeed, got %d: %+v", strip, res.Code, res.JSON)
+		}
+		contentURI := res.JSON.(uploadResponse).ContentURI
+		stored := mustReadMedia(t, db, store, types.MediaID(contentURI[len("mxc://hollow.knight/"):]))
+		cleanup()
+
+		if strip && !bytes.Equal(stored, encoded) {
+			t.Errorf("expected the EXIF data to be stripped from the stored file")
+		}
+		if !strip && !bytes.Equal(stored, withEXIF) {
+			t.Errorf("expected the file to be stored unmodified")
+		}
+	}
+}
@@ -25,6 +25,20 @@ type Database interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
-	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
+	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string, contentType types.ContentType) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	StoreURLPreview(ctx context.Context, url string, preview []byte, ts, expiresTS types.UnixMs) error
+	GetURLPreview(ctx context.Context, url string, ts types.UnixMs) ([]byte, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs) error
+	GetExpiredMedia(ctx context.Context, serverName gomatrixserverlib.ServerName, remoteBeforeTS, localBeforeTS types.UnixMs) ([]*types.MediaMetadata, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	GetMediaCountWithHash(ctx context.Context, base64Hash types.Base64Hash) (int, error)
+	QuarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, quarantinedBy string, ts types.UnixMs) (int64, error)
+	QuarantineMediaByUser(ctx context.Context, userID types.MatrixUserID, serverName gomatrixserverlib.ServerName, quarantinedBy string, ts types.UnixMs) (int64, error)
+	UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+	IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+	StorePendingUpload(ctx context.Context, pendingUpload *types.PendingUpload) error
+	GetPendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs) (*types.PendingUpload, error)
+	GetPendingUploadCount(ctx context.Context, userID types.MatrixUserID, ts types.UnixMs) (int, error)
+	DeletePendingUpload(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
 }
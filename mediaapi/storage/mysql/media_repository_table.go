@@ -0,0 +1,201 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const mediaSchema = `
+-- The media_repository table holds metadata for each media file stored and accessible to the local server,
+-- the actual file is stored separately.
+CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
+    -- The id used to refer to the media.
+    -- For uploads to this server this is a base64-encoded sha256 hash of the file data
+    -- For media from remote servers, this can be any unique identifier string
+    media_id VARCHAR(255) NOT NULL,
+    -- The origin of the media as requested by the client. Should be a homeserver domain.
+    media_origin VARCHAR(255) NOT NULL,
+    -- The MIME-type of the media file as specified when uploading.
+    content_type MEDIUMTEXT NOT NULL,
+    -- Size of the media file in bytes.
+    file_size_bytes BIGINT NOT NULL,
+    -- When the content was uploaded in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- The file name with which the media was uploaded.
+    upload_name MEDIUMTEXT NOT NULL,
+    -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
+    base64hash VARCHAR(255) NOT NULL,
+    -- The user who uploaded the file. Should be a Matrix user ID.
+    user_id VARCHAR(255) NOT NULL,
+    UNIQUE INDEX mediaapi_media_repository_index (media_id, media_origin)
+);
+`
+
+// Added in schema version 3. Existing media are treated as last accessed when they were stored.
+const mediaLastAccessSchema = `
+ALTER TABLE mediaapi_media_repository ADD COLUMN last_access_ts BIGINT NOT NULL DEFAULT 0
+`
+
+const mediaLastAccessBackfillSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = creation_ts
+`
+
+const insertMediaSQL = `
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+const selectMediaSQL = `
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const updateMediaLastAccessSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+// Note: this selects remote media which hasn't been accessed since $2, and local media which was uploaded before $3.
+// Quarantined media is kept for review.
+const selectExpiredMediaSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository m
+    WHERE ((media_origin <> $1 AND last_access_ts < $2) OR (media_origin = $1 AND creation_ts < $3))
+    AND NOT EXISTS (
+        SELECT 1 FROM mediaapi_quarantined_media q WHERE q.media_id = m.media_id AND q.media_origin = m.media_origin
+    )
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaCountWithHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
+type mediaStatements struct {
+	insertMediaStmt              *sql.Stmt
+	selectMediaStmt              *sql.Stmt
+	updateMediaLastAccessStmt    *sql.Stmt
+	selectExpiredMediaStmt       *sql.Stmt
+	deleteMediaStmt              *sql.Stmt
+	selectMediaCountWithHashStmt *sql.Stmt
+}
+
+func (s *mediaStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertMediaStmt, insertMediaSQL},
+		{&s.selectMediaStmt, selectMediaSQL},
+		{&s.updateMediaLastAccessStmt, updateMediaLastAccessSQL},
+		{&s.selectExpiredMediaStmt, selectExpiredMediaSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectMediaCountWithHashStmt, selectMediaCountWithHashSQL},
+	}.prepare(db)
+}
+
+func (s *mediaStatements) insertMedia(
+	ctx context.Context, mediaMetadata *types.MediaMetadata,
+) error {
+	mediaMetadata.CreationTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
+	_, err := s.insertMediaStmt.ExecContext(
+		ctx,
+		mediaMetadata.MediaID,
+		mediaMetadata.Origin,
+		mediaMetadata.ContentType,
+		mediaMetadata.FileSizeBytes,
+		mediaMetadata.CreationTimestamp,
+		mediaMetadata.UploadName,
+		mediaMetadata.Base64Hash,
+		mediaMetadata.UserID,
+		mediaMetadata.CreationTimestamp,
+	)
+	return err
+}
+
+func (s *mediaStatements) selectMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.MediaMetadata, error) {
+	mediaMetadata := types.MediaMetadata{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := s.selectMediaStmt.QueryRowContext(
+		ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
+	).Scan(
+		&mediaMetadata.ContentType,
+		&mediaMetadata.FileSizeBytes,
+		&mediaMetadata.CreationTimestamp,
+		&mediaMetadata.UploadName,
+		&mediaMetadata.Base64Hash,
+		&mediaMetadata.UserID,
+	)
+	return &mediaMetadata, err
+}
+
+func (s *mediaStatements) updateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) error {
+	_, err := s.updateMediaLastAccessStmt.ExecContext(ctx, mediaID, mediaOrigin, ts)
+	return err
+}
+
+func (s *mediaStatements) selectExpiredMedia(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, remoteBeforeTS, localBeforeTS types.UnixMs,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectExpiredMediaStmt.QueryContext(ctx, serverName, remoteBeforeTS, localBeforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectExpiredMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := common.TxStmt(txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) selectMediaCountWithHash(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (count int, err error) {
+	err = s.selectMediaCountWithHashStmt.QueryRowContext(ctx, base64Hash).Scan(&count)
+	return
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// migrations are the schema migrations for the media API database, in order.
+var migrations = []sqlutil.Migration{
+	{
+		Version:     1,
+		Description: "Create the initial schema",
+		Up: sqlutil.Statements(
+			mediaSchema,
+			thumbnailSchema,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Cache URL previews",
+		Up:          sqlutil.Statements(urlPreviewSchema),
+	},
+	{
+		Version:     3,
+		Description: "Track when media was last accessed",
+		Up:          sqlutil.Statements(mediaLastAccessSchema, mediaLastAccessBackfillSQL),
+	},
+	{
+		Version:     4,
+		Description: "Quarantine media",
+		Up:          sqlutil.Statements(quarantinedMediaSchema),
+	},
+	{
+		Version:     5,
+		Description: "Allow thumbnails in several formats",
+		Up:          sqlutil.Statements(thumbnailContentTypeIndexSchema),
+	},
+	{
+		Version:     6,
+		Description: "Create media IDs for later uploads",
+		Up:          sqlutil.Statements(pendingUploadSchema),
+	},
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pendingUploadSchema = `
+-- The mediaapi_pending_upload table holds media IDs which have been created
+-- for media which hasn't been uploaded yet, as per MSC2246.
+CREATE TABLE IF NOT EXISTS mediaapi_pending_upload (
+    media_id VARCHAR(255) NOT NULL,
+    media_origin VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    creation_ts BIGINT NOT NULL,
+    expires_ts BIGINT NOT NULL,
+    UNIQUE INDEX mediaapi_pending_upload_index (media_id, media_origin),
+    INDEX mediaapi_pending_upload_user_id_idx (user_id)
+);
+`
+
+const insertPendingUploadSQL = `
+INSERT INTO mediaapi_pending_upload (media_id, media_origin, user_id, creation_ts, expires_ts) VALUES ($1, $2, $3, $4, $5)
+`
+
+// Note: this only selects media IDs which haven't expired yet
+const selectPendingUploadSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_pending_upload WHERE media_id = $1 AND media_origin = $2 AND expires_ts > $3
+`
+
+const selectPendingUploadCountSQL = `
+SELECT COUNT(*) FROM mediaapi_pending_upload WHERE user_id = $1 AND expires_ts > $2
+`
+
+const deletePendingUploadSQL = `
+DELETE FROM mediaapi_pending_upload WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteExpiredPendingUploadsSQL = `
+DELETE FROM mediaapi_pending_upload WHERE expires_ts <= $1
+`
+
+type pendingUploadStatements struct {
+	insertPendingUploadStmt         *sql.Stmt
+	selectPendingUploadStmt         *sql.Stmt
+	selectPendingUploadCountStmt    *sql.Stmt
+	deletePendingUploadStmt         *sql.Stmt
+	deleteExpiredPendingUploadsStmt *sql.Stmt
+}
+
+func (s *pendingUploadStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertPendingUploadStmt, insertPendingUploadSQL},
+		{&s.selectPendingUploadStmt, selectPendingUploadSQL},
+		{&s.selectPendingUploadCountStmt, selectPendingUploadCountSQL},
+		{&s.deletePendingUploadStmt, deletePendingUploadSQL},
+		{&s.deleteExpiredPendingUploadsStmt, deleteExpiredPendingUploadsSQL},
+	}.prepare(db)
+}
+
+func (s *pendingUploadStatements) insertPendingUpload(
+	ctx context.Context, pendingUpload *types.PendingUpload,
+) error {
+	_, err := s.insertPendingUploadStmt.ExecContext(
+		ctx,
+		pendingUpload.MediaID,
+		pendingUpload.Origin,
+		pendingUpload.UserID,
+		pendingUpload.CreationTimestamp,
+		pendingUpload.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *pendingUploadStatements) selectPendingUpload(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) (*types.PendingUpload, error) {
+	pendingUpload := types.PendingUpload{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := s.selectPendingUploadStmt.QueryRowContext(ctx, mediaID, mediaOrigin, ts).Scan(
+		&pendingUpload.UserID,
+		&pendingUpload.CreationTimestamp,
+		&pendingUpload.ExpiresTimestamp,
+	)
+	return &pendingUpload, err
+}
+
+func (s *pendingUploadStatements) selectPendingUploadCount(
+	ctx context.Context, userID types.MatrixUserID, ts types.UnixMs,
+) (count int, err error) {
+	err = s.selectPendingUploadCountStmt.QueryRowContext(ctx, userID, ts).Scan(&count)
+	return
+}
+
+func (s *pendingUploadStatements) deletePendingUpload(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deletePendingUploadStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *pendingUploadStatements) deleteExpiredPendingUploads(
+	ctx context.Context, ts types.UnixMs,
+) error {
+	_, err := s.deleteExpiredPendingUploadsStmt.ExecContext(ctx, ts)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -50,29 +51,63 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
 `
 
+// Added in schema version 3. Existing media are treated as last accessed when they were stored.
+const mediaLastAccessSchema = `
+ALTER TABLE mediaapi_media_repository ADD COLUMN last_access_ts BIGINT NOT NULL DEFAULT 0
+`
+
+const mediaLastAccessBackfillSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = creation_ts
+`
+
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 
 const selectMediaSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
+const updateMediaLastAccessSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+// Note: this selects remote media which hasn't been accessed since $2, and local media which was uploaded before $3.
+// Quarantined media is kept for review.
+const selectExpiredMediaSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository m
+    WHERE ((media_origin <> $1 AND last_access_ts < $2) OR (media_origin = $1 AND creation_ts < $3))
+    AND NOT EXISTS (
+        SELECT 1 FROM mediaapi_quarantined_media q WHERE q.media_id = m.media_id AND q.media_origin = m.media_origin
+    )
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaCountWithHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
 type mediaStatements struct {
-	insertMediaStmt *sql.Stmt
-	selectMediaStmt *sql.Stmt
+	insertMediaStmt              *sql.Stmt
+	selectMediaStmt              *sql.Stmt
+	updateMediaLastAccessStmt    *sql.Stmt
+	selectExpiredMediaStmt       *sql.Stmt
+	deleteMediaStmt              *sql.Stmt
+	selectMediaCountWithHashStmt *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(mediaSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
+		{&s.updateMediaLastAccessStmt, updateMediaLastAccessSQL},
+		{&s.selectExpiredMediaStmt, selectExpiredMediaSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectMediaCountWithHashStmt, selectMediaCountWithHashSQL},
 	}.prepare(db)
 }
 
@@ -90,6 +125,7 @@ func (s *mediaStatements) insertMedia(
 		mediaMetadata.UploadName,
 		mediaMetadata.Base64Hash,
 		mediaMetadata.UserID,
+		mediaMetadata.CreationTimestamp,
 	)
 	return err
 }
@@ -113,3 +149,53 @@ func (s *mediaStatements) selectMedia(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) updateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) error {
+	_, err := s.updateMediaLastAccessStmt.ExecContext(ctx, mediaID, mediaOrigin, ts)
+	return err
+}
+
+func (s *mediaStatements) selectExpiredMedia(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, remoteBeforeTS, localBeforeTS types.UnixMs,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectExpiredMediaStmt.QueryContext(ctx, serverName, remoteBeforeTS, localBeforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectExpiredMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := common.TxStmt(txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) selectMediaCountWithHash(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (count int, err error) {
+	err = s.selectMediaCountWithHashStmt.QueryRowContext(ctx, base64Hash).Scan(&count)
+	return
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const quarantinedMediaSchema = `
+-- The mediaapi_quarantined_media table holds the media which admins have quarantined.
+-- Quarantined media can't be downloaded, but its files are kept for review.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_media (
+    -- The id and origin of the quarantined media, which might not have been
+    -- fetched by this server.
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- The admin who quarantined the media.
+    quarantined_by TEXT NOT NULL,
+    -- When the media was quarantined in UNIX epoch ms.
+    quarantined_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_quarantined_media_index ON mediaapi_quarantined_media (media_id, media_origin);
+`
+
+const insertQuarantinedMediaSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin, quarantined_by, quarantined_ts) VALUES ($1, $2, $3, $4)
+    ON CONFLICT DO NOTHING
+`
+
+// Note: this quarantines all of the media uploaded to this server by a user
+const insertQuarantinedMediaByUserSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin, quarantined_by, quarantined_ts)
+    SELECT media_id, media_origin, $3, $4 FROM mediaapi_media_repository WHERE user_id = $1 AND media_origin = $2
+    ON CONFLICT DO NOTHING
+`
+
+const deleteQuarantinedMediaSQL = `
+DELETE FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectQuarantinedMediaSQL = `
+SELECT COUNT(*) FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+type quarantinedMediaStatements struct {
+	insertQuarantinedMediaStmt       *sql.Stmt
+	insertQuarantinedMediaByUserStmt *sql.Stmt
+	deleteQuarantinedMediaStmt       *sql.Stmt
+	selectQuarantinedMediaStmt       *sql.Stmt
+}
+
+func (s *quarantinedMediaStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertQuarantinedMediaStmt, insertQuarantinedMediaSQL},
+		{&s.insertQuarantinedMediaByUserStmt, insertQuarantinedMediaByUserSQL},
+		{&s.deleteQuarantinedMediaStmt, deleteQuarantinedMediaSQL},
+		{&s.selectQuarantinedMediaStmt, selectQuarantinedMediaSQL},
+	}.prepare(db)
+}
+
+func (s *quarantinedMediaStatements) insertQuarantinedMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	quarantinedBy string, ts types.UnixMs,
+) (int64, error) {
+	res, err := s.insertQuarantinedMediaStmt.ExecContext(ctx, mediaID, mediaOrigin, quarantinedBy, ts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *quarantinedMediaStatements) insertQuarantinedMediaByUser(
+	ctx context.Context, userID types.MatrixUserID, serverName gomatrixserverlib.ServerName,
+	quarantinedBy string, ts types.UnixMs,
+) (int64, error) {
+	res, err := s.insertQuarantinedMediaByUserStmt.ExecContext(ctx, userID, serverName, quarantinedBy, ts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *quarantinedMediaStatements) deleteQuarantinedMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (int64, error) {
+	res, err := s.deleteQuarantinedMediaStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *quarantinedMediaStatements) selectQuarantinedMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	var count int
+	err := s.selectQuarantinedMediaStmt.QueryRowContext(ctx, mediaID, mediaOrigin).Scan(&count)
+	return count > 0, err
+}
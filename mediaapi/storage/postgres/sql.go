@@ -20,8 +20,11 @@ import (
 )
 
 type statements struct {
-	media     mediaStatements
-	thumbnail thumbnailStatements
+	media      mediaStatements
+	thumbnail  thumbnailStatements
+	urlPreview urlPreviewStatements
+	quarantine quarantinedMediaStatements
+	pending    pendingUploadStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +34,15 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.urlPreview.prepare(db); err != nil {
+		return
+	}
+	if err = s.quarantine.prepare(db); err != nil {
+		return
+	}
+	if err = s.pending.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const urlPreviewSchema = `
+-- The mediaapi_url_preview table caches the previews generated for /preview_url.
+CREATE TABLE IF NOT EXISTS mediaapi_url_preview (
+    -- The URL which was previewed.
+    url TEXT NOT NULL,
+    -- When the preview was generated in UNIX epoch ms.
+    ts BIGINT NOT NULL,
+    -- When the preview should no longer be served from the cache in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL,
+    -- The preview, as the JSON object returned by /preview_url.
+    preview TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mediaapi_url_preview_url_idx ON mediaapi_url_preview (url, ts);
+`
+
+const insertURLPreviewSQL = `
+INSERT INTO mediaapi_url_preview (url, ts, expires_ts, preview) VALUES ($1, $2, $3, $4)
+`
+
+// Note: this selects the most recent preview of the URL which hasn't expired yet
+const selectURLPreviewSQL = `
+SELECT preview FROM mediaapi_url_preview WHERE url = $1 AND expires_ts > $2 ORDER BY ts DESC LIMIT 1
+`
+
+const deleteExpiredURLPreviewsSQL = `
+DELETE FROM mediaapi_url_preview WHERE expires_ts <= $1
+`
+
+type urlPreviewStatements struct {
+	insertURLPreviewStmt         *sql.Stmt
+	selectURLPreviewStmt         *sql.Stmt
+	deleteExpiredURLPreviewsStmt *sql.Stmt
+}
+
+func (s *urlPreviewStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertURLPreviewStmt, insertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+		{&s.deleteExpiredURLPreviewsStmt, deleteExpiredURLPreviewsSQL},
+	}.prepare(db)
+}
+
+func (s *urlPreviewStatements) insertURLPreview(
+	ctx context.Context, url string, preview []byte, ts, expiresTS types.UnixMs,
+) error {
+	_, err := s.insertURLPreviewStmt.ExecContext(ctx, url, ts, expiresTS, string(preview))
+	return err
+}
+
+func (s *urlPreviewStatements) selectURLPreview(
+	ctx context.Context, url string, ts types.UnixMs,
+) ([]byte, error) {
+	var preview string
+	err := s.selectURLPreviewStmt.QueryRowContext(ctx, url, ts).Scan(&preview)
+	return []byte(preview), err
+}
+
+func (s *urlPreviewStatements) deleteExpiredURLPreviews(
+	ctx context.Context, ts types.UnixMs,
+) error {
+	_, err := s.deleteExpiredURLPreviewsStmt.ExecContext(ctx, ts)
+	return err
+}
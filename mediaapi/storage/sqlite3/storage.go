@@ -24,7 +24,6 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Database is used to store metadata about a repository of media files.
@@ -40,6 +39,9 @@ func Open(dataSourceName string) (*Database, error) {
 	if d.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, nil); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(d.db, "mediaapi", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	if err = d.statements.prepare(d.db); err != nil {
 		return nil, err
 	}
@@ -84,9 +86,10 @@ func (d *Database) GetThumbnail(
 	mediaOrigin gomatrixserverlib.ServerName,
 	width, height int,
 	resizeMethod string,
+	contentType types.ContentType,
 ) (*types.ThumbnailMetadata, error) {
 	thumbnailMetadata, err := d.statements.thumbnail.selectThumbnail(
-		ctx, mediaID, mediaOrigin, width, height, resizeMethod,
+		ctx, mediaID, mediaOrigin, width, height, resizeMethod, contentType,
 	)
 	if err != nil && err == sql.ErrNoRows {
 		return nil, nil
@@ -106,3 +109,131 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// StoreURLPreview caches the preview of a URL, generated at ts, until expiresTS.
+// Previews which have already expired are removed from the cache.
+func (d *Database) StoreURLPreview(
+	ctx context.Context, url string, preview []byte, ts, expiresTS types.UnixMs,
+) error {
+	if err := d.statements.urlPreview.deleteExpiredURLPreviews(ctx, ts); err != nil {
+		return err
+	}
+	return d.statements.urlPreview.insertURLPreview(ctx, url, preview, ts, expiresTS)
+}
+
+// GetURLPreview returns the most recent cached preview of a URL which hasn't expired at ts.
+// Returns nil if there is no such preview.
+func (d *Database) GetURLPreview(
+	ctx context.Context, url string, ts types.UnixMs,
+) ([]byte, error) {
+	preview, err := d.statements.urlPreview.selectURLPreview(ctx, url, ts)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return preview, err
+}
+
+// UpdateMediaLastAccess records that the media was accessed at ts.
+func (d *Database) UpdateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) error {
+	return d.statements.media.updateMediaLastAccess(ctx, mediaID, mediaOrigin, ts)
+}
+
+// GetExpiredMedia returns metadata about the remote media which hasn't been accessed since remoteBeforeTS
+// and the media uploaded to serverName before localBeforeTS.
+func (d *Database) GetExpiredMedia(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, remoteBeforeTS, localBeforeTS types.UnixMs,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectExpiredMedia(ctx, serverName, remoteBeforeTS, localBeforeTS)
+}
+
+// DeleteMedia removes the metadata about the media and its thumbnails from the database.
+// The files are not removed.
+func (d *Database) DeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.statements.thumbnail.deleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		return d.statements.media.deleteMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
+// GetMediaCountWithHash returns how many media have the given hash, and so are stored in the same file.
+func (d *Database) GetMediaCountWithHash(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (int, error) {
+	return d.statements.media.selectMediaCountWithHash(ctx, base64Hash)
+}
+
+// QuarantineMedia quarantines the media, which doesn't need to have been fetched yet.
+// Returns how many media were newly quarantined, which is 0 if it already was.
+func (d *Database) QuarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, quarantinedBy string, ts types.UnixMs,
+) (int64, error) {
+	return d.statements.quarantine.insertQuarantinedMedia(ctx, mediaID, mediaOrigin, quarantinedBy, ts)
+}
+
+// QuarantineMediaByUser quarantines all of the media uploaded to serverName by the user.
+// Returns how many media were newly quarantined.
+func (d *Database) QuarantineMediaByUser(
+	ctx context.Context, userID types.MatrixUserID, serverName gomatrixserverlib.ServerName, quarantinedBy string, ts types.UnixMs,
+) (int64, error) {
+	return d.statements.quarantine.insertQuarantinedMediaByUser(ctx, userID, serverName, quarantinedBy, ts)
+}
+
+// UnquarantineMedia releases the media from quarantine.
+// Returns false if the media wasn't quarantined.
+func (d *Database) UnquarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	count, err := d.statements.quarantine.deleteQuarantinedMedia(ctx, mediaID, mediaOrigin)
+	return count > 0, err
+}
+
+// IsMediaQuarantined returns whether the media has been quarantined.
+func (d *Database) IsMediaQuarantined(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	return d.statements.quarantine.selectQuarantinedMedia(ctx, mediaID, mediaOrigin)
+}
+
+// StorePendingUpload records a media ID which has been created for a later upload.
+// Media IDs which have expired without being uploaded to are removed.
+func (d *Database) StorePendingUpload(
+	ctx context.Context, pendingUpload *types.PendingUpload,
+) error {
+	if err := d.statements.pending.deleteExpiredPendingUploads(ctx, pendingUpload.CreationTimestamp); err != nil {
+		return err
+	}
+	return d.statements.pending.insertPendingUpload(ctx, pendingUpload)
+}
+
+// GetPendingUpload returns the created media ID if it hasn't been uploaded to and hasn't expired at ts.
+// Returns nil if there is no such media ID.
+func (d *Database) GetPendingUpload(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) (*types.PendingUpload, error) {
+	pendingUpload, err := d.statements.pending.selectPendingUpload(ctx, mediaID, mediaOrigin, ts)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pendingUpload, err
+}
+
+// GetPendingUploadCount returns the number of media IDs the user has created which haven't been uploaded to and
+// haven't expired at ts.
+func (d *Database) GetPendingUploadCount(
+	ctx context.Context, userID types.MatrixUserID, ts types.UnixMs,
+) (int, error) {
+	return d.statements.pending.selectPendingUploadCount(ctx, userID, ts)
+}
+
+// DeletePendingUpload removes a created media ID once it has been uploaded to.
+func (d *Database) DeletePendingUpload(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.pending.deletePendingUpload(ctx, mediaID, mediaOrigin)
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	ctx          = context.Background()
+	localServer  = gomatrixserverlib.ServerName("hollow.knight")
+	remoteServer = gomatrixserverlib.ServerName("pale.court")
+)
+
+// mustCreateDatabase creates an empty database, which is on the server named by
+// DENDRITE_TEST_DATABASE if it is set. The returned function removes it again.
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.Open(dataSource, nil)
+	if err != nil {
+		closeDB()
+		t.Fatalf("storage.Open returned %s", err)
+	}
+	return db, closeDB
+}
+
+func mustStoreMedia(t *testing.T, db storage.Database, mediaID types.MediaID, origin gomatrixserverlib.ServerName, userID types.MatrixUserID) *types.MediaMetadata {
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        origin,
+		ContentType:   "image/png",
+		FileSizeBytes: 10,
+		UploadName:    "grub.png",
+		Base64Hash:    types.Base64Hash("hash-" + mediaID),
+		UserID:        userID,
+	}
+	if err := db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		t.Fatalf("StoreMediaMetadata returned %s", err)
+	}
+	return mediaMetadata
+}
+
+func nowMs() types.UnixMs {
+	return types.UnixMs(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func TestUpdateMediaLastAccess(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	mustStoreMedia(t, db, "accessed", remoteServer, "")
+	mustStoreMedia(t, db, "forgotten", remoteServer, "")
+
+	ts := nowMs()
+	if err := db.UpdateMediaLastAccess(ctx, "accessed", remoteServer, ts+3600000); err != nil {
+		t.Fatalf("UpdateMediaLastAccess returned %s", err)
+	}
+
+	expired, err := db.GetExpiredMedia(ctx, localServer, ts+60000, 0)
+	if err != nil {
+		t.Fatalf("GetExpiredMedia returned %s", err)
+	}
+	if len(expired) != 1 || expired[0].MediaID != "forgotten" {
+		t.Fatalf("expected only the media which wasn't accessed to expire, got %+v", expired)
+	}
+}
+
+func TestQuarantineMedia(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	mustStoreMedia(t, db, "grub", localServer, "@knight:hollow.knight")
+	mustStoreMedia(t, db, "geo", localServer, "@knight:hollow.knight")
+	mustStoreMedia(t, db, "charm", localServer, "@hornet:hollow.knight")
+	mustStoreMedia(t, db, "dream", remoteServer, "@knight:hollow.knight")
+	ts := nowMs()
+
+	// Media which hasn't been fetched yet can be quarantined, but only once
+	for _, want := range []int64{1, 0} {
+		count, err := db.QuarantineMedia(ctx, "unfetched", remoteServer, "@admin:hollow.knight", ts)
+		if err != nil {
+			t.Fatalf("QuarantineMedia returned %s", err)
+		}
+		if count != want {
+			t.Fatalf("QuarantineMedia: expected %d newly quarantined, got %d", want, count)
+		}
+	}
+
+	if _, err := db.QuarantineMedia(ctx, "geo", localServer, "@admin:hollow.knight", ts); err != nil {
+		t.Fatalf("QuarantineMedia returned %s", err)
+	}
+	// Only the user's media on the given server which wasn't already quarantined is counted
+	count, err := db.QuarantineMediaByUser(ctx, "@knight:hollow.knight", localServer, "@admin:hollow.knight", ts)
+	if err != nil {
+		t.Fatalf("QuarantineMediaByUser returned %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("QuarantineMediaByUser: expected 1 newly quarantined, got %d", count)
+	}
+
+	for _, tc := range []struct {
+		mediaID types.MediaID
+		origin  gomatrixserverlib.ServerName
+		want    bool
+	}{
+		{"unfetched", remoteServer, true},
+		{"grub", localServer, true},
+		{"geo", localServer, true},
+		{"charm", localServer, false},
+		{"dream", remoteServer, false},
+	} {
+		quarantined, err := db.IsMediaQuarantined(ctx, tc.mediaID, tc.origin)
+		if err != nil {
+			t.Fatalf("IsMediaQuarantined returned %s", err)
+		}
+		if quarantined != tc.want {
+			t.Errorf("IsMediaQuarantined(%s/%s): expected %v, got %v", tc.origin, tc.mediaID, tc.want, quarantined)
+		}
+	}
+
+	// Quarantined media is kept for review rather than expiring
+	expired, err := db.GetExpiredMedia(ctx, localServer, ts+60000, ts+60000)
+	if err != nil {
+		t.Fatalf("GetExpiredMedia returned %s", err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("expected the unquarantined media to expire, got %+v", expired)
+	}
+	for _, mediaMetadata := range expired {
+		if mediaMetadata.MediaID != "charm" && mediaMetadata.MediaID != "dream" {
+			t.Errorf("quarantined media %s expired", mediaMetadata.MediaID)
+		}
+	}
+
+	for _, want := range []bool{true, false} {
+		released, err := db.UnquarantineMedia(ctx, "grub", localServer)
+		if err != nil {
+			t.Fatalf("UnquarantineMedia returned %s", err)
+		}
+		if released != want {
+			t.Fatalf("UnquarantineMedia: expected %v, got %v", want, released)
+		}
+	}
+	if quarantined, err := db.IsMediaQuarantined(ctx, "grub", localServer); err != nil || quarantined {
+		t.Fatalf("IsMediaQuarantined: expected media to be released, got %v (%v)", quarantined, err)
+	}
+}
+
+func TestPendingUploads(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+
+	ts := nowMs()
+	for _, pendingUpload := range []*types.PendingUpload{
+		{MediaID: "later", Origin: localServer, UserID: "@knight:hollow.knight", CreationTimestamp: ts, ExpiresTimestamp: ts + 1000},
+		{MediaID: "sooner", Origin: localServer, UserID: "@knight:hollow.knight", CreationTimestamp: ts, ExpiresTimestamp: ts + 10},
+		{MediaID: "other", Origin: localServer, UserID: "@hornet:hollow.knight", CreationTimestamp: ts, ExpiresTimestamp: ts + 1000},
+	} {
+		if err := db.StorePendingUpload(ctx, pendingUpload); err != nil {
+			t.Fatalf("StorePendingUpload returned %s", err)
+		}
+	}
+
+	pendingUpload, err := db.GetPendingUpload(ctx, "later", localServer, ts)
+	if err != nil {
+		t.Fatalf("GetPendingUpload returned %s", err)
+	}
+	if pendingUpload == nil || pendingUpload.UserID != "@knight:hollow.knight" || pendingUpload.ExpiresTimestamp != ts+1000 {
+		t.Fatalf("GetPendingUpload: unexpected pending upload %+v", pendingUpload)
+	}
+	if pendingUpload, err = db.GetPendingUpload(ctx, "later", remoteServer, ts); err != nil || pendingUpload != nil {
+		t.Fatalf("GetPendingUpload: expected no pending upload on another server, got %+v (%v)", pendingUpload, err)
+	}
+
+	// Media IDs which have expired aren't returned or counted
+	if pendingUpload, err = db.GetPendingUpload(ctx, "sooner", localServer, ts+10); err != nil || pendingUpload != nil {
+		t.Fatalf("GetPendingUpload: expected expired media ID to be ignored, got %+v (%v)", pendingUpload, err)
+	}
+	for _, tc := range []struct {
+		ts   types.UnixMs
+		want int
+	}{
+		{ts, 2},
+		{ts + 10, 1},
+		{ts + 1000, 0},
+	} {
+		count, err := db.GetPendingUploadCount(ctx, "@knight:hollow.knight", tc.ts)
+		if err != nil {
+			t.Fatalf("GetPendingUploadCount returned %s", err)
+		}
+		if count != tc.want {
+			t.Errorf("GetPendingUploadCount at %d: expected %d, got %d", tc.ts-ts, tc.want, count)
+		}
+	}
+
+	if err = db.DeletePendingUpload(ctx, "later", localServer); err != nil {
+		t.Fatalf("DeletePendingUpload returned %s", err)
+	}
+	if pendingUpload, err = db.GetPendingUpload(ctx, "later", localServer, ts); err != nil || pendingUpload != nil {
+		t.Fatalf("GetPendingUpload: expected deleted media ID to be gone, got %+v (%v)", pendingUpload, err)
+	}
+	if pendingUpload, err = db.GetPendingUpload(ctx, "other", localServer, ts); err != nil || pendingUpload == nil {
+		t.Fatalf("GetPendingUpload: expected other user's media ID to remain, got %+v (%v)", pendingUpload, err)
+	}
+}
@@ -15,14 +15,19 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
-	"path/filepath"
+	"path"
 	"sync"
 
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	log "github.com/sirupsen/logrus"
@@ -39,13 +44,15 @@ type thumbnailFitness struct {
 // thumbnailTemplate is the filename template for thumbnails
 const thumbnailTemplate = "thumbnail-%vx%v-%v"
 
-// GetThumbnailPath returns the path to a thumbnail given the absolute src path and thumbnail size configuration
-func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
-	srcDir := filepath.Dir(string(src))
-	return types.Path(filepath.Join(
-		srcDir,
-		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
-	))
+// GetThumbnailPath returns the path to a thumbnail in the file store given the src path, thumbnail size configuration
+// and the content type of the thumbnail. JPEG thumbnails keep the path they had before other formats were supported.
+func GetThumbnailPath(src types.Path, config types.ThumbnailSize, contentType types.ContentType) types.Path {
+	srcDir := path.Dir(string(src))
+	name := fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod)
+	if contentType == types.ThumbnailWebP {
+		name += ".webp"
+	}
+	return types.Path(path.Join(srcDir, name))
 }
 
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
@@ -133,15 +140,17 @@ func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.Active
 
 func isThumbnailExists(
 	ctx context.Context,
+	store filestore.FileStore,
 	dst types.Path,
 	config types.ThumbnailSize,
+	contentType types.ContentType,
 	mediaMetadata *types.MediaMetadata,
 	db storage.Database,
 	logger *log.Entry,
 ) (bool, error) {
 	thumbnailMetadata, err := db.GetThumbnail(
 		ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
-		config.Width, config.Height, config.ResizeMethod,
+		config.Width, config.Height, config.ResizeMethod, contentType,
 	)
 	if err != nil {
 		logger.Error("Failed to query database for thumbnail.")
@@ -150,15 +159,103 @@ func isThumbnailExists(
 	if thumbnailMetadata != nil {
 		return true, nil
 	}
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if _, err = os.Stat(string(dst)); !os.IsNotExist(err) {
+	if _, err = store.Stat(ctx, string(dst)); err == nil {
 		// Thumbnail exists
 		return true, nil
+	} else if err != filestore.ErrNotFound {
+		logger.WithError(err).Error("Failed to check the file store for thumbnail.")
+		return false, err
 	}
 	return false, nil
 }
 
+// isAnimated checks whether the image data is an animated GIF, APNG or WebP.
+// Animated images are thumbnailed using their first frame even when they are
+// smaller than the requested size, so that clients get a static thumbnail.
+func isAnimated(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return countGIFFrames(data) > 1
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// An APNG has an animation control chunk before the image data
+		for pos := 8; pos+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			switch string(data[pos+4 : pos+8]) {
+			case "acTL":
+				return true
+			case "IDAT":
+				return false
+			}
+			pos += 12 + length
+		}
+	case len(data) >= 21 && string(data[0:4]) == "RIFF" && string(data[8:16]) == "WEBPVP8X":
+		// The extended format header flags animation
+		return data[20]&0x02 != 0
+	}
+	return false
+}
+
+// countGIFFrames counts the image descriptors in GIF data without decoding them
+func countGIFFrames(data []byte) int {
+	const headerSize = 13
+	if len(data) < headerSize {
+		return 0
+	}
+	pos := headerSize
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	// skipSubBlocks returns the position after a sequence of data sub-blocks
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos = skipSubBlocks(pos + 2)
+		case 0x2c: // image descriptor
+			frames++
+			if pos+10 > len(data) {
+				return frames
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// Skip the LZW minimum code size and the image data
+			pos = skipSubBlocks(pos + 1)
+		default: // trailer or corrupt data
+			return frames
+		}
+	}
+	return frames
+}
+
+// writeTempFile writes the encoded thumbnail to a temporary file, which the
+// caller moves into the file store. Returns the path of the temporary file.
+func writeTempFile(encode func(io.Writer) error) (types.Path, error) {
+	out, err := ioutil.TempFile("", "thumbnail-")
+	if err != nil {
+		return "", err
+	}
+	if err = encode(out); err != nil {
+		out.Close()           // nolint: errcheck
+		os.Remove(out.Name()) // nolint: errcheck
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(out.Name()) // nolint: errcheck
+		return "", err
+	}
+	return types.Path(out.Name()), nil
+}
+
 // init with worst values
 func newThumbnailFitness() thumbnailFitness {
 	return thumbnailFitness{
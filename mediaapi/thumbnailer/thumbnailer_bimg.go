@@ -18,10 +18,12 @@ package thumbnailer
 
 import (
 	"context"
-	"os"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	log "github.com/sirupsen/logrus"
@@ -31,6 +33,7 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
@@ -39,17 +42,18 @@ func GenerateThumbnails(
 	db *storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := readFile(ctx, store, string(src))
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
+	animated := isAnimated(buffer)
 	for _, config := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-			maxThumbnailGenerators, db, logger,
+			ctx, store, src, img, animated, types.ThumbnailSize(config), types.ThumbnailJPEG,
+			mediaMetadata, activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -62,18 +66,20 @@ func GenerateThumbnails(
 	return false, nil
 }
 
-// GenerateThumbnail generates the configured thumbnail size for the source file
+// GenerateThumbnail generates the configured thumbnail size for the source file in the given content type
 func GenerateThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	config types.ThumbnailSize,
+	contentType types.ContentType,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db *storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := readFile(ctx, store, string(src))
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -83,8 +89,8 @@ func GenerateThumbnail(
 	img := bimg.NewImage(buffer)
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		ctx, store, src, img, isAnimated(buffer), config, contentType, mediaMetadata,
+		activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -102,9 +108,12 @@ func GenerateThumbnail(
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	img *bimg.Image,
+	animated bool,
 	config types.ThumbnailSize,
+	contentType types.ContentType,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -115,14 +124,24 @@ func createThumbnail(
 		"Width":        config.Width,
 		"Height":       config.Height,
 		"ResizeMethod": config.ResizeMethod,
+		"ContentType":  contentType,
 	})
 
-	// Check if request is larger than original
+	// Check if request is larger than original. Animated images are still
+	// thumbnailed, using their first frame, but no larger than the original.
+	width, height := config.Width, config.Height
 	if isLargerThanOriginal(config, img) {
-		return false, nil
+		if !animated {
+			return false, nil
+		}
+		imgSize, err := img.Size()
+		if err != nil {
+			return false, err
+		}
+		width, height = imgSize.Width, imgSize.Height
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := GetThumbnailPath(src, config, contentType)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -146,13 +165,13 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, dst, config, contentType, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	width, height, err = resize(ctx, store, dst, img, width, height, config.ResizeMethod == "crop", contentType, logger)
 	if err != nil {
 		return false, err
 	}
@@ -162,18 +181,17 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := store.Stat(ctx, string(dst))
 	if err != nil {
 		return false, err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   contentType,
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -194,6 +212,15 @@ func createThumbnail(
 	return false, nil
 }
 
+func readFile(ctx context.Context, store filestore.FileStore, src string) ([]byte, error) {
+	file, _, err := store.Open(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+	return ioutil.ReadAll(file)
+}
+
 func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 	imgSize, err := img.Size()
 	if err == nil && config.Width >= imgSize.Width && config.Height >= imgSize.Height {
@@ -205,15 +232,20 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func resize(ctx context.Context, store filestore.FileStore, dst types.Path, inImage *bimg.Image, w, h int, crop bool, contentType types.ContentType, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
 	}
 
+	// Thumbnails never carry the metadata of the source image
 	options := bimg.Options{
-		Type:    bimg.JPEG,
-		Quality: 85,
+		Type:          bimg.JPEG,
+		Quality:       85,
+		StripMetadata: true,
+	}
+	if contentType == types.ThumbnailWebP {
+		options.Type = bimg.WEBP
 	}
 	if crop {
 		options.Width = w
@@ -239,7 +271,14 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 		return -1, -1, err
 	}
 
-	if err = bimg.Write(string(dst), newImage); err != nil {
+	tmpPath, err := writeTempFile(func(out io.Writer) error {
+		_, writeErr := out.Write(newImage)
+		return writeErr
+	})
+	if err == nil {
+		err = store.Put(ctx, string(dst), tmpPath)
+	}
+	if err != nil {
 		logger.WithError(err).Error("Failed to resize image")
 		return -1, -1, err
 	}
@@ -17,6 +17,7 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
 	"image"
 	"image/draw"
@@ -27,10 +28,12 @@ import (
 
 	// Imported for png codec
 	_ "image/png"
-	"os"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/filestore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/nfnt/resize"
@@ -40,6 +43,7 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
@@ -48,7 +52,7 @@ func GenerateThumbnails(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	img, animated, err := readFile(ctx, store, string(src))
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
@@ -56,8 +60,8 @@ func GenerateThumbnails(
 	for _, singleConfig := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+			ctx, store, src, img, animated, types.ThumbnailSize(singleConfig), types.ThumbnailJPEG,
+			mediaMetadata, activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -70,18 +74,20 @@ func GenerateThumbnails(
 	return false, nil
 }
 
-// GenerateThumbnail generates the configured thumbnail size for the source file
+// GenerateThumbnail generates the configured thumbnail size for the source file in the given content type
 func GenerateThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	config types.ThumbnailSize,
+	contentType types.ContentType,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	img, animated, err := readFile(ctx, store, string(src))
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -90,8 +96,8 @@ func GenerateThumbnail(
 	}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		ctx, store, src, img, animated, config, contentType, mediaMetadata,
+		activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -105,40 +111,66 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+// readFile decodes the src file and reports whether it is animated.
+// For animated images the first frame is returned: the GIF decoder returns the
+// first frame, which is drawn onto the full canvas as it may only cover part of
+// it, and the PNG decoder returns the default image of an APNG.
+// Note: WebP sources can only be thumbnailed when built with bimg.
+func readFile(ctx context.Context, store filestore.FileStore, src string) (image.Image, bool, error) {
+	file, _, err := store.Open(ctx, src)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer file.Close() // nolint: errcheck
 
-	img, _, err := image.Decode(file)
+	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return img, nil
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	if format == "gif" {
+		imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, err
+		}
+		canvas := image.NewRGBA(image.Rect(0, 0, imgConfig.Width, imgConfig.Height))
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = canvas
+	}
+
+	return img, isAnimated(data), nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
+// writeFile encodes the thumbnail, which carries none of the metadata of the source image
+func writeFile(ctx context.Context, store filestore.FileStore, img image.Image, dst string, contentType types.ContentType) error {
+	tmpPath, err := writeTempFile(func(out io.Writer) error {
+		if contentType == types.ThumbnailWebP {
+			return encodeWebP(out, img)
+		}
+		return jpeg.Encode(out, img, &jpeg.Options{
+			Quality: 85,
+		})
+	})
 	if err != nil {
 		return err
 	}
-	defer (func() { err = out.Close() })()
-
-	return jpeg.Encode(out, img, &jpeg.Options{
-		Quality: 85,
-	})
+	return store.Put(ctx, dst, tmpPath)
 }
 
 // createThumbnail checks if the thumbnail exists, and if not, generates it
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
+	store filestore.FileStore,
 	src types.Path,
 	img image.Image,
+	animated bool,
 	config types.ThumbnailSize,
+	contentType types.ContentType,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -149,14 +181,20 @@ func createThumbnail(
 		"Width":        config.Width,
 		"Height":       config.Height,
 		"ResizeMethod": config.ResizeMethod,
+		"ContentType":  contentType,
 	})
 
-	// Check if request is larger than original
-	if config.Width >= img.Bounds().Dx() && config.Height >= img.Bounds().Dy() {
-		return false, nil
+	// Check if request is larger than original. Animated images are still
+	// thumbnailed, but no larger than the original.
+	width, height := config.Width, config.Height
+	if width >= img.Bounds().Dx() && height >= img.Bounds().Dy() {
+		if !animated {
+			return false, nil
+		}
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := GetThumbnailPath(src, config, contentType)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -180,13 +218,13 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, dst, config, contentType, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	width, height, err = adjustSize(ctx, store, dst, img, width, height, config.ResizeMethod == types.Crop, contentType, logger)
 	if err != nil {
 		return false, err
 	}
@@ -196,18 +234,17 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := store.Stat(ctx, string(dst))
 	if err != nil {
 		return false, err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   contentType,
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -231,7 +268,7 @@ func createThumbnail(
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func adjustSize(ctx context.Context, store filestore.FileStore, dst types.Path, img image.Image, w, h int, crop bool, contentType types.ContentType, logger *log.Entry) (int, int, error) {
 	var out image.Image
 	var err error
 	if crop {
@@ -262,7 +299,7 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
+	if err = writeFile(ctx, store, out, string(dst), contentType); err != nil {
 		logger.WithError(err).Error("Failed to encode and write image")
 		return -1, -1, err
 	}
@@ -0,0 +1,519 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// predictorBits is the log2 of the size of the blocks which share a predictor
+const predictorBits = 4
+
+// The order in which the code length code lengths are written, as per the spec
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP writes the image as a lossless (VP8L) WebP. The pixels are passed
+// through the subtract green and predictor transforms and then Huffman coded
+// as literals. Backward references and colour caches are not used, which keeps
+// the encoder simple at the cost of some compression.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return fmt.Errorf("cannot encode a %dx%d image as WebP", width, height)
+	}
+
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			argb[y*width+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(uint32(boolToInt(hasAlpha)), 1)
+	bw.write(0, 3)
+
+	// The decoder undoes the transforms in reverse order, so the predictor
+	// operates on the pixels after green has been subtracted.
+	bw.write(1, 1)
+	bw.write(2, 2)
+	subtractGreen(argb)
+
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(predictorBits-2, 3)
+	modes := applyPredictors(argb, width, height)
+	writeEntropyCodedImage(bw, modes, false)
+
+	bw.write(0, 1)
+	writeEntropyCodedImage(bw, argb, true)
+
+	data := bw.bytes()
+	padding := len(data) & 1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+padding))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padding != 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// subtractGreen replaces the red and blue channels with their difference to green
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// applyPredictors picks the predictor for each block which gives the smallest
+// residuals, replaces the pixels with the residuals and returns the sub-image
+// of chosen predictors.
+func applyPredictors(argb []uint32, width, height int) []uint32 {
+	blockSize := 1 << predictorBits
+	tilesX := (width + blockSize - 1) >> predictorBits
+	tilesY := (height + blockSize - 1) >> predictorBits
+	modes := make([]uint32, tilesX*tilesY)
+	src := make([]uint32, len(argb))
+	copy(src, argb)
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0, y0 := tx*blockSize, ty*blockSize
+			x1, y1 := min(x0+blockSize, width), min(y0+blockSize, height)
+
+			bestMode, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(subPixels(src[y*width+x], predict(mode, src, x, y, width)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					argb[y*width+x] = subPixels(src[y*width+x], predict(bestMode, src, x, y, width))
+				}
+			}
+			modes[ty*tilesX+tx] = uint32(bestMode) << 8
+		}
+	}
+	return modes
+}
+
+// predict returns the prediction of a pixel using the given predictor mode.
+// The top-left pixel, top row and left column use fixed predictors.
+func predict(mode int, px []uint32, x, y, width int) uint32 {
+	i := y*width + x
+	if y == 0 {
+		if x == 0 {
+			return 0xff000000
+		}
+		return px[i-1]
+	}
+	if x == 0 {
+		return px[i-width]
+	}
+	// Note: on the rightmost column TR wraps to the leftmost pixel of the current row, as required by the spec
+	l, t, tl, tr := px[i-1], px[i-width], px[i-width-1], px[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		return selectPixel(l, t, tl)
+	case 12:
+		return mapChannels(func(c uint) int {
+			return channel(l, c) + channel(t, c) - channel(tl, c)
+		})
+	default:
+		avg := average2(l, t)
+		return mapChannels(func(c uint) int {
+			return channel(avg, c) + (channel(avg, c)-channel(tl, c))/2
+		})
+	}
+}
+
+func channel(p uint32, shift uint) int {
+	return int((p >> shift) & 0xff)
+}
+
+// mapChannels builds a pixel from the clamped result of f for each channel
+func mapChannels(f func(shift uint) int) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := f(shift)
+		if v < 0 {
+			v = 0
+		} else if v > 0xff {
+			v = 0xff
+		}
+		p |= uint32(v) << shift
+	}
+	return p
+}
+
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// selectPixel returns whichever of the left and top pixels is closest to the gradient estimate
+func selectPixel(l, t, tl uint32) uint32 {
+	distL, distT := 0, 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		distL += abs(channel(t, shift) - channel(tl, shift))
+		distT += abs(channel(l, shift) - channel(tl, shift))
+	}
+	if distL < distT {
+		return l
+	}
+	return t
+}
+
+// subPixels subtracts each channel of b from a, modulo 256
+func subPixels(a, b uint32) uint32 {
+	alphaAndGreen := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	redAndBlue := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return alphaAndGreen&0xff00ff00 | redAndBlue&0x00ff00ff
+}
+
+func residualCost(p uint32) int {
+	cost := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		cost += abs(int(int8(p >> shift)))
+	}
+	return cost
+}
+
+// writeEntropyCodedImage writes the pixels with a single group of prefix codes.
+// The main image additionally signals that it has no meta prefix codes.
+func writeEntropyCodedImage(bw *bitWriter, argb []uint32, isMain bool) {
+	// No colour cache
+	bw.write(0, 1)
+	if isMain {
+		bw.write(0, 1)
+	}
+
+	// Green, red, blue and alpha literals. The green alphabet also holds the
+	// 24 length prefixes and the distance alphabet has 40 symbols, none of
+	// which are used.
+	histograms := [5][]uint32{
+		make([]uint32, 256+24), make([]uint32, 256), make([]uint32, 256), make([]uint32, 256), make([]uint32, 40),
+	}
+	for _, p := range argb {
+		histograms[0][(p>>8)&0xff]++
+		histograms[1][(p>>16)&0xff]++
+		histograms[2][p&0xff]++
+		histograms[3][p>>24]++
+	}
+	var codes [5]huffmanCode
+	for i, histogram := range histograms {
+		codes[i] = writeHuffmanCode(bw, histogram)
+	}
+
+	for _, p := range argb {
+		codes[0].write(bw, int((p>>8)&0xff))
+		codes[1].write(bw, int((p>>16)&0xff))
+		codes[2].write(bw, int(p&0xff))
+		codes[3].write(bw, int(p>>24))
+	}
+}
+
+// writeHuffmanCode builds a prefix code for the histogram and writes it,
+// using the simple encoding when no more than two literal symbols are used.
+func writeHuffmanCode(bw *bitWriter, histogram []uint32) huffmanCode {
+	var used []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		bw.write(1, 1)
+		lengths := make([]uint8, len(histogram))
+		for _, symbol := range used {
+			bw.write(uint32(symbol), 8)
+			if len(used) == 2 {
+				lengths[symbol] = 1
+			}
+		}
+		return newHuffmanCode(lengths)
+	}
+
+	lengths := huffmanLengths(histogram, 15)
+
+	// Run-length encode the code lengths, using 17 and 18 for runs of zeros
+	type token struct {
+		symbol, extra, extraBits int
+	}
+	var tokens []token
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, token{int(lengths[i]), 0, 0})
+			i++
+			continue
+		}
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			tokens = append(tokens, token{18, run - 11, 7})
+		case run >= 3:
+			tokens = append(tokens, token{17, run - 3, 3})
+		default:
+			run = 1
+			tokens = append(tokens, token{0, 0, 0})
+		}
+		i += run
+	}
+
+	tokenHistogram := make([]uint32, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		tokenHistogram[t.symbol]++
+	}
+	tokenCode := newHuffmanCode(huffmanLengths(tokenHistogram, 7))
+
+	numCodeLengths := len(codeLengthCodeOrder)
+	for numCodeLengths > 4 && tokenCode.lengths[codeLengthCodeOrder[numCodeLengths-1]] == 0 {
+		numCodeLengths--
+	}
+	bw.write(0, 1)
+	bw.write(uint32(numCodeLengths-4), 4)
+	for _, symbol := range codeLengthCodeOrder[:numCodeLengths] {
+		bw.write(uint32(tokenCode.lengths[symbol]), 3)
+	}
+	// All of the code lengths are written, rather than a max_symbol
+	bw.write(0, 1)
+	for _, t := range tokens {
+		tokenCode.write(bw, t.symbol)
+		bw.write(uint32(t.extra), uint(t.extraBits))
+	}
+
+	return newHuffmanCode(lengths)
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for the histogram,
+// limited to maxLength. If the lengths are too long the smallest counts are
+// raised and the code rebuilt, which converges on a balanced tree. At least two
+// symbols always receive a code so that the code is complete.
+func huffmanLengths(histogram []uint32, maxLength int) []uint8 {
+	type node struct {
+		count  uint32
+		parent int
+	}
+
+	var symbols []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	for symbol := 0; len(symbols) < 2; symbol++ {
+		if histogram[symbol] == 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Ints(symbols)
+
+	for floor := uint32(1); ; floor *= 2 {
+		nodes := make([]node, len(symbols), 2*len(symbols)-1)
+		for i, symbol := range symbols {
+			count := histogram[symbol]
+			if count < floor {
+				count = floor
+			}
+			nodes[i] = node{count, -1}
+		}
+
+		// Indices of the nodes without a parent, sorted by descending count
+		queue := make([]int, len(nodes))
+		for i := range queue {
+			queue[i] = i
+		}
+		sort.SliceStable(queue, func(a, b int) bool {
+			return nodes[queue[a]].count > nodes[queue[b]].count
+		})
+		for len(queue) > 1 {
+			a, b := queue[len(queue)-1], queue[len(queue)-2]
+			queue = queue[:len(queue)-2]
+			parent := len(nodes)
+			nodes = append(nodes, node{nodes[a].count + nodes[b].count, -1})
+			nodes[a].parent = parent
+			nodes[b].parent = parent
+			pos := sort.Search(len(queue), func(i int) bool {
+				return nodes[queue[i]].count <= nodes[parent].count
+			})
+			queue = append(queue, 0)
+			copy(queue[pos+1:], queue[pos:])
+			queue[pos] = parent
+		}
+
+		depths := make([]int, len(nodes))
+		for i := len(nodes) - 2; i >= 0; i-- {
+			depths[i] = depths[nodes[i].parent] + 1
+		}
+
+		lengths := make([]uint8, len(histogram))
+		tooLong := false
+		for i, symbol := range symbols {
+			if depths[i] > maxLength {
+				tooLong = true
+			}
+			lengths[symbol] = uint8(depths[i])
+		}
+		if !tooLong {
+			return lengths
+		}
+	}
+}
+
+// huffmanCode holds canonical prefix codes with their bits reversed, ready to
+// be written least significant bit first.
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint16
+}
+
+func newHuffmanCode(lengths []uint8) huffmanCode {
+	var lengthCounts [16]int
+	for _, length := range lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+	var nextCode [16]int
+	code := 0
+	for length := 1; length < 16; length++ {
+		code = (code + lengthCounts[length-1]) << 1
+		nextCode[length] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		code := nextCode[length]
+		nextCode[length]++
+		var reversed uint16
+		for i := uint8(0); i < length; i++ {
+			reversed = reversed<<1 | uint16(code>>i&1)
+		}
+		codes[symbol] = reversed
+	}
+	return huffmanCode{lengths, codes}
+}
+
+func (h huffmanCode) write(bw *bitWriter, symbol int) {
+	bw.write(uint32(h.codes[symbol]), uint(h.lengths[symbol]))
+}
+
+// bitWriter packs values into bytes least significant bit first
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(value uint32, nbits uint) {
+	w.acc |= uint64(value) << w.nbits
+	w.nbits += nbits
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 11), uint8(x + y), uint8(255 - x)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data)%2 != 0 {
+		t.Errorf("expected an even file size, got %d", len(data))
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+		t.Fatalf("unexpected header %q", data[0:16])
+	}
+	if riffSize := binary.LittleEndian.Uint32(data[4:]); int(riffSize) != len(data)-8 {
+		t.Errorf("expected RIFF size %d, got %d", len(data)-8, riffSize)
+	}
+	if data[20] != 0x2f {
+		t.Fatalf("expected VP8L signature, got %#x", data[20])
+	}
+	header := binary.LittleEndian.Uint32(data[21:])
+	width, height, alpha := header&0x3fff+1, (header>>14)&0x3fff+1, header>>28&1
+	if width != 37 || height != 21 || alpha != 1 {
+		t.Errorf("expected 37x21 with alpha, got %dx%d alpha=%d", width, height, alpha)
+	}
+}
+
+func TestIsAnimated(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	}
+	encodeGIF := func(frames int) []byte {
+		g := &gif.GIF{}
+		for i := 0; i < frames; i++ {
+			g.Image = append(g.Image, frame())
+			g.Delay = append(g.Delay, 10)
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	if isAnimated(encodeGIF(1)) {
+		t.Error("expected a single frame GIF not to be animated")
+	}
+	if !isAnimated(encodeGIF(3)) {
+		t.Error("expected a three frame GIF to be animated")
+	}
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02")
+	if !isAnimated(webp) {
+		t.Error("expected a WebP with the animation flag to be animated")
+	}
+	webp[20] = 0x10
+	if isAnimated(webp) {
+		t.Error("expected a WebP without the animation flag not to be animated")
+	}
+}
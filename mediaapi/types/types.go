@@ -60,6 +60,15 @@ type MediaMetadata struct {
 	UserID            MatrixUserID
 }
 
+// PendingUpload is a media ID which has been created for media that will be uploaded later, as per MSC2246
+type PendingUpload struct {
+	MediaID           MediaID
+	Origin            gomatrixserverlib.ServerName
+	UserID            MatrixUserID
+	CreationTimestamp UnixMs
+	ExpiresTimestamp  UnixMs
+}
+
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
 type RemoteRequestResult struct {
 	// Condition used for the requester to signal the result to all other routines waiting on this condition
@@ -108,3 +117,9 @@ const Crop = "crop"
 
 // Scale indicates we should scale the thumbnail on resize
 const Scale = "scale"
+
+// ThumbnailJPEG is the content type of thumbnails, unless the client accepts WebP
+const ThumbnailJPEG ContentType = "image/jpeg"
+
+// ThumbnailWebP is the content type of thumbnails for clients which accept WebP
+const ThumbnailWebP ContentType = "image/webp"
@@ -16,13 +16,17 @@ package directory
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -47,6 +51,9 @@ func GetPostPublicRooms(
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
+	if tokenErr := checkPublicRoomsToken(request); tokenErr != nil {
+		return *tokenErr
+	}
 	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
 	if err != nil {
 		return jsonerror.InternalServerError()
@@ -66,6 +73,9 @@ func GetPostPublicRoomsWithExternal(
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
+	if tokenErr := checkPublicRoomsToken(request); tokenErr != nil {
+		return *tokenErr
+	}
 	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
 	if err != nil {
 		return jsonerror.InternalServerError()
@@ -102,6 +112,70 @@ func GetPostPublicRoomsWithExternal(
 	}
 }
 
+// GetPostPublicRoomsOnServer implements GET and POST /publicRooms when the
+// `server` parameter names a remote server, by proxying the query to that
+// server's directory over federation.
+func GetPostPublicRoomsOnServer(
+	req *http.Request, cfg *config.Dendrite, fedClient *gomatrixserverlib.FederationClient,
+	serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if fedClient == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Querying remote room directories is not supported by this server"),
+		}
+	}
+	var request PublicRoomReq
+	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+		return *fillErr
+	}
+	response, err := fetchPublicRoomsFromServer(req.Context(), cfg, fedClient, serverName, request)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("server", serverName).Error("fetchPublicRoomsFromServer failed")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to query the room directory of " + string(serverName)),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
+
+// fetchPublicRoomsFromServer queries the public rooms of a remote server. Plain
+// queries use GET, but filtered queries have to be sent as a POST since the
+// filter can only be expressed in the request body.
+func fetchPublicRoomsFromServer(
+	ctx context.Context, cfg *config.Dendrite, fedClient *gomatrixserverlib.FederationClient,
+	serverName gomatrixserverlib.ServerName, request PublicRoomReq,
+) (*gomatrixserverlib.RespPublicRooms, error) {
+	if request.Filter.SearchTerms == "" {
+		res, err := fedClient.GetPublicRooms(ctx, serverName, int(request.Limit), request.Since, false, "")
+		if err != nil {
+			return nil, err
+		}
+		return &res, nil
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPost, serverName, "/_matrix/federation/v1/publicRooms")
+	if err := fedReq.SetContent(request); err != nil {
+		return nil, err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	var res gomatrixserverlib.RespPublicRooms
+	if err = fedClient.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 // bulkFetchPublicRoomsFromServers fetches public rooms from the list of homeservers.
 // Returns a list of public rooms up to the limit specified.
 func bulkFetchPublicRoomsFromServers(
@@ -175,16 +249,14 @@ FanIn:
 
 func publicRooms(ctx context.Context, request PublicRoomReq, publicRoomDatabase storage.Database) (*gomatrixserverlib.RespPublicRooms, error) {
 	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
-	// In that case, we want to assign 0 so we ignore the error
-	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
+	since, backwards, err := parsePublicRoomsToken(request.Since)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("parsePublicRoomsToken failed")
 		return nil, err
 	}
+	if since == nil {
+		backwards = false
+	}
 
 	est, err := publicRoomDatabase.CountPublicRooms(ctx)
 	if err != nil {
@@ -193,24 +265,95 @@ func publicRooms(ctx context.Context, request PublicRoomReq, publicRoomDatabase
 	}
 	response.TotalRoomCountEstimate = int(est)
 
-	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
-	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
+	// Ask for one more room than the limit to find out whether there is
+	// another page beyond this one.
+	limit := int(request.Limit)
+	queryLimit := 0
+	if limit > 0 {
+		queryLimit = limit + 1
 	}
-
-	if response.Chunk, err = publicRoomDatabase.GetPublicRooms(
-		ctx, offset, limit, request.Filter.SearchTerms,
-	); err != nil {
+	rooms, err := publicRoomDatabase.GetPublicRooms(
+		ctx, request.Filter.SearchTerms, since, backwards, queryLimit,
+	)
+	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.GetPublicRooms failed")
 		return nil, err
 	}
+	more := limit > 0 && len(rooms) > limit
+	if more {
+		if backwards {
+			rooms = rooms[1:]
+		} else {
+			rooms = rooms[:limit]
+		}
+	}
+	response.Chunk = rooms
+
+	if len(rooms) > 0 {
+		if (backwards && more) || (!backwards && since != nil) {
+			response.PrevBatch = publicRoomsToken(rooms[0], true)
+		}
+		if (!backwards && more) || backwards {
+			response.NextBatch = publicRoomsToken(rooms[len(rooms)-1], false)
+		}
+	}
 
 	return &response, nil
 }
 
+// publicRoomsToken returns a pagination token for the page of rooms after the
+// given room in the directory, or before it if backwards is true.
+func publicRoomsToken(room gomatrixserverlib.PublicRoom, backwards bool) string {
+	direction := "n"
+	if backwards {
+		direction = "p"
+	}
+	token := direction + strconv.Itoa(room.JoinedMembersCount) + ":" + room.RoomID
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// parsePublicRoomsToken parses a pagination token made by publicRoomsToken.
+// An empty token refers to the start of the directory, and returns a nil
+// position.
+func parsePublicRoomsToken(token string) (*types.PublicRoomsPosition, bool, error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(decoded) == 0 || (decoded[0] != 'n' && decoded[0] != 'p') {
+		return nil, false, errors.New("invalid pagination token direction")
+	}
+	parts := strings.SplitN(string(decoded[1:]), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, false, errors.New("invalid pagination token position")
+	}
+	joinedMembers, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	position := &types.PublicRoomsPosition{
+		JoinedMembers: joinedMembers,
+		RoomID:        parts[1],
+	}
+	return position, decoded[0] == 'p', nil
+}
+
+// checkPublicRoomsToken rejects requests for our own directory whose pagination
+// token wasn't made by this server. Tokens for remote directories are passed on
+// untouched, since only the remote server knows what they mean.
+func checkPublicRoomsToken(request PublicRoomReq) *util.JSONResponse {
+	if _, _, err := parsePublicRoomsToken(request.Since); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid pagination token"),
+		}
+	}
+	return nil
+}
+
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
 // on /publicRooms by parsing the incoming HTTP request
 // Filter is only filled for POST requests
@@ -220,19 +363,22 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		// Atoi returns 0 and an error when trying to parse an empty string
 		// In that case, we want to assign 0 so we ignore the error
 		if err != nil && len(httpReq.FormValue("limit")) > 0 {
-			util.GetLogger(httpReq.Context()).WithError(err).Error("strconv.Atoi failed")
-			reqErr := jsonerror.InternalServerError()
-			return &reqErr
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("limit must be an integer"),
+			}
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
-		return nil
 	} else if httpReq.Method == http.MethodPost {
-		return httputil.UnmarshalJSONRequest(httpReq, request)
-	}
-
-	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
+		if reqErr := httputil.UnmarshalJSONRequest(httpReq, request); reqErr != nil {
+			return reqErr
+		}
+	} else {
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
 	}
+	return nil
 }
@@ -0,0 +1,288 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var editableAttributes = []string{
+	"aliases",
+	"canonical_alias",
+	"name",
+	"topic",
+	"world_readable",
+	"guest_can_join",
+	"avatar_url",
+	"visibility",
+}
+
+// MySQL doesn't allow defaults on TEXT columns, so they are set explicitly when
+// inserting a new room instead.
+const publicRoomsSchema = `
+-- Stores all of the rooms with data needed to create the server's room directory
+CREATE TABLE IF NOT EXISTS publicroomsapi_public_rooms(
+	room_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	joined_members BIGINT NOT NULL DEFAULT 0,
+	aliases MEDIUMTEXT NOT NULL,
+	canonical_alias VARCHAR(255) NOT NULL DEFAULT '',
+	name MEDIUMTEXT NOT NULL,
+	topic MEDIUMTEXT NOT NULL,
+	world_readable BOOLEAN NOT NULL DEFAULT false,
+	guest_can_join BOOLEAN NOT NULL DEFAULT false,
+	avatar_url MEDIUMTEXT NOT NULL,
+	visibility BOOLEAN NOT NULL DEFAULT false
+);
+`
+
+const countPublicRoomsSQL = "" +
+	"SELECT COUNT(*) FROM publicroomsapi_public_rooms" +
+	" WHERE visibility = true"
+
+// publicRoomsFilterSQL restricts a query to the rooms whose name, topic or
+// aliases contain the search term. $1 is a lowercased LIKE pattern, or an empty
+// string to match every room.
+const publicRoomsFilterSQL = "" +
+	" AND ($1 = '' OR LOWER(name) LIKE $1 OR LOWER(topic) LIKE $1" +
+	" OR LOWER(canonical_alias) LIKE $1 OR LOWER(aliases) LIKE $1)"
+
+// Rooms are ordered by joined member count and then by room ID, so that every
+// room has a distinct position in the directory which pagination tokens can
+// refer to.
+const selectPublicRoomsSQL = "" +
+	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
+	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
+	publicRoomsFilterSQL +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $2"
+
+const selectPublicRoomsAfterSQL = "" +
+	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
+	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
+	publicRoomsFilterSQL +
+	" AND (joined_members < $2 OR (joined_members = $2 AND room_id > $3))" +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $4"
+
+const selectPublicRoomsBeforeSQL = "" +
+	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
+	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
+	publicRoomsFilterSQL +
+	" AND (joined_members > $2 OR (joined_members = $2 AND room_id < $3))" +
+	" ORDER BY joined_members ASC, room_id DESC" +
+	" LIMIT $4"
+
+const selectRoomVisibilitySQL = "" +
+	"SELECT visibility FROM publicroomsapi_public_rooms" +
+	" WHERE room_id = $1"
+
+const insertNewRoomSQL = "" +
+	"INSERT INTO publicroomsapi_public_rooms(room_id, aliases, name, topic, avatar_url)" +
+	" VALUES ($1, '', '', '', '')"
+
+const incrementJoinedMembersInRoomSQL = "" +
+	"UPDATE publicroomsapi_public_rooms" +
+	" SET joined_members = joined_members + 1" +
+	" WHERE room_id = $1"
+
+const decrementJoinedMembersInRoomSQL = "" +
+	"UPDATE publicroomsapi_public_rooms" +
+	" SET joined_members = joined_members - 1" +
+	" WHERE room_id = $1"
+
+const updateRoomAttributeSQL = "" +
+	"UPDATE publicroomsapi_public_rooms" +
+	" SET %s = $1" +
+	" WHERE room_id = $2"
+
+type publicRoomsStatements struct {
+	countPublicRoomsStmt             *sql.Stmt
+	selectPublicRoomsStmt            *sql.Stmt
+	selectPublicRoomsAfterStmt       *sql.Stmt
+	selectPublicRoomsBeforeStmt      *sql.Stmt
+	selectRoomVisibilityStmt         *sql.Stmt
+	insertNewRoomStmt                *sql.Stmt
+	incrementJoinedMembersInRoomStmt *sql.Stmt
+	decrementJoinedMembersInRoomStmt *sql.Stmt
+	updateRoomAttributeStmts         map[string]*sql.Stmt
+}
+
+func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
+	stmts := statementList{
+		{&s.countPublicRoomsStmt, countPublicRoomsSQL},
+		{&s.selectPublicRoomsStmt, selectPublicRoomsSQL},
+		{&s.selectPublicRoomsAfterStmt, selectPublicRoomsAfterSQL},
+		{&s.selectPublicRoomsBeforeStmt, selectPublicRoomsBeforeSQL},
+		{&s.selectRoomVisibilityStmt, selectRoomVisibilitySQL},
+		{&s.insertNewRoomStmt, insertNewRoomSQL},
+		{&s.incrementJoinedMembersInRoomStmt, incrementJoinedMembersInRoomSQL},
+		{&s.decrementJoinedMembersInRoomStmt, decrementJoinedMembersInRoomSQL},
+	}
+
+	if err = stmts.prepare(db); err != nil {
+		return
+	}
+
+	s.updateRoomAttributeStmts = make(map[string]*sql.Stmt)
+	for _, editable := range editableAttributes {
+		stmt := fmt.Sprintf(updateRoomAttributeSQL, editable)
+		if s.updateRoomAttributeStmts[editable], err = db.Prepare(stmt); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *publicRoomsStatements) countPublicRooms(ctx context.Context) (nb int64, err error) {
+	err = s.countPublicRoomsStmt.QueryRowContext(ctx).Scan(&nb)
+	return
+}
+
+func (s *publicRoomsStatements) selectPublicRooms(
+	ctx context.Context, filter string, since *types.PublicRoomsPosition, backwards bool, limit int,
+) ([]gomatrixserverlib.PublicRoom, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	pattern := searchPattern(filter)
+
+	var rows *sql.Rows
+	var err error
+	switch {
+	case since == nil:
+		rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, pattern, limit)
+	case backwards:
+		rows, err = s.selectPublicRoomsBeforeStmt.QueryContext(
+			ctx, pattern, since.JoinedMembers, since.RoomID, limit,
+		)
+	default:
+		rows, err = s.selectPublicRoomsAfterStmt.QueryContext(
+			ctx, pattern, since.JoinedMembers, since.RoomID, limit,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPublicRooms failed to close rows")
+
+	rooms := []gomatrixserverlib.PublicRoom{}
+	for rows.Next() {
+		var r gomatrixserverlib.PublicRoom
+		var aliasesJSON string
+
+		err = rows.Scan(
+			&r.RoomID, &r.JoinedMembersCount, &aliasesJSON, &r.CanonicalAlias,
+			&r.Name, &r.Topic, &r.WorldReadable, &r.GuestCanJoin, &r.AvatarURL,
+		)
+		if err != nil {
+			return rooms, err
+		}
+
+		if len(aliasesJSON) > 0 {
+			if err := json.Unmarshal([]byte(aliasesJSON), &r.Aliases); err != nil {
+				return rooms, err
+			}
+		}
+
+		rooms = append(rooms, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	// Rooms before the given position are selected in reverse order, so put
+	// them back into directory order.
+	if backwards && since != nil {
+		for i, j := 0, len(rooms)-1; i < j; i, j = i+1, j-1 {
+			rooms[i], rooms[j] = rooms[j], rooms[i]
+		}
+	}
+	return rooms, nil
+}
+
+// searchPattern returns the LIKE pattern which matches the search term anywhere
+// in a lowercased column, or an empty string if there is no search term.
+func searchPattern(filter string) string {
+	if filter == "" {
+		return ""
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(filter))
+	return "%" + escaped + "%"
+}
+
+func (s *publicRoomsStatements) selectRoomVisibility(
+	ctx context.Context, roomID string,
+) (v bool, err error) {
+	err = s.selectRoomVisibilityStmt.QueryRowContext(ctx, roomID).Scan(&v)
+	return
+}
+
+func (s *publicRoomsStatements) insertNewRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.insertNewRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *publicRoomsStatements) incrementJoinedMembersInRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.incrementJoinedMembersInRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *publicRoomsStatements) decrementJoinedMembersInRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.decrementJoinedMembersInRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *publicRoomsStatements) updateRoomAttribute(
+	ctx context.Context, attrName string, attrValue attributeValue, roomID string,
+) error {
+	stmt, isEditable := s.updateRoomAttributeStmts[attrName]
+
+	if !isEditable {
+		return errors.New("Cannot edit " + attrName)
+	}
+
+	var value interface{}
+	switch v := attrValue.(type) {
+	case []string:
+		b, _ := json.Marshal(v)
+		value = string(b)
+	case bool, string:
+		value = attrValue
+	default:
+		return errors.New("Unsupported attribute type, must be bool, string or []string")
+	}
+
+	_, err := stmt.ExecContext(ctx, value, roomID)
+	return err
+}
@@ -21,8 +21,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -57,37 +60,38 @@ const countPublicRoomsSQL = "" +
 	"SELECT COUNT(*) FROM publicroomsapi_public_rooms" +
 	" WHERE visibility = true"
 
+// publicRoomsFilterSQL restricts a query to the rooms whose name, topic or
+// aliases contain the search term. $1 is a lowercased LIKE pattern, or an empty
+// string to match every room.
+const publicRoomsFilterSQL = "" +
+	" AND ($1 = '' OR LOWER(name) LIKE $1 ESCAPE '\\' OR LOWER(topic) LIKE $1 ESCAPE '\\'" +
+	" OR LOWER(canonical_alias) LIKE $1 ESCAPE '\\' OR LOWER(aliases) LIKE $1 ESCAPE '\\')"
+
+// Rooms are ordered by joined member count and then by room ID, so that every
+// room has a distinct position in the directory which pagination tokens can
+// refer to.
 const selectPublicRoomsSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" LIMIT 30 OFFSET $1"
+	publicRoomsFilterSQL +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $2"
 
-const selectPublicRoomsWithLimitSQL = "" +
+const selectPublicRoomsAfterSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" LIMIT $1 OFFSET $2"
+	publicRoomsFilterSQL +
+	" AND (joined_members < $2 OR (joined_members = $2 AND room_id > $3))" +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $4"
 
-const selectPublicRoomsWithFilterSQL = "" +
-	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms" +
-	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(aliases) LIKE LOWER($1))" + // TODO: Is there a better way to search aliases?
-	" ORDER BY joined_members DESC" +
-	" LIMIT 30 OFFSET $2"
-
-const selectPublicRoomsWithLimitAndFilterSQL = "" +
+const selectPublicRoomsBeforeSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms" +
-	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(aliases) LIKE LOWER($1))" + // TODO: Is there a better way to search aliases?
-	" ORDER BY joined_members DESC" +
-	" LIMIT $3 OFFSET $2"
+	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
+	publicRoomsFilterSQL +
+	" AND (joined_members > $2 OR (joined_members = $2 AND room_id < $3))" +
+	" ORDER BY joined_members ASC, room_id DESC" +
+	" LIMIT $4"
 
 const selectRoomVisibilitySQL = "" +
 	"SELECT visibility FROM publicroomsapi_public_rooms" +
@@ -113,30 +117,23 @@ const updateRoomAttributeSQL = "" +
 	" WHERE room_id = $2"
 
 type publicRoomsStatements struct {
-	countPublicRoomsStmt                    *sql.Stmt
-	selectPublicRoomsStmt                   *sql.Stmt
-	selectPublicRoomsWithLimitStmt          *sql.Stmt
-	selectPublicRoomsWithFilterStmt         *sql.Stmt
-	selectPublicRoomsWithLimitAndFilterStmt *sql.Stmt
-	selectRoomVisibilityStmt                *sql.Stmt
-	insertNewRoomStmt                       *sql.Stmt
-	incrementJoinedMembersInRoomStmt        *sql.Stmt
-	decrementJoinedMembersInRoomStmt        *sql.Stmt
-	updateRoomAttributeStmts                map[string]*sql.Stmt
+	countPublicRoomsStmt             *sql.Stmt
+	selectPublicRoomsStmt            *sql.Stmt
+	selectPublicRoomsAfterStmt       *sql.Stmt
+	selectPublicRoomsBeforeStmt      *sql.Stmt
+	selectRoomVisibilityStmt         *sql.Stmt
+	insertNewRoomStmt                *sql.Stmt
+	incrementJoinedMembersInRoomStmt *sql.Stmt
+	decrementJoinedMembersInRoomStmt *sql.Stmt
+	updateRoomAttributeStmts         map[string]*sql.Stmt
 }
 
 func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(publicRoomsSchema)
-	if err != nil {
-		return
-	}
-
 	stmts := statementList{
 		{&s.countPublicRoomsStmt, countPublicRoomsSQL},
 		{&s.selectPublicRoomsStmt, selectPublicRoomsSQL},
-		{&s.selectPublicRoomsWithLimitStmt, selectPublicRoomsWithLimitSQL},
-		{&s.selectPublicRoomsWithFilterStmt, selectPublicRoomsWithFilterSQL},
-		{&s.selectPublicRoomsWithLimitAndFilterStmt, selectPublicRoomsWithLimitAndFilterSQL},
+		{&s.selectPublicRoomsAfterStmt, selectPublicRoomsAfterSQL},
+		{&s.selectPublicRoomsBeforeStmt, selectPublicRoomsBeforeSQL},
 		{&s.selectRoomVisibilityStmt, selectRoomVisibilitySQL},
 		{&s.insertNewRoomStmt, insertNewRoomSQL},
 		{&s.incrementJoinedMembersInRoomStmt, incrementJoinedMembersInRoomSQL},
@@ -164,34 +161,29 @@ func (s *publicRoomsStatements) countPublicRooms(ctx context.Context) (nb int64,
 }
 
 func (s *publicRoomsStatements) selectPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, filter string, since *types.PublicRoomsPosition, backwards bool, limit int,
 ) ([]gomatrixserverlib.PublicRoom, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	pattern := searchPattern(filter)
+
 	var rows *sql.Rows
 	var err error
-
-	if len(filter) > 0 {
-		pattern := "%" + filter + "%"
-		if limit == 0 {
-			rows, err = s.selectPublicRoomsWithFilterStmt.QueryContext(
-				ctx, pattern, offset,
-			)
-		} else {
-			rows, err = s.selectPublicRoomsWithLimitAndFilterStmt.QueryContext(
-				ctx, pattern, limit, offset,
-			)
-		}
-	} else {
-		if limit == 0 {
-			rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, offset)
-		} else {
-			rows, err = s.selectPublicRoomsWithLimitStmt.QueryContext(
-				ctx, limit, offset,
-			)
-		}
+	switch {
+	case since == nil:
+		rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, pattern, limit)
+	case backwards:
+		rows, err = s.selectPublicRoomsBeforeStmt.QueryContext(
+			ctx, pattern, since.JoinedMembers, since.RoomID, limit,
+		)
+	default:
+		rows, err = s.selectPublicRoomsAfterStmt.QueryContext(
+			ctx, pattern, since.JoinedMembers, since.RoomID, limit,
+		)
 	}
-
 	if err != nil {
-		return []gomatrixserverlib.PublicRoom{}, nil
+		return nil, err
 	}
 	defer common.CloseAndLogIfError(ctx, rows, "selectPublicRooms failed to close rows")
 
@@ -217,9 +209,30 @@ func (s *publicRoomsStatements) selectPublicRooms(
 		rooms = append(rooms, r)
 	}
 
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	// Rooms before the given position are selected in reverse order, so put
+	// them back into directory order.
+	if backwards && since != nil {
+		for i, j := 0, len(rooms)-1; i < j; i, j = i+1, j-1 {
+			rooms[i], rooms[j] = rooms[j], rooms[i]
+		}
+	}
 	return rooms, nil
 }
 
+// searchPattern returns the LIKE pattern which matches the search term anywhere
+// in a lowercased column, or an empty string if there is no search term.
+func searchPattern(filter string) string {
+	if filter == "" {
+		return ""
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(filter))
+	return "%" + escaped + "%"
+}
+
 func (s *publicRoomsStatements) selectRoomVisibility(
 	ctx context.Context, roomID string,
 ) (v bool, err error) {
@@ -20,10 +20,9 @@ import (
 	"database/sql"
 	"encoding/json"
 
-	_ "github.com/mattn/go-sqlite3"
-
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -44,6 +43,9 @@ func NewPublicRoomsServerDatabase(dataSourceName string) (*PublicRoomsServerData
 	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, nil); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(db, "publicroomsapi", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	storage := PublicRoomsServerDatabase{
 		db: db,
 	}
@@ -81,14 +83,14 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 }
 
 // GetPublicRooms returns an array containing the local rooms set as publicly visible, ordered by their number
-// of joined members. This array can be limited by a given number of elements, and offset by a given value.
-// If the limit is 0, doesn't limit the number of results. If the offset is 0 too, the array contains all
-// the rooms set as publicly visible on the server.
+// of joined members and then by room ID. If a search term is given, only the rooms whose name, topic or aliases
+// contain it are returned. If a position is given, the array contains the rooms after it in the directory, or
+// the rooms before it if backwards is true. If the limit is 0, doesn't limit the number of results.
 // Returns an error if the retrieval failed.
 func (d *PublicRoomsServerDatabase) GetPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, filter string, since *types.PublicRoomsPosition, backwards bool, limit int,
 ) ([]gomatrixserverlib.PublicRoom, error) {
-	return d.statements.selectPublicRooms(ctx, offset, limit, filter)
+	return d.statements.selectPublicRooms(ctx, filter, since, backwards, limit)
 }
 
 // UpdateRoomFromEvents iterate over a slice of state events and call
@@ -20,11 +20,14 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage/mysql"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/sqlite3"
 )
 
 const schemePostgres = "postgres"
+const schemeCockroachDB = "cockroachdb"
+const schemeMySQL = "mysql"
 const schemeFile = "file"
 
 // NewPublicRoomsServerDatabase opens a database connection.
@@ -34,8 +37,10 @@ func NewPublicRoomsServerDatabase(dataSourceName string, dbProperties common.DbP
 		return postgres.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
-	case schemePostgres:
+	case schemePostgres, schemeCockroachDB:
 		return postgres.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
+	case schemeMySQL:
+		return mysql.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	case schemeFile:
 		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName)
 	default:
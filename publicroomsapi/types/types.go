@@ -22,3 +22,12 @@ type ExternalPublicRoomsProvider interface {
 	// This will be called -on demand- by clients, so cache appropriately!
 	Homeservers() []string
 }
+
+// PublicRoomsPosition is a position in the room directory, which is ordered by
+// joined member count and then by room ID. Pagination tokens refer to one of
+// these rather than to an offset, so that they keep pointing at the same place
+// while rooms are added to or removed from the directory.
+type PublicRoomsPosition struct {
+	JoinedMembers int64
+	RoomID        string
+}
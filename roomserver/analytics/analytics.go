@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package analytics exports membership transitions from the roomserver to
+// external analytics stores.
+package analytics
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// A MembershipTransition is a change in the membership of a user in the
+// current state of a room.
+type MembershipTransition struct {
+	// The ID of the room.
+	RoomID string
+	// The user whose membership changed.
+	UserID string
+	// The membership before the change, "leave" if there was none.
+	From string
+	// The membership after the change.
+	To string
+	// The sender of the event that changed the membership.
+	ActorUserID string
+	// The origin_server_ts of the event that changed the membership.
+	Timestamp gomatrixserverlib.Timestamp
+}
+
+// A Writer writes membership transitions to an analytics store.
+type Writer interface {
+	WriteMembershipTransition(ctx context.Context, transition MembershipTransition) error
+}
+
+// A Sink hands membership transitions to a Writer in the background. It has a
+// bounded queue and never blocks the caller: if the queue is full then the
+// transition is dropped and counted by the
+// dendrite_roomserver_membership_analytics_dropped_total metric.
+type Sink struct {
+	writer      Writer
+	transitions chan MembershipTransition
+}
+
+// NewSink makes a new Sink with room for queueSize transitions in its queue,
+// and starts writing them to the writer.
+func NewSink(writer Writer, queueSize int) *Sink {
+	s := &Sink{
+		writer:      writer,
+		transitions: make(chan MembershipTransition, queueSize),
+	}
+	go s.run()
+	return s
+}
+
+// Send queues the transition to be written. It is safe to call on a nil Sink,
+// in which case it does nothing.
+func (s *Sink) Send(transition MembershipTransition) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.transitions <- transition:
+	default:
+		droppedTotal.Inc()
+	}
+}
+
+func (s *Sink) run() {
+	for transition := range s.transitions {
+		if err := s.writer.WriteMembershipTransition(context.Background(), transition); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"room_id": transition.RoomID,
+				"user_id": transition.UserID,
+			}).Error("Failed to write membership transition to analytics sink")
+		}
+	}
+}
+
+var droppedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "membership_analytics_dropped_total",
+		Help:      "The number of membership transitions dropped because the analytics sink queue was full",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(droppedTotal)
+}
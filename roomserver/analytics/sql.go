@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// The table name comes from the config file, so make sure it is safe to
+// interpolate into the SQL statements.
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+const membershipTransitionsSchema = `
+CREATE TABLE IF NOT EXISTS %s (
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    from_membership TEXT NOT NULL,
+    to_membership TEXT NOT NULL,
+    actor_user_id TEXT NOT NULL,
+    ts BIGINT NOT NULL
+);
+`
+
+const insertMembershipTransitionSQL = "" +
+	"INSERT INTO %s (room_id, user_id, from_membership, to_membership, actor_user_id, ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+// SQLWriter is a Writer which inserts the transitions into a table in a
+// postgres or sqlite3 database.
+type SQLWriter struct {
+	db                             *sql.DB
+	insertMembershipTransitionStmt *sql.Stmt
+}
+
+// NewSQLWriter opens the database and creates the table if needed. Data
+// sources with a "file:" scheme are opened with sqlite3 and all others with
+// postgres, as for the other databases.
+func NewSQLWriter(
+	dataSourceName, table string, dbProperties common.DbProperties,
+) (*SQLWriter, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid membership analytics table name %q", table)
+	}
+	driverName, dsn := "postgres", dataSourceName
+	if uri, err := url.Parse(dataSourceName); err == nil && uri.Scheme == "file" {
+		driverName, dbProperties = common.SQLiteDriverName(), nil
+		if uri.Opaque != "" {
+			dsn = uri.Opaque
+		} else {
+			dsn = uri.Path
+		}
+	}
+	var w SQLWriter
+	var err error
+	if w.db, err = sqlutil.Open(driverName, dsn, dbProperties); err != nil {
+		return nil, err
+	}
+	if _, err = w.db.Exec(fmt.Sprintf(membershipTransitionsSchema, table)); err != nil {
+		return nil, err
+	}
+	if w.insertMembershipTransitionStmt, err = w.db.Prepare(
+		fmt.Sprintf(insertMembershipTransitionSQL, table),
+	); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// WriteMembershipTransition implements Writer
+func (w *SQLWriter) WriteMembershipTransition(
+	ctx context.Context, transition MembershipTransition,
+) error {
+	_, err := w.insertMembershipTransitionStmt.ExecContext(
+		ctx, transition.RoomID, transition.UserID, transition.From,
+		transition.To, transition.ActorUserID, transition.Timestamp,
+	)
+	return err
+}
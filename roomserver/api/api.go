@@ -4,14 +4,27 @@ import (
 	"context"
 
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// JoinedHostsChangedFunc is called with the servers which joined a room and
+// the servers which left it as the result of a change to its current state.
+// A server joins a room when the first of its users joins, and leaves it when
+// the last of its users leaves.
+type JoinedHostsChangedFunc func(roomID string, joined, left []gomatrixserverlib.ServerName)
+
 // RoomserverInputAPI is used to write events to the room server.
 type RoomserverInternalAPI interface {
 	// needed to avoid chicken and egg scenario when setting up the
 	// interdependencies between the roomserver and other input APIs
 	SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI)
 
+	// Set a function to be called whenever the set of servers joined to a
+	// room changes, once the change has been committed. This lets components
+	// running in the same process as the roomserver react to the change
+	// without waiting for the output log. It has no effect otherwise.
+	SetJoinedHostsChangedHook(hook JoinedHostsChangedFunc)
+
 	InputRoomEvents(
 		ctx context.Context,
 		request *InputRoomEventsRequest,
@@ -30,6 +43,62 @@ type RoomserverInternalAPI interface {
 		res *PerformLeaveResponse,
 	) error
 
+	// Make a local user leave every room they are joined to, and reject every
+	// invite they have, e.g. when their account is deactivated.
+	PerformLeaveAllRooms(
+		ctx context.Context,
+		req *PerformLeaveAllRoomsRequest,
+		res *PerformLeaveAllRoomsResponse,
+	) error
+
+	// Set whether a room is in announce-only mode, in which output events for
+	// joins, leaves and profile changes are suppressed. Intended for admins.
+	PerformSetRoomAnnounceOnly(
+		ctx context.Context,
+		req *PerformSetRoomAnnounceOnlyRequest,
+		res *PerformSetRoomAnnounceOnlyResponse,
+	) error
+
+	// Shut down a room: make all local users leave it, stop them from joining
+	// it again and optionally move them to a new room with a notice. Intended
+	// for admins dealing with abuse.
+	PerformShutdownRoom(
+		ctx context.Context,
+		req *PerformShutdownRoomRequest,
+		res *PerformShutdownRoomResponse,
+	) error
+
+	// Remove a room and everything we know about it from the roomserver, and
+	// tell the other components to do the same. Intended for admins.
+	PerformPurgeRoom(
+		ctx context.Context,
+		req *PerformPurgeRoomRequest,
+		res *PerformPurgeRoomResponse,
+	) error
+
+	// Upgrade a room: create a replacement room of the requested version
+	// with a copy of the old room's state, send a tombstone in the old room
+	// pointing to the new one and move the old room's local aliases to it.
+	PerformUpgradeRoom(
+		ctx context.Context,
+		req *PerformUpgradeRoomRequest,
+		res *PerformUpgradeRoomResponse,
+	) error
+
+	// Query whether a room is in announce-only mode.
+	QueryRoomAnnounceOnly(
+		ctx context.Context,
+		request *QueryRoomAnnounceOnlyRequest,
+		response *QueryRoomAnnounceOnlyResponse,
+	) error
+
+	// Query the mxc:// URIs of the media referenced by the events in a room.
+	QueryRoomMediaURIs(
+		ctx context.Context,
+		request *QueryRoomMediaURIsRequest,
+		response *QueryRoomMediaURIsResponse,
+	) error
+
 	// Query the latest events and state for a room from the room server.
 	QueryLatestEventsAndState(
 		ctx context.Context,
@@ -58,6 +127,14 @@ type RoomserverInternalAPI interface {
 		response *QueryMembershipForUserResponse,
 	) error
 
+	// Query the output events that would be emitted if a membership event
+	// were to be applied to a room, without actually applying it.
+	QueryMembershipChangePreview(
+		ctx context.Context,
+		request *QueryMembershipChangePreviewRequest,
+		response *QueryMembershipChangePreviewResponse,
+	) error
+
 	// Query a list of membership events for a room
 	QueryMembershipsForRoom(
 		ctx context.Context,
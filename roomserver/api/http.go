@@ -39,3 +39,8 @@ func NewRoomserverInternalAPIHTTP(
 func (h *httpRoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsInputAPI.FederationSenderInternalAPI) {
 	h.fsAPI = fsAPI
 }
+
+// SetJoinedHostsChangedHook implements RoomserverInternalAPI. The hook can't be
+// called over HTTP so it is ignored, and consumers need to rely on the output
+// log instead.
+func (h *httpRoomserverInternalAPI) SetJoinedHostsChangedHook(hook JoinedHostsChangedFunc) {}
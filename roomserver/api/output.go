@@ -15,6 +15,8 @@
 package api
 
 import (
+	"encoding/json"
+
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -28,6 +30,24 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRetireInviteBatchEvent indicates that the event is an OutputRetireInviteBatchEvent
+	OutputTypeRetireInviteBatchEvent OutputType = "retire_invite_batch_event"
+	// OutputTypeStateDelta indicates that the event is an OutputStateDelta
+	OutputTypeStateDelta OutputType = "state_delta"
+	// OutputTypeKnockAccepted indicates that the event is an OutputKnockAccepted
+	OutputTypeKnockAccepted OutputType = "knock_accepted"
+	// OutputTypeMembershipDailySummary indicates that the event is an OutputMembershipDailySummary
+	OutputTypeMembershipDailySummary OutputType = "membership_daily_summary"
+	// OutputTypeNewJoinEvent indicates that the event is an OutputNewJoinEvent
+	OutputTypeNewJoinEvent OutputType = "new_join_event"
+	// OutputTypeNewLeaveEvent indicates that the event is an OutputNewLeaveEvent
+	OutputTypeNewLeaveEvent OutputType = "new_leave_event"
+	// OutputTypeNewKnockEvent indicates that the event is an OutputNewKnockEvent
+	OutputTypeNewKnockEvent OutputType = "new_knock_event"
+	// OutputTypePurgeRoom indicates that the event is an OutputPurgeRoom
+	OutputTypePurgeRoom OutputType = "purge_room"
+	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
+	OutputTypeRedactedEvent OutputType = "redacted_event"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +61,24 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeRetireInviteBatchEvent
+	RetireInviteBatchEvent *OutputRetireInviteBatchEvent `json:"retire_invite_batch_event,omitempty"`
+	// The content of event with type OutputTypeStateDelta
+	StateDelta *OutputStateDelta `json:"state_delta,omitempty"`
+	// The content of event with type OutputTypeKnockAccepted
+	KnockAccepted *OutputKnockAccepted `json:"knock_accepted,omitempty"`
+	// The content of event with type OutputTypeMembershipDailySummary
+	MembershipDailySummary *OutputMembershipDailySummary `json:"membership_daily_summary,omitempty"`
+	// The content of event with type OutputTypeNewJoinEvent
+	NewJoinEvent *OutputNewJoinEvent `json:"new_join_event,omitempty"`
+	// The content of event with type OutputTypeNewLeaveEvent
+	NewLeaveEvent *OutputNewLeaveEvent `json:"new_leave_event,omitempty"`
+	// The content of event with type OutputTypeNewKnockEvent
+	NewKnockEvent *OutputNewKnockEvent `json:"new_knock_event,omitempty"`
+	// The content of event with type OutputTypePurgeRoom
+	PurgeRoom *OutputPurgeRoom `json:"purge_room,omitempty"`
+	// The content of event with type OutputTypeRedactedEvent
+	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -120,6 +158,36 @@ type OutputNewInviteEvent struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 	// The "m.room.member" invite event.
 	Event gomatrixserverlib.HeaderedEvent `json:"event"`
+	// The content of the membership event for the user that the invite
+	// replaced in the current state of the room, if any. Only populated if
+	// membership_prev_content is enabled in the room server config.
+	PrevContent json.RawMessage `json:"prev_content,omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:"cause,omitempty"`
+	// The client transaction ID of the request which sent the invite, if it
+	// was sent by a local client which specified one. Empty for invites
+	// received over federation.
+	ClientTxnID string `json:"client_txn_id,omitempty"`
+	// The "type" of the invited room from the content of its "m.room.create"
+	// event, e.g. "m.space" for a space. Empty for normal rooms, or if the
+	// type couldn't be worked out.
+	RoomType string `json:"room_type,omitempty"`
+	// Who is responsible for the invite. See EffectiveActorSystem.
+	EffectiveActor string `json:"effective_actor"`
+	// A key which is the same every time this invite is written, e.g. if it
+	// is written again after the roomserver restarts, so that consumers can
+	// use it to ignore duplicates.
+	IdempotencyKey string `json:"idempotency_key"`
+	// The version of the user's membership in the room after the invite. It
+	// increases with every change to their membership, so consumers can
+	// discard changes that arrive after a change with a higher version.
+	MembershipVersion int64 `json:"membership_version"`
+	// The version of the current state of the room after the invite. It
+	// changes whenever the current state changes, so consumers which cache
+	// the room state can resync when it doesn't match their copy. Only
+	// populated if membership_state_version is enabled in the room server
+	// config.
+	StateVersion int64 `json:"state_version,omitempty"`
 }
 
 // An OutputRetireInviteEvent is written whenever an existing invite is no longer
@@ -137,4 +205,279 @@ type OutputRetireInviteEvent struct {
 	// The "membership" of the user after retiring the invite. One of "join"
 	// "leave" or "ban".
 	Membership string
+	// The join rule of the room that was in effect at the event that retired
+	// the invite, if the membership is "join". This tells consumers whether
+	// the user joined a public room or accepted the invite. It is empty if the
+	// membership isn't "join" or if the join rule couldn't be worked out.
+	JoinRule string `json:",omitempty"`
+	// The content of the membership event for the user that was replaced in
+	// the current state of the room by the event that retired the invite.
+	// Only populated if membership_prev_content is enabled in the room server
+	// config.
+	PrevContent json.RawMessage `json:",omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:",omitempty"`
+	// The client transaction ID of the request which sent the event that
+	// retired the invite, e.g. a kick or ban, if it was sent by a local client
+	// which specified one. This lets the client recognise its own action.
+	// Empty for events received over federation.
+	ClientTxnID string `json:",omitempty"`
+	// Who is responsible for retiring the invite: the sender of the event
+	// that retired it, e.g. for a kick or ban, the target user themselves,
+	// e.g. for a join or a rejected invite, or EffectiveActorSystem.
+	EffectiveActor string
+	// A key which is the same every time this retired invite is written, e.g.
+	// if it is written again after the roomserver restarts, so that consumers
+	// can use it to ignore duplicates.
+	IdempotencyKey string
+	// The version of the target user's membership in the room after the
+	// change that retired the invite. See OutputNewInviteEvent.
+	MembershipVersion int64
+	// The version of the current state of the room after the change that
+	// retired the invite. See OutputNewInviteEvent.
+	StateVersion int64 `json:",omitempty"`
+}
+
+// EffectiveActorSystem is the effective actor of a membership change which
+// wasn't made by any user, e.g. one caused by state resolution. Otherwise the
+// effective actor is the user ID of the sender of the membership event, which
+// is the target user themselves for joins and self-leaves.
+const EffectiveActorSystem = "system"
+
+// MembershipChangeCause describes why the membership of a user in the current
+// state of a room changed.
+type MembershipChangeCause string
+
+const (
+	// MembershipChangeCauseEvent means that the membership changed because a
+	// new membership event was added to the room. It is sent as empty.
+	MembershipChangeCauseEvent MembershipChangeCause = ""
+	// MembershipChangeCauseStateResolution means that the membership changed
+	// because state resolution recomputed the current state of the room, e.g.
+	// when recovering from a state reset, rather than because of a new
+	// membership event. Consumers may want to avoid notifying users about
+	// these changes.
+	MembershipChangeCauseStateResolution MembershipChangeCause = "state_resolution"
+)
+
+// An OutputKnockAccepted is written whenever a user's knock on a room is
+// accepted, i.e. when their membership changes from "knock" to "invite" or
+// "join". Consumers can use it to clear any "knock pending" state they hold
+// for the user. It is written in addition to any invite events.
+type OutputKnockAccepted struct {
+	// The ID of the room that was knocked on.
+	RoomID string `json:"room_id"`
+	// The user whose knock was accepted.
+	TargetUserID string `json:"target_user_id"`
+	// The ID of the "m.room.member" knock event.
+	KnockEventID string `json:"knock_event_id"`
+	// The ID of the "m.room.member" event that accepted the knock.
+	AcceptedByEventID string `json:"accepted_by_event_id"`
+	// The "membership" of the user after the knock was accepted. One of
+	// "invite" or "join".
+	Membership string `json:"membership"`
+	// The content of the membership event for the user that the event which accepted the knock replaced in
+	// the current state of the room, if any. Only populated if
+	// membership_prev_content is enabled in the room server config.
+	PrevContent json.RawMessage `json:"prev_content,omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:"cause,omitempty"`
+	// Who accepted the knock. See EffectiveActorSystem.
+	EffectiveActor string `json:"effective_actor"`
+	// A key which is the same every time this event is written, e.g. if it is
+	// written again after the roomserver restarts, so that consumers can use
+	// it to ignore duplicates.
+	IdempotencyKey string `json:"idempotency_key"`
+	// The version of the current state of the room after the knock was
+	// accepted. See OutputNewInviteEvent.
+	StateVersion int64 `json:"state_version,omitempty"`
+}
+
+// An OutputNewKnockEvent is written whenever the membership of a user in the
+// current state of a room changes to "knock", i.e. when they ask to be
+// invited to the room. Consumers can use it to tell the users who are able to
+// invite them about the knock. There are no client or federation endpoints
+// for knocking yet, see the TODOs in the clientapi and federationapi routing.
+type OutputNewKnockEvent struct {
+	// The ID of the room that was knocked on.
+	RoomID string `json:"room_id"`
+	// The user who knocked.
+	TargetUserID string `json:"target_user_id"`
+	// The ID of the "m.room.member" knock event.
+	EventID string `json:"event_id"`
+	// The reason given for knocking, if any.
+	Reason string `json:"reason,omitempty"`
+	// The content of the membership event for the user that the knock replaced in
+	// the current state of the room, if any. Only populated if
+	// membership_prev_content is enabled in the room server config.
+	PrevContent json.RawMessage `json:"prev_content,omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:"cause,omitempty"`
+	// The client transaction ID of the request which sent the knock, if it
+	// was sent by a local client which specified one.
+	ClientTxnID string `json:"client_txn_id,omitempty"`
+	// Who is responsible for the knock. See EffectiveActorSystem.
+	EffectiveActor string `json:"effective_actor"`
+	// A key which is the same every time this event is written, e.g. if it is
+	// written again after the roomserver restarts, so that consumers can use
+	// it to ignore duplicates.
+	IdempotencyKey string `json:"idempotency_key"`
+	// The version of the user's membership in the room after the knock. See
+	// OutputNewInviteEvent.
+	MembershipVersion int64 `json:"membership_version"`
+	// The version of the current state of the room after the knock. See
+	// OutputNewInviteEvent.
+	StateVersion int64 `json:"state_version,omitempty"`
+}
+
+// An OutputNewJoinEvent is written whenever the membership of a user in the
+// current state of a room changes to "join", but not for profile changes by
+// users who are already joined. It tells the key server whether the existing
+// members of the room need to share their room keys with the user.
+type OutputNewJoinEvent struct {
+	// The ID of the room that was joined.
+	RoomID string `json:"room_id"`
+	// The user who joined the room.
+	TargetUserID string `json:"target_user_id"`
+	// The ID of the "m.room.member" join event.
+	EventID string `json:"event_id"`
+	// Whether the user has been joined to the room before. This is based on
+	// the membership audit log, so joins from before it existed aren't known.
+	Rejoin bool `json:"rejoin"`
+	// Whether the room was encrypted when the user joined it.
+	RoomEncrypted bool `json:"room_encrypted"`
+	// Whether the room keys should be distributed to the user, i.e. the room
+	// is encrypted and this is the first time the user has joined it.
+	ShareRoomKeys bool `json:"share_room_keys"`
+	// The number of users joined to the room after the join, counted from the
+	// membership table once all of the membership changes in the same update
+	// to the room state have been made.
+	JoinedMemberCount int64 `json:"joined_member_count"`
+	// The content of the membership event for the user that the join replaced in
+	// the current state of the room, if any. Only populated if
+	// membership_prev_content is enabled in the room server config.
+	PrevContent json.RawMessage `json:"prev_content,omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:"cause,omitempty"`
+	// A key which is the same every time this event is written, e.g. if it is
+	// written again after the roomserver restarts, so that consumers can use
+	// it to ignore duplicates.
+	IdempotencyKey string `json:"idempotency_key"`
+	// The version of the current state of the room after the join. See
+	// OutputNewInviteEvent.
+	StateVersion int64 `json:"state_version,omitempty"`
+}
+
+// An OutputNewLeaveEvent is written whenever the membership of a user in the
+// current state of a room changes from "join" to "leave" or "ban". Together
+// with OutputNewJoinEvent it lets consumers track the size of the room
+// without keeping their own copy of the room state.
+type OutputNewLeaveEvent struct {
+	// The ID of the room that was left.
+	RoomID string `json:"room_id"`
+	// The user who left the room.
+	TargetUserID string `json:"target_user_id"`
+	// The ID of the "m.room.member" event that made the user leave.
+	EventID string `json:"event_id"`
+	// The "membership" of the user after leaving. One of "leave" or "ban".
+	Membership string `json:"membership"`
+	// The number of users joined to the room after the leave, counted from
+	// the membership table once all of the membership changes in the same
+	// update to the room state have been made.
+	JoinedMemberCount int64 `json:"joined_member_count"`
+	// The content of the membership event for the user that the leave replaced in
+	// the current state of the room, if any. Only populated if
+	// membership_prev_content is enabled in the room server config.
+	PrevContent json.RawMessage `json:"prev_content,omitempty"`
+	// Why the membership changed. Empty if it changed because of a new event.
+	Cause MembershipChangeCause `json:"cause,omitempty"`
+	// A key which is the same every time this event is written, e.g. if it is
+	// written again after the roomserver restarts, so that consumers can use
+	// it to ignore duplicates.
+	IdempotencyKey string `json:"idempotency_key"`
+	// The version of the current state of the room after the leave. See
+	// OutputNewInviteEvent.
+	StateVersion int64 `json:"state_version,omitempty"`
+}
+
+// An OutputRetireInviteBatchEvent is written instead of individual
+// OutputRetireInviteEvents when a single change in the current state of a
+// room makes a large number of users leave at once, e.g. when the room is
+// shut down. Consumers should treat it exactly as if each of the retired
+// invites had been sent in its own OutputRetireInviteEvent.
+type OutputRetireInviteBatchEvent struct {
+	// The invites that were retired by the change in current state.
+	RetiredInvites []OutputRetireInviteEvent `json:"retired_invites"`
+}
+
+// An OutputStateDelta is written whenever the current state of a room changes,
+// if the roomserver is configured to do so. It bundles all of the membership
+// and non-membership state changes caused by processing a single event, so
+// that consumers can apply the whole delta atomically rather than having to
+// reassemble it from the other output events.
+type OutputStateDelta struct {
+	// The ID of the room whose current state changed.
+	RoomID string `json:"room_id"`
+	// The ID of the event which caused the current state to change.
+	EventID string `json:"event_id"`
+	// The changes to "m.room.member" events in the current state.
+	MembershipChanges []StateDeltaChange `json:"membership_changes"`
+	// The changes to all other state events in the current state.
+	StateChanges []StateDeltaChange `json:"state_changes"`
+}
+
+// A StateDeltaChange describes how the current state event for a single
+// (type, state_key) tuple changed.
+type StateDeltaChange struct {
+	// The event type of the state event.
+	Type string `json:"type"`
+	// The state key of the state event.
+	StateKey string `json:"state_key"`
+	// The ID of the state event removed from the current state, or empty if
+	// there was no state event for this tuple before.
+	RemovedEventID string `json:"removed_event_id,omitempty"`
+	// The ID of the state event added to the current state, or empty if
+	// there is no longer a state event for this tuple.
+	AddedEventID string `json:"added_event_id,omitempty"`
+}
+
+// An OutputMembershipDailySummary is written once a day for each room in which
+// any memberships changed that day, if the roomserver is configured to do so.
+// It is built from the membership audit log and lets digest consumers report
+// e.g. "5 people joined, 2 left" without aggregating the membership changes
+// themselves. Days are in UTC.
+type OutputMembershipDailySummary struct {
+	// The ID of the room.
+	RoomID string `json:"room_id"`
+	// The day that is summarised, as YYYY-MM-DD.
+	Date string `json:"date"`
+	// The number of users who joined the room.
+	Joins int `json:"joins"`
+	// The number of users who left the room, or were kicked from it, having
+	// been joined. Rejected and retracted invites aren't counted.
+	Leaves int `json:"leaves"`
+	// The number of users who were invited to the room.
+	Invites int `json:"invites"`
+	// The number of users who were banned from the room.
+	Bans int `json:"bans"`
+}
+
+// An OutputPurgeRoom is written when an admin purges a room from the
+// roomserver. Consumers should delete everything they have stored for the
+// room, since the roomserver no longer knows anything about it.
+type OutputPurgeRoom struct {
+	// The ID of the room that was purged.
+	RoomID string `json:"room_id"`
+}
+
+// An OutputRedactedEvent is written after the OutputNewRoomEvent for an
+// m.room.redaction event, once the roomserver has checked that the redaction
+// is allowed by the rules of the room version. Consumers should replace their
+// stored copy of the redacted event with its redacted form.
+type OutputRedactedEvent struct {
+	// The ID of the event that was redacted.
+	RedactedEventID string `json:"redacted_event_id"`
+	// The m.room.redaction event, which should be included in the unsigned
+	// "redacted_because" field of the redacted event.
+	RedactedBecause gomatrixserverlib.HeaderedEvent `json:"redacted_because"`
 }
@@ -14,6 +14,21 @@ const (
 
 	// RoomserverPerformLeavePath is the HTTP path for the PerformLeave API.
 	RoomserverPerformLeavePath = "/api/roomserver/performLeave"
+
+	// RoomserverPerformLeaveAllRoomsPath is the HTTP path for the PerformLeaveAllRooms API.
+	RoomserverPerformLeaveAllRoomsPath = "/api/roomserver/performLeaveAllRooms"
+
+	// RoomserverPerformSetRoomAnnounceOnlyPath is the HTTP path for the PerformSetRoomAnnounceOnly API.
+	RoomserverPerformSetRoomAnnounceOnlyPath = "/api/roomserver/performSetRoomAnnounceOnly"
+
+	// RoomserverPerformShutdownRoomPath is the HTTP path for the PerformShutdownRoom API.
+	RoomserverPerformShutdownRoomPath = "/api/roomserver/performShutdownRoom"
+
+	// RoomserverPerformPurgeRoomPath is the HTTP path for the PerformPurgeRoom API.
+	RoomserverPerformPurgeRoomPath = "/api/roomserver/performPurgeRoom"
+
+	// RoomserverPerformUpgradeRoomPath is the HTTP path for the PerformUpgradeRoom API.
+	RoomserverPerformUpgradeRoomPath = "/api/roomserver/performUpgradeRoom"
 )
 
 type PerformJoinRequest struct {
@@ -57,3 +72,150 @@ func (h *httpRoomserverInternalAPI) PerformLeave(
 	apiURL := h.roomserverURL + RoomserverPerformLeavePath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// PerformLeaveAllRoomsRequest is a request to PerformLeaveAllRooms
+type PerformLeaveAllRoomsRequest struct {
+	// The ID of the local user who should leave all of their rooms.
+	UserID string `json:"user_id"`
+}
+
+// PerformLeaveAllRoomsResponse is a response to PerformLeaveAllRooms
+type PerformLeaveAllRoomsResponse struct {
+	// The IDs of the rooms the user left or rejected the invite to.
+	LeftRoomIDs []string `json:"left_room_ids"`
+	// The IDs of the rooms the user couldn't leave. The request can be made
+	// again to retry them.
+	FailedRoomIDs []string `json:"failed_room_ids"`
+	// The IDs of the rooms in which the user was the only user able to change
+	// the power levels, so that nobody can now that the user has left.
+	PowerVacuumRoomIDs []string `json:"power_vacuum_room_ids"`
+}
+
+// PerformLeaveAllRooms implements RoomserverInternalAPI
+func (h *httpRoomserverInternalAPI) PerformLeaveAllRooms(
+	ctx context.Context,
+	request *PerformLeaveAllRoomsRequest,
+	response *PerformLeaveAllRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLeaveAllRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformLeaveAllRoomsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformSetRoomAnnounceOnlyRequest is a request to PerformSetRoomAnnounceOnly
+type PerformSetRoomAnnounceOnlyRequest struct {
+	// The ID of the room to change.
+	RoomID string `json:"room_id"`
+	// Whether the room should be in announce-only mode.
+	AnnounceOnly bool `json:"announce_only"`
+}
+
+// PerformSetRoomAnnounceOnlyResponse is a response to PerformSetRoomAnnounceOnly
+type PerformSetRoomAnnounceOnlyResponse struct {
+}
+
+// PerformSetRoomAnnounceOnly implements RoomserverInternalAPI
+func (h *httpRoomserverInternalAPI) PerformSetRoomAnnounceOnly(
+	ctx context.Context,
+	request *PerformSetRoomAnnounceOnlyRequest,
+	response *PerformSetRoomAnnounceOnlyResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformSetRoomAnnounceOnly")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformSetRoomAnnounceOnlyPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformShutdownRoomRequest is a request to PerformShutdownRoom
+type PerformShutdownRoomRequest struct {
+	// The ID of the room to shut down.
+	RoomID string `json:"room_id"`
+	// The local user who creates the replacement room. If empty then no
+	// replacement room is created.
+	NewRoomUserID string `json:"new_room_user_id"`
+	// The name of the replacement room.
+	NewRoomName string `json:"new_room_name"`
+	// The notice to send in the replacement room.
+	Message string `json:"message"`
+}
+
+// PerformShutdownRoomResponse is a response to PerformShutdownRoom
+type PerformShutdownRoomResponse struct {
+	// The local users who were made to leave the room.
+	KickedUserIDs []string `json:"kicked_user_ids"`
+	// The local users who couldn't be made to leave the room.
+	FailedUserIDs []string `json:"failed_user_ids"`
+	// The ID of the replacement room, if one was created.
+	NewRoomID string `json:"new_room_id,omitempty"`
+}
+
+// PerformShutdownRoom implements RoomserverInternalAPI
+func (h *httpRoomserverInternalAPI) PerformShutdownRoom(
+	ctx context.Context,
+	request *PerformShutdownRoomRequest,
+	response *PerformShutdownRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformShutdownRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformShutdownRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformPurgeRoomRequest is a request to PerformPurgeRoom
+type PerformPurgeRoomRequest struct {
+	// The ID of the room to purge.
+	RoomID string `json:"room_id"`
+}
+
+// PerformPurgeRoomResponse is a response to PerformPurgeRoom
+type PerformPurgeRoomResponse struct {
+}
+
+// PerformPurgeRoom implements RoomserverInternalAPI
+func (h *httpRoomserverInternalAPI) PerformPurgeRoom(
+	ctx context.Context,
+	request *PerformPurgeRoomRequest,
+	response *PerformPurgeRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPurgeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformPurgeRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformUpgradeRoomRequest is a request to PerformUpgradeRoom
+type PerformUpgradeRoomRequest struct {
+	// The ID of the room to upgrade.
+	RoomID string `json:"room_id"`
+	// The local user who is upgrading the room.
+	UserID string `json:"user_id"`
+	// The version of the replacement room.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+// PerformUpgradeRoomResponse is a response to PerformUpgradeRoom
+type PerformUpgradeRoomResponse struct {
+	// The ID of the replacement room.
+	NewRoomID string `json:"new_room_id"`
+	// Is the user not allowed to upgrade the room? If so then nothing was
+	// changed.
+	NotAllowed bool `json:"not_allowed"`
+}
+
+// PerformUpgradeRoom implements RoomserverInternalAPI
+func (h *httpRoomserverInternalAPI) PerformUpgradeRoom(
+	ctx context.Context,
+	request *PerformUpgradeRoomRequest,
+	response *PerformUpgradeRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUpgradeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUpgradeRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
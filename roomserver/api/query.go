@@ -124,6 +124,50 @@ type QueryMembershipForUserResponse struct {
 	IsInRoom bool `json:"is_in_room"`
 }
 
+// QueryRoomAnnounceOnlyRequest is a request to QueryRoomAnnounceOnly
+type QueryRoomAnnounceOnlyRequest struct {
+	// The ID of the room to query.
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomAnnounceOnlyResponse is a response to QueryRoomAnnounceOnly
+type QueryRoomAnnounceOnlyResponse struct {
+	// Does the room exist?
+	RoomExists bool `json:"room_exists"`
+	// Is the room in announce-only mode?
+	AnnounceOnly bool `json:"announce_only"`
+}
+
+// QueryRoomMediaURIsRequest is a request to QueryRoomMediaURIs
+type QueryRoomMediaURIsRequest struct {
+	// The ID of the room to query.
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomMediaURIsResponse is a response to QueryRoomMediaURIs
+type QueryRoomMediaURIsResponse struct {
+	// Does the room exist?
+	RoomExists bool `json:"room_exists"`
+	// The distinct mxc:// URIs found anywhere in the events of the room.
+	MediaURIs []string `json:"media_uris"`
+}
+
+// QueryMembershipChangePreviewRequest is a request to QueryMembershipChangePreview
+type QueryMembershipChangePreviewRequest struct {
+	// ID of the room the membership change is for
+	RoomID string `json:"room_id"`
+	// The "m.room.member" event that would change the membership, e.g. a
+	// kick or a ban. The event is not stored or sent anywhere.
+	Event gomatrixserverlib.HeaderedEvent `json:"event"`
+}
+
+// QueryMembershipChangePreviewResponse is a response to QueryMembershipChangePreview
+type QueryMembershipChangePreviewResponse struct {
+	// The invite output events that would be written to the output log if the
+	// event were to become part of the current state of the room.
+	Updates []OutputEvent `json:"updates"`
+}
+
 // QueryMembershipsForRoomRequest is a request to QueryMembershipsForRoom
 type QueryMembershipsForRoomRequest struct {
 	// If true, only returns the membership events of "join" membership
@@ -273,6 +317,15 @@ const RoomserverQueryEventsByIDPath = "/api/roomserver/queryEventsByID"
 // RoomserverQueryMembershipForUserPath is the HTTP path for the QueryMembershipForUser API.
 const RoomserverQueryMembershipForUserPath = "/api/roomserver/queryMembershipForUser"
 
+// RoomserverQueryRoomAnnounceOnlyPath is the HTTP path for the QueryRoomAnnounceOnly API.
+const RoomserverQueryRoomAnnounceOnlyPath = "/api/roomserver/queryRoomAnnounceOnly"
+
+// RoomserverQueryRoomMediaURIsPath is the HTTP path for the QueryRoomMediaURIs API.
+const RoomserverQueryRoomMediaURIsPath = "/api/roomserver/queryRoomMediaURIs"
+
+// RoomserverQueryMembershipChangePreviewPath is the HTTP path for the QueryMembershipChangePreview API.
+const RoomserverQueryMembershipChangePreviewPath = "/api/roomserver/queryMembershipChangePreview"
+
 // RoomserverQueryMembershipsForRoomPath is the HTTP path for the QueryMembershipsForRoom API
 const RoomserverQueryMembershipsForRoomPath = "/api/roomserver/queryMembershipsForRoom"
 
@@ -349,6 +402,45 @@ func (h *httpRoomserverInternalAPI) QueryMembershipForUser(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryRoomAnnounceOnly implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryRoomAnnounceOnly(
+	ctx context.Context,
+	request *QueryRoomAnnounceOnlyRequest,
+	response *QueryRoomAnnounceOnlyResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomAnnounceOnly")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomAnnounceOnlyPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryRoomMediaURIs implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryRoomMediaURIs(
+	ctx context.Context,
+	request *QueryRoomMediaURIsRequest,
+	response *QueryRoomMediaURIsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomMediaURIs")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomMediaURIsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryMembershipChangePreview implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryMembershipChangePreview(
+	ctx context.Context,
+	request *QueryMembershipChangePreviewRequest,
+	response *QueryMembershipChangePreviewResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryMembershipChangePreview")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryMembershipChangePreviewPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipsForRoom implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMembershipsForRoom(
 	ctx context.Context,
@@ -20,8 +20,10 @@ import (
 	"errors"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // RoomserverInternalAPIDatabase has the storage APIs needed to implement the alias API.
@@ -169,7 +171,17 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(
 	// At this point we've already committed the alias to the database so we
 	// shouldn't cancel this request.
 	// TODO: Ensure that we send unsent events when if server restarts.
-	return r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID)
+	if err = r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID); err != nil {
+		return err
+	}
+
+	// The alias no longer points to the room, so the room shouldn't
+	// advertise it either. The user might not be allowed to change the
+	// canonical alias, in which case it is left as it is.
+	if err = r.removeCanonicalAliases(context.TODO(), request.UserID, roomID, []string{request.Alias}); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to remove alias from canonical alias")
+	}
+	return nil
 }
 
 type roomAliasesContent struct {
@@ -269,3 +281,89 @@ func (r *RoomserverInternalAPI) sendUpdatedAliasesEvent(
 	// Send the request
 	return r.InputRoomEvents(ctx, &inputReq, &inputRes)
 }
+
+// removeCanonicalAliases sends a new m.room.canonical_alias event without the
+// given aliases, if the room's current one has any of them in its alias or
+// alt_aliases. Any other content of the event is kept.
+func (r *RoomserverInternalAPI) removeCanonicalAliases(
+	ctx context.Context, userID, roomID string, aliases []string,
+) error {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.canonical_alias", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := r.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return err
+	}
+	if len(stateRes.StateEvents) == 0 {
+		return nil
+	}
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(stateRes.StateEvents[0].Content(), &content); err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool, len(aliases))
+	for _, alias := range aliases {
+		removed[alias] = true
+	}
+	changed := false
+	if alias, ok := content["alias"].(string); ok && removed[alias] {
+		delete(content, "alias")
+		changed = true
+	}
+	if altAliases, ok := content["alt_aliases"].([]interface{}); ok {
+		kept := []interface{}{}
+		for _, altAlias := range altAliases {
+			if alias, ok := altAlias.(string); ok && removed[alias] {
+				changed = true
+				continue
+			}
+			kept = append(kept, altAlias)
+		}
+		content["alt_aliases"] = kept
+	}
+	if !changed {
+		return nil
+	}
+
+	emptyStateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.canonical_alias",
+		StateKey: &emptyStateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return err
+	}
+	var buildRes api.QueryLatestEventsAndStateResponse
+	event, err := common.BuildEvent(ctx, &builder, r.Cfg, time.Now(), r, &buildRes)
+	if err != nil {
+		return err
+	}
+	stateEvents := make([]*gomatrixserverlib.Event, len(buildRes.StateEvents))
+	for i := range buildRes.StateEvents {
+		stateEvents[i] = &buildRes.StateEvents[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*event, &provider); err != nil {
+		return err
+	}
+
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event.Headered(buildRes.RoomVersion),
+				AuthEventIDs: event.AuthEventIDs(),
+				SendAsServer: string(r.Cfg.Matrix.ServerName),
+			},
+		},
+	}
+	var inputRes api.InputRoomEventsResponse
+	return r.InputRoomEvents(ctx, &inputReq, &inputRes)
+}
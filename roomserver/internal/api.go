@@ -10,6 +10,7 @@ import (
 	"github.com/matrix-org/dendrite/common/caching"
 	"github.com/matrix-org/dendrite/common/config"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -25,9 +26,11 @@ type RoomserverInternalAPI struct {
 	ServerName           gomatrixserverlib.ServerName
 	KeyRing              gomatrixserverlib.JSONVerifier
 	FedClient            *gomatrixserverlib.FederationClient
-	OutputRoomEventTopic string     // Kafka topic for new output room events
-	mutex                sync.Mutex // Protects calls to processRoomEvent
+	OutputRoomEventTopic string          // Kafka topic for new output room events
+	MembershipAnalytics  *analytics.Sink // Optional sink for membership transitions
+	mutex                sync.Mutex      // Protects calls to processRoomEvent
 	fsAPI                fsAPI.FederationSenderInternalAPI
+	joinedHostsChanged   api.JoinedHostsChangedFunc
 }
 
 // SetupHTTP adds the RoomserverInternalAPI handlers to the http.ServeMux.
@@ -72,6 +75,99 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.RoomserverPerformLeaveAllRoomsPath,
+		common.MakeInternalAPI("performLeaveAllRooms", func(req *http.Request) util.JSONResponse {
+			var request api.PerformLeaveAllRoomsRequest
+			var response api.PerformLeaveAllRoomsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformLeaveAllRooms(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformSetRoomAnnounceOnlyPath,
+		common.MakeInternalAPI("performSetRoomAnnounceOnly", func(req *http.Request) util.JSONResponse {
+			var request api.PerformSetRoomAnnounceOnlyRequest
+			var response api.PerformSetRoomAnnounceOnlyResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformSetRoomAnnounceOnly(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformShutdownRoomPath,
+		common.MakeInternalAPI("performShutdownRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformShutdownRoomRequest
+			var response api.PerformShutdownRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformShutdownRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformPurgeRoomPath,
+		common.MakeInternalAPI("performPurgeRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformPurgeRoomRequest
+			var response api.PerformPurgeRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformPurgeRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformUpgradeRoomPath,
+		common.MakeInternalAPI("performUpgradeRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformUpgradeRoomRequest
+			var response api.PerformUpgradeRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformUpgradeRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRoomAnnounceOnlyPath,
+		common.MakeInternalAPI("QueryRoomAnnounceOnly", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomAnnounceOnlyRequest
+			var response api.QueryRoomAnnounceOnlyResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomAnnounceOnly(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRoomMediaURIsPath,
+		common.MakeInternalAPI("QueryRoomMediaURIs", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomMediaURIsRequest
+			var response api.QueryRoomMediaURIsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomMediaURIs(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryLatestEventsAndStatePath,
 		common.MakeInternalAPI("queryLatestEventsAndState", func(req *http.Request) util.JSONResponse {
@@ -128,6 +224,20 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryMembershipChangePreviewPath,
+		common.MakeInternalAPI("QueryMembershipChangePreview", func(req *http.Request) util.JSONResponse {
+			var request api.QueryMembershipChangePreviewRequest
+			var response api.QueryMembershipChangePreviewResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryMembershipChangePreview(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryMembershipsForRoomPath,
 		common.MakeInternalAPI("queryMembershipsForRoom", func(req *http.Request) util.JSONResponse {
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 
 	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/api"
 
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
@@ -32,6 +33,21 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.fsAPI = fsAPI
 }
 
+// SetJoinedHostsChangedHook implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) SetJoinedHostsChangedHook(hook api.JoinedHostsChangedFunc) {
+	r.joinedHostsChanged = hook
+}
+
+// JoinedHostsChangedHook implements OutputRoomEventWriter
+func (r *RoomserverInternalAPI) JoinedHostsChangedHook() api.JoinedHostsChangedFunc {
+	return r.joinedHostsChanged
+}
+
+// MembershipAnalyticsSink implements OutputRoomEventWriter
+func (r *RoomserverInternalAPI) MembershipAnalyticsSink() *analytics.Sink {
+	return r.MembershipAnalytics
+}
+
 // WriteOutputEvents implements OutputRoomEventWriter
 func (r *RoomserverInternalAPI) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
 	messages := make([]*sarama.ProducerMessage, len(updates))
@@ -71,7 +87,7 @@ func (r *RoomserverInternalAPI) InputRoomEvents(
 		}
 	}
 	for i := range request.InputRoomEvents {
-		if response.EventID, err = processRoomEvent(ctx, r.DB, r, request.InputRoomEvents[i]); err != nil {
+		if response.EventID, err = processRoomEvent(ctx, r.Cfg, r.DB, r, request.InputRoomEvents[i]); err != nil {
 			return err
 		}
 	}
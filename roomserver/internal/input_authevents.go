@@ -18,23 +18,26 @@ import (
 	"context"
 	"sort"
 
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // checkAuthEvents checks that the event passes authentication checks
-// Returns the numeric IDs for the auth events.
+// Returns the numeric IDs for the auth events, and the auth events themselves
+// so that they can be reused when checking the event against the current
+// state of the room.
 func checkAuthEvents(
 	ctx context.Context,
 	db storage.Database,
 	event gomatrixserverlib.HeaderedEvent,
 	authEventIDs []string,
-) ([]types.EventNID, error) {
+) ([]types.EventNID, *authEvents, error) {
 	// Grab the numeric IDs for the supplied auth state events from the database.
 	authStateEntries, err := db.StateEntriesForEventIDs(ctx, authEventIDs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// TODO: check for duplicate state keys here.
 
@@ -44,12 +47,12 @@ func checkAuthEvents(
 	// Load the actual auth events from the database.
 	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, authStateEntries)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Check if the event is allowed.
 	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Return the numeric IDs for the auth events.
@@ -57,7 +60,75 @@ func checkAuthEvents(
 	for i := range authStateEntries {
 		result[i] = authStateEntries[i].EventNID
 	}
-	return result, nil
+	return result, &authEvents, nil
+}
+
+// isSoftFailed returns true if the event fails the auth checks against the
+// current state of the room, even though it passed them against its own auth
+// events, which were loaded by checkAuthEvents. Events in rooms without a
+// current state yet are never soft-failed.
+func isSoftFailed(
+	ctx context.Context,
+	db storage.Database,
+	roomNID types.RoomNID,
+	event gomatrixserverlib.Event,
+	eventAuthEvents *authEvents,
+) (bool, error) {
+	_, currentStateNID, _, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return false, err
+	}
+	if currentStateNID == 0 {
+		return false, nil
+	}
+
+	// Load the parts of the current state that are needed for auth.
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event})
+	currentState, err := state.NewStateResolution(db).LoadStateAtSnapshotForStringTuples(
+		ctx, currentStateNID, stateNeeded.Tuples(),
+	)
+	if err != nil {
+		return false, err
+	}
+	authEvents, err := loadCurrentAuthEvents(ctx, db, eventAuthEvents, currentState)
+	if err != nil {
+		return false, err
+	}
+
+	return gomatrixserverlib.Allowed(event, &authEvents) != nil, nil
+}
+
+// loadCurrentAuthEvents loads the events needed for authentication from the
+// current state of the room, given those already loaded from the event's own
+// auth events. The same state keys are needed for both, and usually most of
+// the events are the same too, so only the events which differ are loaded.
+func loadCurrentAuthEvents(
+	ctx context.Context,
+	db storage.Database,
+	eventAuthEvents *authEvents,
+	currentState []types.StateEntry,
+) (result authEvents, err error) {
+	result.stateKeyNIDMap = eventAuthEvents.stateKeyNIDMap
+	result.state = currentState
+	var missing []types.EventNID
+	for _, entry := range currentState {
+		if event, ok := eventAuthEvents.events.lookup(entry.EventNID); ok {
+			result.events = append(result.events, *event)
+		} else {
+			missing = append(missing, entry.EventNID)
+		}
+	}
+	if len(missing) > 0 {
+		var events []types.Event
+		if events, err = db.Events(ctx, missing); err != nil {
+			return
+		}
+		result.events = append(result.events, events...)
+		sort.Slice(result.events, func(i, j int) bool {
+			return result.events[i].EventNID < result.events[j].EventNID
+		})
+	}
+	return
 }
 
 type authEvents struct {
@@ -22,6 +22,8 @@ import (
 	"fmt"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
@@ -35,6 +37,12 @@ import (
 type OutputRoomEventWriter interface {
 	// Write a list of events for a room
 	WriteOutputEvents(roomID string, updates []api.OutputEvent) error
+	// The function to call once the servers joined to a room have changed,
+	// or nil if there is nothing to call
+	JoinedHostsChangedHook() api.JoinedHostsChangedFunc
+	// The sink to send membership transitions to for analytics, or nil if
+	// there is none
+	MembershipAnalyticsSink() *analytics.Sink
 }
 
 // processRoomEvent can only be called once at a time
@@ -44,6 +52,7 @@ type OutputRoomEventWriter interface {
 // state deltas when sending to kafka streams
 func processRoomEvent(
 	ctx context.Context,
+	cfg *config.Dendrite,
 	db storage.Database,
 	ow OutputRoomEventWriter,
 	input api.InputRoomEvent,
@@ -53,7 +62,7 @@ func processRoomEvent(
 	event := headered.Unwrap()
 
 	// Check that the event passes authentication checks and work out the numeric IDs for the auth events.
-	authEventNIDs, err := checkAuthEvents(ctx, db, headered, input.AuthEventIDs)
+	authEventNIDs, authEvents, err := checkAuthEvents(ctx, db, headered, input.AuthEventIDs)
 	if err != nil {
 		logrus.WithError(err).WithField("event_id", event.EventID()).WithField("auth_event_ids", input.AuthEventIDs).Error("processRoomEvent.checkAuthEvents failed for event")
 		return
@@ -93,10 +102,56 @@ func processRoomEvent(
 		}
 	}
 
+	// Check new events against the current state of the room, as well as
+	// their auth events. If they fail then they are still stored, but marked
+	// as rejected, and don't change the latest events or the current state of
+	// the room or get sent anywhere. Backfilled events are older than the
+	// current state so it doesn't make sense to check them.
+	if input.Kind == api.KindNew {
+		var softFailed bool
+		softFailed, err = markIfSoftFailed(ctx, db, roomNID, stateAtEvent.EventNID, event, authEvents)
+		if err != nil {
+			return
+		}
+		if softFailed {
+			return event.EventID(), nil
+		}
+	}
+
 	// Update the extremities of the event graph for the room
-	return event.EventID(), updateLatestEvents(
-		ctx, db, ow, roomNID, stateAtEvent, event, input.SendAsServer, input.TransactionID,
-	)
+	if err = updateLatestEvents(
+		ctx, cfg, db, ow, roomNID, stateAtEvent, event, input.SendAsServer, input.TransactionID,
+	); err != nil {
+		return
+	}
+
+	// Now that the redaction has been sent downstream, tell the other
+	// components to redact the event it points at.
+	if input.Kind == api.KindNew && event.Type() == gomatrixserverlib.MRoomRedaction {
+		if err = processRedaction(ctx, db, ow, headered, stateAtEvent.EventNID, authEventNIDs); err != nil {
+			return
+		}
+	}
+
+	return event.EventID(), nil
+}
+
+// markIfSoftFailed marks the event as rejected, and returns true, if it fails
+// the auth checks against the current state of the room.
+func markIfSoftFailed(
+	ctx context.Context,
+	db storage.Database,
+	roomNID types.RoomNID,
+	eventNID types.EventNID,
+	event gomatrixserverlib.Event,
+	eventAuthEvents *authEvents,
+) (bool, error) {
+	softFailed, err := isSoftFailed(ctx, db, roomNID, event, eventAuthEvents)
+	if err != nil || !softFailed {
+		return false, err
+	}
+	logrus.WithField("event_id", event.EventID()).WithField("room", event.RoomID()).Warn("Event failed auth against the current room state")
+	return true, db.MarkEventRejected(ctx, eventNID)
 }
 
 func calculateAndSetState(
@@ -224,7 +279,10 @@ func processInviteEvent(
 		}
 	}
 
-	outputUpdates, err := updateToInviteMembership(updater, &event, nil, input.Event.RoomVersion)
+	outputUpdates, err := updateToInviteMembership(
+		updater, &event, nil, input.Event.RoomVersion,
+		roomTypeAtInvite(ctx, db, &event), clientTransactionID(input.TransactionID),
+	)
 	if err != nil {
 		return nil, err
 	}
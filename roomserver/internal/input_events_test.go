@@ -0,0 +1,552 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+// mustCreateDatabase creates an empty roomserver database. The returned
+// function removes it again.
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.Open(dataSource, nil)
+	if err != nil {
+		closeDB()
+		t.Fatalf("storage.Open returned %s", err)
+	}
+	return db, closeDB
+}
+
+// fakeOutputWriter records the output events which are written, rather than
+// sending them anywhere.
+type fakeOutputWriter struct {
+	updates []api.OutputEvent
+	sink    *analytics.Sink
+}
+
+func (w *fakeOutputWriter) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
+	w.updates = append(w.updates, updates...)
+	return nil
+}
+
+func (w *fakeOutputWriter) JoinedHostsChangedHook() api.JoinedHostsChangedFunc { return nil }
+
+func (w *fakeOutputWriter) MembershipAnalyticsSink() *analytics.Sink { return w.sink }
+
+// fakeAnalyticsWriter passes the membership transitions written to it to a
+// channel.
+type fakeAnalyticsWriter struct {
+	transitions chan analytics.MembershipTransition
+}
+
+func (w *fakeAnalyticsWriter) WriteMembershipTransition(
+	ctx context.Context, transition analytics.MembershipTransition,
+) error {
+	w.transitions <- transition
+	return nil
+}
+
+// testRoom builds the events of a room and inputs them into the roomserver.
+// The events sent with send are tracked so that later events can follow them.
+type testRoom struct {
+	t      *testing.T
+	db     storage.Database
+	ow     *fakeOutputWriter
+	cfg    *config.Dendrite
+	roomID string
+	depth  int64
+	state  map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event
+	latest []gomatrixserverlib.Event
+}
+
+func newTestRoom(t *testing.T, db storage.Database) *testRoom {
+	return &testRoom{
+		t:      t,
+		db:     db,
+		ow:     &fakeOutputWriter{},
+		cfg:    &config.Dendrite{},
+		roomID: fmt.Sprintf("!hallownest:%s", testOrigin),
+		state:  map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event{},
+	}
+}
+
+// create sends the create event of the room and the join of its creator.
+func (r *testRoom) create(creator string) {
+	emptyStateKey := ""
+	r.send(creator, gomatrixserverlib.MRoomCreate, &emptyStateKey,
+		fmt.Sprintf(`{"creator":%q,"room_version":%q}`, creator, testRoomVersion))
+	r.send(creator, gomatrixserverlib.MRoomMember, &creator, `{"membership":"join"}`)
+}
+
+// send builds an event which follows the latest event sent, authed by the
+// current state of the room, and inputs it, returning the event and the
+// output events which were written for it.
+func (r *testRoom) send(
+	sender, eventType string, stateKey *string, content string,
+) (gomatrixserverlib.Event, []api.OutputEvent) {
+	return r.sendWithTransactionID(nil, sender, eventType, stateKey, content)
+}
+
+// sendWithTransactionID is like send, but inputs the event as though it was
+// sent by a local client request with the given transaction ID.
+func (r *testRoom) sendWithTransactionID(
+	transactionID *api.TransactionID,
+	sender, eventType string, stateKey *string, content string,
+) (gomatrixserverlib.Event, []api.OutputEvent) {
+	needed, err := gomatrixserverlib.StateNeededForEventBuilder(&gomatrixserverlib.EventBuilder{
+		Sender: sender, Type: eventType, StateKey: stateKey, Content: []byte(content),
+	})
+	if err != nil {
+		r.t.Fatalf("StateNeededForEventBuilder returned %s", err)
+	}
+	var authEvents []gomatrixserverlib.Event
+	for _, tuple := range needed.Tuples() {
+		if event, ok := r.state[tuple]; ok {
+			authEvents = append(authEvents, event)
+		}
+	}
+	event := r.event(sender, eventType, stateKey, content, r.latest, authEvents)
+	updates := r.inputWithTransactionID(transactionID, event, authEvents)
+	r.latest = []gomatrixserverlib.Event{event}
+	if stateKey != nil {
+		r.state[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: *stateKey}] = event
+	}
+	return event, updates
+}
+
+// event builds an event which follows the prev events and is authed by the
+// auth events.
+func (r *testRoom) event(
+	sender, eventType string, stateKey *string, content string,
+	prevEvents, authEvents []gomatrixserverlib.Event,
+) gomatrixserverlib.Event {
+	r.depth++
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:     r.roomID,
+		Sender:     sender,
+		Type:       eventType,
+		StateKey:   stateKey,
+		Content:    []byte(content),
+		Depth:      r.depth,
+		PrevEvents: eventIDs(prevEvents),
+		AuthEvents: eventIDs(authEvents),
+	}
+	e, err := b.Build(time.Now(), testOrigin, "ed25519:input_test", testPrivateKey, testRoomVersion)
+	if err != nil {
+		r.t.Fatalf("failed to build event: %s", err)
+	}
+	return e
+}
+
+// input inputs a new event into the roomserver, returning the output events
+// which were written for it.
+func (r *testRoom) input(event gomatrixserverlib.Event, authEvents []gomatrixserverlib.Event) []api.OutputEvent {
+	return r.inputWithTransactionID(nil, event, authEvents)
+}
+
+func (r *testRoom) inputWithTransactionID(
+	transactionID *api.TransactionID,
+	event gomatrixserverlib.Event, authEvents []gomatrixserverlib.Event,
+) []api.OutputEvent {
+	written := len(r.ow.updates)
+	_, err := processRoomEvent(context.Background(), r.cfg, r.db, r.ow, api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         event.Headered(testRoomVersion),
+		AuthEventIDs:  eventIDs(authEvents),
+		TransactionID: transactionID,
+	})
+	if err != nil {
+		r.t.Fatalf("processRoomEvent for %s returned %s", event.Type(), err)
+	}
+	return r.ow.updates[written:]
+}
+
+// mustFindOutputEvent returns the only output event of the given type.
+func mustFindOutputEvent(t *testing.T, updates []api.OutputEvent, outputType api.OutputType) api.OutputEvent {
+	var found []api.OutputEvent
+	for _, update := range updates {
+		if update.Type == outputType {
+			found = append(found, update)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected one %s output event, got %v", outputType, outputEventTypes(updates))
+	}
+	return found[0]
+}
+
+func eventIDs(events []gomatrixserverlib.Event) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.EventID())
+	}
+	return ids
+}
+
+func TestSoftFailedEventDoesNotChangeCurrentState(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	emptyStateKey := ""
+
+	create := room.event(alice, "m.room.create", &emptyStateKey, fmt.Sprintf(`{"creator":%q,"room_version":"4"}`, alice), nil, nil)
+	room.input(create, nil)
+	aliceJoin := room.event(alice, "m.room.member", &alice, `{"membership":"join"}`,
+		[]gomatrixserverlib.Event{create}, []gomatrixserverlib.Event{create})
+	room.input(aliceJoin, []gomatrixserverlib.Event{create})
+	joinRules := room.event(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"public"}`,
+		[]gomatrixserverlib.Event{aliceJoin}, []gomatrixserverlib.Event{create, aliceJoin})
+	room.input(joinRules, []gomatrixserverlib.Event{create, aliceJoin})
+	bobJoin := room.event(bob, "m.room.member", &bob, `{"membership":"join"}`,
+		[]gomatrixserverlib.Event{joinRules}, []gomatrixserverlib.Event{create, joinRules})
+	room.input(bobJoin, []gomatrixserverlib.Event{create, joinRules})
+	bobKick := room.event(alice, "m.room.member", &bob, `{"membership":"leave"}`,
+		[]gomatrixserverlib.Event{bobJoin}, []gomatrixserverlib.Event{create, aliceJoin, bobJoin})
+	room.input(bobKick, []gomatrixserverlib.Event{create, aliceJoin, bobJoin})
+
+	roomNID, err := db.RoomNID(ctx, room.roomID)
+	if err != nil {
+		t.Fatalf("RoomNID returned %s", err)
+	}
+	latestBefore, stateBefore, _, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("LatestEventIDs returned %s", err)
+	}
+
+	// Bob's message is allowed by its auth events, from before Bob was
+	// kicked, but not by the current state of the room.
+	message := room.event(bob, "m.room.message", nil, `{"body":"Shaw!","msgtype":"m.text"}`,
+		[]gomatrixserverlib.Event{bobJoin}, []gomatrixserverlib.Event{create, bobJoin})
+	if updates := room.input(message, []gomatrixserverlib.Event{create, bobJoin}); len(updates) != 0 {
+		t.Errorf("expected no output events for the soft-failed event, got %v", outputEventTypes(updates))
+	}
+
+	eventNIDs, err := db.EventNIDs(ctx, []string{message.EventID()})
+	if err != nil || len(eventNIDs) != 1 {
+		t.Fatalf("EventNIDs: expected the soft-failed event to be stored, got %v (%v)", eventNIDs, err)
+	}
+	if rejected, err := db.EventRejected(ctx, eventNIDs[message.EventID()]); err != nil || !rejected {
+		t.Errorf("EventRejected: expected the event to be rejected, got %v (%v)", rejected, err)
+	}
+	latestAfter, stateAfter, _, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("LatestEventIDs returned %s", err)
+	}
+	if stateAfter != stateBefore {
+		t.Errorf("expected the current state to stay at snapshot %d, got %d", stateBefore, stateAfter)
+	}
+	if len(latestAfter) != 1 || len(latestBefore) != 1 || latestAfter[0].EventID != bobKick.EventID() {
+		t.Errorf("expected the latest events to stay at %s, got %v", bobKick.EventID(), latestAfter)
+	}
+}
+
+func TestStateDeltaOutputEvents(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	room.cfg.RoomServer.EmitStateDeltas = true
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	emptyStateKey := ""
+	room.create(alice)
+
+	// stateDelta returns the state delta in the output events, if any.
+	stateDelta := func(updates []api.OutputEvent) *api.OutputStateDelta {
+		var delta *api.OutputStateDelta
+		for _, update := range updates {
+			if update.Type == api.OutputTypeStateDelta {
+				if delta != nil {
+					t.Errorf("expected at most one state delta, got %v", outputEventTypes(updates))
+				}
+				delta = update.StateDelta
+			}
+		}
+		return delta
+	}
+
+	joinRules, updates := room.send(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"public"}`)
+	delta := stateDelta(updates)
+	if delta == nil {
+		t.Fatalf("expected a state delta, got %v", outputEventTypes(updates))
+	}
+	if delta.RoomID != room.roomID || delta.EventID != joinRules.EventID() || len(delta.MembershipChanges) != 0 {
+		t.Errorf("unexpected state delta %+v", delta)
+	}
+	want := []api.StateDeltaChange{{Type: "m.room.join_rules", AddedEventID: joinRules.EventID()}}
+	if fmt.Sprint(delta.StateChanges) != fmt.Sprint(want) {
+		t.Errorf("expected state changes %+v, got %+v", want, delta.StateChanges)
+	}
+
+	bobJoin, joinUpdates := room.send(bob, "m.room.member", &bob, `{"membership":"join"}`)
+	bobLeave, leaveUpdates := room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	for _, test := range []struct {
+		updates []api.OutputEvent
+		want    api.StateDeltaChange
+	}{
+		{joinUpdates, api.StateDeltaChange{Type: "m.room.member", StateKey: bob, AddedEventID: bobJoin.EventID()}},
+		{leaveUpdates, api.StateDeltaChange{Type: "m.room.member", StateKey: bob, RemovedEventID: bobJoin.EventID(), AddedEventID: bobLeave.EventID()}},
+	} {
+		delta = stateDelta(test.updates)
+		if delta == nil {
+			t.Fatalf("expected a state delta, got %v", outputEventTypes(test.updates))
+		}
+		if len(delta.StateChanges) != 0 || len(delta.MembershipChanges) != 1 || delta.MembershipChanges[0] != test.want {
+			t.Errorf("expected membership change %+v, got %+v", test.want, delta)
+		}
+	}
+
+	// Events which don't change the state don't have a delta, and nor does
+	// anything when state deltas aren't enabled.
+	_, updates = room.send(alice, "m.room.message", nil, `{"body":"Shaw!","msgtype":"m.text"}`)
+	if delta = stateDelta(updates); delta != nil {
+		t.Errorf("expected no state delta for a message, got %+v", delta)
+	}
+	room.cfg.RoomServer.EmitStateDeltas = false
+	_, updates = room.send(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"invite"}`)
+	if delta = stateDelta(updates); delta != nil {
+		t.Errorf("expected no state delta when they're disabled, got %+v", delta)
+	}
+}
+
+func TestMembershipAnalyticsTransitions(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	writer := &fakeAnalyticsWriter{transitions: make(chan analytics.MembershipTransition, 10)}
+	room.ow.sink = analytics.NewSink(writer, 10)
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	emptyStateKey := ""
+	room.create(alice)
+	room.send(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"public"}`)
+	bobJoin, _ := room.send(bob, "m.room.member", &bob, `{"membership":"join"}`)
+	room.send(bob, "m.room.message", nil, `{"body":"Shaw!","msgtype":"m.text"}`)
+	bobKick, _ := room.send(alice, "m.room.member", &bob, `{"membership":"leave"}`)
+
+	// Alice's join when the room was created, then Bob's join and kick. The
+	// message and the join rules don't change any memberships.
+	want := []analytics.MembershipTransition{
+		{RoomID: room.roomID, UserID: alice, From: "leave", To: "join", ActorUserID: alice},
+		{RoomID: room.roomID, UserID: bob, From: "leave", To: "join", ActorUserID: bob, Timestamp: bobJoin.OriginServerTS()},
+		{RoomID: room.roomID, UserID: bob, From: "join", To: "leave", ActorUserID: alice, Timestamp: bobKick.OriginServerTS()},
+	}
+	for i, w := range want {
+		select {
+		case got := <-writer.transitions:
+			if i == 0 {
+				// The timestamp of Alice's join isn't known here.
+				w.Timestamp = got.Timestamp
+			}
+			if got != w {
+				t.Errorf("transition %d: want %+v, got %+v", i, w, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for transition %d", i)
+		}
+	}
+	select {
+	case got := <-writer.transitions:
+		t.Errorf("want no more transitions, got %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMembershipOutputClientTxnID(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	alice, bob, carol := "@alice:hollow.knight", "@bob:hollow.knight", "@carol:pale.court"
+	room.create(alice)
+
+	// Invites sent by a local client with a transaction ID include it.
+	txnID := &api.TransactionID{SessionID: 1, TransactionID: "m1"}
+	_, updates := room.sendWithTransactionID(txnID, alice, "m.room.member", &bob, `{"membership":"invite"}`)
+	invite := mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent
+	if invite.ClientTxnID != "m1" {
+		t.Errorf("expected the invite to have client transaction ID %q, got %q", "m1", invite.ClientTxnID)
+	}
+
+	// As do the invites retired by a kick.
+	txnID = &api.TransactionID{SessionID: 1, TransactionID: "m2"}
+	_, updates = room.sendWithTransactionID(txnID, alice, "m.room.member", &bob, `{"membership":"leave"}`)
+	retire := mustFindOutputEvent(t, updates, api.OutputTypeRetireInviteEvent).RetireInviteEvent
+	if retire.ClientTxnID != "m2" {
+		t.Errorf("expected the retired invite to have client transaction ID %q, got %q", "m2", retire.ClientTxnID)
+	}
+
+	// Events without a transaction ID, e.g. from federation, don't.
+	_, updates = room.send(alice, "m.room.member", &carol, `{"membership":"invite"}`)
+	invite = mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent
+	if invite.ClientTxnID != "" {
+		t.Errorf("expected the invite to have no client transaction ID, got %q", invite.ClientTxnID)
+	}
+}
+
+func TestInviteOutputRoomType(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	emptyStateKey := ""
+
+	space := newTestRoom(t, db)
+	space.roomID = fmt.Sprintf("!kingdoms_edge:%s", testOrigin)
+	space.send(alice, gomatrixserverlib.MRoomCreate, &emptyStateKey,
+		fmt.Sprintf(`{"creator":%q,"room_version":%q,"type":"m.space"}`, alice, testRoomVersion))
+	space.send(alice, gomatrixserverlib.MRoomMember, &alice, `{"membership":"join"}`)
+	_, updates := space.send(alice, gomatrixserverlib.MRoomMember, &bob, `{"membership":"invite"}`)
+	invite := mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent
+	if invite.RoomType != "m.space" {
+		t.Errorf("expected the invite to have room type %q, got %q", "m.space", invite.RoomType)
+	}
+
+	// Normal rooms don't have a type.
+	room := newTestRoom(t, db)
+	room.create(alice)
+	_, updates = room.send(alice, gomatrixserverlib.MRoomMember, &bob, `{"membership":"invite"}`)
+	invite = mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent
+	if invite.RoomType != "" {
+		t.Errorf("expected the invite to have no room type, got %q", invite.RoomType)
+	}
+}
+
+func TestMembershipOutputEffectiveActor(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	alice, bob, carol := "@alice:hollow.knight", "@bob:hollow.knight", "@carol:hollow.knight"
+	room.create(alice)
+
+	// The sender of an invite is responsible for it.
+	_, updates := room.send(alice, "m.room.member", &bob, `{"membership":"invite"}`)
+	if actor := mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent.EffectiveActor; actor != alice {
+		t.Errorf("expected the invite's effective actor to be %s, got %q", alice, actor)
+	}
+
+	// Users who reject their own invites are responsible for retiring them.
+	_, updates = room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	if actor := mustFindOutputEvent(t, updates, api.OutputTypeRetireInviteEvent).RetireInviteEvent.EffectiveActor; actor != bob {
+		t.Errorf("expected the rejection's effective actor to be %s, got %q", bob, actor)
+	}
+
+	// Whereas the sender of a kick is responsible for the invite it retires.
+	room.send(alice, "m.room.member", &carol, `{"membership":"invite"}`)
+	_, updates = room.send(alice, "m.room.member", &carol, `{"membership":"leave"}`)
+	if actor := mustFindOutputEvent(t, updates, api.OutputTypeRetireInviteEvent).RetireInviteEvent.EffectiveActor; actor != alice {
+		t.Errorf("expected the kick's effective actor to be %s, got %q", alice, actor)
+	}
+}
+
+func TestInviteOutputMembershipVersion(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	room.create(alice)
+
+	inviteVersion := func(updates []api.OutputEvent) int64 {
+		return mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent.MembershipVersion
+	}
+	retireVersion := func(updates []api.OutputEvent) int64 {
+		return mustFindOutputEvent(t, updates, api.OutputTypeRetireInviteEvent).RetireInviteEvent.MembershipVersion
+	}
+
+	// Every change to Bob's membership increments the version, including
+	// the leave which doesn't retire an invite.
+	_, updates := room.send(alice, "m.room.member", &bob, `{"membership":"invite"}`)
+	first := inviteVersion(updates)
+	_, updates = room.send(bob, "m.room.member", &bob, `{"membership":"join"}`)
+	if got := retireVersion(updates); got != first+1 {
+		t.Errorf("expected the join to have membership version %d, got %d", first+1, got)
+	}
+	room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	_, updates = room.send(alice, "m.room.member", &bob, `{"membership":"invite"}`)
+	if got := inviteVersion(updates); got != first+3 {
+		t.Errorf("expected the second invite to have membership version %d, got %d", first+3, got)
+	}
+	_, updates = room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	if got := retireVersion(updates); got != first+4 {
+		t.Errorf("expected the rejection to have membership version %d, got %d", first+4, got)
+	}
+}
+
+func TestMembershipOutputStateVersion(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	room.cfg.RoomServer.MembershipStateVersion = true
+	alice, bob := "@alice:hollow.knight", "@bob:hollow.knight"
+	emptyStateKey := ""
+	room.create(alice)
+	room.send(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"public"}`)
+	roomNID, err := db.RoomNID(ctx, room.roomID)
+	if err != nil {
+		t.Fatalf("RoomNID returned %s", err)
+	}
+
+	// The state version is that of the current state after the change.
+	currentStateVersion := func() int64 {
+		_, stateNID, _, err := db.LatestEventIDs(ctx, roomNID)
+		if err != nil {
+			t.Fatalf("LatestEventIDs returned %s", err)
+		}
+		return int64(stateNID)
+	}
+	_, updates := room.send(alice, "m.room.member", &bob, `{"membership":"invite"}`)
+	inviteVersion := mustFindOutputEvent(t, updates, api.OutputTypeNewInviteEvent).NewInviteEvent.StateVersion
+	if want := currentStateVersion(); inviteVersion != want {
+		t.Errorf("expected the invite to have state version %d, got %d", want, inviteVersion)
+	}
+	_, updates = room.send(bob, "m.room.member", &bob, `{"membership":"join"}`)
+	joinVersion := mustFindOutputEvent(t, updates, api.OutputTypeNewJoinEvent).NewJoinEvent.StateVersion
+	retireVersion := mustFindOutputEvent(t, updates, api.OutputTypeRetireInviteEvent).RetireInviteEvent.StateVersion
+	if want := currentStateVersion(); joinVersion != want || retireVersion != want {
+		t.Errorf("expected the join to have state version %d, got %d and %d", want, joinVersion, retireVersion)
+	}
+	if joinVersion == inviteVersion {
+		t.Errorf("expected the state version to change after the join")
+	}
+
+	// It isn't included unless it's enabled.
+	room.cfg.RoomServer.MembershipStateVersion = false
+	_, updates = room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	if version := mustFindOutputEvent(t, updates, api.OutputTypeNewLeaveEvent).NewLeaveEvent.StateVersion; version != 0 {
+		t.Errorf("expected no state version when it's disabled, got %d", version)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sort"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// joinedHostDeltas works out how the number of joined users for each server
+// changes as a result of the membership changes in the current state of the
+// room. Servers whose number of joined users doesn't change are left out.
+func joinedHostDeltas(
+	ctx context.Context, db storage.Database, removed, added []types.StateEntry,
+) (map[gomatrixserverlib.ServerName]int, error) {
+	changes := membershipChanges(removed, added)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	var eventNIDs []types.EventNID
+	for _, change := range changes {
+		if change.addedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.addedEventNID)
+		}
+		if change.removedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.removedEventNID)
+		}
+	}
+	events, err := db.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make(map[gomatrixserverlib.ServerName]int)
+	for _, change := range changes {
+		var stateKey *string
+		wasJoined, isJoined := false, false
+		if ev, ok := eventMap(events).lookup(change.removedEventNID); ok {
+			stateKey = ev.StateKey()
+			wasJoined = isJoinEvent(&ev.Event)
+		}
+		if ev, ok := eventMap(events).lookup(change.addedEventNID); ok {
+			stateKey = ev.StateKey()
+			isJoined = isJoinEvent(&ev.Event)
+		}
+		if stateKey == nil || wasJoined == isJoined {
+			continue
+		}
+		_, serverName, err := gomatrixserverlib.SplitID('@', *stateKey)
+		if err != nil {
+			continue
+		}
+		if isJoined {
+			deltas[serverName]++
+		} else {
+			deltas[serverName]--
+		}
+	}
+	for serverName, delta := range deltas {
+		if delta == 0 {
+			delete(deltas, serverName)
+		}
+	}
+	return deltas, nil
+}
+
+// isJoinEvent returns true if the event is a membership event for a join.
+func isJoinEvent(event *gomatrixserverlib.Event) bool {
+	membership, err := event.Membership()
+	return err == nil && membership == gomatrixserverlib.Join
+}
+
+// notifyJoinedHostsChanged works out which servers joined and left the room
+// from the joined host deltas and the current memberships in the room, and
+// calls the joined hosts hook with them. It must only be called once the
+// membership changes have been committed. The changes have already been
+// committed by this point so errors are logged rather than returned.
+func (u *latestEventsUpdater) notifyJoinedHostsChanged() {
+	hook := u.ow.JoinedHostsChangedHook()
+	if hook == nil {
+		return
+	}
+	joinedNIDs, err := u.db.GetMembershipEventNIDsForRoom(u.ctx, u.roomNID, true)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", u.event.RoomID()).Error("Failed to look up joined hosts for hook")
+		return
+	}
+	joinedEvents, err := u.db.Events(u.ctx, joinedNIDs)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", u.event.RoomID()).Error("Failed to look up joined hosts for hook")
+		return
+	}
+	counts := make(map[gomatrixserverlib.ServerName]int)
+	for _, ev := range joinedEvents {
+		if ev.StateKey() == nil {
+			continue
+		}
+		if _, serverName, err := gomatrixserverlib.SplitID('@', *ev.StateKey()); err == nil {
+			counts[serverName]++
+		}
+	}
+
+	joined, left := joinedHostChanges(u.joinedHostDeltas, counts)
+	if len(joined) > 0 || len(left) > 0 {
+		hook(u.event.RoomID(), joined, left)
+	}
+}
+
+// joinedHostChanges returns the servers which joined and left the room, given
+// the change in the number of joined users for each server and the number of
+// joined users for each server after the change. The results are sorted.
+func joinedHostChanges(
+	deltas, counts map[gomatrixserverlib.ServerName]int,
+) (joined, left []gomatrixserverlib.ServerName) {
+	for serverName, delta := range deltas {
+		after := counts[serverName]
+		before := after - delta
+		switch {
+		case before <= 0 && after > 0:
+			joined = append(joined, serverName)
+		case before > 0 && after <= 0:
+			left = append(left, serverName)
+		}
+	}
+	sort.Slice(joined, func(i, j int) bool { return joined[i] < joined[j] })
+	sort.Slice(left, func(i, j int) bool { return left[i] < left[j] })
+	return
+}
@@ -21,6 +21,8 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
@@ -48,6 +50,7 @@ import (
 // Can only be called once at a time
 func updateLatestEvents(
 	ctx context.Context,
+	cfg *config.Dendrite,
 	db storage.Database,
 	ow OutputRoomEventWriter,
 	roomNID types.RoomNID,
@@ -60,19 +63,31 @@ func updateLatestEvents(
 	if err != nil {
 		return
 	}
+	u := latestEventsUpdater{
+		ctx: ctx, cfg: cfg, db: db, updater: updater, ow: ow, roomNID: roomNID,
+		stateAtEvent: stateAtEvent, event: event, sendAsServer: sendAsServer,
+		transactionID: transactionID,
+	}
 	succeeded := false
 	defer func() {
 		txerr := common.EndTransaction(updater, &succeeded)
 		if err == nil && txerr != nil {
 			err = txerr
 		}
+		// Only tell the hook about the joined hosts once they have been
+		// committed to the database.
+		if err == nil && succeeded && len(u.joinedHostDeltas) > 0 {
+			u.notifyJoinedHostsChanged()
+		}
+		// Likewise only send the membership transitions for analytics once
+		// they have been committed.
+		if err == nil && succeeded {
+			for _, transition := range u.membershipTransitions {
+				u.ow.MembershipAnalyticsSink().Send(transition)
+			}
+		}
 	}()
 
-	u := latestEventsUpdater{
-		ctx: ctx, db: db, updater: updater, ow: ow, roomNID: roomNID,
-		stateAtEvent: stateAtEvent, event: event, sendAsServer: sendAsServer,
-		transactionID: transactionID,
-	}
 	if err = u.doUpdateLatestEvents(); err != nil {
 		return err
 	}
@@ -87,6 +102,7 @@ func updateLatestEvents(
 // when there are so many variables to pass around.
 type latestEventsUpdater struct {
 	ctx           context.Context
+	cfg           *config.Dendrite
 	db            storage.Database
 	updater       types.RoomRecentEventsUpdater
 	ow            OutputRoomEventWriter
@@ -111,6 +127,12 @@ type latestEventsUpdater struct {
 	// The snapshots of current state before and after processing this event
 	oldStateNID types.StateSnapshotNID
 	newStateNID types.StateSnapshotNID
+	// The change in the number of joined users for each server whose users
+	// joined or left the room. Only worked out if there is a joined hosts hook.
+	joinedHostDeltas map[gomatrixserverlib.ServerName]int
+	// The membership transitions to send to the analytics sink. Only worked
+	// out if there is an analytics sink.
+	membershipTransitions []analytics.MembershipTransition
 }
 
 func (u *latestEventsUpdater) doUpdateLatestEvents() error {
@@ -147,10 +169,35 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return err
 	}
 
-	updates, err := updateMemberships(u.ctx, u.db, u.updater, u.removed, u.added)
+	var transitions *[]analytics.MembershipTransition
+	if u.ow.MembershipAnalyticsSink() != nil {
+		transitions = &u.membershipTransitions
+	}
+	// Whether the room is announce-only is looked up once for the event, as
+	// it affects both the membership output events and the state delta.
+	var announceOnly bool
+	if len(u.removed) > 0 || len(u.added) > 0 {
+		if announceOnly, err = u.db.IsRoomAnnounceOnly(u.ctx, u.roomNID); err != nil {
+			return err
+		}
+	}
+	updates, err := updateMemberships(
+		u.ctx, u.cfg, u.db, u.updater, u.removed, u.added, u.membershipChangeCause(),
+		announceOnly, transitions, u.event.EventID(), u.transactionID,
+	)
 	if err != nil {
 		return err
 	}
+	if u.cfg != nil && u.cfg.RoomServer.MembershipStateVersion {
+		setStateVersion(updates, u.newStateNID)
+	}
+
+	if u.ow.JoinedHostsChangedHook() != nil {
+		u.joinedHostDeltas, err = joinedHostDeltas(u.ctx, u.db, u.removed, u.added)
+		if err != nil {
+			return err
+		}
+	}
 
 	update, err := u.makeOutputNewRoomEvent()
 	if err != nil {
@@ -158,6 +205,14 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	}
 	updates = append(updates, *update)
 
+	if u.cfg != nil && u.cfg.RoomServer.EmitStateDeltas && (len(u.removed) > 0 || len(u.added) > 0) {
+		delta, err := u.makeOutputStateDelta(announceOnly)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, *delta)
+	}
+
 	// Send the event to the output logs.
 	// We do this inside the database transaction to ensure that we only mark an event as sent if we sent it.
 	// (n.b. this means that it's possible that the same event will be sent twice if the transaction fails but
@@ -177,6 +232,19 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	return u.updater.MarkEventAsSent(u.stateAtEvent.EventNID)
 }
 
+// membershipChangeCause works out why the current state of the room changed.
+// If anything other than the new event itself was added to the current state
+// then state resolution must have recomputed the current state, e.g. because
+// the new event merged forks of the room or because of a state reset.
+func (u *latestEventsUpdater) membershipChangeCause() api.MembershipChangeCause {
+	for _, entry := range u.added {
+		if entry.EventNID != u.stateAtEvent.EventNID {
+			return api.MembershipChangeCauseStateResolution
+		}
+	}
+	return api.MembershipChangeCauseEvent
+}
+
 func (u *latestEventsUpdater) latestState() error {
 	var err error
 	roomState := state.NewStateResolution(u.db)
@@ -300,6 +368,71 @@ func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error)
 	}, nil
 }
 
+// makeOutputStateDelta bundles the changes in the current state of the room
+// into a single output event. The membership changes are separated from the
+// other state changes for the benefit of consumers that only care about one.
+// If the room is announce-only then joins, leaves and profile changes are left
+// out of the membership changes, and only changes to invites are kept.
+func (u *latestEventsUpdater) makeOutputStateDelta(announceOnly bool) (*api.OutputEvent, error) {
+	changes := pairUpChanges(u.removed, u.added)
+
+	var eventNIDs []types.EventNID
+	for _, change := range changes {
+		if change.addedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.addedEventNID)
+		}
+		if change.removedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.removedEventNID)
+		}
+	}
+	// We need the events themselves to find the string type and state key
+	// for each state key tuple.
+	events, err := u.db.Events(u.ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := api.OutputStateDelta{
+		RoomID:  u.event.RoomID(),
+		EventID: u.event.EventID(),
+	}
+	for _, change := range changes {
+		var sdc api.StateDeltaChange
+		var invite bool
+		for _, eventNID := range []types.EventNID{change.removedEventNID, change.addedEventNID} {
+			if eventNID == 0 {
+				continue
+			}
+			ev, ok := eventMap(events).lookup(eventNID)
+			if !ok || ev.StateKey() == nil {
+				continue
+			}
+			sdc.Type, sdc.StateKey = ev.Type(), *ev.StateKey()
+			if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Invite {
+				invite = true
+			}
+			if eventNID == change.removedEventNID {
+				sdc.RemovedEventID = ev.EventID()
+			} else {
+				sdc.AddedEventID = ev.EventID()
+			}
+		}
+		if change.EventTypeNID == types.MRoomMemberNID {
+			if announceOnly && !invite {
+				continue
+			}
+			delta.MembershipChanges = append(delta.MembershipChanges, sdc)
+		} else {
+			delta.StateChanges = append(delta.StateChanges, sdc)
+		}
+	}
+
+	return &api.OutputEvent{
+		Type:       api.OutputTypeStateDelta,
+		StateDelta: &delta,
+	}, nil
+}
+
 type eventNIDSorter []types.EventNID
 
 func (s eventNIDSorter) Len() int           { return len(s) }
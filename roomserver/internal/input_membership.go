@@ -16,26 +16,55 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"strings"
 
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
 // updateMembership updates the current membership and the invites for each
 // user affected by a change in the current state of the room.
 // Returns a list of output events to write to the kafka log to inform the
-// consumers about the invites added or retired by the change in current state.
+// consumers about the invites and knocks added, accepted or retired, and the
+// users who joined or left, because of the change in current state. The joined
+// member count on the join and leave events is read once, after all of the
+// changes have been made.
+// The cause is recorded on each output event so that consumers can tell
+// changes caused by state resolution apart from changes caused by new events.
+// If transitions isn't nil then the membership transitions are appended to it
+// for the analytics sink. The transaction ID, if any, is that of the client
+// request which sent the event with ID txnEventID, and is included in the
+// output events caused by that event.
+// If the room is announce-only then no output events are sent for joins and
+// leaves, but the output events for invites and knocks, including those which
+// retire invites, are still sent.
 func updateMemberships(
 	ctx context.Context,
+	cfg *config.Dendrite,
 	db storage.Database,
 	updater types.RoomRecentEventsUpdater,
 	removed, added []types.StateEntry,
+	cause api.MembershipChangeCause, announceOnly bool,
+	transitions *[]analytics.MembershipTransition,
+	txnEventID string, transactionID *api.TransactionID,
 ) ([]api.OutputEvent, error) {
-	changes := membershipChanges(removed, added)
+	changes, err := filterUnchangedMemberships(ctx, db, membershipChanges(removed, added))
+	if err != nil {
+		return nil, err
+	}
 	var eventNIDs []types.EventNID
 	for _, change := range changes {
 		if change.addedEventNID != 0 {
@@ -46,45 +75,687 @@ func updateMemberships(
 		}
 	}
 
-	// Load the event JSON so we can look up the "membership" key.
-	// TODO: Maybe add a membership key to the events table so we can load that
-	// key without having to load the entire event JSON?
+	// Load the event JSON for the changes that are left, as the events are
+	// needed to update the memberships and to build the output events.
 	events, err := db.Events(ctx, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
 
+	// The join rule and room type are only needed for some of the changes, so
+	// load the auth events for just those changes in a single read rather than
+	// reading them for each change.
+	var needAuthEvents []*gomatrixserverlib.Event
+	for _, change := range changes {
+		if re, ae := changeEvents(events, change); needsAuthEvents(re, ae) {
+			needAuthEvents = append(needAuthEvents, ae)
+		}
+	}
+	authEvents := loadMembershipAuthEvents(ctx, db, needAuthEvents)
+
+	// Likewise whether the joins are rejoins and whether the room was
+	// encrypted when they happened are looked up for all of the joins at
+	// once. This has to be done before the memberships are updated, as the
+	// updates add the joins to the audit log that rejoins are detected from.
+	var joins joinLookups
+	if !announceOnly {
+		joins = loadJoinLookups(ctx, db, changes, events)
+	}
+
 	var updates []api.OutputEvent
+	var leaves int
+	// The joined member counts of the join and leave events, which are filled
+	// in once all of the memberships have been updated.
+	var joinedMemberCounts []*int64
 
 	for _, change := range changes {
-		var ae *gomatrixserverlib.Event
-		var re *gomatrixserverlib.Event
 		targetUserNID := change.EventStateKeyNID
-		if change.removedEventNID != 0 {
-			ev, _ := eventMap(events).lookup(change.removedEventNID)
-			if ev != nil {
-				re = &ev.Event
-			}
+		re, ae := changeEvents(events, change)
+		if isLeaveTransition(re, ae) {
+			leaves++
 		}
-		if change.addedEventNID != 0 {
-			ev, _ := eventMap(events).lookup(change.addedEventNID)
-			if ev != nil {
-				ae = &ev.Event
+		before := len(updates)
+		var joinRule, roomType string
+		if needsAuthEvents(re, ae) {
+			joinRule = authEvents.joinRule(ae)
+			roomType = authEvents.roomType(ae)
+		}
+		var clientTxnID string
+		if ae != nil && ae.EventID() == txnEventID {
+			clientTxnID = clientTransactionID(transactionID)
+		}
+		var joinEvent *api.OutputNewJoinEvent
+		var leaveEvent *api.OutputNewLeaveEvent
+		if !announceOnly {
+			joinEvent = newJoinEvent(re, ae, change.addedEventNID, joins)
+			leaveEvent = newLeaveEvent(re, ae)
+		}
+		if updates, err = updateMembershipRecovering(
+			updater, targetUserNID, re, ae, updates, membershipValidation(cfg), joinRule,
+			roomType, clientTxnID,
+		); err != nil {
+			return nil, err
+		}
+		if joinEvent != nil {
+			joinedMemberCounts = append(joinedMemberCounts, &joinEvent.JoinedMemberCount)
+			updates = append(updates, api.OutputEvent{
+				Type:         api.OutputTypeNewJoinEvent,
+				NewJoinEvent: joinEvent,
+			})
+		}
+		if leaveEvent != nil {
+			joinedMemberCounts = append(joinedMemberCounts, &leaveEvent.JoinedMemberCount)
+			updates = append(updates, api.OutputEvent{
+				Type:          api.OutputTypeNewLeaveEvent,
+				NewLeaveEvent: leaveEvent,
+			})
+		}
+		if cfg != nil && cfg.RoomServer.MembershipPrevContent && re != nil {
+			setPrevContent(updates[before:], re.Content())
+		}
+		if transitions != nil {
+			if transition, ok := membershipTransition(re, ae); ok {
+				*transitions = append(*transitions, transition)
 			}
 		}
-		if updates, err = updateMembership(updater, targetUserNID, re, ae, updates); err != nil {
+	}
+
+	if len(joinedMemberCounts) > 0 {
+		count, err := updater.JoinedMemberCount()
+		if err != nil {
 			return nil, err
 		}
+		for _, joinedMemberCount := range joinedMemberCounts {
+			*joinedMemberCount = count
+		}
+	}
+
+	if cause != api.MembershipChangeCauseEvent {
+		setCause(updates, cause)
+	}
+
+	// If enough users left the room in this one update, e.g. because the room
+	// is being shut down, then send all of the retired invites as a single
+	// event rather than flooding the consumers with one event per invite.
+	if cfg != nil {
+		threshold := cfg.RoomServer.MassLeaveRetireThreshold
+		if threshold > 0 && leaves >= threshold {
+			updates = coalesceRetireInviteEvents(updates)
+		}
 	}
 	return updates, nil
 }
 
+// filterUnchangedMemberships removes the changes which don't change the
+// membership of the user, e.g. a leave replaced by another leave, using the
+// membership stored in the events table so that the event JSON doesn't have
+// to be loaded for them. Joins replaced by joins are kept as they may be
+// profile changes, as are changes where the membership of either event isn't
+// known, e.g. because the event was stored before memberships were recorded.
+func filterUnchangedMemberships(
+	ctx context.Context, db storage.Database, changes []stateChange,
+) ([]stateChange, error) {
+	var eventNIDs []types.EventNID
+	for _, change := range changes {
+		if change.addedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.addedEventNID)
+		}
+		if change.removedEventNID != 0 {
+			eventNIDs = append(eventNIDs, change.removedEventNID)
+		}
+	}
+	if len(eventNIDs) == 0 {
+		return changes, nil
+	}
+	memberships, err := db.EventMemberships(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := changes[:0]
+	for _, change := range changes {
+		if !membershipUnchanged(change, memberships) {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+// membershipUnchanged returns true if the change is known not to change the
+// membership of the user, in which case updateMembership would ignore it.
+func membershipUnchanged(change stateChange, memberships map[types.EventNID]string) bool {
+	if change.addedEventNID == 0 || change.addedEventNID == change.removedEventNID {
+		// These are errors which updateMembership reports.
+		return false
+	}
+	newMembership, ok := memberships[change.addedEventNID]
+	if !ok || newMembership == gomatrixserverlib.Join {
+		return false
+	}
+	oldMembership := gomatrixserverlib.Leave
+	if change.removedEventNID != 0 {
+		if oldMembership, ok = memberships[change.removedEventNID]; !ok {
+			return false
+		}
+	}
+	return oldMembership == newMembership
+}
+
+// membershipTransition describes the change from the removed membership event
+// to the added one, if the membership actually changed.
+func membershipTransition(remove, add *gomatrixserverlib.Event) (analytics.MembershipTransition, bool) {
+	if add == nil || add.StateKey() == nil {
+		return analytics.MembershipTransition{}, false
+	}
+	from := gomatrixserverlib.Leave
+	if remove != nil {
+		membership, err := remove.Membership()
+		if err != nil {
+			return analytics.MembershipTransition{}, false
+		}
+		from = membership
+	}
+	to, err := add.Membership()
+	if err != nil || from == to {
+		return analytics.MembershipTransition{}, false
+	}
+	return analytics.MembershipTransition{
+		RoomID:      add.RoomID(),
+		UserID:      *add.StateKey(),
+		From:        from,
+		To:          to,
+		ActorUserID: add.Sender(),
+		Timestamp:   add.OriginServerTS(),
+	}, true
+}
+
+// setPrevContent sets the previous membership content on the membership
+// output events in the list of updates.
+func setPrevContent(updates []api.OutputEvent, prevContent json.RawMessage) {
+	for _, update := range updates {
+		switch update.Type {
+		case api.OutputTypeNewInviteEvent:
+			update.NewInviteEvent.PrevContent = prevContent
+		case api.OutputTypeRetireInviteEvent:
+			update.RetireInviteEvent.PrevContent = prevContent
+		case api.OutputTypeKnockAccepted:
+			update.KnockAccepted.PrevContent = prevContent
+		case api.OutputTypeNewKnockEvent:
+			update.NewKnockEvent.PrevContent = prevContent
+		case api.OutputTypeNewJoinEvent:
+			update.NewJoinEvent.PrevContent = prevContent
+		case api.OutputTypeNewLeaveEvent:
+			update.NewLeaveEvent.PrevContent = prevContent
+		}
+	}
+}
+
+// setStateVersion sets the version of the current state of the room on the
+// membership output events in the list of updates. The version is the NID of
+// the state snapshot, which changes whenever the current state changes.
+func setStateVersion(updates []api.OutputEvent, stateNID types.StateSnapshotNID) {
+	version := int64(stateNID)
+	for _, update := range updates {
+		switch update.Type {
+		case api.OutputTypeNewInviteEvent:
+			update.NewInviteEvent.StateVersion = version
+		case api.OutputTypeRetireInviteEvent:
+			update.RetireInviteEvent.StateVersion = version
+		case api.OutputTypeRetireInviteBatchEvent:
+			for i := range update.RetireInviteBatchEvent.RetiredInvites {
+				update.RetireInviteBatchEvent.RetiredInvites[i].StateVersion = version
+			}
+		case api.OutputTypeKnockAccepted:
+			update.KnockAccepted.StateVersion = version
+		case api.OutputTypeNewJoinEvent:
+			update.NewJoinEvent.StateVersion = version
+		case api.OutputTypeNewLeaveEvent:
+			update.NewLeaveEvent.StateVersion = version
+		case api.OutputTypeNewKnockEvent:
+			update.NewKnockEvent.StateVersion = version
+		}
+	}
+}
+
+// setCause sets the cause on the membership output events in the list of
+// updates. The changes weren't made by the senders of the membership events,
+// so the effective actor is set to the system where the event has one.
+func setCause(updates []api.OutputEvent, cause api.MembershipChangeCause) {
+	for _, update := range updates {
+		switch update.Type {
+		case api.OutputTypeNewInviteEvent:
+			update.NewInviteEvent.Cause = cause
+			update.NewInviteEvent.EffectiveActor = api.EffectiveActorSystem
+		case api.OutputTypeRetireInviteEvent:
+			update.RetireInviteEvent.Cause = cause
+			update.RetireInviteEvent.EffectiveActor = api.EffectiveActorSystem
+		case api.OutputTypeKnockAccepted:
+			update.KnockAccepted.Cause = cause
+			update.KnockAccepted.EffectiveActor = api.EffectiveActorSystem
+		case api.OutputTypeNewKnockEvent:
+			update.NewKnockEvent.Cause = cause
+			update.NewKnockEvent.EffectiveActor = api.EffectiveActorSystem
+		case api.OutputTypeNewJoinEvent:
+			update.NewJoinEvent.Cause = cause
+		case api.OutputTypeNewLeaveEvent:
+			update.NewLeaveEvent.Cause = cause
+		}
+	}
+}
+
+// effectiveActor returns who is responsible for the membership change made
+// by the event: the sender of the event, which is the target user themselves
+// for joins and self-leaves, or the system if there is no event.
+func effectiveActor(event *gomatrixserverlib.Event) string {
+	if event == nil || event.Sender() == "" {
+		return api.EffectiveActorSystem
+	}
+	return event.Sender()
+}
+
+// isLeaveTransition returns true if the membership change takes the user
+// from being joined or invited to the room to having left or been banned.
+func isLeaveTransition(remove, add *gomatrixserverlib.Event) bool {
+	if remove == nil || add == nil {
+		return false
+	}
+	oldMembership, err := remove.Membership()
+	if err != nil {
+		return false
+	}
+	newMembership, err := add.Membership()
+	if err != nil {
+		return false
+	}
+	switch oldMembership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Invite:
+	default:
+		return false
+	}
+	return newMembership == gomatrixserverlib.Leave || newMembership == gomatrixserverlib.Ban
+}
+
+// coalesceRetireInviteEvents replaces all of the retire invite events in the
+// list of updates with a single batched retire invite event, which is placed
+// where the first retire invite event was. Other updates are left in order.
+func coalesceRetireInviteEvents(updates []api.OutputEvent) []api.OutputEvent {
+	var result []api.OutputEvent
+	var batch *api.OutputRetireInviteBatchEvent
+	for _, update := range updates {
+		if update.Type != api.OutputTypeRetireInviteEvent {
+			result = append(result, update)
+			continue
+		}
+		if batch == nil {
+			batch = &api.OutputRetireInviteBatchEvent{}
+			result = append(result, api.OutputEvent{
+				Type:                   api.OutputTypeRetireInviteBatchEvent,
+				RetireInviteBatchEvent: batch,
+			})
+		}
+		batch.RetiredInvites = append(batch.RetiredInvites, *update.RetireInviteEvent)
+	}
+	return result
+}
+
+// membershipUpdaterProvider provides the membership updaters used by
+// updateMembership. It is implemented by types.RoomRecentEventsUpdater.
+type membershipUpdaterProvider interface {
+	RoomVersion() gomatrixserverlib.RoomVersion
+	MembershipUpdater(targetUserNID types.EventStateKeyNID) (types.MembershipUpdater, error)
+}
+
+// membershipValidation returns the configured membership event validation
+// level, defaulting to lenient.
+func membershipValidation(cfg *config.Dendrite) config.MembershipValidation {
+	if cfg == nil || cfg.RoomServer.MembershipValidation == "" {
+		return config.MembershipValidationLenient
+	}
+	return cfg.RoomServer.MembershipValidation
+}
+
+// knownMemberContentKeys are the top-level content keys that are allowed in
+// "m.room.member" events when validating strictly.
+var knownMemberContentKeys = map[string]bool{
+	"membership":         true,
+	"displayname":        true,
+	"avatar_url":         true,
+	"is_direct":          true,
+	"third_party_invite": true,
+	"reason":             true,
+}
+
+// validateMembershipContent checks the content of a membership event against
+// the validation level. Lenient validation accepts any content, whereas strict
+// validation rejects content with unknown top-level keys.
+func validateMembershipContent(
+	event *gomatrixserverlib.Event, validation config.MembershipValidation,
+) error {
+	if validation != config.MembershipValidationStrict {
+		return nil
+	}
+	var content map[string]json.RawMessage
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return err
+	}
+	for key := range content {
+		if !knownMemberContentKeys[key] {
+			membershipValidationRejectedTotal.Inc()
+			return fmt.Errorf(
+				"input: membership event %q rejected: unknown content key %q", event.EventID(), key,
+			)
+		}
+	}
+	return nil
+}
+
+// changeEvents returns the membership events removed and added by the change,
+// or nil if there isn't one.
+func changeEvents(events []types.Event, change stateChange) (remove, add *gomatrixserverlib.Event) {
+	if change.removedEventNID != 0 {
+		if ev, ok := eventMap(events).lookup(change.removedEventNID); ok {
+			remove = &ev.Event
+		}
+	}
+	if change.addedEventNID != 0 {
+		if ev, ok := eventMap(events).lookup(change.addedEventNID); ok {
+			add = &ev.Event
+		}
+	}
+	return remove, add
+}
+
+// hasMembership returns true if the event is a membership event with the
+// given membership.
+func hasMembership(event *gomatrixserverlib.Event, membership string) bool {
+	if event == nil {
+		return false
+	}
+	m, err := event.Membership()
+	return err == nil && m == membership
+}
+
+// needsAuthEvents returns true if the join rule or room type from the auth
+// events of the added event are used for the membership change, i.e. if it
+// is an invite or a join by a user who wasn't already joined.
+func needsAuthEvents(remove, add *gomatrixserverlib.Event) bool {
+	if hasMembership(add, gomatrixserverlib.Invite) {
+		return true
+	}
+	return hasMembership(add, gomatrixserverlib.Join) && !hasMembership(remove, gomatrixserverlib.Join)
+}
+
+// membershipAuthEvents holds the auth events of membership events by event
+// ID, for finding the join rule and room type at the membership events.
+type membershipAuthEvents map[string]*gomatrixserverlib.Event
+
+// loadMembershipAuthEvents loads the auth events of the membership events with
+// a single database read. This is best effort: if they can't be loaded then
+// the join rule and room type are left empty.
+func loadMembershipAuthEvents(
+	ctx context.Context, db storage.Database, events []*gomatrixserverlib.Event,
+) membershipAuthEvents {
+	var eventIDs []string
+	seen := make(map[string]bool)
+	for _, event := range events {
+		for _, eventID := range event.AuthEventIDs() {
+			if !seen[eventID] {
+				seen[eventID] = true
+				eventIDs = append(eventIDs, eventID)
+			}
+		}
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	authEvents, err := db.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		logrus.WithError(err).Warn(
+			"input: failed to load auth events to find join rule and room type",
+		)
+		return nil
+	}
+	result := make(membershipAuthEvents, len(authEvents))
+	for i := range authEvents {
+		result[authEvents[i].EventID()] = &authEvents[i].Event
+	}
+	return result
+}
+
+// authEvent returns the auth event of the event with the given type, or nil
+// if it isn't known.
+func (m membershipAuthEvents) authEvent(
+	event *gomatrixserverlib.Event, eventType string,
+) *gomatrixserverlib.Event {
+	for _, eventID := range event.AuthEventIDs() {
+		if authEvent, ok := m[eventID]; ok && authEvent.Type() == eventType {
+			return authEvent
+		}
+	}
+	return nil
+}
+
+// joinRule returns the join rule that was in effect when the user joined the
+// room, taken from the join rules event in the auth events of the join event.
+// This is best effort: it returns an empty string if the event isn't a join or
+// if the join rule can't be worked out.
+func (m membershipAuthEvents) joinRule(event *gomatrixserverlib.Event) string {
+	if !hasMembership(event, gomatrixserverlib.Join) {
+		return ""
+	}
+	authEvent := m.authEvent(event, gomatrixserverlib.MRoomJoinRules)
+	if authEvent == nil {
+		return ""
+	}
+	var content gomatrixserverlib.JoinRuleContent
+	if err := json.Unmarshal(authEvent.Content(), &content); err != nil {
+		return ""
+	}
+	return content.JoinRule
+}
+
+// roomType returns the type of the room that the user was invited to, taken
+// from the create event in the auth events of the invite event, e.g. "m.space"
+// for a space. This is best effort: it returns an empty string if the event
+// isn't an invite, if the room has no type or if the type can't be worked out.
+func (m membershipAuthEvents) roomType(event *gomatrixserverlib.Event) string {
+	if !hasMembership(event, gomatrixserverlib.Invite) {
+		return ""
+	}
+	authEvent := m.authEvent(event, gomatrixserverlib.MRoomCreate)
+	if authEvent == nil {
+		return ""
+	}
+	var content struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(authEvent.Content(), &content); err != nil {
+		return ""
+	}
+	return content.Type
+}
+
+// mRoomEncryption is the type of the event which enables encryption in a room.
+// gomatrixserverlib doesn't define it yet.
+const mRoomEncryption = "m.room.encryption"
+
+// isJoin returns whether the membership change changes the membership of the
+// user to "join".
+func isJoin(remove, add *gomatrixserverlib.Event) bool {
+	if add == nil || add.StateKey() == nil {
+		return false
+	}
+	if membership, err := add.Membership(); err != nil || membership != gomatrixserverlib.Join {
+		return false
+	}
+	if remove != nil {
+		if membership, err := remove.Membership(); err == nil && membership == gomatrixserverlib.Join {
+			return false
+		}
+	}
+	return true
+}
+
+// joinLookups holds whether the users in a batch of membership changes have
+// joined the room before, by user ID, and whether the room was encrypted
+// before each of the joins, by event NID.
+type joinLookups struct {
+	rejoins   map[string]bool
+	encrypted map[types.EventNID]bool
+}
+
+// loadJoinLookups looks up the joinLookups for the joins among the changes,
+// with a fixed number of reads however many joins there are. This is best
+// effort: if we can't tell then the joins are treated as first joins, as it's
+// better to share the room keys again than not at all, and the room as not
+// encrypted.
+func loadJoinLookups(
+	ctx context.Context, db storage.Database, changes []stateChange, events []types.Event,
+) (result joinLookups) {
+	var roomID string
+	var userIDs, eventIDs []string
+	for _, change := range changes {
+		if re, ae := changeEvents(events, change); isJoin(re, ae) {
+			roomID = ae.RoomID()
+			userIDs = append(userIDs, *ae.StateKey())
+			eventIDs = append(eventIDs, ae.EventID())
+		}
+	}
+	if len(eventIDs) == 0 {
+		return
+	}
+	var err error
+	if result.rejoins, err = db.UsersJoinedRoomBefore(ctx, roomID, userIDs); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn(
+			"input: failed to look up whether the joins are rejoins",
+		)
+	}
+	result.encrypted = roomEncryptedAtJoins(ctx, db, roomID, eventIDs)
+	return
+}
+
+// newJoinEvent returns the OutputNewJoinEvent for the membership change, or
+// nil if it doesn't change the membership of the user to "join".
+func newJoinEvent(
+	remove, add *gomatrixserverlib.Event, addEventNID types.EventNID, joins joinLookups,
+) *api.OutputNewJoinEvent {
+	if !isJoin(remove, add) {
+		return nil
+	}
+	targetUserID := *add.StateKey()
+	rejoin := joins.rejoins[targetUserID]
+	encrypted := joins.encrypted[addEventNID]
+	return &api.OutputNewJoinEvent{
+		RoomID:        add.RoomID(),
+		TargetUserID:  targetUserID,
+		EventID:       add.EventID(),
+		Rejoin:        rejoin,
+		RoomEncrypted: encrypted,
+		ShareRoomKeys: encrypted && !rejoin,
+		IdempotencyKey: membershipIdempotencyKey(
+			add.RoomID(), targetUserID, string(api.OutputTypeNewJoinEvent), add.EventID(),
+		),
+	}
+}
+
+// newLeaveEvent returns the OutputNewLeaveEvent for the membership change, or
+// nil if it doesn't change the membership of the user from "join" to "leave"
+// or "ban". The joined member count is filled in once the change is made.
+func newLeaveEvent(remove, add *gomatrixserverlib.Event) *api.OutputNewLeaveEvent {
+	if remove == nil || add == nil || add.StateKey() == nil {
+		return nil
+	}
+	if membership, err := remove.Membership(); err != nil || membership != gomatrixserverlib.Join {
+		return nil
+	}
+	membership, err := add.Membership()
+	if err != nil || (membership != gomatrixserverlib.Leave && membership != gomatrixserverlib.Ban) {
+		return nil
+	}
+	targetUserID := *add.StateKey()
+	return &api.OutputNewLeaveEvent{
+		RoomID:       add.RoomID(),
+		TargetUserID: targetUserID,
+		EventID:      add.EventID(),
+		Membership:   membership,
+		IdempotencyKey: membershipIdempotencyKey(
+			add.RoomID(), targetUserID, string(api.OutputTypeNewLeaveEvent), add.EventID(),
+		),
+	}
+}
+
+// roomEncryptedAtJoins returns whether encryption was enabled in the room in
+// the state before each of the join events, by event NID. The state is loaded
+// for all of the joins at once. This is best effort: the room is treated as
+// not encrypted if the state can't be worked out.
+func roomEncryptedAtJoins(
+	ctx context.Context, db storage.Database, roomID string, eventIDs []string,
+) map[types.EventNID]bool {
+	result := make(map[types.EventNID]bool, len(eventIDs))
+	stateAtEvents, err := db.StateAtEventIDs(ctx, eventIDs)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn(
+			"input: failed to load state at joins to find whether the room is encrypted",
+		)
+		return result
+	}
+	stateNIDs := make([]types.StateSnapshotNID, len(stateAtEvents))
+	for i := range stateAtEvents {
+		stateNIDs[i] = stateAtEvents[i].BeforeStateSnapshotNID
+	}
+	entries, err := state.NewStateResolution(db).LoadStateAtSnapshotsForStringTuples(
+		ctx, stateNIDs, []gomatrixserverlib.StateKeyTuple{{EventType: mRoomEncryption, StateKey: ""}},
+	)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn(
+			"input: failed to load state at joins to find whether the room is encrypted",
+		)
+		return result
+	}
+	for _, stateAtEvent := range stateAtEvents {
+		result[stateAtEvent.EventNID] = len(entries[stateAtEvent.BeforeStateSnapshotNID]) > 0
+	}
+	return result
+}
+
+// roomTypeAtInvite returns the type of the room that the user was invited
+// to. See membershipAuthEvents.roomType.
+func roomTypeAtInvite(
+	ctx context.Context, db storage.Database, event *gomatrixserverlib.Event,
+) string {
+	if !hasMembership(event, gomatrixserverlib.Invite) {
+		return ""
+	}
+	return loadMembershipAuthEvents(ctx, db, []*gomatrixserverlib.Event{event}).roomType(event)
+}
+
+// clientTransactionID returns the client transaction ID from the transaction
+// ID given in an input request, or empty if there isn't one.
+func clientTransactionID(transactionID *api.TransactionID) string {
+	if transactionID == nil {
+		return ""
+	}
+	return transactionID.TransactionID
+}
+
 func updateMembership(
-	updater types.RoomRecentEventsUpdater, targetUserNID types.EventStateKeyNID,
+	updater membershipUpdaterProvider, targetUserNID types.EventStateKeyNID,
 	remove, add *gomatrixserverlib.Event,
-	updates []api.OutputEvent,
+	updates []api.OutputEvent, validation config.MembershipValidation,
+	joinRule, roomType, clientTxnID string,
 ) ([]api.OutputEvent, error) {
 	var err error
+	if remove != nil && add != nil && remove.EventID() == add.EventID() {
+		// The state entry was replaced by itself, which only happens if the
+		// state tables are corrupt. Nothing really changed, so don't emit a
+		// spurious transition for it.
+		selfReferentialMembershipTotal.Inc()
+		logrus.WithFields(logrus.Fields{
+			"room_id":  add.RoomID(),
+			"event_id": add.EventID(),
+		}).Warn("input: membership event replaced itself in the state, state may be corrupt")
+		return updates, nil
+	}
+
 	// Default the membership to Leave if no event was added or removed.
 	oldMembership := gomatrixserverlib.Leave
 	newMembership := gomatrixserverlib.Leave
@@ -114,28 +785,153 @@ func updateMembership(
 		return updates, errors.New("add should not be nil")
 	}
 
+	if err = validateMembershipContent(add, validation); err != nil {
+		return nil, err
+	}
+
 	mu, err := updater.MembershipUpdater(targetUserNID)
 	if err != nil {
 		return nil, err
 	}
 
+	if remove != nil {
+		updates = appendKnockAccepted(updates, remove, add, oldMembership, newMembership)
+	}
+
 	switch newMembership {
 	case gomatrixserverlib.Invite:
-		return updateToInviteMembership(mu, add, updates, updater.RoomVersion())
+		return updateToInviteMembership(mu, add, updates, updater.RoomVersion(), roomType, clientTxnID)
 	case gomatrixserverlib.Join:
-		return updateToJoinMembership(mu, add, updates)
+		return updateToJoinMembership(mu, add, updates, joinRule, clientTxnID)
 	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
-		return updateToLeaveMembership(mu, add, newMembership, updates)
+		return updateToLeaveMembership(mu, add, newMembership, updates, clientTxnID)
+	case knockMembership:
+		return updateToKnockMembership(mu, add, updates, clientTxnID)
 	default:
-		panic(fmt.Errorf(
+		return nil, fmt.Errorf(
 			"input: membership %q is not one of the allowed values", newMembership,
-		))
+		)
+	}
+}
+
+// membershipIdempotencyKey derives the idempotency key for a membership output
+// event from the room, the target user, the transition and the ID of the
+// event which caused it. The same logical transition always gets the same
+// key, so consumers can use it to ignore output events written more than once.
+func membershipIdempotencyKey(roomID, targetUserID, transition, eventID string) string {
+	// The parts are NUL separated as none of them can contain NUL.
+	sum := sha256.Sum256([]byte(strings.Join(
+		[]string{roomID, targetUserID, transition, eventID}, "\x00",
+	)))
+	return hex.EncodeToString(sum[:])
+}
+
+// knockMembership is the "membership" of a user who has knocked on a room.
+// gomatrixserverlib doesn't define it yet.
+const knockMembership = "knock"
+
+// appendKnockAccepted appends an OutputKnockAccepted event to the updates if
+// the membership change accepts a knock, i.e. takes the user from "knock" to
+// "invite" or "join".
+func appendKnockAccepted(
+	updates []api.OutputEvent, remove, add *gomatrixserverlib.Event,
+	oldMembership, newMembership string,
+) []api.OutputEvent {
+	if oldMembership != knockMembership {
+		return updates
+	}
+	if newMembership != gomatrixserverlib.Invite && newMembership != gomatrixserverlib.Join {
+		return updates
 	}
+	return append(updates, api.OutputEvent{
+		Type: api.OutputTypeKnockAccepted,
+		KnockAccepted: &api.OutputKnockAccepted{
+			RoomID:            add.RoomID(),
+			TargetUserID:      *add.StateKey(),
+			KnockEventID:      remove.EventID(),
+			AcceptedByEventID: add.EventID(),
+			Membership:        newMembership,
+			EffectiveActor:    effectiveActor(add),
+			IdempotencyKey: membershipIdempotencyKey(
+				add.RoomID(), *add.StateKey(),
+				string(api.OutputTypeKnockAccepted)+":"+newMembership, add.EventID(),
+			),
+		},
+	})
+}
+
+// updateMembershipRecovering calls updateMembership, but recovers from any
+// panic that happens while doing so and returns it as an error instead. This
+// stops a single bad event from taking down the entire roomserver. Recovered
+// panics are logged along with the event that caused them and are counted by
+// the dendrite_roomserver_input_panics_total metric.
+func updateMembershipRecovering(
+	updater membershipUpdaterProvider, targetUserNID types.EventStateKeyNID,
+	remove, add *gomatrixserverlib.Event,
+	updates []api.OutputEvent, validation config.MembershipValidation,
+	joinRule, roomType, clientTxnID string,
+) (result []api.OutputEvent, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			inputPanicsTotal.Inc()
+			fields := logrus.Fields{
+				"target_user_nid": targetUserNID,
+				"panic":           r,
+			}
+			if add != nil {
+				fields["room_id"] = add.RoomID()
+				fields["event_id"] = add.EventID()
+			}
+			if remove != nil {
+				fields["removed_event_id"] = remove.EventID()
+			}
+			logrus.WithFields(fields).Errorf(
+				"input: recovered from panic while updating membership\n%s", debug.Stack(),
+			)
+			result, err = nil, fmt.Errorf("input: recovered from panic while updating membership: %v", r)
+		}
+	}()
+	return updateMembership(
+		updater, targetUserNID, remove, add, updates, validation, joinRule, roomType, clientTxnID,
+	)
+}
+
+var inputPanicsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_panics_total",
+		Help:      "The number of panics recovered from while processing membership changes",
+	},
+)
+
+var membershipValidationRejectedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "membership_validation_rejected_total",
+		Help:      "The number of membership events rejected by strict membership validation",
+	},
+)
+
+var selfReferentialMembershipTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "self_referential_membership_total",
+		Help:      "The number of membership changes skipped because the event replaced itself in the state",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(
+		inputPanicsTotal, membershipValidationRejectedTotal, selfReferentialMembershipTotal,
+	)
 }
 
 func updateToInviteMembership(
 	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
-	roomVersion gomatrixserverlib.RoomVersion,
+	roomVersion gomatrixserverlib.RoomVersion, roomType, clientTxnID string,
 ) ([]api.OutputEvent, error) {
 	// We may have already sent the invite to the user, either because we are
 	// reprocessing this event, or because the we received this invite from a
@@ -152,8 +948,16 @@ func updateToInviteMembership(
 		// consider a single stream of events when determining whether a user
 		// is invited, rather than having to combine multiple streams themselves.
 		onie := api.OutputNewInviteEvent{
-			Event:       add.Headered(roomVersion),
-			RoomVersion: roomVersion,
+			Event:          add.Headered(roomVersion),
+			RoomVersion:    roomVersion,
+			ClientTxnID:    clientTxnID,
+			RoomType:       roomType,
+			EffectiveActor: effectiveActor(add),
+			IdempotencyKey: membershipIdempotencyKey(
+				add.RoomID(), *add.StateKey(),
+				string(api.OutputTypeNewInviteEvent), add.EventID(),
+			),
+			MembershipVersion: mu.MembershipVersion(),
 		}
 		updates = append(updates, api.OutputEvent{
 			Type:           api.OutputTypeNewInviteEvent,
@@ -163,8 +967,12 @@ func updateToInviteMembership(
 	return updates, nil
 }
 
+// updateToJoinMembership marks the user as joined. The join rule is the rule
+// that was in effect at the join event, or empty if it isn't known, and is
+// included in the output events for the invites retired by the join.
 func updateToJoinMembership(
 	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
+	joinRule, clientTxnID string,
 ) ([]api.OutputEvent, error) {
 	// If the user is already marked as being joined, we call SetToJoin to update
 	// the event ID then we can return immediately. Retired is ignored as there
@@ -186,10 +994,15 @@ func updateToJoinMembership(
 	}
 	for _, eventID := range retired {
 		orie := api.OutputRetireInviteEvent{
-			EventID:          eventID,
-			Membership:       gomatrixserverlib.Join,
-			RetiredByEventID: add.EventID(),
-			TargetUserID:     *add.StateKey(),
+			EventID:           eventID,
+			Membership:        gomatrixserverlib.Join,
+			RetiredByEventID:  add.EventID(),
+			TargetUserID:      *add.StateKey(),
+			JoinRule:          joinRule,
+			ClientTxnID:       clientTxnID,
+			EffectiveActor:    effectiveActor(add),
+			IdempotencyKey:    retireInviteIdempotencyKey(add, eventID, gomatrixserverlib.Join),
+			MembershipVersion: mu.MembershipVersion(),
 		}
 		updates = append(updates, api.OutputEvent{
 			Type:              api.OutputTypeRetireInviteEvent,
@@ -199,9 +1012,41 @@ func updateToJoinMembership(
 	return updates, nil
 }
 
+// updateToKnockMembership marks the user as knocking on the room and notifies
+// the consumers about the knock.
+func updateToKnockMembership(
+	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
+	clientTxnID string,
+) ([]api.OutputEvent, error) {
+	if err := mu.SetToKnock(add.Sender(), add.EventID()); err != nil {
+		return nil, err
+	}
+	var content struct {
+		Reason string `json:"reason"`
+	}
+	// The reason is optional, so ignore it if the content can't be parsed.
+	_ = json.Unmarshal(add.Content(), &content)
+	return append(updates, api.OutputEvent{
+		Type: api.OutputTypeNewKnockEvent,
+		NewKnockEvent: &api.OutputNewKnockEvent{
+			RoomID:         add.RoomID(),
+			TargetUserID:   *add.StateKey(),
+			EventID:        add.EventID(),
+			Reason:         content.Reason,
+			ClientTxnID:    clientTxnID,
+			EffectiveActor: effectiveActor(add),
+			IdempotencyKey: membershipIdempotencyKey(
+				add.RoomID(), *add.StateKey(),
+				string(api.OutputTypeNewKnockEvent), add.EventID(),
+			),
+			MembershipVersion: mu.MembershipVersion(),
+		},
+	}), nil
+}
+
 func updateToLeaveMembership(
 	mu types.MembershipUpdater, add *gomatrixserverlib.Event,
-	newMembership string, updates []api.OutputEvent,
+	newMembership string, updates []api.OutputEvent, clientTxnID string,
 ) ([]api.OutputEvent, error) {
 	// If the user is already neither joined, nor invited to the room then we
 	// can return immediately.
@@ -218,10 +1063,14 @@ func updateToLeaveMembership(
 	}
 	for _, eventID := range retired {
 		orie := api.OutputRetireInviteEvent{
-			EventID:          eventID,
-			Membership:       newMembership,
-			RetiredByEventID: add.EventID(),
-			TargetUserID:     *add.StateKey(),
+			EventID:           eventID,
+			Membership:        newMembership,
+			RetiredByEventID:  add.EventID(),
+			TargetUserID:      *add.StateKey(),
+			ClientTxnID:       clientTxnID,
+			EffectiveActor:    effectiveActor(add),
+			IdempotencyKey:    retireInviteIdempotencyKey(add, eventID, newMembership),
+			MembershipVersion: mu.MembershipVersion(),
 		}
 		updates = append(updates, api.OutputEvent{
 			Type:              api.OutputTypeRetireInviteEvent,
@@ -231,6 +1080,19 @@ func updateToLeaveMembership(
 	return updates, nil
 }
 
+// retireInviteIdempotencyKey derives the idempotency key for an output event
+// retiring an invite. The retired invite is part of the transition as a
+// single event can retire more than one invite for a user.
+func retireInviteIdempotencyKey(
+	add *gomatrixserverlib.Event, inviteEventID, newMembership string,
+) string {
+	return membershipIdempotencyKey(
+		add.RoomID(), *add.StateKey(),
+		string(api.OutputTypeRetireInviteEvent)+":"+newMembership+":"+inviteEventID,
+		add.EventID(),
+	)
+}
+
 // membershipChanges pairs up the membership state changes.
 func membershipChanges(removed, added []types.StateEntry) []stateChange {
 	changes := pairUpChanges(removed, added)
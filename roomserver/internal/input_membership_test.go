@@ -0,0 +1,919 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMembershipDB implements the parts of storage.Database which are used
+// by updateMemberships, holding the membership events in memory.
+type fakeMembershipDB struct {
+	storage.Database
+	events []types.Event
+	// The number of calls to EventsFromIDs.
+	eventsFromIDsCalls int
+	// The users who have joined the room before, and the number of calls to
+	// UsersJoinedRoomBefore and StateAtEventIDs.
+	joinedBefore               map[string]bool
+	usersJoinedRoomBeforeCalls int
+	stateAtEventIDsCalls       int
+}
+
+func (db *fakeMembershipDB) addEvent(t *testing.T, eventNID types.EventNID, eventJSON string) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		[]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events = append(db.events, types.Event{EventNID: eventNID, Event: event})
+	sort.Slice(db.events, func(i, j int) bool { return db.events[i].EventNID < db.events[j].EventNID })
+}
+
+func (db *fakeMembershipDB) addMembershipEvent(
+	t *testing.T, eventNID types.EventNID, target, sender, membership string,
+) {
+	db.addEvent(t, eventNID, fmt.Sprintf(`{
+		"event_id": "$%d:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.member",
+		"state_key": %q,
+		"sender": %q,
+		"content": {"membership": %q}
+	}`, eventNID, target, sender, membership))
+}
+
+func (db *fakeMembershipDB) Events(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	var result []types.Event
+	for _, event := range db.events {
+		for _, eventNID := range eventNIDs {
+			if event.EventNID == eventNID {
+				result = append(result, event)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *fakeMembershipDB) EventMemberships(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, error) {
+	events, _ := db.Events(ctx, eventNIDs)
+	result := make(map[types.EventNID]string, len(events))
+	for _, event := range events {
+		if membership, err := event.Membership(); err == nil {
+			result[event.EventNID] = membership
+		}
+	}
+	return result, nil
+}
+
+func (db *fakeMembershipDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	db.eventsFromIDsCalls++
+	var result []types.Event
+	for _, event := range db.events {
+		for _, eventID := range eventIDs {
+			if event.EventID() == eventID {
+				result = append(result, event)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *fakeMembershipDB) UsersJoinedRoomBefore(
+	ctx context.Context, roomID string, userIDs []string,
+) (map[string]bool, error) {
+	db.usersJoinedRoomBeforeCalls++
+	result := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if db.joinedBefore[userID] {
+			result[userID] = true
+		}
+	}
+	return result, nil
+}
+
+func (db *fakeMembershipDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	db.stateAtEventIDsCalls++
+	return nil, nil
+}
+
+// fakeMembershipUpdater tracks the membership of a single user in memory.
+type fakeMembershipUpdater struct {
+	types.MembershipUpdater
+	membership string
+	invites    []string
+	version    int64
+}
+
+func (u *fakeMembershipUpdater) IsInvite() bool { return u.membership == gomatrixserverlib.Invite }
+func (u *fakeMembershipUpdater) IsJoin() bool   { return u.membership == gomatrixserverlib.Join }
+func (u *fakeMembershipUpdater) IsLeave() bool  { return u.membership == gomatrixserverlib.Leave }
+
+func (u *fakeMembershipUpdater) MembershipVersion() int64 { return u.version }
+
+func (u *fakeMembershipUpdater) SetToKnock(senderUserID, eventID string) error {
+	if u.membership != knockMembership {
+		u.membership = knockMembership
+		u.version++
+	}
+	return nil
+}
+
+func (u *fakeMembershipUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, error) {
+	u.membership = gomatrixserverlib.Invite
+	u.invites = append(u.invites, event.EventID())
+	u.version++
+	return true, nil
+}
+
+func (u *fakeMembershipUpdater) SetToJoin(senderUserID, eventID string, isUpdate bool) ([]string, error) {
+	u.membership = gomatrixserverlib.Join
+	retired := u.invites
+	u.invites = nil
+	u.version++
+	return retired, nil
+}
+
+func (u *fakeMembershipUpdater) SetToLeave(senderUserID, eventID string) ([]string, error) {
+	u.membership = gomatrixserverlib.Leave
+	retired := u.invites
+	u.invites = nil
+	u.version++
+	return retired, nil
+}
+
+// fakeRoomUpdater hands out fakeMembershipUpdaters for the users in a room.
+type fakeRoomUpdater struct {
+	types.RoomRecentEventsUpdater
+	members map[types.EventStateKeyNID]*fakeMembershipUpdater
+	// The number of calls to JoinedMemberCount.
+	joinedMemberCountCalls int
+}
+
+func (u *fakeRoomUpdater) member(
+	targetUserNID types.EventStateKeyNID, membership string, invites ...string,
+) {
+	if u.members == nil {
+		u.members = make(map[types.EventStateKeyNID]*fakeMembershipUpdater)
+	}
+	u.members[targetUserNID] = &fakeMembershipUpdater{membership: membership, invites: invites}
+}
+
+func (u *fakeRoomUpdater) RoomVersion() gomatrixserverlib.RoomVersion {
+	return gomatrixserverlib.RoomVersionV1
+}
+
+func (u *fakeRoomUpdater) MembershipUpdater(
+	targetUserNID types.EventStateKeyNID,
+) (types.MembershipUpdater, error) {
+	if _, ok := u.members[targetUserNID]; !ok {
+		u.member(targetUserNID, gomatrixserverlib.Leave)
+	}
+	return u.members[targetUserNID], nil
+}
+
+func (u *fakeRoomUpdater) JoinedMemberCount() (int64, error) {
+	u.joinedMemberCountCalls++
+	var count int64
+	for _, member := range u.members {
+		if member.IsJoin() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// memberEntry returns the membership state entry for the user.
+func memberEntry(targetUserNID types.EventStateKeyNID, eventNID types.EventNID) types.StateEntry {
+	return types.StateEntry{
+		StateKeyTuple: types.StateKeyTuple{
+			EventTypeNID:     types.MRoomMemberNID,
+			EventStateKeyNID: targetUserNID,
+		},
+		EventNID: eventNID,
+	}
+}
+
+// outputEventTypes returns the sorted types of the output events.
+func outputEventTypes(updates []api.OutputEvent) []string {
+	var result []string
+	for _, update := range updates {
+		result = append(result, string(update.Type))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func retireUpdate(eventID string) api.OutputEvent {
+	return api.OutputEvent{
+		Type: api.OutputTypeRetireInviteEvent,
+		RetireInviteEvent: &api.OutputRetireInviteEvent{
+			EventID:    eventID,
+			Membership: "leave",
+		},
+	}
+}
+
+func TestCoalesceRetireInviteEvents(t *testing.T) {
+	invite := api.OutputEvent{Type: api.OutputTypeNewInviteEvent}
+	updates := []api.OutputEvent{
+		invite,
+		retireUpdate("$a"),
+		retireUpdate("$b"),
+		invite,
+		retireUpdate("$c"),
+	}
+
+	result := coalesceRetireInviteEvents(updates)
+	if len(result) != 3 {
+		t.Fatalf("want 3 updates, got %d", len(result))
+	}
+	if result[0].Type != api.OutputTypeNewInviteEvent || result[2].Type != api.OutputTypeNewInviteEvent {
+		t.Errorf("non-retire updates were reordered: %v", result)
+	}
+	batch := result[1]
+	if batch.Type != api.OutputTypeRetireInviteBatchEvent {
+		t.Fatalf("want batch event at index 1, got %q", batch.Type)
+	}
+	var got []string
+	for _, retired := range batch.RetireInviteBatchEvent.RetiredInvites {
+		got = append(got, retired.EventID)
+	}
+	want := []string{"$a", "$b", "$c"}
+	if len(got) != len(want) {
+		t.Fatalf("want retired invites %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want retired invites %v, got %v", want, got)
+		}
+	}
+}
+
+func TestCoalesceRetireInviteEventsNoRetires(t *testing.T) {
+	updates := []api.OutputEvent{{Type: api.OutputTypeNewInviteEvent}}
+	result := coalesceRetireInviteEvents(updates)
+	if len(result) != 1 || result[0].Type != api.OutputTypeNewInviteEvent {
+		t.Errorf("updates without retire events should be unchanged, got %v", result)
+	}
+}
+
+func TestMembershipIdempotencyKey(t *testing.T) {
+	key := membershipIdempotencyKey("!r:a", "@u:a", "new_invite_event", "$e")
+	if again := membershipIdempotencyKey("!r:a", "@u:a", "new_invite_event", "$e"); again != key {
+		t.Fatalf("expected the same key for the same transition, got %q and %q", key, again)
+	}
+	if other := membershipIdempotencyKey("!r:a", "@u:a", "new_invite_event", "$f"); other == key {
+		t.Fatalf("expected a different key for a different event")
+	}
+	if other := membershipIdempotencyKey("!r:a", "@u:a", "new_invite_even", "t$e"); other == key {
+		t.Fatalf("expected the parts to be separated")
+	}
+}
+
+func TestUpdateMembershipSkipsSelfReferentialEvent(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$leave:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.member",
+		"state_key": "@alice:localhost",
+		"sender": "@bob:localhost",
+		"content": {"membership": "leave"}
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := []api.OutputEvent{retireUpdate("$other:localhost")}
+	// The updater is nil as the self-referential event must be skipped before
+	// the membership is looked up.
+	got, err := updateMembership(
+		nil, 1, &event, &event, updates, config.MembershipValidationLenient, "", "", "",
+	)
+	if err != nil {
+		t.Fatalf("updateMembership returned error: %s", err)
+	}
+	if len(got) != len(updates) {
+		t.Fatalf("expected %d updates, got %d", len(updates), len(got))
+	}
+}
+
+func TestMembershipUnchanged(t *testing.T) {
+	memberships := map[types.EventNID]string{
+		1: gomatrixserverlib.Leave,
+		2: gomatrixserverlib.Leave,
+		3: gomatrixserverlib.Join,
+		4: gomatrixserverlib.Join,
+		5: gomatrixserverlib.Ban,
+	}
+	tests := []struct {
+		removed, added types.EventNID
+		want           bool
+	}{
+		{1, 2, true},  // leave replaced by leave
+		{0, 1, true},  // no previous membership is a leave
+		{3, 4, false}, // joins may be profile changes
+		{1, 5, false}, // leave to ban
+		{1, 6, false}, // unknown membership
+		{6, 1, false}, // unknown previous membership
+		{1, 1, false}, // self-referential
+		{1, 0, false}, // nothing added
+	}
+	for _, test := range tests {
+		change := stateChange{removedEventNID: test.removed, addedEventNID: test.added}
+		if got := membershipUnchanged(change, memberships); got != test.want {
+			t.Errorf("%d -> %d: wanted %v, got %v", test.removed, test.added, test.want, got)
+		}
+	}
+}
+
+func TestUpdateMembershipsAnnounceOnly(t *testing.T) {
+	const alice, bob, carol types.EventStateKeyNID = 1, 2, 3
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@alice:localhost", "@alice:localhost", "leave")
+	db.addMembershipEvent(t, 3, "@bob:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 4, "@carol:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 5, "@carol:localhost", "@carol:localhost", "join")
+	// Alice leaves, Bob is invited and Carol accepts her invite.
+	removed := []types.StateEntry{memberEntry(alice, 1), memberEntry(carol, 4)}
+	added := []types.StateEntry{memberEntry(alice, 2), memberEntry(bob, 3), memberEntry(carol, 5)}
+
+	tests := []struct {
+		announceOnly bool
+		want         []string
+	}{
+		{false, []string{
+			string(api.OutputTypeNewInviteEvent),
+			string(api.OutputTypeNewJoinEvent),
+			string(api.OutputTypeNewLeaveEvent),
+			string(api.OutputTypeRetireInviteEvent),
+		}},
+		{true, []string{
+			string(api.OutputTypeNewInviteEvent),
+			string(api.OutputTypeRetireInviteEvent),
+		}},
+	}
+	for _, test := range tests {
+		updater := &fakeRoomUpdater{}
+		updater.member(alice, gomatrixserverlib.Join)
+		updater.member(carol, gomatrixserverlib.Invite, "$4:localhost")
+		updates, err := updateMemberships(
+			context.Background(), nil, db, updater, removed, added,
+			api.MembershipChangeCauseEvent, test.announceOnly, nil, "", nil,
+		)
+		if err != nil {
+			t.Fatalf("updateMemberships returned error: %s", err)
+		}
+		got := outputEventTypes(updates)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("announce-only %v: want output events %v, got %v", test.announceOnly, test.want, got)
+		}
+		// The memberships are still tracked for announce-only rooms.
+		if !updater.members[alice].IsLeave() || !updater.members[bob].IsInvite() || !updater.members[carol].IsJoin() {
+			t.Errorf("announce-only %v: memberships weren't updated", test.announceOnly)
+		}
+	}
+}
+
+// outputEventCause returns the cause of the membership output event.
+func outputEventCause(update api.OutputEvent) api.MembershipChangeCause {
+	switch update.Type {
+	case api.OutputTypeNewInviteEvent:
+		return update.NewInviteEvent.Cause
+	case api.OutputTypeRetireInviteEvent:
+		return update.RetireInviteEvent.Cause
+	case api.OutputTypeKnockAccepted:
+		return update.KnockAccepted.Cause
+	case api.OutputTypeNewKnockEvent:
+		return update.NewKnockEvent.Cause
+	case api.OutputTypeNewJoinEvent:
+		return update.NewJoinEvent.Cause
+	case api.OutputTypeNewLeaveEvent:
+		return update.NewLeaveEvent.Cause
+	}
+	return api.MembershipChangeCauseEvent
+}
+
+func TestUpdateMembershipsCause(t *testing.T) {
+	const alice, bob, carol types.EventStateKeyNID = 1, 2, 3
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@alice:localhost", "@alice:localhost", "leave")
+	db.addMembershipEvent(t, 3, "@bob:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 4, "@carol:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 5, "@carol:localhost", "@carol:localhost", "join")
+	removed := []types.StateEntry{memberEntry(alice, 1), memberEntry(carol, 4)}
+	added := []types.StateEntry{memberEntry(alice, 2), memberEntry(bob, 3), memberEntry(carol, 5)}
+
+	updater := &fakeRoomUpdater{}
+	updater.member(alice, gomatrixserverlib.Join)
+	updater.member(carol, gomatrixserverlib.Invite, "$4:localhost")
+	updates, err := updateMemberships(
+		context.Background(), nil, db, updater, removed, added,
+		api.MembershipChangeCauseStateResolution, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if len(updates) != 4 {
+		t.Fatalf("want 4 output events, got %v", outputEventTypes(updates))
+	}
+	for _, update := range updates {
+		if cause := outputEventCause(update); cause != api.MembershipChangeCauseStateResolution {
+			t.Errorf("%s: want cause %q, got %q", update.Type, api.MembershipChangeCauseStateResolution, cause)
+		}
+		// Nobody sent the events which made these changes.
+		var actor string
+		switch update.Type {
+		case api.OutputTypeNewInviteEvent:
+			actor = update.NewInviteEvent.EffectiveActor
+		case api.OutputTypeRetireInviteEvent:
+			actor = update.RetireInviteEvent.EffectiveActor
+		default:
+			continue
+		}
+		if actor != api.EffectiveActorSystem {
+			t.Errorf("%s: want effective actor %q, got %q", update.Type, api.EffectiveActorSystem, actor)
+		}
+	}
+}
+
+// outputEventPrevContent returns the previous membership content of the
+// membership output event.
+func outputEventPrevContent(update api.OutputEvent) string {
+	switch update.Type {
+	case api.OutputTypeNewInviteEvent:
+		return string(update.NewInviteEvent.PrevContent)
+	case api.OutputTypeRetireInviteEvent:
+		return string(update.RetireInviteEvent.PrevContent)
+	case api.OutputTypeKnockAccepted:
+		return string(update.KnockAccepted.PrevContent)
+	case api.OutputTypeNewKnockEvent:
+		return string(update.NewKnockEvent.PrevContent)
+	case api.OutputTypeNewJoinEvent:
+		return string(update.NewJoinEvent.PrevContent)
+	case api.OutputTypeNewLeaveEvent:
+		return string(update.NewLeaveEvent.PrevContent)
+	}
+	return ""
+}
+
+func TestUpdateMembershipsPrevContent(t *testing.T) {
+	const alice, carol types.EventStateKeyNID = 1, 3
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@alice:localhost", "@alice:localhost", "leave")
+	db.addMembershipEvent(t, 4, "@carol:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 5, "@carol:localhost", "@carol:localhost", "join")
+	// Alice leaves and Carol accepts her invite.
+	removed := []types.StateEntry{memberEntry(alice, 1), memberEntry(carol, 4)}
+	added := []types.StateEntry{memberEntry(alice, 2), memberEntry(carol, 5)}
+
+	cfg := &config.Dendrite{}
+	cfg.RoomServer.MembershipPrevContent = true
+	updater := &fakeRoomUpdater{}
+	updater.member(alice, gomatrixserverlib.Join)
+	updater.member(carol, gomatrixserverlib.Invite, "$4:localhost")
+	updates, err := updateMemberships(
+		context.Background(), cfg, db, updater, removed, added,
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	want := map[api.OutputType]string{
+		api.OutputTypeNewLeaveEvent:     `{"membership": "join"}`,
+		api.OutputTypeNewJoinEvent:      `{"membership": "invite"}`,
+		api.OutputTypeRetireInviteEvent: `{"membership": "invite"}`,
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("want %d output events, got %v", len(want), outputEventTypes(updates))
+	}
+	for _, update := range updates {
+		if got := outputEventPrevContent(update); got != want[update.Type] {
+			t.Errorf("%s: want prev content %s, got %s", update.Type, want[update.Type], got)
+		}
+	}
+}
+
+func TestUpdateMembershipsLoadsAuthEventsOnce(t *testing.T) {
+	const alice, bob, carol, dan types.EventStateKeyNID = 1, 2, 3, 4
+	db := &fakeMembershipDB{}
+	db.addEvent(t, 10, `{
+		"event_id": "$create:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.create",
+		"state_key": "",
+		"sender": "@alice:localhost",
+		"content": {"creator": "@alice:localhost", "type": "m.space"}
+	}`)
+	db.addEvent(t, 11, `{
+		"event_id": "$joinrules:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.join_rules",
+		"state_key": "",
+		"sender": "@alice:localhost",
+		"content": {"join_rule": "public"}
+	}`)
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 3, "@dan:localhost", "@dan:localhost", "join")
+	db.addMembershipEvent(t, 4, "@dan:localhost", "@dan:localhost", "leave")
+	db.addMembershipEvent(t, 6, "@carol:localhost", "@alice:localhost", "invite")
+	for nid, event := range map[types.EventNID]string{
+		5: `"state_key": "@bob:localhost", "sender": "@alice:localhost", "content": {"membership": "invite"}`,
+		7: `"state_key": "@carol:localhost", "sender": "@carol:localhost", "content": {"membership": "join"}`,
+	} {
+		db.addEvent(t, nid, fmt.Sprintf(`{
+			"event_id": "$%d:localhost",
+			"room_id": "!room:localhost",
+			"type": "m.room.member",
+			"auth_events": [["$create:localhost", {}], ["$joinrules:localhost", {}]],
+			%s
+		}`, nid, event))
+	}
+
+	// Alice changes her profile and Dan leaves, which don't need the auth
+	// events, so they aren't loaded.
+	updater := &fakeRoomUpdater{}
+	updater.member(alice, gomatrixserverlib.Join)
+	updater.member(dan, gomatrixserverlib.Join)
+	_, err := updateMemberships(
+		context.Background(), nil, db, updater,
+		[]types.StateEntry{memberEntry(alice, 1), memberEntry(dan, 3)},
+		[]types.StateEntry{memberEntry(alice, 2), memberEntry(dan, 4)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if db.eventsFromIDsCalls != 0 {
+		t.Errorf("want no auth event reads, got %d", db.eventsFromIDsCalls)
+	}
+
+	// Bob is invited and Carol accepts her invite, which both need the auth
+	// events, so they are loaded once for the batch.
+	updater.member(carol, gomatrixserverlib.Invite, "$6:localhost")
+	updates, err := updateMemberships(
+		context.Background(), nil, db, updater,
+		[]types.StateEntry{memberEntry(carol, 6)},
+		[]types.StateEntry{memberEntry(bob, 5), memberEntry(carol, 7)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if db.eventsFromIDsCalls != 1 {
+		t.Errorf("want 1 auth event read, got %d", db.eventsFromIDsCalls)
+	}
+	for _, update := range updates {
+		switch update.Type {
+		case api.OutputTypeNewInviteEvent:
+			if got := update.NewInviteEvent.RoomType; got != "m.space" {
+				t.Errorf("want room type %q, got %q", "m.space", got)
+			}
+		case api.OutputTypeRetireInviteEvent:
+			if got := update.RetireInviteEvent.JoinRule; got != "public" {
+				t.Errorf("want join rule %q, got %q", "public", got)
+			}
+		}
+	}
+	if len(updates) != 3 {
+		t.Errorf("want 3 output events, got %v", outputEventTypes(updates))
+	}
+}
+
+func TestUpdateMembershipsLoadsJoinsOnce(t *testing.T) {
+	const alice, bob, carol types.EventStateKeyNID = 1, 2, 3
+	db := &fakeMembershipDB{joinedBefore: map[string]bool{"@bob:localhost": true}}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@bob:localhost", "@bob:localhost", "join")
+	db.addMembershipEvent(t, 3, "@carol:localhost", "@carol:localhost", "join")
+
+	// All three users join in one batch, so whether they are rejoins and
+	// whether the room was encrypted are each looked up once.
+	updates, err := updateMemberships(
+		context.Background(), nil, db, &fakeRoomUpdater{}, nil,
+		[]types.StateEntry{memberEntry(alice, 1), memberEntry(bob, 2), memberEntry(carol, 3)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if db.usersJoinedRoomBeforeCalls != 1 {
+		t.Errorf("want 1 rejoin lookup, got %d", db.usersJoinedRoomBeforeCalls)
+	}
+	if db.stateAtEventIDsCalls != 1 {
+		t.Errorf("want 1 state lookup, got %d", db.stateAtEventIDsCalls)
+	}
+	rejoins := map[string]bool{}
+	for _, update := range updates {
+		if update.Type == api.OutputTypeNewJoinEvent {
+			rejoins[update.NewJoinEvent.TargetUserID] = update.NewJoinEvent.Rejoin
+		}
+	}
+	want := map[string]bool{"@alice:localhost": false, "@bob:localhost": true, "@carol:localhost": false}
+	if len(rejoins) != len(want) {
+		t.Fatalf("want join events for %v, got %v", want, rejoins)
+	}
+	for userID, rejoin := range want {
+		if rejoins[userID] != rejoin {
+			t.Errorf("want rejoin %t for %s, got %t", rejoin, userID, rejoins[userID])
+		}
+	}
+}
+
+func TestUpdateMembershipsCountsJoinedMembersOnce(t *testing.T) {
+	const alice, bob, carol, dan types.EventStateKeyNID = 1, 2, 3, 4
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@alice:localhost", "@alice:localhost", "leave")
+	db.addMembershipEvent(t, 3, "@bob:localhost", "@bob:localhost", "join")
+	db.addMembershipEvent(t, 4, "@carol:localhost", "@carol:localhost", "join")
+	db.addMembershipEvent(t, 5, "@dan:localhost", "@dan:localhost", "join")
+
+	// Alice leaves and Bob and Carol join, while Dan stays joined.
+	updater := &fakeRoomUpdater{}
+	updater.member(alice, gomatrixserverlib.Join)
+	updater.member(dan, gomatrixserverlib.Join)
+	updates, err := updateMemberships(
+		context.Background(), nil, db, updater,
+		[]types.StateEntry{memberEntry(alice, 1)},
+		[]types.StateEntry{memberEntry(alice, 2), memberEntry(bob, 3), memberEntry(carol, 4)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if updater.joinedMemberCountCalls != 1 {
+		t.Errorf("want 1 joined member count, got %d", updater.joinedMemberCountCalls)
+	}
+	var counted int
+	for _, update := range updates {
+		var count int64
+		switch update.Type {
+		case api.OutputTypeNewJoinEvent:
+			count = update.NewJoinEvent.JoinedMemberCount
+		case api.OutputTypeNewLeaveEvent:
+			count = update.NewLeaveEvent.JoinedMemberCount
+		default:
+			continue
+		}
+		counted++
+		if count != 3 {
+			t.Errorf("%s: want joined member count 3, got %d", update.Type, count)
+		}
+	}
+	if counted != 3 {
+		t.Errorf("want 3 join and leave events, got %v", outputEventTypes(updates))
+	}
+}
+
+func TestUpdateMembershipsKnock(t *testing.T) {
+	const bob types.EventStateKeyNID = 2
+	db := &fakeMembershipDB{}
+	db.addEvent(t, 1, `{
+		"event_id": "$1:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.member",
+		"state_key": "@bob:localhost",
+		"sender": "@bob:localhost",
+		"content": {"membership": "knock", "reason": "Let me in"}
+	}`)
+
+	updater := &fakeRoomUpdater{}
+	updates, err := updateMemberships(
+		context.Background(), nil, db, updater,
+		nil, []types.StateEntry{memberEntry(bob, 1)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err != nil {
+		t.Fatalf("updateMemberships returned error: %s", err)
+	}
+	if len(updates) != 1 || updates[0].Type != api.OutputTypeNewKnockEvent {
+		t.Fatalf("want a knock event, got %v", outputEventTypes(updates))
+	}
+	knock := updates[0].NewKnockEvent
+	if knock.RoomID != "!room:localhost" || knock.TargetUserID != "@bob:localhost" || knock.EventID != "$1:localhost" {
+		t.Errorf("knock event is for the wrong membership: %+v", knock)
+	}
+	if knock.Reason != "Let me in" {
+		t.Errorf("want reason %q, got %q", "Let me in", knock.Reason)
+	}
+	if knock.EffectiveActor != "@bob:localhost" {
+		t.Errorf("want effective actor %q, got %q", "@bob:localhost", knock.EffectiveActor)
+	}
+	if knock.MembershipVersion != 1 {
+		t.Errorf("want membership version 1, got %d", knock.MembershipVersion)
+	}
+	wantKey := membershipIdempotencyKey(
+		"!room:localhost", "@bob:localhost", string(api.OutputTypeNewKnockEvent), "$1:localhost",
+	)
+	if knock.IdempotencyKey != wantKey {
+		t.Errorf("want idempotency key %q, got %q", wantKey, knock.IdempotencyKey)
+	}
+	// Knocking doesn't count as leaving, joining or being invited.
+	if member := updater.members[bob]; member.IsLeave() || member.IsJoin() || member.IsInvite() {
+		t.Errorf("want bob to be knocking, got %q", member.membership)
+	}
+}
+
+// panickingRoomUpdater hands out membership updaters which panic when the
+// membership is changed to join.
+type panickingRoomUpdater struct {
+	fakeRoomUpdater
+}
+
+type panickingMembershipUpdater struct {
+	fakeMembershipUpdater
+}
+
+func (u *panickingRoomUpdater) MembershipUpdater(
+	targetUserNID types.EventStateKeyNID,
+) (types.MembershipUpdater, error) {
+	return &panickingMembershipUpdater{fakeMembershipUpdater{membership: gomatrixserverlib.Leave}}, nil
+}
+
+func (u *panickingMembershipUpdater) SetToJoin(senderUserID, eventID string, isUpdate bool) ([]string, error) {
+	panic("boom")
+}
+
+func TestUpdateMembershipsRecoversFromPanics(t *testing.T) {
+	const alice, bob types.EventStateKeyNID = 1, 2
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@alice:localhost", "@alice:localhost", "join")
+	db.addMembershipEvent(t, 2, "@bob:localhost", "@bob:localhost", "wave")
+
+	// The panic is returned as an error, with no output events, and counted.
+	before := testutil.ToFloat64(inputPanicsTotal)
+	updates, err := updateMemberships(
+		context.Background(), nil, db, &panickingRoomUpdater{}, nil,
+		[]types.StateEntry{memberEntry(alice, 1)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err == nil || len(updates) != 0 {
+		t.Errorf("want an error and no output events, got %v (%v)", outputEventTypes(updates), err)
+	}
+	if got := testutil.ToFloat64(inputPanicsTotal); got != before+1 {
+		t.Errorf("want %v recovered panics, got %v", before+1, got)
+	}
+
+	// A membership which isn't allowed is an error rather than a panic.
+	updates, err = updateMemberships(
+		context.Background(), nil, db, &fakeRoomUpdater{}, nil,
+		[]types.StateEntry{memberEntry(bob, 2)},
+		api.MembershipChangeCauseEvent, false, nil, "", nil,
+	)
+	if err == nil || len(updates) != 0 {
+		t.Errorf("want an error and no output events, got %v (%v)", outputEventTypes(updates), err)
+	}
+	if got := testutil.ToFloat64(inputPanicsTotal); got != before+1 {
+		t.Errorf("want %v recovered panics, got %v", before+1, got)
+	}
+}
+
+func TestUpdateMembershipsValidation(t *testing.T) {
+	const bob, carol types.EventStateKeyNID = 2, 3
+	db := &fakeMembershipDB{}
+	db.addEvent(t, 1, `{
+		"event_id": "$1:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.member",
+		"state_key": "@bob:localhost",
+		"sender": "@alice:localhost",
+		"content": {"membership": "invite", "reason": "Welcome", "is_direct": true, "displayname": "Bob"}
+	}`)
+	db.addEvent(t, 2, `{
+		"event_id": "$2:localhost",
+		"room_id": "!room:localhost",
+		"type": "m.room.member",
+		"state_key": "@carol:localhost",
+		"sender": "@alice:localhost",
+		"content": {"membership": "invite", "org.example.custom": 1}
+	}`)
+
+	tests := []struct {
+		validation config.MembershipValidation
+		target     types.EventStateKeyNID
+		eventNID   types.EventNID
+		wantErr    bool
+	}{
+		{config.MembershipValidationLenient, carol, 2, false},
+		{config.MembershipValidationStrict, bob, 1, false},
+		{config.MembershipValidationStrict, carol, 2, true},
+	}
+	for _, test := range tests {
+		cfg := &config.Dendrite{}
+		cfg.RoomServer.MembershipValidation = test.validation
+		updater := &fakeRoomUpdater{}
+		updates, err := updateMemberships(
+			context.Background(), cfg, db, updater, nil,
+			[]types.StateEntry{memberEntry(test.target, test.eventNID)},
+			api.MembershipChangeCauseEvent, false, nil, "", nil,
+		)
+		if test.wantErr {
+			if err == nil || len(updates) != 0 {
+				t.Errorf("%s: want event %d to be rejected, got %v (%v)", test.validation, test.eventNID, outputEventTypes(updates), err)
+			}
+			if member, ok := updater.members[test.target]; ok && member.IsInvite() {
+				t.Errorf("%s: want the rejected invite not to be stored", test.validation)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: updateMemberships returned error: %s", test.validation, err)
+		}
+		if len(updates) != 1 || updates[0].Type != api.OutputTypeNewInviteEvent {
+			t.Errorf("%s: want an invite event for event %d, got %v", test.validation, test.eventNID, outputEventTypes(updates))
+		}
+	}
+}
+
+func TestUpdateMembershipsKnockAccepted(t *testing.T) {
+	const bob types.EventStateKeyNID = 2
+	db := &fakeMembershipDB{}
+	db.addMembershipEvent(t, 1, "@bob:localhost", "@bob:localhost", "knock")
+	db.addMembershipEvent(t, 2, "@bob:localhost", "@alice:localhost", "invite")
+	db.addMembershipEvent(t, 3, "@bob:localhost", "@bob:localhost", "join")
+	db.addMembershipEvent(t, 4, "@bob:localhost", "@alice:localhost", "leave")
+
+	for _, test := range []struct {
+		name           string
+		addedEventNID  types.EventNID
+		wantAccepted   bool
+		wantMembership string
+		wantActor      string
+	}{
+		{"invite", 2, true, gomatrixserverlib.Invite, "@alice:localhost"},
+		{"join", 3, true, gomatrixserverlib.Join, "@bob:localhost"},
+		{"rejected", 4, false, "", ""},
+	} {
+		updater := &fakeRoomUpdater{}
+		updater.member(bob, knockMembership)
+		updates, err := updateMemberships(
+			context.Background(), nil, db, updater,
+			[]types.StateEntry{memberEntry(bob, 1)},
+			[]types.StateEntry{memberEntry(bob, test.addedEventNID)},
+			api.MembershipChangeCauseEvent, false, nil, "", nil,
+		)
+		if err != nil {
+			t.Fatalf("%s: updateMemberships returned error: %s", test.name, err)
+		}
+		var accepted []*api.OutputKnockAccepted
+		for _, update := range updates {
+			if update.Type == api.OutputTypeKnockAccepted {
+				accepted = append(accepted, update.KnockAccepted)
+			}
+		}
+		if !test.wantAccepted {
+			if len(accepted) != 0 {
+				t.Errorf("%s: want no knock accepted event, got %+v", test.name, accepted[0])
+			}
+			continue
+		}
+		if len(accepted) != 1 {
+			t.Fatalf("%s: want one knock accepted event, got %v", test.name, outputEventTypes(updates))
+		}
+		got := accepted[0]
+		if got.RoomID != "!room:localhost" || got.TargetUserID != "@bob:localhost" {
+			t.Errorf("%s: knock accepted event is for the wrong membership: %+v", test.name, got)
+		}
+		wantAcceptedBy := fmt.Sprintf("$%d:localhost", test.addedEventNID)
+		if got.KnockEventID != "$1:localhost" || got.AcceptedByEventID != wantAcceptedBy {
+			t.Errorf("%s: want knock $1:localhost accepted by %s, got %+v", test.name, wantAcceptedBy, got)
+		}
+		if got.Membership != test.wantMembership || got.EffectiveActor != test.wantActor {
+			t.Errorf("%s: want membership %q by %q, got %q by %q",
+				test.name, test.wantMembership, test.wantActor, got.Membership, got.EffectiveActor)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// processRedaction tells the other components to redact the event that an
+// accepted m.room.redaction event points at, if the redaction is valid for
+// the room version.
+// TODO: Redactions that arrive before the event they redact are dropped.
+func processRedaction(
+	ctx context.Context,
+	db storage.Database,
+	ow OutputRoomEventWriter,
+	redaction gomatrixserverlib.HeaderedEvent,
+	eventNID types.EventNID,
+	authEventNIDs []types.EventNID,
+) error {
+	event := redaction.Unwrap()
+	logger := logrus.WithField("event_id", event.EventID()).WithField("redacts", event.Redacts())
+
+	// Soft-failed redactions aren't applied.
+	rejected, err := db.EventRejected(ctx, eventNID)
+	if err != nil || rejected {
+		return err
+	}
+
+	redactedEvents, err := db.EventsFromIDs(ctx, []string{event.Redacts()})
+	if err != nil {
+		return err
+	}
+	if len(redactedEvents) == 0 {
+		logger.Warn("Ignoring redaction of unknown event")
+		return nil
+	}
+
+	authEvents, err := db.Events(ctx, authEventNIDs)
+	if err != nil {
+		return err
+	}
+	authEventPtrs := make([]*gomatrixserverlib.Event, len(authEvents))
+	for i := range authEvents {
+		authEventPtrs[i] = &authEvents[i].Event
+	}
+	provider := gomatrixserverlib.NewAuthEvents(authEventPtrs)
+
+	allowed, err := redactionAllowed(redaction.RoomVersion, event, redactedEvents[0].Event, &provider)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		logger.Warn("Ignoring redaction which isn't allowed by the room version")
+		return nil
+	}
+
+	return ow.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+		{
+			Type: api.OutputTypeRedactedEvent,
+			RedactedEvent: &api.OutputRedactedEvent{
+				RedactedEventID: event.Redacts(),
+				RedactedBecause: redaction,
+			},
+		},
+	})
+}
+
+// redactionAllowed returns whether the redaction should be applied to the
+// redacted event. In room versions 1 and 2 the auth rules already check that
+// the redaction came from the server of the redacted event, or from a user
+// with enough power. In later room versions event IDs don't contain a domain,
+// so that check has to be made now that we know the redacted event.
+func redactionAllowed(
+	roomVersion gomatrixserverlib.RoomVersion,
+	redaction, redacted gomatrixserverlib.Event,
+	authEvents gomatrixserverlib.AuthEventProvider,
+) (bool, error) {
+	if redaction.RoomID() != redacted.RoomID() {
+		return false, nil
+	}
+	eventIDFormat, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return false, err
+	}
+	if eventIDFormat == gomatrixserverlib.EventIDFormatV1 {
+		return true, nil
+	}
+
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', redaction.Sender())
+	if err != nil {
+		return false, err
+	}
+	_, redactedDomain, err := gomatrixserverlib.SplitID('@', redacted.Sender())
+	if err != nil {
+		return false, err
+	}
+	if senderDomain == redactedDomain {
+		return true, nil
+	}
+
+	var creatorUserID string
+	create, err := authEvents.Create()
+	if err != nil {
+		return false, err
+	}
+	if create != nil {
+		creatorUserID = create.Sender()
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(authEvents, creatorUserID)
+	if err != nil {
+		return false, err
+	}
+	return powerLevels.UserLevel(redaction.Sender()) >= powerLevels.Redact, nil
+}
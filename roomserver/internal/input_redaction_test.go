@@ -0,0 +1,75 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustRedactionTestEvent(
+	t *testing.T, roomVersion gomatrixserverlib.RoomVersion,
+	eventType, roomID, sender string, stateKey *string, content string,
+) gomatrixserverlib.Event {
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"type":%q,"room_id":%q,"sender":%q,%s"content":%s,"event_id":"$e:a",`+
+			`"prev_events":[],"auth_events":[],"depth":1,"origin_server_ts":0,`+
+			`"hashes":{"sha256":"x"},"signatures":{}}`,
+		eventType, roomID, sender, stateKeyJSON, content,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, roomVersion)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON: %s", err)
+	}
+	return event
+}
+
+func TestRedactionAllowed(t *testing.T) {
+	emptyStateKey := ""
+	for _, tc := range []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		roomID      string
+		sender      string
+		want        bool
+	}{
+		{"same server", gomatrixserverlib.RoomVersionV5, "!r:a", "@other:a", true},
+		{"other server with power", gomatrixserverlib.RoomVersionV5, "!r:a", "@mod:b", true},
+		{"other server without power", gomatrixserverlib.RoomVersionV5, "!r:a", "@user:b", false},
+		{"different room", gomatrixserverlib.RoomVersionV5, "!other:a", "@other:a", false},
+		{"checked by auth rules", gomatrixserverlib.RoomVersionV1, "!r:a", "@user:b", true},
+	} {
+		redacted := mustRedactionTestEvent(t, tc.roomVersion, "m.room.message", "!r:a", "@u:a", nil, `{}`)
+		redaction := mustRedactionTestEvent(t, tc.roomVersion, gomatrixserverlib.MRoomRedaction, tc.roomID, tc.sender, nil, `{}`)
+		powerLevels := mustRedactionTestEvent(
+			t, tc.roomVersion, gomatrixserverlib.MRoomPowerLevels, "!r:a", "@u:a", &emptyStateKey,
+			`{"users":{"@u:a":100,"@mod:b":50},"redact":50}`,
+		)
+		authEvents := gomatrixserverlib.NewAuthEvents([]*gomatrixserverlib.Event{&powerLevels})
+		got, err := redactionAllowed(tc.roomVersion, redaction, redacted, &authEvents)
+		if err != nil {
+			t.Fatalf("%s: redactionAllowed: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
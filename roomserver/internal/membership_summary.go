@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// membershipDailySummaryDateFormat is the format of the date in an
+// OutputMembershipDailySummary.
+const membershipDailySummaryDateFormat = "2006-01-02"
+
+// StartMembershipDailySummaries starts writing an OutputMembershipDailySummary
+// for each room in which memberships changed, shortly after midnight UTC each
+// day. A day is not summarised if the roomserver isn't running at the end of
+// it.
+func (r *RoomserverInternalAPI) StartMembershipDailySummaries() {
+	go func() {
+		for {
+			now := time.Now().UTC()
+			end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+			time.Sleep(time.Until(end))
+			start := end.AddDate(0, 0, -1)
+			if err := r.writeMembershipDailySummaries(context.Background(), start, end); err != nil {
+				logrus.WithError(err).WithField("date", start.Format(membershipDailySummaryDateFormat)).Error(
+					"Failed to write membership daily summaries",
+				)
+			}
+		}
+	}()
+}
+
+// A membershipSummaryLeave is a change to "leave" that may have been a ban. We
+// can only tell once we've looked at the event, as the audit log doesn't
+// distinguish between them.
+type membershipSummaryLeave struct {
+	eventID  string
+	fromJoin bool
+}
+
+// writeMembershipDailySummaries summarises the membership changes in the audit
+// log at or after start and before end, and writes a summary for each room.
+func (r *RoomserverInternalAPI) writeMembershipDailySummaries(
+	ctx context.Context, start, end time.Time,
+) error {
+	date := start.Format(membershipDailySummaryDateFormat)
+	var roomIDs []string
+	summaries := map[string]*api.OutputMembershipDailySummary{}
+	leaves := map[string][]membershipSummaryLeave{}
+	err := r.DB.MembershipAuditBetween(ctx, start, end, func(entry types.MembershipAuditEntry) error {
+		summary, ok := summaries[entry.RoomID]
+		if !ok {
+			summary = &api.OutputMembershipDailySummary{
+				RoomID: entry.RoomID,
+				Date:   date,
+			}
+			summaries[entry.RoomID] = summary
+			roomIDs = append(roomIDs, entry.RoomID)
+		}
+		switch entry.NewMembership {
+		case gomatrixserverlib.Join:
+			summary.Joins++
+		case gomatrixserverlib.Invite:
+			summary.Invites++
+		case gomatrixserverlib.Leave:
+			fromJoin := entry.OldMembership == gomatrixserverlib.Join
+			if entry.SenderUserID == entry.TargetUserID {
+				// Users can't ban themselves.
+				if fromJoin {
+					summary.Leaves++
+				}
+				break
+			}
+			leaves[entry.RoomID] = append(leaves[entry.RoomID], membershipSummaryLeave{
+				eventID:  entry.EventID,
+				fromJoin: fromJoin,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, roomID := range roomIDs {
+		summary := summaries[roomID]
+		if err = r.countMembershipSummaryLeaves(ctx, summary, leaves[roomID]); err != nil {
+			return err
+		}
+		if err = r.WriteOutputEvents(roomID, []api.OutputEvent{
+			{
+				Type:                   api.OutputTypeMembershipDailySummary,
+				MembershipDailySummary: summary,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countMembershipSummaryLeaves adds the leaves sent by other users, i.e. kicks
+// and bans, to the summary.
+func (r *RoomserverInternalAPI) countMembershipSummaryLeaves(
+	ctx context.Context, summary *api.OutputMembershipDailySummary,
+	leaves []membershipSummaryLeave,
+) error {
+	if len(leaves) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, len(leaves))
+	for i := range leaves {
+		eventIDs[i] = leaves[i].eventID
+	}
+	events, err := r.DB.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	banned := make(map[string]bool, len(events))
+	for _, event := range events {
+		if membership, merr := event.Membership(); merr == nil && membership == gomatrixserverlib.Ban {
+			banned[event.EventID()] = true
+		}
+	}
+	for _, leave := range leaves {
+		switch {
+		case banned[leave.eventID]:
+			summary.Bans++
+		case leave.fromJoin:
+			summary.Leaves++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// fakeProducer records the output events sent to kafka.
+type fakeProducer struct {
+	sarama.SyncProducer
+	updates []api.OutputEvent
+}
+
+func (p *fakeProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		value, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+		var update api.OutputEvent
+		if err = json.Unmarshal(value, &update); err != nil {
+			return err
+		}
+		p.updates = append(p.updates, update)
+	}
+	return nil
+}
+
+func TestWriteMembershipDailySummaries(t *testing.T) {
+	ctx := context.Background()
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	room := newTestRoom(t, db)
+	alice, bob, carol, dave := "@alice:hollow.knight", "@bob:hollow.knight", "@carol:hollow.knight", "@dave:hollow.knight"
+	emptyStateKey := ""
+	room.create(alice)
+	room.send(alice, "m.room.join_rules", &emptyStateKey, `{"join_rule":"public"}`)
+	room.send(bob, "m.room.member", &bob, `{"membership":"join"}`)
+	room.send(bob, "m.room.member", &bob, `{"membership":"leave"}`)
+	room.send(alice, "m.room.member", &carol, `{"membership":"invite"}`)
+	room.send(carol, "m.room.member", &carol, `{"membership":"leave"}`)
+	room.send(dave, "m.room.member", &dave, `{"membership":"join"}`)
+	room.send(alice, "m.room.member", &dave, `{"membership":"ban"}`)
+
+	producer := &fakeProducer{}
+	r := &RoomserverInternalAPI{DB: db, Producer: producer, OutputRoomEventTopic: "roomserverOutput"}
+	now := time.Now().UTC()
+	start := now.Add(-time.Hour)
+	if err := r.writeMembershipDailySummaries(ctx, start, now.Add(time.Hour)); err != nil {
+		t.Fatalf("writeMembershipDailySummaries returned %s", err)
+	}
+	if len(producer.updates) != 1 || producer.updates[0].Type != api.OutputTypeMembershipDailySummary {
+		t.Fatalf("expected one membership daily summary, got %v", outputEventTypes(producer.updates))
+	}
+	// Carol rejecting the invite isn't a leave, and Dave's ban isn't a kick.
+	want := api.OutputMembershipDailySummary{
+		RoomID:  room.roomID,
+		Date:    start.Format(membershipDailySummaryDateFormat),
+		Joins:   3,
+		Leaves:  1,
+		Invites: 1,
+		Bans:    1,
+	}
+	if got := *producer.updates[0].MembershipDailySummary; got != want {
+		t.Errorf("expected summary %+v, got %+v", want, got)
+	}
+
+	// Nothing is written for days without any membership changes.
+	producer.updates = nil
+	if err := r.writeMembershipDailySummaries(ctx, start.AddDate(0, 0, -1), start); err != nil {
+		t.Fatalf("writeMembershipDailySummaries returned %s", err)
+	}
+	if len(producer.updates) != 0 {
+		t.Errorf("expected no summaries, got %v", outputEventTypes(producer.updates))
+	}
+}
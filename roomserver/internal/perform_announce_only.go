@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// PerformSetRoomAnnounceOnly implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformSetRoomAnnounceOnly(
+	ctx context.Context,
+	req *api.PerformSetRoomAnnounceOnlyRequest,
+	res *api.PerformSetRoomAnnounceOnlyResponse,
+) error {
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+	return r.DB.SetRoomAnnounceOnly(ctx, roomNID, req.AnnounceOnly)
+}
+
+// QueryRoomAnnounceOnly implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRoomAnnounceOnly(
+	ctx context.Context,
+	request *api.QueryRoomAnnounceOnlyRequest,
+	response *api.QueryRoomAnnounceOnlyResponse,
+) error {
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+	response.AnnounceOnly, err = r.DB.IsRoomAnnounceOnly(ctx, roomNID)
+	return err
+}
@@ -97,6 +97,15 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 	}
 	req.ServerNames = append(req.ServerNames, domain)
 
+	// Rooms that have been shut down by an admin can't be joined again.
+	blocked, err := r.DB.IsRoomBlocked(ctx, req.RoomIDOrAlias)
+	if err != nil {
+		return fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+	}
+	if blocked {
+		return fmt.Errorf("Room %q has been shut down by an admin", req.RoomIDOrAlias)
+	}
+
 	// Prepare the template for the join event.
 	userID := req.UserID
 	eb := gomatrixserverlib.EventBuilder{
@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// PerformLeaveAllRooms implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformLeaveAllRooms(
+	ctx context.Context,
+	req *api.PerformLeaveAllRoomsRequest,
+	res *api.PerformLeaveAllRoomsResponse,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
+	}
+
+	// Only the rooms that the user hasn't left yet are returned, so if we
+	// are interrupted then calling this again carries on where we left off.
+	joined, invited, err := r.DB.ActiveRoomsForUser(ctx, req.UserID)
+	if err != nil {
+		return fmt.Errorf("r.DB.ActiveRoomsForUser: %w", err)
+	}
+
+	logger := logrus.WithField("user_id", req.UserID)
+	for _, roomID := range invited {
+		r.leaveRoomForLeaveAll(ctx, req.UserID, roomID, res, logger)
+	}
+	for _, roomID := range joined {
+		// The user leaves regardless, but let the caller know that nobody
+		// will be able to change the power levels in the room afterwards.
+		vacuum, verr := r.leavesPowerVacuum(ctx, roomID, req.UserID)
+		if verr != nil {
+			logger.WithError(verr).WithField("room_id", roomID).Warn("Failed to check power levels before leaving room")
+		} else if vacuum {
+			logger.WithField("room_id", roomID).Warn("User is the only power levels admin in the room they are leaving")
+			res.PowerVacuumRoomIDs = append(res.PowerVacuumRoomIDs, roomID)
+		}
+		r.leaveRoomForLeaveAll(ctx, req.UserID, roomID, res, logger)
+	}
+	return nil
+}
+
+// leaveRoomForLeaveAll makes the user leave, or reject their invite to, the
+// room and records the outcome in the response. A failure to leave one room
+// doesn't stop the user from leaving the others.
+func (r *RoomserverInternalAPI) leaveRoomForLeaveAll(
+	ctx context.Context, userID, roomID string,
+	res *api.PerformLeaveAllRoomsResponse, logger *logrus.Entry,
+) {
+	leaveReq := api.PerformLeaveRequest{
+		RoomID: roomID,
+		UserID: userID,
+	}
+	leaveRes := api.PerformLeaveResponse{}
+	if err := r.performLeaveRoomByID(ctx, &leaveReq, &leaveRes); err != nil {
+		logger.WithError(err).WithField("room_id", roomID).Error("Failed to leave room")
+		res.FailedRoomIDs = append(res.FailedRoomIDs, roomID)
+		return
+	}
+	res.LeftRoomIDs = append(res.LeftRoomIDs, roomID)
+}
+
+// leavesPowerVacuum returns true if the user is the only user who is able to
+// change the power levels in the room, so that nobody will be able to once
+// the user has left.
+func (r *RoomserverInternalAPI) leavesPowerVacuum(
+	ctx context.Context, roomID, userID string,
+) (bool, error) {
+	latestReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{
+				EventType: gomatrixserverlib.MRoomPowerLevels,
+				StateKey:  "",
+			},
+		},
+	}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return false, err
+	}
+	if !latestRes.RoomExists || len(latestRes.StateEvents) == 0 {
+		return false, nil
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(latestRes.StateEvents[0].Unwrap())
+	if err != nil {
+		return false, err
+	}
+	required := powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+	if powerLevels.UserLevel(userID) < required || powerLevels.UsersDefault >= required {
+		return false, nil
+	}
+	for otherUserID, level := range powerLevels.Users {
+		if otherUserID != userID && level >= required {
+			return false, nil
+		}
+	}
+	return true, nil
+}
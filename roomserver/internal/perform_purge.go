@@ -0,0 +1,51 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// PerformPurgeRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) error {
+	// Hold the input lock so that no events for the room are being
+	// processed while we remove it.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	roomNID, err := r.DB.RoomNID(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+	if err = r.DB.PurgeRoom(ctx, roomNID); err != nil {
+		return err
+	}
+	return r.WriteOutputEvents(req.RoomID, []api.OutputEvent{
+		{
+			Type:      api.OutputTypePurgeRoom,
+			PurgeRoom: &api.OutputPurgeRoom{RoomID: req.RoomID},
+		},
+	})
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// PerformShutdownRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformShutdownRoom(
+	ctx context.Context,
+	req *api.PerformShutdownRoomRequest,
+	res *api.PerformShutdownRoomResponse,
+) error {
+	if req.NewRoomUserID != "" {
+		_, domain, err := gomatrixserverlib.SplitID('@', req.NewRoomUserID)
+		if err != nil {
+			return fmt.Errorf("Supplied user ID %q in incorrect format", req.NewRoomUserID)
+		}
+		if domain != r.Cfg.Matrix.ServerName {
+			return fmt.Errorf("User %q does not belong to this homeserver", req.NewRoomUserID)
+		}
+	}
+
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+
+	// Block the room before anyone leaves so that nobody can join it again
+	// while we are still making the other users leave.
+	if err = r.DB.SetRoomBlocked(ctx, req.RoomID, true); err != nil {
+		return fmt.Errorf("r.DB.SetRoomBlocked: %w", err)
+	}
+
+	userIDs, err := r.localJoinedUsers(ctx, roomNID)
+	if err != nil {
+		return fmt.Errorf("r.localJoinedUsers: %w", err)
+	}
+
+	if req.NewRoomUserID != "" {
+		res.NewRoomID, err = r.createShutdownNoticeRoom(ctx, req)
+		if err != nil {
+			return fmt.Errorf("r.createShutdownNoticeRoom: %w", err)
+		}
+	}
+
+	logger := logrus.WithField("room_id", req.RoomID)
+	for _, userID := range userIDs {
+		leaveReq := api.PerformLeaveRequest{
+			RoomID: req.RoomID,
+			UserID: userID,
+		}
+		leaveRes := api.PerformLeaveResponse{}
+		if err = r.performLeaveRoomByID(ctx, &leaveReq, &leaveRes); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("Failed to make user leave shut down room")
+			res.FailedUserIDs = append(res.FailedUserIDs, userID)
+			continue
+		}
+		res.KickedUserIDs = append(res.KickedUserIDs, userID)
+
+		if res.NewRoomID == "" || userID == req.NewRoomUserID {
+			continue
+		}
+		joinReq := api.PerformJoinRequest{
+			RoomIDOrAlias: res.NewRoomID,
+			UserID:        userID,
+		}
+		joinRes := api.PerformJoinResponse{}
+		if err = r.performJoinRoomByID(ctx, &joinReq, &joinRes); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Warn("Failed to join user to replacement room")
+		}
+	}
+	return nil
+}
+
+// localJoinedUsers returns the user IDs of the local users who are joined to
+// the room.
+func (r *RoomserverInternalAPI) localJoinedUsers(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]string, error) {
+	eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomNID, true)
+	if err != nil {
+		return nil, err
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []string
+	for _, event := range events {
+		stateKey := event.StateKey()
+		if stateKey == nil {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *stateKey)
+		if err != nil || domain != r.Cfg.Matrix.ServerName {
+			continue
+		}
+		userIDs = append(userIDs, *stateKey)
+	}
+	return userIDs, nil
+}
+
+// createShutdownNoticeRoom creates a public room, in which only the creator
+// can send messages, for the users of a shut down room to be moved to. The
+// notice from the request is sent into the room.
+func (r *RoomserverInternalAPI) createShutdownNoticeRoom(
+	ctx context.Context, req *api.PerformShutdownRoomRequest,
+) (string, error) {
+	userID := req.NewRoomUserID
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+	roomVersion := version.DefaultRoomVersion()
+
+	powerLevels := common.InitialPowerLevelsContent(userID)
+	powerLevels.EventsDefault = 50
+
+	type fledglingEvent struct {
+		Type     string
+		StateKey *string
+		Content  interface{}
+	}
+	emptyStateKey := ""
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, &emptyStateKey, map[string]interface{}{
+			"creator":      userID,
+			"room_version": roomVersion,
+		}},
+		{gomatrixserverlib.MRoomMember, &userID, gomatrixserverlib.MemberContent{
+			Membership: gomatrixserverlib.Join,
+		}},
+		{gomatrixserverlib.MRoomPowerLevels, &emptyStateKey, powerLevels},
+		{gomatrixserverlib.MRoomJoinRules, &emptyStateKey, gomatrixserverlib.JoinRuleContent{
+			JoinRule: gomatrixserverlib.Public,
+		}},
+		{gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, common.HistoryVisibilityContent{
+			HistoryVisibility: "shared",
+		}},
+	}
+	if req.NewRoomName != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			"m.room.name", &emptyStateKey, common.NameContent{Name: req.NewRoomName},
+		})
+	}
+	if req.Message != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			"m.room.message", nil, map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    req.Message,
+			},
+		})
+	}
+
+	evTime := time.Now()
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	inputEvents := make([]api.InputRoomEvent, 0, len(eventsToMake))
+	var prevEvent *gomatrixserverlib.Event
+	for i, e := range eventsToMake {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     e.Type,
+			StateKey: e.StateKey,
+			Depth:    int64(i + 1),
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return "", fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if prevEvent != nil {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{prevEvent.EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return "", fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return "", fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		event, err := builder.Build(
+			evTime, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, roomVersion,
+		)
+		if err != nil {
+			return "", fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
+			return "", fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+		if event.StateKey() != nil {
+			if err = authEvents.AddEvent(&event); err != nil {
+				return "", fmt.Errorf("authEvents.AddEvent: %w", err)
+			}
+		}
+		inputEvents = append(inputEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        event.Headered(roomVersion),
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+		prevEvent = &event
+	}
+
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: inputEvents,
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	if err := r.InputRoomEvents(ctx, &inputReq, &inputRes); err != nil {
+		return "", fmt.Errorf("r.InputRoomEvents: %w", err)
+	}
+	return roomID, nil
+}
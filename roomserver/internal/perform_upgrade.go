@@ -0,0 +1,396 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeCopiedStateTypes are the types of the state events which are copied
+// from a room to its replacement when it is upgraded, in the order that they
+// are sent after the power levels.
+var upgradeCopiedStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	"m.room.name",
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+	"m.room.canonical_alias",
+}
+
+// PerformUpgradeRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformUpgradeRoom(
+	ctx context.Context,
+	req *api.PerformUpgradeRoomRequest,
+	res *api.PerformUpgradeRoomResponse,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
+	}
+	if _, err = version.SupportedRoomVersion(req.RoomVersion); err != nil {
+		return err
+	}
+
+	newRoomID, err := r.upgradeRoom(ctx, req)
+	var notAllowed *gomatrixserverlib.NotAllowed
+	if errors.As(err, &notAllowed) {
+		res.NotAllowed = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.NewRoomID = newRoomID
+
+	// Moving the aliases sends m.room.aliases events, which takes the input
+	// lock, so it has to happen once the upgrade itself is done.
+	if err = r.moveLocalAliases(ctx, req.UserID, req.RoomID, newRoomID); err != nil {
+		return fmt.Errorf("r.moveLocalAliases: %w", err)
+	}
+	return nil
+}
+
+// upgradeRoom creates the replacement room and tombstones the old room. The
+// input lock is held throughout, so that the state of the old room can't
+// change between copying it and sending the tombstone. Returns a
+// *gomatrixserverlib.NotAllowed error if the user can't upgrade the room.
+// nolint: gocyclo
+func (r *RoomserverInternalAPI) upgradeRoom(
+	ctx context.Context, req *api.PerformUpgradeRoomRequest,
+) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	latestReq := api.QueryLatestEventsAndStateRequest{RoomID: req.RoomID}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return "", fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	if !latestRes.RoomExists {
+		return "", fmt.Errorf("Room %q does not exist", req.RoomID)
+	}
+	oldState := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event{}
+	oldAuthEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range latestRes.StateEvents {
+		ev := &latestRes.StateEvents[i].Event
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		if err := oldAuthEvents.AddEvent(ev); err != nil {
+			return "", fmt.Errorf("oldAuthEvents.AddEvent: %w", err)
+		}
+	}
+	oldStateEvent := func(eventType string) *gomatrixserverlib.Event {
+		return oldState[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]
+	}
+
+	userID := req.UserID
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+	emptyStateKey := ""
+	evTime := time.Now()
+
+	// The tombstone is built first, even though it is sent last, because
+	// the create event of the new room refers to it. Building it also checks
+	// that the user is allowed to upgrade the room.
+	tombstoneBuilder := gomatrixserverlib.EventBuilder{
+		Sender:     userID,
+		RoomID:     req.RoomID,
+		Type:       "m.room.tombstone",
+		StateKey:   &emptyStateKey,
+		Depth:      latestRes.Depth,
+		PrevEvents: latestRes.LatestEvents,
+	}
+	if err := tombstoneBuilder.SetContent(map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": newRoomID,
+	}); err != nil {
+		return "", fmt.Errorf("tombstoneBuilder.SetContent: %w", err)
+	}
+	tombstone, err := r.buildUpgradeEvent(&tombstoneBuilder, &oldAuthEvents, latestRes.RoomVersion, evTime)
+	if err != nil {
+		return "", err
+	}
+	oldRoomEvents := []gomatrixserverlib.Event{*tombstone}
+
+	// Stop ordinary users from talking in the old room, so that they move to
+	// the new one. This is skipped if the user can't change the power levels.
+	if powerLevelsEvent := oldStateEvent(gomatrixserverlib.MRoomPowerLevels); powerLevelsEvent != nil {
+		var restricted *gomatrixserverlib.Event
+		restricted, err = r.buildRestrictedPowerLevelsEvent(
+			userID, powerLevelsEvent, tombstone, &oldAuthEvents, latestRes.RoomVersion, evTime,
+		)
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if err != nil && !errors.As(err, &notAllowed) {
+			return "", err
+		}
+		if restricted != nil {
+			oldRoomEvents = append(oldRoomEvents, *restricted)
+		}
+	}
+
+	// Work out the events of the new room, starting with the create event,
+	// which keeps any extra keys of the old one, such as m.federate.
+	createContent := map[string]interface{}{}
+	if createEvent := oldStateEvent(gomatrixserverlib.MRoomCreate); createEvent != nil {
+		if err = json.Unmarshal(createEvent.Content(), &createContent); err != nil {
+			return "", fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	createContent["creator"] = userID
+	createContent["room_version"] = req.RoomVersion
+	createContent["predecessor"] = map[string]string{
+		"room_id":  req.RoomID,
+		"event_id": tombstone.EventID(),
+	}
+	memberContent := gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}
+	if memberEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]; memberEvent != nil {
+		var oldMemberContent gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(memberEvent.Content(), &oldMemberContent); err == nil {
+			memberContent.DisplayName = oldMemberContent.DisplayName
+			memberContent.AvatarURL = oldMemberContent.AvatarURL
+		}
+	}
+
+	// The user needs to be able to send all of the copied state, so if the
+	// old power levels don't let them then they are raised to begin with and
+	// the old power levels are restored at the end.
+	var powerLevelsContent, initialPowerLevelsContent interface{}
+	powerLevelsContent = common.InitialPowerLevelsContent(userID)
+	initialPowerLevelsContent = powerLevelsContent
+	if powerLevelsEvent := oldStateEvent(gomatrixserverlib.MRoomPowerLevels); powerLevelsEvent != nil {
+		powerLevelsContent = json.RawMessage(powerLevelsEvent.Content())
+		initialPowerLevelsContent = powerLevelsContent
+		var powerLevels gomatrixserverlib.PowerLevelContent
+		powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(*powerLevelsEvent)
+		if err != nil {
+			return "", fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+		}
+		needed := powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+		for _, eventType := range upgradeCopiedStateTypes {
+			if oldStateEvent(eventType) != nil && powerLevels.EventLevel(eventType, true) > needed {
+				needed = powerLevels.EventLevel(eventType, true)
+			}
+		}
+		if powerLevels.UserLevel(userID) < needed {
+			raised := map[string]interface{}{}
+			if err = json.Unmarshal(powerLevelsEvent.Content(), &raised); err != nil {
+				return "", fmt.Errorf("json.Unmarshal: %w", err)
+			}
+			users, _ := raised["users"].(map[string]interface{})
+			if users == nil {
+				users = map[string]interface{}{}
+			}
+			users[userID] = needed
+			raised["users"] = users
+			initialPowerLevelsContent = raised
+		}
+	}
+
+	type fledglingEvent struct {
+		Type     string
+		StateKey string
+		Content  interface{}
+	}
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, userID, memberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", initialPowerLevelsContent},
+	}
+	for _, eventType := range upgradeCopiedStateTypes {
+		if ev := oldStateEvent(eventType); ev != nil {
+			eventsToMake = append(eventsToMake, fledglingEvent{eventType, "", json.RawMessage(ev.Content())})
+		}
+	}
+	if _, raised := initialPowerLevelsContent.(map[string]interface{}); raised {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", powerLevelsContent})
+	}
+
+	newAuthEvents := gomatrixserverlib.NewAuthEvents(nil)
+	var newRoomEvents []gomatrixserverlib.Event
+	for i, e := range eventsToMake {
+		stateKey := e.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1),
+		}
+		if err = builder.SetContent(e.Content); err != nil {
+			return "", fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{newRoomEvents[i-1].EventReference()}
+		}
+		var event *gomatrixserverlib.Event
+		event, err = r.buildUpgradeEvent(&builder, &newAuthEvents, req.RoomVersion, evTime)
+		if err != nil {
+			return "", err
+		}
+		newRoomEvents = append(newRoomEvents, *event)
+	}
+
+	// Send the new room first, so that it exists by the time that anyone
+	// follows the tombstone to it.
+	var inputEvents []api.InputRoomEvent
+	for _, event := range newRoomEvents {
+		inputEvents = append(inputEvents, r.upgradeInputEvent(event, req.RoomVersion))
+	}
+	for _, event := range oldRoomEvents {
+		inputEvents = append(inputEvents, r.upgradeInputEvent(event, latestRes.RoomVersion))
+	}
+	for i := range inputEvents {
+		if _, err = processRoomEvent(ctx, r.Cfg, r.DB, r, inputEvents[i]); err != nil {
+			return "", fmt.Errorf("processRoomEvent: %w", err)
+		}
+	}
+	return newRoomID, nil
+}
+
+// buildRestrictedPowerLevelsEvent builds a power levels event for the old
+// room which stops users without a power level from sending messages or
+// inviting anyone. Returns nil if they already can't.
+func (r *RoomserverInternalAPI) buildRestrictedPowerLevelsEvent(
+	userID string, powerLevelsEvent, tombstone *gomatrixserverlib.Event,
+	authEvents *gomatrixserverlib.AuthEvents, roomVersion gomatrixserverlib.RoomVersion,
+	evTime time.Time,
+) (*gomatrixserverlib.Event, error) {
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*powerLevelsEvent)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+	}
+	restrictedLevel := powerLevels.UsersDefault + 1
+	if restrictedLevel < 50 {
+		restrictedLevel = 50
+	}
+	if powerLevels.EventsDefault >= restrictedLevel && powerLevels.Invite >= restrictedLevel {
+		return nil, nil
+	}
+	content := map[string]interface{}{}
+	if err = json.Unmarshal(powerLevelsEvent.Content(), &content); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if powerLevels.EventsDefault < restrictedLevel {
+		content["events_default"] = restrictedLevel
+	}
+	if powerLevels.Invite < restrictedLevel {
+		content["invite"] = restrictedLevel
+	}
+
+	emptyStateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     userID,
+		RoomID:     tombstone.RoomID(),
+		Type:       gomatrixserverlib.MRoomPowerLevels,
+		StateKey:   &emptyStateKey,
+		Depth:      tombstone.Depth() + 1,
+		PrevEvents: []gomatrixserverlib.EventReference{tombstone.EventReference()},
+	}
+	if err = builder.SetContent(content); err != nil {
+		return nil, fmt.Errorf("builder.SetContent: %w", err)
+	}
+	return r.buildUpgradeEvent(&builder, authEvents, roomVersion, evTime)
+}
+
+// buildUpgradeEvent builds an event for a room upgrade and checks that it is
+// allowed by the auth events, which it is then added to.
+func (r *RoomserverInternalAPI) buildUpgradeEvent(
+	builder *gomatrixserverlib.EventBuilder, authEvents *gomatrixserverlib.AuthEvents,
+	roomVersion gomatrixserverlib.RoomVersion, evTime time.Time,
+) (*gomatrixserverlib.Event, error) {
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+	}
+	if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(authEvents); err != nil {
+		return nil, fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+	}
+	event, err := builder.Build(
+		evTime, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+		r.Cfg.Matrix.PrivateKey, roomVersion,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("builder.Build: %w", err)
+	}
+	if err = gomatrixserverlib.Allowed(event, authEvents); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+	}
+	if err = authEvents.AddEvent(&event); err != nil {
+		return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+	}
+	return &event, nil
+}
+
+func (r *RoomserverInternalAPI) upgradeInputEvent(
+	event gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion,
+) api.InputRoomEvent {
+	return api.InputRoomEvent{
+		Kind:         api.KindNew,
+		Event:        event.Headered(roomVersion),
+		AuthEventIDs: event.AuthEventIDs(),
+		SendAsServer: string(r.Cfg.Matrix.ServerName),
+	}
+}
+
+// moveLocalAliases points the local aliases of the old room at the new room,
+// keeping their creators, sends updated m.room.aliases events to both and
+// removes the moved aliases from the old room's canonical alias.
+func (r *RoomserverInternalAPI) moveLocalAliases(
+	ctx context.Context, userID, oldRoomID, newRoomID string,
+) error {
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, oldRoomID)
+	if err != nil || len(aliases) == 0 {
+		return err
+	}
+	for _, alias := range aliases {
+		var creatorID string
+		if creatorID, err = r.DB.GetCreatorIDForAlias(ctx, alias); err != nil {
+			return err
+		}
+		if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
+			return err
+		}
+		if err = r.DB.SetRoomAlias(ctx, alias, newRoomID, creatorID); err != nil {
+			return err
+		}
+	}
+	if err = r.sendUpdatedAliasesEvent(ctx, userID, oldRoomID); err != nil {
+		return err
+	}
+	if err = r.sendUpdatedAliasesEvent(ctx, userID, newRoomID); err != nil {
+		return err
+	}
+	if err = r.removeCanonicalAliases(ctx, userID, oldRoomID, aliases); err != nil {
+		logrus.WithError(err).WithField("room_id", oldRoomID).Warn("Failed to remove moved aliases from canonical alias")
+	}
+	return nil
+}
@@ -238,6 +238,79 @@ func (r *RoomserverInternalAPI) QueryMembershipForUser(
 	return nil
 }
 
+// QueryMembershipChangePreview implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryMembershipChangePreview(
+	ctx context.Context,
+	request *api.QueryMembershipChangePreviewRequest,
+	response *api.QueryMembershipChangePreviewResponse,
+) error {
+	event := request.Event.Unwrap()
+	if event.RoomID() != request.RoomID {
+		return fmt.Errorf("event %q is for room %q, not %q", event.EventID(), event.RoomID(), request.RoomID)
+	}
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return fmt.Errorf("event %q is not a membership event", event.EventID())
+	}
+
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return fmt.Errorf("room %q is not known", request.RoomID)
+	}
+
+	membershipEventNID, mu, err := r.DB.MembershipPreviewUpdater(ctx, roomNID, *event.StateKey())
+	if err != nil {
+		return err
+	}
+
+	// The current membership event for the user is the one that would be
+	// removed from the current state of the room by the new event.
+	var remove *gomatrixserverlib.Event
+	if membershipEventNID != 0 {
+		events, err := r.DB.Events(ctx, []types.EventNID{membershipEventNID})
+		if err != nil {
+			return err
+		}
+		if len(events) == 1 {
+			remove = &events[0].Event
+		}
+	}
+
+	var joinRule, roomType string
+	if needsAuthEvents(remove, &event) {
+		authEvents := loadMembershipAuthEvents(ctx, r.DB, []*gomatrixserverlib.Event{&event})
+		joinRule = authEvents.joinRule(&event)
+		roomType = authEvents.roomType(&event)
+	}
+
+	previewer := &membershipPreviewer{
+		roomVersion: request.Event.RoomVersion,
+		updater:     mu,
+	}
+	response.Updates, err = updateMembershipRecovering(
+		previewer, 0, remove, &event, nil, membershipValidation(r.Cfg),
+		joinRule, roomType, "",
+	)
+	return err
+}
+
+// membershipPreviewer hands out a read-only membership updater so that the
+// membership transition logic can be run without changing anything.
+type membershipPreviewer struct {
+	roomVersion gomatrixserverlib.RoomVersion
+	updater     types.MembershipUpdater
+}
+
+func (p *membershipPreviewer) RoomVersion() gomatrixserverlib.RoomVersion {
+	return p.roomVersion
+}
+
+func (p *membershipPreviewer) MembershipUpdater(types.EventStateKeyNID) (types.MembershipUpdater, error) {
+	return p.updater, nil
+}
+
 // QueryMembershipsForRoom implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryMembershipsForRoom(
 	ctx context.Context,
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// mediaURIRegex matches the mxc:// URIs of media, which can appear in many
+// places in events, e.g. in the url of m.image messages, the info of files,
+// avatars and formatted bodies.
+var mediaURIRegex = regexp.MustCompile(`mxc://[A-Za-z0-9.:\[\]-]+/[A-Za-z0-9_-]+`)
+
+// QueryRoomMediaURIs implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRoomMediaURIs(
+	ctx context.Context,
+	request *api.QueryRoomMediaURIsRequest,
+	response *api.QueryRoomMediaURIsResponse,
+) error {
+	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+
+	eventJSONs, err := r.DB.RoomEventJSON(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	response.MediaURIs = []string{}
+	for _, eventJSON := range eventJSONs {
+		for _, uri := range mediaURIRegex.FindAll(eventJSON, -1) {
+			if !seen[string(uri)] {
+				seen[string(uri)] = true
+				response.MediaURIs = append(response.MediaURIs, string(uri))
+			}
+		}
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/roomserver/analytics"
 	"github.com/matrix-org/dendrite/roomserver/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/sirupsen/logrus"
@@ -35,10 +36,16 @@ func SetupRoomServerComponent(
 	keyRing gomatrixserverlib.JSONVerifier,
 	fedClient *gomatrixserverlib.FederationClient,
 ) api.RoomserverInternalAPI {
-	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer), base.Cfg.DbProperties())
+	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer), base.Cfg.DbPropertiesFor("room_server"))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
+	if replica := base.Cfg.Database.ReadReplicas.RoomServer; replica != "" {
+		roomserverDB, err = storage.WithReadReplica(roomserverDB, string(replica), base.Cfg.DbPropertiesFor("room_server"))
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to room server read replica")
+		}
+	}
 
 	internalAPI := internal.RoomserverInternalAPI{
 		DB:                   roomserverDB,
@@ -51,6 +58,20 @@ func SetupRoomServerComponent(
 		KeyRing:              keyRing,
 	}
 
+	if analyticsCfg := base.Cfg.RoomServer.MembershipAnalytics; analyticsCfg.Database != "" {
+		writer, err := analytics.NewSQLWriter(
+			string(analyticsCfg.Database), analyticsCfg.Table, base.Cfg.DbProperties(),
+		)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to membership analytics db")
+		}
+		internalAPI.MembershipAnalytics = analytics.NewSink(writer, analyticsCfg.QueueSize)
+	}
+
+	if base.Cfg.RoomServer.MembershipDailySummary {
+		internalAPI.StartMembershipDailySummaries()
+	}
+
 	internalAPI.SetupHTTP(http.DefaultServeMux)
 
 	return &internalAPI
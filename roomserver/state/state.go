@@ -246,6 +246,56 @@ func (v StateResolution) LoadStateAtSnapshotForStringTuples(
 	return v.loadStateAtSnapshotForNumericTuples(ctx, stateNID, numericTuples)
 }
 
+// LoadStateAtSnapshotsForStringTuples loads the state for a list of event type
+// and state key pairs at each of a list of snapshots. Unlike calling
+// LoadStateAtSnapshotForStringTuples for each snapshot, it reads the database
+// the same number of times however many snapshots there are.
+// Returns a map from snapshot to a sorted list of state entries or an error if
+// there was a problem talking to the database.
+func (v StateResolution) LoadStateAtSnapshotsForStringTuples(
+	ctx context.Context,
+	stateNIDs []types.StateSnapshotNID,
+	stateKeyTuples []gomatrixserverlib.StateKeyTuple,
+) (map[types.StateSnapshotNID][]types.StateEntry, error) {
+	result := make(map[types.StateSnapshotNID][]types.StateEntry, len(stateNIDs))
+	if len(stateNIDs) == 0 {
+		return result, nil
+	}
+	numericTuples, err := v.stringTuplesToNumericTuples(ctx, stateKeyTuples)
+	if err != nil || len(numericTuples) == 0 {
+		return result, err
+	}
+	stateBlockNIDLists, err := v.db.StateBlockNIDs(ctx, uniqueStateSnapshotNIDs(stateNIDs))
+	if err != nil {
+		return nil, err
+	}
+	var stateBlockNIDs []types.StateBlockNID
+	for _, list := range stateBlockNIDLists {
+		stateBlockNIDs = append(stateBlockNIDs, list.StateBlockNIDs...)
+	}
+	stateEntryLists, err := v.db.StateEntriesForTuples(
+		ctx, uniqueStateBlockNIDs(stateBlockNIDs), numericTuples,
+	)
+	if err != nil {
+		return nil, err
+	}
+	stateEntriesMap := stateEntryListMap(stateEntryLists)
+
+	// Combine the state entries for each snapshot as in
+	// loadStateAtSnapshotForNumericTuples.
+	for _, list := range stateBlockNIDLists {
+		var fullState []types.StateEntry
+		for _, stateBlockNID := range list.StateBlockNIDs {
+			if entries, ok := stateEntriesMap.lookup(stateBlockNID); ok {
+				fullState = append(fullState, entries...)
+			}
+		}
+		sort.Stable(stateEntryByStateKeySorter(fullState))
+		result[list.StateSnapshotNID] = fullState[:util.Unique(stateEntryByStateKeySorter(fullState))]
+	}
+	return result, nil
+}
+
 // stringTuplesToNumericTuples converts the string state key tuples into numeric IDs
 // If there isn't a numeric ID for either the event type or the event state key then the tuple is discarded.
 // Returns an error if there was a problem talking to the database.
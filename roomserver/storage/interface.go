@@ -16,6 +16,8 @@ package storage
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -59,6 +61,10 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up the "membership" of the membership events for a list of numeric
+	// event IDs, without loading the event JSON. Events stored before their
+	// membership was recorded are omitted from the map.
+	EventMemberships(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Look up a room version from the room NID.
@@ -78,14 +84,86 @@ type Database interface {
 	RoomNIDExcludingStubs(ctx context.Context, roomID string) (types.RoomNID, error)
 	LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error)
 	GetInvitesForUser(ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (senderUserIDs []types.EventStateKeyNID, err error)
+	// Look up the invites which are still active for users on the given server,
+	// i.e. invites that have been neither accepted nor rejected yet. This is
+	// useful for working out whether invites to a remote server are stuck.
+	PendingRemoteInvites(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]types.RoomUser, error)
+	// Count the number of different users that have sent the active invites
+	// for a user, across all rooms. A large number of inviters can be a sign of
+	// a coordinated invite spam campaign against the user.
+	DistinctInviterCount(ctx context.Context, targetUserID string) (int, error)
 	SetRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) error
 	GetRoomIDForAlias(ctx context.Context, alias string) (string, error)
 	GetAliasesForRoomID(ctx context.Context, roomID string) ([]string, error)
 	GetCreatorIDForAlias(ctx context.Context, alias string) (string, error)
 	RemoveRoomAlias(ctx context.Context, alias string) error
 	MembershipUpdater(ctx context.Context, roomID, targetUserID string, roomVersion gomatrixserverlib.RoomVersion) (types.MembershipUpdater, error)
+	// Look up the current membership event NID for a user in a room, along with
+	// a read-only membership updater which reports the effect of each update
+	// without writing anything to the database.
+	MembershipPreviewUpdater(ctx context.Context, roomNID types.RoomNID, targetUserID string) (types.EventNID, types.MembershipUpdater, error)
 	GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error)
+	// Look up the users who are currently banned from a room, along with who
+	// banned them and why.
+	BannedUsersInRoom(ctx context.Context, roomID string) ([]types.BannedUser, error)
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error)
+	// Call the function for every membership row in the database, across all
+	// rooms. The rows are read in batches so that the whole table doesn't need
+	// to be held in memory. Leaves and bans are both reported as "leave", and
+	// the event ID is empty for invites. Stops at the first error.
+	StreamAllMemberships(ctx context.Context, fn func(roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, membership, eventID string) error) error
+	// Write the membership changes in the room at or after since to w, oldest
+	// first, in the format "csv" or "json" (newline-delimited). The changes are
+	// streamed rather than buffered, so w should apply its own buffering.
+	ExportMembershipAudit(ctx context.Context, roomID string, since time.Time, format string, w io.Writer) error
+	// Call fn with each membership change in any room at or after from and
+	// before to. The changes for each room are contiguous and oldest first.
+	MembershipAuditBetween(ctx context.Context, from, to time.Time, fn func(entry types.MembershipAuditEntry) error) error
+	// Look up every change the actor made to the membership of the target,
+	// e.g. invites, kicks and bans, across all rooms, oldest first. This is
+	// based on the membership audit log.
+	ActorTargetInteractions(ctx context.Context, actorUserID, targetUserID string) ([]types.MembershipAuditEntry, error)
+	// Look up the most recent membership changes across all rooms, up to the
+	// limit, newest first. This is based on the membership audit log.
+	RecentMembershipTransitions(ctx context.Context, limit int) ([]types.MembershipAuditEntry, error)
+	// Look up which of the users have ever been joined to the room. This is
+	// based on the membership audit log, so joins from before the audit log
+	// existed aren't known about.
+	UsersJoinedRoomBefore(ctx context.Context, roomID string, userIDs []string) (map[string]bool, error)
+	// Check the membership rows for the room against the membership events
+	// they refer to, returning any rows where the event is missing or
+	// disagrees with the row, e.g. to decide whether the room needs repair.
+	VerifyMembershipConsistency(ctx context.Context, roomID string) ([]types.MembershipInconsistency, error)
+	// Look up the IDs of the rooms in which the user is joined, and of the
+	// rooms to which the user is invited.
+	ActiveRoomsForUser(ctx context.Context, userID string) (joined, invited []string, err error)
+	// Set whether the room is in announce-only mode, in which output events for
+	// joins, leaves and profile changes are suppressed. Rooms default to off.
+	SetRoomAnnounceOnly(ctx context.Context, roomNID types.RoomNID, announceOnly bool) error
+	// Look up whether the room is in announce-only mode.
+	IsRoomAnnounceOnly(ctx context.Context, roomNID types.RoomNID) (bool, error)
+	// Set whether the room has been shut down by an admin, in which case local
+	// users can't join it. Rooms are blocked by room ID so that they stay
+	// blocked after being purged.
+	SetRoomBlocked(ctx context.Context, roomID string, blocked bool) error
+	// Look up whether the room has been shut down by an admin.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
+	// Remove all events, state, memberships, invites and aliases for the room
+	// in a single transaction. The room NID is not reused afterwards.
+	PurgeRoom(ctx context.Context, roomNID types.RoomNID) error
+	// Look up the JSON of all of the events in the room, in no particular order.
+	RoomEventJSON(ctx context.Context, roomNID types.RoomNID) ([][]byte, error)
+	// Mark the event as having failed the auth checks against the current
+	// state of the room (soft-failed), so that it isn't applied to the room.
+	MarkEventRejected(ctx context.Context, eventNID types.EventNID) error
+	// Look up whether the event has been marked with MarkEventRejected.
+	EventRejected(ctx context.Context, eventNID types.EventNID) (bool, error)
+	// Look up the active invites for the user whose invite events have an
+	// origin_server_ts before olderThan, oldest first.
+	StaleInvitesForUser(ctx context.Context, userID string, olderThan time.Time) ([]types.InviteRecord, error)
+	// Look up which of the events exist, e.g. so that purged events can be
+	// skipped. Every event NID given is in the returned map.
+	EventsExist(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]bool, error)
 	EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error)
 	GetRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error)
 }
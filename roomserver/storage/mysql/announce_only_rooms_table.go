@@ -0,0 +1,80 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const announceOnlyRoomsSchema = `
+	CREATE TABLE IF NOT EXISTS roomserver_announce_only_rooms (
+		room_nid BIGINT PRIMARY KEY
+	);
+`
+
+const insertAnnounceOnlyRoomSQL = `
+	INSERT IGNORE INTO roomserver_announce_only_rooms (room_nid) VALUES ($1)
+`
+
+const deleteAnnounceOnlyRoomSQL = `
+	DELETE FROM roomserver_announce_only_rooms WHERE room_nid = $1
+`
+
+const selectAnnounceOnlyRoomSQL = `
+	SELECT room_nid FROM roomserver_announce_only_rooms WHERE room_nid = $1
+`
+
+type announceOnlyRoomsStatements struct {
+	insertAnnounceOnlyRoomStmt *sql.Stmt
+	deleteAnnounceOnlyRoomStmt *sql.Stmt
+	selectAnnounceOnlyRoomStmt *sql.Stmt
+}
+
+func (s *announceOnlyRoomsStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertAnnounceOnlyRoomStmt, insertAnnounceOnlyRoomSQL},
+		{&s.deleteAnnounceOnlyRoomStmt, deleteAnnounceOnlyRoomSQL},
+		{&s.selectAnnounceOnlyRoomStmt, selectAnnounceOnlyRoomSQL},
+	}.prepare(db)
+}
+
+func (s *announceOnlyRoomsStatements) insertAnnounceOnlyRoom(
+	ctx context.Context, roomNID types.RoomNID,
+) error {
+	_, err := s.insertAnnounceOnlyRoomStmt.ExecContext(ctx, roomNID)
+	return err
+}
+
+func (s *announceOnlyRoomsStatements) deleteAnnounceOnlyRoom(
+	ctx context.Context, roomNID types.RoomNID,
+) error {
+	_, err := s.deleteAnnounceOnlyRoomStmt.ExecContext(ctx, roomNID)
+	return err
+}
+
+func (s *announceOnlyRoomsStatements) selectAnnounceOnlyRoom(
+	ctx context.Context, roomNID types.RoomNID,
+) (bool, error) {
+	var nid types.RoomNID
+	err := s.selectAnnounceOnlyRoomStmt.QueryRowContext(ctx, roomNID).Scan(&nid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
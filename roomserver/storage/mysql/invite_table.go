@@ -0,0 +1,249 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const inviteSchema = `
+	CREATE TABLE IF NOT EXISTS roomserver_invites (
+		invite_event_id VARCHAR(255) PRIMARY KEY,
+		room_nid BIGINT NOT NULL,
+		target_nid BIGINT NOT NULL,
+		sender_nid BIGINT NOT NULL DEFAULT 0,
+		retired BOOLEAN NOT NULL DEFAULT FALSE,
+		invite_event_json MEDIUMTEXT NOT NULL,
+		origin_server_ts BIGINT NOT NULL DEFAULT 0,
+		INDEX roomserver_invites_active_idx (target_nid, room_nid)
+	);
+`
+const insertInviteEventSQL = "" +
+	"INSERT IGNORE INTO roomserver_invites (invite_event_id, room_nid, target_nid," +
+	" sender_nid, invite_event_json, origin_server_ts) VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectInviteActiveForUserInRoomSQL = "" +
+	"SELECT sender_nid FROM roomserver_invites" +
+	" WHERE target_nid = $1 AND room_nid = $2" +
+	" AND NOT retired"
+
+// Select the active invites for a user which were sent before a timestamp,
+// oldest first.
+const selectInvitesActiveForUserBeforeSQL = "" +
+	"SELECT r.room_id, i.invite_event_id, COALESCE(k.event_state_key, ''), i.origin_server_ts" +
+	" FROM roomserver_invites AS i" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = i.room_nid" +
+	" LEFT JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = i.sender_nid" +
+	" WHERE i.target_nid = $1 AND NOT i.retired AND i.origin_server_ts < $2" +
+	" ORDER BY i.origin_server_ts ASC"
+
+const selectInviteDistinctSenderCountSQL = "" +
+	"SELECT COUNT(DISTINCT sender_nid) FROM roomserver_invites" +
+	" WHERE target_nid = $1 AND NOT retired"
+
+// Select the active invites for users on a given server. The user IDs are
+// matched on their ":server_name" suffix.
+const selectInvitesActiveForServerSQL = "" +
+	"SELECT r.room_id, k.event_state_key FROM roomserver_invites AS i" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = i.room_nid" +
+	" JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = i.target_nid" +
+	" WHERE NOT i.retired" +
+	" AND RIGHT(k.event_state_key, CHAR_LENGTH($1) + 1) = CONCAT(':', $1)"
+
+// Retire every active invite for a user in a room.
+// Ideally we'd know which invite events were retired by a given update so we
+// wouldn't need to remove every active invite.
+// However the matrix protocol doesn't give us a way to reliably identify the
+// invites that were retired, so we are forced to retire all of them.
+const updateInviteRetiredSQL = `
+	UPDATE roomserver_invites SET retired = TRUE WHERE room_nid = $1 AND target_nid = $2 AND NOT retired
+`
+
+const selectInvitesAboutToRetireSQL = `
+SELECT invite_event_id FROM roomserver_invites WHERE room_nid = $1 AND target_nid = $2 AND NOT retired
+`
+
+type inviteStatements struct {
+	insertInviteEventStmt                *sql.Stmt
+	selectInviteActiveForUserInRoomStmt  *sql.Stmt
+	updateInviteRetiredStmt              *sql.Stmt
+	selectInvitesActiveForServerStmt     *sql.Stmt
+	selectInviteDistinctSenderCountStmt  *sql.Stmt
+	selectInvitesActiveForUserBeforeStmt *sql.Stmt
+	selectInvitesAboutToRetireStmt       *sql.Stmt
+}
+
+func (s *inviteStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertInviteEventStmt, insertInviteEventSQL},
+		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
+		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
+		{&s.selectInvitesActiveForServerStmt, selectInvitesActiveForServerSQL},
+		{&s.selectInviteDistinctSenderCountStmt, selectInviteDistinctSenderCountSQL},
+		{&s.selectInvitesActiveForUserBeforeStmt, selectInvitesActiveForUserBeforeSQL},
+		{&s.selectInvitesAboutToRetireStmt, selectInvitesAboutToRetireSQL},
+	}.prepare(db)
+}
+
+func (s *inviteStatements) insertInviteEvent(
+	ctx context.Context,
+	txn *sql.Tx, inviteEventID string, roomNID types.RoomNID,
+	targetUserNID, senderUserNID types.EventStateKeyNID,
+	inviteEventJSON []byte, originServerTS gomatrixserverlib.Timestamp,
+) (bool, error) {
+	stmt := common.TxStmt(txn, s.insertInviteEventStmt)
+	defer stmt.Close() // nolint: errcheck
+	result, err := stmt.ExecContext(
+		ctx, inviteEventID, roomNID, targetUserNID, senderUserNID, inviteEventJSON, originServerTS,
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func (s *inviteStatements) updateInviteRetired(
+	ctx context.Context,
+	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) (eventIDs []string, err error) {
+	// gather all the event IDs we will retire
+	stmt := txn.Stmt(s.selectInvitesAboutToRetireStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, targetUserNID)
+	if err != nil {
+		return nil, err
+	}
+	defer (func() { err = rows.Close() })()
+	for rows.Next() {
+		var inviteEventID string
+		if err = rows.Scan(&inviteEventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, inviteEventID)
+	}
+
+	// now retire the invites
+	stmt = txn.Stmt(s.updateInviteRetiredStmt)
+	_, err = stmt.ExecContext(ctx, roomNID, targetUserNID)
+	return
+}
+
+// selectInviteActiveForUserInRoom returns a list of sender state key NIDs
+func (s *inviteStatements) selectInviteActiveForUserInRoom(
+	ctx context.Context,
+	targetUserNID types.EventStateKeyNID, roomNID types.RoomNID,
+) ([]types.EventStateKeyNID, error) {
+	rows, err := s.selectInviteActiveForUserInRoomStmt.QueryContext(
+		ctx, targetUserNID, roomNID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInviteActiveForUserInRoom: rows.close() failed")
+	var result []types.EventStateKeyNID
+	for rows.Next() {
+		var senderUserNID int64
+		if err := rows.Scan(&senderUserNID); err != nil {
+			return nil, err
+		}
+		result = append(result, types.EventStateKeyNID(senderUserNID))
+	}
+	return result, nil
+}
+
+// selectInvitesActiveForServer returns the room and target user ID of every
+// active invite for a user on the given server.
+func (s *inviteStatements) selectInvitesActiveForServer(
+	ctx context.Context, serverName string,
+) ([]types.RoomUser, error) {
+	rows, err := s.selectInvitesActiveForServerStmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInvitesActiveForServer: rows.close() failed")
+	var result []types.RoomUser
+	for rows.Next() {
+		var roomUser types.RoomUser
+		if err := rows.Scan(&roomUser.RoomID, &roomUser.UserID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomUser)
+	}
+	return result, rows.Err()
+}
+
+// selectInviteEventIDsActiveForUserInRoom returns the event IDs of the active
+// invites for a user in a room, i.e. the invites that would be retired if the
+// user joined or left the room.
+func (s *inviteStatements) selectInviteEventIDsActiveForUserInRoom(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) ([]string, error) {
+	stmt := common.TxStmt(txn, s.selectInvitesAboutToRetireStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, targetUserNID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInviteEventIDsActiveForUserInRoom: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var inviteEventID string
+		if err := rows.Scan(&inviteEventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, inviteEventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectInviteDistinctSenderCount returns the number of different users that
+// have sent the active invites for a user, across all rooms.
+func (s *inviteStatements) selectInviteDistinctSenderCount(
+	ctx context.Context, targetUserNID types.EventStateKeyNID,
+) (count int, err error) {
+	err = s.selectInviteDistinctSenderCountStmt.QueryRowContext(ctx, targetUserNID).Scan(&count)
+	return
+}
+
+func (s *inviteStatements) selectInvitesActiveForUserBefore(
+	ctx context.Context, targetUserNID types.EventStateKeyNID,
+	beforeTS gomatrixserverlib.Timestamp,
+) ([]types.InviteRecord, error) {
+	rows, err := s.selectInvitesActiveForUserBeforeStmt.QueryContext(ctx, targetUserNID, beforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInvitesActiveForUserBefore: rows.close() failed")
+	var result []types.InviteRecord
+	for rows.Next() {
+		var invite types.InviteRecord
+		if err = rows.Scan(
+			&invite.RoomID, &invite.EventID, &invite.SenderUserID, &invite.OriginServerTS,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, invite)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The purge statements remove everything the roomserver knows about a room.
+// They're run in order, so rows which are found by joining against the
+// events table have to be removed before the events themselves.
+
+const selectRoomStateBlockNIDsSQL = "" +
+	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeStateBlockSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = $1"
+
+const purgeStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN (" +
+	" SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeRejectedEventsSQL = "" +
+	"DELETE FROM roomserver_rejected_events WHERE event_nid IN (" +
+	" SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeTransactionsSQL = "" +
+	"DELETE FROM roomserver_transactions WHERE event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeMembershipAuditSQL = "" +
+	"DELETE FROM roomserver_membership_audit WHERE room_nid = $1"
+
+const purgeAnnounceOnlyRoomSQL = "" +
+	"DELETE FROM roomserver_announce_only_rooms WHERE room_nid = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = (" +
+	" SELECT room_id FROM roomserver_rooms WHERE room_nid = $1" +
+	")"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+type purgeStatements struct {
+	selectRoomStateBlockNIDsStmt *sql.Stmt
+	purgeStateBlockStmt          *sql.Stmt
+	purgeStmts                   []*sql.Stmt
+}
+
+func (s *purgeStatements) prepare(db *sql.DB) (err error) {
+	if err = (statementList{
+		{&s.selectRoomStateBlockNIDsStmt, selectRoomStateBlockNIDsSQL},
+		{&s.purgeStateBlockStmt, purgeStateBlockSQL},
+	}.prepare(db)); err != nil {
+		return
+	}
+	for _, query := range []string{
+		purgeStateSnapshotsSQL,
+		purgeEventJSONSQL,
+		purgeRejectedEventsSQL,
+		purgePreviousEventsSQL,
+		purgeTransactionsSQL,
+		purgeEventsSQL,
+		purgeInvitesSQL,
+		purgeMembershipsSQL,
+		purgeMembershipAuditSQL,
+		purgeAnnounceOnlyRoomSQL,
+		purgeRoomAliasesSQL,
+		purgeRoomSQL,
+	} {
+		var stmt *sql.Stmt
+		if stmt, err = db.Prepare(query); err != nil {
+			return
+		}
+		s.purgeStmts = append(s.purgeStmts, stmt)
+	}
+	return
+}
+
+func (s *purgeStatements) purgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	// The state block NIDs of each snapshot are stored as a JSON array,
+	// so we have to find the state blocks to delete ourselves.
+	stateBlockNIDs, err := s.selectRoomStateBlockNIDs(ctx, txn, roomNID)
+	if err != nil {
+		return err
+	}
+	purgeStateBlockStmt := common.TxStmt(txn, s.purgeStateBlockStmt)
+	for _, stateBlockNID := range stateBlockNIDs {
+		if _, err = purgeStateBlockStmt.ExecContext(ctx, stateBlockNID); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range s.purgeStmts {
+		if _, err := common.TxStmt(txn, stmt).ExecContext(ctx, roomNID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *purgeStatements) selectRoomStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateBlockNID, error) {
+	rows, err := common.TxStmt(txn, s.selectRoomStateBlockNIDsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomStateBlockNIDs: rows.close() failed")
+	seen := make(map[types.StateBlockNID]bool)
+	var result []types.StateBlockNID
+	for rows.Next() {
+		var stateBlockNIDsJSON string
+		if err = rows.Scan(&stateBlockNIDsJSON); err != nil {
+			return nil, err
+		}
+		var stateBlockNIDs []types.StateBlockNID
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &stateBlockNIDs); err != nil {
+			return nil, err
+		}
+		for _, stateBlockNID := range stateBlockNIDs {
+			if !seen[stateBlockNID] {
+				seen[stateBlockNID] = true
+				result = append(result, stateBlockNID)
+			}
+		}
+	}
+	return result, rows.Err()
+}
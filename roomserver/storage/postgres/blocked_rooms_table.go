@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+)
+
+const blockedRoomsSchema = `
+-- The blocked_rooms table stores the rooms which have been shut down by an
+-- admin. Local users can't join these rooms. The rooms are stored by room ID
+-- rather than room NID so that they stay blocked if the room is purged.
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    -- The room ID of the room.
+    room_id TEXT PRIMARY KEY
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteBlockedRoomSQL = "" +
+	"DELETE FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectBlockedRoomSQL = "" +
+	"SELECT room_id FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+type blockedRoomsStatements struct {
+	insertBlockedRoomStmt *sql.Stmt
+	deleteBlockedRoomStmt *sql.Stmt
+	selectBlockedRoomStmt *sql.Stmt
+}
+
+func (s *blockedRoomsStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.deleteBlockedRoomStmt, deleteBlockedRoomSQL},
+		{&s.selectBlockedRoomStmt, selectBlockedRoomSQL},
+	}.prepare(db)
+}
+
+func (s *blockedRoomsStatements) insertBlockedRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.insertBlockedRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) deleteBlockedRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.deleteBlockedRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) selectBlockedRoom(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	var id string
+	err := s.selectBlockedRoomStmt.QueryRowContext(ctx, roomID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -53,19 +53,23 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+// Select the JSON of all of the events in a room.
+const selectRoomEventJSONSQL = "" +
+	"SELECT j.event_json FROM roomserver_event_json j" +
+	" JOIN roomserver_events e ON e.event_nid = j.event_nid" +
+	" WHERE e.room_nid = $1"
+
 type eventJSONStatements struct {
 	insertEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
+	selectRoomEventJSONStmt *sql.Stmt
 }
 
 func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(eventJSONSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectRoomEventJSONStmt, selectRoomEventJSONSQL},
 	}.prepare(db)
 }
 
@@ -106,3 +110,23 @@ func (s *eventJSONStatements) bulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) selectRoomEventJSON(
+	ctx context.Context, roomNID types.RoomNID,
+) ([][]byte, error) {
+	rows, err := s.selectRoomEventJSONStmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomEventJSON: rows.close() failed")
+
+	var eventJSONs [][]byte
+	for rows.Next() {
+		var eventJSON []byte
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		eventJSONs = append(eventJSONs, eventJSON)
+	}
+	return eventJSONs, rows.Err()
+}
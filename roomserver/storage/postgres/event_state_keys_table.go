@@ -48,7 +48,7 @@ INSERT INTO roomserver_event_state_keys (event_state_key_nid, event_state_key) V
 // Same as insertEventTypeNIDSQL
 const insertEventStateKeyNIDSQL = "" +
 	"INSERT INTO roomserver_event_state_keys (event_state_key) VALUES ($1)" +
-	" ON CONFLICT ON CONSTRAINT roomserver_event_state_key_unique" +
+	" ON CONFLICT (event_state_key)" +
 	" DO NOTHING RETURNING (event_state_key_nid)"
 
 const selectEventStateKeyNIDSQL = "" +
@@ -75,10 +75,6 @@ type eventStateKeyStatements struct {
 }
 
 func (s *eventStateKeyStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(eventStateKeysSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertEventStateKeyNIDStmt, insertEventStateKeyNIDSQL},
 		{&s.selectEventStateKeyNIDStmt, selectEventStateKeyNIDSQL},
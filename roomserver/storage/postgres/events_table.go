@@ -62,14 +62,20 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     -- Needed for setting reference hashes when sending new events.
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
-    auth_event_nids BIGINT[] NOT NULL
+    auth_event_nids BIGINT[] NOT NULL,
+    -- The "membership" key from the content of "m.room.member" events, so
+    -- that membership changes can be processed without loading the event
+    -- JSON. This is NULL for other events, and for membership events stored
+    -- before the column was added.
+    membership TEXT
 );
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS membership TEXT;
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
-	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, membership)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))" +
+	" ON CONFLICT (event_id)" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
 
@@ -110,9 +116,16 @@ const bulkSelectEventReferenceSQL = "" +
 const bulkSelectEventIDSQL = "" +
 	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const bulkSelectExistingEventNIDSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE event_nid = ANY($1)"
+
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id = ANY($1)"
 
+const bulkSelectEventMembershipSQL = "" +
+	"SELECT event_nid, membership FROM roomserver_events" +
+	" WHERE event_nid = ANY($1) AND membership IS NOT NULL"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
 
@@ -131,17 +144,14 @@ type eventStatements struct {
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
+	bulkSelectExistingEventNIDStmt         *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
+	bulkSelectEventMembershipStmt          *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
 }
 
 func (s *eventStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(eventsSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertEventStmt, insertEventSQL},
 		{&s.selectEventStmt, selectEventSQL},
@@ -155,6 +165,8 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.bulkSelectEventMembershipStmt, bulkSelectEventMembershipSQL},
+		{&s.bulkSelectExistingEventNIDStmt, bulkSelectExistingEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 	}.prepare(db)
@@ -169,12 +181,13 @@ func (s *eventStatements) insertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	membership string,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, membership,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -392,6 +405,68 @@ func (s *eventStatements) bulkSelectEventID(ctx context.Context, eventNIDs []typ
 	return results, nil
 }
 
+// bulkSelectEventMembership returns a map from numeric event ID to the
+// "membership" of the event. Events which aren't membership events, or whose
+// membership wasn't recorded when they were stored, are omitted from the map.
+func (s *eventStatements) bulkSelectEventMembership(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, error) {
+	rows, err := s.bulkSelectEventMembershipStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "bulkSelectEventMembership: rows.close() failed")
+	results := make(map[types.EventNID]string, len(eventNIDs))
+	for rows.Next() {
+		var eventNID int64
+		var membership string
+		if err = rows.Scan(&eventNID, &membership); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = membership
+	}
+	return results, rows.Err()
+}
+
+// existingEventNIDsChunkSize is the maximum number of event NIDs looked up
+// by a single query in bulkSelectExistingEventNIDs.
+const existingEventNIDsChunkSize = 10000
+
+// bulkSelectExistingEventNIDs returns which of the event NIDs exist in the
+// events table. Large lists are looked up in chunks.
+func (s *eventStatements) bulkSelectExistingEventNIDs(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]bool, error) {
+	results := make(map[types.EventNID]bool, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		results[eventNID] = false
+	}
+	for start := 0; start < len(eventNIDs); start += existingEventNIDsChunkSize {
+		end := start + existingEventNIDsChunkSize
+		if end > len(eventNIDs) {
+			end = len(eventNIDs)
+		}
+		rows, err := s.bulkSelectExistingEventNIDStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs[start:end]))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var eventNID int64
+			if err = rows.Scan(&eventNID); err != nil {
+				common.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventNIDs: rows.close() failed")
+				return nil, err
+			}
+			results[types.EventNID(eventNID)] = true
+		}
+		err = rows.Err()
+		common.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventNIDs: rows.close() failed")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
 // bulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 // If an event ID is not in the database then it is omitted from the map.
 func (s *eventStatements) bulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const inviteSchema = `
@@ -47,7 +48,10 @@ CREATE TABLE IF NOT EXISTS roomserver_invites (
 	-- explicitly when rejecting events over federation.
 	retired BOOLEAN NOT NULL DEFAULT FALSE,
 	-- The invite event JSON.
-	invite_event_json TEXT NOT NULL
+	invite_event_json TEXT NOT NULL,
+	-- The origin_server_ts of the invite event, in milliseconds since the
+	-- epoch. This is used to find stale invites.
+	origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE INDEX IF NOT EXISTS roomserver_invites_active_idx ON roomserver_invites (target_nid, room_nid)
@@ -55,7 +59,7 @@ CREATE INDEX IF NOT EXISTS roomserver_invites_active_idx ON roomserver_invites (
 `
 const insertInviteEventSQL = "" +
 	"INSERT INTO roomserver_invites (invite_event_id, room_nid, target_nid," +
-	" sender_nid, invite_event_json) VALUES ($1, $2, $3, $4, $5)" +
+	" sender_nid, invite_event_json, origin_server_ts) VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT DO NOTHING"
 
 const selectInviteActiveForUserInRoomSQL = "" +
@@ -63,6 +67,34 @@ const selectInviteActiveForUserInRoomSQL = "" +
 	" WHERE target_nid = $1 AND room_nid = $2" +
 	" AND NOT retired"
 
+const selectInviteEventIDsActiveForUserInRoomSQL = "" +
+	"SELECT invite_event_id FROM roomserver_invites" +
+	" WHERE room_nid = $1 AND target_nid = $2" +
+	" AND NOT retired"
+
+// Select the active invites for a user which were sent before a timestamp,
+// oldest first.
+const selectInvitesActiveForUserBeforeSQL = "" +
+	"SELECT r.room_id, i.invite_event_id, COALESCE(k.event_state_key, ''), i.origin_server_ts" +
+	" FROM roomserver_invites AS i" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = i.room_nid" +
+	" LEFT JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = i.sender_nid" +
+	" WHERE i.target_nid = $1 AND NOT i.retired AND i.origin_server_ts < $2" +
+	" ORDER BY i.origin_server_ts ASC"
+
+const selectInviteDistinctSenderCountSQL = "" +
+	"SELECT COUNT(DISTINCT sender_nid) FROM roomserver_invites" +
+	" WHERE target_nid = $1 AND NOT retired"
+
+// Select the active invites for users on a given server. The user IDs are
+// matched on their ":server_name" suffix.
+const selectInvitesActiveForServerSQL = "" +
+	"SELECT r.room_id, k.event_state_key FROM roomserver_invites AS i" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = i.room_nid" +
+	" JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = i.target_nid" +
+	" WHERE NOT i.retired" +
+	" AND right(k.event_state_key, length($1) + 1) = ':' || $1"
+
 // Retire every active invite for a user in a room.
 // Ideally we'd know which invite events were retired by a given update so we
 // wouldn't need to remove every active invite.
@@ -74,21 +106,24 @@ const updateInviteRetiredSQL = "" +
 	" RETURNING invite_event_id"
 
 type inviteStatements struct {
-	insertInviteEventStmt               *sql.Stmt
-	selectInviteActiveForUserInRoomStmt *sql.Stmt
-	updateInviteRetiredStmt             *sql.Stmt
+	insertInviteEventStmt                *sql.Stmt
+	selectInviteActiveForUserInRoomStmt  *sql.Stmt
+	updateInviteRetiredStmt              *sql.Stmt
+	selectInvitesActiveForServerStmt     *sql.Stmt
+	selectInviteDistinctSenderCountStmt  *sql.Stmt
+	selectInvitesActiveForUserBeforeStmt *sql.Stmt
+	selectInviteEventIDsActiveStmt       *sql.Stmt
 }
 
 func (s *inviteStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(inviteSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertInviteEventStmt, insertInviteEventSQL},
 		{&s.selectInviteActiveForUserInRoomStmt, selectInviteActiveForUserInRoomSQL},
 		{&s.updateInviteRetiredStmt, updateInviteRetiredSQL},
+		{&s.selectInvitesActiveForServerStmt, selectInvitesActiveForServerSQL},
+		{&s.selectInviteDistinctSenderCountStmt, selectInviteDistinctSenderCountSQL},
+		{&s.selectInvitesActiveForUserBeforeStmt, selectInvitesActiveForUserBeforeSQL},
+		{&s.selectInviteEventIDsActiveStmt, selectInviteEventIDsActiveForUserInRoomSQL},
 	}.prepare(db)
 }
 
@@ -96,10 +131,10 @@ func (s *inviteStatements) insertInviteEvent(
 	ctx context.Context,
 	txn *sql.Tx, inviteEventID string, roomNID types.RoomNID,
 	targetUserNID, senderUserNID types.EventStateKeyNID,
-	inviteEventJSON []byte,
+	inviteEventJSON []byte, originServerTS gomatrixserverlib.Timestamp,
 ) (bool, error) {
 	result, err := common.TxStmt(txn, s.insertInviteEventStmt).ExecContext(
-		ctx, inviteEventID, roomNID, targetUserNID, senderUserNID, inviteEventJSON,
+		ctx, inviteEventID, roomNID, targetUserNID, senderUserNID, inviteEventJSON, originServerTS,
 	)
 	if err != nil {
 		return false, err
@@ -155,3 +190,77 @@ func (s *inviteStatements) selectInviteActiveForUserInRoom(
 	}
 	return result, rows.Err()
 }
+
+// selectInvitesActiveForServer returns the room and target user ID of every
+// active invite for a user on the given server.
+func (s *inviteStatements) selectInvitesActiveForServer(
+	ctx context.Context, serverName string,
+) ([]types.RoomUser, error) {
+	rows, err := s.selectInvitesActiveForServerStmt.QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInvitesActiveForServer: rows.close() failed")
+	var result []types.RoomUser
+	for rows.Next() {
+		var roomUser types.RoomUser
+		if err := rows.Scan(&roomUser.RoomID, &roomUser.UserID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomUser)
+	}
+	return result, rows.Err()
+}
+
+// selectInviteEventIDsActiveForUserInRoom returns the event IDs of the active
+// invites for a user in a room, i.e. the invites that would be retired if the
+// user joined or left the room.
+func (s *inviteStatements) selectInviteEventIDsActiveForUserInRoom(
+	ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) ([]string, error) {
+	rows, err := s.selectInviteEventIDsActiveStmt.QueryContext(ctx, roomNID, targetUserNID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInviteEventIDsActiveForUserInRoom: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var inviteEventID string
+		if err := rows.Scan(&inviteEventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, inviteEventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectInviteDistinctSenderCount returns the number of different users that
+// have sent the active invites for a user, across all rooms.
+func (s *inviteStatements) selectInviteDistinctSenderCount(
+	ctx context.Context, targetUserNID types.EventStateKeyNID,
+) (count int, err error) {
+	err = s.selectInviteDistinctSenderCountStmt.QueryRowContext(ctx, targetUserNID).Scan(&count)
+	return
+}
+
+func (s *inviteStatements) selectInvitesActiveForUserBefore(
+	ctx context.Context, targetUserNID types.EventStateKeyNID,
+	beforeTS gomatrixserverlib.Timestamp,
+) ([]types.InviteRecord, error) {
+	rows, err := s.selectInvitesActiveForUserBeforeStmt.QueryContext(ctx, targetUserNID, beforeTS)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectInvitesActiveForUserBefore: rows.close() failed")
+	var result []types.InviteRecord
+	for rows.Next() {
+		var invite types.InviteRecord
+		if err = rows.Scan(
+			&invite.RoomID, &invite.EventID, &invite.SenderUserID, &invite.OriginServerTS,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, invite)
+	}
+	return result, rows.Err()
+}
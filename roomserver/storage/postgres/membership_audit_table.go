@@ -0,0 +1,267 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const membershipAuditSchema = `
+-- The membership_audit table records every change in the membership of a user
+-- in the current state of a room, so that the history of who was in a room can
+-- be exported for compliance purposes.
+CREATE SEQUENCE IF NOT EXISTS roomserver_membership_audit_id_seq;
+CREATE TABLE IF NOT EXISTS roomserver_membership_audit (
+    -- Local numeric ID for the change, used to order the changes.
+    audit_id BIGINT PRIMARY KEY DEFAULT nextval('roomserver_membership_audit_id_seq'),
+    -- The numeric ID of the room.
+    room_nid BIGINT NOT NULL,
+    -- The numeric state key ID of the user whose membership changed.
+    target_nid BIGINT NOT NULL,
+    -- The numeric state key ID of the sender of the event.
+    sender_nid BIGINT NOT NULL,
+    -- The membership before and after the change: "invite", "join" or "leave".
+    old_membership TEXT NOT NULL,
+    new_membership TEXT NOT NULL,
+    -- The ID of the event that changed the membership.
+    event_id TEXT NOT NULL,
+    -- When the change was processed, in milliseconds since the epoch.
+    changed_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS roomserver_membership_audit_room_ts_idx
+    ON roomserver_membership_audit (room_nid, changed_ts);
+CREATE INDEX IF NOT EXISTS roomserver_membership_audit_sender_target_idx
+    ON roomserver_membership_audit (sender_nid, target_nid);
+CREATE INDEX IF NOT EXISTS roomserver_membership_audit_ts_idx
+    ON roomserver_membership_audit (changed_ts);
+`
+
+const insertMembershipAuditSQL = "" +
+	"INSERT INTO roomserver_membership_audit" +
+	" (room_nid, target_nid, sender_nid, old_membership, new_membership, event_id, changed_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+const selectMembershipAuditSQL = "" +
+	"SELECT t.event_state_key, s.event_state_key, a.old_membership, a.new_membership, a.event_id, a.changed_ts" +
+	" FROM roomserver_membership_audit AS a" +
+	" JOIN roomserver_event_state_keys AS t ON t.event_state_key_nid = a.target_nid" +
+	" JOIN roomserver_event_state_keys AS s ON s.event_state_key_nid = a.sender_nid" +
+	" WHERE a.room_nid = $1 AND a.changed_ts >= $2" +
+	" ORDER BY a.audit_id ASC"
+
+const selectMembershipAuditBetweenSQL = "" +
+	"SELECT r.room_id, t.event_state_key, s.event_state_key, a.old_membership, a.new_membership, a.event_id, a.changed_ts" +
+	" FROM roomserver_membership_audit AS a" +
+	" JOIN roomserver_event_state_keys AS t ON t.event_state_key_nid = a.target_nid" +
+	" JOIN roomserver_event_state_keys AS s ON s.event_state_key_nid = a.sender_nid" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = a.room_nid" +
+	" WHERE a.changed_ts >= $1 AND a.changed_ts < $2" +
+	" ORDER BY a.room_nid ASC, a.audit_id ASC"
+
+const selectMembershipAuditBySenderAndTargetSQL = "" +
+	"SELECT r.room_id, a.old_membership, a.new_membership, a.event_id, a.changed_ts" +
+	" FROM roomserver_membership_audit AS a" +
+	" JOIN roomserver_event_state_keys AS t ON t.event_state_key_nid = a.target_nid" +
+	" JOIN roomserver_event_state_keys AS s ON s.event_state_key_nid = a.sender_nid" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = a.room_nid" +
+	" WHERE s.event_state_key = $1 AND t.event_state_key = $2" +
+	" ORDER BY a.audit_id ASC"
+
+const selectMembershipAuditUsersWithMembershipSQL = "" +
+	"SELECT DISTINCT t.event_state_key FROM roomserver_membership_audit AS a" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = a.room_nid" +
+	" JOIN roomserver_event_state_keys AS t ON t.event_state_key_nid = a.target_nid" +
+	" WHERE r.room_id = $1 AND a.new_membership = $2 AND t.event_state_key = ANY($3)"
+
+const selectMembershipAuditRecentSQL = "" +
+	"SELECT r.room_id, t.event_state_key, s.event_state_key, a.old_membership, a.new_membership, a.event_id, a.changed_ts" +
+	" FROM roomserver_membership_audit AS a" +
+	" JOIN roomserver_event_state_keys AS t ON t.event_state_key_nid = a.target_nid" +
+	" JOIN roomserver_event_state_keys AS s ON s.event_state_key_nid = a.sender_nid" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = a.room_nid" +
+	" ORDER BY a.changed_ts DESC, a.audit_id DESC" +
+	" LIMIT $1"
+
+type membershipAuditStatements struct {
+	insertMembershipAuditStmt                    *sql.Stmt
+	selectMembershipAuditStmt                    *sql.Stmt
+	selectMembershipAuditBetweenStmt             *sql.Stmt
+	selectMembershipAuditBySenderAndTargetStmt   *sql.Stmt
+	selectMembershipAuditUsersWithMembershipStmt *sql.Stmt
+	selectMembershipAuditRecentStmt              *sql.Stmt
+}
+
+func (s *membershipAuditStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertMembershipAuditStmt, insertMembershipAuditSQL},
+		{&s.selectMembershipAuditStmt, selectMembershipAuditSQL},
+		{&s.selectMembershipAuditBetweenStmt, selectMembershipAuditBetweenSQL},
+		{&s.selectMembershipAuditBySenderAndTargetStmt, selectMembershipAuditBySenderAndTargetSQL},
+		{&s.selectMembershipAuditUsersWithMembershipStmt, selectMembershipAuditUsersWithMembershipSQL},
+		{&s.selectMembershipAuditRecentStmt, selectMembershipAuditRecentSQL},
+	}.prepare(db)
+}
+
+func (s *membershipAuditStatements) insertMembershipAudit(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID, senderUserNID types.EventStateKeyNID,
+	oldMembership, newMembership membershipState, eventID string,
+	changedTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := common.TxStmt(txn, s.insertMembershipAuditStmt)
+	_, err := stmt.ExecContext(
+		ctx, roomNID, targetUserNID, senderUserNID,
+		oldMembership.String(), newMembership.String(), eventID, changedTS,
+	)
+	return err
+}
+
+// selectMembershipAudit calls fn with each membership change in the room at or
+// after the timestamp, oldest first, without loading them all into memory.
+func (s *membershipAuditStatements) selectMembershipAudit(
+	ctx context.Context, roomNID types.RoomNID, sinceTS gomatrixserverlib.Timestamp,
+	fn func(entry types.MembershipAuditEntry) error,
+) error {
+	rows, err := s.selectMembershipAuditStmt.QueryContext(ctx, roomNID, sinceTS)
+	if err != nil {
+		return err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipAudit: rows.close() failed")
+	for rows.Next() {
+		var entry types.MembershipAuditEntry
+		if err = rows.Scan(
+			&entry.TargetUserID, &entry.SenderUserID, &entry.OldMembership,
+			&entry.NewMembership, &entry.EventID, &entry.Timestamp,
+		); err != nil {
+			return err
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// selectMembershipAuditBetween calls fn with each membership change in any room
+// at or after fromTS and before toTS, without loading them all into memory.
+// The changes for each room are contiguous and oldest first.
+func (s *membershipAuditStatements) selectMembershipAuditBetween(
+	ctx context.Context, fromTS, toTS gomatrixserverlib.Timestamp,
+	fn func(entry types.MembershipAuditEntry) error,
+) error {
+	rows, err := s.selectMembershipAuditBetweenStmt.QueryContext(ctx, fromTS, toTS)
+	if err != nil {
+		return err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipAuditBetween: rows.close() failed")
+	for rows.Next() {
+		var entry types.MembershipAuditEntry
+		if err = rows.Scan(
+			&entry.RoomID, &entry.TargetUserID, &entry.SenderUserID, &entry.OldMembership,
+			&entry.NewMembership, &entry.EventID, &entry.Timestamp,
+		); err != nil {
+			return err
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// selectMembershipAuditBySenderAndTarget returns each change in the membership
+// of the target user made by an event sent by the sender, in any room, oldest
+// first.
+func (s *membershipAuditStatements) selectMembershipAuditBySenderAndTarget(
+	ctx context.Context, senderUserID, targetUserID string,
+) ([]types.MembershipAuditEntry, error) {
+	rows, err := s.selectMembershipAuditBySenderAndTargetStmt.QueryContext(ctx, senderUserID, targetUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipAuditBySenderAndTarget: rows.close() failed")
+	var entries []types.MembershipAuditEntry
+	for rows.Next() {
+		entry := types.MembershipAuditEntry{
+			TargetUserID: targetUserID,
+			SenderUserID: senderUserID,
+		}
+		if err = rows.Scan(
+			&entry.RoomID, &entry.OldMembership, &entry.NewMembership,
+			&entry.EventID, &entry.Timestamp,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// selectMembershipAuditUsersWithMembership returns which of the target users'
+// membership in the room has ever changed to the given membership.
+func (s *membershipAuditStatements) selectMembershipAuditUsersWithMembership(
+	ctx context.Context, roomID string, targetUserIDs []string, membership string,
+) (map[string]bool, error) {
+	result := make(map[string]bool, len(targetUserIDs))
+	if len(targetUserIDs) == 0 {
+		return result, nil
+	}
+	rows, err := s.selectMembershipAuditUsersWithMembershipStmt.QueryContext(
+		ctx, roomID, membership, pq.StringArray(targetUserIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipAuditUsersWithMembership: rows.close() failed")
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		result[userID] = true
+	}
+	return result, rows.Err()
+}
+
+// selectMembershipAuditRecent returns the most recent membership changes in
+// any room, up to the limit, newest first.
+func (s *membershipAuditStatements) selectMembershipAuditRecent(
+	ctx context.Context, limit int,
+) ([]types.MembershipAuditEntry, error) {
+	rows, err := s.selectMembershipAuditRecentStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipAuditRecent: rows.close() failed")
+	var entries []types.MembershipAuditEntry
+	for rows.Next() {
+		var entry types.MembershipAuditEntry
+		if err = rows.Scan(
+			&entry.RoomID, &entry.TargetUserID, &entry.SenderUserID, &entry.OldMembership,
+			&entry.NewMembership, &entry.EventID, &entry.Timestamp,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,71 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const rejectedEventsSchema = `
+-- The rejected_events table stores the events which passed the auth checks
+-- against their auth events, and so were stored, but failed them against the
+-- current state of the room (they were "soft-failed"). These events shouldn't
+-- be sent over federation.
+CREATE TABLE IF NOT EXISTS roomserver_rejected_events (
+    -- The numeric ID of the event.
+    event_nid BIGINT PRIMARY KEY
+);
+`
+
+const insertRejectedEventSQL = "" +
+	"INSERT INTO roomserver_rejected_events (event_nid) VALUES ($1)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRejectedEventSQL = "" +
+	"SELECT event_nid FROM roomserver_rejected_events WHERE event_nid = $1"
+
+type rejectedEventsStatements struct {
+	insertRejectedEventStmt *sql.Stmt
+	selectRejectedEventStmt *sql.Stmt
+}
+
+func (s *rejectedEventsStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.insertRejectedEventStmt, insertRejectedEventSQL},
+		{&s.selectRejectedEventStmt, selectRejectedEventSQL},
+	}.prepare(db)
+}
+
+func (s *rejectedEventsStatements) insertRejectedEvent(
+	ctx context.Context, eventNID types.EventNID,
+) error {
+	_, err := s.insertRejectedEventStmt.ExecContext(ctx, eventNID)
+	return err
+}
+
+func (s *rejectedEventsStatements) selectRejectedEvent(
+	ctx context.Context, eventNID types.EventNID,
+) (bool, error) {
+	var nid types.EventNID
+	err := s.selectRejectedEventStmt.QueryRowContext(ctx, eventNID).Scan(&nid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
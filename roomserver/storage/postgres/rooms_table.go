@@ -51,7 +51,7 @@ CREATE TABLE IF NOT EXISTS roomserver_rooms (
 // Same as insertEventTypeNIDSQL
 const insertRoomNIDSQL = "" +
 	"INSERT INTO roomserver_rooms (room_id, room_version) VALUES ($1, $2)" +
-	" ON CONFLICT ON CONSTRAINT roomserver_room_id_unique" +
+	" ON CONFLICT (room_id)" +
 	" DO NOTHING RETURNING (room_nid)"
 
 const selectRoomNIDSQL = "" +
@@ -83,10 +83,6 @@ type roomStatements struct {
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(roomsSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertRoomNIDStmt, insertRoomNIDSQL},
 		{&s.selectRoomNIDStmt, selectRoomNIDSQL},
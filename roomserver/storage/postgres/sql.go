@@ -32,6 +32,11 @@ type statements struct {
 	inviteStatements
 	membershipStatements
 	transactionStatements
+	membershipAuditStatements
+	announceOnlyRoomsStatements
+	rejectedEventsStatements
+	purgeStatements
+	blockedRoomsStatements
 }
 
 func (s *statements) prepare(db *sql.DB) error {
@@ -50,6 +55,11 @@ func (s *statements) prepare(db *sql.DB) error {
 		s.inviteStatements.prepare,
 		s.membershipStatements.prepare,
 		s.transactionStatements.prepare,
+		s.membershipAuditStatements.prepare,
+		s.announceOnlyRoomsStatements.prepare,
+		s.rejectedEventsStatements.prepare,
+		s.purgeStatements.prepare,
+		s.blockedRoomsStatements.prepare,
 	} {
 		if err = prepare(db); err != nil {
 			return err
@@ -88,11 +88,6 @@ type stateBlockStatements struct {
 }
 
 func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(stateDataSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertStateDataStmt, insertStateDataSQL},
 		{&s.selectNextStateBlockNIDStmt, selectNextStateBlockNIDSQL},
@@ -65,11 +65,6 @@ type stateSnapshotStatements struct {
 }
 
 func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(stateSnapshotSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
@@ -52,11 +52,6 @@ type transactionStatements struct {
 }
 
 func (s *transactionStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(transactionsSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertTransactionStmt, insertTransactionSQL},
 		{&s.selectTransactionEventIDStmt, selectTransactionEventIDSQL},
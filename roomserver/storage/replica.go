@@ -0,0 +1,106 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// WithReadReplica returns a database which sends event and state lookups to a
+// read-only Postgres replica of the primary database, and everything else to
+// the primary. Events and state never change once they have been stored, so a
+// lookup that the replica can answer completely is up to date. Lookups that the
+// replica fails or only partly answers, because it hasn't caught up with the
+// primary yet, are retried against the primary.
+func WithReadReplica(
+	primary Database, replicaDataSourceName string, dbProperties common.DbProperties,
+) (Database, error) {
+	replica, err := postgres.OpenReadReplica(replicaDataSourceName, dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &readReplicaDatabase{Database: primary, replica: replica}, nil
+}
+
+type readReplicaDatabase struct {
+	Database
+	replica Database
+}
+
+func (d *readReplicaDatabase) StateBlockNIDs(
+	ctx context.Context, stateNIDs []types.StateSnapshotNID,
+) ([]types.StateBlockNIDList, error) {
+	lists, err := d.replica.StateBlockNIDs(ctx, stateNIDs)
+	if err != nil || len(lists) < len(stateNIDs) {
+		return d.Database.StateBlockNIDs(ctx, stateNIDs)
+	}
+	return lists, nil
+}
+
+func (d *readReplicaDatabase) StateEntries(
+	ctx context.Context, stateBlockNIDs []types.StateBlockNID,
+) ([]types.StateEntryList, error) {
+	lists, err := d.replica.StateEntries(ctx, stateBlockNIDs)
+	if err != nil || len(lists) < len(stateBlockNIDs) {
+		return d.Database.StateEntries(ctx, stateBlockNIDs)
+	}
+	return lists, nil
+}
+
+func (d *readReplicaDatabase) Events(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	events, err := d.replica.Events(ctx, eventNIDs)
+	if err != nil || len(events) < len(eventNIDs) {
+		return d.Database.Events(ctx, eventNIDs)
+	}
+	return events, nil
+}
+
+func (d *readReplicaDatabase) EventsFromIDs(
+	ctx context.Context, eventIDs []string,
+) ([]types.Event, error) {
+	events, err := d.replica.EventsFromIDs(ctx, eventIDs)
+	if err != nil || len(events) < len(eventIDs) {
+		return d.Database.EventsFromIDs(ctx, eventIDs)
+	}
+	return events, nil
+}
+
+func (d *readReplicaDatabase) EventNIDs(
+	ctx context.Context, eventIDs []string,
+) (map[string]types.EventNID, error) {
+	nids, err := d.replica.EventNIDs(ctx, eventIDs)
+	if err != nil || len(nids) < len(eventIDs) {
+		return d.Database.EventNIDs(ctx, eventIDs)
+	}
+	return nids, nil
+}
+
+func (d *readReplicaDatabase) EventIDs(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, error) {
+	ids, err := d.replica.EventIDs(ctx, eventNIDs)
+	if err != nil || len(ids) < len(eventNIDs) {
+		return d.Database.EventIDs(ctx, eventNIDs)
+	}
+	return ids, nil
+}
@@ -69,10 +69,6 @@ type eventStateKeyStatements struct {
 
 func (s *eventStateKeyStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(eventStateKeysSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertEventStateKeyNIDStmt, insertEventStateKeyNIDSQL},
 		{&s.selectEventStateKeyNIDStmt, selectEventStateKeyNIDSQL},
@@ -83,10 +83,6 @@ type eventTypeStatements struct {
 
 func (s *eventTypeStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(eventTypesSchema)
-	if err != nil {
-		return
-	}
 
 	return statementList{
 		{&s.insertEventTypeNIDStmt, insertEventTypeNIDSQL},
@@ -38,13 +38,36 @@ const eventsSchema = `
     depth INTEGER NOT NULL,
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
-    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+    auth_event_nids TEXT NOT NULL DEFAULT '[]',
+    membership TEXT
   );
 `
 
+// SQLite has no ADD COLUMN IF NOT EXISTS, so we check for the membership
+// column ourselves before adding it to tables created before it existed.
+const selectEventsMembershipColumnSQL = "" +
+	"SELECT COUNT(*) FROM pragma_table_info('roomserver_events') WHERE name = 'membership'"
+
+const addEventsMembershipColumnSQL = "" +
+	"ALTER TABLE roomserver_events ADD COLUMN membership TEXT"
+
+// addEventsMembershipColumn adds the membership column to a roomserver_events
+// table which was created before it existed.
+func addEventsMembershipColumn(ctx context.Context, txn *sql.Tx) error {
+	var hasMembership bool
+	if err := txn.QueryRowContext(ctx, selectEventsMembershipColumnSQL).Scan(&hasMembership); err != nil {
+		return err
+	}
+	if hasMembership {
+		return nil
+	}
+	_, err := txn.ExecContext(ctx, addEventsMembershipColumnSQL)
+	return err
+}
+
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, membership)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -85,9 +108,16 @@ const bulkSelectEventReferenceSQL = "" +
 const bulkSelectEventIDSQL = "" +
 	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid IN ($1)"
 
+const bulkSelectExistingEventNIDSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE event_nid IN ($1)"
+
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id IN ($1)"
 
+const bulkSelectEventMembershipSQL = "" +
+	"SELECT event_nid, membership FROM roomserver_events" +
+	" WHERE event_nid IN ($1) AND membership IS NOT NULL"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid IN ($1)"
 
@@ -113,10 +143,6 @@ type eventStatements struct {
 
 func (s *eventStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(eventsSchema)
-	if err != nil {
-		return
-	}
 
 	return statementList{
 		{&s.insertEventStmt, insertEventSQL},
@@ -145,12 +171,13 @@ func (s *eventStatements) insertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	membership string,
 ) (types.EventNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	insertStmt := common.TxStmt(txn, s.insertEventStmt)
 	result, err := insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, membership,
 	)
 	if err != nil {
 		return 0, err
@@ -391,6 +418,58 @@ func (s *eventStatements) bulkSelectEventReference(
 }
 
 // bulkSelectEventID returns a map from numeric event ID to string event ID.
+// existingEventNIDsChunkSize is the maximum number of event NIDs looked up
+// by a single query in bulkSelectExistingEventNIDs. This keeps the number of
+// query parameters below the SQLite limit of 999.
+const existingEventNIDsChunkSize = 500
+
+// bulkSelectExistingEventNIDs returns which of the event NIDs exist in the
+// events table. Large lists are looked up in chunks.
+func (s *eventStatements) bulkSelectExistingEventNIDs(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (map[types.EventNID]bool, error) {
+	results := make(map[types.EventNID]bool, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		results[eventNID] = false
+	}
+	for start := 0; start < len(eventNIDs); start += existingEventNIDsChunkSize {
+		end := start + existingEventNIDsChunkSize
+		if end > len(eventNIDs) {
+			end = len(eventNIDs)
+		}
+		chunk := eventNIDs[start:end]
+		iEventNIDs := make([]interface{}, len(chunk))
+		for k, v := range chunk {
+			iEventNIDs[k] = v
+		}
+		query := strings.Replace(bulkSelectExistingEventNIDSQL, "($1)", common.QueryVariadic(len(iEventNIDs)), 1)
+		var rows *sql.Rows
+		var err error
+		if txn != nil {
+			rows, err = txn.QueryContext(ctx, query, iEventNIDs...)
+		} else {
+			rows, err = s.db.QueryContext(ctx, query, iEventNIDs...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var eventNID int64
+			if err = rows.Scan(&eventNID); err != nil {
+				common.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventNIDs: rows.close() failed")
+				return nil, err
+			}
+			results[types.EventNID(eventNID)] = true
+		}
+		err = rows.Err()
+		common.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventNIDs: rows.close() failed")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
 func (s *eventStatements) bulkSelectEventID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
 	///////////////
 	iEventNIDs := make([]interface{}, len(eventNIDs))
@@ -426,6 +505,43 @@ func (s *eventStatements) bulkSelectEventID(ctx context.Context, txn *sql.Tx, ev
 	return results, nil
 }
 
+// bulkSelectEventMembership returns a map from numeric event ID to the
+// "membership" of the event. Events which aren't membership events, or whose
+// membership wasn't recorded when they were stored, are omitted from the map.
+func (s *eventStatements) bulkSelectEventMembership(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, error) {
+	results := make(map[types.EventNID]string, len(eventNIDs))
+	if len(eventNIDs) == 0 {
+		return results, nil
+	}
+	iEventNIDs := make([]interface{}, len(eventNIDs))
+	for k, v := range eventNIDs {
+		iEventNIDs[k] = v
+	}
+	query := strings.Replace(bulkSelectEventMembershipSQL, "($1)", common.QueryVariadic(len(iEventNIDs)), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, iEventNIDs...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, iEventNIDs...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "bulkSelectEventMembership: rows.close() failed")
+	for rows.Next() {
+		var eventNID int64
+		var membership string
+		if err = rows.Scan(&eventNID, &membership); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = membership
+	}
+	return results, rows.Err()
+}
+
 // bulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 // If an event ID is not in the database then it is omitted from the map.
 func (s *eventStatements) bulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventNID, error) {
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type membershipState int64
@@ -29,8 +30,28 @@ const (
 	membershipStateLeaveOrBan membershipState = 1
 	membershipStateInvite     membershipState = 2
 	membershipStateJoin       membershipState = 3
+	membershipStateKnock      membershipState = 4
 )
 
+// membershipKnock is the "membership" of a user who has knocked on a room.
+// gomatrixserverlib doesn't define it yet.
+const membershipKnock = "knock"
+
+// String returns the "membership" key that corresponds to the state. Leaves
+// and bans are stored with the same state so both are returned as "leave".
+func (m membershipState) String() string {
+	switch m {
+	case membershipStateInvite:
+		return gomatrixserverlib.Invite
+	case membershipStateJoin:
+		return gomatrixserverlib.Join
+	case membershipStateKnock:
+		return membershipKnock
+	default:
+		return gomatrixserverlib.Leave
+	}
+}
+
 const membershipSchema = `
 	CREATE TABLE IF NOT EXISTS roomserver_membership (
 		room_nid INTEGER NOT NULL,
@@ -38,10 +59,33 @@ const membershipSchema = `
 		sender_nid INTEGER NOT NULL DEFAULT 0,
 		membership_nid INTEGER NOT NULL DEFAULT 1,
 		event_nid INTEGER NOT NULL DEFAULT 0,
+		version INTEGER NOT NULL DEFAULT 0,
 		UNIQUE (room_nid, target_nid)
 	);
 `
 
+// SQLite has no ADD COLUMN IF NOT EXISTS, so we check for the version column
+// ourselves before adding it to tables created before it existed.
+const selectMembershipVersionColumnSQL = "" +
+	"SELECT COUNT(*) FROM pragma_table_info('roomserver_membership') WHERE name = 'version'"
+
+const addMembershipVersionColumnSQL = "" +
+	"ALTER TABLE roomserver_membership ADD COLUMN version INTEGER NOT NULL DEFAULT 0"
+
+// addMembershipVersionColumn adds the version column to a roomserver_membership
+// table which was created before it existed.
+func addMembershipVersionColumn(ctx context.Context, txn *sql.Tx) error {
+	var hasVersion bool
+	if err := txn.QueryRowContext(ctx, selectMembershipVersionColumnSQL).Scan(&hasVersion); err != nil {
+		return err
+	}
+	if hasVersion {
+		return nil
+	}
+	_, err := txn.ExecContext(ctx, addMembershipVersionColumnSQL)
+	return err
+}
+
 // Insert a row in to membership table so that it can be locked by the
 // SELECT FOR UPDATE
 const insertMembershipSQL = "" +
@@ -62,35 +106,98 @@ const selectMembershipsFromRoomSQL = "" +
 	" WHERE room_nid = $1"
 
 const selectMembershipForUpdateSQL = "" +
-	"SELECT membership_nid FROM roomserver_membership" +
+	"SELECT membership_nid, version FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND target_nid = $2"
+
+const selectMembershipVersionSQL = "" +
+	"SELECT version FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2"
 
+const selectJoinedMemberCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND membership_nid = $2"
+
+// Select a page of memberships across all rooms, ordered by room and target
+// so that the whole table can be walked using keyset pagination.
+const selectMembershipsAfterSQL = "" +
+	"SELECT m.room_nid, m.target_nid, m.membership_nid, COALESCE(e.event_id, '')" +
+	" FROM roomserver_membership AS m" +
+	" LEFT JOIN roomserver_events AS e ON e.event_nid = m.event_nid" +
+	" WHERE m.room_nid > $1 OR (m.room_nid = $1 AND m.target_nid > $2)" +
+	" ORDER BY m.room_nid, m.target_nid LIMIT $3"
+
+// Select the memberships in a room along with the JSON of the membership
+// events they refer to, so that they can be checked against each other.
+const selectMembershipsWithEventsForRoomSQL = "" +
+	"SELECT k.event_state_key, m.membership_nid, m.event_nid," +
+	" COALESCE(e.event_id, ''), COALESCE(j.event_json, '')" +
+	" FROM roomserver_membership AS m" +
+	" JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = m.target_nid" +
+	" LEFT JOIN roomserver_events AS e ON e.event_nid = m.event_nid" +
+	" LEFT JOIN roomserver_event_json AS j ON j.event_nid = m.event_nid" +
+	" WHERE m.room_nid = $1" +
+	" ORDER BY m.target_nid"
+
+// Select the rooms in which the user is joined or invited, along with the
+// membership, so that they can be left when the user is deactivated.
+const selectActiveRoomsForUserSQL = "" +
+	"SELECT r.room_id, m.membership_nid" +
+	" FROM roomserver_membership AS m" +
+	" JOIN roomserver_event_state_keys AS k ON k.event_state_key_nid = m.target_nid" +
+	" JOIN roomserver_rooms AS r ON r.room_nid = m.room_nid" +
+	" WHERE k.event_state_key = $1 AND m.membership_nid != $2" +
+	" ORDER BY m.room_nid"
+
 const updateMembershipSQL = "" +
-	"UPDATE roomserver_membership SET sender_nid = $1, membership_nid = $2, event_nid = $3" +
+	"UPDATE roomserver_membership SET sender_nid = $1, membership_nid = $2, event_nid = $3, version = version + 1" +
 	" WHERE room_nid = $4 AND target_nid = $5"
 
 type membershipStatements struct {
 	insertMembershipStmt                       *sql.Stmt
 	selectMembershipForUpdateStmt              *sql.Stmt
+	selectMembershipVersionStmt                *sql.Stmt
+	selectJoinedMemberCountStmt                *sql.Stmt
 	selectMembershipFromRoomAndTargetStmt      *sql.Stmt
 	selectMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt              *sql.Stmt
 	updateMembershipStmt                       *sql.Stmt
+	selectMembershipsAfterStmt                 *sql.Stmt
+	selectMembershipsWithEventsForRoomStmt     *sql.Stmt
+	selectActiveRoomsForUserStmt               *sql.Stmt
 }
 
-func (s *membershipStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(membershipSchema)
-	if err != nil {
-		return
-	}
+// membershipRow is a row of the membership table, along with the event ID of
+// the membership event it refers to.
+type membershipRow struct {
+	roomNID    types.RoomNID
+	targetNID  types.EventStateKeyNID
+	membership membershipState
+	eventID    string
+}
+
+// membershipEventRow is a row of the membership table for a room, along with
+// the membership event it refers to, if any.
+type membershipEventRow struct {
+	targetUserID string
+	membership   membershipState
+	eventNID     types.EventNID
+	eventID      string
+	eventJSON    []byte
+}
 
+func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 	return statementList{
 		{&s.insertMembershipStmt, insertMembershipSQL},
 		{&s.selectMembershipForUpdateStmt, selectMembershipForUpdateSQL},
+		{&s.selectMembershipVersionStmt, selectMembershipVersionSQL},
+		{&s.selectJoinedMemberCountStmt, selectJoinedMemberCountSQL},
 		{&s.selectMembershipFromRoomAndTargetStmt, selectMembershipFromRoomAndTargetSQL},
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
+		{&s.selectMembershipsAfterStmt, selectMembershipsAfterSQL},
+		{&s.selectMembershipsWithEventsForRoomStmt, selectMembershipsWithEventsForRoomSQL},
+		{&s.selectActiveRoomsForUserStmt, selectActiveRoomsForUserSQL},
 	}.prepare(db)
 }
 
@@ -106,11 +213,31 @@ func (s *membershipStatements) insertMembership(
 func (s *membershipStatements) selectMembershipForUpdate(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
-) (membership membershipState, err error) {
+) (membership membershipState, version int64, err error) {
 	stmt := common.TxStmt(txn, s.selectMembershipForUpdateStmt)
 	err = stmt.QueryRowContext(
 		ctx, roomNID, targetUserNID,
-	).Scan(&membership)
+	).Scan(&membership, &version)
+	return
+}
+
+func (s *membershipStatements) selectMembershipVersion(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
+) (version int64, err error) {
+	stmt := common.TxStmt(txn, s.selectMembershipVersionStmt)
+	err = stmt.QueryRowContext(
+		ctx, roomNID, targetUserNID,
+	).Scan(&version)
+	return
+}
+
+func (s *membershipStatements) selectJoinedMemberCount(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (count int64, err error) {
+	err = common.TxStmt(txn, s.selectJoinedMemberCountStmt).QueryRowContext(
+		ctx, roomNID, membershipStateJoin,
+	).Scan(&count)
 	return
 }
 
@@ -171,10 +298,137 @@ func (s *membershipStatements) updateMembership(
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	senderUserNID types.EventStateKeyNID, membership membershipState,
 	eventNID types.EventNID,
-) error {
+) (int64, error) {
 	stmt := common.TxStmt(txn, s.updateMembershipStmt)
 	_, err := stmt.ExecContext(
 		ctx, senderUserNID, membership, eventNID, roomNID, targetUserNID,
 	)
-	return err
+	if err != nil {
+		return 0, err
+	}
+	// SQLite doesn't support RETURNING, so read the new version back in the
+	// same transaction instead.
+	return s.selectMembershipVersion(ctx, txn, roomNID, targetUserNID)
+}
+
+// selectMembershipsAfter returns up to limit membership rows which come after
+// the given room and target in the order of the table.
+func (s *membershipStatements) selectMembershipsAfter(
+	ctx context.Context,
+	afterRoomNID types.RoomNID, afterTargetNID types.EventStateKeyNID, limit int,
+) ([]membershipRow, error) {
+	rows, err := s.selectMembershipsAfterStmt.QueryContext(ctx, afterRoomNID, afterTargetNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipsAfter: rows.close() failed")
+
+	var result []membershipRow
+	for rows.Next() {
+		var row membershipRow
+		if err = rows.Scan(&row.roomNID, &row.targetNID, &row.membership, &row.eventID); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (s *membershipStatements) selectMembershipsWithEventsForRoom(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]membershipEventRow, error) {
+	rows, err := s.selectMembershipsWithEventsForRoomStmt.QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectMembershipsWithEventsForRoom: rows.close() failed")
+
+	var result []membershipEventRow
+	for rows.Next() {
+		var row membershipEventRow
+		if err = rows.Scan(
+			&row.targetUserID, &row.membership, &row.eventNID, &row.eventID, &row.eventJSON,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// inconsistency checks the row against the membership event it refers to and
+// returns what is wrong with it, if anything. Invite rows don't refer to the
+// invite event, and leave rows needn't refer to any event, so those are only
+// checked if they refer to an event.
+func (row *membershipEventRow) inconsistency(
+	roomVersion gomatrixserverlib.RoomVersion,
+) *types.MembershipInconsistency {
+	if row.eventNID == 0 && row.membership != membershipStateJoin {
+		return nil
+	}
+	if row.membership == membershipStateInvite {
+		return nil
+	}
+	result := &types.MembershipInconsistency{
+		TargetUserID:     row.targetUserID,
+		EventID:          row.eventID,
+		EventNID:         row.eventNID,
+		StoredMembership: row.membership.String(),
+	}
+	if row.eventID == "" || len(row.eventJSON) == 0 {
+		result.Reason = types.MembershipInconsistencyMissingEvent
+		return result
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(row.eventJSON, false, roomVersion)
+	if err != nil {
+		result.Reason = types.MembershipInconsistencyBadEvent
+		return result
+	}
+	membership, err := event.Membership()
+	if err != nil {
+		result.Reason = types.MembershipInconsistencyBadEvent
+		return result
+	}
+	result.EventMembership = membership
+	if event.StateKey() == nil || *event.StateKey() != row.targetUserID {
+		result.Reason = types.MembershipInconsistencyWrongTarget
+		return result
+	}
+	stored := row.membership.String()
+	if membership == gomatrixserverlib.Ban {
+		// Bans are stored in the same state as leaves.
+		membership = gomatrixserverlib.Leave
+	}
+	if membership != stored {
+		result.Reason = types.MembershipInconsistencyWrongMembership
+		return result
+	}
+	return nil
+}
+
+// selectActiveRoomsForUser returns the IDs of the rooms in which the user is
+// joined and the rooms to which the user is invited.
+func (s *membershipStatements) selectActiveRoomsForUser(
+	ctx context.Context, userID string,
+) (joined, invited []string, err error) {
+	rows, err := s.selectActiveRoomsForUserStmt.QueryContext(ctx, userID, membershipStateLeaveOrBan)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectActiveRoomsForUser: rows.close() failed")
+
+	for rows.Next() {
+		var roomID string
+		var membership membershipState
+		if err = rows.Scan(&roomID, &membership); err != nil {
+			return nil, nil, err
+		}
+		switch membership {
+		case membershipStateJoin:
+			joined = append(joined, roomID)
+		case membershipStateInvite:
+			invited = append(invited, roomID)
+		}
+	}
+	return joined, invited, rows.Err()
 }
@@ -56,11 +56,6 @@ type previousEventStatements struct {
 }
 
 func (s *previousEventStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(previousEventSchema)
-	if err != nil {
-		return
-	}
-
 	return statementList{
 		{&s.insertPreviousEventStmt, insertPreviousEventSQL},
 		{&s.selectPreviousEventExistsStmt, selectPreviousEventExistsSQL},
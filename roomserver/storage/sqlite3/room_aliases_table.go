@@ -61,10 +61,6 @@ type roomAliasesStatements struct {
 }
 
 func (s *roomAliasesStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(roomAliasesSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertRoomAliasStmt, insertRoomAliasSQL},
 		{&s.selectRoomIDFromAliasStmt, selectRoomIDFromAliasSQL},
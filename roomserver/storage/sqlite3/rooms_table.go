@@ -72,10 +72,6 @@ type roomStatements struct {
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(roomsSchema)
-	if err != nil {
-		return
-	}
 	return statementList{
 		{&s.insertRoomNIDStmt, insertRoomNIDSQL},
 		{&s.selectRoomNIDStmt, selectRoomNIDSQL},
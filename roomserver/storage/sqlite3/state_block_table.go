@@ -79,10 +79,6 @@ type stateBlockStatements struct {
 
 func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(stateDataSchema)
-	if err != nil {
-		return
-	}
 
 	return statementList{
 		{&s.insertStateDataStmt, insertStateDataSQL},
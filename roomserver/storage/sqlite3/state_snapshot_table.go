@@ -53,10 +53,6 @@ type stateSnapshotStatements struct {
 
 func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
 	s.db = db
-	_, err = db.Exec(stateSnapshotSchema)
-	if err != nil {
-		return
-	}
 
 	return statementList{
 		{&s.insertStateStmt, insertStateSQL},
@@ -20,7 +20,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/url"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 
@@ -28,9 +30,12 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// streamMembershipsBatchSize is the number of membership rows that
+// StreamAllMemberships reads from the database at a time.
+const streamMembershipsBatchSize = 1000
+
 // A Database is used to store room events and stream offsets.
 type Database struct {
 	statements statements
@@ -55,6 +60,9 @@ func Open(dataSourceName string) (*Database, error) {
 	if d.db, err = sqlutil.Open(common.SQLiteDriverName(), cs, nil); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(d.db, "roomserver", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	//d.db.Exec("PRAGMA journal_mode=WAL;")
 	//d.db.Exec("PRAGMA read_uncommitted = true;")
 
@@ -124,6 +132,13 @@ func (d *Database) StoreEvent(
 			}
 		}
 
+		// Record the membership of membership events so that membership
+		// changes can be processed without loading the event JSON.
+		var membership string
+		if event.Type() == gomatrixserverlib.MRoomMember {
+			membership, _ = event.Membership()
+		}
+
 		if eventNID, err = d.statements.insertEvent(
 			ctx,
 			txn,
@@ -134,6 +149,7 @@ func (d *Database) StoreEvent(
 			event.EventReference().EventSHA256,
 			authEventNIDs,
 			event.Depth(),
+			membership,
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -293,6 +309,13 @@ func (d *Database) EventNIDs(
 	return
 }
 
+// EventMemberships implements input.EventDatabase
+func (d *Database) EventMemberships(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, error) {
+	return d.statements.bulkSelectEventMembership(ctx, nil, eventNIDs)
+}
+
 // Events implements input.EventDatabase
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
@@ -577,6 +600,15 @@ func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventSta
 	return
 }
 
+// JoinedMemberCount implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) JoinedMemberCount() (count int64, err error) {
+	err = common.WithTransaction(u.d.db, func(txn *sql.Tx) error {
+		count, err = u.d.statements.selectJoinedMemberCount(u.ctx, txn, u.roomNID)
+		return err
+	})
+	return
+}
+
 // RoomNID implements query.RoomserverQueryAPIDB
 func (d *Database) RoomNID(ctx context.Context, roomID string) (roomNID types.RoomNID, err error) {
 	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
@@ -639,6 +671,27 @@ func (d *Database) GetInvitesForUser(
 	return d.statements.selectInviteActiveForUserInRoom(ctx, targetUserNID, roomNID)
 }
 
+// PendingRemoteInvites implements query.RoomserverQueryAPIDatabase
+func (d *Database) PendingRemoteInvites(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]types.RoomUser, error) {
+	return d.statements.selectInvitesActiveForServer(ctx, string(serverName))
+}
+
+// DistinctInviterCount implements query.RoomserverQueryAPIDatabase
+func (d *Database) DistinctInviterCount(ctx context.Context, targetUserID string) (int, error) {
+	stateKeyNIDs, err := d.EventStateKeyNIDs(ctx, []string{targetUserID})
+	if err != nil {
+		return 0, err
+	}
+	targetUserNID, ok := stateKeyNIDs[targetUserID]
+	if !ok {
+		// We've never seen this user before so nobody can have invited them.
+		return 0, nil
+	}
+	return d.statements.selectInviteDistinctSenderCount(ctx, targetUserNID)
+}
+
 // SetRoomAlias implements alias.RoomserverAliasAPIDB
 func (d *Database) SetRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) error {
 	return d.statements.insertRoomAlias(ctx, nil, alias, roomID, creatorUserID)
@@ -731,6 +784,7 @@ type membershipUpdater struct {
 	roomNID       types.RoomNID
 	targetUserNID types.EventStateKeyNID
 	membership    membershipState
+	version       int64
 }
 
 func (d *Database) membershipUpdaterTxn(
@@ -744,14 +798,14 @@ func (d *Database) membershipUpdaterTxn(
 		return nil, err
 	}
 
-	membership, err := d.statements.selectMembershipForUpdate(ctx, txn, roomNID, targetUserNID)
+	membership, version, err := d.statements.selectMembershipForUpdate(ctx, txn, roomNID, targetUserNID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &membershipUpdater{
 		// purposefully set the txn to nil so if we try to use it we panic and fail fast
-		transaction{ctx, nil}, d, roomNID, targetUserNID, membership,
+		transaction{ctx, nil}, d, roomNID, targetUserNID, membership, version,
 	}, nil
 }
 
@@ -779,16 +833,20 @@ func (u *membershipUpdater) SetToInvite(event gomatrixserverlib.Event) (inserted
 		}
 		inserted, err = u.d.statements.insertInviteEvent(
 			u.ctx, txn, event.EventID(), u.roomNID, u.targetUserNID, senderUserNID, event.JSON(),
+			event.OriginServerTS(),
 		)
 		if err != nil {
 			return err
 		}
 		if u.membership != membershipStateInvite {
-			if err = u.d.statements.updateMembership(
+			if u.version, err = u.d.statements.updateMembership(
 				u.ctx, txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateInvite, 0,
 			); err != nil {
 				return err
 			}
+			if err = u.audit(txn, senderUserNID, membershipStateInvite, event.EventID()); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -820,13 +878,18 @@ func (u *membershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 		}
 
 		if u.membership != membershipStateJoin || isUpdate {
-			if err = u.d.statements.updateMembership(
+			if u.version, err = u.d.statements.updateMembership(
 				u.ctx, txn, u.roomNID, u.targetUserNID, senderUserNID,
 				membershipStateJoin, nIDs[eventID],
 			); err != nil {
 				return err
 			}
 		}
+		if u.membership != membershipStateJoin {
+			if err = u.audit(txn, senderUserNID, membershipStateJoin, eventID); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 
@@ -854,18 +917,182 @@ func (u *membershipUpdater) SetToLeave(senderUserID string, eventID string) (inv
 		}
 
 		if u.membership != membershipStateLeaveOrBan {
-			if err = u.d.statements.updateMembership(
+			if u.version, err = u.d.statements.updateMembership(
 				u.ctx, txn, u.roomNID, u.targetUserNID, senderUserNID,
 				membershipStateLeaveOrBan, nIDs[eventID],
 			); err != nil {
 				return err
 			}
+			if err = u.audit(txn, senderUserNID, membershipStateLeaveOrBan, eventID); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 	return
 }
 
+// SetToKnock implements types.MembershipUpdater
+func (u *membershipUpdater) SetToKnock(senderUserID string, eventID string) error {
+	return common.WithTransaction(u.d.db, func(txn *sql.Tx) error {
+		senderUserNID, err := u.d.assignStateKeyNID(u.ctx, txn, senderUserID)
+		if err != nil {
+			return err
+		}
+
+		// Look up the NID of the new knock event
+		nIDs, err := u.d.EventNIDs(u.ctx, []string{eventID})
+		if err != nil {
+			return err
+		}
+
+		if u.membership != membershipStateKnock {
+			if u.version, err = u.d.statements.updateMembership(
+				u.ctx, txn, u.roomNID, u.targetUserNID, senderUserNID,
+				membershipStateKnock, nIDs[eventID],
+			); err != nil {
+				return err
+			}
+			if err = u.audit(txn, senderUserNID, membershipStateKnock, eventID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MembershipVersion implements types.MembershipUpdater
+func (u *membershipUpdater) MembershipVersion() int64 {
+	return u.version
+}
+
+// audit records the change in membership in the membership audit log.
+func (u *membershipUpdater) audit(
+	txn *sql.Tx, senderUserNID types.EventStateKeyNID,
+	newMembership membershipState, eventID string,
+) error {
+	return u.d.statements.insertMembershipAudit(
+		u.ctx, txn, u.roomNID, u.targetUserNID, senderUserNID,
+		u.membership, newMembership, eventID,
+		gomatrixserverlib.AsTimestamp(time.Now()),
+	)
+}
+
+// MembershipPreviewUpdater implements query.RoomserverQueryAPIDatabase
+func (d *Database) MembershipPreviewUpdater(
+	ctx context.Context, roomNID types.RoomNID, targetUserID string,
+) (types.EventNID, types.MembershipUpdater, error) {
+	preview := &membershipPreviewUpdater{membership: membershipStateLeaveOrBan}
+	stateKeyNIDs, err := d.EventStateKeyNIDs(ctx, []string{targetUserID})
+	if err != nil {
+		return 0, nil, err
+	}
+	targetUserNID, ok := stateKeyNIDs[targetUserID]
+	if !ok {
+		// We've never seen this user before so they can't be in the room.
+		return 0, preview, nil
+	}
+	membershipEventNID, membership, err := d.statements.selectMembershipFromRoomAndTarget(
+		ctx, nil, roomNID, targetUserNID,
+	)
+	if err == sql.ErrNoRows {
+		// The user has never been a member of that room
+		return 0, preview, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	preview.membership = membership
+	preview.version, err = d.statements.selectMembershipVersion(ctx, nil, roomNID, targetUserNID)
+	if err != nil {
+		return 0, nil, err
+	}
+	preview.inviteEventIDs, err = d.statements.selectInviteEventIDsActiveForUserInRoom(
+		ctx, nil, roomNID, targetUserNID,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	return membershipEventNID, preview, nil
+}
+
+// membershipPreviewUpdater is a types.MembershipUpdater which reports what
+// each update would do without writing anything to the database.
+type membershipPreviewUpdater struct {
+	membership     membershipState
+	version        int64
+	inviteEventIDs []string
+}
+
+// IsInvite implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) IsInvite() bool {
+	return u.membership == membershipStateInvite
+}
+
+// IsJoin implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) IsJoin() bool {
+	return u.membership == membershipStateJoin
+}
+
+// IsLeave implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) IsLeave() bool {
+	return u.membership == membershipStateLeaveOrBan
+}
+
+// SetToInvite implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, error) {
+	if u.membership != membershipStateInvite {
+		u.version++
+	}
+	for _, eventID := range u.inviteEventIDs {
+		if eventID == event.EventID() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SetToJoin implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) SetToJoin(senderUserID string, eventID string, isUpdate bool) ([]string, error) {
+	if u.membership != membershipStateJoin || isUpdate {
+		u.version++
+	}
+	if isUpdate {
+		return nil, nil
+	}
+	return u.inviteEventIDs, nil
+}
+
+// SetToLeave implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) SetToLeave(senderUserID string, eventID string) ([]string, error) {
+	if u.membership != membershipStateLeaveOrBan {
+		u.version++
+	}
+	return u.inviteEventIDs, nil
+}
+
+// SetToKnock implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) SetToKnock(senderUserID string, eventID string) error {
+	if u.membership != membershipStateKnock {
+		u.version++
+	}
+	return nil
+}
+
+// MembershipVersion implements types.MembershipUpdater
+func (u *membershipPreviewUpdater) MembershipVersion() int64 {
+	return u.version
+}
+
+// Commit implements types.Transaction
+func (u *membershipPreviewUpdater) Commit() error {
+	return nil
+}
+
+// Rollback implements types.Transaction
+func (u *membershipPreviewUpdater) Rollback() error {
+	return nil
+}
+
 // GetMembership implements query.RoomserverQueryAPIDB
 func (d *Database) GetMembership(
 	ctx context.Context, roomNID types.RoomNID, requestSenderUserID string,
@@ -894,6 +1121,48 @@ func (d *Database) GetMembership(
 	return
 }
 
+// BannedUsersInRoom implements query.RoomserverQueryAPIDatabase
+func (d *Database) BannedUsersInRoom(
+	ctx context.Context, roomID string,
+) ([]types.BannedUser, error) {
+	roomNID, err := d.RoomNID(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return nil, err
+	}
+	// Bans are stored with the same membership state as leaves, so we need to
+	// look at the membership events themselves to tell them apart.
+	leaveEventNIDs, err := d.statements.selectMembershipsFromRoomAndMembership(
+		ctx, nil, roomNID, membershipStateLeaveOrBan,
+	)
+	if err != nil {
+		return nil, err
+	}
+	eventNIDs := make([]types.EventNID, 0, len(leaveEventNIDs))
+	for _, eventNID := range leaveEventNIDs {
+		if eventNID != 0 {
+			eventNIDs = append(eventNIDs, eventNID)
+		}
+	}
+	events, err := d.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.BannedUser
+	for _, event := range events {
+		content, err := gomatrixserverlib.NewMemberContentFromEvent(event.Event)
+		if err != nil || content.Membership != gomatrixserverlib.Ban || event.StateKey() == nil {
+			continue
+		}
+		result = append(result, types.BannedUser{
+			UserID:   *event.StateKey(),
+			BannedBy: event.Sender(),
+			EventID:  event.EventID(),
+			Reason:   content.Reason,
+		})
+	}
+	return result, nil
+}
+
 // GetMembershipEventNIDsForRoom implements query.RoomserverQueryAPIDB
 func (d *Database) GetMembershipEventNIDsForRoom(
 	ctx context.Context, roomNID types.RoomNID, joinOnly bool,
@@ -912,6 +1181,39 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return
 }
 
+// StreamAllMemberships implements storage.Database
+func (d *Database) StreamAllMemberships(
+	ctx context.Context,
+	fn func(roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, membership, eventID string) error,
+) error {
+	var afterRoomNID types.RoomNID
+	var afterTargetNID types.EventStateKeyNID
+	for {
+		rows, err := d.statements.selectMembershipsAfter(
+			ctx, afterRoomNID, afterTargetNID, streamMembershipsBatchSize,
+		)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			// Invite rows refer to the previous leave event, if any, rather
+			// than to the invite, so don't return an event ID for them.
+			eventID := row.eventID
+			if row.membership == membershipStateInvite {
+				eventID = ""
+			}
+			if err = fn(row.roomNID, row.targetNID, row.membership.String(), eventID); err != nil {
+				return err
+			}
+		}
+		if len(rows) < streamMembershipsBatchSize {
+			return nil
+		}
+		last := rows[len(rows)-1]
+		afterRoomNID, afterTargetNID = last.roomNID, last.targetNID
+	}
+}
+
 // EventsFromIDs implements query.RoomserverQueryAPIEventDB
 func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
 	nidMap, err := d.EventNIDs(ctx, eventIDs)
@@ -963,3 +1265,170 @@ func (t *transaction) Rollback() error {
 	}
 	return t.txn.Rollback()
 }
+
+// ExportMembershipAudit implements query.RoomserverQueryAPIDatabase
+func (d *Database) ExportMembershipAudit(
+	ctx context.Context, roomID string, since time.Time, format string, w io.Writer,
+) error {
+	aw, err := types.NewMembershipAuditWriter(format, w)
+	if err != nil {
+		return err
+	}
+	roomNID, err := d.RoomNID(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if roomNID != 0 {
+		err = d.statements.selectMembershipAudit(
+			ctx, roomNID, gomatrixserverlib.AsTimestamp(since),
+			func(entry types.MembershipAuditEntry) error {
+				entry.RoomID = roomID
+				return aw.Write(entry)
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Flush()
+}
+
+// MembershipAuditBetween implements query.RoomserverQueryAPIDatabase
+func (d *Database) MembershipAuditBetween(
+	ctx context.Context, from, to time.Time,
+	fn func(entry types.MembershipAuditEntry) error,
+) error {
+	return d.statements.selectMembershipAuditBetween(
+		ctx, gomatrixserverlib.AsTimestamp(from), gomatrixserverlib.AsTimestamp(to), fn,
+	)
+}
+
+// ActorTargetInteractions implements query.RoomserverQueryAPIDatabase
+func (d *Database) ActorTargetInteractions(
+	ctx context.Context, actorUserID, targetUserID string,
+) ([]types.MembershipAuditEntry, error) {
+	return d.statements.selectMembershipAuditBySenderAndTarget(ctx, actorUserID, targetUserID)
+}
+
+// RecentMembershipTransitions implements query.RoomserverQueryAPIDatabase
+func (d *Database) RecentMembershipTransitions(
+	ctx context.Context, limit int,
+) ([]types.MembershipAuditEntry, error) {
+	return d.statements.selectMembershipAuditRecent(ctx, limit)
+}
+
+// UsersJoinedRoomBefore implements query.RoomserverQueryAPIDatabase
+func (d *Database) UsersJoinedRoomBefore(
+	ctx context.Context, roomID string, userIDs []string,
+) (map[string]bool, error) {
+	return d.statements.selectMembershipAuditUsersWithMembership(ctx, roomID, userIDs, gomatrixserverlib.Join)
+}
+
+// VerifyMembershipConsistency implements query.RoomserverQueryAPIDatabase
+func (d *Database) VerifyMembershipConsistency(
+	ctx context.Context, roomID string,
+) ([]types.MembershipInconsistency, error) {
+	roomNID, err := d.RoomNID(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return nil, err
+	}
+	roomVersion, err := d.GetRoomVersionForRoomNID(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.statements.selectMembershipsWithEventsForRoom(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.MembershipInconsistency
+	for i := range rows {
+		if inconsistency := rows[i].inconsistency(roomVersion); inconsistency != nil {
+			result = append(result, *inconsistency)
+		}
+	}
+	return result, nil
+}
+
+// ActiveRoomsForUser implements query.RoomserverQueryAPIDatabase
+func (d *Database) ActiveRoomsForUser(
+	ctx context.Context, userID string,
+) (joined, invited []string, err error) {
+	return d.statements.selectActiveRoomsForUser(ctx, userID)
+}
+
+// SetRoomAnnounceOnly implements query.RoomserverQueryAPIDatabase
+func (d *Database) SetRoomAnnounceOnly(
+	ctx context.Context, roomNID types.RoomNID, announceOnly bool,
+) error {
+	if announceOnly {
+		return d.statements.insertAnnounceOnlyRoom(ctx, roomNID)
+	}
+	return d.statements.deleteAnnounceOnlyRoom(ctx, roomNID)
+}
+
+// SetRoomBlocked implements query.RoomserverQueryAPIDatabase
+func (d *Database) SetRoomBlocked(
+	ctx context.Context, roomID string, blocked bool,
+) error {
+	if blocked {
+		return d.statements.insertBlockedRoom(ctx, roomID)
+	}
+	return d.statements.deleteBlockedRoom(ctx, roomID)
+}
+
+// IsRoomBlocked implements query.RoomserverQueryAPIDatabase
+func (d *Database) IsRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	return d.statements.selectBlockedRoom(ctx, roomID)
+}
+
+// RoomEventJSON implements query.RoomserverQueryAPIDatabase
+func (d *Database) RoomEventJSON(ctx context.Context, roomNID types.RoomNID) ([][]byte, error) {
+	return d.statements.selectRoomEventJSON(ctx, roomNID)
+}
+
+// PurgeRoom implements query.RoomserverQueryAPIDatabase
+func (d *Database) PurgeRoom(ctx context.Context, roomNID types.RoomNID) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.statements.purgeRoom(ctx, txn, roomNID)
+	})
+}
+
+// MarkEventRejected implements query.RoomserverQueryAPIDatabase
+func (d *Database) MarkEventRejected(ctx context.Context, eventNID types.EventNID) error {
+	return d.statements.insertRejectedEvent(ctx, eventNID)
+}
+
+// EventRejected implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventRejected(ctx context.Context, eventNID types.EventNID) (bool, error) {
+	return d.statements.selectRejectedEvent(ctx, eventNID)
+}
+
+// IsRoomAnnounceOnly implements query.RoomserverQueryAPIDatabase
+func (d *Database) IsRoomAnnounceOnly(ctx context.Context, roomNID types.RoomNID) (bool, error) {
+	return d.statements.selectAnnounceOnlyRoom(ctx, roomNID)
+}
+
+// StaleInvitesForUser implements query.RoomserverQueryAPIDatabase
+func (d *Database) StaleInvitesForUser(
+	ctx context.Context, userID string, olderThan time.Time,
+) ([]types.InviteRecord, error) {
+	stateKeyNIDs, err := d.EventStateKeyNIDs(ctx, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	targetUserNID, ok := stateKeyNIDs[userID]
+	if !ok {
+		// We've never seen this user before so they can't have any invites.
+		return nil, nil
+	}
+	return d.statements.selectInvitesActiveForUserBefore(
+		ctx, targetUserNID, gomatrixserverlib.AsTimestamp(olderThan),
+	)
+}
+
+// EventsExist implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventsExist(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]bool, error) {
+	return d.statements.bulkSelectExistingEventNIDs(ctx, nil, eventNIDs)
+}
@@ -20,6 +20,7 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/storage/mysql"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
 	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
 )
@@ -31,8 +32,10 @@ func Open(dataSourceName string, dbProperties common.DbProperties) (Database, er
 		return postgres.Open(dataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
-	case "postgres":
+	case "postgres", "cockroachdb":
 		return postgres.Open(dataSourceName, dbProperties)
+	case "mysql":
+		return mysql.Open(dataSourceName, dbProperties)
 	case "file":
 		return sqlite3.Open(dataSourceName)
 	default:
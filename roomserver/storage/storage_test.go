@@ -0,0 +1,909 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	ctx             = context.Background()
+	emptyStateKey   = ""
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testRoomID      = fmt.Sprintf("!hallownest:%s", testOrigin)
+	testUserID      = fmt.Sprintf("@hornet:%s", testOrigin)
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testKeyID       = gomatrixserverlib.KeyID("ed25519:storage_test")
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+// mustCreateDatabase creates an empty database, which is on the server named by
+// DENDRITE_TEST_DATABASE if it is set. The returned function removes it again.
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.Open(dataSource, nil)
+	if err != nil {
+		closeDB()
+		t.Fatalf("storage.Open returned %s", err)
+	}
+	return db, closeDB
+}
+
+// mustBuildEvent builds and signs an event in the test room which follows the
+// previous event, if any.
+func mustBuildEvent(
+	t *testing.T, b gomatrixserverlib.EventBuilder, prev *gomatrixserverlib.Event,
+) gomatrixserverlib.Event {
+	return mustBuildEventAt(t, b, prev, time.Now())
+}
+
+// mustBuildEventAt is mustBuildEvent with the origin_server_ts of the event.
+func mustBuildEventAt(
+	t *testing.T, b gomatrixserverlib.EventBuilder, prev *gomatrixserverlib.Event, ts time.Time,
+) gomatrixserverlib.Event {
+	b.RoomID = testRoomID
+	if b.Sender == "" {
+		b.Sender = testUserID
+	}
+	b.Depth = 1
+	if prev != nil {
+		b.Depth = prev.Depth() + 1
+		b.PrevEvents = []string{prev.EventID()}
+	}
+	e, err := b.Build(ts, testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return e
+}
+
+// mustCreateRoom returns the create and join events of a new room, followed by
+// a message.
+func mustCreateRoom(t *testing.T) []gomatrixserverlib.Event {
+	var events []gomatrixserverlib.Event
+	for _, b := range []gomatrixserverlib.EventBuilder{
+		{
+			Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testUserID)),
+			Type:     "m.room.create",
+			StateKey: &emptyStateKey,
+		},
+		{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     "m.room.member",
+			StateKey: &testUserID,
+		},
+		{
+			Content: []byte(`{"body":"Shaw!","msgtype":"m.text"}`),
+			Type:    "m.room.message",
+		},
+	} {
+		var prev *gomatrixserverlib.Event
+		if len(events) > 0 {
+			prev = &events[len(events)-1]
+		}
+		events = append(events, mustBuildEvent(t, b, prev))
+	}
+	return events
+}
+
+// mustBuildMemberEvent builds a membership event for the target user which
+// follows the previous event.
+func mustBuildMemberEvent(
+	t *testing.T, prev gomatrixserverlib.Event, sender, target, membership string,
+) gomatrixserverlib.Event {
+	return mustBuildEvent(t, gomatrixserverlib.EventBuilder{
+		Content:  []byte(fmt.Sprintf(`{"membership":%q}`, membership)),
+		Type:     "m.room.member",
+		Sender:   sender,
+		StateKey: &target,
+	}, &prev)
+}
+
+// mustStoreEvents stores the events, returning the NID of their room.
+func mustStoreEvents(t *testing.T, db storage.Database, events []gomatrixserverlib.Event) types.RoomNID {
+	var roomNID types.RoomNID
+	for _, event := range events {
+		var err error
+		if roomNID, _, err = db.StoreEvent(ctx, event, nil, nil); err != nil {
+			t.Fatalf("StoreEvent returned %s", err)
+		}
+	}
+	return roomNID
+}
+
+// mustSetMembership updates the membership of the target of the membership
+// event, as the roomserver does when the event is added to the current state.
+func mustSetMembership(t *testing.T, db storage.Database, event gomatrixserverlib.Event) {
+	updater, err := db.MembershipUpdater(ctx, event.RoomID(), *event.StateKey(), testRoomVersion)
+	if err != nil {
+		t.Fatalf("MembershipUpdater returned %s", err)
+	}
+	membership, err := event.Membership()
+	if err != nil {
+		t.Fatalf("failed to get membership: %s", err)
+	}
+	switch membership {
+	case gomatrixserverlib.Invite:
+		_, err = updater.SetToInvite(event)
+	case gomatrixserverlib.Join:
+		_, err = updater.SetToJoin(event.Sender(), event.EventID(), false)
+	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		_, err = updater.SetToLeave(event.Sender(), event.EventID())
+	default:
+		err = updater.SetToKnock(event.Sender(), event.EventID())
+	}
+	if err != nil {
+		t.Fatalf("failed to set membership to %s: %s", membership, err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit returned %s", err)
+	}
+}
+
+// mustAddMemberships builds, stores and applies a membership event for each
+// of the changes, in order, after the events, returning all of the events.
+func mustAddMemberships(
+	t *testing.T, db storage.Database, events []gomatrixserverlib.Event, changes ...[3]string,
+) []gomatrixserverlib.Event {
+	for _, change := range changes {
+		event := mustBuildMemberEvent(t, events[len(events)-1], change[0], change[1], change[2])
+		mustStoreEvents(t, db, []gomatrixserverlib.Event{event})
+		mustSetMembership(t, db, event)
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestStoreEvents(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+
+	var roomNID types.RoomNID
+	var state []types.StateEntry
+	var eventIDs []string
+	for _, event := range events {
+		var stateAtEvent types.StateAtEvent
+		var err error
+		roomNID, stateAtEvent, err = db.StoreEvent(ctx, event, nil, nil)
+		if err != nil {
+			t.Fatalf("StoreEvent returned %s", err)
+		}
+		if event.StateKey() != nil {
+			state = append(state, stateAtEvent.StateEntry)
+		}
+		eventIDs = append(eventIDs, event.EventID())
+	}
+
+	if nid, err := db.RoomNID(ctx, testRoomID); err != nil || nid != roomNID {
+		t.Fatalf("RoomNID: expected %d, got %d (%v)", roomNID, nid, err)
+	}
+	roomVersion, err := db.GetRoomVersionForRoom(ctx, testRoomID)
+	if err != nil || roomVersion != testRoomVersion {
+		t.Fatalf("GetRoomVersionForRoom: expected %s, got %s (%v)", testRoomVersion, roomVersion, err)
+	}
+
+	eventNIDs, err := db.EventNIDs(ctx, eventIDs)
+	if err != nil || len(eventNIDs) != len(events) {
+		t.Fatalf("EventNIDs: expected %d events, got %v (%v)", len(events), eventNIDs, err)
+	}
+	stored, err := db.EventsFromIDs(ctx, eventIDs)
+	if err != nil || len(stored) != len(events) {
+		t.Fatalf("EventsFromIDs: expected %d events, got %d (%v)", len(events), len(stored), err)
+	}
+	for i := range stored {
+		if stored[i].EventID() != eventIDs[i] || stored[i].EventNID != eventNIDs[eventIDs[i]] {
+			t.Errorf("EventsFromIDs: event %d is %s (%d)", i, stored[i].EventID(), stored[i].EventNID)
+		}
+	}
+	memberships, err := db.EventMemberships(ctx, []types.EventNID{eventNIDs[eventIDs[1]]})
+	if err != nil || memberships[eventNIDs[eventIDs[1]]] != "join" {
+		t.Errorf("EventMemberships: expected a join, got %v (%v)", memberships, err)
+	}
+
+	// The state after the join is the create and join events.
+	stateNID, err := db.AddState(ctx, roomNID, nil, state)
+	if err != nil {
+		t.Fatalf("AddState returned %s", err)
+	}
+	messageNID := eventNIDs[eventIDs[2]]
+	if err = db.SetState(ctx, messageNID, stateNID); err != nil {
+		t.Fatalf("SetState returned %s", err)
+	}
+	if nid, err := db.SnapshotNIDFromEventID(ctx, eventIDs[2]); err != nil || nid != stateNID {
+		t.Fatalf("SnapshotNIDFromEventID: expected %d, got %d (%v)", stateNID, nid, err)
+	}
+	blockNIDs, err := db.StateBlockNIDs(ctx, []types.StateSnapshotNID{stateNID})
+	if err != nil || len(blockNIDs) != 1 || len(blockNIDs[0].StateBlockNIDs) != 1 {
+		t.Fatalf("StateBlockNIDs: expected one block, got %v (%v)", blockNIDs, err)
+	}
+	stateEntries, err := db.StateEntries(ctx, blockNIDs[0].StateBlockNIDs)
+	if err != nil || len(stateEntries) != 1 {
+		t.Fatalf("StateEntries: expected one block, got %v (%v)", stateEntries, err)
+	}
+	if len(stateEntries[0].StateEntries) != len(state) {
+		t.Fatalf("StateEntries: expected %v, got %v", state, stateEntries[0].StateEntries)
+	}
+	for i := range state {
+		if stateEntries[0].StateEntries[i] != state[i] {
+			t.Errorf("StateEntries: expected %v, got %v", state[i], stateEntries[0].StateEntries[i])
+		}
+	}
+
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("GetLatestEventsForUpdate returned %s", err)
+	}
+	latest := []types.StateAtEventAndReference{{
+		StateAtEvent:   types.StateAtEvent{BeforeStateSnapshotNID: stateNID, StateEntry: types.StateEntry{EventNID: messageNID}},
+		EventReference: events[2].EventReference(),
+	}}
+	if err = updater.SetLatestEvents(roomNID, latest, messageNID, stateNID); err != nil {
+		t.Fatalf("SetLatestEvents returned %s", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit returned %s", err)
+	}
+	latestEvents, currentStateNID, depth, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("LatestEventIDs returned %s", err)
+	}
+	// The depth is that of the next event in the room.
+	if len(latestEvents) != 1 || latestEvents[0].EventID != eventIDs[2] || currentStateNID != stateNID || depth != 4 {
+		t.Errorf("LatestEventIDs: unexpected %v, %d, %d", latestEvents, currentStateNID, depth)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	var roomNID types.RoomNID
+	for _, event := range events {
+		var err error
+		if roomNID, _, err = db.StoreEvent(ctx, event, nil, nil); err != nil {
+			t.Fatalf("StoreEvent returned %s", err)
+		}
+	}
+
+	updater, err := db.MembershipUpdater(ctx, testRoomID, testUserID, testRoomVersion)
+	if err != nil {
+		t.Fatalf("MembershipUpdater returned %s", err)
+	}
+	if _, err = updater.SetToJoin(testUserID, events[1].EventID(), false); err != nil {
+		t.Fatalf("SetToJoin returned %s", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit returned %s", err)
+	}
+
+	eventNID, stillInRoom, err := db.GetMembership(ctx, roomNID, testUserID)
+	if err != nil || !stillInRoom || eventNID == 0 {
+		t.Fatalf("GetMembership: expected the user to be joined, got %d, %v (%v)", eventNID, stillInRoom, err)
+	}
+	joined, invited, err := db.ActiveRoomsForUser(ctx, testUserID)
+	if err != nil || len(joined) != 1 || joined[0] != testRoomID || len(invited) != 0 {
+		t.Fatalf("ActiveRoomsForUser: unexpected %v, %v (%v)", joined, invited, err)
+	}
+	joinedNIDs, err := db.GetMembershipEventNIDsForRoom(ctx, roomNID, true)
+	if err != nil || len(joinedNIDs) != 1 || joinedNIDs[0] != eventNID {
+		t.Fatalf("GetMembershipEventNIDsForRoom: expected [%d], got %v (%v)", eventNID, joinedNIDs, err)
+	}
+}
+
+func TestKnockMembership(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	knockerID := fmt.Sprintf("@quirrel:%s", testOrigin)
+	events = append(events, mustBuildEvent(t, gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"knock","reason":"Let me in"}`),
+		Type:     "m.room.member",
+		Sender:   knockerID,
+		StateKey: &knockerID,
+	}, &events[len(events)-1]))
+	knock := events[len(events)-1]
+	for _, event := range events {
+		if _, _, err := db.StoreEvent(ctx, event, nil, nil); err != nil {
+			t.Fatalf("StoreEvent returned %s", err)
+		}
+	}
+
+	updater, err := db.MembershipUpdater(ctx, testRoomID, knockerID, testRoomVersion)
+	if err != nil {
+		t.Fatalf("MembershipUpdater returned %s", err)
+	}
+	if err = updater.SetToKnock(knockerID, knock.EventID()); err != nil {
+		t.Fatalf("SetToKnock returned %s", err)
+	}
+	version := updater.MembershipVersion()
+	if version == 0 {
+		t.Errorf("SetToKnock: expected the membership version to be set")
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit returned %s", err)
+	}
+
+	// The knock is stored as its own membership rather than as a leave.
+	updater, err = db.MembershipUpdater(ctx, testRoomID, knockerID, testRoomVersion)
+	if err != nil {
+		t.Fatalf("MembershipUpdater returned %s", err)
+	}
+	if updater.IsLeave() || updater.IsJoin() || updater.IsInvite() {
+		t.Errorf("MembershipUpdater: expected the user to be knocking")
+	}
+	// Knocking again doesn't change the membership.
+	if err = updater.SetToKnock(knockerID, knock.EventID()); err != nil {
+		t.Fatalf("SetToKnock returned %s", err)
+	}
+	if updater.MembershipVersion() != version {
+		t.Errorf("SetToKnock: expected version %d, got %d", version, updater.MembershipVersion())
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit returned %s", err)
+	}
+
+	var memberships []string
+	err = db.StreamAllMemberships(ctx, func(
+		roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, membership, eventID string,
+	) error {
+		memberships = append(memberships, membership+" "+eventID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamAllMemberships returned %s", err)
+	}
+	if len(memberships) != 1 || memberships[0] != "knock "+knock.EventID() {
+		t.Errorf("StreamAllMemberships: expected the knock, got %v", memberships)
+	}
+	transitions, err := db.RecentMembershipTransitions(ctx, 10)
+	if err != nil {
+		t.Fatalf("RecentMembershipTransitions returned %s", err)
+	}
+	if len(transitions) != 1 || transitions[0].TargetUserID != knockerID ||
+		transitions[0].OldMembership != "leave" || transitions[0].NewMembership != "knock" ||
+		transitions[0].EventID != knock.EventID() {
+		t.Errorf("RecentMembershipTransitions: expected one knock, got %+v", transitions)
+	}
+}
+
+func TestPendingRemoteInvites(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	zote, myla := "@zote:pale.court", "@myla:pale.court"
+	sly, other := fmt.Sprintf("@sly:%s", testOrigin), "@bretta:notpale.court"
+	mustAddMemberships(t, db, events,
+		[3]string{testUserID, zote, "invite"},
+		[3]string{testUserID, myla, "invite"},
+		[3]string{testUserID, sly, "invite"},
+		[3]string{testUserID, other, "invite"},
+		[3]string{zote, zote, "join"},
+	)
+
+	// Zote accepted the invite, and the others aren't on pale.court.
+	invites, err := db.PendingRemoteInvites(ctx, "pale.court")
+	if err != nil {
+		t.Fatalf("PendingRemoteInvites returned %s", err)
+	}
+	if len(invites) != 1 || invites[0] != (types.RoomUser{RoomID: testRoomID, UserID: myla}) {
+		t.Errorf("PendingRemoteInvites: expected only the invite for %s, got %v", myla, invites)
+	}
+	if invites, err = db.PendingRemoteInvites(ctx, "white.palace"); err != nil || len(invites) != 0 {
+		t.Errorf("PendingRemoteInvites: expected no invites for another server, got %v (%v)", invites, err)
+	}
+}
+
+func TestDistinctInviterCount(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, myla := fmt.Sprintf("@sly:%s", testOrigin), "@myla:pale.court"
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, sly, "invite"},
+		[3]string{sly, sly, "join"},
+		[3]string{testUserID, myla, "invite"},
+		[3]string{sly, myla, "invite"},
+		[3]string{testUserID, myla, "invite"},
+	)
+
+	// Hornet invited Myla twice, so there are only two different inviters.
+	if count, err := db.DistinctInviterCount(ctx, myla); err != nil || count != 2 {
+		t.Errorf("DistinctInviterCount: expected 2, got %d (%v)", count, err)
+	}
+	// Sly accepted the only invite, so it isn't active any more.
+	if count, err := db.DistinctInviterCount(ctx, sly); err != nil || count != 0 {
+		t.Errorf("DistinctInviterCount: expected 0 after joining, got %d (%v)", count, err)
+	}
+	if count, err := db.DistinctInviterCount(ctx, "@zote:pale.court"); err != nil || count != 0 {
+		t.Errorf("DistinctInviterCount: expected 0 for an unknown user, got %d (%v)", count, err)
+	}
+
+	// Accepting the invites retires all of them.
+	mustAddMemberships(t, db, events, [3]string{myla, myla, "join"})
+	if count, err := db.DistinctInviterCount(ctx, myla); err != nil || count != 0 {
+		t.Errorf("DistinctInviterCount: expected 0 after joining, got %d (%v)", count, err)
+	}
+}
+
+func TestBannedUsersInRoom(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, zote, myla := fmt.Sprintf("@sly:%s", testOrigin), "@zote:pale.court", "@myla:pale.court"
+	events = mustAddMemberships(t, db, events,
+		[3]string{sly, sly, "join"},
+		[3]string{zote, zote, "join"},
+		[3]string{sly, sly, "leave"},
+		[3]string{testUserID, myla, "ban"},
+		[3]string{testUserID, myla, "leave"},
+	)
+	ban := mustBuildEvent(t, gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"ban","reason":"Too mighty"}`),
+		Type:     "m.room.member",
+		StateKey: &zote,
+	}, &events[len(events)-1])
+	mustStoreEvents(t, db, []gomatrixserverlib.Event{ban})
+	mustSetMembership(t, db, ban)
+
+	// Sly left and Myla was unbanned, so only Zote is banned.
+	banned, err := db.BannedUsersInRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("BannedUsersInRoom returned %s", err)
+	}
+	want := types.BannedUser{UserID: zote, BannedBy: testUserID, EventID: ban.EventID(), Reason: "Too mighty"}
+	if len(banned) != 1 || banned[0] != want {
+		t.Errorf("BannedUsersInRoom: expected [%+v], got %+v", want, banned)
+	}
+	if banned, err = db.BannedUsersInRoom(ctx, "!unknown:hollow.knight"); err != nil || len(banned) != 0 {
+		t.Errorf("BannedUsersInRoom: expected no bans in an unknown room, got %+v (%v)", banned, err)
+	}
+}
+
+func TestStreamAllMemberships(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, zote := fmt.Sprintf("@sly:%s", testOrigin), "@zote:pale.court"
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, testUserID, "join"},
+		[3]string{sly, sly, "join"},
+		[3]string{sly, sly, "leave"},
+	)
+	// Enough invites that the rows are read in more than one batch.
+	const invites = 1100
+	invite := events[len(events)-1]
+	for i := 0; i < invites; i++ {
+		invite = mustBuildMemberEvent(t, invite, testUserID, fmt.Sprintf("@grub%d:pale.court", i), "invite")
+		mustSetMembership(t, db, invite)
+	}
+	invite = mustBuildMemberEvent(t, invite, testUserID, zote, "invite")
+	mustSetMembership(t, db, invite)
+
+	type key struct {
+		roomNID   types.RoomNID
+		targetNID types.EventStateKeyNID
+	}
+	seen := map[key]bool{}
+	var last key
+	got := map[string]string{}
+	counts := map[string]int{}
+	err := db.StreamAllMemberships(ctx, func(
+		roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, membership, eventID string,
+	) error {
+		k := key{roomNID, targetUserNID}
+		if seen[k] {
+			t.Errorf("StreamAllMemberships: row %v returned twice", k)
+		}
+		if k.roomNID < last.roomNID || (k.roomNID == last.roomNID && k.targetNID < last.targetNID) {
+			t.Errorf("StreamAllMemberships: row %v returned after %v", k, last)
+		}
+		seen[k], last = true, k
+		counts[membership]++
+		got[membership+" "+eventID] = membership
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamAllMemberships returned %s", err)
+	}
+	// Hornet is joined and Sly has left, and the event IDs aren't returned
+	// for invites.
+	want := map[string]int{"join": 1, "leave": 1, "invite": invites + 1}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("StreamAllMemberships: expected %v, got %v", want, counts)
+	}
+	for _, row := range []string{"join " + events[3].EventID(), "leave " + events[5].EventID(), "invite "} {
+		if _, ok := got[row]; !ok {
+			t.Errorf("StreamAllMemberships: expected row %q", row)
+		}
+	}
+
+	// Errors from the callback stop the stream.
+	calls := 0
+	err = db.StreamAllMemberships(ctx, func(types.RoomNID, types.EventStateKeyNID, string, string) error {
+		calls++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("StreamAllMemberships: expected to stop at the first error, got %d calls (%v)", calls, err)
+	}
+}
+
+func TestExportMembershipAudit(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly := fmt.Sprintf("@sly:%s", testOrigin)
+	start := time.Now().Add(-time.Minute)
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, testUserID, "join"},
+		[3]string{testUserID, sly, "invite"},
+		[3]string{sly, sly, "join"},
+		[3]string{sly, sly, "leave"},
+	)
+
+	var buf bytes.Buffer
+	if err := db.ExportMembershipAudit(ctx, testRoomID, start, types.MembershipAuditFormatJSON, &buf); err != nil {
+		t.Fatalf("ExportMembershipAudit returned %s", err)
+	}
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry types.MembershipAuditEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("failed to decode the export: %s", err)
+		}
+		if entry.RoomID != testRoomID || entry.Timestamp == 0 {
+			t.Errorf("ExportMembershipAudit: unexpected entry %+v", entry)
+		}
+		got = append(got, fmt.Sprintf(
+			"%s %s %s>%s %s", entry.SenderUserID, entry.TargetUserID,
+			entry.OldMembership, entry.NewMembership, entry.EventID,
+		))
+	}
+	want := []string{
+		fmt.Sprintf("%s %s leave>join %s", testUserID, testUserID, events[3].EventID()),
+		fmt.Sprintf("%s %s leave>invite %s", testUserID, sly, events[4].EventID()),
+		fmt.Sprintf("%s %s invite>join %s", sly, sly, events[5].EventID()),
+		fmt.Sprintf("%s %s join>leave %s", sly, sly, events[6].EventID()),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ExportMembershipAudit: expected\n%v\ngot\n%v", want, got)
+	}
+
+	// Nothing has changed since now, so the CSV only has the header, as does
+	// the export for a room we don't know about.
+	for _, roomID := range []string{testRoomID, "!unknown:hollow.knight"} {
+		buf.Reset()
+		if err := db.ExportMembershipAudit(ctx, roomID, time.Now().Add(time.Minute), types.MembershipAuditFormatCSV, &buf); err != nil {
+			t.Fatalf("ExportMembershipAudit returned %s", err)
+		}
+		if want := "room_id,target_user_id,sender_user_id,old_membership,new_membership,event_id,ts\n"; buf.String() != want {
+			t.Errorf("ExportMembershipAudit: %s: expected only the header, got %q", roomID, buf.String())
+		}
+	}
+	if err := db.ExportMembershipAudit(ctx, testRoomID, start, "xml", &buf); err == nil {
+		t.Errorf("ExportMembershipAudit: expected an error for an unknown format")
+	}
+}
+
+func TestStaleInvitesForUser(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, myla, zote := fmt.Sprintf("@sly:%s", testOrigin), "@myla:pale.court", "@zote:pale.court"
+	now := time.Now()
+	for _, invite := range []struct {
+		sender, target string
+		ts             time.Time
+	}{
+		{testUserID, myla, now.Add(-48 * time.Hour)},
+		{sly, myla, now.Add(-time.Hour)},
+		{testUserID, zote, now.Add(-48 * time.Hour)},
+	} {
+		target := invite.target
+		event := mustBuildEventAt(t, gomatrixserverlib.EventBuilder{
+			Content:  []byte(`{"membership":"invite"}`),
+			Type:     "m.room.member",
+			Sender:   invite.sender,
+			StateKey: &target,
+		}, &events[len(events)-1], invite.ts)
+		mustStoreEvents(t, db, []gomatrixserverlib.Event{event})
+		mustSetMembership(t, db, event)
+		events = append(events, event)
+	}
+	// Zote accepted the invite, so it isn't active any more.
+	mustAddMemberships(t, db, events, [3]string{zote, zote, "join"})
+
+	cutoff := now.Add(-24 * time.Hour)
+	invites, err := db.StaleInvitesForUser(ctx, myla, cutoff)
+	if err != nil {
+		t.Fatalf("StaleInvitesForUser returned %s", err)
+	}
+	want := types.InviteRecord{
+		RoomID:         testRoomID,
+		EventID:        events[3].EventID(),
+		SenderUserID:   testUserID,
+		OriginServerTS: events[3].OriginServerTS(),
+	}
+	if len(invites) != 1 || invites[0] != want {
+		t.Errorf("StaleInvitesForUser: expected [%+v], got %+v", want, invites)
+	}
+	// Both of Myla's invites are older than now.
+	if invites, err = db.StaleInvitesForUser(ctx, myla, now); err != nil || len(invites) != 2 || invites[0] != want {
+		t.Errorf("StaleInvitesForUser: expected both invites, oldest first, got %+v (%v)", invites, err)
+	}
+	for _, userID := range []string{zote, "@bretta:pale.court"} {
+		if invites, err = db.StaleInvitesForUser(ctx, userID, now); err != nil || len(invites) != 0 {
+			t.Errorf("StaleInvitesForUser: expected no invites for %s, got %+v (%v)", userID, invites, err)
+		}
+	}
+}
+
+func TestEventsExist(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	roomNID := mustStoreEvents(t, db, events)
+	eventNIDMap, err := db.EventNIDs(ctx, []string{events[0].EventID(), events[2].EventID()})
+	if err != nil {
+		t.Fatalf("EventNIDs returned %s", err)
+	}
+	createNID, messageNID := eventNIDMap[events[0].EventID()], eventNIDMap[events[2].EventID()]
+	const unknownNID types.EventNID = 999
+
+	exist, err := db.EventsExist(ctx, []types.EventNID{createNID, unknownNID, messageNID})
+	if err != nil {
+		t.Fatalf("EventsExist returned %s", err)
+	}
+	want := map[types.EventNID]bool{createNID: true, unknownNID: false, messageNID: true}
+	if fmt.Sprint(exist) != fmt.Sprint(want) {
+		t.Errorf("EventsExist: expected %v, got %v", want, exist)
+	}
+	if exist, err = db.EventsExist(ctx, nil); err != nil || len(exist) != 0 {
+		t.Errorf("EventsExist: expected an empty map, got %v (%v)", exist, err)
+	}
+
+	// The events don't exist once the room is purged.
+	if err = db.PurgeRoom(ctx, roomNID); err != nil {
+		t.Fatalf("PurgeRoom returned %s", err)
+	}
+	if exist, err = db.EventsExist(ctx, []types.EventNID{createNID, messageNID}); err != nil || len(exist) != 2 || exist[createNID] || exist[messageNID] {
+		t.Errorf("EventsExist: expected the purged events not to exist, got %v (%v)", exist, err)
+	}
+}
+
+func TestActorTargetInteractions(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, myla := fmt.Sprintf("@sly:%s", testOrigin), "@myla:pale.court"
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, sly, "invite"},
+		[3]string{sly, sly, "join"},
+		[3]string{testUserID, sly, "leave"},
+		[3]string{testUserID, myla, "invite"},
+		[3]string{sly, sly, "join"},
+		[3]string{testUserID, sly, "ban"},
+	)
+
+	// Hornet invited, kicked and banned Sly. Sly's own joins and Hornet's
+	// invite for Myla aren't included.
+	entries, err := db.ActorTargetInteractions(ctx, testUserID, sly)
+	if err != nil {
+		t.Fatalf("ActorTargetInteractions returned %s", err)
+	}
+	var got []string
+	for _, entry := range entries {
+		if entry.RoomID != testRoomID || entry.Timestamp == 0 {
+			t.Errorf("ActorTargetInteractions: unexpected entry %+v", entry)
+		}
+		got = append(got, fmt.Sprintf("%s>%s %s", entry.OldMembership, entry.NewMembership, entry.EventID))
+	}
+	want := []string{
+		"leave>invite " + events[3].EventID(),
+		"join>leave " + events[5].EventID(),
+		"join>leave " + events[8].EventID(),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ActorTargetInteractions: expected %v, got %v", want, got)
+	}
+	if entries, err = db.ActorTargetInteractions(ctx, sly, testUserID); err != nil || len(entries) != 0 {
+		t.Errorf("ActorTargetInteractions: expected nothing the other way round, got %+v (%v)", entries, err)
+	}
+}
+
+func TestVerifyMembershipConsistency(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	sly, myla, zote := fmt.Sprintf("@sly:%s", testOrigin), "@myla:pale.court", "@zote:pale.court"
+	bretta := "@bretta:pale.court"
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, testUserID, "join"},
+		[3]string{testUserID, zote, "ban"},
+		[3]string{testUserID, myla, "invite"},
+	)
+	slyLeave := mustBuildMemberEvent(t, events[len(events)-1], sly, sly, "leave")
+	mustStoreEvents(t, db, []gomatrixserverlib.Event{slyLeave})
+
+	// Point the rows for Sly, Myla and Bretta at the wrong events.
+	for _, join := range []struct{ userID, eventID string }{
+		{sly, slyLeave.EventID()},
+		{myla, events[3].EventID()},
+		{bretta, "$missing:hollow.knight"},
+	} {
+		updater, err := db.MembershipUpdater(ctx, testRoomID, join.userID, testRoomVersion)
+		if err != nil {
+			t.Fatalf("MembershipUpdater returned %s", err)
+		}
+		if _, err = updater.SetToJoin(join.userID, join.eventID, false); err != nil {
+			t.Fatalf("SetToJoin returned %s", err)
+		}
+		if err = updater.Commit(); err != nil {
+			t.Fatalf("Commit returned %s", err)
+		}
+	}
+
+	// Hornet's join and Zote's ban are consistent with their events.
+	inconsistencies, err := db.VerifyMembershipConsistency(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("VerifyMembershipConsistency returned %s", err)
+	}
+	got := map[string]string{}
+	for _, inconsistency := range inconsistencies {
+		if inconsistency.StoredMembership != "join" {
+			t.Errorf("VerifyMembershipConsistency: expected a join to be stored, got %+v", inconsistency)
+		}
+		got[inconsistency.TargetUserID] = fmt.Sprintf(
+			"%s %s %s", inconsistency.Reason, inconsistency.EventID, inconsistency.EventMembership,
+		)
+	}
+	want := map[string]string{
+		sly:    fmt.Sprintf("%s %s leave", types.MembershipInconsistencyWrongMembership, slyLeave.EventID()),
+		myla:   fmt.Sprintf("%s %s join", types.MembershipInconsistencyWrongTarget, events[3].EventID()),
+		bretta: fmt.Sprintf("%s  ", types.MembershipInconsistencyMissingEvent),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("VerifyMembershipConsistency: expected %v, got %v", want, got)
+	}
+	if inconsistencies, err = db.VerifyMembershipConsistency(ctx, "!unknown:hollow.knight"); err != nil || len(inconsistencies) != 0 {
+		t.Errorf("VerifyMembershipConsistency: expected nothing for an unknown room, got %+v (%v)", inconsistencies, err)
+	}
+}
+
+func TestRecentMembershipTransitions(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	mustStoreEvents(t, db, events)
+	if entries, err := db.RecentMembershipTransitions(ctx, 10); err != nil || len(entries) != 0 {
+		t.Errorf("RecentMembershipTransitions: expected nothing yet, got %+v (%v)", entries, err)
+	}
+	sly := fmt.Sprintf("@sly:%s", testOrigin)
+	events = mustAddMemberships(t, db, events,
+		[3]string{testUserID, testUserID, "join"},
+		[3]string{testUserID, sly, "invite"},
+		[3]string{sly, sly, "join"},
+		[3]string{sly, sly, "leave"},
+	)
+
+	// The most recent changes come first, up to the limit.
+	entries, err := db.RecentMembershipTransitions(ctx, 3)
+	if err != nil {
+		t.Fatalf("RecentMembershipTransitions returned %s", err)
+	}
+	var got []string
+	for _, entry := range entries {
+		if entry.RoomID != testRoomID || entry.Timestamp == 0 {
+			t.Errorf("RecentMembershipTransitions: unexpected entry %+v", entry)
+		}
+		got = append(got, fmt.Sprintf(
+			"%s %s %s>%s %s", entry.SenderUserID, entry.TargetUserID,
+			entry.OldMembership, entry.NewMembership, entry.EventID,
+		))
+	}
+	want := []string{
+		fmt.Sprintf("%s %s join>leave %s", sly, sly, events[6].EventID()),
+		fmt.Sprintf("%s %s invite>join %s", sly, sly, events[5].EventID()),
+		fmt.Sprintf("%s %s leave>invite %s", testUserID, sly, events[4].EventID()),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("RecentMembershipTransitions: expected\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestRoomSettings(t *testing.T) {
+	db, closeDB := mustCreateDatabase(t)
+	defer closeDB()
+	events := mustCreateRoom(t)
+	roomNID, _, err := db.StoreEvent(ctx, events[0], nil, nil)
+	if err != nil {
+		t.Fatalf("StoreEvent returned %s", err)
+	}
+
+	alias := "#hallownest:hollow.knight"
+	if err = db.SetRoomAlias(ctx, alias, testRoomID, testUserID); err != nil {
+		t.Fatalf("SetRoomAlias returned %s", err)
+	}
+	if roomID, err := db.GetRoomIDForAlias(ctx, alias); err != nil || roomID != testRoomID {
+		t.Errorf("GetRoomIDForAlias: expected %s, got %s (%v)", testRoomID, roomID, err)
+	}
+	if aliases, err := db.GetAliasesForRoomID(ctx, testRoomID); err != nil || len(aliases) != 1 || aliases[0] != alias {
+		t.Errorf("GetAliasesForRoomID: expected [%s], got %v (%v)", alias, aliases, err)
+	}
+	if creator, err := db.GetCreatorIDForAlias(ctx, alias); err != nil || creator != testUserID {
+		t.Errorf("GetCreatorIDForAlias: expected %s, got %s (%v)", testUserID, creator, err)
+	}
+	if err = db.RemoveRoomAlias(ctx, alias); err != nil {
+		t.Fatalf("RemoveRoomAlias returned %s", err)
+	}
+	if roomID, err := db.GetRoomIDForAlias(ctx, alias); err != nil || roomID != "" {
+		t.Errorf("GetRoomIDForAlias: expected the alias to be removed, got %s (%v)", roomID, err)
+	}
+
+	for _, announceOnly := range []bool{true, false} {
+		if err = db.SetRoomAnnounceOnly(ctx, roomNID, announceOnly); err != nil {
+			t.Fatalf("SetRoomAnnounceOnly returned %s", err)
+		}
+		if got, err := db.IsRoomAnnounceOnly(ctx, roomNID); err != nil || got != announceOnly {
+			t.Errorf("IsRoomAnnounceOnly: expected %v, got %v (%v)", announceOnly, got, err)
+		}
+	}
+	for _, blocked := range []bool{true, false, true} {
+		if err = db.SetRoomBlocked(ctx, testRoomID, blocked); err != nil {
+			t.Fatalf("SetRoomBlocked returned %s", err)
+		}
+		if got, err := db.IsRoomBlocked(ctx, testRoomID); err != nil || got != blocked {
+			t.Errorf("IsRoomBlocked: expected %v, got %v (%v)", blocked, got, err)
+		}
+	}
+
+	// Purging the room removes its events, but it stays blocked.
+	if err = db.PurgeRoom(ctx, roomNID); err != nil {
+		t.Fatalf("PurgeRoom returned %s", err)
+	}
+	if roomNID, err = db.RoomNID(ctx, testRoomID); err != nil || roomNID != 0 {
+		t.Errorf("RoomNID: expected the room to be purged, got %d (%v)", roomNID, err)
+	}
+	if blocked, err := db.IsRoomBlocked(ctx, testRoomID); err != nil || !blocked {
+		t.Errorf("IsRoomBlocked: expected the purged room to stay blocked, got %v (%v)", blocked, err)
+	}
+}
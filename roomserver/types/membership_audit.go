@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// MembershipAuditFormatCSV exports the membership audit log as CSV with a
+	// header row.
+	MembershipAuditFormatCSV = "csv"
+	// MembershipAuditFormatJSON exports the membership audit log as
+	// newline-delimited JSON, with one object per line.
+	MembershipAuditFormatJSON = "json"
+)
+
+// A MembershipAuditEntry is a single change in the membership of a user in
+// the current state of a room, as recorded in the membership audit log.
+type MembershipAuditEntry struct {
+	// The ID of the room.
+	RoomID string `json:"room_id"`
+	// The user whose membership changed.
+	TargetUserID string `json:"target_user_id"`
+	// The sender of the event that changed the membership.
+	SenderUserID string `json:"sender_user_id"`
+	// The membership before the change. "leave" also covers bans.
+	OldMembership string `json:"old_membership"`
+	// The membership after the change. "leave" also covers bans.
+	NewMembership string `json:"new_membership"`
+	// The ID of the event that changed the membership.
+	EventID string `json:"event_id"`
+	// When the change was processed by the roomserver.
+	Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+var membershipAuditCSVHeader = []string{
+	"room_id", "target_user_id", "sender_user_id",
+	"old_membership", "new_membership", "event_id", "ts",
+}
+
+// A MembershipAuditWriter writes membership audit entries to an io.Writer in
+// an export format, one entry at a time so that large logs can be streamed.
+type MembershipAuditWriter interface {
+	// Write writes a single entry.
+	Write(entry MembershipAuditEntry) error
+	// Flush writes any buffered data to the underlying io.Writer.
+	Flush() error
+}
+
+// NewMembershipAuditWriter returns a MembershipAuditWriter for the format,
+// which must be MembershipAuditFormatCSV or MembershipAuditFormatJSON.
+func NewMembershipAuditWriter(format string, w io.Writer) (MembershipAuditWriter, error) {
+	switch format {
+	case MembershipAuditFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(membershipAuditCSVHeader); err != nil {
+			return nil, err
+		}
+		return &membershipAuditCSVWriter{cw}, nil
+	case MembershipAuditFormatJSON:
+		return &membershipAuditJSONWriter{json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown membership audit export format %q", format)
+	}
+}
+
+type membershipAuditCSVWriter struct {
+	w *csv.Writer
+}
+
+func (m *membershipAuditCSVWriter) Write(entry MembershipAuditEntry) error {
+	return m.w.Write([]string{
+		entry.RoomID, entry.TargetUserID, entry.SenderUserID,
+		entry.OldMembership, entry.NewMembership, entry.EventID,
+		strconv.FormatUint(uint64(entry.Timestamp), 10),
+	})
+}
+
+func (m *membershipAuditCSVWriter) Flush() error {
+	m.w.Flush()
+	return m.w.Error()
+}
+
+type membershipAuditJSONWriter struct {
+	enc *json.Encoder
+}
+
+func (m *membershipAuditJSONWriter) Write(entry MembershipAuditEntry) error {
+	// json.Encoder terminates each value with a newline.
+	return m.enc.Encode(entry)
+}
+
+func (m *membershipAuditJSONWriter) Flush() error {
+	return nil
+}
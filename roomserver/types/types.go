@@ -169,6 +169,9 @@ type RoomRecentEventsUpdater interface {
 	// Build a membership updater for the target user in this room.
 	// It will share the same transaction as this updater.
 	MembershipUpdater(targetUserNID EventStateKeyNID) (MembershipUpdater, error)
+	// Count the users joined to the room, including any changes made by the
+	// membership updaters built from this updater.
+	JoinedMemberCount() (int64, error)
 	// Implements Transaction so it can be committed or rolledback
 	common.Transaction
 }
@@ -183,7 +186,7 @@ type MembershipUpdater interface {
 	IsInvite() bool
 	// True if the target user is joined to the room before updating.
 	IsJoin() bool
-	// True if the target user is not invited or joined to the room before updating.
+	// True if the target user is not invited, joined or knocking on the room before updating.
 	IsLeave() bool
 	// Set the state to invite.
 	// Returns whether this invite needs to be sent
@@ -194,10 +197,78 @@ type MembershipUpdater interface {
 	// Set the state to leave.
 	// Returns a list of invite event IDs that this state change retired.
 	SetToLeave(senderUserID string, eventID string) (inviteEventIDs []string, err error)
+	// Set the state to knock.
+	SetToKnock(senderUserID string, eventID string) error
+	// The version of the membership of the target user in the room, which is
+	// incremented by every write to it. After a Set call this is the version
+	// written by that call, so consumers can order the resulting changes.
+	MembershipVersion() int64
 	// Implements Transaction so it can be committed or rolledback.
 	common.Transaction
 }
 
+// A RoomUser identifies a user in a room, e.g. the target of an invite.
+type RoomUser struct {
+	RoomID string
+	UserID string
+}
+
+// A BannedUser is a user who is currently banned from a room.
+type BannedUser struct {
+	// The user ID of the banned user.
+	UserID string
+	// The user ID of the user who banned them.
+	BannedBy string
+	// The event ID of the ban event.
+	EventID string
+	// The reason given for the ban, if any.
+	Reason string
+}
+
+// An InviteRecord is an active invite for a user, as stored in the invite
+// table.
+type InviteRecord struct {
+	// The ID of the room the user is invited to.
+	RoomID string
+	// The event ID of the invite event.
+	EventID string
+	// The user ID of the user who sent the invite.
+	SenderUserID string
+	// The origin_server_ts of the invite event.
+	OriginServerTS gomatrixserverlib.Timestamp
+}
+
+// The reasons why a membership row can be inconsistent with the events table.
+const (
+	// The membership event referred to by the row doesn't exist.
+	MembershipInconsistencyMissingEvent = "missing_event"
+	// The membership event referred to by the row can't be parsed.
+	MembershipInconsistencyBadEvent = "bad_event"
+	// The membership event is for a different user than the row.
+	MembershipInconsistencyWrongTarget = "wrong_target"
+	// The membership stored in the row differs from that of the event.
+	MembershipInconsistencyWrongMembership = "wrong_membership"
+)
+
+// A MembershipInconsistency is a row of the membership table which disagrees
+// with the membership event that it refers to.
+type MembershipInconsistency struct {
+	// The user ID of the user whose membership row is inconsistent.
+	TargetUserID string
+	// The event ID of the membership event referred to by the row, or empty
+	// if the event doesn't exist.
+	EventID string
+	// The numeric ID of the membership event referred to by the row.
+	EventNID EventNID
+	// The membership stored in the row. "leave" also covers bans.
+	StoredMembership string
+	// The membership of the event, or empty if it couldn't be worked out.
+	EventMembership string
+	// Why the row is inconsistent, one of the MembershipInconsistency*
+	// constants.
+	Reason string
+}
+
 // A MissingEventError is an error that happened because the roomserver was
 // missing requested events from its database.
 type MissingEventError string
@@ -87,6 +87,17 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypeRetireInviteBatchEvent:
+		for _, retired := range output.RetireInviteBatchEvent.RetiredInvites {
+			if err := s.onRetireInviteEvent(context.TODO(), retired); err != nil {
+				return err
+			}
+		}
+		return nil
+	case api.OutputTypeRedactedEvent:
+		return s.onRedactedEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypePurgeRoom:
+		return s.onPurgeRoom(context.TODO(), *output.PurgeRoom)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -185,6 +196,36 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	return nil
 }
 
+func (s *OutputRoomEventConsumer) onRedactedEvent(
+	ctx context.Context, msg api.OutputRedactedEvent,
+) error {
+	err := s.db.RedactEvent(ctx, msg.RedactedEventID, msg.RedactedBecause)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event_id":     msg.RedactedEventID,
+			"redaction_id": msg.RedactedBecause.EventID(),
+			log.ErrorKey:   err,
+		}).Panicf("roomserver output log: redact event failure")
+		return nil
+	}
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) onPurgeRoom(
+	ctx context.Context, msg api.OutputPurgeRoom,
+) error {
+	if err := s.db.PurgeRoom(ctx, msg.RoomID); err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: purge room failure")
+		return nil
+	}
+	return nil
+}
+
 // lookupStateEvents looks up the state events that are added by a new event.
 func (s *OutputRoomEventConsumer) lookupStateEvents(
 	addsStateEventIDs []string, event gomatrixserverlib.HeaderedEvent,
@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRoomEventSearchConsumer consumes events that originated in the room
+// server and adds them to the full-text search index. It keeps its own
+// partition offsets so that the index can be rebuilt independently of the
+// rest of the sync API database.
+type OutputRoomEventSearchConsumer struct {
+	rsConsumer *common.ContinualConsumer
+	db         storage.Database
+}
+
+// NewOutputRoomEventSearchConsumer creates a new OutputRoomEventSearchConsumer.
+// Call Start() to begin consuming from room servers.
+func NewOutputRoomEventSearchConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+) *OutputRoomEventSearchConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store.SearchIndexPartitions(),
+	}
+	s := &OutputRoomEventSearchConsumer{
+		rsConsumer: &consumer,
+		db:         store,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventSearchConsumer) Start() error {
+	return s.rsConsumer.Start()
+}
+
+// onMessage is called when the search index receives a new event from the
+// room server output log.
+func (s *OutputRoomEventSearchConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+
+	ctx := context.TODO()
+	switch output.Type {
+	case api.OutputTypeNewRoomEvent:
+		ev := output.NewRoomEvent.Event
+		if err := s.db.IndexEventForSearch(ctx, &ev); err != nil {
+			log.WithFields(log.Fields{
+				"event_id":   ev.EventID(),
+				log.ErrorKey: err,
+			}).Panicf("roomserver output log: search index failure")
+		}
+	case api.OutputTypeRedactedEvent:
+		eventID := output.RedactedEvent.RedactedEventID
+		if err := s.db.RemoveEventFromSearch(ctx, eventID); err != nil {
+			log.WithFields(log.Fields{
+				"event_id":   eventID,
+				log.ErrorKey: err,
+			}).Panicf("roomserver output log: search index redaction failure")
+		}
+	case api.OutputTypePurgeRoom:
+		roomID := output.PurgeRoom.RoomID
+		if err := s.db.RemoveRoomFromSearch(ctx, roomID); err != nil {
+			log.WithFields(log.Fields{
+				"room_id":    roomID,
+				log.ErrorKey: err,
+			}).Panicf("roomserver output log: search index purge failure")
+		}
+	}
+	return nil
+}
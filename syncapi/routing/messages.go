@@ -16,15 +16,18 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -50,6 +53,7 @@ type messagesResp struct {
 	Start string                          `json:"start"`
 	End   string                          `json:"end"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -58,7 +62,8 @@ const defaultMessagesLimit = 10
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	lazyLoad *sync.LazyLoadCache, roomID string,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
@@ -116,8 +121,23 @@ func OnIncomingMessagesRequest(
 		wasToProvided = false
 	}
 
-	// Maximum number of events to return; defaults to 10.
+	// Filter to apply to the events.
+	var filter gomatrixserverlib.RoomEventFilter
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
+
+	// Maximum number of events to return; defaults to the filter's limit or
+	// else to 10.
 	limit := defaultMessagesLimit
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
 	if len(req.URL.Query().Get("limit")) > 0 {
 		limit, err = strconv.Atoi(req.URL.Query().Get("limit"))
 
@@ -128,7 +148,6 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -158,6 +177,9 @@ func OnIncomingMessagesRequest(
 		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
 		return jsonerror.InternalServerError()
 	}
+	// The events are filtered after they have been retrieved, so fewer than
+	// the limit may be returned even if there are more events in the room.
+	clientEvents = sync.FilterRoomEvents(clientEvents, &filter)
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
 		"from":         from.String(),
 		"to":           to.String(),
@@ -167,6 +189,20 @@ func OnIncomingMessagesRequest(
 		"return_end":   end.String(),
 	}).Info("Responding")
 
+	// If the client is lazily loading members, send it the member events of
+	// the senders of the returned events which it hasn't seen yet.
+	var state []gomatrixserverlib.ClientEvent
+	if filter.LazyLoadMembers {
+		state, err = lazyLoad.LazyLoadMembers(
+			req.Context(), db, device, roomID, nil, clientEvents,
+			filter.IncludeRedundantMembers, gomatrixserverlib.FormatAll,
+		)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("lazyLoad.LazyLoadMembers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	// Respond with the events.
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -174,6 +210,7 @@ func OnIncomingMessagesRequest(
 			Chunk: clientEvents,
 			Start: start.String(),
 			End:   end.String(),
+			State: state,
 		},
 	}
 }
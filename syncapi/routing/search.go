@@ -0,0 +1,345 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultSearchLimit        = 10
+	defaultSearchContextLimit = 5
+)
+
+// searchableKeys are the keys which can be searched, and which are searched
+// if the request doesn't give any.
+var searchableKeys = []string{"content.body", "content.name", "content.topic"}
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *eventContextCriteria             `json:"event_context"`
+	IncludeState bool                              `json:"include_state"`
+}
+
+type eventContextCriteria struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories searchCategoriesResponse `json:"search_categories"`
+}
+
+type searchCategoriesResponse struct {
+	RoomEvents roomEventsResults `json:"room_events"`
+}
+
+type roomEventsResults struct {
+	Count      int                                        `json:"count"`
+	Highlights []string                                   `json:"highlights"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	NextBatch  string                                     `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *eventContext                 `json:"context,omitempty"`
+}
+
+type eventContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]userProfile          `json:"profile_info,omitempty"`
+}
+
+type userProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// Search implements POST /search, searching the events in the rooms which the
+// user is joined to.
+// See: https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-search
+func Search(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+) util.JSONResponse {
+	var offset int
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch parameter"),
+			}
+		}
+	}
+
+	var searchReq searchRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &searchReq); reqErr != nil {
+		return *reqErr
+	}
+	criteria := searchReq.SearchCategories.RoomEvents
+	if criteria == nil {
+		// Room events are the only category of search, so there is nothing to
+		// search for.
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: searchResponse{},
+		}
+	}
+
+	keys := criteria.Keys
+	if len(keys) == 0 {
+		keys = searchableKeys
+	}
+	for _, key := range keys {
+		if !contains(searchableKeys, key) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Cannot search key " + key),
+			}
+		}
+	}
+	var orderByRank bool
+	switch criteria.OrderBy {
+	case "", "rank":
+		orderByRank = true
+	case "recent":
+		orderByRank = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order_by must be either 'rank' or 'recent'"),
+		}
+	}
+	limit := defaultSearchLimit
+	if criteria.Filter.Limit > 0 {
+		limit = criteria.Filter.Limit
+	}
+
+	joinedRoomIDs, err := db.RoomIDsWithMembership(req.Context(), device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	var roomIDs []string
+	for _, roomID := range joinedRoomIDs {
+		if contains(criteria.Filter.NotRooms, roomID) {
+			continue
+		}
+		if criteria.Filter.Rooms != nil && !contains(criteria.Filter.Rooms, roomID) {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	found, count, err := db.SearchRoomEvents(
+		req.Context(), criteria.SearchTerm, roomIDs, keys, orderByRank, limit, offset,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SearchRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomEventsResults{
+		Count:      count,
+		Highlights: strings.Fields(strings.ToLower(criteria.SearchTerm)),
+		Results:    []searchResult{},
+	}
+	if offset+limit < count {
+		res.NextBatch = strconv.Itoa(offset + limit)
+	}
+	resultRoomIDs := make(map[string]bool)
+	for _, result := range found {
+		// The senders and types in the filter are applied after the search, so
+		// fewer than the limit may be returned even if there are more results.
+		clientEvent := gomatrixserverlib.HeaderedToClientEvent(result.Event, gomatrixserverlib.FormatAll)
+		if len(sync.FilterRoomEvents([]gomatrixserverlib.ClientEvent{clientEvent}, &criteria.Filter)) == 0 {
+			continue
+		}
+		sr := searchResult{
+			Rank:   result.Rank,
+			Result: clientEvent,
+		}
+		if criteria.EventContext != nil {
+			sr.Context, err = getEventContext(req.Context(), db, &result.Event, criteria.EventContext)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("getEventContext failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		res.Results = append(res.Results, sr)
+		resultRoomIDs[result.Event.RoomID()] = true
+	}
+
+	if criteria.IncludeState {
+		res.State = make(map[string][]gomatrixserverlib.ClientEvent)
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		for roomID := range resultRoomIDs {
+			stateEvents, err := db.GetStateEventsForRoom(req.Context(), roomID, &stateFilter)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEventsForRoom failed")
+				return jsonerror.InternalServerError()
+			}
+			res.State[roomID] = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: searchResponse{
+			SearchCategories: searchCategoriesResponse{RoomEvents: res},
+		},
+	}
+}
+
+// getEventContext returns the events either side of a search result in its
+// room, and optionally the profiles of their senders.
+func getEventContext(
+	ctx context.Context, db storage.Database, ev *gomatrixserverlib.HeaderedEvent,
+	criteria *eventContextCriteria,
+) (*eventContext, error) {
+	beforeLimit, afterLimit := defaultSearchContextLimit, defaultSearchContextLimit
+	if criteria.BeforeLimit != nil {
+		beforeLimit = *criteria.BeforeLimit
+	}
+	if criteria.AfterLimit != nil {
+		afterLimit = *criteria.AfterLimit
+	}
+
+	pos, err := db.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		return nil, fmt.Errorf("db.EventPositionInTopology: %w", err)
+	}
+	start, end := pos, pos
+
+	var before, after []gomatrixserverlib.HeaderedEvent
+	if beforeLimit > 0 {
+		// The backward range includes the event itself, so fetch one more.
+		to := types.NewTopologyToken(0, 0)
+		streamEvents, err := db.GetEventsInTopologicalRange(ctx, &pos, &to, ev.RoomID(), beforeLimit+1, true)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+		}
+		before = withoutEvent(db.StreamEventsToEvents(nil, streamEvents), ev.EventID(), beforeLimit)
+	}
+	if afterLimit > 0 {
+		maxPos, err := db.MaxTopologicalPosition(ctx, ev.RoomID())
+		if err != nil {
+			return nil, fmt.Errorf("db.MaxTopologicalPosition: %w", err)
+		}
+		// The forward range excludes the events at the depth of the upper
+		// bound, so go one deeper to include the latest events.
+		to := types.NewTopologyToken(maxPos.Depth()+1, 0)
+		streamEvents, err := db.GetEventsInTopologicalRange(ctx, &pos, &to, ev.RoomID(), afterLimit, false)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+		}
+		after = withoutEvent(db.StreamEventsToEvents(nil, streamEvents), ev.EventID(), afterLimit)
+	}
+
+	if len(before) > 0 {
+		if start, err = db.EventPositionInTopology(ctx, before[len(before)-1].EventID()); err != nil {
+			return nil, fmt.Errorf("db.EventPositionInTopology: %w", err)
+		}
+		start.Decrement()
+	}
+	if len(after) > 0 {
+		if end, err = db.EventPositionInTopology(ctx, after[len(after)-1].EventID()); err != nil {
+			return nil, fmt.Errorf("db.EventPositionInTopology: %w", err)
+		}
+	}
+
+	evCtx := &eventContext{
+		Start:        start.String(),
+		End:          end.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+	}
+	if criteria.IncludeProfile {
+		evCtx.ProfileInfo = make(map[string]userProfile)
+		senders := []string{ev.Sender()}
+		for _, e := range append(before, after...) {
+			senders = append(senders, e.Sender())
+		}
+		for _, sender := range senders {
+			if _, ok := evCtx.ProfileInfo[sender]; ok {
+				continue
+			}
+			memberEvent, err := db.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomMember, sender)
+			if err != nil {
+				return nil, fmt.Errorf("db.GetStateEvent: %w", err)
+			}
+			var profile userProfile
+			if memberEvent != nil {
+				profile.DisplayName = gjson.GetBytes(memberEvent.Content(), "displayname").Str
+				profile.AvatarURL = gjson.GetBytes(memberEvent.Content(), "avatar_url").Str
+			}
+			evCtx.ProfileInfo[sender] = profile
+		}
+	}
+	return evCtx, nil
+}
+
+// withoutEvent returns up to limit of the events, leaving out the event with
+// the given ID.
+func withoutEvent(
+	events []gomatrixserverlib.HeaderedEvent, eventID string, limit int,
+) []gomatrixserverlib.HeaderedEvent {
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.EventID() != eventID && len(result) < limit {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
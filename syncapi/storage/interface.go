@@ -79,6 +79,15 @@ type Database interface {
 	// RetireInviteEvent removes an old invite event from the database.
 	// Returns an error if there was a problem communicating with the database.
 	RetireInviteEvent(ctx context.Context, inviteEventID string) error
+	// RedactEvent replaces the stored event with its redacted form, with the
+	// redaction event in its unsigned "redacted_because" field. Does nothing
+	// if the event isn't in the database.
+	// Returns an error if there was a problem communicating with the database.
+	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause gomatrixserverlib.HeaderedEvent) error
+	// PurgeRoom removes all events, state, invites and backwards extremities
+	// for the room from the database.
+	// Returns an error if there was a problem communicating with the database.
+	PurgeRoom(ctx context.Context, roomID string) error
 	// SetTypingTimeoutCallback sets a callback function that is called right after
 	// a user is removed from the typing user list due to timeout.
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
@@ -105,4 +114,31 @@ type Database interface {
 	StreamEventsToEvents(device *authtypes.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent
 	// SyncStreamPosition returns the latest position in the sync stream. Returns 0 if there are no events yet.
 	SyncStreamPosition(ctx context.Context) (types.StreamPosition, error)
+	// GetFilter looks up the filter with the given ID uploaded by the user with
+	// the given localpart. Returns sql.ErrNoRows if there is no such filter.
+	GetFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
+	// PutFilter stores the filter for the user with the given localpart and
+	// returns its ID.
+	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
+	// ImportFilter stores a filter which was moved from another database,
+	// keeping its ID so that clients can still refer to it.
+	ImportFilter(ctx context.Context, localpart string, filterID int64, filterJSON []byte) error
+	// SearchIndexPartitions returns where the consumer which feeds the full-text
+	// search index has reached in the room server's output log.
+	SearchIndexPartitions() common.PartitionStorer
+	// IndexEventForSearch adds the searchable parts of the event, if it has any,
+	// to the full-text search index.
+	IndexEventForSearch(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error
+	// RemoveEventFromSearch removes the event from the full-text search index.
+	RemoveEventFromSearch(ctx context.Context, eventID string) error
+	// RemoveRoomFromSearch removes all of the room's events from the full-text search index.
+	RemoveRoomFromSearch(ctx context.Context, roomID string) error
+	// SearchRoomEvents returns up to limit of the events in the given rooms whose
+	// given keys match the search term, skipping the first offset of them, along
+	// with how many events match in total. The events are ordered by rank if
+	// orderByRank is true, or else with the most recent first.
+	SearchRoomEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+	// RoomIDsWithMembership returns the IDs of the rooms which the user currently
+	// has the given membership of.
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
 }
@@ -1,4 +1,4 @@
-// Copyright 2017 Jan Christian Grünhage
+// Copyright 2020 The Matrix.org Foundation C.I.C.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -12,65 +12,71 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package postgres
+package mysql
 
 import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const filterSchema = `
 -- Stores data about filters
-CREATE TABLE IF NOT EXISTS account_filter (
+CREATE TABLE IF NOT EXISTS syncapi_filter (
 	-- The filter
-	filter TEXT NOT NULL,
+	filter MEDIUMTEXT NOT NULL,
 	-- The ID
-	id SERIAL UNIQUE,
+	id BIGINT PRIMARY KEY AUTO_INCREMENT,
 	-- The localpart of the Matrix user ID associated to this filter
-	localpart TEXT NOT NULL,
+	localpart VARCHAR(255) NOT NULL,
 
-	PRIMARY KEY(id, localpart)
+	UNIQUE (id, localpart),
+	INDEX syncapi_filter_localpart (localpart)
 );
-
-CREATE INDEX IF NOT EXISTS account_filter_localpart ON account_filter(localpart);
 `
 
 const selectFilterSQL = "" +
-	"SELECT filter FROM account_filter WHERE localpart = $1 AND id = $2"
+	"SELECT filter FROM syncapi_filter WHERE localpart = $1 AND id = $2"
 
 const selectFilterIDByContentSQL = "" +
-	"SELECT id FROM account_filter WHERE localpart = $1 AND filter = $2"
+	"SELECT id FROM syncapi_filter WHERE localpart = $1 AND filter = $2"
 
 const insertFilterSQL = "" +
-	"INSERT INTO account_filter (filter, id, localpart) VALUES ($1, DEFAULT, $2) RETURNING id"
+	"INSERT INTO syncapi_filter (filter, localpart) VALUES ($1, $2)"
+
+const importFilterSQL = "" +
+	"INSERT IGNORE INTO syncapi_filter (filter, id, localpart) VALUES ($1, $2, $3)"
 
 type filterStatements struct {
 	selectFilterStmt            *sql.Stmt
 	selectFilterIDByContentStmt *sql.Stmt
 	insertFilterStmt            *sql.Stmt
+	importFilterStmt            *sql.Stmt
 }
 
-func (s *filterStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(filterSchema)
-	if err != nil {
-		return
-	}
+func NewMySQLFilterTable(db *sql.DB) (tables.Filter, error) {
+	s := &filterStatements{}
+	var err error
 	if s.selectFilterStmt, err = db.Prepare(selectFilterSQL); err != nil {
-		return
+		return nil, err
 	}
 	if s.selectFilterIDByContentStmt, err = db.Prepare(selectFilterIDByContentSQL); err != nil {
-		return
+		return nil, err
 	}
 	if s.insertFilterStmt, err = db.Prepare(insertFilterSQL); err != nil {
-		return
+		return nil, err
 	}
-	return
+	if s.importFilterStmt, err = db.Prepare(importFilterSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func (s *filterStatements) selectFilter(
+func (s *filterStatements) SelectFilter(
 	ctx context.Context, localpart string, filterID string,
 ) (*gomatrixserverlib.Filter, error) {
 	// Retrieve filter from database (stored as canonical JSON)
@@ -88,7 +94,7 @@ func (s *filterStatements) selectFilter(
 	return &filter, nil
 }
 
-func (s *filterStatements) insertFilter(
+func (s *filterStatements) InsertFilter(
 	ctx context.Context, filter *gomatrixserverlib.Filter, localpart string,
 ) (filterID string, err error) {
 	var existingFilterID string
@@ -121,7 +127,21 @@ func (s *filterStatements) insertFilter(
 	}
 
 	// Otherwise insert the filter and return the new ID
-	err = s.insertFilterStmt.QueryRowContext(ctx, filterJSON, localpart).
-		Scan(&filterID)
+	res, err := s.insertFilterStmt.ExecContext(ctx, filterJSON, localpart)
+	if err != nil {
+		return "", err
+	}
+	rowid, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	filterID = fmt.Sprintf("%d", rowid)
 	return
 }
+
+func (s *filterStatements) ImportFilter(
+	ctx context.Context, localpart string, filterID int64, filterJSON []byte,
+) error {
+	_, err := s.importFilterStmt.ExecContext(ctx, filterJSON, filterID, localpart)
+	return err
+}
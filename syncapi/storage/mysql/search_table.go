@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const searchSchema = `
+-- Stores the searchable parts of events, i.e. the bodies of messages and the
+-- names and topics of rooms.
+CREATE TABLE IF NOT EXISTS syncapi_event_search (
+	-- Orders the events in the order they were indexed.
+	id BIGINT PRIMARY KEY AUTO_INCREMENT,
+	-- The event ID of the event.
+	event_id VARCHAR(255) NOT NULL,
+	-- The room ID of the room the event is in.
+	room_id VARCHAR(255) NOT NULL,
+	-- The sender of the event.
+	sender VARCHAR(255) NOT NULL,
+	-- The type of the event.
+	type VARCHAR(255) NOT NULL,
+	-- The key of the event's content which was indexed, e.g. "content.body".
+	` + "`key`" + ` VARCHAR(255) NOT NULL,
+	-- The value of the key.
+	value MEDIUMTEXT NOT NULL,
+	UNIQUE (event_id, ` + "`key`" + `),
+	INDEX syncapi_event_search_room_id_idx (room_id),
+	FULLTEXT INDEX syncapi_event_search_value_idx (value)
+);
+`
+
+const insertSearchEntrySQL = "" +
+	"INSERT IGNORE INTO syncapi_event_search (event_id, room_id, sender, type, `key`, value)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const deleteSearchEntriesForEventSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1"
+
+const deleteSearchEntriesForRoomSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE room_id = $1"
+
+type searchStatements struct {
+	insertSearchEntryStmt           *sql.Stmt
+	deleteSearchEntriesForEventStmt *sql.Stmt
+	deleteSearchEntriesForRoomStmt  *sql.Stmt
+	db                              *sql.DB
+}
+
+func NewMySQLSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{db: db}
+	var err error
+	if s.insertSearchEntryStmt, err = db.Prepare(insertSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForEventStmt, err = db.Prepare(deleteSearchEntriesForEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForRoomStmt, err = db.Prepare(deleteSearchEntriesForRoomSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEntry(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, sender, eventType, key, value string,
+) error {
+	stmt := common.TxStmt(txn, s.insertSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, sender, eventType, key, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	// Every word of the search term must appear in the value.
+	var required []string
+	for _, word := range strings.Fields(searchTerm) {
+		if word = strings.Trim(word, booleanModeOperators); word != "" {
+			required = append(required, "+"+word)
+		}
+	}
+	if len(required) == 0 || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+
+	args := []interface{}{strings.Join(required, " ")}
+	roomIDsIn := common.QueryVariadicOffset(len(roomIDs), len(args))
+	for _, roomID := range roomIDs {
+		args = append(args, roomID)
+	}
+	keysIn := common.QueryVariadicOffset(len(keys), len(args))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	where := " FROM syncapi_event_search" +
+		" WHERE MATCH (value) AGAINST ($1 IN BOOLEAN MODE)" +
+		" AND room_id IN " + roomIDsIn + " AND `key` IN " + keysIn
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*)"+where, args...).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	orderBy := " ORDER BY id DESC"
+	if orderByRank {
+		orderBy = " ORDER BY search_rank DESC, id DESC"
+	}
+	query := "SELECT event_id, MATCH (value) AGAINST ($1 IN BOOLEAN MODE) AS search_rank" + where + orderBy +
+		fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// booleanModeOperators are the characters which have a special meaning in a
+// boolean mode full-text search, which are trimmed from the search words.
+const booleanModeOperators = `+-<>()~*"@`
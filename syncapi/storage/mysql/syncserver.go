@@ -0,0 +1,114 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/shared"
+)
+
+// SyncServerDatasource represents a sync server datasource which manages
+// both the database for PDUs and caches for EDUs.
+type SyncServerDatasource struct {
+	shared.Database
+	db *sql.DB
+	common.PartitionOffsetStatements
+	streamID streamIDStatements
+}
+
+// NewDatabase creates a new sync server database
+// nolint: gocyclo
+func NewDatabase(dataSourceName string, dbProperties common.DbProperties) (*SyncServerDatasource, error) {
+	var d SyncServerDatasource
+	dsn, err := sqlutil.ParseMySQLDataSourceName(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if d.db, err = sqlutil.Open(sqlutil.MySQLDriverName, dsn, dbProperties); err != nil {
+		return nil, err
+	}
+	if err = sqlutil.NewMigrator(d.db, "syncapi", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.prepare(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (d *SyncServerDatasource) prepare() (err error) {
+	if err = d.PartitionOffsetStatements.PrepareMySQL(d.db, "syncapi"); err != nil {
+		return err
+	}
+	if err = d.streamID.prepare(d.db); err != nil {
+		return err
+	}
+	accountData, err := NewMySQLAccountDataTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	events, err := NewMySQLEventsTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	roomState, err := NewMySQLCurrentRoomStateTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	invites, err := NewMySQLInvitesTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	topology, err := NewMySQLTopologyTable(d.db)
+	if err != nil {
+		return err
+	}
+	bwExtrem, err := NewMySQLBackwardsExtremitiesTable(d.db)
+	if err != nil {
+		return err
+	}
+	filter, err := NewMySQLFilterTable(d.db)
+	if err != nil {
+		return err
+	}
+	search, err := NewMySQLSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	var searchPartitions common.PartitionOffsetStatements
+	if err = searchPartitions.PrepareMySQL(d.db, "syncapi_search"); err != nil {
+		return err
+	}
+	d.Database = shared.Database{
+		DB:                  d.db,
+		Invites:             invites,
+		AccountData:         accountData,
+		OutputEvents:        events,
+		BackwardExtremities: bwExtrem,
+		Filter:              filter,
+		Search:              search,
+		SearchPartitions:    &searchPartitions,
+		CurrentRoomState:    roomState,
+		Topology:            topology,
+		EDUCache:            cache.New(),
+	}
+	return nil
+}
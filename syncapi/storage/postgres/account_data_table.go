@@ -51,7 +51,7 @@ CREATE UNIQUE INDEX IF NOT EXISTS syncapi_account_data_id_idx ON syncapi_account
 
 const insertAccountDataSQL = "" +
 	"INSERT INTO syncapi_account_data_type (user_id, room_id, type) VALUES ($1, $2, $3)" +
-	" ON CONFLICT ON CONSTRAINT syncapi_account_data_unique" +
+	" ON CONFLICT (user_id, room_id, type)" +
 	" DO UPDATE SET id = EXCLUDED.id" +
 	" RETURNING id"
 
@@ -73,10 +73,7 @@ type accountDataStatements struct {
 
 func NewPostgresAccountDataTable(db *sql.DB) (tables.AccountData, error) {
 	s := &accountDataStatements{}
-	_, err := db.Exec(accountDataSchema)
-	if err != nil {
-		return nil, err
-	}
+	var err error
 	if s.insertAccountDataStmt, err = db.Prepare(insertAccountDataSQL); err != nil {
 		return nil, err
 	}
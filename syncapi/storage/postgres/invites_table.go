@@ -60,19 +60,20 @@ const selectInviteEventsInRangeSQL = "" +
 const selectMaxInviteIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_invite_events"
 
+const deleteInviteEventsForRoomSQL = "" +
+	"DELETE FROM syncapi_invite_events WHERE room_id = $1"
+
 type inviteEventsStatements struct {
 	insertInviteEventStmt         *sql.Stmt
 	selectInviteEventsInRangeStmt *sql.Stmt
 	deleteInviteEventStmt         *sql.Stmt
 	selectMaxInviteIDStmt         *sql.Stmt
+	deleteInviteEventsForRoomStmt *sql.Stmt
 }
 
 func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
 	s := &inviteEventsStatements{}
-	_, err := db.Exec(inviteEventsSchema)
-	if err != nil {
-		return nil, err
-	}
+	var err error
 	if s.insertInviteEventStmt, err = db.Prepare(insertInviteEventSQL); err != nil {
 		return nil, err
 	}
@@ -85,6 +86,9 @@ func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
 	if s.selectMaxInviteIDStmt, err = db.Prepare(selectMaxInviteIDSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteInviteEventsForRoomStmt, err = db.Prepare(deleteInviteEventsForRoomSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -156,3 +160,11 @@ func (s *inviteEventsStatements) SelectMaxInviteID(
 	}
 	return
 }
+
+// DeleteInviteEventsForRoom removes all invite events for the room.
+func (s *inviteEventsStatements) DeleteInviteEventsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := common.TxStmt(txn, s.deleteInviteEventsForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
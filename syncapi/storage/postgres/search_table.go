@@ -0,0 +1,167 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const searchSchema = `
+-- Stores the searchable parts of events, i.e. the bodies of messages and the
+-- names and topics of rooms, as text search vectors.
+CREATE TABLE IF NOT EXISTS syncapi_event_search (
+	-- Orders the events in the order they were indexed.
+	id BIGSERIAL PRIMARY KEY,
+	-- The event ID of the event.
+	event_id TEXT NOT NULL,
+	-- The room ID of the room the event is in.
+	room_id TEXT NOT NULL,
+	-- The sender of the event.
+	sender TEXT NOT NULL,
+	-- The type of the event.
+	type TEXT NOT NULL,
+	-- The key of the event's content which was indexed, e.g. "content.body".
+	key TEXT NOT NULL,
+	-- The text search vector of the value of the key.
+	vector TSVECTOR NOT NULL,
+	CONSTRAINT syncapi_event_search_unique UNIQUE (event_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_event_search_room_id_idx ON syncapi_event_search (room_id);
+CREATE INDEX IF NOT EXISTS syncapi_event_search_vector_idx ON syncapi_event_search USING GIN (vector);
+`
+
+const insertSearchEntrySQL = "" +
+	"INSERT INTO syncapi_event_search (event_id, room_id, sender, type, key, vector)" +
+	" VALUES ($1, $2, $3, $4, $5, to_tsvector('english', $6))" +
+	" ON CONFLICT ON CONSTRAINT syncapi_event_search_unique DO NOTHING"
+
+const deleteSearchEntriesForEventSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1"
+
+const deleteSearchEntriesForRoomSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE room_id = $1"
+
+const selectSearchResultsByRankSQL = "" +
+	"SELECT event_id, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, id DESC LIMIT $4 OFFSET $5"
+
+const selectSearchResultsByRecencySQL = "" +
+	"SELECT event_id, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY id DESC LIMIT $4 OFFSET $5"
+
+const selectSearchResultCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_event_search, plainto_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)"
+
+type searchStatements struct {
+	insertSearchEntryStmt            *sql.Stmt
+	deleteSearchEntriesForEventStmt  *sql.Stmt
+	deleteSearchEntriesForRoomStmt   *sql.Stmt
+	selectSearchResultsByRankStmt    *sql.Stmt
+	selectSearchResultsByRecencyStmt *sql.Stmt
+	selectSearchResultCountStmt      *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{}
+	var err error
+	if s.insertSearchEntryStmt, err = db.Prepare(insertSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForEventStmt, err = db.Prepare(deleteSearchEntriesForEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForRoomStmt, err = db.Prepare(deleteSearchEntriesForRoomSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRankStmt, err = db.Prepare(selectSearchResultsByRankSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRecencyStmt, err = db.Prepare(selectSearchResultsByRecencySQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultCountStmt, err = db.Prepare(selectSearchResultCountSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEntry(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, sender, eventType, key, value string,
+) error {
+	stmt := common.TxStmt(txn, s.insertSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, sender, eventType, key, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	var count int
+	err := s.selectSearchResultCountStmt.QueryRowContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys),
+	).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+	stmt := s.selectSearchResultsByRecencyStmt
+	if orderByRank {
+		stmt = s.selectSearchResultsByRankStmt
+	}
+	rows, err := stmt.QueryContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
@@ -16,6 +16,7 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -37,11 +38,33 @@ type SyncServerDatasource struct {
 
 // NewDatabase creates a new sync server database
 func NewDatabase(dbDataSourceName string, dbProperties common.DbProperties) (*SyncServerDatasource, error) {
+	return newDatabase("postgres", dbDataSourceName, dbProperties, cache.New())
+}
+
+// NewReadReplicaDatabase opens a read-only replica of a sync server database.
+// The schema must already have been created through the primary database. The
+// replica shares the primary's EDU cache, since EDUs aren't stored in the
+// database.
+func NewReadReplicaDatabase(
+	dbDataSourceName string, dbProperties common.DbProperties, eduCache *cache.EDUCache,
+) (*SyncServerDatasource, error) {
+	return newDatabase(sqlutil.ReadReplicaDriverName, dbDataSourceName, dbProperties, eduCache)
+}
+
+func newDatabase(
+	driverName, dbDataSourceName string, dbProperties common.DbProperties, eduCache *cache.EDUCache,
+) (*SyncServerDatasource, error) {
 	var d SyncServerDatasource
 	var err error
-	if d.db, err = sqlutil.Open("postgres", dbDataSourceName, dbProperties); err != nil {
+	if d.db, err = sqlutil.Open(driverName, dbDataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
+	// The schema of a read replica is migrated through its primary.
+	if driverName != sqlutil.ReadReplicaDriverName {
+		if err = sqlutil.NewMigrator(d.db, "syncapi", migrations).Up(context.Background()); err != nil {
+			return nil, err
+		}
+	}
 	if err = d.PartitionOffsetStatements.Prepare(d.db, "syncapi"); err != nil {
 		return nil, err
 	}
@@ -69,6 +92,18 @@ func NewDatabase(dbDataSourceName string, dbProperties common.DbProperties) (*Sy
 	if err != nil {
 		return nil, err
 	}
+	filter, err := NewPostgresFilterTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	var searchPartitions common.PartitionOffsetStatements
+	if err = searchPartitions.Prepare(d.db, "syncapi_search"); err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -77,7 +112,10 @@ func NewDatabase(dbDataSourceName string, dbProperties common.DbProperties) (*Sy
 		Topology:            topology,
 		CurrentRoomState:    currState,
 		BackwardExtremities: backwardExtremities,
-		EDUCache:            cache.New(),
+		Filter:              filter,
+		Search:              search,
+		SearchPartitions:    &searchPartitions,
+		EDUCache:            eduCache,
 	}
 	return &d, nil
 }
@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// WithReadReplica returns a database which serves sync requests from a
+// read-only Postgres replica of the primary database, and sends everything else
+// to the primary. Incremental syncs are only served by the replica once it has
+// caught up with the position being synced to, since otherwise the client would
+// miss the events that the replica doesn't have yet. Complete syncs are always
+// served by the replica, since the client carries on from whatever position the
+// replica had reached.
+func WithReadReplica(
+	primary Database, replicaDataSourceName string, dbProperties common.DbProperties,
+) (Database, error) {
+	p, ok := primary.(*postgres.SyncServerDatasource)
+	if !ok {
+		return nil, fmt.Errorf("read replicas are only supported for postgres databases")
+	}
+	replica, err := postgres.NewReadReplicaDatabase(replicaDataSourceName, dbProperties, p.EDUCache)
+	if err != nil {
+		return nil, err
+	}
+	return &readReplicaDatabase{Database: primary, replica: replica}, nil
+}
+
+type readReplicaDatabase struct {
+	Database
+	replica Database
+}
+
+// replicaHasReached returns true if the replica has caught up with the given
+// position in the sync stream.
+func (d *readReplicaDatabase) replicaHasReached(ctx context.Context, pos types.StreamPosition) bool {
+	replicaPos, err := d.replica.SyncStreamPosition(ctx)
+	return err == nil && replicaPos >= pos
+}
+
+func (d *readReplicaDatabase) IncrementalSync(
+	ctx context.Context, device authtypes.Device, fromPos, toPos types.StreamingToken,
+	numRecentEventsPerRoom int, wantFullState bool,
+) (*types.Response, error) {
+	if d.replicaHasReached(ctx, toPos.PDUPosition()) {
+		return d.replica.IncrementalSync(ctx, device, fromPos, toPos, numRecentEventsPerRoom, wantFullState)
+	}
+	return d.Database.IncrementalSync(ctx, device, fromPos, toPos, numRecentEventsPerRoom, wantFullState)
+}
+
+func (d *readReplicaDatabase) CompleteSync(
+	ctx context.Context, userID string, numRecentEventsPerRoom int,
+) (*types.Response, error) {
+	return d.replica.CompleteSync(ctx, userID, numRecentEventsPerRoom)
+}
+
+func (d *readReplicaDatabase) GetAccountDataInRange(
+	ctx context.Context, userID string, r types.Range,
+	accountDataFilterPart *gomatrixserverlib.EventFilter,
+) (map[string][]string, error) {
+	if d.replicaHasReached(ctx, r.High()) {
+		return d.replica.GetAccountDataInRange(ctx, userID, r, accountDataFilterPart)
+	}
+	return d.Database.GetAccountDataInRange(ctx, userID, r, accountDataFilterPart)
+}
+
+func (d *readReplicaDatabase) Events(
+	ctx context.Context, eventIDs []string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	events, err := d.replica.Events(ctx, eventIDs)
+	if err != nil || len(events) < len(eventIDs) {
+		return d.Database.Events(ctx, eventIDs)
+	}
+	return events, nil
+}
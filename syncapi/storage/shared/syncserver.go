@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -27,9 +28,123 @@ type Database struct {
 	Topology            tables.Topology
 	CurrentRoomState    tables.CurrentRoomState
 	BackwardExtremities tables.BackwardsExtremities
+	Filter              tables.Filter
+	Search              tables.Search
+	SearchPartitions    common.PartitionStorer
 	EDUCache            *cache.EDUCache
 }
 
+// searchableKeys are the keys of the content of each type of event which are
+// added to the full-text search index.
+var searchableKeys = map[string]string{
+	"m.room.message": "body",
+	"m.room.name":    "name",
+	"m.room.topic":   "topic",
+}
+
+// SearchIndexPartitions returns where the consumer which feeds the full-text
+// search index has reached in the room server's output log.
+func (d *Database) SearchIndexPartitions() common.PartitionStorer {
+	return d.SearchPartitions
+}
+
+// IndexEventForSearch adds the searchable parts of the event, if it has any,
+// to the full-text search index.
+func (d *Database) IndexEventForSearch(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error {
+	key, ok := searchableKeys[ev.Type()]
+	if !ok {
+		return nil
+	}
+	value := gjson.GetBytes(ev.Content(), key)
+	if value.Type != gjson.String || value.Str == "" {
+		return nil
+	}
+	return d.Search.InsertSearchEntry(
+		ctx, nil, ev.EventID(), ev.RoomID(), ev.Sender(), ev.Type(), "content."+key, value.Str,
+	)
+}
+
+// RemoveEventFromSearch removes the event from the full-text search index,
+// e.g. after it has been redacted.
+func (d *Database) RemoveEventFromSearch(ctx context.Context, eventID string) error {
+	return d.Search.DeleteSearchEntriesForEvent(ctx, nil, eventID)
+}
+
+// RemoveRoomFromSearch removes all of the room's events from the full-text
+// search index.
+func (d *Database) RemoveRoomFromSearch(ctx context.Context, roomID string) error {
+	return d.Search.DeleteSearchEntriesForRoom(ctx, nil, roomID)
+}
+
+// SearchRoomEvents returns up to limit of the events in the given rooms whose
+// given keys match the search term, skipping the first offset of them, along
+// with how many events match in total. Events which have been indexed but not
+// yet stored by the sync API are left out.
+func (d *Database) SearchRoomEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	results, count, err := d.Search.SelectSearchResults(
+		ctx, searchTerm, roomIDs, keys, orderByRank, limit, offset,
+	)
+	if err != nil || len(results) == 0 {
+		return nil, count, err
+	}
+	eventIDs := make([]string, len(results))
+	for i := range results {
+		eventIDs[i] = results[i].EventID
+	}
+	streamEvents, err := d.OutputEvents.SelectEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	events := make(map[string]gomatrixserverlib.HeaderedEvent, len(streamEvents))
+	for _, ev := range d.StreamEventsToEvents(nil, streamEvents) {
+		events[ev.EventID()] = ev
+	}
+	found := results[:0]
+	for _, result := range results {
+		if ev, ok := events[result.EventID]; ok {
+			result.Event = ev
+			found = append(found, result)
+		}
+	}
+	return found, count, nil
+}
+
+// RoomIDsWithMembership returns the IDs of the rooms which the user currently
+// has the given membership of.
+func (d *Database) RoomIDsWithMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
+}
+
+// GetFilter looks up the filter with the given ID uploaded by the user with the
+// given localpart. Returns sql.ErrNoRows if there is no such filter.
+func (d *Database) GetFilter(
+	ctx context.Context, localpart string, filterID string,
+) (*gomatrixserverlib.Filter, error) {
+	return d.Filter.SelectFilter(ctx, localpart, filterID)
+}
+
+// PutFilter stores the filter for the user with the given localpart and
+// returns its ID.
+func (d *Database) PutFilter(
+	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+) (string, error) {
+	return d.Filter.InsertFilter(ctx, filter, localpart)
+}
+
+// ImportFilter stores a filter which was moved from another database, keeping
+// its ID so that clients can still refer to it. Nothing is stored if there is
+// already a filter with the ID.
+func (d *Database) ImportFilter(
+	ctx context.Context, localpart string, filterID int64, filterJSON []byte,
+) error {
+	return d.Filter.ImportFilter(ctx, localpart, filterID, filterJSON)
+}
+
 // Events lookups a list of event by their event ID.
 // Returns a list of events matching the requested IDs found in the database.
 // If an event is not found in the database then it will be omitted from the list.
@@ -166,6 +281,70 @@ func (d *Database) RetireInviteEvent(
 	return err
 }
 
+// RedactEvent replaces the stored event with its redacted form, with the
+// redaction event in its unsigned "redacted_because" field. Does nothing
+// if the event isn't in the database.
+// Returns an error if there was a problem communicating with the database.
+func (d *Database) RedactEvent(
+	ctx context.Context, redactedEventID string, redactedBecause gomatrixserverlib.HeaderedEvent,
+) error {
+	return common.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		streamEvents, err := d.OutputEvents.SelectEvents(ctx, txn, []string{redactedEventID})
+		if err != nil {
+			return err
+		}
+		if len(streamEvents) == 0 {
+			return nil
+		}
+		// Events loaded from a HeaderedEvent are always flagged as redacted,
+		// which would make Redact a no-op, so parse the JSON again first.
+		original := streamEvents[0].HeaderedEvent
+		originalEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(
+			original.JSON(), false, original.RoomVersion,
+		)
+		if err != nil {
+			return err
+		}
+		redactedEvent := originalEvent.Redact()
+		redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(
+			redactedEvent.JSON(), true, original.RoomVersion,
+		)
+		if err != nil {
+			return err
+		}
+		redactedBecauseClient := gomatrixserverlib.ToClientEvent(redactedBecause.Unwrap(), gomatrixserverlib.FormatAll)
+		if err = redacted.SetUnsignedField("redacted_because", redactedBecauseClient); err != nil {
+			return err
+		}
+		headered := redacted.Headered(original.RoomVersion)
+		if err = d.OutputEvents.UpdateEventJSON(ctx, txn, headered); err != nil {
+			return err
+		}
+		return d.CurrentRoomState.UpdateEventJSON(ctx, txn, headered)
+	})
+}
+
+// PurgeRoom removes all events, state, invites and backwards extremities
+// for the room from the database.
+// Returns an error if there was a problem communicating with the database.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return common.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if err := d.OutputEvents.DeleteEventsForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.Topology.DeleteTopologyForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.CurrentRoomState.DeleteRoomStateForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.Invites.DeleteInviteEventsForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.BackwardExtremities.DeleteBackwardExtremitiesForRoom(ctx, txn, roomID)
+	})
+}
+
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
 // Returns a map following the format data[roomID] = []dataTypes
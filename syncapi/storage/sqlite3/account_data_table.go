@@ -60,10 +60,7 @@ func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables
 	s := &accountDataStatements{
 		streamIDStatements: streamID,
 	}
-	_, err := db.Exec(accountDataSchema)
-	if err != nil {
-		return nil, err
-	}
+	var err error
 	if s.insertAccountDataStmt, err = db.Prepare(insertAccountDataSQL); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,44 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import "github.com/matrix-org/dendrite/internal/sqlutil"
+
+// migrations are the schema migrations for the sync API database, in order.
+var migrations = []sqlutil.Migration{
+	{
+		Version:     1,
+		Description: "Create the initial schema",
+		Up: sqlutil.Statements(
+			streamIDTableSchema,
+			accountDataSchema,
+			outputRoomEventsSchema,
+			currentRoomStateSchema,
+			inviteEventsSchema,
+			outputRoomEventsTopologySchema,
+			backwardExtremitiesSchema,
+		),
+	},
+	{
+		Version:     2,
+		Description: "Store filters, which used to be stored in the accounts database",
+		Up:          sqlutil.Statements(filterSchema),
+	},
+	{
+		Version:     3,
+		Description: "Add the full-text search index",
+		Up:          sqlutil.Statements(searchSchema),
+	},
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// SQLite's full-text search extensions aren't available in every build of
+// SQLite that Dendrite can use, so events are searched by matching each word
+// of the search term as a substring, and ranked by how often the words appear.
+const searchSchema = `
+-- Stores the searchable parts of events, i.e. the bodies of messages and the
+-- names and topics of rooms.
+CREATE TABLE IF NOT EXISTS syncapi_event_search (
+	-- Orders the events in the order they were indexed.
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The event ID of the event.
+	event_id TEXT NOT NULL,
+	-- The room ID of the room the event is in.
+	room_id TEXT NOT NULL,
+	-- The sender of the event.
+	sender TEXT NOT NULL,
+	-- The type of the event.
+	type TEXT NOT NULL,
+	-- The key of the event's content which was indexed, e.g. "content.body".
+	key TEXT NOT NULL,
+	-- The value of the key.
+	value TEXT NOT NULL,
+	UNIQUE (event_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_event_search_room_id_idx ON syncapi_event_search (room_id);
+`
+
+const insertSearchEntrySQL = "" +
+	"INSERT INTO syncapi_event_search (event_id, room_id, sender, type, key, value)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (event_id, key) DO NOTHING"
+
+const deleteSearchEntriesForEventSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE event_id = $1"
+
+const deleteSearchEntriesForRoomSQL = "" +
+	"DELETE FROM syncapi_event_search WHERE room_id = $1"
+
+type searchStatements struct {
+	insertSearchEntryStmt           *sql.Stmt
+	deleteSearchEntriesForEventStmt *sql.Stmt
+	deleteSearchEntriesForRoomStmt  *sql.Stmt
+	db                              *sql.DB
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{db: db}
+	var err error
+	if s.insertSearchEntryStmt, err = db.Prepare(insertSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForEventStmt, err = db.Prepare(deleteSearchEntriesForEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntriesForRoomStmt, err = db.Prepare(deleteSearchEntriesForRoomSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEntry(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, sender, eventType, key, value string,
+) error {
+	stmt := common.TxStmt(txn, s.insertSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, sender, eventType, key, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntriesForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteSearchEntriesForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	words := strings.Fields(strings.ToLower(searchTerm))
+	if len(words) == 0 || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+
+	// SQLite numbers the parameters in the order that they first appear in
+	// the query, so each parameter is used exactly once and in order.
+	where, whereArgs := searchConditions(words, roomIDs, keys, 0)
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*)"+where, whereArgs...).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	// The rank is the number of times that the words appear in the value.
+	var args []interface{}
+	occurrences := make([]string, len(words))
+	for i, word := range words {
+		args = append(args, word, word)
+		occurrences[i] = fmt.Sprintf(
+			"(length(lower(value)) - length(replace(lower(value), $%d, ''))) / length($%d)", len(args)-1, len(args),
+		)
+	}
+	where, whereArgs = searchConditions(words, roomIDs, keys, len(args))
+	args = append(args, whereArgs...)
+	orderBy := " ORDER BY id DESC"
+	if orderByRank {
+		orderBy = " ORDER BY rank DESC, id DESC"
+	}
+	query := "SELECT event_id, " + strings.Join(occurrences, " + ") + " AS rank" + where + orderBy +
+		fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// searchConditions returns the FROM and WHERE clauses which select the entries
+// matching all of the words, numbering the parameters from offset+1.
+func searchConditions(words, roomIDs, keys []string, offset int) (string, []interface{}) {
+	var args []interface{}
+	roomIDsIn := common.QueryVariadicOffset(len(roomIDs), offset)
+	for _, roomID := range roomIDs {
+		args = append(args, roomID)
+	}
+	keysIn := common.QueryVariadicOffset(len(keys), offset+len(args))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	conditions := make([]string, len(words))
+	for i, word := range words {
+		args = append(args, "%"+escapeLikePattern(word)+"%")
+		conditions[i] = fmt.Sprintf(`value LIKE $%d ESCAPE '\'`, offset+len(args))
+	}
+	where := " FROM syncapi_event_search" +
+		" WHERE room_id IN " + roomIDsIn + " AND key IN " + keysIn +
+		" AND " + strings.Join(conditions, " AND ")
+	return where, args
+}
+
+// escapeLikePattern escapes the characters which have a special meaning in a
+// LIKE pattern.
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
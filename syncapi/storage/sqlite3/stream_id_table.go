@@ -32,10 +32,6 @@ type streamIDStatements struct {
 }
 
 func (s *streamIDStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(streamIDTableSchema)
-	if err != nil {
-		return
-	}
 	if s.increaseStreamIDStmt, err = db.Prepare(increaseStreamIDStmt); err != nil {
 		return
 	}
@@ -16,15 +16,13 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/url"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 
-	// Import the sqlite3 package
-	_ "github.com/mattn/go-sqlite3"
-
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/syncapi/storage/shared"
@@ -58,6 +56,9 @@ func NewDatabase(dataSourceName string) (*SyncServerDatasource, error) {
 	if d.db, err = sqlutil.Open(common.SQLiteDriverName(), cs, nil); err != nil {
 		return nil, err
 	}
+	if err = sqlutil.NewMigrator(d.db, "syncapi", migrations).Up(context.Background()); err != nil {
+		return nil, err
+	}
 	if err = d.prepare(); err != nil {
 		return nil, err
 	}
@@ -95,12 +96,27 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	filter, err := NewSqliteFilterTable(d.db)
+	if err != nil {
+		return err
+	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	var searchPartitions common.PartitionOffsetStatements
+	if err = searchPartitions.Prepare(d.db, "syncapi_search"); err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
 		AccountData:         accountData,
 		OutputEvents:        events,
 		BackwardExtremities: bwExtrem,
+		Filter:              filter,
+		Search:              search,
+		SearchPartitions:    &searchPartitions,
 		CurrentRoomState:    roomState,
 		Topology:            topology,
 		EDUCache:            cache.New(),
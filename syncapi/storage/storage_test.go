@@ -3,13 +3,15 @@ package storage_test
 import (
 	"context"
 	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/test"
 	"github.com/matrix-org/dendrite/syncapi/storage"
-	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -50,12 +52,19 @@ func MustCreateEvent(t *testing.T, roomID string, prevs []gomatrixserverlib.Head
 	return e.Headered(testRoomVersion)
 }
 
-func MustCreateDatabase(t *testing.T) storage.Database {
-	db, err := sqlite3.NewDatabase("file::memory:")
+// MustCreateDatabase creates an empty database, which is on the server named by
+// DENDRITE_TEST_DATABASE if it is set. The returned function removes it again.
+func MustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dataSource, closeDB, err := test.NewDatabase()
 	if err != nil {
+		t.Fatalf("failed to create the test database: %s", err)
+	}
+	db, err := storage.NewSyncServerDatasource(dataSource, nil)
+	if err != nil {
+		closeDB()
 		t.Fatalf("NewSyncServerDatasource returned %s", err)
 	}
-	return db
+	return db, closeDB
 }
 
 // Create a list of events which include a create event, join event and some messages.
@@ -126,7 +135,8 @@ func MustWriteEvents(t *testing.T, db storage.Database, events []gomatrixserverl
 
 func TestWriteEvents(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 	MustWriteEvents(t, db, events)
 }
@@ -134,7 +144,8 @@ func TestWriteEvents(t *testing.T) {
 // These tests assert basic functionality of the IncrementalSync and CompleteSync functions.
 func TestSyncResponse(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 	positions := MustWriteEvents(t, db, events)
 	latest, err := db.SyncPosition(ctx)
@@ -223,7 +234,8 @@ func TestSyncResponse(t *testing.T) {
 
 func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 	positions := MustWriteEvents(t, db, events)
 	latest, err := db.SyncPosition(ctx)
@@ -267,7 +279,8 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a stream token.
 func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 	MustWriteEvents(t, db, events)
 	latest, err := db.SyncPosition(ctx)
@@ -289,7 +302,8 @@ func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a topology token
 func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 	MustWriteEvents(t, db, events)
 	from, err := db.MaxTopologicalPosition(ctx, testRoomID)
@@ -321,7 +335,8 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 // - Backpagination from the middle of the fork should not return duplicates (things later than the token).
 func TestGetEventsInRangeWithEventsSameDepth(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 
 	var events []gomatrixserverlib.HeaderedEvent
 	events = append(events, MustCreateEvent(t, testRoomID, nil, &gomatrixserverlib.EventBuilder{
@@ -411,7 +426,8 @@ func TestGetEventsInRangeWithEventsSameDepth(t *testing.T) {
 // that this check isn't using the room ID if the brackets are wrong in the SQL query.
 func TestGetEventsInTopologicalRangeMultiRoom(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 
 	makeEvents := func(roomID string) (events []gomatrixserverlib.HeaderedEvent) {
 		events = append(events, MustCreateEvent(t, roomID, nil, &gomatrixserverlib.EventBuilder{
@@ -462,7 +478,8 @@ func TestGetEventsInTopologicalRangeMultiRoom(t *testing.T) {
 // The test then does a backfill to ensure that the response is ordered correctly according to depth.
 func TestGetEventsInRangeWithEventsInsertedLikeBackfill(t *testing.T) {
 	t.Parallel()
-	db := MustCreateDatabase(t)
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
 	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
 
 	// "federation" join
@@ -512,6 +529,49 @@ func TestGetEventsInRangeWithEventsInsertedLikeBackfill(t *testing.T) {
 	}
 }
 
+// The stored copy of a redacted event should be replaced with its redacted form.
+func TestRedactEvent(t *testing.T) {
+	t.Parallel()
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	redactedEventID := events[3].EventID()
+	redaction := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{}`),
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Sender:  testUserIDA,
+		Redacts: redactedEventID,
+		Depth:   int64(len(events) + 1),
+	})
+	if err := db.RedactEvent(ctx, redactedEventID, redaction); err != nil {
+		t.Fatalf("RedactEvent failed: %s", err)
+	}
+
+	got, err := db.Events(ctx, []string{redactedEventID})
+	if err != nil {
+		t.Fatalf("Events failed: %s", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d events, want 1", len(got))
+	}
+	if string(got[0].Content()) != "{}" {
+		t.Errorf("got content %s, want {}", string(got[0].Content()))
+	}
+	var unsigned struct {
+		RedactedBecause struct {
+			EventID string `json:"event_id"`
+		} `json:"redacted_because"`
+	}
+	if err = json.Unmarshal(got[0].Unsigned(), &unsigned); err != nil {
+		t.Fatalf("failed to unmarshal unsigned: %s", err)
+	}
+	if unsigned.RedactedBecause.EventID != redaction.EventID() {
+		t.Errorf("got redacted_because %q, want %q", unsigned.RedactedBecause.EventID, redaction.EventID())
+	}
+}
+
 func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatrixserverlib.ClientEvent, wants []gomatrixserverlib.HeaderedEvent) {
 	if len(gots) != len(wants) {
 		t.Fatalf("%s response returned %d events, want %d", msg, len(gots), len(wants))
@@ -552,6 +612,82 @@ func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatr
 	}
 }
 
+func TestPutAndGetFilter(t *testing.T) {
+	t.Parallel()
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.Timeline.Types = []string{"m.room.message"}
+
+	filterID, err := db.PutFilter(ctx, "hornet", &filter)
+	if err != nil {
+		t.Fatalf("PutFilter failed: %s", err)
+	}
+	// Uploading the same filter again returns the same ID.
+	if sameID, err := db.PutFilter(ctx, "hornet", &filter); err != nil {
+		t.Fatalf("PutFilter failed: %s", err)
+	} else if sameID != filterID {
+		t.Errorf("PutFilter returned %q for the same filter, want %q", sameID, filterID)
+	}
+
+	got, err := db.GetFilter(ctx, "hornet", filterID)
+	if err != nil {
+		t.Fatalf("GetFilter failed: %s", err)
+	}
+	if len(got.Room.Timeline.Types) != 1 || got.Room.Timeline.Types[0] != "m.room.message" {
+		t.Errorf("GetFilter returned timeline types %v, want [m.room.message]", got.Room.Timeline.Types)
+	}
+	// Filters belong to the user who uploaded them.
+	if _, err = db.GetFilter(ctx, "paleking", filterID); err != sql.ErrNoRows {
+		t.Errorf("GetFilter for another user returned %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestSearchRoomEvents(t *testing.T) {
+	t.Parallel()
+	db, closeDB := MustCreateDatabase(t)
+	defer closeDB()
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	for i := range events {
+		if err := db.IndexEventForSearch(ctx, &events[i]); err != nil {
+			t.Fatalf("IndexEventForSearch failed: %s", err)
+		}
+	}
+	roomIDs := []string{testRoomID}
+	keys := []string{"content.body"}
+
+	results, count, err := db.SearchRoomEvents(ctx, "message b 3", roomIDs, keys, true, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents failed: %s", err)
+	}
+	if count != 1 || len(results) != 1 || results[0].Event.EventID() != events[15].EventID() {
+		t.Fatalf("SearchRoomEvents returned %d of %d results, want only %s", len(results), count, events[15].EventID())
+	}
+
+	// Ordering by recency returns the latest messages first.
+	results, count, err = db.SearchRoomEvents(ctx, "message", roomIDs, keys, false, 5, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents failed: %s", err)
+	}
+	if count != 20 || len(results) != 5 {
+		t.Fatalf("SearchRoomEvents returned %d of %d results, want 5 of 20", len(results), count)
+	}
+	if results[0].Event.EventID() != events[len(events)-1].EventID() {
+		t.Errorf("SearchRoomEvents returned %s first, want %s", results[0].Event.EventID(), events[len(events)-1].EventID())
+	}
+
+	// Redacted events are no longer found.
+	if err = db.RemoveEventFromSearch(ctx, events[15].EventID()); err != nil {
+		t.Fatalf("RemoveEventFromSearch failed: %s", err)
+	}
+	if _, count, err = db.SearchRoomEvents(ctx, "message b 3", roomIDs, keys, true, 10, 0); err != nil {
+		t.Fatalf("SearchRoomEvents failed: %s", err)
+	} else if count != 0 {
+		t.Errorf("SearchRoomEvents found %d results for a removed event, want 0", count)
+	}
+}
+
 func topologyTokenBefore(t *testing.T, db storage.Database, eventID string) *types.TopologyToken {
 	tok, err := db.EventPositionInTopology(ctx, eventID)
 	if err != nil {
@@ -40,3 +40,11 @@ func NewSyncServerDatasource(
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
 }
+
+// WithReadReplica isn't supported for this architecture, since read replicas
+// must be Postgres databases.
+func WithReadReplica(
+	primary Database, replicaDataSourceName string, dbProperties common.DbProperties,
+) (Database, error) {
+	return nil, fmt.Errorf("Cannot use postgres implementation")
+}
@@ -22,6 +22,8 @@ type Invites interface {
 	// SelectInviteEventsInRange returns a map of room ID to invite events.
 	SelectInviteEventsInRange(ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range) (map[string]gomatrixserverlib.HeaderedEvent, error)
 	SelectMaxInviteID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// DeleteInviteEventsForRoom removes all invite events for the room.
+	DeleteInviteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
 type Events interface {
@@ -35,6 +37,10 @@ type Events interface {
 	// SelectEarlyEvents returns the earliest events in the given room.
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
+	// UpdateEventJSON replaces the stored JSON of the event, e.g. after it has been redacted.
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.HeaderedEvent) error
+	// DeleteEventsForRoom removes all events for the room.
+	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -52,6 +58,8 @@ type Topology interface {
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectMaxPositionInTopology returns the event which has the highest depth, and if there are multiple, the event with the highest stream position.
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
+	// DeleteTopologyForRoom removes the topological positions of all events in the room.
+	DeleteTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
 type CurrentRoomState interface {
@@ -65,6 +73,10 @@ type CurrentRoomState interface {
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// UpdateEventJSON replaces the stored JSON of the state event, e.g. after it has been redacted.
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.HeaderedEvent) error
+	// DeleteRoomStateForRoom removes all current state for the room.
+	DeleteRoomStateForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -93,4 +105,41 @@ type BackwardsExtremities interface {
 	SelectBackwardExtremitiesForRoom(ctx context.Context, roomID string) (eventIDs []string, err error)
 	// DeleteBackwardExtremity removes a backwards extremity for a room, if one existed.
 	DeleteBackwardExtremity(ctx context.Context, txn *sql.Tx, roomID, knownEventID string) (err error)
+	// DeleteBackwardExtremitiesForRoom removes all backwards extremities for the room.
+	DeleteBackwardExtremitiesForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+// Filter stores the filters uploaded by clients, which they can then refer to
+// by ID when syncing.
+type Filter interface {
+	// SelectFilter returns the filter with the given ID uploaded by the user
+	// with the given localpart. Returns sql.ErrNoRows if there is no such filter.
+	SelectFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
+	// InsertFilter stores the filter for the user with the given localpart and
+	// returns its ID. If the user has already uploaded the same filter then the
+	// ID of the existing filter is returned.
+	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
+	// ImportFilter stores the filter JSON for the user with the given localpart
+	// under the given ID, unless a filter with that ID already exists. Filters
+	// inserted afterwards get higher IDs.
+	ImportFilter(ctx context.Context, localpart string, filterID int64, filterJSON []byte) error
+}
+
+// Search is a full-text index of the searchable parts of events, i.e. the
+// bodies of messages and the names and topics of rooms.
+type Search interface {
+	// InsertSearchEntry adds the value of the given key of the event to the
+	// index. Does nothing if the event's key has already been indexed.
+	InsertSearchEntry(ctx context.Context, txn *sql.Tx, eventID, roomID, sender, eventType, key, value string) error
+	// DeleteSearchEntriesForEvent removes the event from the index, e.g. after
+	// it has been redacted.
+	DeleteSearchEntriesForEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// DeleteSearchEntriesForRoom removes all of the room's events from the index.
+	DeleteSearchEntriesForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectSearchResults returns up to limit of the events in the given rooms
+	// whose given keys match the search term, skipping the first offset of
+	// them, along with how many events match in total. The events are ordered
+	// by rank if orderByRank is true, or else with the most recent first. The
+	// results only have their event IDs and ranks filled in.
+	SelectSearchResults(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
 }
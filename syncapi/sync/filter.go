@@ -0,0 +1,302 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// eventFilter holds the parts of the different kinds of filter which decide
+// whether an event is included.
+type eventFilter struct {
+	types       []string
+	notTypes    []string
+	senders     []string
+	notSenders  []string
+	containsURL *bool
+}
+
+func (f *eventFilter) allows(ev *gomatrixserverlib.ClientEvent) bool {
+	for _, pattern := range f.notTypes {
+		if matchesWildcard(pattern, ev.Type) {
+			return false
+		}
+	}
+	if f.types != nil && !matchesAnyWildcard(f.types, ev.Type) {
+		return false
+	}
+	for _, sender := range f.notSenders {
+		if sender == ev.Sender {
+			return false
+		}
+	}
+	if f.senders != nil && !contains(f.senders, ev.Sender) {
+		return false
+	}
+	if f.containsURL != nil {
+		hasURL := gjson.GetBytes(ev.Content, "url").Exists()
+		if hasURL != *f.containsURL {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *eventFilter) filter(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(events))
+	for i := range events {
+		if f.allows(&events[i]) {
+			filtered = append(filtered, events[i])
+		}
+	}
+	return filtered
+}
+
+// FilterRoomEvents returns the events which are allowed by the filter. The
+// rooms in the filter are ignored, as are its limit and its lazy-loading
+// options, which are up to the caller.
+func FilterRoomEvents(
+	events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.RoomEventFilter,
+) []gomatrixserverlib.ClientEvent {
+	f := eventFilter{filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders, filter.ContainsURL}
+	return f.filter(events)
+}
+
+func filterRoomEventsInRoom(
+	roomID string, events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.RoomEventFilter,
+) []gomatrixserverlib.ClientEvent {
+	if !roomAllowed(roomID, filter.Rooms, filter.NotRooms) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	return FilterRoomEvents(events, filter)
+}
+
+func filterStateEventsInRoom(
+	roomID string, events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.StateFilter,
+) []gomatrixserverlib.ClientEvent {
+	if !roomAllowed(roomID, filter.Rooms, filter.NotRooms) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	f := eventFilter{filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders, filter.ContainsURL}
+	return f.filter(events)
+}
+
+func filterNonRoomEvents(
+	events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.EventFilter,
+) []gomatrixserverlib.ClientEvent {
+	f := eventFilter{filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders, nil}
+	return f.filter(events)
+}
+
+// applyFilter removes the rooms and events which the filter doesn't allow from
+// the /sync response. Event limits aren't applied here, since the timeline
+// limit is applied when the events are fetched from the database.
+func applyFilter(res *types.Response, filter *gomatrixserverlib.Filter) {
+	res.AccountData.Events = filterNonRoomEvents(res.AccountData.Events, &filter.AccountData)
+	res.Presence.Events = filterNonRoomEvents(res.Presence.Events, &filter.Presence)
+
+	roomFilter := &filter.Room
+	for roomID, jr := range res.Rooms.Join {
+		if !roomAllowed(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			delete(res.Rooms.Join, roomID)
+			continue
+		}
+		jr.State.Events = filterStateEventsInRoom(roomID, jr.State.Events, &roomFilter.State)
+		jr.Timeline.Events = filterRoomEventsInRoom(roomID, jr.Timeline.Events, &roomFilter.Timeline)
+		jr.Ephemeral.Events = filterRoomEventsInRoom(roomID, jr.Ephemeral.Events, &roomFilter.Ephemeral)
+		jr.AccountData.Events = filterRoomEventsInRoom(roomID, jr.AccountData.Events, &roomFilter.AccountData)
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		if !roomAllowed(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			delete(res.Rooms.Leave, roomID)
+			continue
+		}
+		lr.State.Events = filterStateEventsInRoom(roomID, lr.State.Events, &roomFilter.State)
+		lr.Timeline.Events = filterRoomEventsInRoom(roomID, lr.Timeline.Events, &roomFilter.Timeline)
+		res.Rooms.Leave[roomID] = lr
+	}
+	for roomID := range res.Rooms.Invite {
+		if !roomAllowed(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			delete(res.Rooms.Invite, roomID)
+		}
+	}
+}
+
+// roomAllowed returns whether the room is allowed by the rooms and not_rooms
+// lists of a filter. A nil rooms list allows every room.
+func roomAllowed(roomID string, rooms, notRooms []string) bool {
+	if contains(notRooms, roomID) {
+		return false
+	}
+	return rooms == nil || contains(rooms, roomID)
+}
+
+// eventTypeAllowed returns whether events of the given type are allowed by the
+// types and not_types lists of a filter.
+func eventTypeAllowed(eventType string, types, notTypes []string) bool {
+	if matchesAnyWildcard(notTypes, eventType) {
+		return false
+	}
+	return types == nil || matchesAnyWildcard(types, eventType)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyWildcard(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matchesWildcard(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWildcard returns whether the value matches the pattern, in which a
+// "*" matches any sequence of characters, as described in
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-user-userid-filter
+func matchesWildcard(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// filterEventFields returns the /sync response with the events in it reduced to the
+// given fields, as described by the event_fields option of a filter. Each
+// field is a path into the event with its parts separated by "." and any "."
+// in a part escaped as "\.".
+func filterEventFields(response interface{}, fields []string) (interface{}, error) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	// Decode numbers as json.Number so that large integers survive intact.
+	decoder := json.NewDecoder(bytes.NewReader(responseJSON))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err = decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	paths := make([][]string, len(fields))
+	for i, field := range fields {
+		paths[i] = splitEventFieldPath(field)
+	}
+	filterEventFieldsIn(decoded, paths)
+	return decoded, nil
+}
+
+func filterEventFieldsIn(value interface{}, paths [][]string) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, child := range object {
+		events, isList := child.([]interface{})
+		if !isList || key != "events" {
+			filterEventFieldsIn(child, paths)
+			continue
+		}
+		for i, ev := range events {
+			if evObject, isObject := ev.(map[string]interface{}); isObject {
+				events[i] = selectEventFields(evObject, paths)
+			}
+		}
+	}
+}
+
+func selectEventFields(ev map[string]interface{}, paths [][]string) map[string]interface{} {
+	selected := make(map[string]interface{})
+	for _, path := range paths {
+		var value interface{} = ev
+		found := true
+		for _, part := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			if value, ok = object[part]; !ok {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		target := selected
+		for _, part := range path[:len(path)-1] {
+			existing, exists := target[part]
+			if !exists {
+				existing = make(map[string]interface{})
+				target[part] = existing
+			}
+			// If the whole of this part has already been selected by another
+			// field then the value is already there.
+			if target, found = existing.(map[string]interface{}); !found {
+				break
+			}
+		}
+		if found {
+			target[path[len(path)-1]] = value
+		}
+	}
+	return selected
+}
+
+// splitEventFieldPath splits an event field into its parts on the unescaped
+// "." characters.
+func splitEventFieldPath(field string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(field); i++ {
+		switch {
+		case field[i] == '\\' && i+1 < len(field) && field[i+1] == '.':
+			part.WriteByte('.')
+			i++
+		case field[i] == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(field[i])
+		}
+	}
+	return append(parts, part.String())
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestMatchesWildcard(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"m.room.message", "m.room.message", true},
+		{"m.room.message", "m.room.member", false},
+		{"m.room.*", "m.room.member", true},
+		{"m.*.member", "m.room.member", true},
+		{"*.member", "m.room.member", true},
+		{"m.room.*", "m.call.invite", false},
+		{"m.*.*.x", "m.room.x", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		if got := matchesWildcard(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("matchesWildcard(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyFilter(t *testing.T) {
+	noURL := false
+	res := types.NewResponse(types.NewStreamToken(0, 0))
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$text", Sender: alice, Type: "m.room.message", Content: []byte(`{"body":"hi"}`)},
+		{EventID: "$image", Sender: alice, Type: "m.room.message", Content: []byte(`{"url":"mxc://a/b"}`)},
+		{EventID: "$bob", Sender: bob, Type: "m.room.message", Content: []byte(`{"body":"hi"}`)},
+		{EventID: "$topic", Sender: alice, Type: "m.room.topic", Content: []byte(`{"topic":"hi"}`)},
+	}
+	res.Rooms.Join[roomID] = *jr
+	res.Rooms.Join["!other:localhost"] = *types.NewJoinResponse()
+
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.NotRooms = []string{"!other:localhost"}
+	filter.Room.Timeline.Types = []string{"m.room.*"}
+	filter.Room.Timeline.NotTypes = []string{"m.room.topic"}
+	filter.Room.Timeline.NotSenders = []string{bob}
+	filter.Room.Timeline.ContainsURL = &noURL
+	applyFilter(res, &filter)
+
+	if _, ok := res.Rooms.Join["!other:localhost"]; ok {
+		t.Errorf("room in not_rooms was not removed")
+	}
+	got := eventIDs(res.Rooms.Join[roomID].Timeline.Events)
+	if want := []string{"$text"}; !equalStrings(got, want) {
+		t.Errorf("got timeline %v, want %v", got, want)
+	}
+}
+
+func TestFilterEventFields(t *testing.T) {
+	res := types.NewResponse(types.NewStreamToken(0, 0))
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{{
+		EventID: "$text", Sender: alice, Type: "m.room.message",
+		Content: []byte(`{"body":"hi","msgtype":"m.text","a.b":1}`),
+	}}
+	res.Rooms.Join[roomID] = *jr
+
+	filtered, err := filterEventFields(res, []string{"type", "content.body", `content.a\.b`})
+	if err != nil {
+		t.Fatalf("filterEventFields failed: %s", err)
+	}
+	filteredJSON, err := json.Marshal(filtered)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	var got struct {
+		Rooms struct {
+			Join map[string]struct {
+				Timeline struct {
+					Events []map[string]interface{} `json:"events"`
+				} `json:"timeline"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(filteredJSON, &got); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	events := got.Rooms.Join[roomID].Timeline.Events
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	eventJSON, _ := json.Marshal(events[0])
+	if want := `{"content":{"a.b":1,"body":"hi"},"type":"m.room.message"}`; string(eventJSON) != want {
+		t.Errorf("got event %s, want %s", eventJSON, want)
+	}
+}
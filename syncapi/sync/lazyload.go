@@ -0,0 +1,192 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// lazyLoadCacheMaxDevices is the number of devices for which the lazy-loaded
+// members are remembered. Once a device is evicted from the cache it will be
+// sent the member events again, which is wasteful but harmless.
+const lazyLoadCacheMaxDevices = 4096
+
+// LazyLoadCache remembers which member events have already been sent to each
+// device by /sync and /messages when the client asked for members to be lazily
+// loaded, so that they aren't sent again unless the client asks for redundant
+// members.
+type LazyLoadCache struct {
+	cache *lru.Cache
+}
+
+// lazyLoadedMembers holds the member events sent to a device, as a map of room
+// ID to user ID to event ID.
+type lazyLoadedMembers struct {
+	sync.Mutex
+	rooms map[string]map[string]string
+}
+
+// NewLazyLoadCache makes a new LazyLoadCache.
+func NewLazyLoadCache() (*LazyLoadCache, error) {
+	cache, err := lru.New(lazyLoadCacheMaxDevices)
+	if err != nil {
+		return nil, err
+	}
+	return &LazyLoadCache{cache}, nil
+}
+
+func lazyLoadCacheKey(device *authtypes.Device) string {
+	return device.UserID + "|" + device.ID
+}
+
+func (c *LazyLoadCache) membersFor(device *authtypes.Device) *lazyLoadedMembers {
+	key := lazyLoadCacheKey(device)
+	if members, ok := c.cache.Get(key); ok {
+		return members.(*lazyLoadedMembers)
+	}
+	members := &lazyLoadedMembers{rooms: make(map[string]map[string]string)}
+	if previous, ok, _ := c.cache.PeekOrAdd(key, members); ok {
+		return previous.(*lazyLoadedMembers)
+	}
+	return members
+}
+
+// Reset forgets which member events have been sent to the device. This should
+// be called whenever the device is about to be sent the full state of its
+// rooms, e.g. on an initial sync.
+func (c *LazyLoadCache) Reset(device *authtypes.Device) {
+	c.cache.Remove(lazyLoadCacheKey(device))
+}
+
+// isSent returns whether the member event has already been sent to the device.
+func (m *lazyLoadedMembers) isSent(roomID, userID, eventID string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.rooms[roomID][userID] == eventID
+}
+
+// markSent records that the member event has been sent to the device.
+func (m *lazyLoadedMembers) markSent(roomID, userID, eventID string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.rooms[roomID] == nil {
+		m.rooms[roomID] = make(map[string]string)
+	}
+	m.rooms[roomID][userID] = eventID
+}
+
+// LazyLoadMembers returns the state events which should be sent to a client
+// which has asked for members to be lazily loaded alongside the given timeline
+// events. Member events are removed from the state unless their user sent one
+// of the timeline events, and the member events of any senders which are
+// missing from the state are added from the current state of the room. Unless
+// includeRedundant is set, member events which have already been sent to the
+// device are left out.
+func (c *LazyLoadCache) LazyLoadMembers(
+	ctx context.Context, db storage.Database, device *authtypes.Device, roomID string,
+	state, timeline []gomatrixserverlib.ClientEvent, includeRedundant bool,
+	format gomatrixserverlib.EventFormat,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	members := c.membersFor(device)
+
+	senders := make(map[string]bool)
+	for _, ev := range timeline {
+		senders[ev.Sender] = true
+		// The client learns about member events in the timeline from the
+		// timeline itself.
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+			members.markSent(roomID, *ev.StateKey, ev.EventID)
+		}
+	}
+
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(state))
+	found := make(map[string]bool)
+	for _, ev := range state {
+		if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+			filtered = append(filtered, ev)
+			continue
+		}
+		userID := *ev.StateKey
+		if !senders[userID] {
+			continue
+		}
+		found[userID] = true
+		if !includeRedundant && members.isSent(roomID, userID, ev.EventID) {
+			continue
+		}
+		filtered = append(filtered, ev)
+		members.markSent(roomID, userID, ev.EventID)
+	}
+
+	missing := make([]string, 0, len(senders))
+	for userID := range senders {
+		if !found[userID] {
+			missing = append(missing, userID)
+		}
+	}
+	sort.Strings(missing)
+	for _, userID := range missing {
+		ev, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+		if err != nil {
+			return nil, err
+		}
+		if ev == nil {
+			continue
+		}
+		if !includeRedundant && members.isSent(roomID, userID, ev.EventID()) {
+			continue
+		}
+		filtered = append(filtered, gomatrixserverlib.HeaderedToClientEvent(*ev, format))
+		members.markSent(roomID, userID, ev.EventID())
+	}
+	return filtered, nil
+}
+
+// lazyLoadResponse applies lazy-loading of members to every room in the /sync
+// response.
+func (c *LazyLoadCache) lazyLoadResponse(
+	ctx context.Context, db storage.Database, device *authtypes.Device,
+	res *types.Response, includeRedundant bool,
+) (err error) {
+	for roomID, jr := range res.Rooms.Join {
+		jr.State.Events, err = c.LazyLoadMembers(
+			ctx, db, device, roomID, jr.State.Events, jr.Timeline.Events,
+			includeRedundant, gomatrixserverlib.FormatSync,
+		)
+		if err != nil {
+			return
+		}
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		lr.State.Events, err = c.LazyLoadMembers(
+			ctx, db, device, roomID, lr.State.Events, lr.Timeline.Events,
+			includeRedundant, gomatrixserverlib.FormatSync,
+		)
+		if err != nil {
+			return
+		}
+		res.Rooms.Leave[roomID] = lr
+	}
+	return
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func memberEvent(eventID, userID string) gomatrixserverlib.ClientEvent {
+	return gomatrixserverlib.ClientEvent{
+		EventID:  eventID,
+		Sender:   userID,
+		StateKey: &userID,
+		Type:     gomatrixserverlib.MRoomMember,
+	}
+}
+
+func eventIDs(events []gomatrixserverlib.ClientEvent) []string {
+	ids := make([]string, len(events))
+	for i, ev := range events {
+		ids[i] = ev.EventID
+	}
+	return ids
+}
+
+func TestLazyLoadMembers(t *testing.T) {
+	cache, err := NewLazyLoadCache()
+	if err != nil {
+		t.Fatalf("NewLazyLoadCache failed: %s", err)
+	}
+	device := &authtypes.Device{UserID: alice, ID: "ALICEDEVICE"}
+	emptyStateKey := ""
+	state := []gomatrixserverlib.ClientEvent{
+		{EventID: "$create", Sender: alice, StateKey: &emptyStateKey, Type: gomatrixserverlib.MRoomCreate},
+		memberEvent("$alicejoin", alice),
+		memberEvent("$bobjoin", bob),
+	}
+	timeline := []gomatrixserverlib.ClientEvent{
+		{EventID: "$message", Sender: alice, Type: "m.room.message"},
+	}
+
+	tests := []struct {
+		name             string
+		includeRedundant bool
+		want             []string
+	}{
+		// Bob's member event is left out as he didn't send anything.
+		{"first sync", false, []string{"$create", "$alicejoin"}},
+		// Alice's member event has already been sent to the device.
+		{"second sync", false, []string{"$create"}},
+		{"redundant members", true, []string{"$create", "$alicejoin"}},
+	}
+	for _, tt := range tests {
+		// The database isn't needed as the state has the senders' member events.
+		got, err := cache.LazyLoadMembers(
+			context.Background(), nil, device, roomID, state, timeline,
+			tt.includeRedundant, gomatrixserverlib.FormatSync,
+		)
+		if err != nil {
+			t.Fatalf("%s: LazyLoadMembers failed: %s", tt.name, err)
+		}
+		if ids := eventIDs(got); !equalStrings(ids, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+
+	cache.Reset(device)
+	got, err := cache.LazyLoadMembers(
+		context.Background(), nil, device, roomID, state, timeline, false, gomatrixserverlib.FormatSync,
+	)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	if ids, want := eventIDs(got), []string{"$create", "$alicejoin"}; !equalStrings(ids, want) {
+		t.Errorf("after reset: got %v, want %v", ids, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -16,13 +16,17 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
-
+	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,10 +42,13 @@ type syncRequest struct {
 	timeout       time.Duration
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	filter        gomatrixserverlib.Filter
 	log           *log.Entry
 }
 
-func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, error) {
+func newSyncRequest(
+	req *http.Request, device authtypes.Device, syncDB storage.Database,
+) (*syncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
@@ -54,18 +61,54 @@ func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, e
 		}
 		since = &tok
 	}
-	// TODO: Additional query params: set_presence, filter
+	filter, err := getFilter(req, device, syncDB)
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultTimelineLimit
+	if filter.Room.Timeline.Limit > 0 {
+		limit = filter.Room.Timeline.Limit
+	}
+	// TODO: Additional query params: set_presence
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         defaultTimelineLimit, // TODO: read from filter
+		filter:        filter,
+		limit:         limit,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
 
+// getFilter returns the filter given in the request, which is either the ID of
+// a filter previously uploaded by the user or a filter encoded as JSON.
+func getFilter(
+	req *http.Request, device authtypes.Device, syncDB storage.Database,
+) (gomatrixserverlib.Filter, error) {
+	filter := gomatrixserverlib.DefaultFilter()
+	filterQuery := req.URL.Query().Get("filter")
+	if filterQuery == "" {
+		return filter, nil
+	}
+	if strings.HasPrefix(filterQuery, "{") {
+		if err := json.Unmarshal([]byte(filterQuery), &filter); err != nil {
+			return filter, fmt.Errorf("invalid filter: %w", err)
+		}
+		return filter, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return filter, err
+	}
+	storedFilter, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
+	if err != nil {
+		return filter, fmt.Errorf("no such filter: %s", filterQuery)
+	}
+	return *storedFilter, nil
+}
+
 func getTimeout(timeoutMS string) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
@@ -15,12 +15,14 @@
 package sync
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	push "github.com/matrix-org/dendrite/clientapi/push/storage"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -32,12 +34,16 @@ import (
 type RequestPool struct {
 	db        storage.Database
 	accountDB accounts.Database
+	pushDB    push.Database
 	notifier  *Notifier
+	lazyLoad  *LazyLoadCache
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db storage.Database, n *Notifier, adb accounts.Database, pdb push.Database, lazyLoad *LazyLoadCache,
+) *RequestPool {
+	return &RequestPool{db, adb, pdb, n, lazyLoad}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -48,7 +54,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 	// Extract values from request
 	userID := device.UserID
-	syncReq, err := newSyncRequest(req, *device)
+	syncReq, err := newSyncRequest(req, *device, rp.db)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -70,10 +76,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 			return jsonerror.InternalServerError()
 		}
 		logger.WithField("next", syncData.NextBatch).Info("Responding immediately")
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: syncData,
-		}
+		return syncResponse(syncReq, syncData)
 	}
 
 	// Otherwise, we wait for the notifier to tell us if something *may* have
@@ -124,10 +127,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 		if !syncData.IsEmpty() || hasTimedOut {
 			logger.WithField("next", syncData.NextBatch).WithField("timed_out", hasTimedOut).Info("Responding")
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: syncData,
-			}
+			return syncResponse(syncReq, syncData)
 		}
 	}
 }
@@ -144,11 +144,58 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 		return
 	}
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
+	// The filter is applied to the account data along with everything else
+	// once it has been added to the response.
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
 	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition(), &accountDataFilter)
+	if err != nil {
+		return
+	}
+	if err = rp.appendUnreadNotifications(req.ctx, res, req.device.UserID); err != nil {
+		return
+	}
+
+	applyFilter(res, &req.filter)
+
+	stateFilter := req.filter.Room.State
+	if stateFilter.LazyLoadMembers && eventTypeAllowed(gomatrixserverlib.MRoomMember, stateFilter.Types, stateFilter.NotTypes) {
+		// The client is about to be sent the state of its rooms from scratch,
+		// so it needs to be sent the member events again too.
+		if req.since == nil || req.wantFullState {
+			rp.lazyLoad.Reset(&req.device)
+		}
+		err = rp.lazyLoad.lazyLoadResponse(
+			req.ctx, rp.db, &req.device, res, stateFilter.IncludeRedundantMembers,
+		)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+// appendUnreadNotifications adds the counts of the user's unread notifications
+// to the joined rooms in the response.
+func (rp *RequestPool) appendUnreadNotifications(
+	ctx context.Context, res *types.Response, userID string,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	counts, err := rp.pushDB.GetNotificationCounts(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	for roomID, jr := range res.Rooms.Join {
+		c := counts[roomID]
+		jr.UnreadNotifications.HighlightCount = c.HighlightCount
+		jr.UnreadNotifications.NotificationCount = c.NotificationCount
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 	accountDataFilter *gomatrixserverlib.EventFilter,
@@ -234,6 +281,26 @@ func (rp *RequestPool) appendAccountData(
 	return data, nil
 }
 
+// syncResponse returns the /sync response, with only the fields of the events
+// which the client asked for.
+func syncResponse(syncReq *syncRequest, syncData *types.Response) util.JSONResponse {
+	if len(syncReq.filter.EventFields) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: syncData,
+		}
+	}
+	filtered, err := filterEventFields(syncData, syncReq.filter.EventFields)
+	if err != nil {
+		syncReq.log.WithError(err).Error("filterEventFields failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: filtered,
+	}
+}
+
 // shouldReturnImmediately returns whether the /sync request is an initial sync,
 // or timeout=0, or full_state=true, in any of the cases the request should
 // return immediately.
@@ -42,10 +42,20 @@ func SetupSyncAPIComponent(
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.Dendrite,
 ) {
-	syncDB, err := storage.NewSyncServerDatasource(string(base.Cfg.Database.SyncAPI), base.Cfg.DbProperties())
+	syncDB, err := storage.NewSyncServerDatasource(string(base.Cfg.Database.SyncAPI), base.Cfg.DbPropertiesFor("sync_api"))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to sync db")
 	}
+	if replica := base.Cfg.Database.ReadReplicas.SyncAPI; replica != "" {
+		syncDB, err = storage.WithReadReplica(syncDB, string(replica), base.Cfg.DbPropertiesFor("sync_api"))
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to sync read replica")
+		}
+	}
+
+	if err = moveLegacyFilters(context.Background(), accountsDB, syncDB); err != nil {
+		logrus.WithError(err).Panicf("failed to move filters to sync db")
+	}
 
 	pos, err := syncDB.SyncPosition(context.Background())
 	if err != nil {
@@ -58,7 +68,12 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB)
+	lazyLoad, err := sync.NewLazyLoadCache()
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to create lazy-loading cache")
+	}
+
+	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB, base.CreatePushDB(), lazyLoad)
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, notifier, syncDB, rsAPI,
@@ -67,6 +82,13 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start room server consumer")
 	}
 
+	searchConsumer := consumers.NewOutputRoomEventSearchConsumer(
+		base.Cfg, base.KafkaConsumer, syncDB,
+	)
+	if err = searchConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start search index consumer")
+	}
+
 	clientConsumer := consumers.NewOutputClientDataConsumer(
 		base.Cfg, base.KafkaConsumer, notifier, syncDB,
 	)
@@ -81,5 +103,25 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start typing server consumer")
 	}
 
-	routing.Setup(base.APIMux, requestPool, syncDB, deviceDB, federation, rsAPI, cfg)
+	routing.Setup(base.APIMux, requestPool, lazyLoad, syncDB, deviceDB, federation, rsAPI, cfg)
+}
+
+// moveLegacyFilters copies the filters which were stored in the accounts
+// database, before filters were moved to the sync API database, keeping their
+// IDs so that clients can still refer to them. They are then removed from the
+// accounts database so that this only happens once.
+func moveLegacyFilters(ctx context.Context, accountsDB accounts.Database, syncDB storage.Database) error {
+	filters, err := accountsDB.GetLegacyFilters(ctx)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err = syncDB.ImportFilter(ctx, filter.Localpart, filter.ID, filter.Filter); err != nil {
+			return err
+		}
+	}
+	if len(filters) > 0 {
+		logrus.WithField("filters", len(filters)).Info("Moved filters from the accounts database to the sync API database")
+	}
+	return accountsDB.RemoveLegacyFilters(ctx)
 }
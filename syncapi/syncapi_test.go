@@ -0,0 +1,132 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// mustExec runs the statements against the database directly, bypassing the
+// storage packages.
+func mustExec(t *testing.T, dataSource string, statements ...string) {
+	uri, err := url.Parse(dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db *sql.DB
+	switch uri.Scheme {
+	case "file":
+		db, err = sqlutil.Open(common.SQLiteDriverName(), dataSource, nil)
+	case "mysql":
+		var dsn string
+		if dsn, err = sqlutil.ParseMySQLDataSourceName(dataSource); err == nil {
+			db, err = sqlutil.Open(sqlutil.MySQLDriverName, dsn, nil)
+		}
+	default:
+		db, err = sqlutil.Open("postgres", dataSource, nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("%q returned %s", statement, err)
+		}
+	}
+}
+
+func TestMoveLegacyFilters(t *testing.T) {
+	ctx := context.Background()
+	accountsDataSource, closeAccountsDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the accounts database: %s", err)
+	}
+	defer closeAccountsDB()
+	syncDataSource, closeSyncDB, err := test.NewDatabase()
+	if err != nil {
+		t.Fatalf("failed to create the sync database: %s", err)
+	}
+	defer closeSyncDB()
+
+	accountsDB, err := accounts.NewDatabase(accountsDataSource, nil, "hollow.knight")
+	if err != nil {
+		t.Fatalf("accounts.NewDatabase returned %s", err)
+	}
+	syncDB, err := storage.NewSyncServerDatasource(syncDataSource, nil)
+	if err != nil {
+		t.Fatalf("storage.NewSyncServerDatasource returned %s", err)
+	}
+
+	// Nothing happens for a database created after filters were moved.
+	if err = moveLegacyFilters(ctx, accountsDB, syncDB); err != nil {
+		t.Fatalf("moveLegacyFilters returned %s", err)
+	}
+
+	mustExec(t, accountsDataSource,
+		"CREATE TABLE account_filter (filter TEXT NOT NULL, id BIGINT NOT NULL, localpart VARCHAR(255) NOT NULL)",
+		`INSERT INTO account_filter (filter, id, localpart) VALUES ('{"room":{"timeline":{"limit":5}}}', 3, 'hornet')`,
+		`INSERT INTO account_filter (filter, id, localpart) VALUES ('{"room":{"timeline":{"limit":7}}}', 8, 'quirrel')`,
+	)
+	if err = moveLegacyFilters(ctx, accountsDB, syncDB); err != nil {
+		t.Fatalf("moveLegacyFilters returned %s", err)
+	}
+
+	// The filters keep their IDs.
+	for _, want := range []struct {
+		localpart, filterID string
+		limit               int
+	}{{"hornet", "3", 5}, {"quirrel", "8", 7}} {
+		filter, err := syncDB.GetFilter(ctx, want.localpart, want.filterID)
+		if err != nil {
+			t.Fatalf("GetFilter(%s, %s) returned %s", want.localpart, want.filterID, err)
+		}
+		if filter.Room.Timeline.Limit != want.limit {
+			t.Errorf("filter %s: expected a timeline limit of %d, got %d", want.filterID, want.limit, filter.Room.Timeline.Limit)
+		}
+	}
+	if _, err = syncDB.GetFilter(ctx, "hornet", "8"); err != sql.ErrNoRows {
+		t.Errorf("expected another user's filter not to be found, got %v", err)
+	}
+
+	// New filters don't reuse the moved IDs.
+	filter := gomatrixserverlib.DefaultFilter()
+	filterID, err := syncDB.PutFilter(ctx, "hornet", &filter)
+	if err != nil {
+		t.Fatalf("PutFilter returned %s", err)
+	}
+	if filterID != "9" {
+		t.Errorf("expected the new filter to have ID 9, got %s", filterID)
+	}
+
+	// The filters are only moved once.
+	filters, err := accountsDB.GetLegacyFilters(ctx)
+	if err != nil {
+		t.Fatalf("GetLegacyFilters returned %s", err)
+	}
+	if len(filters) != 0 {
+		t.Errorf("expected the moved filters to be removed, got %d", len(filters))
+	}
+}
@@ -345,6 +345,10 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications struct {
+		HighlightCount    int `json:"highlight_count"`
+		NotificationCount int `json:"notification_count"`
+	} `json:"unread_notifications"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -393,3 +397,11 @@ func NewLeaveResponse() *LeaveResponse {
 	res.Timeline.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	return &res
 }
+
+// SearchResult is an event which matched a full-text search.
+type SearchResult struct {
+	EventID string
+	// Rank is how well the event matched the search, higher being better.
+	Rank  float64
+	Event gomatrixserverlib.HeaderedEvent
+}